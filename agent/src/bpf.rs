@@ -10,7 +10,7 @@ use agent_skel::{
 use anyhow::{Context, Result, anyhow};
 use bytemuck::{Pod, Zeroable};
 use libbpf_rs::{
-    Link, MapCore, MapFlags,
+    Link, MapCore, MapFlags, MapHandle,
     skel::{OpenSkel, SkelBuilder},
 };
 use nix::time::{ClockId, clock_gettime};
@@ -41,6 +41,15 @@ impl<'a> Bpf<'a> {
             fs::create_dir_all(BPF_FS_PATH).context("Failed to create BPF FS directory")?;
         }
 
+        // A map pinned by an older agent with a different value layout cannot be reused.
+        let stale_pin = MapHandle::from_pinned_path(MAP_PIN_PATH)
+            .map(|pinned| pinned.value_size() as usize != std::mem::size_of::<session_val>())
+            .unwrap_or(false);
+        if stale_pin {
+            warn!("Pinned session map has an old layout, dropping its rules");
+            fs::remove_file(MAP_PIN_PATH).context("Failed to remove old session map pin")?;
+        }
+
         let skel_builder = AegisSkelBuilder::default();
 
         // Open the BPF skeleton with static lifetime
@@ -86,8 +95,15 @@ impl<'a> Bpf<'a> {
         Ok(Self { skel, _link: link })
     }
 
-    /// Adds a firewall rule to allow traffic for a specific session.
-    pub fn add_rule(&self, dest_ip: u32, src_ip: u32, dest_port: u16) -> Result<()> {
+    /// Adds a firewall rule to allow traffic for a specific session. A non-zero timeout_ns
+    /// reaps the rule sooner than the configured rule timeout.
+    pub fn add_rule(
+        &self,
+        dest_ip: u32,
+        src_ip: u32,
+        dest_port: u16,
+        timeout_ns: u64,
+    ) -> Result<()> {
         let now = Self::get_ktime_ns();
 
         let key = session_key {
@@ -98,6 +114,7 @@ impl<'a> Bpf<'a> {
         let val = session_val {
             created_at_ns: now,
             last_seen_ns: now,
+            timeout_ns,
         };
 
         self.skel.maps.session.update(
@@ -303,7 +320,7 @@ impl<'a> Bpf<'a> {
                     }
 
                     let val: &session_val = bytemuck::from_bytes(&val_bytes);
-                    now.saturating_sub(val.last_seen_ns) > timeout_ns
+                    now.saturating_sub(val.last_seen_ns) > Self::rule_timeout(val, timeout_ns)
                 } else {
                     false
                 }
@@ -385,7 +402,7 @@ impl<'a> Bpf<'a> {
                     let key: &session_key = bytemuck::from_bytes(&key_bytes);
                     let val: &session_val = bytemuck::from_bytes(&val_bytes);
                     let elapsed = now.saturating_sub(val.last_seen_ns);
-                    let time_left_ns = timeout_ns.saturating_sub(elapsed);
+                    let time_left_ns = Self::rule_timeout(val, timeout_ns).saturating_sub(elapsed);
                     let time_left_sec = (time_left_ns / 1_000_000_000) as i32;
 
                     Some((key.src_ip, key.dest_ip, key.dest_port, time_left_sec))
@@ -397,6 +414,15 @@ impl<'a> Bpf<'a> {
         Ok(sessions)
     }
 
+    /// Returns the idle timeout of a rule: its own, if shorter than the configured default_ns.
+    fn rule_timeout(val: &session_val, default_ns: u64) -> u64 {
+        if val.timeout_ns > 0 {
+            val.timeout_ns.min(default_ns)
+        } else {
+            default_ns
+        }
+    }
+
     /// Returns the current kernel monotonic time in nanoseconds.
     /// Uses a fallback value if the system call fails to prevent panic.
     fn get_ktime_ns() -> u64 {
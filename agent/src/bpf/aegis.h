@@ -18,6 +18,7 @@ typedef struct session_key {
 typedef struct session_val {
   __u64 last_seen_ns;  // Timestamp of the last valid packet (System uptime)
   __u64 created_at_ns; // Timestamp when the session was authorized
+  __u64 timeout_ns;    // Idle timeout of this rule; 0 for rule_timeout_ns
 } session_val;
 
 #endif // AEGIS_H
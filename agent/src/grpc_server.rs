@@ -3,6 +3,7 @@
 //! Implements the SessionManager service for the controller to:
 //! - Submit session authentication events
 //! - Monitor active sessions
+//! - Resync the agent's state after either side restarts
 
 // Include the generated protobuf code
 pub mod session {
@@ -11,13 +12,16 @@ pub mod session {
 
 use anyhow::{Context, Result, anyhow};
 use session::{
-    Ack, Empty, IpChangeList, LoginEvent, SessionList,
+    Ack, Empty, IpChangeList, LoginEvent, ServiceSnapshot, SessionList,
     session_manager_server::{SessionManager, SessionManagerServer},
 };
 use std::{
     fs,
     net::{Ipv4Addr, SocketAddr},
-    sync::Arc,
+    sync::{
+        Arc,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
 };
 use tokio::sync::{Mutex, broadcast};
 use tonic::{
@@ -28,8 +32,13 @@ use tracing::{debug, error, info, warn};
 
 use crate::config::Config;
 
-/// Callback function type for adding/removing firewall rules
-type ModifyRulesFn = Arc<Mutex<dyn Fn(bool, u32, u32, u16) -> Result<()> + Send + Sync>>;
+/// Most rules a single session may cover, counting every port at every address of its network; the
+/// controller enforces the same limit on services.
+const MAX_PORT_RANGE_PORTS: u32 = 256;
+
+/// Callback function type for adding/removing firewall rules; the last argument is the rule's idle
+/// timeout in nanoseconds, 0 for the configured rule timeout
+type ModifyRulesFn = Arc<Mutex<dyn Fn(bool, u32, u32, u16, u64) -> Result<()> + Send + Sync>>;
 
 /// Callback function type for updating destination IPs
 type UpdateIpFn = Arc<Mutex<dyn Fn(u32, u32) -> Result<usize> + Send + Sync>>;
@@ -81,6 +90,10 @@ pub struct SessionManagerService {
     modify_rules: ModifyRulesFn,
     update_ip: UpdateIpFn,
     monitor_tx: broadcast::Sender<Result<SessionList, Status>>,
+    /// Sequence number of the last IP change batch applied, 0 before the first one
+    last_ip_sequence: AtomicU64,
+    /// Set while the agent needs a snapshot from the controller, which it asks for in every session list
+    resync_needed: Arc<AtomicBool>,
 }
 
 impl SessionManagerService {
@@ -93,15 +106,15 @@ impl SessionManagerService {
             modify_rules,
             update_ip,
             monitor_tx,
+            last_ip_sequence: AtomicU64::new(0),
+            // A starting agent has lost whatever state it held before
+            resync_needed: Arc::new(AtomicBool::new(true)),
         }
     }
-}
-
-#[tonic::async_trait]
-impl SessionManager for SessionManagerService {
-    async fn submit_session(&self, request: Request<LoginEvent>) -> Result<Response<Ack>, Status> {
-        let event = request.into_inner();
 
+    /// Adds or removes the rules of a session, one per address and port it covers. Returns whether
+    /// every rule was modified, or an error for an event describing no valid destination.
+    async fn apply_session(&self, event: &LoginEvent) -> Result<bool, Status> {
         // Validate port range to prevent overflow
         if event.dst_port > u16::MAX as u32 {
             warn!("Invalid destination port: {}", event.dst_port);
@@ -110,26 +123,96 @@ impl SessionManager for SessionManagerService {
 
         let dst_port = event.dst_port as u16;
 
+        // A range covers every port from dst_port to dst_port_end, one rule per port
+        let dst_port_end = if event.dst_port_end == 0 {
+            dst_port
+        } else if event.dst_port_end < event.dst_port
+            || event.dst_port_end - event.dst_port >= MAX_PORT_RANGE_PORTS
+        {
+            warn!(
+                "Invalid destination port range: {}-{}",
+                event.dst_port, event.dst_port_end
+            );
+            return Err(Status::invalid_argument("Destination port range invalid"));
+        } else {
+            event.dst_port_end as u16
+        };
+
+        // A network covers every address of dst_ip/dst_prefix_len, one rule per address and port
+        let dst_addresses: u64 = if event.dst_prefix_len == 0 {
+            1
+        } else if event.dst_prefix_len > 32 {
+            warn!(
+                "Invalid destination prefix length: {}",
+                event.dst_prefix_len
+            );
+            return Err(Status::invalid_argument("Destination network invalid"));
+        } else {
+            let host_mask = u32::MAX.checked_shr(event.dst_prefix_len).unwrap_or(0);
+            if event.dst_ip & host_mask != 0 {
+                warn!(
+                    "Destination network {}/{} has host bits set",
+                    Ipv4Addr::from(event.dst_ip),
+                    event.dst_prefix_len
+                );
+                return Err(Status::invalid_argument("Destination network invalid"));
+            }
+            host_mask as u64 + 1
+        };
+        let rules = dst_addresses * ((dst_port_end - dst_port) as u64 + 1);
+        if rules > MAX_PORT_RANGE_PORTS as u64 {
+            warn!(
+                "Destination network {}/{} with ports {}-{} needs {} rules",
+                Ipv4Addr::from(event.dst_ip),
+                event.dst_prefix_len,
+                dst_port,
+                dst_port_end,
+                rules
+            );
+            return Err(Status::invalid_argument("Destination network too large"));
+        }
+
         debug!(
-            "Session request (activate={}): {} → {}:{}",
-            event.activate, event.src_ip, event.dst_ip, dst_port
+            "Session request (activate={}): {} → {}/{}:{}-{}",
+            event.activate,
+            event.src_ip,
+            event.dst_ip,
+            event.dst_prefix_len,
+            dst_port,
+            dst_port_end
         );
 
-        // Add or remove session rule
+        // Add or remove session rules
+        let timeout_ns = event.ttl_seconds as u64 * 1_000_000_000;
         let add_rule = self.modify_rules.lock().await;
-        let success = match add_rule(event.activate, event.dst_ip, event.src_ip, dst_port) {
-            Ok(_) => {
-                debug!(
-                    "Session modified (is_active: {}): {} → {}:{}",
-                    event.activate, event.src_ip, event.dst_ip, dst_port
-                );
-                true
-            }
-            Err(e) => {
-                error!("Failed to modify session: {}", e);
-                false
+        let mut success = true;
+        for offset in 0..dst_addresses as u32 {
+            let dst_ip = event.dst_ip + offset;
+            for port in dst_port..=dst_port_end {
+                match add_rule(event.activate, dst_ip, event.src_ip, port, timeout_ns) {
+                    Ok(_) => {
+                        debug!(
+                            "Session modified (is_active: {}): {} → {}:{}",
+                            event.activate, event.src_ip, dst_ip, port
+                        );
+                    }
+                    Err(e) => {
+                        error!("Failed to modify session on {}:{}: {}", dst_ip, port, e);
+                        success = false;
+                    }
+                }
             }
-        };
+        }
+
+        Ok(success)
+    }
+}
+
+#[tonic::async_trait]
+impl SessionManager for SessionManagerService {
+    async fn submit_session(&self, request: Request<LoginEvent>) -> Result<Response<Ack>, Status> {
+        let event = request.into_inner();
+        let success = self.apply_session(&event).await?;
 
         let reply = Ack { success };
         Ok(Response::new(reply))
@@ -145,11 +228,15 @@ impl SessionManager for SessionManagerService {
         debug!("Starting session monitoring stream");
 
         let mut broadcast_rx = self.monitor_tx.subscribe();
+        let resync_needed = self.resync_needed.clone();
         let (tx, rx) = tokio::sync::mpsc::channel(4);
         tokio::spawn(async move {
             loop {
                 match broadcast_rx.recv().await {
-                    Ok(msg) => {
+                    Ok(mut msg) => {
+                        if let Ok(list) = &mut msg {
+                            list.resync_requested = resync_needed.load(Ordering::SeqCst);
+                        }
                         if tx.send(msg).await.is_err() {
                             break;
                         }
@@ -172,7 +259,38 @@ impl SessionManager for SessionManagerService {
     async fn ip_change(&self, request: Request<IpChangeList>) -> Result<Response<Ack>, Status> {
         let ip_changes = request.into_inner();
 
-        debug!("Received {} IP change events", ip_changes.ip_changes.len());
+        debug!(
+            "Received {} IP change events (batch {})",
+            ip_changes.ip_changes.len(),
+            ip_changes.sequence
+        );
+
+        // Batches are numbered from 1 by each controller run; 0 comes from controllers that do not
+        // number them. Older batches and repeats are acknowledged without applying them again.
+        if ip_changes.sequence != 0 {
+            let last = self.last_ip_sequence.load(Ordering::SeqCst);
+            if ip_changes.sequence == 1 && last != 0 {
+                info!(
+                    "Controller restarted IP change numbering after batch {}",
+                    last
+                );
+            } else if ip_changes.sequence <= last {
+                warn!(
+                    "Ignoring IP change batch {} received after batch {}",
+                    ip_changes.sequence, last
+                );
+                return Ok(Response::new(Ack { success: true }));
+            } else if ip_changes.sequence > last + 1 && last != 0 {
+                warn!(
+                    "Missed IP change batches {}-{}, requesting a resync",
+                    last + 1,
+                    ip_changes.sequence - 1
+                );
+                self.resync_needed.store(true, Ordering::SeqCst);
+            }
+            self.last_ip_sequence
+                .store(ip_changes.sequence, Ordering::SeqCst);
+        }
 
         let mut total_updated = 0;
         let mut has_errors = false;
@@ -216,6 +334,58 @@ impl SessionManager for SessionManagerService {
         };
         Ok(Response::new(reply))
     }
+
+    async fn resync(&self, request: Request<ServiceSnapshot>) -> Result<Response<Ack>, Status> {
+        let snapshot = request.into_inner();
+
+        info!(
+            "Received snapshot of {} active services and {} sessions as of IP change batch {}",
+            snapshot.services.len(),
+            snapshot.sessions.len(),
+            snapshot.sequence
+        );
+        for target in &snapshot.services {
+            debug!(
+                "Active service: {}/{}:{}-{}",
+                Ipv4Addr::from(target.ip),
+                if target.prefix_len == 0 {
+                    32
+                } else {
+                    target.prefix_len
+                },
+                target.port,
+                target.port_end.max(target.port)
+            );
+        }
+
+        // Reinstall every session; rules the agent still holds are refreshed
+        let mut failed = 0;
+        for event in &snapshot.sessions {
+            let event = LoginEvent {
+                activate: true,
+                ..event.clone()
+            };
+            if !matches!(self.apply_session(&event).await, Ok(true)) {
+                failed += 1;
+            }
+        }
+        if failed > 0 {
+            // The resync stays requested, so the controller sends another snapshot
+            error!(
+                "Failed to reinstall {} of {} sessions from the snapshot",
+                failed,
+                snapshot.sessions.len()
+            );
+            return Err(Status::internal("Failed to reinstall sessions"));
+        }
+
+        // The snapshot includes every batch up to its sequence number; later batches apply on top
+        self.last_ip_sequence
+            .store(snapshot.sequence, Ordering::SeqCst);
+        self.resync_needed.store(false, Ordering::SeqCst);
+
+        Ok(Response::new(Ack { success: true }))
+    }
 }
 
 /// Starts the gRPC server with mTLS authentication.
@@ -307,18 +477,161 @@ mod tests {
 
     #[test]
     fn test_service_creation() {
-        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _| Ok(())));
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
         let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
         let (tx, _) = broadcast::channel(4);
 
         let _service = SessionManagerService::new(modify_rules, update_ip, tx);
     }
 
+    #[tokio::test]
+    async fn test_submit_session_port_range() {
+        let ports = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let ports_clone = ports.clone();
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(
+            move |activate: bool, _dst_ip: u32, _src_ip: u32, port: u16, _timeout_ns: u64| {
+                assert!(activate);
+                ports_clone.lock().unwrap().push(port);
+                Ok(())
+            },
+        ));
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        let event = |dst_port: u32, dst_port_end: u32| {
+            Request::new(LoginEvent {
+                src_ip: 0x0A000001,
+                dst_ip: 0x0A000002,
+                dst_port,
+                activate: true,
+                dst_port_end,
+                ..Default::default()
+            })
+        };
+
+        let response = service.submit_session(event(10000, 10003)).await.unwrap();
+        assert!(response.into_inner().success);
+        assert_eq!(*ports.lock().unwrap(), vec![10000, 10001, 10002, 10003]);
+
+        // A zero end is a single port
+        ports.lock().unwrap().clear();
+        service.submit_session(event(80, 0)).await.unwrap();
+        assert_eq!(*ports.lock().unwrap(), vec![80]);
+
+        // Backwards and oversized ranges are rejected without touching any rule
+        ports.lock().unwrap().clear();
+        let backwards = service.submit_session(event(10000, 9999)).await;
+        assert_eq!(backwards.unwrap_err().code(), tonic::Code::InvalidArgument);
+        let oversized = service
+            .submit_session(event(10000, 10000 + MAX_PORT_RANGE_PORTS))
+            .await;
+        assert_eq!(oversized.unwrap_err().code(), tonic::Code::InvalidArgument);
+        assert!(ports.lock().unwrap().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_submit_session_ttl() {
+        let timeouts = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let timeouts_clone = timeouts.clone();
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(
+            move |_activate: bool, _dst_ip: u32, _src_ip: u32, _port: u16, timeout_ns: u64| {
+                timeouts_clone.lock().unwrap().push(timeout_ns);
+                Ok(())
+            },
+        ));
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        let event = |ttl_seconds: u32| {
+            Request::new(LoginEvent {
+                src_ip: 0x0A000001,
+                dst_ip: 0x0A000002,
+                dst_port: 22,
+                activate: true,
+                ttl_seconds,
+                ..Default::default()
+            })
+        };
+
+        // A role's limit reaches the rule; without one the configured timeout applies
+        service.submit_session(event(30)).await.unwrap();
+        service.submit_session(event(0)).await.unwrap();
+        assert_eq!(*timeouts.lock().unwrap(), vec![30_000_000_000, 0]);
+    }
+
+    #[tokio::test]
+    async fn test_submit_session_network() {
+        let rules = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let rules_clone = rules.clone();
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(
+            move |_activate: bool, dst_ip: u32, _src_ip: u32, port: u16, _timeout_ns: u64| {
+                rules_clone.lock().unwrap().push((dst_ip, port));
+                Ok(())
+            },
+        ));
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        let event = |dst_ip: u32, dst_prefix_len: u32, dst_port_end: u32| {
+            Request::new(LoginEvent {
+                src_ip: 0x0A000001,
+                dst_ip,
+                dst_port: 443,
+                activate: true,
+                dst_port_end,
+                dst_prefix_len,
+                ..Default::default()
+            })
+        };
+
+        // Every address of the network gets a rule for every port
+        let response = service
+            .submit_session(event(0x0A140000, 31, 444))
+            .await
+            .unwrap();
+        assert!(response.into_inner().success);
+        assert_eq!(
+            *rules.lock().unwrap(),
+            vec![
+                (0x0A140000, 443),
+                (0x0A140000, 444),
+                (0x0A140001, 443),
+                (0x0A140001, 444)
+            ]
+        );
+
+        // A /32 is the address alone
+        rules.lock().unwrap().clear();
+        service
+            .submit_session(event(0x0A140005, 32, 0))
+            .await
+            .unwrap();
+        assert_eq!(*rules.lock().unwrap(), vec![(0x0A140005, 443)]);
+
+        // Host bits, impossible prefixes and networks over the rule limit are rejected
+        rules.lock().unwrap().clear();
+        for (dst_ip, dst_prefix_len, dst_port_end) in [
+            (0x0A140001, 24, 0),
+            (0x0A140000, 33, 0),
+            (0x0A140000, 23, 0),
+            (0x0A140000, 24, 444),
+        ] {
+            let result = service
+                .submit_session(event(dst_ip, dst_prefix_len, dst_port_end))
+                .await;
+            assert_eq!(result.unwrap_err().code(), tonic::Code::InvalidArgument);
+        }
+        assert!(rules.lock().unwrap().is_empty());
+    }
+
     #[tokio::test]
     async fn test_ip_change_success() {
         use std::sync::atomic::{AtomicBool, Ordering};
 
-        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _| Ok(())));
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
 
         let called = Arc::new(AtomicBool::new(false));
         let called_clone = called.clone();
@@ -339,6 +652,7 @@ mod tests {
                 old_ip: 0x0A000001,
                 new_ip: 0x0A000002,
             }],
+            ..Default::default()
         });
 
         let remote_addr = SocketAddr::new(IpAddr::V4(Ipv4Addr::new(10, 0, 0, 1)), 1234);
@@ -354,7 +668,7 @@ mod tests {
 
     #[tokio::test]
     async fn test_ip_change_multiple_events() {
-        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _| Ok(())));
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
 
         let call_count = Arc::new(std::sync::Mutex::new(0));
         let call_count_clone = call_count.clone();
@@ -382,6 +696,7 @@ mod tests {
                     new_ip: 0x0A000006,
                 },
             ],
+            ..Default::default()
         });
 
         let remote_addr = SocketAddr::new(IpAddr::V4(Ipv4Addr::new(10, 0, 0, 1)), 1234);
@@ -397,7 +712,7 @@ mod tests {
 
     #[tokio::test]
     async fn test_ip_change_with_errors() {
-        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _| Ok(())));
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
         let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_old_ip: u32, _new_ip: u32| {
             Err(anyhow!("BPF update failed"))
         }));
@@ -410,6 +725,7 @@ mod tests {
                 old_ip: 0x0A000001,
                 new_ip: 0x0A000002,
             }],
+            ..Default::default()
         });
 
         let remote_addr = SocketAddr::new(IpAddr::V4(Ipv4Addr::new(10, 0, 0, 1)), 1234);
@@ -424,13 +740,13 @@ mod tests {
 
     #[tokio::test]
     async fn test_ip_change_empty_list() {
-        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _| Ok(())));
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
         let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
 
         let (tx, _) = broadcast::channel(4);
         let service = SessionManagerService::new(modify_rules, update_ip, tx);
 
-        let mut request = Request::new(IpChangeList { ip_changes: vec![] });
+        let mut request = Request::new(IpChangeList::default());
 
         let remote_addr = SocketAddr::new(IpAddr::V4(Ipv4Addr::new(10, 0, 0, 1)), 1234);
         request.extensions_mut().insert(remote_addr);
@@ -441,4 +757,167 @@ mod tests {
         let response = result.unwrap();
         assert!(response.into_inner().success);
     }
+
+    #[tokio::test]
+    async fn test_ip_change_skips_stale_batches() {
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
+
+        let applied = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let applied_clone = applied.clone();
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(move |old_ip: u32, _new_ip: u32| {
+            applied_clone.lock().unwrap().push(old_ip);
+            Ok(1)
+        }));
+
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        let batch = |sequence: u64, old_ip: u32| {
+            Request::new(IpChangeList {
+                ip_changes: vec![session::IpChangeEvent {
+                    old_ip,
+                    new_ip: old_ip + 1,
+                }],
+                sequence,
+            })
+        };
+
+        // 1 and 3 are applied despite the gap, the late 2 and the repeated 3 are not, and 1 again
+        // starts over after a controller restart
+        for (sequence, old_ip) in [(1, 10), (3, 30), (2, 20), (3, 31), (1, 11)] {
+            let result = service.ip_change(batch(sequence, old_ip)).await;
+            assert!(result.unwrap().into_inner().success);
+        }
+        assert_eq!(*applied.lock().unwrap(), vec![10, 30, 11]);
+    }
+
+    #[tokio::test]
+    async fn test_resync_clears_request() {
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(|_, _, _, _, _| Ok(())));
+
+        let applied = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let applied_clone = applied.clone();
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(move |old_ip: u32, _new_ip: u32| {
+            applied_clone.lock().unwrap().push(old_ip);
+            Ok(1)
+        }));
+
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+        assert!(service.resync_needed.load(Ordering::SeqCst));
+
+        let snapshot = Request::new(ServiceSnapshot {
+            services: vec![session::ServiceTarget {
+                ip: 0x0A000005,
+                port: 80,
+                port_end: 0,
+                ..Default::default()
+            }],
+            sequence: 4,
+            ..Default::default()
+        });
+        let result = service.resync(snapshot).await;
+        assert!(result.unwrap().into_inner().success);
+        assert!(!service.resync_needed.load(Ordering::SeqCst));
+
+        // Batch 4 is part of the snapshot, batch 5 follows it, and a gap asks for another resync
+        for (sequence, old_ip) in [(4, 40), (5, 50), (7, 70)] {
+            let request = Request::new(IpChangeList {
+                ip_changes: vec![session::IpChangeEvent {
+                    old_ip,
+                    new_ip: old_ip + 1,
+                }],
+                sequence,
+            });
+            assert!(
+                service
+                    .ip_change(request)
+                    .await
+                    .unwrap()
+                    .into_inner()
+                    .success
+            );
+        }
+        assert_eq!(*applied.lock().unwrap(), vec![50, 70]);
+        assert!(service.resync_needed.load(Ordering::SeqCst));
+    }
+
+    #[tokio::test]
+    async fn test_resync_reinstalls_sessions() {
+        let rules = Arc::new(std::sync::Mutex::new(Vec::new()));
+        let rules_clone = rules.clone();
+        let modify_rules: ModifyRulesFn = Arc::new(Mutex::new(
+            move |activate: bool, dst_ip: u32, src_ip: u32, port: u16, _timeout_ns: u64| {
+                assert!(activate);
+                rules_clone.lock().unwrap().push((src_ip, dst_ip, port));
+                Ok(())
+            },
+        ));
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        // A restarted agent holds no rules until the snapshot reinstalls them
+        let snapshot = Request::new(ServiceSnapshot {
+            sessions: vec![
+                LoginEvent {
+                    src_ip: 0x0A000001,
+                    dst_ip: 0x0A000005,
+                    dst_port: 80,
+                    dst_port_end: 81,
+                    activate: true,
+                    ..Default::default()
+                },
+                LoginEvent {
+                    src_ip: 0x0A000002,
+                    dst_ip: 0x0A140000,
+                    dst_port: 22,
+                    dst_prefix_len: 31,
+                    // Sessions in a snapshot are always installed
+                    activate: false,
+                    ..Default::default()
+                },
+            ],
+            sequence: 2,
+            ..Default::default()
+        });
+        let result = service.resync(snapshot).await;
+        assert!(result.unwrap().into_inner().success);
+        assert_eq!(
+            *rules.lock().unwrap(),
+            vec![
+                (0x0A000001, 0x0A000005, 80),
+                (0x0A000001, 0x0A000005, 81),
+                (0x0A000002, 0x0A140000, 22),
+                (0x0A000002, 0x0A140001, 22)
+            ]
+        );
+        assert!(!service.resync_needed.load(Ordering::SeqCst));
+        assert_eq!(service.last_ip_sequence.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_resync_failure_keeps_request() {
+        let modify_rules: ModifyRulesFn =
+            Arc::new(Mutex::new(|_, _, _, _, _| Err(anyhow!("BPF map full"))));
+        let update_ip: UpdateIpFn = Arc::new(Mutex::new(|_, _| Ok(0)));
+        let (tx, _) = broadcast::channel(4);
+        let service = SessionManagerService::new(modify_rules, update_ip, tx);
+
+        let snapshot = Request::new(ServiceSnapshot {
+            sessions: vec![LoginEvent {
+                src_ip: 0x0A000001,
+                dst_ip: 0x0A000005,
+                dst_port: 80,
+                activate: true,
+                ..Default::default()
+            }],
+            sequence: 3,
+            ..Default::default()
+        });
+        let result = service.resync(snapshot).await;
+        assert_eq!(result.unwrap_err().code(), tonic::Code::Internal);
+        assert!(service.resync_needed.load(Ordering::SeqCst));
+        assert_eq!(service.last_ip_sequence.load(Ordering::SeqCst), 0);
+    }
 }
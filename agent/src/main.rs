@@ -104,8 +104,10 @@ async fn main() -> Result<()> {
                                 })
                                 .collect();
 
+                            // The gRPC server fills in whether a resync is needed
                             let session_list = SessionList {
                                 sessions: proto_sessions,
+                                ..Default::default()
                             };
 
                             let _ = monitor_tx_loop.send(Ok(session_list));
@@ -129,13 +131,23 @@ async fn main() -> Result<()> {
 
     let bpf_grpc = bpf.clone();
     let modify_rule_handler = Arc::new(Mutex::new(
-        move |is_add: bool, dest_ip: u32, src_ip: u32, dest_port: u16| -> Result<()> {
+        move |is_add: bool,
+              dest_ip: u32,
+              src_ip: u32,
+              dest_port: u16,
+              timeout_ns: u64|
+              -> Result<()> {
             let bpf = bpf_grpc
                 .lock()
                 .map_err(|_| anyhow::anyhow!("BPF mutex poisoned"))?;
 
             if is_add {
-                bpf.add_rule(dest_ip.to_be(), src_ip.to_be(), dest_port.to_be())
+                bpf.add_rule(
+                    dest_ip.to_be(),
+                    src_ip.to_be(),
+                    dest_port.to_be(),
+                    timeout_ns,
+                )
             } else {
                 bpf.remove_rule(dest_ip.to_be(), src_ip.to_be(), dest_port.to_be())
             }
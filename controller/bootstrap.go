@@ -0,0 +1,154 @@
+package main
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// defaultRootUsername is the root account --bootstrap creates unless --username is given.
+const defaultRootUsername = "root"
+
+// bootstrapOptions controls the --bootstrap first-run mode.
+type bootstrapOptions struct {
+	Username string
+	Password string
+	Force    bool
+}
+
+// runBootstrap creates the database under dir if needed and creates or resets a root account.
+// On an existing database it refuses to run while a root user exists unless opts.Force is set.
+// If opts.Password is empty the password is read twice from in.
+func runBootstrap(dir string, opts bootstrapOptions, in io.Reader, out io.Writer) (err error) {
+	created, err := repository.CreateDB(dir)
+	if err != nil {
+		return err
+	}
+
+	db := repository.InitDB(dir, 1, 1, time.Hour)
+	defer func() {
+		_ = db.Close()
+		repository.DB = nil
+		// Never leave a fresh database behind with only the seeded placeholder account.
+		if err != nil && created {
+			_ = repository.RemoveDB(dir)
+		}
+	}()
+
+	userRepo, err := repository.NewUserRepository(db)
+	if err != nil {
+		return fmt.Errorf("failed to create user repository: %w", err)
+	}
+	roleRepo, err := repository.NewRoleRepository(db)
+	if err != nil {
+		return fmt.Errorf("failed to create role repository: %w", err)
+	}
+	userSvc := service.NewUserService(userRepo, roleRepo, "")
+
+	rootRoleID, err := roleRepo.GetIDByName(models.RootRoleName)
+	if err != nil {
+		return fmt.Errorf("root role not found: %w", err)
+	}
+	if !created && !opts.Force {
+		n, err := userRepo.CountByRole(rootRoleID)
+		if err != nil {
+			return fmt.Errorf("failed to check for root users: %w", err)
+		}
+		if n > 0 {
+			return errors.New("a root user already exists; rerun with --force to reset it")
+		}
+	}
+
+	password := opts.Password
+	if password == "" {
+		if password, err = promptPassword(in, out); err != nil {
+			return err
+		}
+	}
+
+	opts.Username = utils.NormalizeUsername(opts.Username)
+	id, err := userRepo.GetIDByUsername(opts.Username)
+	switch {
+	case err == nil:
+		if err := userSvc.ResetPassword(id, password, ""); err != nil {
+			return err
+		}
+		if err := userSvc.UpdateRole(id, rootRoleID, "", ""); err != nil {
+			return err
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		// The default root is shorter than auth.username_pattern allows, so only the password is
+		// checked the way it is for new users.
+		if opts.Username == "" {
+			return errors.New("username must not be empty")
+		}
+		if err := utils.ValidatePasswordComplexity(password); err != nil {
+			return fmt.Errorf("password too weak: %w", err)
+		}
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		if _, err := userRepo.Create(opts.Username, hash, rootRoleID); err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+	default:
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	_, _ = fmt.Fprintf(out, "Root user %q is ready.\n", opts.Username)
+	return nil
+}
+
+// promptPassword reads a password and its confirmation from in.
+func promptPassword(in io.Reader, out io.Writer) (string, error) {
+	scanner := bufio.NewScanner(in)
+	read := func(prompt string) (string, error) {
+		_, _ = fmt.Fprint(out, prompt)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", errors.New("no password provided")
+		}
+		return strings.TrimRight(scanner.Text(), "\r"), nil
+	}
+
+	password, err := read("Root password: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := read("Confirm password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// requireRootUser returns an error pointing at --bootstrap if no user has the root role, e.g. on a
+// database the controller has just created.
+func requireRootUser(userRepo repository.UserRepository, roleRepo repository.RoleRepository) error {
+	rootRoleID, err := roleRepo.GetIDByName(models.RootRoleName)
+	if err != nil {
+		return fmt.Errorf("root role not found: %w", err)
+	}
+	n, err := userRepo.CountByRole(rootRoleID)
+	if err != nil {
+		return fmt.Errorf("failed to check for root users: %w", err)
+	}
+	if n == 0 {
+		return errors.New("the database has no root user; run aegis-controller --bootstrap to create one")
+	}
+	return nil
+}
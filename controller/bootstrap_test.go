@@ -0,0 +1,143 @@
+package main
+
+import (
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openBootstrappedDB(t *testing.T, dir string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "aegis.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestBootstrapFreshDatabase(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	opts := bootstrapOptions{Username: "superuser", Password: "Str0ng!Pass"}
+
+	if err := runBootstrap(dir, opts, strings.NewReader(""), &bytes.Buffer{}); err != nil {
+		t.Fatalf("runBootstrap failed: %v", err)
+	}
+
+	db := openBootstrappedDB(t, dir)
+	var hash, role string
+	err := db.QueryRow("SELECT u.password, r.name FROM users u JOIN roles r ON u.role_id = r.id WHERE u.username = ?", "superuser").Scan(&hash, &role)
+	if err != nil {
+		t.Fatalf("bootstrapped user not found: %v", err)
+	}
+	if role != "root" {
+		t.Errorf("expected role root, got %q", role)
+	}
+	if !utils.CheckPasswordHash("Str0ng!Pass", hash) {
+		t.Error("stored hash does not match the bootstrap password")
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'root'").Scan(&n); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+	if n != 0 {
+		t.Error("expected no placeholder root user")
+	}
+}
+
+func TestBootstrapRefusesExistingRoot(t *testing.T) {
+	dir := t.TempDir()
+	opts := bootstrapOptions{Username: "superuser", Password: "Str0ng!Pass"}
+	if err := runBootstrap(dir, opts, strings.NewReader(""), &bytes.Buffer{}); err != nil {
+		t.Fatalf("first bootstrap failed: %v", err)
+	}
+
+	opts.Password = "N3w!Password"
+	err := runBootstrap(dir, opts, strings.NewReader(""), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("expected refusal mentioning --force, got %v", err)
+	}
+
+	opts.Force = true
+	if err := runBootstrap(dir, opts, strings.NewReader(""), &bytes.Buffer{}); err != nil {
+		t.Fatalf("forced bootstrap failed: %v", err)
+	}
+	var hash string
+	if err := openBootstrappedDB(t, dir).QueryRow("SELECT password FROM users WHERE username = ?", "superuser").Scan(&hash); err != nil {
+		t.Fatalf("failed to read password: %v", err)
+	}
+	if !utils.CheckPasswordHash("N3w!Password", hash) {
+		t.Error("expected --force to reset the password")
+	}
+}
+
+func TestBootstrapPromptsForPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{"Matching passwords", "Str0ng!Pass\nStr0ng!Pass\n", ""},
+		{"Mismatched passwords", "Str0ng!Pass\nOther!Pass1\n", "do not match"},
+		{"Weak password", "weak\nweak\n", "password too weak"},
+		{"No input", "", "no password provided"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := runBootstrap(dir, bootstrapOptions{Username: defaultRootUsername}, strings.NewReader(tt.input), &bytes.Buffer{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if _, statErr := os.Stat(filepath.Join(dir, "aegis.db")); !os.IsNotExist(statErr) {
+				t.Error("expected the fresh database to be removed after a failed bootstrap")
+			}
+		})
+	}
+}
+
+func TestRequireRootUser(t *testing.T) {
+	dir := t.TempDir()
+	check := func() error {
+		db := repository.InitDB(dir, 1, 1, time.Hour)
+		defer func() {
+			_ = db.Close()
+			repository.DB = nil
+		}()
+		userRepo, err := repository.NewUserRepository(db)
+		if err != nil {
+			t.Fatalf("failed to create user repository: %v", err)
+		}
+		roleRepo, err := repository.NewRoleRepository(db)
+		if err != nil {
+			t.Fatalf("failed to create role repository: %v", err)
+		}
+		return requireRootUser(userRepo, roleRepo)
+	}
+
+	// A database created by a normal start has no users to sign in with.
+	if err := check(); err == nil || !strings.Contains(err.Error(), "--bootstrap") {
+		t.Fatalf("expected an error pointing at --bootstrap, got %v", err)
+	}
+
+	if err := runBootstrap(dir, bootstrapOptions{Username: "superuser", Password: "Str0ng!Pass"}, strings.NewReader(""), &bytes.Buffer{}); err != nil {
+		t.Fatalf("runBootstrap failed: %v", err)
+	}
+	if err := check(); err != nil {
+		t.Errorf("expected the bootstrapped root user to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"Aegis/controller/config"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/proto"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// certExpiryWarning is how close to expiry a certificate must be before --check warns about it.
+	certExpiryWarning = 30 * 24 * time.Hour
+	// checkAgentTimeout bounds how long --check waits for the agent connection to become ready.
+	checkAgentTimeout = 5 * time.Second
+	// checkDBTimeout bounds how long --check waits for the database to answer.
+	checkDBTimeout = 2 * time.Second
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// checkResult is one row of the --check report.
+type checkResult struct {
+	Name   string
+	Status checkStatus
+	Detail string
+}
+
+// runCheck validates the runtime environment without starting the server or modifying any state.
+// It prints a report to out and returns the process exit code: 1 if any check failed, 0 otherwise.
+func runCheck(cfg *config.Config, cfgErr error, out io.Writer) int {
+	var results []checkResult
+	if cfgErr != nil {
+		results = append(results, checkResult{"config", checkFail, cfgErr.Error()})
+	} else {
+		results = collectChecks(cfg, proto.Probe)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+	failed := false
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		failed = failed || r.Status == checkFail
+	}
+	_ = w.Flush()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// agentProbeFunc connects to the agent and reports whether it became ready in time.
+type agentProbeFunc func(addr, certFile, keyFile, caFile, serverName string, timeout time.Duration) error
+
+// collectChecks runs every environment check against cfg.
+func collectChecks(cfg *config.Config, probe agentProbeFunc) []checkResult {
+	results := []checkResult{
+		checkConfig(cfg),
+		checkCertPair("server certificate", cfg.CertFile, cfg.KeyFile),
+		checkCertPair("agent client certificate", cfg.AgentCertFile, cfg.AgentKeyFile),
+		checkCA("agent CA", cfg.AgentCAFile),
+		checkDatabase(cfg.DBDir, cfg.DefaultUserRole, cfg.LowercaseUsernames),
+		checkAgent(cfg, "agent", cfg.AgentAddress, probe),
+	}
+	names := make([]string, 0, len(cfg.Agents))
+	for name := range cfg.Agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		results = append(results, checkAgent(cfg, "agent "+name, cfg.Agents[name], probe))
+	}
+	return append(results, checkSigningKeys(cfg))
+}
+
+func checkConfig(cfg *config.Config) checkResult {
+	if err := cfg.Validate(); err != nil {
+		return checkResult{"config", checkFail, err.Error()}
+	}
+	return checkResult{"config", checkPass, "valid"}
+}
+
+func checkCertPair(name, certFile, keyFile string) checkResult {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return checkResult{name, checkFail, err.Error()}
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return checkResult{name, checkFail, fmt.Sprintf("failed to parse %s: %v", certFile, err)}
+	}
+	return checkExpiry(name, leaf)
+}
+
+func checkCA(name, caFile string) checkResult {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return checkResult{name, checkFail, err.Error()}
+	}
+	var earliest *x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return checkResult{name, checkFail, fmt.Sprintf("failed to parse %s: %v", caFile, err)}
+		}
+		if earliest == nil || cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	if earliest == nil {
+		return checkResult{name, checkFail, fmt.Sprintf("no certificates found in %s", caFile)}
+	}
+	return checkExpiry(name, earliest)
+}
+
+// checkExpiry fails expired or not yet valid certificates and warns about ones close to expiry.
+func checkExpiry(name string, cert *x509.Certificate) checkResult {
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return checkResult{name, checkFail, fmt.Sprintf("not valid before %s", cert.NotBefore.Format(time.RFC3339))}
+	case now.After(cert.NotAfter):
+		return checkResult{name, checkFail, fmt.Sprintf("expired on %s", cert.NotAfter.Format(time.RFC3339))}
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		days := int(cert.NotAfter.Sub(now).Hours() / 24)
+		return checkResult{name, checkWarn, fmt.Sprintf("expires in %d days (%s)", days, cert.NotAfter.Format(time.RFC3339))}
+	}
+	return checkResult{name, checkPass, fmt.Sprintf("valid until %s", cert.NotAfter.Format(time.RFC3339))}
+}
+
+// checkDatabase also fails when auth.case_insensitive_usernames is set while usernames that are not
+// lowercase remain, since those users could no longer sign in.
+func checkDatabase(dir, defaultRole string, lowercaseUsernames bool) checkResult {
+	db, err := repository.OpenReadOnly(dir)
+	if err != nil {
+		return checkResult{"database", checkFail, err.Error()}
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkDBTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return checkResult{"database", checkFail, err.Error()}
+	}
+	version, err := repository.DetectSchemaVersion(db)
+	if err != nil {
+		return checkResult{"database", checkFail, err.Error()}
+	}
+	collisions, err := repository.NameCaseCollisions(db)
+	if err != nil {
+		return checkResult{"database", checkFail, err.Error()}
+	}
+	if len(collisions) > 0 {
+		return checkResult{"database", checkFail, "names differ only in case, rename them before migrating: " + strings.Join(collisions, "; ")}
+	}
+	if version != repository.CurrentSchemaVersion {
+		return checkResult{"database", checkFail, fmt.Sprintf("schema version %s, expected %s; run the migrations in data/", version, repository.CurrentSchemaVersion)}
+	}
+	var roleExists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM roles WHERE name = ? COLLATE NOCASE)", defaultRole).Scan(&roleExists); err != nil {
+		return checkResult{"database", checkFail, err.Error()}
+	}
+	if !roleExists {
+		return checkResult{"database", checkFail, fmt.Sprintf("auth.default_user_role %q does not name an existing role", defaultRole)}
+	}
+	if lowercaseUsernames {
+		collisions, mixed, err := repository.UsernameCaseCollisions(db)
+		if err != nil {
+			return checkResult{"database", checkFail, err.Error()}
+		}
+		if len(collisions) > 0 {
+			return checkResult{"database", checkFail, "usernames differ only in case, merge or rename them before enabling auth.case_insensitive_usernames: " + strings.Join(collisions, "; ")}
+		}
+		if mixed > 0 {
+			return checkResult{"database", checkFail, fmt.Sprintf("%d usernames are not lowercase and cannot sign in with auth.case_insensitive_usernames; run data/lowercase_usernames.sql", mixed)}
+		}
+	}
+	return checkResult{"database", checkPass, "schema version " + version}
+}
+
+func checkAgent(cfg *config.Config, name, addr string, probe agentProbeFunc) checkResult {
+	err := probe(addr, cfg.AgentCertFile, cfg.AgentKeyFile, cfg.AgentCAFile, cfg.AgentServerName, checkAgentTimeout)
+	if err != nil {
+		return checkResult{name, checkFail, fmt.Sprintf("%s: %v", addr, err)}
+	}
+	return checkResult{name, checkPass, "reachable at " + addr}
+}
+
+// checkSigningKeys only warns when the keys cannot be loaded, since the server then falls back to
+// HS256, unless auth.require_rs256 is set. Unreadable verification keys fail, since the server
+// refuses to start with them.
+func checkSigningKeys(cfg *config.Config) checkResult {
+	name := cfg.JwtAlgorithm + " keys"
+	privateKey, publicKey, err := loadKeyPair(cfg)
+	if err != nil {
+		if cfg.JwtRequireRS256 {
+			return checkResult{name, checkFail, err.Error() + "; auth.require_rs256 is set"}
+		}
+		return checkResult{name, checkWarn, fmt.Sprintf("%v; %s signing will not be available", err, cfg.JwtAlgorithm)}
+	}
+	if !keysMatch(privateKey, publicKey) {
+		return checkResult{name, checkFail, "public key does not match private key"}
+	}
+	var detail string
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		detail = fmt.Sprintf("%d-bit RSA key pair", key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		detail = key.Curve.Params().Name + " EC key pair"
+	}
+	if cfg.JwtPublicKeysDir != "" {
+		keys, err := loadPublicKeys(cfg.JwtPublicKeysDir)
+		if err != nil {
+			return checkResult{name, checkFail, err.Error()}
+		}
+		detail += fmt.Sprintf(", %d verification keys in %s", len(keys), cfg.JwtPublicKeysDir)
+	}
+	return checkResult{name, checkPass, detail}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"Aegis/controller/config"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and key valid between notBefore and notAfter.
+func writeTestCert(t *testing.T, dir, name string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+".key")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+// writeRSAKeys writes an RS256 key pair in the formats loadRSAKeys expects.
+func writeRSAKeys(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	privPath := filepath.Join(dir, "jwt_private.pem")
+	pubPath := filepath.Join(dir, "jwt_public.pem")
+	writePEM(t, privPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	writePEM(t, pubPath, "PUBLIC KEY", pub)
+	return privPath, pubPath
+}
+
+// writeECKeys writes an ES256 key pair in the formats loadECKeys expects.
+func writeECKeys(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	priv, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal private key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	privPath := filepath.Join(dir, "jwt_ec_private.pem")
+	pubPath := filepath.Join(dir, "jwt_ec_public.pem")
+	writePEM(t, privPath, "EC PRIVATE KEY", priv)
+	writePEM(t, pubPath, "PUBLIC KEY", pub)
+	return privPath, pubPath
+}
+
+// newCheckEnv builds a config whose files all exist and are valid.
+func newCheckEnv(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Now()
+	serverCert, serverKey := writeTestCert(t, dir, "server", now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	agentCert, agentKey := writeTestCert(t, dir, "controller", now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	privPath, pubPath := writeRSAKeys(t, dir)
+	keysDir := filepath.Join(dir, "jwt_keys")
+	if err := os.Mkdir(keysDir, 0700); err != nil {
+		t.Fatalf("failed to create key directory: %v", err)
+	}
+	retired, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&retired.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	writePEM(t, filepath.Join(keysDir, "retired.pem"), "PUBLIC KEY", pub)
+
+	db, err := repository.SetupTestStmt(dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	_ = db.Close()
+	repository.DB = nil
+
+	return &config.Config{
+		DBDir:            dir,
+		MaxOpenConns:     1,
+		MaxIdleConns:     1,
+		ServerPort:       ":443",
+		TLSMinVersion:    "1.2",
+		CertFile:         serverCert,
+		KeyFile:          serverKey,
+		AgentAddress:     "127.0.0.1:50001",
+		AgentCertFile:    agentCert,
+		AgentKeyFile:     agentKey,
+		AgentCAFile:      agentCert,
+		JwtKey:           "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA",
+		JwtAlgorithm:     config.JWTAlgorithmRS256,
+		JwtPrivateKey:    privPath,
+		JwtPublicKey:     pubPath,
+		JwtPublicKeysDir: keysDir,
+		StepUpMaxAge:     5 * time.Minute,
+		DefaultUserRole:  "user",
+		UsernamePattern:  utils.DefaultUsernamePattern,
+
+		DisabledUserResponse: config.DisabledUserUnauthorized,
+
+		MonitorRetryDelay:    5 * time.Second,
+		MonitorMaxRetryDelay: 60 * time.Second,
+		MonitorStallTimeout:  2 * time.Minute,
+		ResolveWorkers:       8,
+		DNSTimeout:           5 * time.Second,
+		DNSIPAuthority:       config.IPAuthorityDocker,
+		DBSynchronous:        "NORMAL",
+
+		AgentCallTimeout:        time.Second,
+		AgentSessionTimeout:     time.Second,
+		AgentIpUpdateTimeout:    time.Second,
+		AgentOnUnreachable:      config.OnUnreachableFail,
+		ActivationRetryInterval: 5 * time.Second,
+		ActivationTTL:           5 * time.Minute,
+	}
+}
+
+func statusOf(results []checkResult, name string) checkStatus {
+	for _, r := range results {
+		if r.Name == name {
+			return r.Status
+		}
+	}
+	return ""
+}
+
+func agentUp(string, string, string, string, string, time.Duration) error { return nil }
+
+func TestCollectChecksAllPass(t *testing.T) {
+	cfg := newCheckEnv(t)
+	for _, r := range collectChecks(cfg, agentUp) {
+		if r.Status != checkPass {
+			t.Errorf("%s: expected PASS, got %s (%s)", r.Name, r.Status, r.Detail)
+		}
+	}
+}
+
+func TestCollectChecksFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(t *testing.T, cfg *config.Config)
+		probe  agentProbeFunc
+		check  string
+		want   checkStatus
+	}{
+		{"Placeholder JWT secret", func(t *testing.T, cfg *config.Config) { cfg.JwtKey = "CHANGE_ME" }, agentUp, "config", checkFail},
+		{"Missing server key", func(t *testing.T, cfg *config.Config) { cfg.KeyFile = filepath.Join(t.TempDir(), "missing.key") }, agentUp, "server certificate", checkFail},
+		{"Expired agent certificate", func(t *testing.T, cfg *config.Config) {
+			now := time.Now()
+			cfg.AgentCertFile, cfg.AgentKeyFile = writeTestCert(t, t.TempDir(), "old", now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0))
+		}, agentUp, "agent client certificate", checkFail},
+		{"CA close to expiry", func(t *testing.T, cfg *config.Config) {
+			now := time.Now()
+			cfg.AgentCAFile, _ = writeTestCert(t, t.TempDir(), "ca", now.Add(-time.Hour), now.AddDate(0, 0, 7))
+		}, agentUp, "agent CA", checkWarn},
+		{"Missing database", func(t *testing.T, cfg *config.Config) { cfg.DBDir = t.TempDir() }, agentUp, "database", checkFail},
+		{"Unknown default role", func(t *testing.T, cfg *config.Config) { cfg.DefaultUserRole = "contractor" }, agentUp, "database", checkFail},
+		{"Service names differing only in case", func(t *testing.T, cfg *config.Config) {
+			// A database that has not been migrated yet has no case-insensitive index.
+			execCheckDB(t, cfg, `DROP INDEX idx_services_name_nocase;
+				INSERT INTO services (name, hostname, ip, port) VALUES ('Prod', '10.0.0.1:80', 167772161, 80), ('prod', '10.0.0.2:80', 167772162, 80)`)
+		}, agentUp, "database", checkFail},
+		{"Lowercase usernames", func(t *testing.T, cfg *config.Config) { cfg.LowercaseUsernames = true }, agentUp, "database", checkPass},
+		{"Lowercase usernames with mixed-case users", func(t *testing.T, cfg *config.Config) {
+			cfg.LowercaseUsernames = true
+			execCheckDB(t, cfg, "INSERT INTO users (username, password, role_id) VALUES ('Alice_Ops', 'x', 3)")
+		}, agentUp, "database", checkFail},
+		{"Lowercase usernames with colliding users", func(t *testing.T, cfg *config.Config) {
+			cfg.LowercaseUsernames = true
+			execCheckDB(t, cfg, "INSERT INTO users (username, password, role_id) VALUES ('Alice_Ops', 'x', 3), ('alice_ops', 'x', 3)")
+		}, agentUp, "database", checkFail},
+		{"Agent unreachable", func(t *testing.T, cfg *config.Config) {}, func(string, string, string, string, string, time.Duration) error {
+			return errors.New("connection refused")
+		}, "agent", checkFail},
+		{"RS256 keys missing", func(t *testing.T, cfg *config.Config) { cfg.JwtPrivateKey = "" }, agentUp, "RS256 keys", checkWarn},
+		{"RS256 keys missing but required", func(t *testing.T, cfg *config.Config) {
+			cfg.JwtPrivateKey = filepath.Join(t.TempDir(), "missing.pem")
+			cfg.JwtRequireRS256 = true
+		}, agentUp, "RS256 keys", checkFail},
+		{"RS256 keys mismatched", func(t *testing.T, cfg *config.Config) {
+			_, cfg.JwtPublicKey = writeRSAKeys(t, t.TempDir())
+		}, agentUp, "RS256 keys", checkFail},
+		{"ES256 keys", func(t *testing.T, cfg *config.Config) {
+			cfg.JwtAlgorithm = config.JWTAlgorithmES256
+			cfg.JwtPrivateKey, cfg.JwtPublicKey = writeECKeys(t, t.TempDir())
+		}, agentUp, "ES256 keys", checkPass},
+		{"ES256 selected with RSA keys", func(t *testing.T, cfg *config.Config) {
+			cfg.JwtAlgorithm = config.JWTAlgorithmES256
+		}, agentUp, "ES256 keys", checkWarn},
+		{"RS256 verification key invalid", func(t *testing.T, cfg *config.Config) {
+			if err := os.WriteFile(filepath.Join(cfg.JwtPublicKeysDir, "broken.pem"), []byte("not a key"), 0600); err != nil {
+				t.Fatalf("failed to write key: %v", err)
+			}
+		}, agentUp, "RS256 keys", checkFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newCheckEnv(t)
+			tt.mutate(t, cfg)
+			if got := statusOf(collectChecks(cfg, tt.probe), tt.check); got != tt.want {
+				t.Errorf("%s: expected %s, got %s", tt.check, tt.want, got)
+			}
+		})
+	}
+}
+
+// execCheckDB runs query against the database of a config made by newCheckEnv.
+func execCheckDB(t *testing.T, cfg *config.Config, query string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", repository.DBPath(cfg.DBDir))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if _, err := db.Exec(query); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+}
+
+func TestRunCheckReportsConfigError(t *testing.T) {
+	var out bytes.Buffer
+	if code := runCheck(nil, errors.New("failed to parse config file"), &out); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(out.String(), "FAIL") || !strings.Contains(out.String(), "failed to parse config file") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
@@ -1,26 +1,87 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"Aegis/controller/internal/utils"
+
 	"github.com/BurntSushi/toml"
 )
 
 // DefaultConfigPath is the default location for the TOML config file.
 const DefaultConfigPath = "config.toml"
 
+// PrimaryAgentName is the name under which the [agent] section is registered.
+const PrimaryAgentName = "primary"
+
+// Values of agent.on_unreachable: fail a selection straight away, or queue it and retry.
+const (
+	OnUnreachableFail  = "fail"
+	OnUnreachableQueue = "queue"
+)
+
+// Values of auth.disabled_user_response: how requests with a valid session of a user disabled after
+// signing in are answered.
+const (
+	DisabledUserUnauthorized = "unauthorized"
+	DisabledUserForbidden    = "forbidden"
+)
+
+// Values of oidc.github_groups: which GitHub memberships become groups for group_mappings.
+const (
+	GitHubGroupsNone  = "none"
+	GitHubGroupsOrgs  = "orgs"
+	GitHubGroupsTeams = "teams"
+)
+
+// Values of dns.ip_authority: which writer's address a service keeps when the Docker watcher and
+// hostname resolution disagree.
+const (
+	IPAuthorityDocker = "docker"
+	IPAuthorityDNS    = "dns"
+)
+
+// Values of auth.jwt_algorithm: the algorithm tokens are signed with when the key pair loads.
+const (
+	JWTAlgorithmRS256 = "RS256"
+	JWTAlgorithmES256 = "ES256"
+)
+
 // Config holds all config values for the controller.
 type Config struct {
 	// Database settings
-	DBDir  string
-	DBPath string
+	DBDir string
 
 	// Server settings
 	ServerPort string
+	ListenAddr string
 	CertFile   string
 	KeyFile    string
+	StaticDir  string
+
+	// TLS of the HTTPS server. Empty TLSCipherSuites means the curated defaults.
+	TLSMinVersion   string
+	TLSCipherSuites []string
+
+	// HTTP server timeouts. Zero means no limit.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	HandlerTimeout    time.Duration
+
+	// Static asset delivery
+	StaticCompression  bool
+	StaticCacheHeaders bool
+	MetricsEnabled     bool
 
 	// gRPC Agent connection
 	AgentAddress     string
@@ -29,30 +90,100 @@ type Config struct {
 	AgentCAFile      string
 	AgentServerName  string
 	AgentCallTimeout time.Duration
+	// Per-operation timeouts; each defaults to AgentCallTimeout
+	AgentSessionTimeout  time.Duration // activating and closing sessions
+	AgentIpUpdateTimeout time.Duration // pushing changed service IPs
+
+	// Selections while an agent is unreachable: "fail" or "queue"
+	AgentOnUnreachable      string
+	ActivationRetryInterval time.Duration
+	ActivationTTL           time.Duration
+	// Ceiling on rows in user_active_services; 0 means no limit
+	MaxActiveSessions int
+	RejectOverLimit   bool
+	// Where activations take the enforced source IP from: a request header set by a VPN gateway, else
+	// the request IP. Users holding override_source_ip may name any address in SourceIPAllowlist.
+	SourceIPHeader    string
+	SourceIPAllowlist []string
+	// Additional agents by name; they share the [agent] TLS settings.
+	Agents map[string]string
 
 	// Session monitoring
-	MonitorRetryDelay time.Duration
-	IpUpdateInterval  time.Duration
+	MonitorRetryDelay    time.Duration
+	MonitorMaxRetryDelay time.Duration
+	MonitorStableAfter   time.Duration
+	MonitorStallTimeout  time.Duration
+	IpUpdateInterval     time.Duration
+	ResolveWorkers       int
+
+	// DNS resolution for service hostnames. Empty DNSNameservers means the system resolver.
+	DNSNameservers []string
+	DNSTimeout     time.Duration
+	// DNSIPAuthority is the writer whose address wins when the Docker watcher and hostname resolution
+	// disagree; the other may only replace it once it is DNSAuthorityHold old.
+	DNSIPAuthority   string
+	DNSAuthorityHold time.Duration
 
 	// Connection pool settings
 	MaxOpenConns    int
 	MaxIdleConns    int
 	ConnMaxLifetime time.Duration
 
+	// SQLite pragmas applied to every connection
+	DBBusyTimeout time.Duration
+	DBSynchronous string
+	DBCacheSize   int
+
+	// Database observability
+	SlowQueryThreshold time.Duration
+	PoolWaitThreshold  time.Duration
+
 	// Authentication settings
 	JwtKey           string
 	JwtTokenLifetime time.Duration
-	JwtPrivateKey    string
-	JwtPublicKey     string
+	// JwtAlgorithm selects the key pair in JwtPrivateKey and JwtPublicKey: RSA for RS256, EC P-256
+	// for ES256.
+	JwtAlgorithm  string
+	JwtPrivateKey string
+	JwtPublicKey  string
+	// JwtPublicKeysDir holds further public keys tokens are verified with, for RS256 key rotation.
+	JwtPublicKeysDir string
+	// JwtRequireRS256 makes a failure to load the RSA keys fatal instead of falling back to HS256.
+	JwtRequireRS256 bool
+	StepUpMaxAge    time.Duration
+	DefaultUserRole string
+	UsernamePattern string
+	// LowercaseUsernames makes usernames case-insensitive by lowercasing them when accounts are created
+	// and when users sign in.
+	LowercaseUsernames bool
+	// DefaultServiceRole names a role granted every service created; empty grants none.
+	DefaultServiceRole string
+	// ActiveCheckTTL is how long whether a signed-in user is still enabled is cached for, and
+	// DisabledUserResponse is "unauthorized" or "forbidden", the answer once they are not.
+	ActiveCheckTTL       time.Duration
+	DisabledUserResponse string
 
 	// OIDC settings
 	OIDCEnabled          bool
 	OIDCGoogleClientID   string
 	OIDCGoogleSecret     string
+	OIDCGoogleEnabled    bool
 	OIDCGitHubClientID   string
 	OIDCGitHubSecret     string
+	OIDCGitHubEnabled    bool
 	OIDCRedirectURL      string
 	OIDCRoleMappingRules string
+	OIDCGoogleScopes     []string
+	OIDCGitHubScopes     []string
+	OIDCOfflineAccess    bool
+	OIDCGitHubGroups     string
+	OIDCTokenKey         string
+
+	// OpenTelemetry tracing, exported over OTLP/HTTP. Off by default.
+	TracingEnabled     bool
+	TracingEndpoint    string
+	TracingInsecure    bool
+	TracingSampleRatio float64
 }
 
 // [database] section of config.toml.
@@ -61,13 +192,30 @@ type tomlDatabase struct {
 	MaxOpenConns    int    `toml:"max_open_conns"`
 	MaxIdleConns    int    `toml:"max_idle_conns"`
 	ConnMaxLifetime string `toml:"conn_max_lifetime"`
+	SlowQuery       string `toml:"slow_query_threshold"`
+	PoolWait        string `toml:"pool_wait_threshold"`
+	BusyTimeout     string `toml:"busy_timeout"`
+	Synchronous     string `toml:"synchronous"`
+	CacheSize       int    `toml:"cache_size"`
 }
 
 // [server] section of config.toml.
 type tomlServer struct {
-	Port     string `toml:"port"`
-	CertFile string `toml:"cert_file"`
-	KeyFile  string `toml:"key_file"`
+	Port           string   `toml:"port"`
+	ListenAddr     string   `toml:"listen_addr"`
+	CertFile       string   `toml:"cert_file"`
+	KeyFile        string   `toml:"key_file"`
+	TLSMinVersion  string   `toml:"tls_min_version"`
+	CipherSuites   []string `toml:"tls_cipher_suites"`
+	ReadHeader     string   `toml:"read_header_timeout"`
+	Read           string   `toml:"read_timeout"`
+	Write          string   `toml:"write_timeout"`
+	Idle           string   `toml:"idle_timeout"`
+	Handler        string   `toml:"handler_timeout"`
+	StaticDir      string   `toml:"static_dir"`
+	CompressStatic bool     `toml:"compress_static"`
+	CacheStatic    bool     `toml:"cache_static"`
+	Metrics        bool     `toml:"metrics_enabled"`
 }
 
 // [agent] section of config.toml.
@@ -78,31 +226,82 @@ type tomlAgent struct {
 	CAFile      string `toml:"ca_file"`
 	ServerName  string `toml:"server_name"`
 	CallTimeout string `toml:"call_timeout"`
+	// SessionTimeout and IpUpdateTimeout are empty to use CallTimeout.
+	SessionTimeout  string `toml:"session_timeout"`
+	IpUpdateTimeout string `toml:"ip_update_timeout"`
+	// OnUnreachable is "fail" or "queue".
+	OnUnreachable string `toml:"on_unreachable"`
+	RetryInterval string `toml:"activation_retry_interval"`
+	ActivationTTL string `toml:"activation_ttl"`
+	// MaxActiveSessions is 0 for no limit.
+	MaxActiveSessions int  `toml:"max_active_sessions"`
+	RejectOverLimit   bool `toml:"reject_over_limit"`
+	// SourceIPHeader is empty to use the request IP.
+	SourceIPHeader    string   `toml:"source_ip_header"`
+	SourceIPAllowlist []string `toml:"source_ip_allowlist"`
 }
 
 // [monitor] section of config.toml.
 type tomlMonitor struct {
 	RetryDelay       string `toml:"retry_delay"`
+	MaxRetryDelay    string `toml:"max_retry_delay"`
+	StableAfter      string `toml:"stable_after"`
+	StallTimeout     string `toml:"stall_timeout"`
 	IpUpdateInterval string `toml:"ip_update_interval"`
+	ResolveWorkers   int    `toml:"resolve_workers"`
+}
+
+// [dns] section of config.toml.
+type tomlDNS struct {
+	Nameservers   []string `toml:"nameservers"`
+	Timeout       string   `toml:"timeout"`
+	IPAuthority   string   `toml:"ip_authority"`
+	AuthorityHold string   `toml:"authority_hold"`
+}
+
+// [tracing] section of config.toml.
+type tomlTracing struct {
+	Enabled bool `toml:"enabled"`
+	// Endpoint is the host:port of an OTLP/HTTP collector.
+	Endpoint    string  `toml:"otlp_endpoint"`
+	Insecure    bool    `toml:"insecure"`
+	SampleRatio float64 `toml:"sample_ratio"`
 }
 
 // [auth] section of config.toml.
 type tomlAuth struct {
 	JwtSecret        string `toml:"jwt_secret"`
 	JwtTokenLifetime string `toml:"jwt_token_lifetime"`
+	JwtAlgorithm     string `toml:"jwt_algorithm"`
 	JwtPrivateKey    string `toml:"jwt_private_key"`
 	JwtPublicKey     string `toml:"jwt_public_key"`
+	JwtPublicKeysDir string `toml:"jwt_public_keys_dir"`
+	RequireRS256     bool   `toml:"require_rs256"`
+	StepUpMaxAge     string `toml:"step_up_max_age"`
+	DefaultUserRole  string `toml:"default_user_role"`
+	DefaultSvcRole   string `toml:"default_service_role"`
+	UsernamePattern  string `toml:"username_pattern"`
+	CaseInsensitive  bool   `toml:"case_insensitive_usernames"`
+	ActiveCheckTTL   string `toml:"active_check_ttl"`
+	DisabledResponse string `toml:"disabled_user_response"`
 }
 
 // [oidc] section of config.toml.
 type tomlOIDC struct {
-	Enabled          bool   `toml:"enabled"`
-	GoogleClientID   string `toml:"google_client_id"`
-	GoogleSecret     string `toml:"google_secret"`
-	GitHubClientID   string `toml:"github_client_id"`
-	GitHubSecret     string `toml:"github_secret"`
-	RedirectURL      string `toml:"redirect_url"`
-	RoleMappingRules string `toml:"role_mapping_rules"`
+	Enabled          bool     `toml:"enabled"`
+	GoogleClientID   string   `toml:"google_client_id"`
+	GoogleSecret     string   `toml:"google_secret"`
+	GoogleEnabled    bool     `toml:"google_enabled"`
+	GitHubClientID   string   `toml:"github_client_id"`
+	GitHubSecret     string   `toml:"github_secret"`
+	GitHubEnabled    bool     `toml:"github_enabled"`
+	RedirectURL      string   `toml:"redirect_url"`
+	RoleMappingRules string   `toml:"role_mapping_rules"`
+	GoogleScopes     []string `toml:"google_scopes"`
+	GitHubScopes     []string `toml:"github_scopes"`
+	OfflineAccess    bool     `toml:"offline_access"`
+	GitHubGroups     string   `toml:"github_groups"`
+	TokenKey         string   `toml:"token_encryption_key"`
 }
 
 // TOML structure.
@@ -111,8 +310,12 @@ type tomlFile struct {
 	Server   tomlServer   `toml:"server"`
 	Agent    tomlAgent    `toml:"agent"`
 	Monitor  tomlMonitor  `toml:"monitor"`
+	DNS      tomlDNS      `toml:"dns"`
 	Auth     tomlAuth     `toml:"auth"`
 	OIDC     tomlOIDC     `toml:"oidc"`
+	Tracing  tomlTracing  `toml:"tracing"`
+	// [agents] maps agent names to addresses.
+	Agents map[string]string `toml:"agents"`
 }
 
 // defaults returns the default tomlFile values.
@@ -123,51 +326,126 @@ func defaults() tomlFile {
 			MaxOpenConns:    1,
 			MaxIdleConns:    1,
 			ConnMaxLifetime: "1h",
+			SlowQuery:       "200ms",
+			PoolWait:        "1s",
+			BusyTimeout:     "5s",
+			Synchronous:     "NORMAL",
+			CacheSize:       -2000,
 		},
 		Server: tomlServer{
-			Port:     ":443",
-			CertFile: "certs/server.crt",
-			KeyFile:  "certs/server.key",
+			Port:           ":443",
+			TLSMinVersion:  "1.2",
+			ReadHeader:     "5s",
+			Read:           "30s",
+			Write:          "60s",
+			Idle:           "120s",
+			Handler:        "30s",
+			CertFile:       "certs/server.crt",
+			KeyFile:        "certs/server.key",
+			StaticDir:      "static",
+			CompressStatic: true,
+			CacheStatic:    true,
 		},
 		Agent: tomlAgent{
-			Address:     "172.21.0.10:50001",
-			CertFile:    "certs/controller.pem",
-			KeyFile:     "certs/controller.key",
-			CAFile:      "certs/ca.pem",
-			ServerName:  "aegis-agent",
-			CallTimeout: "1s",
+			Address:       "172.21.0.10:50001",
+			CertFile:      "certs/controller.pem",
+			KeyFile:       "certs/controller.key",
+			CAFile:        "certs/ca.pem",
+			ServerName:    "aegis-agent",
+			CallTimeout:   "1s",
+			OnUnreachable: OnUnreachableFail,
+			RetryInterval: "5s",
+			ActivationTTL: "5m",
 		},
 		Monitor: tomlMonitor{
 			RetryDelay:       "5s",
+			MaxRetryDelay:    "60s",
+			StableAfter:      "10s",
+			StallTimeout:     "2m",
 			IpUpdateInterval: "60s",
+			ResolveWorkers:   8,
+		},
+		DNS: tomlDNS{
+			Timeout:       "5s",
+			IPAuthority:   IPAuthorityDocker,
+			AuthorityHold: "10m",
 		},
 		Auth: tomlAuth{
 			JwtSecret:        "CHANGE_ME",
 			JwtTokenLifetime: "60s",
+			JwtAlgorithm:     JWTAlgorithmRS256,
 			JwtPrivateKey:    "keys/jwt_private.pem",
 			JwtPublicKey:     "keys/jwt_public.pem",
+			StepUpMaxAge:     "5m",
+			DefaultUserRole:  "user",
+			UsernamePattern:  utils.DefaultUsernamePattern,
+			ActiveCheckTTL:   "5s",
+			DisabledResponse: DisabledUserUnauthorized,
 		},
 		OIDC: tomlOIDC{
 			Enabled:          false,
+			GoogleEnabled:    true,
+			GitHubEnabled:    true,
 			RedirectURL:      "https://localhost/api/auth/oidc/callback",
 			RoleMappingRules: `{"domain_mappings":{"@company.com":"user","admin@company.com":"admin"}}`,
+			GoogleScopes:     []string{"openid", "profile", "email"},
+			GitHubScopes:     []string{"read:user", "user:email"},
+			GitHubGroups:     GitHubGroupsNone,
+		},
+		Tracing: tomlTracing{
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
 		},
 	}
 }
 
 // Fallback durations for each field.
 var defaultDurations = struct {
-	ConnMaxLifetime   time.Duration
-	AgentCallTimeout  time.Duration
-	MonitorRetryDelay time.Duration
-	IpUpdateInterval  time.Duration
-	JwtTokenLifetime  time.Duration
+	ConnMaxLifetime      time.Duration
+	SlowQuery            time.Duration
+	PoolWait             time.Duration
+	BusyTimeout          time.Duration
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	HandlerTimeout       time.Duration
+	AgentCallTimeout     time.Duration
+	ActivationRetry      time.Duration
+	ActivationTTL        time.Duration
+	MonitorRetryDelay    time.Duration
+	MonitorMaxRetryDelay time.Duration
+	MonitorStableAfter   time.Duration
+	MonitorStallTimeout  time.Duration
+	IpUpdateInterval     time.Duration
+	DNSTimeout           time.Duration
+	DNSAuthorityHold     time.Duration
+	JwtTokenLifetime     time.Duration
+	StepUpMaxAge         time.Duration
+	ActiveCheckTTL       time.Duration
 }{
-	ConnMaxLifetime:   time.Hour,
-	AgentCallTimeout:  time.Second,
-	MonitorRetryDelay: 5 * time.Second,
-	IpUpdateInterval:  60 * time.Second,
-	JwtTokenLifetime:  60 * time.Second,
+	ConnMaxLifetime:      time.Hour,
+	SlowQuery:            200 * time.Millisecond,
+	PoolWait:             time.Second,
+	BusyTimeout:          5 * time.Second,
+	ReadHeaderTimeout:    5 * time.Second,
+	ReadTimeout:          30 * time.Second,
+	WriteTimeout:         60 * time.Second,
+	IdleTimeout:          120 * time.Second,
+	HandlerTimeout:       30 * time.Second,
+	AgentCallTimeout:     time.Second,
+	ActivationRetry:      5 * time.Second,
+	ActivationTTL:        5 * time.Minute,
+	MonitorRetryDelay:    5 * time.Second,
+	MonitorMaxRetryDelay: 60 * time.Second,
+	MonitorStableAfter:   10 * time.Second,
+	MonitorStallTimeout:  2 * time.Minute,
+	IpUpdateInterval:     60 * time.Second,
+	DNSTimeout:           5 * time.Second,
+	DNSAuthorityHold:     10 * time.Minute,
+	JwtTokenLifetime:     60 * time.Second,
+	StepUpMaxAge:         5 * time.Minute,
+	ActiveCheckTTL:       5 * time.Second,
 }
 
 // parseDuration parses a duration string. If invalide returns fallback duration.
@@ -179,36 +457,100 @@ func parseDuration(s string, fallback time.Duration) time.Duration {
 	return fallback
 }
 
+// parseOptionalDuration parses a duration string that may be left empty to use fallback.
+func parseOptionalDuration(s string, fallback time.Duration) time.Duration {
+	if s == "" {
+		return fallback
+	}
+	return parseDuration(s, fallback)
+}
+
 // returns Config struct from toml.
 func buildConfig(tf tomlFile) *Config {
 	cfg := &Config{
-		DBDir:                tf.Database.Dir,
-		MaxOpenConns:         tf.Database.MaxOpenConns,
-		MaxIdleConns:         tf.Database.MaxIdleConns,
-		ConnMaxLifetime:      parseDuration(tf.Database.ConnMaxLifetime, defaultDurations.ConnMaxLifetime),
-		ServerPort:           tf.Server.Port,
-		CertFile:             tf.Server.CertFile,
-		KeyFile:              tf.Server.KeyFile,
-		AgentAddress:         tf.Agent.Address,
-		AgentCertFile:        tf.Agent.CertFile,
-		AgentKeyFile:         tf.Agent.KeyFile,
-		AgentCAFile:          tf.Agent.CAFile,
-		AgentServerName:      tf.Agent.ServerName,
-		AgentCallTimeout:     parseDuration(tf.Agent.CallTimeout, defaultDurations.AgentCallTimeout),
-		MonitorRetryDelay:    parseDuration(tf.Monitor.RetryDelay, defaultDurations.MonitorRetryDelay),
-		IpUpdateInterval:     parseDuration(tf.Monitor.IpUpdateInterval, defaultDurations.IpUpdateInterval),
-		JwtKey:               tf.Auth.JwtSecret,
-		JwtTokenLifetime:     parseDuration(tf.Auth.JwtTokenLifetime, defaultDurations.JwtTokenLifetime),
-		JwtPrivateKey:        tf.Auth.JwtPrivateKey,
-		JwtPublicKey:         tf.Auth.JwtPublicKey,
-		OIDCEnabled:          tf.OIDC.Enabled,
-		OIDCGoogleClientID:   tf.OIDC.GoogleClientID,
-		OIDCGoogleSecret:     tf.OIDC.GoogleSecret,
-		OIDCGitHubClientID:   tf.OIDC.GitHubClientID,
-		OIDCGitHubSecret:     tf.OIDC.GitHubSecret,
-		OIDCRedirectURL:      tf.OIDC.RedirectURL,
-		OIDCRoleMappingRules: tf.OIDC.RoleMappingRules,
+		DBDir:                   tf.Database.Dir,
+		MaxOpenConns:            tf.Database.MaxOpenConns,
+		MaxIdleConns:            tf.Database.MaxIdleConns,
+		ConnMaxLifetime:         parseDuration(tf.Database.ConnMaxLifetime, defaultDurations.ConnMaxLifetime),
+		SlowQueryThreshold:      parseDuration(tf.Database.SlowQuery, defaultDurations.SlowQuery),
+		PoolWaitThreshold:       parseDuration(tf.Database.PoolWait, defaultDurations.PoolWait),
+		DBBusyTimeout:           parseDuration(tf.Database.BusyTimeout, defaultDurations.BusyTimeout),
+		DBSynchronous:           strings.ToUpper(tf.Database.Synchronous),
+		DBCacheSize:             tf.Database.CacheSize,
+		ServerPort:              tf.Server.Port,
+		ListenAddr:              tf.Server.ListenAddr,
+		TLSMinVersion:           tf.Server.TLSMinVersion,
+		TLSCipherSuites:         tf.Server.CipherSuites,
+		ReadHeaderTimeout:       parseDuration(tf.Server.ReadHeader, defaultDurations.ReadHeaderTimeout),
+		ReadTimeout:             parseDuration(tf.Server.Read, defaultDurations.ReadTimeout),
+		WriteTimeout:            parseDuration(tf.Server.Write, defaultDurations.WriteTimeout),
+		IdleTimeout:             parseDuration(tf.Server.Idle, defaultDurations.IdleTimeout),
+		HandlerTimeout:          parseDuration(tf.Server.Handler, defaultDurations.HandlerTimeout),
+		CertFile:                tf.Server.CertFile,
+		KeyFile:                 tf.Server.KeyFile,
+		StaticDir:               tf.Server.StaticDir,
+		StaticCompression:       tf.Server.CompressStatic,
+		StaticCacheHeaders:      tf.Server.CacheStatic,
+		MetricsEnabled:          tf.Server.Metrics,
+		AgentAddress:            tf.Agent.Address,
+		AgentCertFile:           tf.Agent.CertFile,
+		AgentKeyFile:            tf.Agent.KeyFile,
+		AgentCAFile:             tf.Agent.CAFile,
+		AgentServerName:         tf.Agent.ServerName,
+		AgentCallTimeout:        parseDuration(tf.Agent.CallTimeout, defaultDurations.AgentCallTimeout),
+		AgentOnUnreachable:      tf.Agent.OnUnreachable,
+		ActivationRetryInterval: parseDuration(tf.Agent.RetryInterval, defaultDurations.ActivationRetry),
+		ActivationTTL:           parseDuration(tf.Agent.ActivationTTL, defaultDurations.ActivationTTL),
+		MaxActiveSessions:       tf.Agent.MaxActiveSessions,
+		RejectOverLimit:         tf.Agent.RejectOverLimit,
+		SourceIPHeader:          strings.TrimSpace(tf.Agent.SourceIPHeader),
+		SourceIPAllowlist:       tf.Agent.SourceIPAllowlist,
+		Agents:                  tf.Agents,
+		MonitorRetryDelay:       parseDuration(tf.Monitor.RetryDelay, defaultDurations.MonitorRetryDelay),
+		MonitorMaxRetryDelay:    parseDuration(tf.Monitor.MaxRetryDelay, defaultDurations.MonitorMaxRetryDelay),
+		MonitorStableAfter:      parseDuration(tf.Monitor.StableAfter, defaultDurations.MonitorStableAfter),
+		MonitorStallTimeout:     parseDuration(tf.Monitor.StallTimeout, defaultDurations.MonitorStallTimeout),
+		IpUpdateInterval:        parseDuration(tf.Monitor.IpUpdateInterval, defaultDurations.IpUpdateInterval),
+		ResolveWorkers:          tf.Monitor.ResolveWorkers,
+		DNSNameservers:          tf.DNS.Nameservers,
+		DNSTimeout:              parseDuration(tf.DNS.Timeout, defaultDurations.DNSTimeout),
+		DNSIPAuthority:          tf.DNS.IPAuthority,
+		DNSAuthorityHold:        parseDuration(tf.DNS.AuthorityHold, defaultDurations.DNSAuthorityHold),
+		JwtKey:                  tf.Auth.JwtSecret,
+		JwtTokenLifetime:        parseDuration(tf.Auth.JwtTokenLifetime, defaultDurations.JwtTokenLifetime),
+		JwtAlgorithm:            tf.Auth.JwtAlgorithm,
+		JwtPrivateKey:           tf.Auth.JwtPrivateKey,
+		JwtPublicKey:            tf.Auth.JwtPublicKey,
+		JwtPublicKeysDir:        tf.Auth.JwtPublicKeysDir,
+		JwtRequireRS256:         tf.Auth.RequireRS256,
+		StepUpMaxAge:            parseDuration(tf.Auth.StepUpMaxAge, defaultDurations.StepUpMaxAge),
+		DefaultUserRole:         strings.TrimSpace(tf.Auth.DefaultUserRole),
+		DefaultServiceRole:      strings.TrimSpace(tf.Auth.DefaultSvcRole),
+		UsernamePattern:         tf.Auth.UsernamePattern,
+		LowercaseUsernames:      tf.Auth.CaseInsensitive,
+		ActiveCheckTTL:          parseDuration(tf.Auth.ActiveCheckTTL, defaultDurations.ActiveCheckTTL),
+		DisabledUserResponse:    tf.Auth.DisabledResponse,
+		OIDCEnabled:             tf.OIDC.Enabled,
+		OIDCGoogleClientID:      tf.OIDC.GoogleClientID,
+		OIDCGoogleSecret:        tf.OIDC.GoogleSecret,
+		OIDCGoogleEnabled:       tf.OIDC.GoogleEnabled,
+		OIDCGitHubClientID:      tf.OIDC.GitHubClientID,
+		OIDCGitHubSecret:        tf.OIDC.GitHubSecret,
+		OIDCGitHubEnabled:       tf.OIDC.GitHubEnabled,
+		OIDCRedirectURL:         tf.OIDC.RedirectURL,
+		OIDCRoleMappingRules:    tf.OIDC.RoleMappingRules,
+		OIDCGoogleScopes:        tf.OIDC.GoogleScopes,
+		OIDCGitHubScopes:        tf.OIDC.GitHubScopes,
+		OIDCOfflineAccess:       tf.OIDC.OfflineAccess,
+		OIDCGitHubGroups:        tf.OIDC.GitHubGroups,
+		OIDCTokenKey:            tf.OIDC.TokenKey,
+		TracingEnabled:          tf.Tracing.Enabled,
+		TracingEndpoint:         strings.TrimSpace(tf.Tracing.Endpoint),
+		TracingInsecure:         tf.Tracing.Insecure,
+		TracingSampleRatio:      tf.Tracing.SampleRatio,
 	}
+	cfg.AgentSessionTimeout = parseOptionalDuration(tf.Agent.SessionTimeout, cfg.AgentCallTimeout)
+	cfg.AgentIpUpdateTimeout = parseOptionalDuration(tf.Agent.IpUpdateTimeout, cfg.AgentCallTimeout)
 	return cfg
 }
 
@@ -219,17 +561,29 @@ func Load() *Config {
 
 // LoadFromFile reads config from given file. returns default if file not found.
 func LoadFromFile(path string) *Config {
+	cfg, err := Read(path)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("[FATAL] Invalid configuration: %v", err)
+	}
+	return cfg
+}
+
+// Read reads config from given file without validating it. returns default if file not found.
+func Read(path string) (*Config, error) {
 	tf := defaults()
 
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Fatalf("[FATAL] Failed to read config file %s: %v", path, err)
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
 		}
 		log.Printf("[WARN] Config file %s not found, using built-in defaults", path)
 	} else {
 		if err := toml.Unmarshal(data, &tf); err != nil {
-			log.Fatalf("[FATAL] Failed to parse config file %s: %v", path, err)
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
 		}
 	}
 
@@ -238,10 +592,245 @@ func LoadFromFile(path string) *Config {
 	if jwtSecret := os.Getenv("JWT_SECRET"); jwtSecret != "" {
 		cfg.JwtKey = jwtSecret
 	}
+	if listenAddr := os.Getenv("LISTEN_ADDR"); listenAddr != "" {
+		cfg.ListenAddr = listenAddr
+	}
+	if requireRS256 := os.Getenv("JWT_REQUIRE_RS256"); requireRS256 != "" {
+		v, err := strconv.ParseBool(requireRS256)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_REQUIRE_RS256 must be true or false, got %q", requireRS256)
+		}
+		cfg.JwtRequireRS256 = v
+	}
+
+	return cfg, nil
+}
 
-	if cfg.JwtKey == "CHANGE_ME" {
-		log.Fatal("[FATAL] auth.jwt_secret in config.toml must be changed from the default placeholder value")
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "***"
+
+// Redacted returns a copy of c with secrets replaced by "***", suitable for logging.
+// Empty secrets stay empty so the output still shows whether they are set.
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, s := range []*string{&r.JwtKey, &r.OIDCGoogleSecret, &r.OIDCGitHubSecret, &r.OIDCTokenKey} {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	if c.Agents != nil {
+		r.Agents = make(map[string]string, len(c.Agents))
+		for name, addr := range c.Agents {
+			r.Agents[name] = addr
+		}
 	}
+	return &r
+}
 
-	return cfg
+// ServerAddr combines server.listen_addr with the port of server.port into the address the HTTPS
+// server binds. An empty listen_addr keeps the host of server.port, which is all interfaces for ":443".
+func (c *Config) ServerAddr() (string, error) {
+	host, port, err := net.SplitHostPort(c.ServerPort)
+	if err != nil {
+		return "", fmt.Errorf("server.port must be a port like \":443\", got %q", c.ServerPort)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("server.port must be between 0 and 65535, got %q", port)
+	}
+	if c.ListenAddr != "" {
+		if host != "" {
+			return "", fmt.Errorf("server.listen_addr %q conflicts with the host in server.port %q", c.ListenAddr, c.ServerPort)
+		}
+		host = c.ListenAddr
+	}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("server.listen_addr must be an IP address or localhost, got %q", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// requiredOIDCScopes must be requested from OpenID Connect providers: logins are verified through the
+// ID token and mapped to roles by email.
+var requiredOIDCScopes = []string{"openid", "email"}
+
+// synchronousModes are the accepted values of database.synchronous.
+var synchronousModes = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+
+// Validate reports every setting the controller cannot start with.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.JwtKey == "" || c.JwtKey == "CHANGE_ME" {
+		errs = append(errs, errors.New("auth.jwt_secret in config.toml must be changed from the default placeholder value"))
+	} else if err := checkJWTSecret(c.JwtKey); err != nil {
+		errs = append(errs, err)
+	}
+	if c.StepUpMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf("auth.step_up_max_age must be positive, got %v", c.StepUpMaxAge))
+	}
+	if c.ActiveCheckTTL < 0 {
+		errs = append(errs, fmt.Errorf("auth.active_check_ttl must not be negative, got %v", c.ActiveCheckTTL))
+	}
+	if c.DisabledUserResponse != DisabledUserUnauthorized && c.DisabledUserResponse != DisabledUserForbidden {
+		errs = append(errs, fmt.Errorf("auth.disabled_user_response must be %q or %q, got %q", DisabledUserUnauthorized, DisabledUserForbidden, c.DisabledUserResponse))
+	}
+	if c.JwtAlgorithm != JWTAlgorithmRS256 && c.JwtAlgorithm != JWTAlgorithmES256 {
+		errs = append(errs, fmt.Errorf("auth.jwt_algorithm must be %q or %q, got %q", JWTAlgorithmRS256, JWTAlgorithmES256, c.JwtAlgorithm))
+	}
+	if c.JwtRequireRS256 && (c.JwtPrivateKey == "" || c.JwtPublicKey == "") {
+		errs = append(errs, errors.New("auth.require_rs256 needs auth.jwt_private_key and auth.jwt_public_key"))
+	}
+	if c.DefaultUserRole == "" {
+		errs = append(errs, errors.New("auth.default_user_role must not be empty"))
+	}
+	if c.UsernamePattern == "" {
+		errs = append(errs, errors.New("auth.username_pattern must not be empty"))
+	} else if _, err := utils.CompileUsernamePattern(c.UsernamePattern); err != nil {
+		errs = append(errs, fmt.Errorf("auth.username_pattern: %w", err))
+	}
+	if c.DBDir == "" {
+		errs = append(errs, errors.New("database.dir must not be empty"))
+	}
+	if c.MaxOpenConns < 1 {
+		errs = append(errs, fmt.Errorf("database.max_open_conns must be at least 1, got %d", c.MaxOpenConns))
+	}
+	if c.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("database.max_idle_conns must not be negative, got %d", c.MaxIdleConns))
+	}
+	if c.DBBusyTimeout < 0 {
+		errs = append(errs, fmt.Errorf("database.busy_timeout must not be negative, got %v", c.DBBusyTimeout))
+	}
+	if !slices.Contains(synchronousModes, c.DBSynchronous) {
+		errs = append(errs, fmt.Errorf("database.synchronous must be one of %s, got %q", strings.Join(synchronousModes, ", "), c.DBSynchronous))
+	}
+	if c.ServerPort == "" || c.CertFile == "" || c.KeyFile == "" {
+		errs = append(errs, errors.New("server.port, server.cert_file and server.key_file are required"))
+	}
+	if c.ServerPort != "" {
+		if _, err := c.ServerAddr(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := c.ServerTLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, t := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"handler_timeout", c.HandlerTimeout},
+	} {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("server.%s must not be negative, got %v", t.key, t.d))
+		}
+	}
+	if c.HandlerTimeout > 0 && c.WriteTimeout > 0 && c.HandlerTimeout >= c.WriteTimeout {
+		errs = append(errs, fmt.Errorf("server.handler_timeout (%v) must be less than server.write_timeout (%v) so the timeout response can be written", c.HandlerTimeout, c.WriteTimeout))
+	}
+	if c.AgentAddress == "" {
+		errs = append(errs, errors.New("agent.address must not be empty"))
+	}
+	for _, t := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"call_timeout", c.AgentCallTimeout},
+		{"session_timeout", c.AgentSessionTimeout},
+		{"ip_update_timeout", c.AgentIpUpdateTimeout},
+	} {
+		if t.d <= 0 {
+			errs = append(errs, fmt.Errorf("agent.%s must be positive, got %v", t.key, t.d))
+		}
+	}
+	if c.AgentOnUnreachable != OnUnreachableFail && c.AgentOnUnreachable != OnUnreachableQueue {
+		errs = append(errs, fmt.Errorf("agent.on_unreachable must be %q or %q, got %q", OnUnreachableFail, OnUnreachableQueue, c.AgentOnUnreachable))
+	}
+	if c.ActivationRetryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("agent.activation_retry_interval must be positive, got %v", c.ActivationRetryInterval))
+	}
+	if c.ActivationTTL <= 0 {
+		errs = append(errs, fmt.Errorf("agent.activation_ttl must be positive, got %v", c.ActivationTTL))
+	}
+	if c.MaxActiveSessions < 0 {
+		errs = append(errs, fmt.Errorf("agent.max_active_sessions must not be negative, got %d", c.MaxActiveSessions))
+	}
+	if c.RejectOverLimit && c.MaxActiveSessions == 0 {
+		errs = append(errs, errors.New("agent.reject_over_limit requires agent.max_active_sessions"))
+	}
+	if strings.ContainsAny(c.SourceIPHeader, " \t:") {
+		errs = append(errs, fmt.Errorf("agent.source_ip_header %q is not a valid header name", c.SourceIPHeader))
+	}
+	if _, err := utils.ParseSourceIPAllowlist(c.SourceIPAllowlist); err != nil {
+		errs = append(errs, fmt.Errorf("agent.source_ip_allowlist: %w", err))
+	}
+	for name, addr := range c.Agents {
+		if name == "" || name == PrimaryAgentName {
+			errs = append(errs, fmt.Errorf("agents: name %q is reserved for the [agent] section", name))
+		}
+		if addr == "" {
+			errs = append(errs, fmt.Errorf("agents.%s: address must not be empty", name))
+		}
+	}
+	if c.MonitorRetryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("monitor.retry_delay must be positive, got %v", c.MonitorRetryDelay))
+	} else if c.MonitorMaxRetryDelay < c.MonitorRetryDelay {
+		errs = append(errs, fmt.Errorf("monitor.max_retry_delay (%v) must not be less than monitor.retry_delay (%v)", c.MonitorMaxRetryDelay, c.MonitorRetryDelay))
+	}
+	if c.MonitorStallTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("monitor.stall_timeout must be positive, got %v", c.MonitorStallTimeout))
+	}
+	if c.ResolveWorkers < 1 {
+		errs = append(errs, fmt.Errorf("monitor.resolve_workers must be at least 1, got %d", c.ResolveWorkers))
+	}
+	for _, ns := range c.DNSNameservers {
+		if _, err := NameserverAddr(ns); err != nil {
+			errs = append(errs, fmt.Errorf("dns.nameservers: %w", err))
+		}
+	}
+	if c.DNSTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("dns.timeout must be positive, got %v", c.DNSTimeout))
+	}
+	if c.DNSIPAuthority != IPAuthorityDocker && c.DNSIPAuthority != IPAuthorityDNS {
+		errs = append(errs, fmt.Errorf("dns.ip_authority must be %q or %q, got %q", IPAuthorityDocker, IPAuthorityDNS, c.DNSIPAuthority))
+	}
+	if c.DNSAuthorityHold < 0 {
+		errs = append(errs, fmt.Errorf("dns.authority_hold must not be negative, got %v", c.DNSAuthorityHold))
+	}
+	if c.TracingEnabled && c.TracingEndpoint == "" {
+		errs = append(errs, errors.New("tracing.otlp_endpoint is required when tracing is enabled"))
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio must be between 0 and 1, got %v", c.TracingSampleRatio))
+	}
+	if c.OIDCEnabled {
+		if c.OIDCRedirectURL == "" {
+			errs = append(errs, errors.New("oidc.redirect_url is required when oidc is enabled"))
+		}
+		if c.OIDCGoogleClientID == "" && c.OIDCGitHubClientID == "" {
+			errs = append(errs, errors.New("oidc is enabled but no provider client ID is configured"))
+		}
+		if c.OIDCGoogleClientID != "" {
+			for _, scope := range requiredOIDCScopes {
+				if !slices.Contains(c.OIDCGoogleScopes, scope) {
+					errs = append(errs, fmt.Errorf("oidc.google_scopes must include %q", scope))
+				}
+			}
+		}
+		switch c.OIDCGitHubGroups {
+		case GitHubGroupsNone:
+		case GitHubGroupsOrgs, GitHubGroupsTeams:
+			if c.OIDCGitHubClientID != "" && !slices.Contains(c.OIDCGitHubScopes, "read:org") {
+				errs = append(errs, fmt.Errorf("oidc.github_scopes must include \"read:org\" when github_groups is %q", c.OIDCGitHubGroups))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("oidc.github_groups must be %q, %q or %q, got %q", GitHubGroupsNone, GitHubGroupsOrgs, GitHubGroupsTeams, c.OIDCGitHubGroups))
+		}
+		if c.OIDCOfflineAccess && len(c.OIDCTokenKey) < MinJWTSecretLength {
+			errs = append(errs, fmt.Errorf("oidc.token_encryption_key must be at least %d bytes when offline_access is enabled; generate one with --gen-jwt-secret", MinJWTSecretLength))
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -25,31 +27,100 @@ func writeTOML(t *testing.T, content string) string {
 func TestLoadFromFileDefaults(t *testing.T) {
 	// An empty TOML file should produce the defaults.
 	path := writeTOML(t, `[auth]
-jwt_secret = "test-secret"
+jwt_secret = "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"
 `)
 	cfg := LoadFromFile(path)
 
 	if cfg.ServerPort != ":443" {
 		t.Errorf("ServerPort: got %q, want %q", cfg.ServerPort, ":443")
 	}
+	if addr, err := cfg.ServerAddr(); err != nil || addr != ":443" {
+		t.Errorf("ServerAddr: got %q, %v, want :443", addr, err)
+	}
+	if tlsCfg, err := cfg.ServerTLSConfig(); err != nil || tlsCfg.MinVersion != tls.VersionTLS12 || len(tlsCfg.CipherSuites) != len(defaultCipherSuites) {
+		t.Errorf("ServerTLSConfig: got %+v, %v, want TLS 1.2 with the default suites", tlsCfg, err)
+	}
+	if cfg.ReadHeaderTimeout != 5*time.Second || cfg.ReadTimeout != 30*time.Second || cfg.WriteTimeout != 60*time.Second || cfg.IdleTimeout != 120*time.Second || cfg.HandlerTimeout != 30*time.Second {
+		t.Errorf("server timeouts: got %v/%v/%v/%v/%v, want 5s/30s/60s/120s/30s", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout, cfg.HandlerTimeout)
+	}
 	if cfg.AgentAddress != "172.21.0.10:50001" {
 		t.Errorf("AgentAddress: got %q, want %q", cfg.AgentAddress, "172.21.0.10:50001")
 	}
 	if cfg.DBDir != "./data" {
 		t.Errorf("DBDir: got %q, want %q", cfg.DBDir, "./data")
 	}
+	if cfg.StaticDir != "static" {
+		t.Errorf("StaticDir: got %q, want %q", cfg.StaticDir, "static")
+	}
 	if cfg.MaxOpenConns != 1 {
 		t.Errorf("MaxOpenConns: got %d, want 1", cfg.MaxOpenConns)
 	}
 	if cfg.ConnMaxLifetime != time.Hour {
 		t.Errorf("ConnMaxLifetime: got %v, want 1h", cfg.ConnMaxLifetime)
 	}
+	if cfg.SlowQueryThreshold != 200*time.Millisecond {
+		t.Errorf("SlowQueryThreshold: got %v, want 200ms", cfg.SlowQueryThreshold)
+	}
+	if cfg.DBBusyTimeout != 5*time.Second || cfg.DBSynchronous != "NORMAL" || cfg.DBCacheSize != -2000 {
+		t.Errorf("Pragmas: got busy_timeout=%v synchronous=%q cache_size=%d", cfg.DBBusyTimeout, cfg.DBSynchronous, cfg.DBCacheSize)
+	}
+	if cfg.MetricsEnabled {
+		t.Error("MetricsEnabled: expected false by default")
+	}
 	if cfg.IpUpdateInterval != 60*time.Second {
 		t.Errorf("IpUpdateInterval: got %v, want 60s", cfg.IpUpdateInterval)
 	}
+	if cfg.MonitorRetryDelay != 5*time.Second || cfg.MonitorMaxRetryDelay != 60*time.Second || cfg.MonitorStableAfter != 10*time.Second {
+		t.Errorf("monitor backoff: got %v/%v/%v, want 5s/60s/10s", cfg.MonitorRetryDelay, cfg.MonitorMaxRetryDelay, cfg.MonitorStableAfter)
+	}
+	if cfg.MonitorStallTimeout != 2*time.Minute {
+		t.Errorf("MonitorStallTimeout: got %v, want 2m", cfg.MonitorStallTimeout)
+	}
+	if cfg.ResolveWorkers != 8 {
+		t.Errorf("ResolveWorkers: got %d, want 8", cfg.ResolveWorkers)
+	}
+	if cfg.AgentOnUnreachable != OnUnreachableFail || cfg.ActivationRetryInterval != 5*time.Second || cfg.ActivationTTL != 5*time.Minute {
+		t.Errorf("activation queue: got %q/%v/%v, want fail/5s/5m", cfg.AgentOnUnreachable, cfg.ActivationRetryInterval, cfg.ActivationTTL)
+	}
+	if cfg.MaxActiveSessions != 0 || cfg.RejectOverLimit {
+		t.Errorf("session limit: got %d/%v, want 0/false", cfg.MaxActiveSessions, cfg.RejectOverLimit)
+	}
+	if cfg.SourceIPHeader != "" || len(cfg.SourceIPAllowlist) != 0 {
+		t.Errorf("source IP: got %q/%v, want request IP and no overrides", cfg.SourceIPHeader, cfg.SourceIPAllowlist)
+	}
+	if cfg.StepUpMaxAge != 5*time.Minute {
+		t.Errorf("StepUpMaxAge: got %v, want 5m", cfg.StepUpMaxAge)
+	}
+	if cfg.DefaultUserRole != "user" {
+		t.Errorf("DefaultUserRole: got %q, want user", cfg.DefaultUserRole)
+	}
+	if cfg.UsernamePattern != "^[a-zA-Z0-9_]{5,30}$" {
+		t.Errorf("UsernamePattern: got %q, want the built-in pattern", cfg.UsernamePattern)
+	}
+	if cfg.LowercaseUsernames {
+		t.Error("LowercaseUsernames: expected false by default")
+	}
+	if cfg.ActiveCheckTTL != 5*time.Second || cfg.DisabledUserResponse != DisabledUserUnauthorized {
+		t.Errorf("disabled users: got %v/%q, want 5s/unauthorized", cfg.ActiveCheckTTL, cfg.DisabledUserResponse)
+	}
+	if len(cfg.DNSNameservers) != 0 || cfg.DNSTimeout != 5*time.Second {
+		t.Errorf("dns: got %v/%v, want system resolver/5s", cfg.DNSNameservers, cfg.DNSTimeout)
+	}
+	if cfg.DNSIPAuthority != IPAuthorityDocker || cfg.DNSAuthorityHold != 10*time.Minute {
+		t.Errorf("dns authority: got %q/%v, want docker/10m", cfg.DNSIPAuthority, cfg.DNSAuthorityHold)
+	}
 	if cfg.OIDCEnabled {
 		t.Error("OIDCEnabled: expected false by default")
 	}
+	if strings.Join(cfg.OIDCGoogleScopes, " ") != "openid profile email" || strings.Join(cfg.OIDCGitHubScopes, " ") != "read:user user:email" || cfg.OIDCOfflineAccess {
+		t.Errorf("OIDC scopes: got google=%v github=%v offline=%v", cfg.OIDCGoogleScopes, cfg.OIDCGitHubScopes, cfg.OIDCOfflineAccess)
+	}
+	if !cfg.OIDCGoogleEnabled || !cfg.OIDCGitHubEnabled {
+		t.Errorf("OIDC providers: expected enabled by default, got google=%v github=%v", cfg.OIDCGoogleEnabled, cfg.OIDCGitHubEnabled)
+	}
+	if cfg.OIDCGitHubGroups != GitHubGroupsNone {
+		t.Errorf("OIDCGitHubGroups: got %q", cfg.OIDCGitHubGroups)
+	}
 	if cfg.OIDCRedirectURL != "https://localhost/api/auth/oidc/callback" {
 		t.Errorf("OIDCRedirectURL: got %q", cfg.OIDCRedirectURL)
 	}
@@ -57,17 +128,31 @@ jwt_secret = "test-secret"
 
 func TestLoadFromFileCustomValues(t *testing.T) {
 	t.Setenv("JWT_SECRET", "")
+	t.Setenv("LISTEN_ADDR", "")
+	t.Setenv("JWT_REQUIRE_RS256", "")
 	tomlContent := `
 [database]
 dir              = "/custom/data"
 max_open_conns   = 5
 max_idle_conns   = 3
 conn_max_lifetime = "30m"
+busy_timeout     = "10s"
+synchronous      = "full"
+cache_size       = 4000
 
 [server]
 port      = ":8443"
+listen_addr = "127.0.0.1"
+tls_min_version = "1.3"
+tls_cipher_suites = ["TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"]
+read_header_timeout = "2s"
+read_timeout = "10s"
+write_timeout = "20s"
+idle_timeout = "0s"
+handler_timeout = "15s"
 cert_file = "custom/server.crt"
 key_file  = "custom/server.key"
+static_dir = "/srv/aegis-ui"
 
 [agent]
 address     = "10.0.0.1:50001"
@@ -76,16 +161,43 @@ key_file    = "custom/ctrl.key"
 ca_file     = "custom/ca.pem"
 server_name = "my-agent"
 call_timeout = "2s"
+session_timeout = "5s"
+on_unreachable = "queue"
+activation_retry_interval = "10s"
+activation_ttl = "15m"
+max_active_sessions = 5000
+reject_over_limit = true
+source_ip_header = "X-VPN-Client-IP"
+source_ip_allowlist = ["10.8.0.0/16", "192.0.2.7"]
 
 [monitor]
 retry_delay        = "10s"
+max_retry_delay    = "2m"
+stable_after       = "30s"
+stall_timeout      = "5m"
 ip_update_interval = "120s"
+resolve_workers    = 16
+
+[dns]
+nameservers = ["10.0.0.2", "10.0.0.3:5353"]
+timeout     = "2s"
+ip_authority   = "dns"
+authority_hold = "30s"
 
 [auth]
-jwt_secret         = "super-secret"
-jwt_token_lifetime = "15m"
-jwt_private_key    = "keys/priv.pem"
-jwt_public_key     = "keys/pub.pem"
+jwt_secret                 = "Zx8Wq2Ls5Tn9Vb3Km7Hp1Rd6Gf4Jc0Ya"
+jwt_token_lifetime         = "15m"
+jwt_private_key            = "keys/priv.pem"
+jwt_public_key             = "keys/pub.pem"
+jwt_public_keys_dir        = "keys/verify"
+require_rs256              = true
+step_up_max_age            = "2m"
+default_user_role          = "guest"
+default_service_role       = " operators "
+username_pattern           = '[a-z.]+@example\.com'
+case_insensitive_usernames = true
+active_check_ttl           = "30s"
+disabled_user_response     = "forbidden"
 
 [oidc]
 enabled          = true
@@ -93,11 +205,28 @@ google_client_id = "google-id"
 google_secret    = "google-secret"
 github_client_id = "github-id"
 github_secret    = "github-secret"
+github_enabled   = false
 redirect_url     = "https://example.com/callback"
 role_mapping_rules = '{"default_role":"user"}'
+
+[tracing]
+enabled       = true
+otlp_endpoint = "otel-collector:4318"
+insecure      = true
+sample_ratio  = 0.25
+
+[agents]
+zone-b = "10.1.0.10:50001"
 `
 	path := writeTOML(t, tomlContent)
 	cfg := LoadFromFile(path)
+	if !cfg.TracingEnabled || cfg.TracingEndpoint != "otel-collector:4318" || !cfg.TracingInsecure || cfg.TracingSampleRatio != 0.25 {
+		t.Errorf("tracing: got %v/%q/%v/%v, want enabled, otel-collector:4318, insecure, 0.25",
+			cfg.TracingEnabled, cfg.TracingEndpoint, cfg.TracingInsecure, cfg.TracingSampleRatio)
+	}
+	if cfg.Agents["zone-b"] != "10.1.0.10:50001" {
+		t.Errorf("Agents: got %v", cfg.Agents)
+	}
 
 	if cfg.DBDir != "/custom/data" {
 		t.Errorf("DBDir: got %q, want /custom/data", cfg.DBDir)
@@ -111,12 +240,28 @@ role_mapping_rules = '{"default_role":"user"}'
 	if cfg.ConnMaxLifetime != 30*time.Minute {
 		t.Errorf("ConnMaxLifetime: got %v, want 30m", cfg.ConnMaxLifetime)
 	}
+	if cfg.DBBusyTimeout != 10*time.Second || cfg.DBSynchronous != "FULL" || cfg.DBCacheSize != 4000 {
+		t.Errorf("Pragmas: got busy_timeout=%v synchronous=%q cache_size=%d", cfg.DBBusyTimeout, cfg.DBSynchronous, cfg.DBCacheSize)
+	}
 	if cfg.ServerPort != ":8443" {
 		t.Errorf("ServerPort: got %q, want :8443", cfg.ServerPort)
 	}
+	if addr, err := cfg.ServerAddr(); err != nil || addr != "127.0.0.1:8443" {
+		t.Errorf("ServerAddr: got %q, %v, want 127.0.0.1:8443", addr, err)
+	}
+	tlsCfg, err := cfg.ServerTLSConfig()
+	if err != nil || tlsCfg.MinVersion != tls.VersionTLS13 || len(tlsCfg.CipherSuites) != 1 || tlsCfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("ServerTLSConfig: got %+v, %v", tlsCfg, err)
+	}
+	if cfg.ReadHeaderTimeout != 2*time.Second || cfg.ReadTimeout != 10*time.Second || cfg.WriteTimeout != 20*time.Second || cfg.IdleTimeout != 0 || cfg.HandlerTimeout != 15*time.Second {
+		t.Errorf("server timeouts: got %v/%v/%v/%v/%v, want 2s/10s/20s/0s/15s", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout, cfg.HandlerTimeout)
+	}
 	if cfg.CertFile != "custom/server.crt" {
 		t.Errorf("CertFile: got %q", cfg.CertFile)
 	}
+	if cfg.StaticDir != "/srv/aegis-ui" {
+		t.Errorf("StaticDir: got %q", cfg.StaticDir)
+	}
 	if cfg.AgentAddress != "10.0.0.1:50001" {
 		t.Errorf("AgentAddress: got %q", cfg.AgentAddress)
 	}
@@ -126,27 +271,88 @@ role_mapping_rules = '{"default_role":"user"}'
 	if cfg.AgentCallTimeout != 2*time.Second {
 		t.Errorf("AgentCallTimeout: got %v, want 2s", cfg.AgentCallTimeout)
 	}
+	// ip_update_timeout is unset, so IP pushes use call_timeout.
+	if cfg.AgentSessionTimeout != 5*time.Second || cfg.AgentIpUpdateTimeout != 2*time.Second {
+		t.Errorf("per-operation timeouts: got %v/%v, want 5s/2s", cfg.AgentSessionTimeout, cfg.AgentIpUpdateTimeout)
+	}
+	if cfg.AgentOnUnreachable != OnUnreachableQueue || cfg.ActivationRetryInterval != 10*time.Second || cfg.ActivationTTL != 15*time.Minute {
+		t.Errorf("activation queue: got %q/%v/%v, want queue/10s/15m", cfg.AgentOnUnreachable, cfg.ActivationRetryInterval, cfg.ActivationTTL)
+	}
+	if cfg.MaxActiveSessions != 5000 || !cfg.RejectOverLimit {
+		t.Errorf("session limit: got %d/%v, want 5000/true", cfg.MaxActiveSessions, cfg.RejectOverLimit)
+	}
+	if cfg.SourceIPHeader != "X-VPN-Client-IP" || len(cfg.SourceIPAllowlist) != 2 {
+		t.Errorf("source IP: got %q/%v, want X-VPN-Client-IP and two networks", cfg.SourceIPHeader, cfg.SourceIPAllowlist)
+	}
 	if cfg.MonitorRetryDelay != 10*time.Second {
 		t.Errorf("MonitorRetryDelay: got %v, want 10s", cfg.MonitorRetryDelay)
 	}
+	if cfg.MonitorMaxRetryDelay != 2*time.Minute {
+		t.Errorf("MonitorMaxRetryDelay: got %v, want 2m", cfg.MonitorMaxRetryDelay)
+	}
+	if cfg.MonitorStableAfter != 30*time.Second {
+		t.Errorf("MonitorStableAfter: got %v, want 30s", cfg.MonitorStableAfter)
+	}
+	if cfg.MonitorStallTimeout != 5*time.Minute {
+		t.Errorf("MonitorStallTimeout: got %v, want 5m", cfg.MonitorStallTimeout)
+	}
 	if cfg.IpUpdateInterval != 120*time.Second {
 		t.Errorf("IpUpdateInterval: got %v, want 120s", cfg.IpUpdateInterval)
 	}
-	if cfg.JwtKey != "super-secret" {
+	if cfg.ResolveWorkers != 16 {
+		t.Errorf("ResolveWorkers: got %d, want 16", cfg.ResolveWorkers)
+	}
+	if got := cfg.Nameservers(); len(got) != 2 || got[0] != "10.0.0.2:53" || got[1] != "10.0.0.3:5353" {
+		t.Errorf("Nameservers: got %v, want [10.0.0.2:53 10.0.0.3:5353]", got)
+	}
+	if cfg.DNSTimeout != 2*time.Second {
+		t.Errorf("DNSTimeout: got %v, want 2s", cfg.DNSTimeout)
+	}
+	if cfg.DNSIPAuthority != IPAuthorityDNS || cfg.DNSAuthorityHold != 30*time.Second {
+		t.Errorf("dns authority: got %q/%v, want dns/30s", cfg.DNSIPAuthority, cfg.DNSAuthorityHold)
+	}
+	if cfg.JwtKey != "Zx8Wq2Ls5Tn9Vb3Km7Hp1Rd6Gf4Jc0Ya" {
 		t.Errorf("JwtKey: got %q", cfg.JwtKey)
 	}
 	if cfg.JwtTokenLifetime != 15*time.Minute {
 		t.Errorf("JwtTokenLifetime: got %v, want 15m", cfg.JwtTokenLifetime)
 	}
+	if cfg.StepUpMaxAge != 2*time.Minute {
+		t.Errorf("StepUpMaxAge: got %v, want 2m", cfg.StepUpMaxAge)
+	}
+	if cfg.DefaultUserRole != "guest" {
+		t.Errorf("DefaultUserRole: got %q, want guest", cfg.DefaultUserRole)
+	}
+	if cfg.DefaultServiceRole != "operators" {
+		t.Errorf("DefaultServiceRole: got %q, want operators", cfg.DefaultServiceRole)
+	}
+	if cfg.UsernamePattern != `[a-z.]+@example\.com` {
+		t.Errorf("UsernamePattern: got %q, want [a-z.]+@example\\.com", cfg.UsernamePattern)
+	}
+	if !cfg.LowercaseUsernames {
+		t.Error("LowercaseUsernames: expected true")
+	}
+	if cfg.ActiveCheckTTL != 30*time.Second || cfg.DisabledUserResponse != DisabledUserForbidden {
+		t.Errorf("disabled users: got %v/%q, want 30s/forbidden", cfg.ActiveCheckTTL, cfg.DisabledUserResponse)
+	}
 	if cfg.JwtPrivateKey != "keys/priv.pem" {
 		t.Errorf("JwtPrivateKey: got %q", cfg.JwtPrivateKey)
 	}
+	if cfg.JwtPublicKeysDir != "keys/verify" {
+		t.Errorf("JwtPublicKeysDir: got %q", cfg.JwtPublicKeysDir)
+	}
+	if !cfg.JwtRequireRS256 {
+		t.Error("JwtRequireRS256: expected true")
+	}
 	if !cfg.OIDCEnabled {
 		t.Error("OIDCEnabled: expected true")
 	}
 	if cfg.OIDCGoogleClientID != "google-id" {
 		t.Errorf("OIDCGoogleClientID: got %q", cfg.OIDCGoogleClientID)
 	}
+	if !cfg.OIDCGoogleEnabled || cfg.OIDCGitHubEnabled {
+		t.Errorf("OIDC providers: expected google enabled and github disabled, got %v and %v", cfg.OIDCGoogleEnabled, cfg.OIDCGitHubEnabled)
+	}
 	if cfg.OIDCGitHubClientID != "github-id" {
 		t.Errorf("OIDCGitHubClientID: got %q", cfg.OIDCGitHubClientID)
 	}
@@ -158,6 +364,39 @@ role_mapping_rules = '{"default_role":"user"}'
 	}
 }
 
+func TestRequireRS256EnvOverride(t *testing.T) {
+	path := writeTOML(t, `[auth]
+require_rs256 = false
+`)
+	t.Setenv("JWT_REQUIRE_RS256", "true")
+	cfg, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !cfg.JwtRequireRS256 {
+		t.Error("JwtRequireRS256: expected the environment to override the file")
+	}
+
+	t.Setenv("JWT_REQUIRE_RS256", "sometimes")
+	if _, err := Read(path); err == nil || !strings.Contains(err.Error(), "JWT_REQUIRE_RS256") {
+		t.Errorf("Expected an error naming JWT_REQUIRE_RS256, got %v", err)
+	}
+}
+
+func TestListenAddrEnvOverride(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", "::1")
+	path := writeTOML(t, `[server]
+listen_addr = "127.0.0.1"
+`)
+	cfg, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if addr, err := cfg.ServerAddr(); err != nil || addr != "[::1]:443" {
+		t.Errorf("ServerAddr: got %q, %v, want [::1]:443", addr, err)
+	}
+}
+
 func TestLoadFromFileMissingFile(t *testing.T) {
 	// A non existent path should fall back to built-in defaults (no fatal).
 	def := defaults()
@@ -189,7 +428,7 @@ func TestLoadFromFileSampleConfig(t *testing.T) {
 	for _, line := range splitLines(content) {
 		trimmed := strings.TrimLeft(line, " \t")
 		if strings.HasPrefix(trimmed, "jwt_secret") && strings.ContainsRune(trimmed, '=') {
-			patched += `jwt_secret = "test-secret"` + "\n"
+			patched += `jwt_secret = "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"` + "\n"
 		} else {
 			patched += line + "\n"
 		}
@@ -223,6 +462,169 @@ func TestParseDuration(t *testing.T) {
 	}
 }
 
+func TestReadInvalidTOML(t *testing.T) {
+	path := writeTOML(t, "[server\nport = ")
+	if _, err := Read(path); err == nil {
+		t.Error("expected an error for malformed TOML")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := buildConfig(defaults())
+		cfg.JwtKey = "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(cfg *Config)
+		wantErr string
+	}{
+		{"Valid defaults", func(cfg *Config) {}, ""},
+		{"Placeholder JWT secret", func(cfg *Config) { cfg.JwtKey = "CHANGE_ME" }, "jwt_secret"},
+		{"Short JWT secret", func(cfg *Config) { cfg.JwtKey = "test-secret" }, "at least 32"},
+		{"Repetitive JWT secret", func(cfg *Config) { cfg.JwtKey = "passwordpasswordpasswordpassword" }, "too predictable"},
+		{"Hex JWT secret", func(cfg *Config) { cfg.JwtKey = "9f86d081884c7d659a2feaa0c55ad015" }, ""},
+		{"Zero step-up max age", func(cfg *Config) { cfg.StepUpMaxAge = 0 }, "auth.step_up_max_age"},
+		{"Unknown JWT algorithm", func(cfg *Config) { cfg.JwtAlgorithm = "PS256" }, "auth.jwt_algorithm"},
+		{"ES256 JWT algorithm", func(cfg *Config) { cfg.JwtAlgorithm = JWTAlgorithmES256 }, ""},
+		{"RS256 required without keys", func(cfg *Config) { cfg.JwtRequireRS256 = true; cfg.JwtPrivateKey = "" }, "auth.require_rs256"},
+		{"Empty default user role", func(cfg *Config) { cfg.DefaultUserRole = "" }, "auth.default_user_role"},
+		{"Invalid username pattern", func(cfg *Config) { cfg.UsernamePattern = "[a-z" }, "auth.username_pattern"},
+		{"Email username pattern", func(cfg *Config) { cfg.UsernamePattern = `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}` }, ""},
+		{"No open connections", func(cfg *Config) { cfg.MaxOpenConns = 0 }, "max_open_conns"},
+		{"Negative busy timeout", func(cfg *Config) { cfg.DBBusyTimeout = -time.Second }, "database.busy_timeout"},
+		{"Unknown synchronous mode", func(cfg *Config) { cfg.DBSynchronous = "FAST" }, "database.synchronous"},
+		{"Localhost listen address", func(cfg *Config) { cfg.ListenAddr = "localhost" }, ""},
+		{"Hostname listen address", func(cfg *Config) { cfg.ListenAddr = "proxy.internal" }, "server.listen_addr"},
+		{"Listen address and host in port", func(cfg *Config) { cfg.ListenAddr = "127.0.0.1"; cfg.ServerPort = "10.0.0.1:443" }, "conflicts"},
+		{"Port without colon", func(cfg *Config) { cfg.ServerPort = "443" }, "server.port"},
+		{"TLS 1.3 only", func(cfg *Config) { cfg.TLSMinVersion = "1.3" }, ""},
+		{"TLS 1.0", func(cfg *Config) { cfg.TLSMinVersion = "1.0" }, "server.tls_min_version"},
+		{"Insecure cipher suite", func(cfg *Config) { cfg.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, "server.tls_cipher_suites"},
+		{"No HTTP/2 cipher suite", func(cfg *Config) { cfg.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"} }, "HTTP/2"},
+		{"Negative read timeout", func(cfg *Config) { cfg.ReadTimeout = -time.Second }, "server.read_timeout"},
+		{"Handler timeout not below write timeout", func(cfg *Config) { cfg.HandlerTimeout = cfg.WriteTimeout }, "server.handler_timeout"},
+		{"No write timeout", func(cfg *Config) { cfg.WriteTimeout = 0 }, ""},
+		{"Port out of range", func(cfg *Config) { cfg.ServerPort = ":70000" }, "server.port"},
+		{"Missing agent address", func(cfg *Config) { cfg.AgentAddress = "" }, "agent.address"},
+		{"Zero session timeout", func(cfg *Config) { cfg.AgentSessionTimeout = 0 }, "agent.session_timeout"},
+		{"Negative active check TTL", func(cfg *Config) { cfg.ActiveCheckTTL = -time.Second }, "auth.active_check_ttl"},
+		{"Unknown disabled user response", func(cfg *Config) { cfg.DisabledUserResponse = "redirect" }, "auth.disabled_user_response"},
+		{"Unknown on_unreachable", func(cfg *Config) { cfg.AgentOnUnreachable = "retry" }, "agent.on_unreachable"},
+		{"Zero activation TTL", func(cfg *Config) { cfg.ActivationTTL = 0 }, "agent.activation_ttl"},
+		{"Negative session limit", func(cfg *Config) { cfg.MaxActiveSessions = -1 }, "agent.max_active_sessions"},
+		{"Reject without a session limit", func(cfg *Config) { cfg.RejectOverLimit = true }, "agent.reject_over_limit"},
+		{"Rejecting session limit", func(cfg *Config) { cfg.MaxActiveSessions = 100; cfg.RejectOverLimit = true }, ""},
+		{"Source IP header", func(cfg *Config) { cfg.SourceIPHeader = "X-VPN-Client-IP" }, ""},
+		{"Source IP header with a colon", func(cfg *Config) { cfg.SourceIPHeader = "X-VPN:" }, "agent.source_ip_header"},
+		{"Source IP allowlist", func(cfg *Config) { cfg.SourceIPAllowlist = []string{"10.8.0.0/16", "192.0.2.7"} }, ""},
+		{"IPv6 source IP network", func(cfg *Config) { cfg.SourceIPAllowlist = []string{"fd00::/8"} }, "only IPv4"},
+		{"Bad source IP network", func(cfg *Config) { cfg.SourceIPAllowlist = []string{"10.8.0.0/33"} }, "agent.source_ip_allowlist"},
+		{"Zero retry delay", func(cfg *Config) { cfg.MonitorRetryDelay = 0 }, "monitor.retry_delay"},
+		{"Max retry delay below base", func(cfg *Config) { cfg.MonitorMaxRetryDelay = time.Second }, "monitor.max_retry_delay"},
+		{"Zero stall timeout", func(cfg *Config) { cfg.MonitorStallTimeout = 0 }, "monitor.stall_timeout"},
+		{"No resolve workers", func(cfg *Config) { cfg.ResolveWorkers = 0 }, "monitor.resolve_workers"},
+		{"IPv6 nameserver", func(cfg *Config) { cfg.DNSNameservers = []string{"fd00::53", "[fd00::54]:53"} }, ""},
+		{"Nameserver hostname", func(cfg *Config) { cfg.DNSNameservers = []string{"dns.internal"} }, "dns.nameservers"},
+		{"Nameserver bad port", func(cfg *Config) { cfg.DNSNameservers = []string{"10.0.0.2:dns-ish"} }, "invalid port"},
+		{"Zero DNS timeout", func(cfg *Config) { cfg.DNSTimeout = 0 }, "dns.timeout"},
+		{"Unknown IP authority", func(cfg *Config) { cfg.DNSIPAuthority = "agent" }, "dns.ip_authority"},
+		{"No authority hold", func(cfg *Config) { cfg.DNSAuthorityHold = 0 }, ""},
+		{"Tracing without endpoint", func(cfg *Config) { cfg.TracingEnabled, cfg.TracingEndpoint = true, "" }, "tracing.otlp_endpoint"},
+		{"Sample ratio above 1", func(cfg *Config) { cfg.TracingSampleRatio = 1.5 }, "tracing.sample_ratio"},
+		{"OIDC without provider", func(cfg *Config) { cfg.OIDCEnabled = true }, "no provider"},
+		{"Google without email scope", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGoogleClientID, cfg.OIDCGoogleScopes = true, "google-client", []string{"openid", "profile"}
+		}, `oidc.google_scopes must include "email"`},
+		{"GitHub with custom scopes", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGitHubClientID, cfg.OIDCGitHubScopes = true, "github-client", []string{"read:user"}
+		}, ""},
+		{"GitHub teams without read:org", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGitHubClientID, cfg.OIDCGitHubGroups = true, "github-client", GitHubGroupsTeams
+		}, `oidc.github_scopes must include "read:org"`},
+		{"GitHub orgs with read:org", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGitHubClientID, cfg.OIDCGitHubGroups = true, "github-client", GitHubGroupsOrgs
+			cfg.OIDCGitHubScopes = []string{"read:user", "user:email", "read:org"}
+		}, ""},
+		{"Unknown GitHub groups", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGitHubClientID, cfg.OIDCGitHubGroups = true, "github-client", "members"
+		}, "oidc.github_groups"},
+		{"Offline access without key", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGitHubClientID, cfg.OIDCOfflineAccess = true, "github-client", true
+		}, "oidc.token_encryption_key"},
+		{"Offline access with key", func(cfg *Config) {
+			cfg.OIDCEnabled, cfg.OIDCGoogleClientID, cfg.OIDCOfflineAccess, cfg.OIDCTokenKey = true, "google-client", true, "9f86d081884c7d659a2feaa0c55ad015"
+		}, ""},
+		{"Extra agent named primary", func(cfg *Config) { cfg.Agents = map[string]string{"primary": "10.0.0.2:50001"} }, "reserved"},
+		{"Extra agent without address", func(cfg *Config) { cfg.Agents = map[string]string{"zone-b": ""} }, "agents.zone-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.mutate(cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGenerateJWTSecret(t *testing.T) {
+	a, err := GenerateJWTSecret()
+	if err != nil {
+		t.Fatalf("GenerateJWTSecret failed: %v", err)
+	}
+	b, _ := GenerateJWTSecret()
+	if a == b {
+		t.Error("expected two generated secrets to differ")
+	}
+	if err := checkJWTSecret(a); err != nil {
+		t.Errorf("generated secret rejected: %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := buildConfig(defaults())
+	cfg.JwtKey = "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"
+	cfg.OIDCGoogleSecret = "google-client-secret"
+	cfg.OIDCGitHubSecret = "github-client-secret"
+	cfg.OIDCTokenKey = "oidc-token-encryption-key-0123456789"
+	cfg.Agents = map[string]string{"zone-b": "10.1.0.10:50001"}
+
+	redacted := cfg.Redacted()
+	out := fmt.Sprintf("%+v", *redacted)
+	for _, secret := range []string{cfg.JwtKey, cfg.OIDCGoogleSecret, cfg.OIDCGitHubSecret, cfg.OIDCTokenKey} {
+		if strings.Contains(out, secret) {
+			t.Errorf("redacted output contains secret %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "10.1.0.10:50001") || !strings.Contains(out, cfg.ServerPort) {
+		t.Errorf("redacted output lost non-secret settings: %s", out)
+	}
+
+	if cfg.JwtKey != "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA" {
+		t.Error("Redacted modified the original config")
+	}
+	redacted.Agents["zone-c"] = "10.2.0.10:50001"
+	if _, ok := cfg.Agents["zone-c"]; ok {
+		t.Error("Redacted shares the Agents map with the original config")
+	}
+
+	cfg.OIDCGitHubSecret = ""
+	if cfg.Redacted().OIDCGitHubSecret != "" {
+		t.Error("expected an unset secret to stay empty")
+	}
+}
+
 // splitLines splits a string into lines without adding newlines.
 func splitLines(s string) []string {
 	var lines []string
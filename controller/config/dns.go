@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// defaultDNSPort is used for nameservers given without a port.
+const defaultDNSPort = "53"
+
+// NameserverAddr returns ns as an ip:port address, adding port 53 when ns has no port.
+// Nameservers must be IP addresses, since they cannot be resolved themselves.
+func NameserverAddr(ns string) (string, error) {
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		host, port = ns, defaultDNSPort
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("nameserver %q must be an IP address with an optional port", ns)
+	}
+	if _, err := net.LookupPort("udp", port); err != nil {
+		return "", fmt.Errorf("nameserver %q has an invalid port", ns)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Nameservers returns the configured nameservers as ip:port addresses. Invalid entries, which
+// Validate reports, are skipped.
+func (c *Config) Nameservers() []string {
+	addrs := make([]string, 0, len(c.DNSNameservers))
+	for _, ns := range c.DNSNameservers {
+		if addr, err := NameserverAddr(ns); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
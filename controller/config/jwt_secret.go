@@ -0,0 +1,56 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+)
+
+const (
+	// MinJWTSecretLength is the shortest HS256 secret, in bytes, the controller accepts.
+	MinJWTSecretLength = 32
+	// minJWTSecretEntropyBits is the lowest estimated entropy accepted for an HS256 secret. It rejects
+	// long but repetitive secrets such as a word typed several times.
+	minJWTSecretEntropyBits = 96
+)
+
+// GenerateJWTSecret returns a random secret suitable for auth.jwt_secret.
+func GenerateJWTSecret() (string, error) {
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkJWTSecret rejects secrets that are short or low in entropy, since HS256 tokens signed with
+// them can be brute-forced offline.
+func checkJWTSecret(secret string) error {
+	if len(secret) < MinJWTSecretLength {
+		return fmt.Errorf("auth.jwt_secret is %d bytes, must be at least %d; generate one with --gen-jwt-secret", len(secret), MinJWTSecretLength)
+	}
+	if bits := secretEntropyBits(secret); bits < minJWTSecretEntropyBits {
+		return fmt.Errorf("auth.jwt_secret is too predictable (about %.0f bits of entropy, need %d); generate one with --gen-jwt-secret", bits, minJWTSecretEntropyBits)
+	}
+	return nil
+}
+
+// secretEntropyBits estimates the entropy of s from its byte frequencies. It is an upper bound for
+// human-chosen secrets but catches repetition and small alphabets.
+func secretEntropyBits(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	n := float64(len(s))
+	perByte := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * n
+}
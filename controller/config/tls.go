@@ -0,0 +1,68 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+)
+
+// tlsVersions maps the accepted values of server.tls_min_version to their protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are offered to TLS 1.2 clients when server.tls_cipher_suites is empty: forward
+// secret AEAD suites only. TLS 1.3 suites are not configurable and always enabled.
+var defaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+// http2CipherSuites are the suites of which HTTP/2 requires at least one when TLS 1.2 is allowed.
+var http2CipherSuites = []string{
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+}
+
+// CipherSuiteIDs returns the IDs of the named cipher suites. Suites Go considers insecure are rejected.
+func CipherSuiteIDs(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, tls.CipherSuites()[i].ID)
+	}
+	return ids, nil
+}
+
+// ServerTLSConfig builds the TLS settings of the HTTPS server from server.tls_min_version and
+// server.tls_cipher_suites, offering HTTP/2 through ALPN. Certificates are added by the caller.
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("server.tls_min_version must be 1.2 or 1.3, got %q", c.TLSMinVersion)
+	}
+	names := c.TLSCipherSuites
+	if len(names) == 0 {
+		names = defaultCipherSuites
+	}
+	suites, err := CipherSuiteIDs(names)
+	if err != nil {
+		return nil, fmt.Errorf("server.tls_cipher_suites: %w", err)
+	}
+	if minVersion < tls.VersionTLS13 && !slices.ContainsFunc(names, func(n string) bool { return slices.Contains(http2CipherSuites, n) }) {
+		return nil, fmt.Errorf("server.tls_cipher_suites must include %s or %s for HTTP/2", http2CipherSuites[0], http2CipherSuites[1])
+	}
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
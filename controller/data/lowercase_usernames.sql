@@ -0,0 +1,15 @@
+-- Lowercases every username, as auth.case_insensitive_usernames expects: with it enabled, usernames are
+-- lowercased before they are looked up, so other accounts could no longer sign in. Run this once before
+-- enabling the option. Usernames that differ only in case would become the same account, so it stops
+-- without changing anything while any exist; `aegis-controller --check` lists them.
+CREATE TEMP TABLE username_case_collisions (count INTEGER);
+CREATE TEMP TRIGGER username_case_collisions_abort BEFORE INSERT ON username_case_collisions WHEN NEW.count > 0
+BEGIN
+    SELECT RAISE(ABORT, 'usernames differ only in case; run aegis-controller --check to list them and merge or rename them first');
+END;
+INSERT INTO username_case_collisions SELECT COUNT(*) FROM (
+    SELECT 1 FROM users GROUP BY username COLLATE NOCASE HAVING COUNT(*) > 1
+);
+DROP TABLE username_case_collisions;
+
+UPDATE users SET username = lower(username) WHERE username != lower(username);
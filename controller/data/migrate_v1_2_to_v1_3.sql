@@ -0,0 +1,5 @@
+-- Add per-service agent targeting. Existing services stay on the primary agent.
+ALTER TABLE services ADD COLUMN agent TEXT NOT NULL DEFAULT 'primary';
+
+-- Create index for looking up the services an agent enforces
+CREATE INDEX IF NOT EXISTS idx_services_agent ON services(agent);
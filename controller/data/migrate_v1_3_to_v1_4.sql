@@ -0,0 +1,149 @@
+-- Personal API tokens for programmatic access. Only a SHA-256 hash of each token is stored.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scope TEXT NOT NULL DEFAULT 'full',
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Create index for listing a user's tokens
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+-- Services a token with the 'services' scope may activate and deactivate
+CREATE TABLE IF NOT EXISTS api_token_services (
+    token_id INTEGER NOT NULL,
+    service_id INTEGER NOT NULL,
+    PRIMARY KEY (token_id, service_id),
+    FOREIGN KEY(token_id) REFERENCES api_tokens(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+-- Selections queued while the enforcing agent was unreachable, retried until they succeed or expire
+CREATE TABLE IF NOT EXISTS pending_activations (
+    user_id INTEGER NOT NULL,
+    service_id INTEGER NOT NULL,
+    client_ip TEXT NOT NULL,
+    requested_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, service_id),
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
+
+-- Services that need a recent re-authentication before they can be activated
+ALTER TABLE services ADD COLUMN requires_step_up INTEGER NOT NULL DEFAULT 0;
+
+-- Last port of the contiguous range a service covers from its port; 0 when it is a single port
+ALTER TABLE services ADD COLUMN port_range_end INTEGER NOT NULL DEFAULT 0;
+
+-- Address set each service's hostname resolved to in the last IP sync, so a restarted controller
+-- only pushes addresses that really changed
+ALTER TABLE services ADD COLUMN resolved_ips TEXT NOT NULL DEFAULT '';
+
+-- Which writer last set each service's address ('dns' or 'docker') and when, so dns.ip_authority can
+-- keep one from immediately undoing the other
+ALTER TABLE services ADD COLUMN ip_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE services ADD COLUMN ip_updated_at DATETIME;
+
+-- Docker container (ID or name) bound to each service; the watcher updates the service whenever that
+-- container starts instead of matching containers by hostname. '' when unbound
+ALTER TABLE services ADD COLUMN container TEXT NOT NULL DEFAULT '';
+
+-- Client IP of each user's most recent login, used when an admin activates a service on their behalf
+ALTER TABLE users ADD COLUMN last_login_ip TEXT;
+
+-- Refresh tokens issued by OIDC providers with offline access, encrypted with oidc.token_encryption_key
+CREATE TABLE IF NOT EXISTS oidc_refresh_tokens (
+    user_id INTEGER PRIMARY KEY,
+    provider TEXT NOT NULL,
+    token TEXT NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Capabilities granted to each role; management endpoints check these rather than role names
+CREATE TABLE IF NOT EXISTS role_capabilities (
+    role_id INTEGER NOT NULL,
+    capability TEXT NOT NULL,
+    PRIMARY KEY (role_id, capability),
+    FOREIGN KEY(role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+-- Seed the built-in roles with the access they had before capabilities
+INSERT OR IGNORE INTO role_capabilities (role_id, capability)
+SELECT r.id, c.capability FROM roles r, (
+    SELECT 'manage_users' AS capability UNION ALL SELECT 'manage_roles' UNION ALL SELECT 'manage_services'
+    UNION ALL SELECT 'view_management' UNION ALL SELECT 'view_sessions' UNION ALL SELECT 'export_policy' UNION ALL SELECT 'import_policy'
+    UNION ALL SELECT 'override_source_ip'
+) c WHERE r.name = 'root';
+
+INSERT OR IGNORE INTO role_capabilities (role_id, capability)
+SELECT r.id, c.capability FROM roles r, (
+    SELECT 'manage_users' AS capability UNION ALL SELECT 'manage_services'
+    UNION ALL SELECT 'view_management' UNION ALL SELECT 'view_sessions' UNION ALL SELECT 'export_policy'
+) c WHERE r.name = 'admin';
+
+-- Read-only role for security reviews: it can list users, roles, services and sessions but change nothing
+INSERT OR IGNORE INTO roles (name, description) VALUES ('auditor', 'Read-only access to users, roles, services and sessions');
+
+INSERT OR IGNORE INTO role_capabilities (role_id, capability)
+SELECT r.id, c.capability FROM roles r, (
+    SELECT 'view_management' AS capability UNION ALL SELECT 'view_sessions'
+) c WHERE r.name = 'auditor';
+
+-- Service and role names are unique regardless of case, so "Prod" and "prod" cannot coexist. The
+-- indexes cannot be built while such names exist: stop with an error instead, and list them with
+-- `aegis-controller --check` so they can be renamed before running this again.
+CREATE TEMP TABLE name_case_collisions (count INTEGER);
+CREATE TEMP TRIGGER name_case_collisions_abort BEFORE INSERT ON name_case_collisions WHEN NEW.count > 0
+BEGIN
+    SELECT RAISE(ABORT, 'service or role names differ only in case; run aegis-controller --check to list them and rename them first');
+END;
+INSERT INTO name_case_collisions SELECT COUNT(*) FROM (
+    SELECT 1 FROM services GROUP BY name COLLATE NOCASE HAVING COUNT(*) > 1
+    UNION ALL
+    SELECT 1 FROM roles GROUP BY name COLLATE NOCASE HAVING COUNT(*) > 1
+);
+DROP TABLE name_case_collisions;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_services_name_nocase ON services(name COLLATE NOCASE);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_roles_name_nocase ON roles(name COLLATE NOCASE);
+
+-- Raised whenever the tokens issued to a user must stop working: on a role change, a password reset by
+-- an admin and when the account is disabled. Access tokens carry the generation they were issued at
+-- and are refused once it is stale
+ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0;
+
+-- Accounts are disabled directly in the database, so the generation is raised by a trigger
+CREATE TRIGGER IF NOT EXISTS users_disabled_token_generation
+AFTER UPDATE OF is_active ON users
+WHEN OLD.is_active AND NOT NEW.is_active
+BEGIN
+    UPDATE users SET token_generation = token_generation + 1 WHERE id = NEW.id;
+END;
+
+-- How a service's hostname is read: 'host' is a hostname or IP and port resolved to a single address,
+-- 'cidr' is "network/bits:port", every address of the network, stored with ip holding the network
+-- address and never resolved
+ALTER TABLE services ADD COLUMN destination_type TEXT NOT NULL DEFAULT 'host';
+
+-- Timestamps are stored in UTC without an offset, like CURRENT_TIMESTAMP, so they compare correctly
+-- as text. Convert the ones written with the controller's local offset
+UPDATE user_active_services SET updated_at = datetime(updated_at) WHERE updated_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+UPDATE pending_activations SET requested_at = datetime(requested_at) WHERE requested_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+UPDATE services SET ip_updated_at = datetime(ip_updated_at) WHERE ip_updated_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+UPDATE refresh_tokens SET expires_at = datetime(expires_at) WHERE expires_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+UPDATE api_tokens SET expires_at = datetime(expires_at) WHERE expires_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+UPDATE api_tokens SET last_used_at = datetime(last_used_at) WHERE last_used_at GLOB '*[+-][0-9][0-9]:[0-9][0-9]';
+
+-- The client address a session was opened for, so the session can be reinstalled on an agent that
+-- lost its rules. Sessions opened before fall back to the user's last login address
+ALTER TABLE user_active_services ADD COLUMN client_ip TEXT NOT NULL DEFAULT '';
+
+-- The longest idle timeout, in seconds, of the sessions of a role's users. It wins over the default
+-- timeout where it is shorter; NULL leaves the default
+ALTER TABLE roles ADD COLUMN max_ttl INTEGER;
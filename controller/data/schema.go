@@ -0,0 +1,32 @@
+// Package data embeds the SQL scripts used to create the Aegis database.
+package data
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed *.sql
+var scripts embed.FS
+
+// schemaScripts are the scripts that build the current schema on an empty database, in order.
+// init.sql already contains the v1.1.1 services layout, so only later migrations follow it.
+var schemaScripts = []string{
+	"init.sql",
+	"migrate_v1_1_1_to_v1_2.sql",
+	"migrate_v1_2_to_v1_3.sql",
+	"migrate_v1_3_to_v1_4.sql",
+}
+
+// Schema returns the SQL scripts that build the current production schema, in the order they must run.
+func Schema() ([]string, error) {
+	out := make([]string, 0, len(schemaScripts))
+	for _, name := range schemaScripts {
+		b, err := scripts.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		out = append(out, string(b))
+	}
+	return out, nil
+}
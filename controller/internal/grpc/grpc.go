@@ -1,48 +1,131 @@
 package grpc
 
 import (
+	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
 	"Aegis/controller/proto"
+	"context"
 	"fmt"
 	"log"
+	"maps"
 	"net"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
-const (
-	baseDelay      = 1 * time.Second
-	maxDelay       = 60 * time.Second
-	resetThreshold = 10 * time.Second
-)
-
 // SessionConfig holds config for the session manager.
 type SessionConfig struct {
 	IpUpdateInterval time.Duration
+	// IpUpdateTimeout bounds each call sending an agent its changed IPs or a resync snapshot.
+	IpUpdateTimeout time.Duration
+	// ResolveWorkers is the number of concurrent hostname lookups during an IP sync.
+	ResolveWorkers int
+	// Reconnect backoff for the monitor stream; see backoff.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	StableAfter   time.Duration
+	// StallTimeout is how long a monitor stream may go without a session list before it is
+	// reconnected; see stallLimit.
+	StallTimeout time.Duration
+}
+
+// stallIntervals is how many of an agent's push intervals a stream may miss before it counts as
+// stalled, if that is longer than SessionConfig.StallTimeout.
+const stallIntervals = 3
+
+// backoff computes reconnect delays for a monitor stream. The first delay is base; it doubles after
+// every connection that lasted less than stableAfter, up to max, and drops back to base once a
+// connection stays up for stableAfter.
+type backoff struct {
+	base, max, stableAfter time.Duration
+	current                time.Duration
+}
+
+func newBackoff(cfg SessionConfig) *backoff {
+	return &backoff{base: cfg.RetryDelay, max: cfg.MaxRetryDelay, stableAfter: cfg.StableAfter}
+}
+
+// next returns the delay before reconnecting after a connection that stayed up for connected.
+func (b *backoff) next(connected time.Duration) time.Duration {
+	switch {
+	case b.current == 0 || connected >= b.stableAfter:
+		b.current = b.base
+	default:
+		b.current = min(b.current*2, b.max)
+	}
+	return b.current
 }
 
 // SessionManager monitors gRPC streams and keeps session in sync.
 type SessionManager struct {
 	svcRepo  repository.ServiceRepository
 	userRepo repository.UserRepository
+
+	mu         sync.Mutex
+	snapshots  map[string][]*proto.Session // latest session list reported by each agent
+	receivedAt map[string]time.Time        // when each snapshot arrived
+	intervals  map[string]time.Duration    // observed push interval of each agent
+
+	// Used only by the hostname sync goroutine.
+	lookup lookupFunc
+}
+
+// AgentSnapshot is the most recent session list received from one agent.
+// ReceivedAt is zero if the agent has not reported yet. Interval is the time between the last two
+// lists received on the same stream, i.e. the agent's push cadence, or zero if not yet known.
+type AgentSnapshot struct {
+	Agent      string
+	ReceivedAt time.Time
+	Interval   time.Duration
+	Sessions   []*proto.Session
 }
 
 // NewSessionManager creates a new SessionManager.
 func NewSessionManager(svcRepo repository.ServiceRepository, userRepo repository.UserRepository) *SessionManager {
-	return &SessionManager{svcRepo: svcRepo, userRepo: userRepo}
+	return &SessionManager{
+		svcRepo:    svcRepo,
+		userRepo:   userRepo,
+		snapshots:  make(map[string][]*proto.Session),
+		receivedAt: make(map[string]time.Time),
+		intervals:  make(map[string]time.Duration),
+		lookup:     utils.ResolveHostnameContext,
+	}
+}
+
+// Snapshots returns the latest session list received from every configured agent, primary first.
+func (m *SessionManager) Snapshots() []AgentSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agents := proto.Agents()
+	out := make([]AgentSnapshot, 0, len(agents))
+	for _, agent := range agents {
+		out = append(out, AgentSnapshot{Agent: agent, ReceivedAt: m.receivedAt[agent], Interval: m.intervals[agent], Sessions: m.snapshots[agent]})
+	}
+	return out
 }
 
-// Start launches all background goroutines.
-func (m *SessionManager) Start(cfg SessionConfig) {
-	go m.connectGrpc()
-	go m.updateIpFromHostnames(cfg.IpUpdateInterval)
-	go m.cleanupExpiredTokens()
+// Start launches all background goroutines on wg, including one session monitor per agent. They
+// stop once ctx is cancelled, after finishing any database write in progress.
+func (m *SessionManager) Start(ctx context.Context, wg *sync.WaitGroup, cfg SessionConfig) {
+	for _, agent := range proto.Agents() {
+		wg.Go(func() { m.connectGrpc(ctx, agent, newBackoff(cfg), cfg.StallTimeout, cfg.IpUpdateTimeout) })
+	}
+	wg.Go(func() { m.updateIpFromHostnames(ctx, cfg.IpUpdateInterval, cfg.IpUpdateTimeout, cfg.ResolveWorkers) })
+	wg.Go(func() { m.cleanupExpiredTokens(ctx) })
 }
 
-func (m *SessionManager) cleanupExpiredTokens() {
+func (m *SessionManager) cleanupExpiredTokens(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		if err := m.userRepo.CleanupExpiredRefreshTokens(); err != nil {
 			log.Printf("[ERROR] Failed to cleanup expired refresh tokens: %v", err)
 		} else {
@@ -51,153 +134,404 @@ func (m *SessionManager) cleanupExpiredTokens() {
 	}
 }
 
-func (m *SessionManager) connectGrpc() {
-	currentDelay := baseDelay
+func (m *SessionManager) connectGrpc(parent context.Context, agent string, bo *backoff, stallTimeout, pushTimeout time.Duration) {
 	for {
 		connectStartTime := time.Now()
+		ctx, cancel := context.WithCancel(parent)
+		go m.watchStream(ctx, cancel, agent, connectStartTime, stallTimeout)
 
-		err := proto.MonitorStream(func(list *proto.SessionList) {
-			log.Printf("[INFO] Received update with %d sessions", len(list.Sessions))
-
-			serviceMap, err := m.svcRepo.GetServiceMap()
-			if err != nil {
-				log.Printf("[ERROR] Sync skipped: failed to get service map: %v", err)
-				return
+		// The agent pushes on its own schedule; the gap between lists on one stream is its cadence.
+		var last time.Time
+		err := proto.MonitorStream(ctx, agent, func(list *proto.SessionList) {
+			now := time.Now()
+			log.Printf("[INFO] Received update with %d sessions from agent %s", len(list.Sessions), agent)
+			if !last.IsZero() {
+				m.recordInterval(agent, now.Sub(last))
 			}
-
-			activeUsersMap, err := m.svcRepo.GetActiveServiceUsers()
-			if err != nil {
-				log.Printf("[ERROR] Sync skipped: failed to get active users: %v", err)
-				return
-			}
-
-			type key struct{ uID, sID int }
-			syncMap := make(map[key]int)
-
-			for _, s := range list.Sessions {
-				dstIpStr := utils.Uint32ToIp(s.DstIp)
-				serviceKey := fmt.Sprintf("%s:%d", dstIpStr, s.DstPort)
-
-				if svcID, ok := serviceMap[serviceKey]; ok {
-					if userIDs, exists := activeUsersMap[svcID]; exists {
-						for _, uID := range userIDs {
-							k := key{uID, svcID}
-							if t, exists := syncMap[k]; !exists || int(s.TimeLeft) > t {
-								syncMap[k] = int(s.TimeLeft)
-							}
-						}
-					}
-				} else {
-					log.Printf("[WARN] Unknown service traffic %s", serviceKey)
-				}
-			}
-
-			sessionsToSync := make([]repository.ActiveSessionSync, 0, len(syncMap))
-			for k, timeLeft := range syncMap {
-				sessionsToSync = append(sessionsToSync, repository.ActiveSessionSync{
-					UserID: k.uID, ServiceID: k.sID, TimeLeft: timeLeft,
-				})
-			}
-
-			if err := m.svcRepo.SyncActiveSessions(sessionsToSync); err != nil {
-				log.Printf("[ERROR] Error syncing active sessions to DB: %v", err)
-			} else {
-				log.Printf("[INFO] Synced %d active sessions to database", len(sessionsToSync))
+			last = now
+			m.syncSessions(agent, list.Sessions)
+			if list.GetResyncRequested() {
+				m.resync(ctx, agent, pushTimeout)
 			}
 		})
+		cancel()
+		if parent.Err() != nil {
+			log.Printf("[INFO] MonitorStream on agent %s stopped", agent)
+			return
+		}
 
 		connectionDuration := time.Since(connectStartTime)
 		if err != nil {
-			log.Printf("[ERROR] MonitorStream disconnected: %v", err)
+			log.Printf("[ERROR] MonitorStream on agent %s disconnected: %v", agent, err)
 		} else {
-			log.Println("[WARN] MonitorStream closed cleanly (EOF), reconnecting...")
+			log.Printf("[WARN] MonitorStream on agent %s closed cleanly (EOF), reconnecting...", agent)
 		}
-		if connectionDuration > resetThreshold {
-			currentDelay = baseDelay
-			log.Println("[INFO] Connection was stable. Resetting backoff.")
-		} else {
-			currentDelay *= 2
-			if currentDelay > maxDelay {
-				currentDelay = maxDelay
-			}
+		delay := bo.next(connectionDuration)
+		log.Printf("[INFO] Reconnecting to agent %s in %v...", agent, delay)
+		select {
+		case <-parent.Done():
+			return
+		case <-time.After(delay):
 		}
-		log.Printf("[INFO] Reconnecting in %v...", currentDelay)
-		time.Sleep(currentDelay)
 	}
 }
 
-func (m *SessionManager) updateIpFromHostnames(updateInterval time.Duration) {
-	m.syncHostnameIPs()
-	ticker := time.NewTicker(updateInterval)
+// watchStream cancels a monitor stream that has delivered no session list for longer than
+// stallLimit. Recv blocks forever on a half-open connection, so without this a dead stream would
+// never be noticed. It returns when ctx is done.
+func (m *SessionManager) watchStream(ctx context.Context, cancel context.CancelFunc, agent string, connected time.Time, stallTimeout time.Duration) {
+	ticker := time.NewTicker(stallTimeout / 4)
 	defer ticker.Stop()
-	for range ticker.C {
-		m.syncHostnameIPs()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			last, limit := m.stallLimit(agent, connected, stallTimeout)
+			if age := now.Sub(last); age > limit {
+				log.Printf("[WARN] MonitorStream on agent %s delivered nothing for %v (limit %v), reconnecting", agent, age.Round(time.Second), limit)
+				cancel()
+				return
+			}
+		}
 	}
 }
 
-func (m *SessionManager) syncHostnameIPs() {
-	changedIps := &proto.IpChangeList{IpChanges: []*proto.IpChangeEvent{}}
+// stallLimit returns when the current stream of agent last delivered a session list, or when it
+// connected if it has not yet, and how long it may stay silent: stallTimeout, or stallIntervals of
+// the agent's observed push interval if that is longer.
+func (m *SessionManager) stallLimit(agent string, connected time.Time, stallTimeout time.Duration) (time.Time, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last := connected
+	if received := m.receivedAt[agent]; received.After(last) {
+		last = received
+	}
+	return last, max(stallTimeout, stallIntervals*m.intervals[agent])
+}
 
-	services, err := m.svcRepo.ListForIPSync()
+// LastSync returns when a session list was last received from agent, or the zero time if never.
+func (m *SessionManager) LastSync(agent string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.receivedAt[agent]
+}
+
+// recordInterval stores the push cadence observed for agent.
+func (m *SessionManager) recordInterval(agent string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.intervals[agent] = d
+}
+
+// syncSessions stores the latest session list from agent and writes the merged view of all agents to the DB.
+// Each agent only reports its own services, so the lists are merged rather than replacing each other.
+func (m *SessionManager) syncSessions(agent string, sessions []*proto.Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[agent] = sessions
+	m.receivedAt[agent] = time.Now()
+
+	serviceMap, err := m.svcRepo.GetServiceMap()
 	if err != nil {
-		log.Printf("[ERROR] updateHostnames: failed to query services: %v", err)
+		log.Printf("[ERROR] Sync skipped: failed to get service map: %v", err)
 		return
 	}
 
+	activeUsersMap, err := m.svcRepo.GetActiveServiceUsers()
+	if err != nil {
+		log.Printf("[ERROR] Sync skipped: failed to get active users: %v", err)
+		return
+	}
+
+	sessionsToSync := mergeSessions(m.snapshots, serviceMap, activeUsersMap)
+	diff, err := m.svcRepo.SyncActiveSessions(sessionsToSync)
+	if err != nil {
+		log.Printf("[ERROR] Error syncing active sessions to DB: %v", err)
+		return
+	}
+	log.Printf("[INFO] Synced %d active sessions to database (%d inserted, %d updated, %d deleted)",
+		len(sessionsToSync), len(diff.Inserted), len(diff.Updated), len(diff.Deleted))
+}
+
+// resync sends agent a snapshot of its active services, after it asked for one because it lost its
+// state, e.g. in a restart. The agent keeps asking in every session list until a snapshot arrives.
+func (m *SessionManager) resync(ctx context.Context, agent string, timeout time.Duration) {
+	log.Printf("[INFO] Agent %s requested a resync", agent)
+	success, err := proto.SendSnapshot(ctx, agent, func() (*proto.ServiceSnapshot, error) {
+		return m.serviceSnapshot(agent)
+	}, timeout)
+	if err != nil {
+		log.Printf("[ERROR] Failed to send snapshot to agent %s: %v", agent, err)
+	} else if !success {
+		log.Printf("[ERROR] Agent %s failed to apply snapshot", agent)
+	}
+}
+
+// serviceSnapshot returns the current address of every service enforced by agent that a user has
+// active, and every session open on them for the agent to reinstall, as stored in the DB.
+func (m *SessionManager) serviceSnapshot(agent string) (*proto.ServiceSnapshot, error) {
+	services, err := m.svcRepo.GetActiveTargets(agent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active services: %w", err)
+	}
+	clients, err := m.svcRepo.GetActiveClients(agent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active sessions: %w", err)
+	}
+	snapshot := &proto.ServiceSnapshot{Services: make([]*proto.ServiceTarget, 0, len(services))}
 	for _, s := range services {
-		host, port, err := net.SplitHostPort(s.Hostname)
-		if err != nil {
-			log.Printf("[WARN] updateHostnames: invalid hostname format for service ID %d (%s): %v", s.ID, s.Hostname, err)
+		snapshot.Services = append(snapshot.Services, &proto.ServiceTarget{
+			Ip:        s.Ip,
+			Port:      uint32(s.Port),
+			PortEnd:   uint32(s.PortRangeEnd),
+			PrefixLen: uint32(s.PrefixLen),
+		})
+		if s.Ip == 0 && s.DestType != models.DestinationCIDR {
+			log.Printf("[WARN] Not reinstalling sessions of service %d on agent %s: it has no address", s.Id, agent)
 			continue
 		}
+		for _, client := range clients[s.Id] {
+			if net.ParseIP(client.IP).To4() == nil {
+				log.Printf("[WARN] Not reinstalling a session of service %d on agent %s: no IPv4 client address", s.Id, agent)
+				continue
+			}
+			_, ttl := models.SessionTTL(client.MaxTTL)
+			snapshot.Sessions = append(snapshot.Sessions, &proto.LoginEvent{
+				SrcIp:        utils.IpToUint32(client.IP),
+				DstIp:        s.Ip,
+				DstPrefixLen: uint32(s.PrefixLen),
+				DstPort:      uint32(s.Port),
+				DstPortEnd:   uint32(s.PortRangeEnd),
+				TtlSeconds:   ttl,
+				Activate:     true,
+			})
+		}
+	}
+	return snapshot, nil
+}
 
-		var resolvedIP string
-		if ip := net.ParseIP(host); ip != nil {
-			resolvedIP = host
-		} else {
-			ips, err := utils.ResolveHostname(host)
-			if err != nil || len(ips) == 0 {
-				log.Printf("[WARN] updateHostnames: failed to resolve %s for service ID %d: %v", host, s.ID, err)
+// mergeSessions maps every agent's sessions to (user, service) pairs, matching services by (agent, ip:port).
+// When a pair is reported more than once the largest remaining time wins. Sessions whose time_left is
+// not a plausible number of seconds are dropped.
+func mergeSessions(snapshots map[string][]*proto.Session, serviceMap map[repository.ServiceKey]int, activeUsersMap map[int][]int) []repository.ActiveSessionSync {
+	type key struct{ uID, sID int }
+	syncMap := make(map[key]int)
+
+	for agent, sessions := range snapshots {
+		for _, s := range sessions {
+			dstIpStr := utils.Uint32ToIp(s.DstIp)
+			serviceKey := repository.ServiceKey{Agent: agent, Addr: fmt.Sprintf("%s:%d", dstIpStr, s.DstPort)}
+
+			if s.TimeLeft < 0 || s.TimeLeft > models.MaxSessionTimeLeft {
+				log.Printf("[WARN] Ignoring session to %s on agent %s with implausible time_left %ds", serviceKey.Addr, agent, s.TimeLeft)
 				continue
 			}
-			resolvedIP = ips[0]
+			svcID, ok := serviceMap[serviceKey]
+			if !ok {
+				log.Printf("[WARN] Unknown service traffic %s on agent %s", serviceKey.Addr, agent)
+				continue
+			}
+			for _, uID := range activeUsersMap[svcID] {
+				k := key{uID, svcID}
+				if t, exists := syncMap[k]; !exists || int(s.TimeLeft) > t {
+					syncMap[k] = int(s.TimeLeft)
+				}
+			}
 		}
+	}
 
-		newIpInt := utils.IpToUint32(resolvedIP)
-		portNum, err := net.LookupPort("tcp", port)
-		if err != nil {
-			log.Printf("[WARN] updateHostnames: invalid port %s for service ID %d: %v", port, s.ID, err)
-			continue
+	sessionsToSync := make([]repository.ActiveSessionSync, 0, len(syncMap))
+	for k, timeLeft := range syncMap {
+		sessionsToSync = append(sessionsToSync, repository.ActiveSessionSync{
+			UserID: k.uID, ServiceID: k.sID, TimeLeft: timeLeft,
+		})
+	}
+	return sessionsToSync
+}
+
+func (m *SessionManager) updateIpFromHostnames(ctx context.Context, updateInterval, pushTimeout time.Duration, workers int) {
+	ticker := time.NewTicker(updateInterval)
+	defer ticker.Stop()
+	for {
+		m.syncHostnameIPs(ctx, updateInterval, pushTimeout, workers)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		newPort := uint16(portNum)
+	}
+}
 
-		if newIpInt != s.CurrentIP || newPort != s.CurrentPort {
-			oldIpStr := utils.Uint32ToIp(s.CurrentIP)
-			log.Printf("[INFO] Service %d (%s) changed: %s:%d -> %s:%d. Updating DB.",
-				s.ID, s.Hostname, oldIpStr, s.CurrentPort, resolvedIP, newPort)
+// lookupFunc resolves a hostname to its IPv4 addresses.
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
 
-			if err := m.svcRepo.UpdateIPPort(s.ID, newIpInt, newPort); err != nil {
-				log.Printf("[ERROR] updateHostnames: failed to update service ID %d: %v", s.ID, err)
+// resolvedService is the address set a service's hostname resolved to in a hostname sync, sorted
+// and without duplicates. An IP literal resolves to itself.
+type resolvedService struct {
+	entry repository.HostnameSyncEntry
+	ips   []uint32
+	port  uint16
+}
+
+// resolveServices resolves the hostnames of entries with up to workers concurrent lookups. It returns
+// when every entry is resolved or ctx is done, whichever comes first; entries that failed or were
+// still pending at that point are logged and left out. Results are in no particular order.
+func resolveServices(ctx context.Context, entries []repository.HostnameSyncEntry, workers int, lookup lookupFunc) []resolvedService {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan repository.HostnameSyncEntry)
+	// Buffered so workers never block on a collector that has given up.
+	results := make(chan *resolvedService, len(entries))
+	for range min(workers, len(entries)) {
+		go func() {
+			for s := range jobs {
+				results <- resolveService(ctx, s, lookup)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, s := range entries {
+			select {
+			case jobs <- s:
+			case <-ctx.Done():
+				return
 			}
+		}
+	}()
 
-			if s.CurrentIP != newIpInt {
-				changedIps.IpChanges = append(changedIps.IpChanges, &proto.IpChangeEvent{
-					OldIp: s.CurrentIP,
-					NewIp: newIpInt,
-				})
+	resolved := make([]resolvedService, 0, len(entries))
+	for pending := len(entries); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r != nil {
+				resolved = append(resolved, *r)
 			}
+		case <-ctx.Done():
+			log.Printf("[WARN] updateHostnames: cycle deadline reached with %d of %d services unresolved", pending, len(entries))
+			return resolved
 		}
 	}
+	return resolved
+}
 
-	if len(changedIps.IpChanges) > 0 {
-		success, err := proto.SendChanedIpData(changedIps, time.Second)
+// resolveService resolves one service's hostname, or returns nil if it cannot be resolved.
+func resolveService(ctx context.Context, s repository.HostnameSyncEntry, lookup lookupFunc) *resolvedService {
+	host, port, err := net.SplitHostPort(s.Hostname)
+	if err != nil {
+		log.Printf("[WARN] updateHostnames: invalid hostname format for service ID %d (%s): %v", s.ID, s.Hostname, err)
+		return nil
+	}
+
+	var ips []uint32
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			log.Printf("[WARN] updateHostnames: service ID %d has an IPv6 address (%s), which agents do not support", s.ID, host)
+			return nil
+		}
+		ips = []uint32{utils.IpToUint32(host)}
+	} else {
+		addrs, err := lookup(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			log.Printf("[WARN] updateHostnames: failed to resolve %s for service ID %d: %v", host, s.ID, err)
+			return nil
+		}
+		for _, a := range addrs {
+			ips = append(ips, utils.IpToUint32(a))
+		}
+		slices.Sort(ips)
+		ips = slices.Compact(ips)
+	}
+
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		log.Printf("[WARN] updateHostnames: invalid port %s for service ID %d: %v", port, s.ID, err)
+		return nil
+	}
+	return &resolvedService{entry: s, ips: ips, port: uint16(portNum)}
+}
+
+// syncHostnameIPs re-resolves every service hostname, stores changed addresses and sends each agent
+// one batch of its IP changes, in order of agent name, waiting up to pushTimeout for each. Lookups
+// must finish within cycle so a slow resolver cannot delay the next sync; services not resolved in
+// time keep their address until the next cycle, as do services whose lookups are abandoned because
+// ctx is cancelled.
+func (m *SessionManager) syncHostnameIPs(ctx context.Context, cycle, pushTimeout time.Duration, workers int) {
+	resolveCtx, cancel := context.WithTimeout(ctx, cycle)
+	changedByAgent := m.refreshHostnames(resolveCtx, workers)
+	cancel()
+
+	for _, agent := range slices.Sorted(maps.Keys(changedByAgent)) {
+		changedIps := changedByAgent[agent]
+		success, err := proto.SendChanedIpData(ctx, agent, changedIps, pushTimeout)
 		if err != nil {
-			log.Printf("[ERROR] updateHostnames: failed to update IPs in agent: %v", err)
+			log.Printf("[ERROR] updateHostnames: failed to update IPs in agent %s: %v", agent, err)
 		}
 		if success {
-			log.Printf("[INFO] updateHostnames: updated %d IPs in agent", len(changedIps.IpChanges))
+			log.Printf("[INFO] updateHostnames: updated %d IPs in agent %s", len(changedIps.IpChanges), agent)
 		} else {
-			log.Printf("[ERROR] updateHostnames: failed to update IPs in agent")
+			log.Printf("[ERROR] updateHostnames: failed to update IPs in agent %s", agent)
+		}
+	}
+}
+
+// refreshHostnames resolves every service hostname and stores the services whose address changed.
+// It returns the IP changes to send, grouped by agent.
+//
+// Round-robin DNS returns the same addresses in a different order on every lookup, so a service's
+// address only changes when its resolved set changes and no longer contains the current address.
+// The new address is then the lowest one in the set. Each set is stored with its service, so after a
+// restart answers are compared against the sets seen before it rather than treated as new.
+func (m *SessionManager) refreshHostnames(ctx context.Context, workers int) map[string]*proto.IpChangeList {
+	services, err := m.svcRepo.ListForIPSync()
+	if err != nil {
+		log.Printf("[ERROR] updateHostnames: failed to query services: %v", err)
+		return nil
+	}
+
+	resolved := resolveServices(ctx, services, workers, m.lookup)
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].entry.ID < resolved[j].entry.ID })
+
+	changedByAgent := make(map[string]*proto.IpChangeList)
+	for _, r := range resolved {
+		s := r.entry
+		newIP := s.CurrentIP
+		if !slices.Equal(r.ips, s.ResolvedIPs) {
+			if err := m.svcRepo.UpdateResolvedIPs(s.ID, r.ips); err != nil {
+				log.Printf("[ERROR] updateHostnames: failed to store resolved addresses of service ID %d: %v", s.ID, err)
+			}
+			if !slices.Contains(r.ips, s.CurrentIP) {
+				newIP = r.ips[0]
+			}
+		}
+		if newIP == s.CurrentIP && r.port == s.CurrentPort {
+			continue
+		}
+
+		updated, err := m.svcRepo.UpdateIPPort(s.ID, newIP, r.port, repository.IPSourceDNS)
+		if err != nil {
+			log.Printf("[ERROR] updateHostnames: failed to update service ID %d: %v", s.ID, err)
+		} else if !updated {
+			log.Printf("[INFO] updateHostnames: service %d (%s) resolves to %s:%d but keeps %s:%d set by Docker (dns.ip_authority)",
+				s.ID, s.Hostname, utils.Uint32ToIp(newIP), r.port, utils.Uint32ToIp(s.CurrentIP), s.CurrentPort)
+			continue
+		}
+		log.Printf("[INFO] Service %d (%s) changed: %s:%d -> %s:%d.",
+			s.ID, s.Hostname, utils.Uint32ToIp(s.CurrentIP), s.CurrentPort, utils.Uint32ToIp(newIP), r.port)
+
+		if s.CurrentIP != newIP {
+			changedIps, ok := changedByAgent[s.Agent]
+			if !ok {
+				changedIps = &proto.IpChangeList{IpChanges: []*proto.IpChangeEvent{}}
+				changedByAgent[s.Agent] = changedIps
+			}
+			changedIps.IpChanges = append(changedIps.IpChanges, &proto.IpChangeEvent{
+				OldIp: s.CurrentIP,
+				NewIp: newIP,
+			})
 		}
 	}
+	return changedByAgent
 }
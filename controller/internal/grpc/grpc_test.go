@@ -0,0 +1,547 @@
+package grpc
+
+import (
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"Aegis/controller/proto"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeSessions(t *testing.T) {
+	// Both zones run a service on 10.0.0.5:80; they must not be confused with each other.
+	serviceMap := map[repository.ServiceKey]int{
+		{Agent: "primary", Addr: "10.0.0.5:80"}: 1,
+		{Agent: "zone-b", Addr: "10.0.0.5:80"}:  2,
+		{Agent: "zone-b", Addr: "10.1.0.7:22"}:  3,
+	}
+	activeUsers := map[int][]int{
+		1: {100},
+		2: {200},
+		3: {100, 200},
+	}
+	snapshots := map[string][]*proto.Session{
+		"primary": {
+			{DstIp: 0x0A000005, DstPort: 80, TimeLeft: 30},
+			{DstIp: 0x0A000005, DstPort: 80, TimeLeft: 1 << 30}, // implausible, dropped
+		},
+		"zone-b": {
+			{DstIp: 0x0A000005, DstPort: 80, TimeLeft: 45},
+			{DstIp: 0x0A010007, DstPort: 22, TimeLeft: 10},
+			{DstIp: 0x0A010007, DstPort: 22, TimeLeft: 50},
+			{DstIp: 0x0A0100FF, DstPort: 443, TimeLeft: 60}, // unknown service
+		},
+	}
+
+	got := mergeSessions(snapshots, serviceMap, activeUsers)
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].ServiceID != got[j].ServiceID {
+			return got[i].ServiceID < got[j].ServiceID
+		}
+		return got[i].UserID < got[j].UserID
+	})
+
+	want := []repository.ActiveSessionSync{
+		{UserID: 100, ServiceID: 1, TimeLeft: 30},
+		{UserID: 200, ServiceID: 2, TimeLeft: 45},
+		{UserID: 100, ServiceID: 3, TimeLeft: 50},
+		{UserID: 200, ServiceID: 3, TimeLeft: 50},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d sessions, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("session %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestServiceSnapshotHoldsActiveServices(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	// alice signed in from 192.0.2.10; bob has no known address.
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, last_login_ip) VALUES ('alice', 'x', 3, '192.0.2.10'), ('bob', 'x', 3, NULL)"); err != nil {
+		t.Fatalf("Failed to create test users: %v", err)
+	}
+	for _, q := range []string{
+		// alice's role limits her sessions to less than the default timeout.
+		"INSERT INTO roles (id, name, max_ttl) VALUES (10, 'brief', 20)",
+		"UPDATE users SET role_id = 10 WHERE username = 'alice'",
+		"INSERT INTO services (id, name, hostname, ip, port, port_range_end, agent) VALUES (1, 'Web', 'web:80', 167772165, 80, 0, 'primary')",
+		"INSERT INTO services (id, name, hostname, ip, port, port_range_end, agent) VALUES (2, 'Idle', 'idle:22', 167772166, 22, 0, 'primary')",
+		"INSERT INTO services (id, name, hostname, ip, port, port_range_end, agent) VALUES (3, 'Ranged', 'ranged:9000', 167772167, 9000, 9010, 'primary')",
+		"INSERT INTO services (id, name, hostname, ip, port, port_range_end, agent) VALUES (4, 'Zone', 'zone:80', 167837703, 80, 0, 'zone-b')",
+		"INSERT INTO services (id, name, hostname, ip, port, port_range_end, agent, destination_type) VALUES (5, 'Subnet', '10.1.0.0/28:443', 167837696, 443, 0, 'primary', 'cidr')",
+		"INSERT INTO user_active_services (user_id, service_id) SELECT id, 1 FROM users WHERE username = 'alice'",
+		"INSERT INTO user_active_services (user_id, service_id) SELECT id, 1 FROM users WHERE username = 'bob'",
+		"INSERT INTO user_active_services (user_id, service_id, client_ip) SELECT id, 3, '192.0.2.20' FROM users WHERE username = 'alice'",
+		"INSERT INTO user_active_services (user_id, service_id) SELECT id, 4 FROM users WHERE username = 'alice'",
+		"INSERT INTO user_active_services (user_id, service_id) SELECT id, 5 FROM users WHERE username = 'alice'",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Failed to seed %q: %v", q, err)
+		}
+	}
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	m := NewSessionManager(svcRepo, nil)
+
+	// Only the primary agent's services with an active user, whatever their port span or network.
+	snapshot, err := m.serviceSnapshot(proto.PrimaryAgent)
+	if err != nil {
+		t.Fatalf("serviceSnapshot failed: %v", err)
+	}
+	want := []*proto.ServiceTarget{
+		{Ip: utils.IpToUint32("10.0.0.5"), Port: 80},
+		{Ip: utils.IpToUint32("10.0.0.7"), Port: 9000, PortEnd: 9010},
+		{Ip: utils.IpToUint32("10.1.0.0"), Port: 443, PrefixLen: 28},
+	}
+	got := snapshot.GetServices()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d services, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i].GetIp() != want[i].Ip || got[i].GetPort() != want[i].Port || got[i].GetPortEnd() != want[i].PortEnd || got[i].GetPrefixLen() != want[i].PrefixLen {
+			t.Errorf("service %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+
+	// Every session with a client address is there to reinstall, from the address it was opened for
+	// or else the user's last login address, with the timeout of the user's role.
+	wantSessions := []*proto.LoginEvent{
+		{SrcIp: utils.IpToUint32("192.0.2.10"), DstIp: utils.IpToUint32("10.0.0.5"), DstPort: 80, TtlSeconds: 20, Activate: true},
+		{SrcIp: utils.IpToUint32("192.0.2.20"), DstIp: utils.IpToUint32("10.0.0.7"), DstPort: 9000, DstPortEnd: 9010, TtlSeconds: 20, Activate: true},
+		{SrcIp: utils.IpToUint32("192.0.2.10"), DstIp: utils.IpToUint32("10.1.0.0"), DstPrefixLen: 28, DstPort: 443, TtlSeconds: 20, Activate: true},
+	}
+	gotSessions := snapshot.GetSessions()
+	if len(gotSessions) != len(wantSessions) {
+		t.Fatalf("Expected %d sessions, got %v", len(wantSessions), gotSessions)
+	}
+	for i, w := range wantSessions {
+		g := gotSessions[i]
+		if g.GetSrcIp() != w.SrcIp || g.GetDstIp() != w.DstIp || g.GetDstPrefixLen() != w.DstPrefixLen || g.GetDstPort() != w.DstPort || g.GetDstPortEnd() != w.DstPortEnd || g.GetTtlSeconds() != w.TtlSeconds || !g.GetActivate() {
+			t.Errorf("session %d: expected %v, got %v", i, w, g)
+		}
+	}
+
+	// A service moved by a hostname sync appears at its new address.
+	if _, err := svcRepo.UpdateIPPort(1, utils.IpToUint32("10.0.0.9"), 8080, repository.IPSourceDNS); err != nil {
+		t.Fatalf("UpdateIPPort failed: %v", err)
+	}
+	snapshot, err = m.serviceSnapshot(proto.PrimaryAgent)
+	if err != nil {
+		t.Fatalf("serviceSnapshot failed: %v", err)
+	}
+	if first := snapshot.GetServices()[0]; utils.Uint32ToIp(first.GetIp()) != "10.0.0.9" || first.GetPort() != 8080 {
+		t.Errorf("Expected the moved service at 10.0.0.9:8080, got %v", first)
+	}
+	if first := snapshot.GetSessions()[0]; utils.Uint32ToIp(first.GetDstIp()) != "10.0.0.9" || first.GetDstPort() != 8080 {
+		t.Errorf("Expected the session reinstalled at 10.0.0.9:8080, got %v", first)
+	}
+}
+
+func TestBackoffProgression(t *testing.T) {
+	bo := newBackoff(SessionConfig{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second, StableAfter: 30 * time.Second})
+
+	steps := []struct {
+		connected time.Duration
+		want      time.Duration
+	}{
+		{0, time.Second},                    // first failure waits the base delay
+		{time.Second, 2 * time.Second},      // short-lived connections double it
+		{time.Second, 4 * time.Second},      //
+		{time.Second, 8 * time.Second},      //
+		{time.Second, 10 * time.Second},     // capped at the maximum
+		{time.Second, 10 * time.Second},     //
+		{time.Minute, time.Second},          // a stable connection resets to the base delay
+		{29 * time.Second, 2 * time.Second}, // just under stableAfter still counts as short
+	}
+	for i, step := range steps {
+		if got := bo.next(step.connected); got != step.want {
+			t.Errorf("step %d: next(%v) = %v, want %v", i, step.connected, got, step.want)
+		}
+	}
+}
+
+func TestStallLimit(t *testing.T) {
+	m := NewSessionManager(nil, nil)
+	connected := time.Now().Add(-time.Hour)
+
+	if last, limit := m.stallLimit("primary", connected, time.Minute); !last.Equal(connected) || limit != time.Minute {
+		t.Errorf("Before any list: got %v/%v, want connect time/1m", last, limit)
+	}
+
+	received := time.Now()
+	m.receivedAt["primary"] = received
+	m.intervals["primary"] = 10 * time.Second
+	if last, limit := m.stallLimit("primary", connected, time.Minute); !last.Equal(received) || limit != time.Minute {
+		t.Errorf("Short push interval: got %v/%v, want last list/1m", last, limit)
+	}
+
+	m.intervals["primary"] = time.Minute
+	if _, limit := m.stallLimit("primary", connected, time.Minute); limit != 3*time.Minute {
+		t.Errorf("Long push interval: got %v, want 3m", limit)
+	}
+
+	// A list received on an earlier stream does not count for one that connected since.
+	if last, _ := m.stallLimit("primary", received.Add(time.Second), time.Minute); !last.Equal(received.Add(time.Second)) {
+		t.Errorf("Reconnected stream: got %v, want its connect time", last)
+	}
+}
+
+func TestWatchStreamCancelsStalledStream(t *testing.T) {
+	m := NewSessionManager(nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.watchStream(ctx, cancel, "primary", time.Now(), 100*time.Millisecond)
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a stream with no session lists to be cancelled")
+	}
+
+	// A stream that keeps delivering is left alone.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go m.watchStream(ctx, cancel, "primary", time.Now(), 100*time.Millisecond)
+	for range 10 {
+		m.mu.Lock()
+		m.receivedAt["primary"] = time.Now()
+		m.mu.Unlock()
+		time.Sleep(30 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected a stream receiving session lists not to be cancelled")
+	}
+}
+
+func TestResolveServicesDeadline(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		if strings.HasPrefix(host, "hang") {
+			<-hang // ignores ctx, like a resolver stuck in a blocking call
+			return nil, errors.New("unreachable")
+		}
+		return []string{"10.0.0.9"}, nil
+	}
+
+	// The hanging lookups come first and tie up two of the four workers for good.
+	entries := []repository.HostnameSyncEntry{
+		{ID: 1, Hostname: "hang-1.internal:80"},
+		{ID: 2, Hostname: "hang-2.internal:80"},
+		{ID: 3, Hostname: "no-port.internal"},
+		{ID: 4, Hostname: "10.0.0.4:443"},
+	}
+	for id := 5; id <= 10; id++ {
+		entries = append(entries, repository.HostnameSyncEntry{ID: id, Hostname: fmt.Sprintf("svc-%d.internal:80", id)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resolved := resolveServices(ctx, entries, 4, lookup)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the sync to stop at its 200ms deadline, took %v", elapsed)
+	}
+
+	var ids []int
+	for _, r := range resolved {
+		ids = append(ids, r.entry.ID)
+	}
+	sort.Ints(ids)
+	if want := []int{4, 5, 6, 7, 8, 9, 10}; !slices.Equal(ids, want) {
+		t.Errorf("Expected services %v to resolve, got %v", want, ids)
+	}
+}
+
+func TestResolveServicesSkipsIPv6(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		t.Errorf("Unexpected lookup of %s", host)
+		return nil, nil
+	}
+	entries := []repository.HostnameSyncEntry{{ID: 1, Hostname: "[::1]:80"}, {ID: 2, Hostname: "10.0.0.9:80"}}
+	resolved := resolveServices(context.Background(), entries, 2, lookup)
+	if len(resolved) != 1 || resolved[0].entry.ID != 2 {
+		t.Errorf("Expected only the IPv4 service to resolve, got %+v", resolved)
+	}
+}
+
+func TestResolveServicesConcurrently(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return []string{"10.0.0.9"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var entries []repository.HostnameSyncEntry
+	for id := 1; id <= 8; id++ {
+		entries = append(entries, repository.HostnameSyncEntry{ID: id, Hostname: fmt.Sprintf("svc-%d.internal:80", id)})
+	}
+
+	start := time.Now()
+	resolved := resolveServices(context.Background(), entries, 8, lookup)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected 8 lookups of 100ms on 8 workers to overlap, took %v", elapsed)
+	}
+	if len(resolved) != len(entries) {
+		t.Errorf("Expected all %d services to resolve, got %d", len(entries), len(resolved))
+	}
+}
+
+func TestRefreshHostnamesIgnoresReorderedAnswers(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Web', 'rr.internal:80', ?, 80)", utils.IpToUint32("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	var answers [][]string
+	m := NewSessionManager(svcRepo, nil)
+	m.lookup = func(ctx context.Context, host string) ([]string, error) {
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, nil
+	}
+	refresh := func() []*proto.IpChangeEvent {
+		t.Helper()
+		var events []*proto.IpChangeEvent
+		for _, list := range m.refreshHostnames(context.Background(), 1) {
+			events = append(events, list.IpChanges...)
+		}
+		return events
+	}
+	currentIP := func() string {
+		t.Helper()
+		var ip uint32
+		if err := db.QueryRow("SELECT ip FROM services WHERE id = ?", svcID).Scan(&ip); err != nil {
+			t.Fatalf("Failed to read service: %v", err)
+		}
+		return utils.Uint32ToIp(ip)
+	}
+
+	// A round-robin record answering in a different order every time, including the current address.
+	answers = [][]string{
+		{"10.0.0.3", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.3"},
+	}
+	for cycle := range 3 {
+		if events := refresh(); len(events) != 0 {
+			t.Errorf("cycle %d: expected no IP changes for a reordered answer, got %v", cycle, events)
+		}
+	}
+	if ip := currentIP(); ip != "10.0.0.2" {
+		t.Errorf("Expected the service to keep 10.0.0.2, got %s", ip)
+	}
+
+	// The record moves: the lowest new address is picked once, then reordering is ignored again.
+	answers = [][]string{{"10.0.0.9", "10.0.0.5"}, {"10.0.0.5", "10.0.0.9"}}
+	events := refresh()
+	if len(events) != 1 || utils.Uint32ToIp(events[0].OldIp) != "10.0.0.2" || utils.Uint32ToIp(events[0].NewIp) != "10.0.0.5" {
+		t.Fatalf("Expected one change 10.0.0.2 -> 10.0.0.5, got %v", events)
+	}
+	if ip := currentIP(); ip != "10.0.0.5" {
+		t.Errorf("Expected the service to move to 10.0.0.5, got %s", ip)
+	}
+	if events := refresh(); len(events) != 0 {
+		t.Errorf("Expected no IP changes after the move, got %v", events)
+	}
+}
+
+func TestRefreshHostnamesAfterRestart(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Web', 'rr.internal:80', ?, 80)", utils.IpToUint32("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	// Each manager stands for one controller run; they share nothing but the database.
+	refresh := func(answer ...string) []*proto.IpChangeEvent {
+		t.Helper()
+		m := NewSessionManager(svcRepo, nil)
+		m.lookup = func(ctx context.Context, host string) ([]string, error) { return answer, nil }
+		var events []*proto.IpChangeEvent
+		for _, list := range m.refreshHostnames(context.Background(), 1) {
+			events = append(events, list.IpChanges...)
+		}
+		return events
+	}
+
+	if events := refresh("10.0.0.9", "10.0.0.5"); len(events) != 1 || utils.Uint32ToIp(events[0].NewIp) != "10.0.0.5" {
+		t.Fatalf("Expected one change to 10.0.0.5 before the restart, got %v", events)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT resolved_ips FROM services WHERE id = ?", svcID).Scan(&stored); err != nil {
+		t.Fatalf("Failed to read service: %v", err)
+	}
+	if stored != "10.0.0.5,10.0.0.9" {
+		t.Errorf("Expected the resolved set to be stored, got %q", stored)
+	}
+
+	for restart := range 2 {
+		if events := refresh("10.0.0.5", "10.0.0.9"); len(events) != 0 {
+			t.Errorf("restart %d: expected no IP changes with unchanged DNS, got %v", restart, events)
+		}
+	}
+}
+
+func TestIPAuthorityStopsPingPong(t *testing.T) {
+	t.Cleanup(func() {
+		repository.SetIPAuthority(repository.IPAuthority{Preferred: repository.IPSourceDocker, Hold: 10 * time.Minute})
+	})
+	setup := func(t *testing.T, preferred string) (repository.ServiceRepository, int, func(answer string) int, func() string) {
+		t.Helper()
+		repository.SetIPAuthority(repository.IPAuthority{Preferred: preferred, Hold: time.Hour})
+		db, err := repository.SetupTestStmt(t.TempDir())
+		if err != nil {
+			t.Fatalf("SetupTestStmt failed: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Web', 'web:80', ?, 80)", utils.IpToUint32("10.0.0.2"))
+		if err != nil {
+			t.Fatalf("Failed to create test service: %v", err)
+		}
+		svcID, _ := res.LastInsertId()
+		svcRepo, err := repository.NewServiceRepository(db)
+		if err != nil {
+			t.Fatalf("Failed to create service repo: %v", err)
+		}
+		m := NewSessionManager(svcRepo, nil)
+		var answer string
+		m.lookup = func(ctx context.Context, host string) ([]string, error) { return []string{answer}, nil }
+		dnsSync := func(a string) int {
+			t.Helper()
+			answer = a
+			var events int
+			for _, list := range m.refreshHostnames(context.Background(), 1) {
+				events += len(list.IpChanges)
+			}
+			return events
+		}
+		currentIP := func() string {
+			t.Helper()
+			var ip uint32
+			if err := db.QueryRow("SELECT ip FROM services WHERE id = ?", svcID).Scan(&ip); err != nil {
+				t.Fatalf("Failed to read service: %v", err)
+			}
+			return utils.Uint32ToIp(ip)
+		}
+		return svcRepo, int(svcID), dnsSync, currentIP
+	}
+	container := utils.IpToUint32("172.17.0.3")
+
+	t.Run("docker wins", func(t *testing.T) {
+		svcRepo, svcID, dnsSync, currentIP := setup(t, repository.IPSourceDocker)
+		if events := dnsSync("10.0.0.5"); events != 1 {
+			t.Fatalf("Expected the first DNS answer to be applied, got %d changes", events)
+		}
+		// The container restarts while DNS keeps flipping between two VIPs.
+		for i, vip := range []string{"10.0.0.6", "10.0.0.5", "10.0.0.6"} {
+			if ok, err := svcRepo.UpdateIPPort(svcID, container, 80, repository.IPSourceDocker); err != nil || !ok {
+				t.Fatalf("round %d: expected the Docker update to apply, got %v, %v", i, ok, err)
+			}
+			if events := dnsSync(vip); events != 0 {
+				t.Errorf("round %d: expected DNS not to replace the container address, got %d changes", i, events)
+			}
+			if ip := currentIP(); ip != "172.17.0.3" {
+				t.Errorf("round %d: expected the service to keep 172.17.0.3, got %s", i, ip)
+			}
+		}
+
+		// Once the Docker address is older than the hold, DNS may replace it again.
+		repository.SetIPAuthority(repository.IPAuthority{Preferred: repository.IPSourceDocker})
+		if events := dnsSync("10.0.0.7"); events != 1 || currentIP() != "10.0.0.7" {
+			t.Errorf("Expected DNS to apply 10.0.0.7 after the hold, got %d changes and %s", events, currentIP())
+		}
+	})
+
+	t.Run("dns wins", func(t *testing.T) {
+		svcRepo, svcID, dnsSync, currentIP := setup(t, repository.IPSourceDNS)
+		if events := dnsSync("10.0.0.5"); events != 1 {
+			t.Fatalf("Expected the first DNS answer to be applied, got %d changes", events)
+		}
+		for i := range 3 {
+			if ok, err := svcRepo.UpdateIPPort(svcID, container, 80, repository.IPSourceDocker); err != nil || ok {
+				t.Fatalf("round %d: expected the Docker update to be suppressed, got %v, %v", i, ok, err)
+			}
+			if events := dnsSync("10.0.0.5"); events != 0 {
+				t.Errorf("round %d: expected no IP changes, got %d", i, events)
+			}
+			if ip := currentIP(); ip != "10.0.0.5" {
+				t.Errorf("round %d: expected the service to keep 10.0.0.5, got %s", i, ip)
+			}
+		}
+	})
+}
+
+func TestUpdateIpFromHostnamesStopsOnCancel(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Web', 'slow.internal:80', ?, 80)", utils.IpToUint32("10.0.0.2")); err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	m := NewSessionManager(svcRepo, nil)
+	started := make(chan struct{}, 1)
+	m.lookup = func(ctx context.Context, host string) ([]string, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.updateIpFromHostnames(ctx, time.Hour, time.Second, 1)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the IP sync loop to stop after cancellation")
+	}
+}
@@ -3,8 +3,12 @@ package handler
 import (
 	"Aegis/controller/internal/middleware"
 	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
+	"database/sql"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,7 +39,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	result, err := h.authSvc.Login(req.Username, req.Password)
+	result, err := h.authSvc.Login(req.Username, req.Password, utils.GetClientIP(c.Request))
 	if err != nil {
 		msg := err.Error()
 		switch msg {
@@ -52,6 +56,21 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	setLoginCookies(c, result)
+	log.Printf("[auth] login successful for user '%s'", req.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged in successfully", "role": result.RoleName})
+}
+
+// refreshCookiePath scopes the refresh_token cookie to the auth routes, so that it reaches both
+// refresh and logout.
+const refreshCookiePath = "/api/auth"
+
+// legacyRefreshCookiePath is where refresh_token cookies were scoped before logout needed them.
+// Logout still clears cookies there.
+const legacyRefreshCookiePath = "/api/auth/refresh"
+
+// setLoginCookies sets the access and refresh token cookies of a successful login.
+func setLoginCookies(c *gin.Context, result *service.LoginResult) {
 	http.SetCookie(c.Writer, &http.Cookie{
 		Name:     "token",
 		Value:    result.TokenString,
@@ -67,22 +86,78 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		Expires:  result.RefreshExpiry,
 		HttpOnly: true,
 		Secure:   true,
-		Path:     "/api/auth/refresh",
+		Path:     refreshCookiePath,
 		SameSite: http.SameSiteStrictMode,
 	})
+}
 
-	log.Printf("[auth] login successful for user '%s'", req.Username)
-	c.JSON(http.StatusOK, gin.H{"message": "Logged in successfully", "role": result.RoleName})
+// StepUp re-authenticates the signed-in user with their password so that services requiring a
+// recent authentication can be activated. It sets new auth cookies like Login.
+func (h *AuthHandler) StepUp(c *gin.Context) {
+	if _, ok := c.Get(middleware.TokenScopeKey); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API tokens cannot step up"})
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	username := c.GetString(middleware.UsernameKey)
+	result, err := h.authSvc.StepUp(username, req.Password, utils.GetClientIP(c.Request))
+	if err != nil {
+		switch err.Error() {
+		case "invalid credentials":
+			log.Printf("[auth] step-up failed for user '%s': invalid credentials", username)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		case "sso users must sign in with their provider":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Sign in again with your identity provider"})
+		case "account disabled":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		default:
+			log.Printf("[auth] step-up failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		return
+	}
+
+	setLoginCookies(c, result)
+	log.Printf("[auth] step-up successful for user '%s'", username)
+	c.JSON(http.StatusOK, gin.H{"message": "Re-authenticated successfully"})
 }
 
-// Logout clears auth cookies and deletes refresh tokens.
+// Logout clears auth cookies and ends the current session by deleting its refresh token. With
+// ?all=true it ends the user's sessions on every device instead, e.g. after a suspected compromise.
 func (h *AuthHandler) Logout(c *gin.Context) {
+	all := false
+	if v := c.Query("all"); v != "" {
+		var err error
+		if all, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid all parameter"})
+			return
+		}
+	}
+
 	username, _ := c.Get(middleware.UsernameKey)
 	if u, ok := username.(string); ok && u != "" {
-		if err := h.authSvc.Logout(u); err != nil {
-			log.Printf("[auth] failed to delete refresh tokens for user '%s': %v", u, err)
+		if all {
+			revoked, err := h.authSvc.LogoutAll(u)
+			if err != nil {
+				log.Printf("[audit] logout of all devices for user '%s' failed: %v", u, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions"})
+				return
+			}
+			log.Printf("[audit] user '%s' logged out of all devices from IP %s, ending %d sessions", u, utils.GetClientIP(c.Request), revoked)
+		} else {
+			refreshToken, _ := c.Cookie("refresh_token")
+			if err := h.authSvc.Logout(u, refreshToken); err != nil {
+				log.Printf("[auth] failed to delete refresh token for user '%s': %v", u, err)
+			}
+			log.Printf("[auth] user '%s' logged out", u)
 		}
-		log.Printf("[auth] user '%s' logged out", u)
 	}
 
 	http.SetCookie(c.Writer, &http.Cookie{
@@ -94,19 +169,22 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 		Path:     "/",
 		SameSite: http.SameSiteStrictMode,
 	})
-	http.SetCookie(c.Writer, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		Expires:  time.Unix(0, 0),
-		HttpOnly: true,
-		Secure:   true,
-		Path:     "/api/auth/refresh",
-		SameSite: http.SameSiteStrictMode,
-	})
+	for _, path := range []string{refreshCookiePath, legacyRefreshCookiePath} {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     "refresh_token",
+			Value:    "",
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+			Secure:   true,
+			Path:     path,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
 	c.String(http.StatusOK, "Logged out successfully")
 }
 
-// UpdatePassword changes the user's own password.
+// UpdatePassword changes the user's own password. Their other sessions end, and this one continues
+// with new auth cookies.
 func (h *AuthHandler) UpdatePassword(c *gin.Context) {
 	var req struct {
 		OldPassword string `json:"old_password"`
@@ -120,7 +198,8 @@ func (h *AuthHandler) UpdatePassword(c *gin.Context) {
 	username, _ := c.Get(middleware.UsernameKey)
 	u, _ := username.(string)
 
-	if err := h.authSvc.UpdatePassword(u, req.OldPassword, req.NewPassword); err != nil {
+	result, err := h.authSvc.UpdatePassword(u, req.OldPassword, req.NewPassword, utils.GetClientIP(c.Request))
+	if err != nil {
 		msg := err.Error()
 		switch {
 		case msg == "invalid credentials":
@@ -136,6 +215,7 @@ func (h *AuthHandler) UpdatePassword(c *gin.Context) {
 		return
 	}
 
+	setLoginCookies(c, result)
 	log.Printf("[auth] password updated successfully for user '%s'", u)
 	c.String(http.StatusOK, "Password updated successfully")
 }
@@ -144,12 +224,17 @@ func (h *AuthHandler) UpdatePassword(c *gin.Context) {
 func (h *AuthHandler) GetCurrentUser(c *gin.Context) {
 	username, exists := c.Get(middleware.UsernameKey)
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		middleware.Unauthorized(c, false)
 		return
 	}
 
 	info, err := h.authSvc.GetCurrentUser(username.(string))
+	if errors.Is(err, sql.ErrNoRows) {
+		middleware.Unauthorized(c, true)
+		return
+	}
 	if err != nil {
+		log.Printf("[auth] get current user failed for '%s': %v", username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
@@ -157,6 +242,37 @@ func (h *AuthHandler) GetCurrentUser(c *gin.Context) {
 	c.JSON(http.StatusOK, info)
 }
 
+// Introspect verifies a session token and returns its claims and whether it is still active. Users
+// may introspect their own tokens; tokens of other users need manage_users.
+func (h *AuthHandler) Introspect(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Token) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+
+	u := c.GetString(middleware.UsernameKey)
+	result, err := h.authSvc.Introspect(u, strings.TrimSpace(req.Token))
+	if err != nil {
+		switch err.Error() {
+		case "forbidden":
+			log.Printf("[audit] user '%s' denied introspection of another user's token", u)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: You may only introspect your own tokens"})
+		default:
+			log.Printf("[auth] token introspection failed for user '%s': %v", u, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		return
+	}
+
+	if result.Username != "" && result.Username != u {
+		log.Printf("[audit] user '%s' introspected a token of user '%s'", u, result.Username)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 // RefreshToken generates a new access token from a valid refresh token.
 func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	cookie, err := c.Cookie("refresh_token")
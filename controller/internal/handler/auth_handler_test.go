@@ -2,16 +2,19 @@ package handler
 
 import (
 	"Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/service"
 	"Aegis/controller/internal/utils"
 	"bytes"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -91,6 +94,69 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestLoginCaseInsensitiveUsernames(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	t.Cleanup(func() { utils.SetLowercaseUsernames(false) })
+
+	password := "TestPass123!"
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewAuthHandler(service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	}))
+	r := gin.New()
+	r.POST("/api/auth/login", h.Login)
+	login := func(username string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// By default usernames are case-sensitive.
+	if _, err := userSvc.Create("CaseUser1", password, 0, ""); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if w := login("caseuser1"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Case-sensitive login with other case: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := login("CaseUser1"); w.Code != http.StatusOK {
+		t.Errorf("Case-sensitive login with exact case: expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	utils.SetLowercaseUsernames(true)
+	created, err := userSvc.Create("MixedCase2", password, 0, "")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if created.Credentials.Username != "mixedcase2" {
+		t.Errorf("Expected the username to be stored lowercase, got %q", created.Credentials.Username)
+	}
+	if _, err := userSvc.Create("mixedCASE2", password, 0, ""); err == nil || err.Error() != "username already exists" {
+		t.Errorf("Expected a username differing only in case to exist already, got %v", err)
+	}
+	for _, username := range []string{"mixedcase2", "MIXEDCASE2", "MixedCase2"} {
+		w := login(username)
+		if w.Code != http.StatusOK {
+			t.Errorf("Login as %q: expected status %d, got %d", username, http.StatusOK, w.Code)
+			continue
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name != "token" {
+				continue
+			}
+			if got, err := utils.GetUsernameFromToken(cookie.Value, []byte("test-secret-key")); err != nil || got != "mixedcase2" {
+				t.Errorf("Login as %q: expected a token for %q, got %q (%v)", username, "mixedcase2", got, err)
+			}
+		}
+	}
+}
+
 func TestLoginInactiveUser(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -195,6 +261,12 @@ func TestUpdatePassword(t *testing.T) {
 	r.POST("/api/auth/password", func(c *gin.Context) {
 		c.Set(middleware.UsernameKey, "passworduser")
 	}, h.UpdatePassword)
+	r.POST("/api/auth/refresh", h.RefreshToken)
+	r.GET("/probe", middleware.JWTAuth([]byte("test-secret-key"), nil, nil, &middleware.AccountCheck{Lookup: userRepo.GetAuthState, DisabledStatus: http.StatusUnauthorized}), func(c *gin.Context) { c.Status(http.StatusOK) })
+	before, err := authSvc.Login("passworduser", oldPassword, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
 
 	tests := []struct {
 		name           string
@@ -207,6 +279,7 @@ func TestUpdatePassword(t *testing.T) {
 		{"Weak new password", oldPassword, "weak", http.StatusBadRequest},
 	}
 
+	var issued []*http.Cookie
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			payload := map[string]string{"old_password": tt.oldPassword, "new_password": tt.newPassword}
@@ -219,8 +292,49 @@ func TestUpdatePassword(t *testing.T) {
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
 			}
+			if w.Code == http.StatusOK {
+				issued = w.Result().Cookies()
+			}
 		})
 	}
+
+	probe := func(cookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	refresh := func(cookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The tokens issued before the password change, as to another device, no longer work.
+	if code := probe(&http.Cookie{Name: "token", Value: before.TokenString}); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a token issued before the password change, got %d", http.StatusUnauthorized, code)
+	}
+	if code := refresh(&http.Cookie{Name: "refresh_token", Value: before.RefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a refresh token issued before the password change, got %d", http.StatusUnauthorized, code)
+	}
+
+	// The request that changed the password continues with the cookies it was given.
+	cookies := map[string]*http.Cookie{}
+	for _, c := range issued {
+		cookies[c.Name] = c
+	}
+	if cookies["token"] == nil || cookies["refresh_token"] == nil {
+		t.Fatalf("Expected new auth cookies with the password change, got %v", issued)
+	}
+	if code := probe(cookies["token"]); code != http.StatusOK {
+		t.Errorf("Expected status %d for the token issued with the password change, got %d", http.StatusOK, code)
+	}
+	if code := refresh(cookies["refresh_token"]); code != http.StatusOK {
+		t.Errorf("Expected status %d for the refresh token issued with the password change, got %d", http.StatusOK, code)
+	}
 }
 
 func TestGetCurrentUser(t *testing.T) {
@@ -269,6 +383,76 @@ func TestGetCurrentUser(t *testing.T) {
 	}
 }
 
+func TestGetCurrentUserCapabilities(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := utils.HashPassword("TestPass123!")
+	for _, u := range []struct {
+		name   string
+		roleID int
+	}{{"admin-user", 2}, {"plain-user", 3}} {
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, ?, ?, 1)", u.name, hashedPassword, u.roleID); err != nil {
+			t.Fatalf("Failed to create test user: %v", err)
+		}
+	}
+	for _, stmt := range []string{
+		"INSERT INTO services (id, name, hostname, ip, port) VALUES (10, 'Wiki', 'wiki:80', 0, 80), (11, 'Git', 'git:22', 0, 22), (12, 'Vault', 'vault:8200', 0, 8200)",
+		"INSERT INTO role_services (role_id, service_id) VALUES (3, 10), (2, 12)",
+		"INSERT INTO user_extra_services (user_id, service_id) SELECT id, 11 FROM users WHERE username = 'plain-user'",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Failed to set up services: %v", err)
+		}
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+	h := NewAuthHandler(authSvc)
+
+	tests := []struct {
+		username     string
+		capabilities service.Capabilities
+		services     []string
+	}{
+		{"root", service.Capabilities{CanManageUsers: true, CanManageServices: true, CanManageRoles: true}, []string{}},
+		{"admin-user", service.Capabilities{CanManageUsers: true, CanManageServices: true}, []string{"Vault"}},
+		{"plain-user", service.Capabilities{}, []string{"Git", "Wiki"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/api/auth/me", func(c *gin.Context) {
+				c.Set(middleware.UsernameKey, tt.username)
+			}, h.GetCurrentUser)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/me", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var result service.CurrentUserInfo
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if result.Capabilities != tt.capabilities {
+				t.Errorf("Expected capabilities %+v, got %+v", tt.capabilities, result.Capabilities)
+			}
+			names := []string{}
+			for _, s := range result.Services {
+				names = append(names, s.Name)
+			}
+			if !slices.Equal(names, tt.services) {
+				t.Errorf("Expected services %v, got %v", tt.services, names)
+			}
+		})
+	}
+}
+
 func TestGetCurrentUserUnauthorized(t *testing.T) {
 	h, cleanup := newAuthTestRouter(t)
 	defer cleanup()
@@ -285,6 +469,30 @@ func TestGetCurrentUserUnauthorized(t *testing.T) {
 	}
 }
 
+func TestGetCurrentUserStatus(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, _ := createReposFromDB(t, db)
+	h := NewAuthHandler(service.NewAuthService(userRepo, service.AuthConfig{JWTKey: []byte("test-secret-key"), TokenLifetime: time.Hour}))
+
+	get := func(username string) int {
+		r := gin.New()
+		r.GET("/api/auth/me", func(c *gin.Context) { c.Set(middleware.UsernameKey, username) }, h.GetCurrentUser)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/me", nil))
+		return w.Code
+	}
+
+	if code := get("deleted-user"); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a user that no longer exists, got %d", http.StatusUnauthorized, code)
+	}
+	_ = db.Close()
+	if code := get("root"); code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d when the database fails, got %d", http.StatusInternalServerError, code)
+	}
+}
+
 func TestRefreshToken(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -412,3 +620,259 @@ func TestLogoutAnonymous(t *testing.T) {
 		t.Error("Expected token cookie to be cleared on anonymous logout")
 	}
 }
+
+func TestStepUp(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	password := "TestPass123!"
+	hashedPassword, _ := utils.HashPassword(password)
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, ?, 3, 1)", "stepupuser", hashedPassword); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	key := []byte("test-secret-key")
+	h := NewAuthHandler(service.NewAuthService(userRepo, service.AuthConfig{JWTKey: key, TokenLifetime: time.Hour}))
+
+	r := gin.New()
+	r.POST("/api/auth/step-up", func(c *gin.Context) { c.Set(middleware.UsernameKey, "stepupuser") }, h.StepUp)
+	r.POST("/api/token/auth/step-up", func(c *gin.Context) {
+		c.Set(middleware.UsernameKey, "stepupuser")
+		c.Set(middleware.TokenScopeKey, models.TokenScopeFull)
+	}, h.StepUp)
+
+	stepUp := func(path, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(mustMarshal(t, map[string]string{"password": password})))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := stepUp("/api/auth/step-up", "wrongpassword"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a wrong password, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+	if w := stepUp("/api/token/auth/step-up", password); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for an API token, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	w := stepUp("/api/auth/step-up", password)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var claims *models.Claims
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "token" {
+			c, err := utils.ParseToken(cookie.Value, key)
+			if err != nil {
+				t.Fatalf("Failed to parse token: %v", err)
+			}
+			claims = c
+		}
+	}
+	if claims == nil || claims.AuthTime == nil || time.Since(claims.AuthTime.Time) > time.Minute {
+		t.Errorf("Expected a token with a fresh auth_time, got %+v", claims)
+	}
+	userID, _ := userRepo.GetIDByUsername("stepupuser")
+	if ip, err := userRepo.GetLastLoginIP(userID); err != nil || ip != "192.0.2.1" {
+		t.Errorf("Expected the login IP to be recorded, got %q, %v", ip, err)
+	}
+}
+
+func TestLogoutAllDevices(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	password := "TestPass123!"
+	hashedPassword, _ := utils.HashPassword(password)
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, ?, 2, 1)", "logoutuser", hashedPassword); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userRepo, _ := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+	h := NewAuthHandler(authSvc)
+
+	r := gin.New()
+	r.POST("/api/auth/logout", func(c *gin.Context) {
+		c.Set(middleware.UsernameKey, "logoutuser")
+	}, h.Logout)
+	r.GET("/probe", middleware.JWTAuth([]byte("test-secret-key"), nil, nil, &middleware.AccountCheck{Lookup: userRepo.GetAuthState, DisabledStatus: http.StatusUnauthorized}), func(c *gin.Context) { c.Status(http.StatusOK) })
+	probe := func(accessToken string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: accessToken})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	logout := func(query, refreshToken string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/logout"+query, nil)
+		if refreshToken != "" {
+			req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Each login is a session on its own device.
+	sessions := make([]string, 3)
+	accessTokens := make([]string, 3)
+	for i := range sessions {
+		result, err := authSvc.Login("logoutuser", password, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		sessions[i], accessTokens[i] = result.RefreshToken, result.TokenString
+	}
+	valid := func(refreshToken string) bool {
+		_, err := authSvc.RefreshToken(refreshToken)
+		return err == nil
+	}
+
+	// A plain logout ends only the session whose refresh token it carries.
+	if code := logout("", sessions[0]); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if valid(sessions[0]) {
+		t.Error("Expected the logged out session to be ended")
+	}
+	if !valid(sessions[1]) || !valid(sessions[2]) {
+		t.Fatal("Expected the other sessions to stay valid")
+	}
+	if code := probe(accessTokens[1]); code != http.StatusOK {
+		t.Fatalf("Expected status %d for the access token of another session, got %d", http.StatusOK, code)
+	}
+
+	if code := logout("?all=maybe", sessions[1]); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid all parameter, got %d", http.StatusBadRequest, code)
+	}
+
+	if code := logout("?all=true", sessions[1]); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	for i, s := range sessions {
+		if valid(s) {
+			t.Errorf("Expected session %d to be ended by logging out of all devices", i)
+		}
+		if code := probe(accessTokens[i]); code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for the access token of session %d, got %d", http.StatusUnauthorized, i, code)
+		}
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, u := range []struct {
+		name   string
+		roleID int
+	}{{"alice", 3}, {"bob", 3}, {"boss", 2}} {
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, 'x', ?, 1)", u.name, u.roleID); err != nil {
+			t.Fatalf("Failed to create user %s: %v", u.name, err)
+		}
+	}
+	userRepo, _ := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+	h := NewAuthHandler(authSvc)
+
+	token := func(username string, expiresAt time.Time, key []byte) string {
+		t.Helper()
+		claims := &models.Claims{
+			Username: username,
+			Role:     "user",
+			RoleID:   3,
+			Provider: "local",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+				Issuer:    "aegis-controller",
+				Subject:   username,
+			},
+		}
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return s
+	}
+	key := []byte("test-secret-key")
+	valid := token("alice", time.Now().Add(time.Hour), key)
+	expired := token("alice", time.Now().Add(-time.Minute), key)
+	forged := token("alice", time.Now().Add(time.Hour), []byte("attacker-key"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"username": "alice"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	introspect := func(caller, tok string) (int, map[string]any) {
+		t.Helper()
+		r := gin.New()
+		r.POST("/api/auth/introspect", func(c *gin.Context) {
+			c.Set(middleware.UsernameKey, caller)
+		}, h.Introspect)
+		body, _ := json.Marshal(map[string]string{"token": tok})
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/introspect", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	tests := []struct {
+		name       string
+		caller     string
+		token      string
+		wantCode   int
+		wantStatus string
+		wantActive bool
+	}{
+		{"Own valid token", "alice", valid, http.StatusOK, service.TokenStatusActive, true},
+		{"Own expired token", "alice", expired, http.StatusOK, service.TokenStatusExpired, false},
+		{"Forged token", "alice", forged, http.StatusOK, service.TokenStatusInvalid, false},
+		{"Unsigned token", "alice", unsigned, http.StatusOK, service.TokenStatusInvalid, false},
+		{"Garbage", "alice", "not-a-token", http.StatusOK, service.TokenStatusInvalid, false},
+		{"Other user's token", "bob", valid, http.StatusForbidden, "", false},
+		{"Other user's expired token", "bob", expired, http.StatusForbidden, "", false},
+		{"Admin introspecting another user's token", "boss", valid, http.StatusOK, service.TokenStatusActive, true},
+		{"Missing token", "alice", "", http.StatusBadRequest, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := introspect(tt.caller, tt.token)
+			if code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %v", tt.wantCode, code, resp)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			if resp["status"] != tt.wantStatus || resp["active"] != tt.wantActive {
+				t.Errorf("Expected status %q active %v, got %v", tt.wantStatus, tt.wantActive, resp)
+			}
+			if tt.wantStatus == service.TokenStatusInvalid {
+				if _, ok := resp["username"]; ok {
+					t.Errorf("Expected no claims for an invalid token, got %v", resp)
+				}
+				return
+			}
+			if resp["username"] != "alice" || resp["role"] != "user" || resp["provider"] != "local" ||
+				resp["issuer"] != "aegis-controller" || resp["expires_at"] == nil {
+				t.Errorf("Expected the token's claims, got %v", resp)
+			}
+		})
+	}
+
+	// Raising alice's token generation, as a role change does, revokes the token.
+	if _, err := db.Exec("UPDATE users SET token_generation = token_generation + 1 WHERE username = 'alice'"); err != nil {
+		t.Fatalf("Failed to raise token generation: %v", err)
+	}
+	if code, resp := introspect("alice", valid); code != http.StatusOK || resp["status"] != service.TokenStatusRevoked || resp["active"] != false {
+		t.Errorf("Expected a revoked token, got %d: %v", code, resp)
+	}
+}
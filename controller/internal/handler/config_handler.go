@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"Aegis/controller/config"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FeatureFlags reports which optional features are in effect, as opposed to merely configured.
+type FeatureFlags struct {
+	OIDCEnabled          bool `json:"oidc_enabled"`
+	RS256Enabled         bool `json:"rs256_enabled"`
+	ES256Enabled         bool `json:"es256_enabled"`
+	DockerWatcherRunning bool `json:"docker_watcher_running"`
+	AgentConnected       bool `json:"agent_connected"`
+}
+
+// FeatureFlagsFunc reports the current feature flags.
+type FeatureFlagsFunc func() FeatureFlags
+
+// ConfigHandler exposes the effective configuration for troubleshooting.
+type ConfigHandler struct {
+	cfg   *config.Config
+	flags FeatureFlagsFunc
+}
+
+// NewConfigHandler creates a new ConfigHandler.
+func NewConfigHandler(cfg *config.Config, flags FeatureFlagsFunc) *ConfigHandler {
+	return &ConfigHandler{cfg: cfg, flags: flags}
+}
+
+// Get returns the configuration with secrets redacted, and the feature flags computed from the
+// running state.
+func (h *ConfigHandler) Get(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"config": h.cfg.Redacted(), "features": h.flags()})
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"Aegis/controller/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConfigHandlerRedactsSecrets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		ServerPort:       ":443",
+		JwtKey:           "jwt-signing-secret",
+		OIDCEnabled:      true,
+		OIDCGoogleSecret: "google-client-secret",
+		OIDCGitHubSecret: "github-client-secret",
+		OIDCTokenKey:     "refresh-token-key",
+		Agents:           map[string]string{"edge": "10.0.0.3:50001"},
+	}
+	flags := FeatureFlags{OIDCEnabled: true, DockerWatcherRunning: true}
+	h := NewConfigHandler(cfg, func() FeatureFlags { return flags })
+
+	r := gin.New()
+	r.GET("/api/admin/config", h.Get)
+	get := func() (map[string]any, FeatureFlags) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/config", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		for _, secret := range []string{cfg.JwtKey, cfg.OIDCGoogleSecret, cfg.OIDCGitHubSecret, cfg.OIDCTokenKey} {
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("Expected %q to be redacted, got %s", secret, w.Body.String())
+			}
+		}
+		var resp struct {
+			Config   map[string]any `json:"config"`
+			Features FeatureFlags   `json:"features"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp.Config, resp.Features
+	}
+
+	got, features := get()
+	if got["JwtKey"] != "***" || got["OIDCGoogleSecret"] != "***" {
+		t.Errorf("Expected set secrets to read ***, got %v and %v", got["JwtKey"], got["OIDCGoogleSecret"])
+	}
+	if got["ServerPort"] != ":443" {
+		t.Errorf("Expected ServerPort :443, got %v", got["ServerPort"])
+	}
+	if features != flags {
+		t.Errorf("Expected features %+v, got %+v", flags, features)
+	}
+	if cfg.JwtKey != "jwt-signing-secret" {
+		t.Errorf("Expected the running configuration to keep its secret, got %q", cfg.JwtKey)
+	}
+
+	// Flags are computed per request, so they follow the running state.
+	flags = FeatureFlags{RS256Enabled: true, AgentConnected: true}
+	if _, features := get(); features != flags {
+		t.Errorf("Expected features %+v, got %+v", flags, features)
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/connectivity"
+)
+
+// readinessTimeout bounds how long a single dependency check may take.
+const readinessTimeout = 2 * time.Second
+
+// AgentStateFunc reports the agent connection state and whether the client is initialized.
+type AgentStateFunc func() (connectivity.State, bool)
+
+// AgentEndpointFunc reports the agent endpoint currently in use, or "" if none.
+type AgentEndpointFunc func() string
+
+// LastSyncFunc reports when the agent last delivered a session list, or the zero time if never.
+type LastSyncFunc func() time.Time
+
+// AgentCall summarizes the calls made to the agent with one gRPC method.
+type AgentCall struct {
+	Method       string  `json:"method"`
+	Calls        uint64  `json:"calls"`
+	Errors       uint64  `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	LastError    string  `json:"last_error,omitempty"`
+	// LastErrorAgeSeconds is how long ago LastError occurred; nil if no call has failed.
+	LastErrorAgeSeconds *int64 `json:"last_error_age_seconds,omitempty"`
+}
+
+// AgentCallsFunc reports the calls made to the agent so far, by method.
+type AgentCallsFunc func() []AgentCall
+
+// DockerStatus is the state of the Docker watcher's event subscription.
+type DockerStatus struct {
+	Enabled     bool
+	Connected   bool
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// DockerStatusFunc reports the state of the Docker watcher.
+type DockerStatusFunc func() DockerStatus
+
+// HealthHandler handles liveness and readiness probes.
+type HealthHandler struct {
+	db            *sql.DB
+	agentState    AgentStateFunc
+	agentEndpoint AgentEndpointFunc
+	lastSync      LastSyncFunc
+	agentCalls    AgentCallsFunc
+	docker        DockerStatusFunc
+}
+
+// NewHealthHandler creates a new HealthHandler. agentEndpoint, lastSync, agentCalls and docker may be nil.
+func NewHealthHandler(db *sql.DB, agentState AgentStateFunc, agentEndpoint AgentEndpointFunc, lastSync LastSyncFunc, agentCalls AgentCallsFunc, docker DockerStatusFunc) *HealthHandler {
+	return &HealthHandler{db: db, agentState: agentState, agentEndpoint: agentEndpoint, lastSync: lastSync, agentCalls: agentCalls, docker: docker}
+}
+
+type dependencyStatus struct {
+	Status   string `json:"status"`
+	State    string `json:"state,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// LastSyncAgeSeconds is how long ago the agent last delivered a session list; nil if never.
+	LastSyncAgeSeconds *int64 `json:"last_sync_age_seconds,omitempty"`
+	// Calls breaks down the calls made to the agent by method, to tell a slow or failing agent from
+	// a slow controller.
+	Calls []AgentCall `json:"calls,omitempty"`
+	// LastErrorAgeSeconds is how long ago Error occurred, for dependencies that recover from errors
+	// on their own; nil if none has.
+	LastErrorAgeSeconds *int64 `json:"last_error_age_seconds,omitempty"`
+}
+
+// Liveness reports that the server loop is running.
+func (h *HealthHandler) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness reports whether the database and agent connection are usable. The Docker watcher is
+// reported too but is optional, so its state does not affect readiness.
+func (h *HealthHandler) Readiness(c *gin.Context) {
+	ready := true
+	checks := make(map[string]dependencyStatus)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+	if err := h.db.PingContext(ctx); err != nil {
+		log.Printf("[health] readiness: database ping failed: %v", err)
+		checks["database"] = dependencyStatus{Status: "unavailable"}
+		ready = false
+	} else {
+		checks["database"] = dependencyStatus{Status: "ok"}
+	}
+
+	var endpoint string
+	if h.agentEndpoint != nil {
+		endpoint = h.agentEndpoint()
+	}
+	var agent dependencyStatus
+	state, initialized := h.agentState()
+	switch {
+	case !initialized:
+		agent = dependencyStatus{Status: "unavailable", Error: "agent client not initialized"}
+		ready = false
+	case state == connectivity.Ready || state == connectivity.Idle:
+		agent = dependencyStatus{Status: "ok", State: state.String(), Endpoint: endpoint}
+	default:
+		agent = dependencyStatus{Status: "unavailable", State: state.String(), Endpoint: endpoint}
+		ready = false
+	}
+	if h.lastSync != nil {
+		if last := h.lastSync(); !last.IsZero() {
+			age := int64(time.Since(last) / time.Second)
+			agent.LastSyncAgeSeconds = &age
+		}
+	}
+	if h.agentCalls != nil {
+		agent.Calls = h.agentCalls()
+	}
+	checks["agent"] = agent
+	if h.docker != nil {
+		checks["docker"] = dockerStatus(h.docker())
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
+
+// dockerStatus reports the Docker watcher as "ok" while subscribed to container events,
+// "disconnected" while reconnecting and "disabled" if Docker was not reachable at startup.
+func dockerStatus(st DockerStatus) dependencyStatus {
+	out := dependencyStatus{Status: "ok", State: "connected", Error: st.LastError}
+	switch {
+	case !st.Enabled:
+		out.Status, out.State = "disabled", ""
+	case !st.Connected:
+		out.Status, out.State = "disconnected", "reconnecting"
+	}
+	if !st.LastErrorAt.IsZero() {
+		age := int64(time.Since(st.LastErrorAt) / time.Second)
+		out.LastErrorAgeSeconds = &age
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestLiveness(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	h := NewHealthHandler(db, func() (connectivity.State, bool) { return connectivity.Shutdown, false }, nil, nil, nil, nil)
+
+	r := gin.New()
+	r.GET("/healthz", h.Liveness)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name           string
+		state          connectivity.State
+		initialized    bool
+		closeDB        bool
+		expectedStatus int
+		expectedAgent  string
+		expectedDB     string
+	}{
+		{"Agent ready", connectivity.Ready, true, false, http.StatusOK, "ok", "ok"},
+		{"Agent idle", connectivity.Idle, true, false, http.StatusOK, "ok", "ok"},
+		{"Agent in transient failure", connectivity.TransientFailure, true, false, http.StatusServiceUnavailable, "unavailable", "ok"},
+		{"Agent not initialized", connectivity.Shutdown, false, false, http.StatusServiceUnavailable, "unavailable", "ok"},
+		{"Database closed", connectivity.Ready, true, true, http.StatusServiceUnavailable, "ok", "unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := setupTestDB(t)
+			defer cleanup()
+			if tt.closeDB {
+				_ = db.Close()
+			}
+
+			lastSync := func() time.Time { return time.Now().Add(-42 * time.Second) }
+			h := NewHealthHandler(db, func() (connectivity.State, bool) { return tt.state, tt.initialized }, func() string { return "10.0.0.2:50001" }, lastSync, func() []AgentCall {
+				return []AgentCall{{Method: "/session.SessionManager/SubmitSession", Calls: 4, Errors: 1, AvgLatencyMs: 12.5, LastError: "unavailable"}}
+			}, func() DockerStatus {
+				return DockerStatus{Enabled: true, LastError: "unexpected EOF", LastErrorAt: time.Now().Add(-3 * time.Second)}
+			})
+
+			r := gin.New()
+			r.GET("/readyz", h.Readiness)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+
+			var resp struct {
+				Status string                      `json:"status"`
+				Checks map[string]dependencyStatus `json:"checks"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Checks["agent"].Status != tt.expectedAgent {
+				t.Errorf("Expected agent status %q, got %q", tt.expectedAgent, resp.Checks["agent"].Status)
+			}
+			if tt.initialized && resp.Checks["agent"].Endpoint != "10.0.0.2:50001" {
+				t.Errorf("Expected agent endpoint %q, got %q", "10.0.0.2:50001", resp.Checks["agent"].Endpoint)
+			}
+			if age := resp.Checks["agent"].LastSyncAgeSeconds; age == nil || *age != 42 {
+				t.Errorf("Expected a last sync age of 42s, got %v", age)
+			}
+			if calls := resp.Checks["agent"].Calls; len(calls) != 1 || calls[0].Calls != 4 || calls[0].Errors != 1 {
+				t.Errorf("Expected the agent call summary, got %+v", calls)
+			}
+			if docker := resp.Checks["docker"]; docker.Status != "disconnected" || docker.Error != "unexpected EOF" || docker.LastErrorAgeSeconds == nil || *docker.LastErrorAgeSeconds != 3 {
+				t.Errorf("Expected a reconnecting Docker watcher, got %+v", docker)
+			}
+			if resp.Checks["database"].Status != tt.expectedDB {
+				t.Errorf("Expected database status %q, got %q", tt.expectedDB, resp.Checks["database"].Status)
+			}
+			if resp.Checks["database"].Error != "" {
+				t.Errorf("Expected the database error to stay out of the response, got %q", resp.Checks["database"].Error)
+			}
+		})
+	}
+}
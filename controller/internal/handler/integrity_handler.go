@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/service"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IntegrityHandler reports and repairs data left inconsistent by manual database edits.
+type IntegrityHandler struct {
+	integritySvc service.IntegrityService
+}
+
+// NewIntegrityHandler creates a new IntegrityHandler.
+func NewIntegrityHandler(integritySvc service.IntegrityService) *IntegrityHandler {
+	return &IntegrityHandler{integritySvc: integritySvc}
+}
+
+// Get reports malformed values stored for services, with a suggested repair for each, and rows that
+// refer to rows which no longer exist.
+func (h *IntegrityHandler) Get(c *gin.Context) {
+	report, err := h.integritySvc.Check()
+	if err != nil {
+		log.Printf("[integrity] check failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check data integrity"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+type integrityCleanup struct {
+	Removed []models.Orphan `json:"removed"`
+	*models.IntegrityReport
+}
+
+// Clean deletes the removable orphans and returns them with the report of what is left.
+func (h *IntegrityHandler) Clean(c *gin.Context) {
+	removed, err := h.integritySvc.RemoveOrphans()
+	if err != nil {
+		log.Printf("[integrity] cleanup failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove orphaned rows"})
+		return
+	}
+	log.Printf("[integrity] %s removed %d orphaned rows", c.GetString(middleware.UsernameKey), len(removed))
+	report, err := h.integritySvc.Check()
+	if err != nil {
+		log.Printf("[integrity] check failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check data integrity"})
+		return
+	}
+	c.JSON(http.StatusOK, integrityCleanup{Removed: removed, IntegrityReport: report})
+}
@@ -5,10 +5,12 @@ import (
 	oidcPkg "Aegis/controller/internal/oidc"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,8 +19,28 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
 )
 
+// stateTTL is how long a login may take at the provider before its state token expires.
+const stateTTL = 10 * time.Minute
+
+// maxPendingStates caps the outstanding state tokens, so flooding the login endpoint cannot
+// exhaust memory. Further logins are refused until tokens are used or expire.
+const maxPendingStates = 10000
+
+// exchangeTimeout bounds the exchange of an authorization code for tokens at the provider.
+const exchangeTimeout = 10 * time.Second
+
+// errInvalidCode is wrapped by exchange errors for codes the provider rejected.
+var errInvalidCode = errors.New("invalid authorization code")
+
+// pendingLogin is a login waiting for the provider to redirect back, stored under its state token.
+type pendingLogin struct {
+	provider string
+	expires  time.Time
+}
+
 // OIDCHandler handles OIDC authentication endpoints.
 type OIDCHandler struct {
 	oidcManager *oidcPkg.OIDCManager
@@ -26,7 +48,8 @@ type OIDCHandler struct {
 	userRepo    repository.UserRepository
 	roleRepo    repository.RoleRepository
 	stateMu     sync.Mutex
-	states      map[string]time.Time
+	states      map[string]pendingLogin
+	maxStates   int
 }
 
 // NewOIDCHandler creates a new OIDCHandler.
@@ -36,11 +59,13 @@ func NewOIDCHandler(oidcManager *oidcPkg.OIDCManager, authSvc service.AuthServic
 		authSvc:     authSvc,
 		userRepo:    userRepo,
 		roleRepo:    roleRepo,
-		states:      make(map[string]time.Time),
+		states:      make(map[string]pendingLogin),
+		maxStates:   maxPendingStates,
 	}
 }
 
-// ListProviders returns the list of enabled OIDC providers.
+// ListProviders returns the list of enabled OIDC providers. Disabled providers are left out, so the
+// login page does not offer them.
 func (h *OIDCHandler) ListProviders(c *gin.Context) {
 	if h.oidcManager == nil {
 		c.JSON(http.StatusNotImplemented, gin.H{"error": "OIDC not enabled"})
@@ -48,8 +73,10 @@ func (h *OIDCHandler) ListProviders(c *gin.Context) {
 	}
 
 	providers := make([]string, 0, len(h.oidcManager.Providers))
-	for name := range h.oidcManager.Providers {
-		providers = append(providers, name)
+	for name, provider := range h.oidcManager.Providers {
+		if !provider.Disabled {
+			providers = append(providers, name)
+		}
 	}
 	c.JSON(http.StatusOK, gin.H{"providers": providers})
 }
@@ -73,11 +100,24 @@ func (h *OIDCHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider"})
 		return
 	}
+	if provider.Disabled {
+		log.Printf("[oidc] refusing login via disabled provider %s from %s", providerName, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": providerDisabledMessage(providerName)})
+		return
+	}
 
 	state := h.generateState()
 	h.stateMu.Lock()
-	h.states[state] = time.Now().Add(10 * time.Minute)
-	h.cleanExpiredStates()
+	if len(h.states) >= h.maxStates {
+		h.cleanExpiredStates()
+	}
+	if len(h.states) >= h.maxStates {
+		h.stateMu.Unlock()
+		log.Printf("[oidc] refusing login from %s: %d logins pending", c.ClientIP(), h.maxStates)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many pending logins, try again later"})
+		return
+	}
+	h.states[state] = pendingLogin{provider: providerName, expires: time.Now().Add(stateTTL)}
 	h.stateMu.Unlock()
 
 	authURL := provider.Config.AuthCodeURL(state)
@@ -98,13 +138,13 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 	}
 
 	h.stateMu.Lock()
-	expiry, ok := h.states[state]
+	pending, ok := h.states[state]
 	if ok {
 		delete(h.states, state)
 	}
 	h.stateMu.Unlock()
 
-	if !ok || time.Now().After(expiry) {
+	if !ok || time.Now().After(pending.expires) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired state"})
 		return
 	}
@@ -115,27 +155,33 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 		return
 	}
 
-	var userInfo *oidcUserInfo
-	var providerName string
-	var err error
-
-	for name, provider := range h.oidcManager.Providers {
-		userInfo, err = h.exchangeCodeForUserInfo(c.Request.Context(), provider, code)
-		if err == nil {
-			providerName = name
-			break
-		}
-		log.Printf("[oidc] failed to exchange code with %s: %v", name, err)
+	// The code is only exchanged with the provider the login started at.
+	providerName := pending.provider
+	provider, err := h.oidcManager.GetProvider(providerName)
+	if err != nil {
+		log.Printf("[oidc] callback failed: provider %s of the login is no longer configured", providerName)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired state"})
+		return
+	}
+	// The provider may have been disabled while the login was at it.
+	if provider.Disabled {
+		log.Printf("[oidc] callback refused: provider %s is disabled", providerName)
+		c.JSON(http.StatusForbidden, gin.H{"error": providerDisabledMessage(providerName)})
+		return
 	}
 
-	if userInfo == nil {
-		log.Printf("[oidc] callback failed: could not exchange code with any provider")
+	userInfo, err := h.exchangeCodeForUserInfo(c.Request.Context(), provider, code)
+	if err != nil {
+		log.Printf("[oidc] callback failed: could not exchange code with %s: %v", providerName, err)
+		if errors.Is(err, oidcPkg.ErrProviderUnavailable) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable, try again later"})
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
 		return
 	}
 
-	provider, _ := h.oidcManager.GetProvider(providerName)
-	roleName := provider.MapClaimsToRole(userInfo.Email, userInfo.Groups)
+	roleName := provider.MapClaimsToRole(userInfo.Email, userInfo.EmailVerified, userInfo.Groups)
 
 	if roleName == "" || roleName == "none" {
 		log.Printf("[oidc] login denied for user '%s' via %s: no role mapping and no default role", userInfo.Email, providerName)
@@ -155,6 +201,10 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
 		return
 	}
+	if err := h.userRepo.SetLastLoginIP(user.Id, utils.GetClientIP(c.Request)); err != nil {
+		log.Printf("[oidc] failed to record login IP for user '%s': %v", user.Username, err)
+	}
+	h.storeProviderRefreshToken(user, providerName, userInfo.RefreshToken)
 
 	expiresAt := time.Now().Add(time.Hour)
 	claims := &models.Claims{
@@ -162,6 +212,7 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 		Role:     roleName,
 		RoleID:   user.RoleId,
 		Provider: providerName,
+		AuthTime: jwt.NewNumericDate(time.Now()),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			Issuer:    "aegis-controller",
@@ -200,7 +251,7 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 				Expires:  refreshExpiry,
 				HttpOnly: true,
 				Secure:   true,
-				Path:     "/api/auth/refresh",
+				Path:     refreshCookiePath,
 				SameSite: http.SameSiteStrictMode,
 			})
 		}
@@ -210,6 +261,73 @@ func (h *OIDCHandler) Callback(c *gin.Context) {
 	c.Redirect(http.StatusTemporaryRedirect, "/static/pages/dashboard.html")
 }
 
+// testMappingRequest is a sample identity to run through role mapping rules.
+type testMappingRequest struct {
+	Provider string   `json:"provider"`
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups"`
+	// EmailVerified defaults to true, as most providers only return verified addresses.
+	EmailVerified *bool `json:"email_verified"`
+	// Rules replaces the provider's configured rules, as an object or as the JSON string the
+	// configuration holds.
+	Rules json.RawMessage `json:"rules"`
+}
+
+// TestMapping returns the role the role mapping rules assign to a sample identity and the rule that
+// decided it, so rules can be checked before users log in with them (root only).
+func (h *OIDCHandler) TestMapping(c *gin.Context) {
+	var req testMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	var rules *oidcPkg.RoleMappingRules
+	if len(req.Rules) > 0 {
+		rulesJSON := string(req.Rules)
+		var str string
+		if json.Unmarshal(req.Rules, &str) == nil {
+			rulesJSON = str
+		}
+		var err error
+		if rules, err = oidcPkg.ParseRoleMappingRules(rulesJSON); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role mapping rules: " + err.Error()})
+			return
+		}
+	} else {
+		if h.oidcManager == nil {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "OIDC not enabled"})
+			return
+		}
+		if req.Provider == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Provider or rules required"})
+			return
+		}
+		provider, err := h.oidcManager.GetProvider(req.Provider)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider"})
+			return
+		}
+		rules = provider.Rules()
+	}
+
+	verified := req.EmailVerified == nil || *req.EmailVerified
+	role, matched := rules.Match(req.Email, verified, req.Groups)
+	// Callback refuses the login without a role, and fails it for a role that does not exist.
+	denied := role == "" || role == "none"
+	resp := gin.H{"role": role, "matched": matched, "denied": denied}
+	if !denied {
+		_, err := h.roleRepo.GetIDByName(role)
+		resp["role_exists"] = err == nil
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// providerDisabledMessage tells a user that logins via a provider are turned off.
+func providerDisabledMessage(provider string) string {
+	return fmt.Sprintf("Logins via %s are disabled", provider)
+}
+
 // oidcUserInfo contains user info extracted from an OIDC provider.
 type oidcUserInfo struct {
 	Subject       string
@@ -217,17 +335,28 @@ type oidcUserInfo struct {
 	EmailVerified bool
 	Name          string
 	Groups        []string
+	// RefreshToken is the provider's refresh token, set only when offline access was granted.
+	RefreshToken string
 }
 
 // exchangeCodeForUserInfo exchanges an OAuth2 authorization code for user information.
 // It supports both standard OIDC providers (via ID token verification) and GitHub OAuth2.
+// Errors wrap errInvalidCode when the provider rejected the code, and
+// oidcPkg.ErrProviderUnavailable when it could not be reached.
 func (h *OIDCHandler) exchangeCodeForUserInfo(ctx context.Context, provider *oidcPkg.Provider, code string) (*oidcUserInfo, error) {
-	oauth2Token, err := provider.Config.Exchange(ctx, code)
+	exchangeCtx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+	oauth2Token, err := provider.Config.Exchange(exchangeCtx, code)
 	if err != nil {
-		return nil, fmt.Errorf("failed to exchange token: %w", err)
+		// The code is single-use, so a failed exchange is not retried.
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+			return nil, fmt.Errorf("failed to exchange token: %w: %w", errInvalidCode, err)
+		}
+		return nil, fmt.Errorf("failed to exchange token: %w: %w", oidcPkg.ErrProviderUnavailable, err)
 	}
 
-	userInfo := &oidcUserInfo{}
+	userInfo := &oidcUserInfo{RefreshToken: oauth2Token.RefreshToken}
 
 	if provider.Verifier != nil {
 		rawIDToken, ok := oauth2Token.Extra("id_token").(string)
@@ -252,19 +381,14 @@ func (h *OIDCHandler) exchangeCodeForUserInfo(ctx context.Context, provider *oid
 		userInfo.Name = claims.Name
 	} else {
 		client := provider.Config.Client(ctx, oauth2Token)
-		resp, err := client.Get("https://api.github.com/user")
-		if err != nil {
-			return nil, fmt.Errorf("failed to get user info: %w", err)
-		}
-		defer func() { _ = resp.Body.Close() }()
 		var githubUser struct {
 			ID    int64  `json:"id"`
 			Login string `json:"login"`
 			Email string `json:"email"`
 			Name  string `json:"name"`
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&githubUser); err != nil {
-			return nil, fmt.Errorf("failed to decode user info: %w", err)
+		if err := oidcPkg.GitHubGetJSON(ctx, client, provider.APIURL+"/user", &githubUser); err != nil {
+			return nil, fmt.Errorf("failed to get user info: %w", err)
 		}
 		userInfo.Subject = fmt.Sprintf("%d", githubUser.ID)
 		userInfo.Email = githubUser.Email
@@ -272,24 +396,28 @@ func (h *OIDCHandler) exchangeCodeForUserInfo(ctx context.Context, provider *oid
 		userInfo.EmailVerified = true
 
 		if userInfo.Email == "" {
-			emailResp, err := client.Get("https://api.github.com/user/emails")
-			if err == nil {
-				defer func() { _ = emailResp.Body.Close() }()
-				var emails []struct {
-					Email    string `json:"email"`
-					Primary  bool   `json:"primary"`
-					Verified bool   `json:"verified"`
-				}
-				if json.NewDecoder(emailResp.Body).Decode(&emails) == nil {
-					for _, e := range emails {
-						if e.Primary && e.Verified {
-							userInfo.Email = e.Email
-							break
-						}
-					}
+			var emails []struct {
+				Email    string `json:"email"`
+				Primary  bool   `json:"primary"`
+				Verified bool   `json:"verified"`
+			}
+			if err := oidcPkg.GitHubGetJSON(ctx, client, provider.APIURL+"/user/emails", &emails); err != nil {
+				log.Printf("[oidc] failed to fetch GitHub emails for user '%s': %v", githubUser.Login, err)
+			}
+			for _, e := range emails {
+				if e.Primary && e.Verified {
+					userInfo.Email = e.Email
+					break
 				}
 			}
 		}
+
+		// Without groups the login still maps by email or falls back to the default role.
+		groups, err := oidcPkg.FetchGitHubGroups(ctx, client, provider.APIURL, provider.GitHubGroups)
+		if err != nil {
+			log.Printf("[oidc] failed to fetch GitHub groups for user '%s', mapping without them: %v", githubUser.Login, err)
+		}
+		userInfo.Groups = groups
 	}
 	return userInfo, nil
 }
@@ -313,9 +441,9 @@ func (h *OIDCHandler) getOrCreateOIDCUser(userInfo *oidcUserInfo, provider, role
 		return nil, fmt.Errorf("failed to get role ID for role '%s': %w", roleName, err)
 	}
 
-	username := userInfo.Email
-	if username == "" {
-		username = fmt.Sprintf("%s_%s", provider, userInfo.Subject)
+	username, err := oidcUsername(userInfo, provider)
+	if err != nil {
+		return nil, err
 	}
 
 	newUser, err := h.userRepo.CreateOIDCUser(username, provider, userInfo.Subject, userInfo.Email, roleID)
@@ -327,6 +455,34 @@ func (h *OIDCHandler) getOrCreateOIDCUser(userInfo *oidcUserInfo, provider, role
 	return newUser, nil
 }
 
+// oidcUsername picks the username of a new OIDC user: the email address if it follows the
+// configured username rule, otherwise provider_subject. Either is normalized like local usernames.
+func oidcUsername(userInfo *oidcUserInfo, provider string) (string, error) {
+	if email := utils.NormalizeUsername(userInfo.Email); email != "" && utils.ValidUsername(email) {
+		return email, nil
+	}
+	if username := utils.NormalizeUsername(fmt.Sprintf("%s_%s", provider, userInfo.Subject)); utils.ValidUsername(username) {
+		return username, nil
+	}
+	return "", fmt.Errorf("no username for %s subject %q follows the configured username pattern", provider, userInfo.Subject)
+}
+
+// storeProviderRefreshToken keeps the refresh token issued by the provider, encrypted with the
+// manager's token key. Without a token or key there is nothing to store.
+func (h *OIDCHandler) storeProviderRefreshToken(user *models.User, providerName, refreshToken string) {
+	if refreshToken == "" || h.oidcManager.TokenKey == "" {
+		return
+	}
+	sealed, err := utils.Seal(h.oidcManager.TokenKey, refreshToken)
+	if err != nil {
+		log.Printf("[oidc] failed to encrypt %s refresh token for user '%s': %v", providerName, user.Username, err)
+		return
+	}
+	if err := h.userRepo.SetOIDCRefreshToken(user.Id, providerName, sealed); err != nil {
+		log.Printf("[oidc] failed to store %s refresh token for user '%s': %v", providerName, user.Username, err)
+	}
+}
+
 // generateState creates a cryptographically random, URL-safe state token for CSRF protection.
 func (h *OIDCHandler) generateState() string {
 	b := make([]byte, 32)
@@ -338,13 +494,29 @@ func (h *OIDCHandler) generateState() string {
 // Must be called with h.stateMu held.
 func (h *OIDCHandler) cleanExpiredStates() {
 	now := time.Now()
-	for state, expiry := range h.states {
-		if now.After(expiry) {
+	for state, pending := range h.states {
+		if now.After(pending.expires) {
 			delete(h.states, state)
 		}
 	}
 }
 
+// PruneStates removes expired state tokens every interval until ctx is cancelled.
+func (h *OIDCHandler) PruneStates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.stateMu.Lock()
+			h.cleanExpiredStates()
+			h.stateMu.Unlock()
+		}
+	}
+}
+
 // generateSecureToken creates a cryptographically random, URL-safe token of n bytes.
 func generateSecureToken(n int) (string, error) {
 	b := make([]byte, n)
@@ -3,14 +3,22 @@ package handler
 import (
 	oidcPkg "Aegis/controller/internal/oidc"
 	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
 )
 
 func TestListOIDCProviders(t *testing.T) {
@@ -27,6 +35,7 @@ func TestListOIDCProviders(t *testing.T) {
 	tests := []struct {
 		name           string
 		setupOIDC      bool
+		opts           oidcPkg.Options
 		expectedStatus int
 		expectedCount  int
 	}{
@@ -41,6 +50,13 @@ func TestListOIDCProviders(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectedCount:  1,
 		},
+		{
+			name:           "Disabled provider is not listed",
+			setupOIDC:      true,
+			opts:           oidcPkg.Options{GitHubDisabled: true},
+			expectedStatus: http.StatusOK,
+			expectedCount:  0,
+		},
 	}
 
 	for _, tt := range tests {
@@ -53,6 +69,7 @@ func TestListOIDCProviders(t *testing.T) {
 					"test-github-client", "test-github-secret",
 					"http://localhost/callback",
 					`{"default_role": "user"}`,
+					tt.opts,
 				)
 				if err != nil {
 					t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -106,6 +123,7 @@ func TestOIDCCallbackMissingState(t *testing.T) {
 		"test-github-client", "test-github-secret",
 		"http://localhost/callback",
 		`{"default_role": "user"}`,
+		oidcPkg.Options{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -203,6 +221,7 @@ func TestOIDCLogin(t *testing.T) {
 		"test-github-client", "test-github-secret",
 		"http://localhost/callback",
 		`{"default_role": "user"}`,
+		oidcPkg.Options{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -273,6 +292,7 @@ func TestOIDCCallbackInvalidState(t *testing.T) {
 		"test-github-client", "test-github-secret",
 		"http://localhost/callback",
 		`{"default_role": "user"}`,
+		oidcPkg.Options{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -291,3 +311,490 @@ func TestOIDCCallbackInvalidState(t *testing.T) {
 		t.Errorf("Expected status %d for unknown state, got %d", http.StatusBadRequest, w.Code)
 	}
 }
+
+func TestOIDCLoginCapsPendingStates(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+	manager, err := oidcPkg.NewOIDCManager(
+		context.Background(), "", "",
+		"test-github-client", "test-github-secret",
+		"http://localhost/callback",
+		`{"default_role": "user"}`,
+		oidcPkg.Options{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create OIDC manager: %v", err)
+	}
+
+	h := NewOIDCHandler(manager, authSvc, userRepo, roleRepo)
+	h.maxStates = 2
+	r := gin.New()
+	r.GET("/api/auth/oidc/login", h.Login)
+
+	login := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?provider=github", nil))
+		return w.Code
+	}
+
+	for i := range 2 {
+		if code := login(); code != http.StatusTemporaryRedirect {
+			t.Fatalf("login %d: expected status %d, got %d", i, http.StatusTemporaryRedirect, code)
+		}
+	}
+	if code := login(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d once the cap is reached, got %d", http.StatusTooManyRequests, code)
+	}
+	if len(h.states) != 2 {
+		t.Errorf("Expected 2 pending states, got %d", len(h.states))
+	}
+
+	// An expired state frees its slot.
+	for state, pending := range h.states {
+		pending.expires = time.Now().Add(-time.Second)
+		h.states[state] = pending
+		break
+	}
+	if code := login(); code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected status %d after a state expired, got %d", http.StatusTemporaryRedirect, code)
+	}
+}
+
+func TestStoreProviderRefreshToken(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	const key = "oidc-token-encryption-key-0123456789"
+	manager, err := oidcPkg.NewOIDCManager(
+		context.Background(), "", "",
+		"test-github-client", "test-github-secret",
+		"http://localhost/callback",
+		`{"default_role": "user"}`,
+		oidcPkg.Options{OfflineAccess: true, TokenKey: key},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create OIDC manager: %v", err)
+	}
+	h := NewOIDCHandler(manager, nil, userRepo, roleRepo)
+
+	user, err := userRepo.CreateOIDCUser("oidc-user", "google", "sub-1", "oidc-user@company.com", 3)
+	if err != nil {
+		t.Fatalf("Failed to create OIDC user: %v", err)
+	}
+
+	h.storeProviderRefreshToken(user, "google", "")
+	if _, _, err := userRepo.GetOIDCRefreshToken(user.Id); err != sql.ErrNoRows {
+		t.Fatalf("Expected no stored token without a refresh token, got %v", err)
+	}
+
+	for _, token := range []string{"1//first-refresh-token", "1//second-refresh-token"} {
+		h.storeProviderRefreshToken(user, "google", token)
+		provider, sealed, err := userRepo.GetOIDCRefreshToken(user.Id)
+		if err != nil {
+			t.Fatalf("GetOIDCRefreshToken failed: %v", err)
+		}
+		if provider != "google" || strings.Contains(sealed, "refresh-token") {
+			t.Errorf("Expected an encrypted google token, got provider %q token %q", provider, sealed)
+		}
+		if plaintext, err := utils.Open(key, sealed); err != nil || plaintext != token {
+			t.Errorf("Expected the stored token to decrypt to %q, got %q, %v", token, plaintext, err)
+		}
+	}
+}
+
+func TestOIDCUsernamePattern(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	userRepo, roleRepo := createReposFromDB(t, db)
+	h := NewOIDCHandler(nil, nil, userRepo, roleRepo)
+	t.Cleanup(func() { _ = utils.SetUsernamePattern(utils.DefaultUsernamePattern) })
+
+	t.Cleanup(func() { utils.SetLowercaseUsernames(false) })
+
+	emailPattern := `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`
+	tests := []struct {
+		name      string
+		pattern   string
+		lowercase bool
+		info      oidcUserInfo
+		want      string
+		wantFail  bool
+	}{
+		{"Email rejected by default pattern", utils.DefaultUsernamePattern, false, oidcUserInfo{Subject: "1234567", Email: "alice@company.com"}, "google_1234567", false},
+		{"No username follows the pattern", utils.DefaultUsernamePattern, false, oidcUserInfo{Subject: "sub-1", Email: "bob@company.com"}, "", true},
+		{"Email allowed", emailPattern, false, oidcUserInfo{Subject: "7654321", Email: "carol.smith@company.com"}, "carol.smith@company.com", false},
+		{"Email case kept by default", emailPattern, false, oidcUserInfo{Subject: "1111111", Email: "Dave.Jones@Company.com"}, "Dave.Jones@Company.com", false},
+		{"Email lowercased", emailPattern, true, oidcUserInfo{Subject: "2222222", Email: "Erin.Moss@Company.com"}, "erin.moss@company.com", false},
+		{"Subject lowercased", utils.DefaultUsernamePattern, true, oidcUserInfo{Subject: "AbC3333"}, "google_abc3333", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := utils.SetUsernamePattern(tt.pattern); err != nil {
+				t.Fatalf("SetUsernamePattern failed: %v", err)
+			}
+			utils.SetLowercaseUsernames(tt.lowercase)
+			user, err := h.getOrCreateOIDCUser(&tt.info, "google", "user")
+			if tt.wantFail {
+				if err == nil {
+					t.Errorf("Expected the user to be refused, got %q", user.Username)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getOrCreateOIDCUser failed: %v", err)
+			}
+			if user.Username != tt.want {
+				t.Errorf("Expected username %q, got %q", tt.want, user.Username)
+			}
+		})
+	}
+}
+
+func TestOIDCTestMapping(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	userRepo, roleRepo := createReposFromDB(t, db)
+	manager, err := oidcPkg.NewOIDCManager(context.Background(), "", "", "test-github-client", "test-github-secret",
+		"http://localhost/callback", `{"domain_mappings":{"@company.com":"user"},"default_role":"none"}`, oidcPkg.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create OIDC manager: %v", err)
+	}
+	h := NewOIDCHandler(manager, nil, userRepo, roleRepo)
+	r := gin.New()
+	r.POST("/api/admin/oidc/test-mapping", h.TestMapping)
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/oidc/test-mapping", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	rules := `{"domain_mappings":{"@company.com":"user","admin@company.com":"root"},"group_mappings":{"ops":"admin"},"default_role":"auditor"}`
+	tests := []struct {
+		name string
+		body string
+		want map[string]any
+	}{
+		{"Configured rules of the provider", `{"provider":"github","email":"alice@company.com"}`,
+			map[string]any{"role": "user", "matched": "domain", "denied": false, "role_exists": true}},
+		{"Configured default denies", `{"provider":"github","email":"bob@other.com"}`,
+			map[string]any{"role": "none", "matched": "default", "denied": true}},
+		{"Exact email wins over its domain", `{"email":"admin@company.com","groups":["ops"],"rules":` + rules + `}`,
+			map[string]any{"role": "root", "matched": "email", "denied": false, "role_exists": true}},
+		{"Domain wins over groups", `{"email":"carol@company.com","groups":["ops"],"rules":` + rules + `}`,
+			map[string]any{"role": "user", "matched": "domain", "denied": false, "role_exists": true}},
+		{"Group without a domain match", `{"email":"dave@other.com","groups":["ops"],"rules":` + rules + `}`,
+			map[string]any{"role": "admin", "matched": "group", "denied": false, "role_exists": true}},
+		{"Default fallback", `{"email":"erin@other.com","groups":["sales"],"rules":` + rules + `}`,
+			map[string]any{"role": "auditor", "matched": "default", "denied": false, "role_exists": true}},
+		{"Unverified email skips the domain", `{"email":"frank@company.com","email_verified":false,"rules":` + rules + `}`,
+			map[string]any{"role": "auditor", "matched": "default", "denied": false, "role_exists": true}},
+		{"Rules as a configuration string", `{"email":"gina@company.com","rules":"{\"domain_mappings\":{\"@company.com\":\"contractors\"}}"}`,
+			map[string]any{"role": "contractors", "matched": "domain", "denied": false, "role_exists": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var got map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name, body, wantError string
+		wantStatus            int
+	}{
+		{"Unknown key", `{"email":"a@company.com","rules":{"domain_mapping":{"@company.com":"user"}}}`, "Invalid role mapping rules", http.StatusBadRequest},
+		{"Domain without @", `{"email":"a@company.com","rules":{"domain_mappings":{"company.com":"user"}}}`, `domain_mappings key \"company.com\"`, http.StatusBadRequest},
+		{"Malformed JSON string", `{"email":"a@company.com","rules":"{\"domain_mappings\":"}`, "Invalid role mapping rules", http.StatusBadRequest},
+		{"Unknown provider", `{"provider":"gitlab","email":"a@company.com"}`, "Invalid provider", http.StatusBadRequest},
+		{"Neither provider nor rules", `{"email":"a@company.com"}`, "Provider or rules required", http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.body)
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("Expected status %d with %q, got %d: %s", tt.wantStatus, tt.wantError, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestGitHubUserInfoGroups signs in against a mocked GitHub and checks that team memberships become
+// groups, and that a login still succeeds without them when GitHub refuses to list them.
+func TestGitHubUserInfoGroups(t *testing.T) {
+	var teamsStatus atomic.Int32
+	teamsStatus.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			_, _ = w.Write([]byte(`{"access_token":"gho_test","token_type":"bearer","scope":"read:user,user:email,read:org"}`))
+		case "/user":
+			_, _ = w.Write([]byte(`{"id":42,"login":"alice","email":"alice@company.com","name":"Alice"}`))
+		case "/user/orgs":
+			_, _ = w.Write([]byte(`[{"login":"acme"}]`))
+		case "/user/teams":
+			w.WriteHeader(int(teamsStatus.Load()))
+			_, _ = w.Write([]byte(`[{"slug":"platform","organization":{"login":"acme"}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	provider := &oidcPkg.Provider{
+		Name: "github",
+		Config: &oauth2.Config{
+			ClientID:     "github-client",
+			ClientSecret: "github-secret",
+			Endpoint:     oauth2.Endpoint{TokenURL: srv.URL + "/login/oauth/access_token"},
+		},
+		RoleMapping:  &oidcPkg.RoleMappingRules{GroupMappings: map[string]string{"acme:platform": "admin"}, DefaultRole: "user"},
+		APIURL:       srv.URL,
+		GitHubGroups: oidcPkg.GitHubGroupsTeams,
+	}
+	h := &OIDCHandler{}
+
+	userInfo, err := h.exchangeCodeForUserInfo(context.Background(), provider, "code")
+	if err != nil {
+		t.Fatalf("exchangeCodeForUserInfo failed: %v", err)
+	}
+	if userInfo.Subject != "42" || !reflect.DeepEqual(userInfo.Groups, []string{"acme", "acme:platform"}) {
+		t.Fatalf("Expected subject 42 with groups [acme acme:platform], got %q with %v", userInfo.Subject, userInfo.Groups)
+	}
+	if role := provider.MapClaimsToRole(userInfo.Email, userInfo.EmailVerified, userInfo.Groups); role != "admin" {
+		t.Errorf("Expected the team to map to admin, got %q", role)
+	}
+
+	teamsStatus.Store(http.StatusForbidden)
+	userInfo, err = h.exchangeCodeForUserInfo(context.Background(), provider, "code")
+	if err != nil {
+		t.Fatalf("Expected the login to succeed without groups, got %v", err)
+	}
+	if len(userInfo.Groups) != 0 || userInfo.Email != "alice@company.com" {
+		t.Errorf("Expected no groups and the email to be kept, got %v and %q", userInfo.Groups, userInfo.Email)
+	}
+	if role := provider.MapClaimsToRole(userInfo.Email, userInfo.EmailVerified, userInfo.Groups); role != "user" {
+		t.Errorf("Expected the default role without groups, got %q", role)
+	}
+}
+
+// TestOIDCCallbackGitHubFailures checks that a callback tells a code GitHub rejected apart from
+// GitHub being unreachable or failing.
+func TestOIDCCallbackGitHubFailures(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+
+	var userCalls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			// GitHub answers a bad code with 200 and an error body.
+			if err := r.ParseForm(); err == nil && r.PostForm.Get("code") == "bad-code" {
+				_, _ = w.Write([]byte(`{"error":"bad_verification_code","error_description":"The code passed is incorrect or expired."}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"gho_test","token_type":"bearer"}`))
+		case "/user":
+			userCalls.Add(1)
+			http.Error(w, `{"message":"Server Error"}`, http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name           string
+		tokenURL       string
+		code           string
+		expectedStatus int
+		expectedError  error
+	}{
+		{"Rejected code", srv.URL + "/login/oauth/access_token", "bad-code", http.StatusUnauthorized, errInvalidCode},
+		{"Token endpoint unreachable", closed.URL + "/login/oauth/access_token", "code", http.StatusBadGateway, oidcPkg.ErrProviderUnavailable},
+		{"User API failing", srv.URL + "/login/oauth/access_token", "code", http.StatusBadGateway, oidcPkg.ErrProviderUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, err := oidcPkg.NewOIDCManager(context.Background(), "", "", "test-github-client", "test-github-secret",
+				"http://localhost/callback", `{"default_role": "user"}`, oidcPkg.Options{})
+			if err != nil {
+				t.Fatalf("Failed to create OIDC manager: %v", err)
+			}
+			provider := manager.Providers["github"]
+			provider.Config.Endpoint = oauth2.Endpoint{TokenURL: tt.tokenURL, AuthStyle: oauth2.AuthStyleInParams}
+			provider.APIURL = srv.URL
+
+			h := NewOIDCHandler(manager, authSvc, userRepo, roleRepo)
+			if _, err := h.exchangeCodeForUserInfo(context.Background(), provider, tt.code); !errors.Is(err, tt.expectedError) {
+				t.Errorf("Expected an error wrapping %q, got %v", tt.expectedError, err)
+			}
+
+			h.states["test-state"] = pendingLogin{provider: "github", expires: time.Now().Add(stateTTL)}
+			r := gin.New()
+			r.GET("/api/auth/oidc/callback", h.Callback)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?state=test-state&code="+tt.code, nil))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Each callback in the last case retried the failing user API.
+	if calls := userCalls.Load(); calls < 4 {
+		t.Errorf("Expected the user API to be retried, got %d calls", calls)
+	}
+}
+
+// TestOIDCCallbackUsesLoginProvider checks that the callback exchanges the code only with the
+// provider the login was started at.
+func TestOIDCCallbackUsesLoginProvider(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+
+	// newProvider mocks a GitHub-style provider and counts the codes exchanged with it.
+	newProvider := func(name string, exchanges *atomic.Int32) *oidcPkg.Provider {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/token":
+				exchanges.Add(1)
+				_, _ = w.Write([]byte(`{"access_token":"token-` + name + `","token_type":"bearer"}`))
+			case "/user":
+				_, _ = w.Write([]byte(`{"id":7,"login":"alice","email":"alice@company.com"}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		return &oidcPkg.Provider{
+			Name: name,
+			Config: &oauth2.Config{
+				ClientID:     name + "-client",
+				ClientSecret: name + "-secret",
+				RedirectURL:  "http://localhost/callback",
+				Endpoint:     oauth2.Endpoint{AuthURL: srv.URL + "/authorize", TokenURL: srv.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+			},
+			RoleMapping: &oidcPkg.RoleMappingRules{DefaultRole: "user"},
+			APIURL:      srv.URL,
+		}
+	}
+	var firstExchanges, secondExchanges atomic.Int32
+	manager := &oidcPkg.OIDCManager{Providers: map[string]*oidcPkg.Provider{
+		"first":  newProvider("first", &firstExchanges),
+		"second": newProvider("second", &secondExchanges),
+	}}
+
+	h := NewOIDCHandler(manager, authSvc, userRepo, roleRepo)
+	r := gin.New()
+	r.GET("/api/auth/oidc/login", h.Login)
+	r.GET("/api/auth/oidc/callback", h.Callback)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?provider=second", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status %d, got %d", http.StatusTemporaryRedirect, w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect location: %v", err)
+	}
+	state := location.Query().Get("state")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code=test-code&state="+url.QueryEscape(state), nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	}
+	if firstExchanges.Load() != 0 || secondExchanges.Load() != 1 {
+		t.Errorf("Expected one exchange with the login's provider only, got first=%d second=%d", firstExchanges.Load(), secondExchanges.Load())
+	}
+	if _, err := userRepo.GetByProviderAndID("second", "7"); err != nil {
+		t.Errorf("Expected the user to be created for provider 'second': %v", err)
+	}
+}
+
+// TestOIDCDisabledProvider checks that a disabled provider refuses new logins, including logins
+// started before it was disabled, while other providers keep working.
+func TestOIDCDisabledProvider(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{
+		JWTKey:        []byte("test-secret-key"),
+		TokenLifetime: time.Hour,
+	})
+
+	manager, err := oidcPkg.NewOIDCManager(context.Background(), "", "", "test-github-client", "test-github-secret",
+		"http://localhost/callback", `{"default_role": "user"}`, oidcPkg.Options{GitHubDisabled: true})
+	if err != nil {
+		t.Fatalf("Failed to create OIDC manager: %v", err)
+	}
+	manager.Providers["backup"] = &oidcPkg.Provider{
+		Name:        "backup",
+		Config:      &oauth2.Config{ClientID: "backup-client", Endpoint: oauth2.Endpoint{AuthURL: "https://sso.example.com/authorize"}},
+		RoleMapping: &oidcPkg.RoleMappingRules{DefaultRole: "user"},
+	}
+
+	h := NewOIDCHandler(manager, authSvc, userRepo, roleRepo)
+	r := gin.New()
+	r.GET("/api/auth/oidc/login", h.Login)
+	r.GET("/api/auth/oidc/callback", h.Callback)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?provider=github", nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Logins via github are disabled") {
+		t.Errorf("Expected 403 for a disabled provider, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(h.states) != 0 {
+		t.Errorf("Expected no pending login for a disabled provider, got %d", len(h.states))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login?provider=backup", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected an enabled provider to redirect, got %d", w.Code)
+	}
+
+	h.states["started-before"] = pendingLogin{provider: "github", expires: time.Now().Add(stateTTL)}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?state=started-before&code=test-code", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a callback of a disabled provider, got %d: %s", w.Code, w.Body.String())
+	}
+}
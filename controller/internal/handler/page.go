@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPageSize is the page size when a cursor is given without a limit.
+const defaultPageSize = 50
+
+// pageRequest reads the limit and cursor query parameters of a list endpoint. paged is false when
+// neither is set, so the endpoint keeps returning the whole list. A limit that is not a number
+// writes 400 and reports ok false.
+func pageRequest(c *gin.Context) (cursor string, limit int, paged, ok bool) {
+	cursor = c.Query("cursor")
+	raw := c.Query("limit")
+	if raw == "" {
+		return cursor, defaultPageSize, cursor != "", true
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return "", 0, false, false
+	}
+	return cursor, limit, true, true
+}
+
+// pageFailed writes 400 for an invalid sort key, limit or cursor and reports whether it did.
+func pageFailed(c *gin.Context, err error) bool {
+	switch err.Error() {
+	case "invalid sort key":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort key"})
+	case "invalid limit":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+	case "invalid cursor":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+	default:
+		return false
+	}
+	return true
+}
+
+// pageBody is the response of a paginated list: the items under key, and next_cursor unless this
+// is the last page.
+func pageBody(key string, items any, next string) gin.H {
+	body := gin.H{key: items}
+	if next != "" {
+		body["next_cursor"] = next
+	}
+	return body
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/service"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PolicyHandler handles exporting and importing the access model.
+type PolicyHandler struct {
+	policySvc service.PolicyService
+}
+
+// NewPolicyHandler creates a new PolicyHandler.
+func NewPolicyHandler(policySvc service.PolicyService) *PolicyHandler {
+	return &PolicyHandler{policySvc: policySvc}
+}
+
+// Export returns roles, services and assignments as a policy document.
+func (h *PolicyHandler) Export(c *gin.Context) {
+	doc, err := h.policySvc.Export()
+	if err != nil {
+		log.Printf("[policy] export failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export policy"})
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// Import applies a policy document in a single transaction. With ?dry_run=true the report is
+// computed but nothing is written. Any conflict rejects the whole document with 409.
+func (h *PolicyHandler) Import(c *gin.Context) {
+	var doc models.PolicyDocument
+	if err := c.ShouldBindJSON(&doc); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	report, err := h.policySvc.Import(&doc, c.Query("dry_run") == "true")
+	if err != nil {
+		if err.Error() == "unsupported policy version" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported policy version"})
+			return
+		}
+		log.Printf("[policy] import failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import policy"})
+		return
+	}
+	if len(report.Conflicts) > 0 {
+		c.JSON(http.StatusConflict, report)
+		return
+	}
+
+	if report.Applied {
+		log.Printf("[policy] imported policy: %d roles, %d services, %d role links and %d user links created",
+			len(report.Roles.Created), len(report.Services.Created), len(report.RoleServices.Created), len(report.UserServices.Created))
+	}
+	c.JSON(http.StatusOK, report)
+}
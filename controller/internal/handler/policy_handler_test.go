@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/service"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newPolicyTestRouter(t *testing.T, db *sql.DB) *gin.Engine {
+	t.Helper()
+	policyRepo, err := repository.NewPolicyRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create policy repo: %v", err)
+	}
+	h := NewPolicyHandler(service.NewPolicyService(policyRepo))
+	r := gin.New()
+	r.GET("/api/admin/export", h.Export)
+	r.POST("/api/admin/import", h.Import)
+	return r
+}
+
+func importPolicy(t *testing.T, r *gin.Engine, query string, doc any) (*httptest.ResponseRecorder, models.PolicyReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/import"+query, bytes.NewReader(mustMarshal(t, doc))))
+	var report models.PolicyReport
+	if w.Code == http.StatusOK || w.Code == http.StatusConflict {
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to decode report: %v", err)
+		}
+	}
+	return w, report
+}
+
+func exportPolicy(t *testing.T, r *gin.Engine) models.PolicyDocument {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var doc models.PolicyDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to decode export: %v", err)
+	}
+	return doc
+}
+
+func testPolicy() models.PolicyDocument {
+	return models.PolicyDocument{
+		Version: models.PolicyVersion,
+		Roles:   []models.PolicyRole{{Name: "dev", Description: "Developers"}},
+		Services: []models.PolicyService{
+			{Name: "Database", Hostname: "10.0.0.5:5432", Description: "Postgres"},
+			{Name: "Wiki", Hostname: "10.0.0.6:80"},
+		},
+		RoleServices: []models.PolicyRoleService{{Role: "dev", Service: "Database"}},
+		UserServices: []models.PolicyUserService{{User: "root", Service: "Wiki"}},
+	}
+}
+
+func TestImportPolicy(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	r := newPolicyTestRouter(t, db)
+	doc := testPolicy()
+
+	w, report := importPolicy(t, r, "?dry_run=true", doc)
+	if w.Code != http.StatusOK || !report.DryRun || report.Applied || len(report.Services.Created) != 2 {
+		t.Fatalf("Unexpected dry run result %d: %s", w.Code, w.Body.String())
+	}
+	if got := exportPolicy(t, r); len(got.Services) != 0 || slices.ContainsFunc(got.Roles, func(r models.PolicyRole) bool { return r.Name == "dev" }) {
+		t.Fatalf("Expected a dry run to leave the database unchanged, got %+v", got)
+	}
+
+	w, report = importPolicy(t, r, "", doc)
+	if w.Code != http.StatusOK || !report.Applied {
+		t.Fatalf("Expected the import to be applied, got %d: %s", w.Code, w.Body.String())
+	}
+	if !slices.Equal(report.Roles.Created, []string{"dev"}) || !slices.Equal(report.RoleServices.Created, []string{"dev/Database"}) ||
+		!slices.Equal(report.UserServices.Created, []string{"root/Wiki"}) {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	// Importing the same document again changes nothing; changing a field updates by name.
+	doc.Services[1].Description = "Team wiki"
+	w, report = importPolicy(t, r, "", doc)
+	if w.Code != http.StatusOK || len(report.Roles.Created) != 0 || !slices.Equal(report.Services.Updated, []string{"Wiki"}) ||
+		!slices.Equal(report.Services.Unchanged, []string{"Database"}) || !slices.Equal(report.RoleServices.Unchanged, []string{"dev/Database"}) {
+		t.Errorf("Unexpected re-import report %d: %s", w.Code, w.Body.String())
+	}
+
+	exported := exportPolicy(t, r)
+	if len(exported.Services) != 2 || exported.Services[1].Description != "Team wiki" || exported.Services[0].Agent == "" {
+		t.Errorf("Unexpected exported services: %+v", exported.Services)
+	}
+	if !slices.Contains(exported.RoleServices, models.PolicyRoleService{Role: "dev", Service: "Database"}) ||
+		!slices.Contains(exported.UserServices, models.PolicyUserService{User: "root", Service: "Wiki"}) {
+		t.Errorf("Expected the assignments to be exported, got %+v", exported)
+	}
+
+	// The export is itself a valid import that changes nothing.
+	w, report = importPolicy(t, r, "", exported)
+	if w.Code != http.StatusOK || len(report.Roles.Created)+len(report.Roles.Updated)+len(report.Services.Created)+len(report.Services.Updated) != 0 {
+		t.Errorf("Expected a round trip to be a no-op, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImportPolicyConflicts(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	r := newPolicyTestRouter(t, db)
+
+	doc := testPolicy()
+	doc.Services = append(doc.Services, models.PolicyService{Name: "Wiki", Hostname: "10.0.0.7:80"},
+		models.PolicyService{Name: "Notes", Hostname: "10.0.0.8:80", Description: strings.Repeat("a", service.MaxDescriptionLength+1)})
+	doc.UserServices = append(doc.UserServices, models.PolicyUserService{User: "ghost", Service: "Wiki"})
+	doc.RoleServices = append(doc.RoleServices, models.PolicyRoleService{Role: "dev", Service: "Missing"})
+
+	w, report := importPolicy(t, r, "", doc)
+	if w.Code != http.StatusConflict || report.Applied {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	want := []string{
+		`services[2]: duplicate service "Wiki"`,
+		`services[3]: description must not be longer than 500 characters`,
+		`role_services[1]: unknown service "Missing"`,
+		`user_services[1]: unknown user "ghost"`,
+	}
+	if !slices.Equal(report.Conflicts, want) {
+		t.Errorf("Expected conflicts %q, got %q", want, report.Conflicts)
+	}
+	if got := exportPolicy(t, r); len(got.Services) != 0 {
+		t.Errorf("Expected nothing to be applied, got %+v", got.Services)
+	}
+}
+
+func TestImportPolicyMatchesNamesIgnoringCase(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	r := newPolicyTestRouter(t, db)
+
+	if w, _ := importPolicy(t, r, "", testPolicy()); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	doc := testPolicy()
+	for i := range doc.Roles {
+		doc.Roles[i].Name = strings.ToUpper(doc.Roles[i].Name)
+	}
+	for i := range doc.Services {
+		doc.Services[i].Name = strings.ToUpper(doc.Services[i].Name)
+	}
+	w, report := importPolicy(t, r, "", doc)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(report.Roles.Created) != 0 || len(report.Services.Created) != 0 {
+		t.Errorf("Expected names differing only in case to match existing entries, got %+v", report)
+	}
+
+	doc = testPolicy()
+	doc.Services = append(doc.Services, models.PolicyService{Name: strings.ToUpper(doc.Services[0].Name), Hostname: "10.0.0.9:80"})
+	if _, report := importPolicy(t, r, "", doc); !slices.Contains(report.Conflicts, fmt.Sprintf("services[%d]: duplicate service %q", len(doc.Services)-1, strings.ToUpper(doc.Services[0].Name))) {
+		t.Errorf("Expected a duplicate conflict for a name differing only in case, got %q", report.Conflicts)
+	}
+}
+
+func TestImportPolicyInvalid(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	r := newPolicyTestRouter(t, db)
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"Invalid JSON", []byte("{")},
+		{"Unsupported version", mustMarshal(t, models.PolicyDocument{Version: 99})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/import", bytes.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
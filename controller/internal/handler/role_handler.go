@@ -1,8 +1,10 @@
 package handler
 
 import (
+	"Aegis/controller/internal/middleware"
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/service"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -22,8 +24,12 @@ func NewRoleHandler(roleSvc service.RoleService) *RoleHandler {
 
 // GetAll returns all roles.
 func (h *RoleHandler) GetAll(c *gin.Context) {
-	roles, err := h.roleSvc.GetAll()
+	roles, err := h.roleSvc.GetAll(c.Query("sort"))
 	if err != nil {
+		if err.Error() == "invalid sort key" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort key"})
+			return
+		}
 		log.Printf("[roles] get all failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
 		return
@@ -39,12 +45,17 @@ func (h *RoleHandler) Create(c *gin.Context) {
 		return
 	}
 
-	result, err := h.roleSvc.Create(newRole.Name, newRole.Description)
+	result, err := h.roleSvc.Create(newRole.Name, newRole.Description, newRole.MaxTTL, newRole.Capabilities, c.GetStringSlice(middleware.CapabilitiesKey))
 	if err != nil {
+		if validationFailed(c, err) {
+			return
+		}
 		msg := err.Error()
 		switch msg {
-		case "role name is required":
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Role name is required"})
+		case "cannot grant capabilities you do not hold":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot grant capabilities you do not hold"})
+		case "manage_roles is reserved for the root role":
+			c.JSON(http.StatusForbidden, gin.H{"error": "manage_roles is reserved for the root role"})
 		case "role name already exists":
 			c.JSON(http.StatusConflict, gin.H{"error": "Error creating role (name must be unique)"})
 		default:
@@ -53,10 +64,89 @@ func (h *RoleHandler) Create(c *gin.Context) {
 		return
 	}
 
-	log.Printf("[roles] created role '%s' (ID: %d)", result.Name, result.Id)
+	log.Printf("[roles] created role '%s' (ID: %d) with capabilities %v", result.Name, result.Id, result.Capabilities)
 	c.JSON(http.StatusCreated, result)
 }
 
+// GetCapabilities lists every capability a role can be granted.
+func (h *RoleHandler) GetCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"capabilities": models.AllCapabilities})
+}
+
+// SetCapabilities replaces the capabilities of a role.
+func (h *RoleHandler) SetCapabilities(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	var req struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Capabilities == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	if err := h.roleSvc.SetCapabilities(id, req.Capabilities, c.GetStringSlice(middleware.CapabilitiesKey)); err != nil {
+		switch err.Error() {
+		case "role not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		case "unknown capability":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown capability"})
+		case "cannot grant capabilities you do not hold":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot grant capabilities you do not hold"})
+		case "manage_roles is reserved for the root role":
+			c.JSON(http.StatusForbidden, gin.H{"error": "manage_roles is reserved for the root role"})
+		case "cannot change root role capabilities":
+			c.JSON(http.StatusForbidden, gin.H{"error": "The root role's capabilities cannot be changed"})
+		default:
+			log.Printf("[roles] set capabilities failed for role ID %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set capabilities"})
+		}
+		return
+	}
+
+	log.Printf("[roles] set capabilities of role ID %d to %v by %s", id, req.Capabilities, c.GetString(middleware.UsernameKey))
+	c.JSON(http.StatusOK, gin.H{"message": "Capabilities updated"})
+}
+
+// SetMaxTTL sets or, with a null max_ttl, removes the session time limit of a role.
+func (h *RoleHandler) SetMaxTTL(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	var req struct {
+		MaxTTL *int `json:"max_ttl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	if err := h.roleSvc.SetMaxTTL(id, req.MaxTTL); err != nil {
+		switch err.Error() {
+		case "role not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		case "invalid max_ttl":
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max_ttl must be between 1 and %d seconds", models.MaxSessionTimeLeft)})
+		default:
+			log.Printf("[roles] set max_ttl failed for role ID %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set max_ttl"})
+		}
+		return
+	}
+
+	if req.MaxTTL == nil {
+		log.Printf("[roles] removed the max_ttl of role ID %d by %s", id, c.GetString(middleware.UsernameKey))
+	} else {
+		log.Printf("[roles] set max_ttl of role ID %d to %ds by %s", id, *req.MaxTTL, c.GetString(middleware.UsernameKey))
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Max TTL updated"})
+}
+
 // Delete removes a role by ID.
 func (h *RoleHandler) Delete(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
@@ -112,8 +202,15 @@ func (h *RoleHandler) AddService(c *gin.Context) {
 	}
 
 	if err := h.roleSvc.AddService(roleID, req.ServiceID); err != nil {
-		log.Printf("[roles] add service failed for role %d and service %d: %v", roleID, req.ServiceID, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to link service to role (check if IDs exist)"})
+		switch err.Error() {
+		case "role not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		case "service not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		default:
+			log.Printf("[roles] add service failed for role %d and service %d: %v", roleID, req.ServiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link service to role"})
+		}
 		return
 	}
 
@@ -121,7 +218,8 @@ func (h *RoleHandler) AddService(c *gin.Context) {
 	c.String(http.StatusOK, "Service added to role successfully")
 }
 
-// RemoveService unlinks a service from a role.
+// RemoveService unlinks a service from a role. Removing a link that does not exist succeeds
+// unless ?strict=true is given, in which case it returns 404.
 func (h *RoleHandler) RemoveService(c *gin.Context) {
 	roleID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -135,11 +233,21 @@ func (h *RoleHandler) RemoveService(c *gin.Context) {
 		return
 	}
 
-	if err := h.roleSvc.RemoveService(roleID, svcID); err != nil {
+	removed, err := h.roleSvc.RemoveService(roleID, svcID)
+	if err != nil {
 		log.Printf("[roles] remove service failed for role %d and service %d: %v", roleID, svcID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove service from role"})
 		return
 	}
+	if !removed {
+		log.Printf("[roles] no assignment found for service %d and role %d", svcID, roleID)
+		if c.Query("strict") == "true" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service is not assigned to role"})
+			return
+		}
+		c.String(http.StatusOK, "Service removed from role successfully")
+		return
+	}
 
 	log.Printf("[roles] removed service %d from role %d", svcID, roleID)
 	c.String(http.StatusOK, "Service removed from role successfully")
@@ -1,13 +1,17 @@
 package handler
 
 import (
+	"Aegis/controller/internal/middleware"
 	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/service"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -84,15 +88,252 @@ func TestCreateRoleDuplicate(t *testing.T) {
 	r := gin.New()
 	r.POST("/api/roles", h.Create)
 
-	// "admin" already exists from seed
-	body, _ := json.Marshal(models.Role{Name: "admin", Description: "Duplicate"})
-	w := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/api/roles", bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	r.ServeHTTP(w, req)
+	// "admin" already exists from seed; names are unique regardless of case and surrounding spaces.
+	for _, name := range []string{"admin", "Admin", " ADMIN "} {
+		body, _ := json.Marshal(models.Role{Name: name, Description: "Duplicate"})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/roles", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status %d for duplicate role %q, got %d", http.StatusConflict, name, w.Code)
+		}
+	}
+}
 
-	if w.Code != http.StatusConflict {
-		t.Errorf("Expected status %d for duplicate role, got %d", http.StatusConflict, w.Code)
+func TestCreateRoleCapabilities(t *testing.T) {
+	_, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+
+	h := NewRoleHandler(service.NewRoleService(roleRepo))
+
+	r := gin.New()
+	r.POST("/api/roles", func(c *gin.Context) {
+		c.Set(middleware.CapabilitiesKey, []string{models.CapManageRoles, models.CapViewSessions})
+	}, h.Create)
+
+	tests := []struct {
+		name           string
+		payload        models.Role
+		expectedStatus int
+	}{
+		{"Held capability", models.Role{Name: "reviewer", Capabilities: []string{models.CapViewSessions}}, http.StatusCreated},
+		{"Unknown capability", models.Role{Name: "bogus", Capabilities: []string{"fly"}}, http.StatusBadRequest},
+		{"Capability not held", models.Role{Name: "importer", Capabilities: []string{models.CapImportPolicy}}, http.StatusForbidden},
+		{"manage_roles is reserved", models.Role{Name: "deputy", Capabilities: []string{models.CapManageRoles}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/roles", bytes.NewReader(mustMarshal(t, tt.payload)))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	roles, err := roleRepo.GetAll(repository.DefaultRoleSort)
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	for _, role := range roles {
+		if role.Name == "reviewer" && (len(role.Capabilities) != 1 || role.Capabilities[0] != models.CapViewSessions) {
+			t.Errorf("Expected reviewer to hold only %s, got %v", models.CapViewSessions, role.Capabilities)
+		}
+		if role.Name == "importer" || role.Name == "bogus" || role.Name == "deputy" {
+			t.Errorf("Expected role %q not to be created", role.Name)
+		}
+	}
+}
+
+func TestSetRoleCapabilities(t *testing.T) {
+	_, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+
+	h := NewRoleHandler(service.NewRoleService(roleRepo))
+
+	r := gin.New()
+	r.PUT("/api/roles/:id/capabilities", func(c *gin.Context) {
+		c.Set(middleware.CapabilitiesKey, slices.DeleteFunc(slices.Clone(models.AllCapabilities), func(c string) bool { return c == models.CapImportPolicy }))
+	}, h.SetCapabilities)
+
+	tests := []struct {
+		name           string
+		roleID         string
+		capabilities   []string
+		expectedStatus int
+	}{
+		{"Set user capabilities", "3", []string{models.CapViewSessions, models.CapExportPolicy}, http.StatusOK},
+		{"Clear user capabilities", "3", []string{}, http.StatusOK},
+		{"Root role is immutable", "1", []string{models.CapManageUsers}, http.StatusForbidden},
+		{"Capability not held", "3", []string{models.CapImportPolicy}, http.StatusForbidden},
+		{"manage_roles is reserved", "2", []string{models.CapManageUsers, models.CapManageRoles}, http.StatusForbidden},
+		{"Unknown capability", "3", []string{"fly"}, http.StatusBadRequest},
+		{"Missing capabilities", "3", nil, http.StatusBadRequest},
+		{"Role not found", "9999", []string{models.CapViewSessions}, http.StatusNotFound},
+		{"Invalid role ID", "abc", []string{models.CapViewSessions}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "/api/roles/"+tt.roleID+"/capabilities", bytes.NewReader(mustMarshal(t, gin.H{"capabilities": tt.capabilities})))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRoleMaxTTLEndpoints(t *testing.T) {
+	_, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+
+	h := NewRoleHandler(service.NewRoleService(roleRepo))
+
+	r := gin.New()
+	r.GET("/api/roles", h.GetAll)
+	r.POST("/api/roles", func(c *gin.Context) { c.Set(middleware.CapabilitiesKey, models.AllCapabilities) }, h.Create)
+	r.PUT("/api/roles/:id/max-ttl", h.SetMaxTTL)
+	send := func(method, path string, payload any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	maxTTLOf := func(name string) *int {
+		var roles []models.Role
+		if err := json.Unmarshal(send(http.MethodGet, "/api/roles", nil).Body.Bytes(), &roles); err != nil {
+			t.Fatalf("Failed to decode roles: %v", err)
+		}
+		for _, role := range roles {
+			if role.Name == name {
+				return role.MaxTTL
+			}
+		}
+		t.Fatalf("Role %s not listed", name)
+		return nil
+	}
+
+	expectFieldErrors(t, send(http.MethodPost, "/api/roles", gin.H{"name": "zero", "max_ttl": 0}), "max_ttl")
+	expectFieldErrors(t, send(http.MethodPost, "/api/roles", gin.H{"name": "forever", "max_ttl": models.MaxSessionTimeLeft + 1}), "max_ttl")
+
+	w := send(http.MethodPost, "/api/roles", gin.H{"name": "contractor", "max_ttl": 30})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created models.Role
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to decode role: %v", err)
+	}
+	if created.MaxTTL == nil || *created.MaxTTL != 30 {
+		t.Errorf("Expected the created role to have max_ttl 30, got %v", created.MaxTTL)
+	}
+	if got := maxTTLOf("contractor"); got == nil || *got != 30 {
+		t.Errorf("Expected contractor to be listed with max_ttl 30, got %v", got)
+	}
+	if got := maxTTLOf("user"); got != nil {
+		t.Errorf("Expected user to have no max_ttl, got %d", *got)
+	}
+
+	path := fmt.Sprintf("/api/roles/%d/max-ttl", created.Id)
+	tests := []struct {
+		name           string
+		path           string
+		payload        gin.H
+		expectedStatus int
+	}{
+		{"Zero", path, gin.H{"max_ttl": 0}, http.StatusBadRequest},
+		{"Too long", path, gin.H{"max_ttl": models.MaxSessionTimeLeft + 1}, http.StatusBadRequest},
+		{"Role not found", "/api/roles/9999/max-ttl", gin.H{"max_ttl": 30}, http.StatusNotFound},
+		{"Invalid role ID", "/api/roles/abc/max-ttl", gin.H{"max_ttl": 30}, http.StatusBadRequest},
+		{"Set", path, gin.H{"max_ttl": 45}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(http.MethodPut, tt.path, tt.payload); w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+	if got := maxTTLOf("contractor"); got == nil || *got != 45 {
+		t.Errorf("Expected max_ttl 45 after the update, got %v", got)
+	}
+
+	// A null max_ttl removes the limit.
+	if w := send(http.MethodPut, path, gin.H{"max_ttl": nil}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := maxTTLOf("contractor"); got != nil {
+		t.Errorf("Expected no max_ttl after removing it, got %d", *got)
+	}
+}
+
+func TestCustomRoleCapabilities(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	roleH := NewRoleHandler(service.NewRoleService(roleRepo))
+	svcH := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	userH := NewUserHandler(service.NewUserService(userRepo, roleRepo, "user"), nil)
+
+	roleID, err := roleRepo.Create("serviceops", "Service operators", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+	if _, err := userRepo.Create("opsuser", "hash", int(roleID)); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// The username header stands in for the auth middleware.
+	r := gin.New()
+	api := r.Group("/api", func(c *gin.Context) { c.Set(middleware.UsernameKey, c.GetHeader("X-User")) })
+	require := func(caps ...string) gin.HandlerFunc { return middleware.RequireCapability(userRepo, caps...) }
+	api.PUT("/roles/:id/capabilities", require(models.CapManageRoles), roleH.SetCapabilities)
+	api.POST("/services", require(models.CapManageServices), svcH.Create)
+	api.POST("/users", require(models.CapManageUsers), userH.Create)
+
+	do := func(user, method, path string, body any) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	newService := models.Service{Name: "OpsService", Hostname: "127.0.0.1:9090"}
+	newUser := models.UserWithCredentials{Credentials: models.Credentials{Username: "newuser", Password: "ValidPass123!"}, RoleId: 3}
+	capsPath := fmt.Sprintf("/api/roles/%d/capabilities", roleID)
+
+	if code := do("opsuser", http.MethodPost, "/api/services", newService); code != http.StatusForbidden {
+		t.Errorf("Expected status %d before the capability is assigned, got %d", http.StatusForbidden, code)
+	}
+	if code := do("opsuser", http.MethodPut, capsPath, gin.H{"capabilities": []string{models.CapManageServices}}); code != http.StatusForbidden {
+		t.Errorf("Expected status %d when assigning capabilities without manage_roles, got %d", http.StatusForbidden, code)
+	}
+	if code := do("root", http.MethodPut, capsPath, gin.H{"capabilities": []string{models.CapManageServices}}); code != http.StatusOK {
+		t.Fatalf("Expected root to assign capabilities, got %d", code)
+	}
+	if code := do("opsuser", http.MethodPost, "/api/services", newService); code != http.StatusCreated {
+		t.Errorf("Expected status %d creating a service with manage_services, got %d", http.StatusCreated, code)
+	}
+	if code := do("opsuser", http.MethodPost, "/api/users", newUser); code != http.StatusForbidden {
+		t.Errorf("Expected status %d creating a user without manage_users, got %d", http.StatusForbidden, code)
 	}
 }
 
@@ -143,7 +384,7 @@ func TestGetRoleServices(t *testing.T) {
 	svcResult, _ := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, ?)", "RoleSvc", "localhost:8080", 0x7F000001, 8080)
 	svcID, _ := svcResult.LastInsertId()
 
-	var roleID int64 = 1 // admin
+	var roleID int64 = 1 // root
 	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (?, ?)", roleID, svcID); err != nil {
 		t.Fatalf("Failed to link service to role: %v", err)
 	}
@@ -196,10 +437,13 @@ func TestAddRoleService(t *testing.T) {
 		roleID         string
 		body           []byte
 		expectedStatus int
+		expectedError  string
 	}{
-		{"Successful link", "1", mustMarshal(t, map[string]int{"service_id": int(svcID)}), http.StatusOK},
-		{"Invalid role ID", "invalid", mustMarshal(t, map[string]int{"service_id": int(svcID)}), http.StatusBadRequest},
-		{"Invalid JSON body", "1", []byte("not-json"), http.StatusBadRequest},
+		{"Successful link", "1", mustMarshal(t, map[string]int{"service_id": int(svcID)}), http.StatusOK, ""},
+		{"Invalid role ID", "invalid", mustMarshal(t, map[string]int{"service_id": int(svcID)}), http.StatusBadRequest, ""},
+		{"Invalid JSON body", "1", []byte("not-json"), http.StatusBadRequest, ""},
+		{"Missing role", "9999", mustMarshal(t, map[string]int{"service_id": int(svcID)}), http.StatusNotFound, "Role not found"},
+		{"Missing service", "1", mustMarshal(t, map[string]int{"service_id": 9999}), http.StatusNotFound, "Service not found"},
 	}
 
 	for _, tt := range tests {
@@ -212,6 +456,9 @@ func TestAddRoleService(t *testing.T) {
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
 			}
+			if tt.expectedError != "" && !strings.Contains(w.Body.String(), tt.expectedError) {
+				t.Errorf("Expected error %q, got %s", tt.expectedError, w.Body.String())
+			}
 		})
 	}
 }
@@ -238,17 +485,20 @@ func TestRemoveRoleService(t *testing.T) {
 		name           string
 		roleID         string
 		svcID          string
+		query          string
 		expectedStatus int
 	}{
-		{"Successful removal", fmt.Sprintf("%d", roleID), fmt.Sprintf("%d", svcID), http.StatusOK},
-		{"Invalid role ID", "invalid", fmt.Sprintf("%d", svcID), http.StatusBadRequest},
-		{"Invalid service ID", fmt.Sprintf("%d", roleID), "invalid", http.StatusBadRequest},
+		{"Successful strict removal", fmt.Sprintf("%d", roleID), fmt.Sprintf("%d", svcID), "?strict=true", http.StatusOK},
+		{"Repeated removal is idempotent", fmt.Sprintf("%d", roleID), fmt.Sprintf("%d", svcID), "", http.StatusOK},
+		{"Repeated strict removal", fmt.Sprintf("%d", roleID), fmt.Sprintf("%d", svcID), "?strict=true", http.StatusNotFound},
+		{"Invalid role ID", "invalid", fmt.Sprintf("%d", svcID), "", http.StatusBadRequest},
+		{"Invalid service ID", fmt.Sprintf("%d", roleID), "invalid", "", http.StatusBadRequest},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := httptest.NewRequest(http.MethodDelete, "/api/roles/"+tt.roleID+"/services/"+tt.svcID, nil)
+			req := httptest.NewRequest(http.MethodDelete, "/api/roles/"+tt.roleID+"/services/"+tt.svcID+tt.query, nil)
 			r.ServeHTTP(w, req)
 
 			if w.Code != tt.expectedStatus {
@@ -267,3 +517,72 @@ func mustMarshal(t *testing.T, v any) []byte {
 	}
 	return b
 }
+
+// expectFieldErrors checks that w is a 400 listing exactly the given fields as invalid.
+func expectFieldErrors(t *testing.T, w *httptest.ResponseRecorder, fields ...string) {
+	t.Helper()
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	var resp struct {
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Errors) != len(fields) {
+		t.Errorf("Expected errors for %v, got %v", fields, resp.Errors)
+	}
+	for _, field := range fields {
+		if resp.Errors[field] == "" {
+			t.Errorf("Expected an error for %q, got %v", field, resp.Errors)
+		}
+	}
+}
+
+func TestCreateRoleReportsAllErrors(t *testing.T) {
+	_, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+
+	r := gin.New()
+	r.POST("/api/roles", func(c *gin.Context) {
+		c.Set(middleware.CapabilitiesKey, models.AllCapabilities)
+	}, NewRoleHandler(service.NewRoleService(roleRepo)).Create)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/roles", bytes.NewReader(mustMarshal(t, models.Role{Capabilities: []string{"fly"}})))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	expectFieldErrors(t, w, "name", "capabilities")
+}
+
+func TestCreateRoleDescription(t *testing.T) {
+	_, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+
+	r := gin.New()
+	r.POST("/api/roles", func(c *gin.Context) {
+		c.Set(middleware.CapabilitiesKey, models.AllCapabilities)
+	}, NewRoleHandler(service.NewRoleService(roleRepo)).Create)
+	create := func(role models.Role) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/roles", bytes.NewReader(mustMarshal(t, role)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := create(models.Role{Name: "ops", Description: "On-call\x1b operators\u0085"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created models.Role
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if created.Description != "On-call operators" {
+		t.Errorf("Expected control characters to be stripped, got %q", created.Description)
+	}
+
+	expectFieldErrors(t, create(models.Role{Name: "verbose", Description: strings.Repeat("a", service.MaxDescriptionLength+1)}), "description")
+}
@@ -6,9 +6,12 @@ import (
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/service"
 	"Aegis/controller/internal/utils"
+	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -24,10 +27,32 @@ func NewServiceHandler(svcSvc service.ServiceService, userRepo repository.UserRe
 	return &ServiceHandler{svcSvc: svcSvc, userRepo: userRepo}
 }
 
-// GetAll returns all services (admin).
+// GetAll returns all services (admin), or one page of them when a limit or cursor is given.
 func (h *ServiceHandler) GetAll(c *gin.Context) {
-	services, err := h.svcSvc.GetAll()
+	cursor, limit, paged, ok := pageRequest(c)
+	if !ok {
+		return
+	}
+	if paged {
+		services, next, err := h.svcSvc.GetPage(c.Query("sort"), cursor, limit)
+		if err != nil {
+			if pageFailed(c, err) {
+				return
+			}
+			log.Printf("[services] get page failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
+			return
+		}
+		c.JSON(http.StatusOK, pageBody("services", services, next))
+		return
+	}
+
+	services, err := h.svcSvc.GetAll(c.Query("sort"))
 	if err != nil {
+		if err.Error() == "invalid sort key" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort key"})
+			return
+		}
 		log.Printf("[services] get all failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
 		return
@@ -35,6 +60,17 @@ func (h *ServiceHandler) GetAll(c *gin.Context) {
 	c.JSON(http.StatusOK, services)
 }
 
+// GetUnassigned returns the services no role or user is granted, which nobody can reach (admin).
+func (h *ServiceHandler) GetUnassigned(c *gin.Context) {
+	services, err := h.svcSvc.GetUnassigned()
+	if err != nil {
+		log.Printf("[services] get unassigned failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
+		return
+	}
+	c.JSON(http.StatusOK, services)
+}
+
 // Create adds a new service.
 func (h *ServiceHandler) Create(c *gin.Context) {
 	var newService models.Service
@@ -43,14 +79,15 @@ func (h *ServiceHandler) Create(c *gin.Context) {
 		return
 	}
 
-	result, err := h.svcSvc.Create(newService.Name, newService.Hostname, newService.Description)
+	result, err := h.svcSvc.Create(newService.Name, newService.Hostname, newService.DestType, newService.Description, newService.Agent, newService.PortRangeEnd, newService.RequiresStepUp)
 	if err != nil {
+		if validationFailed(c, err) {
+			return
+		}
 		msg := err.Error()
 		switch msg {
 		case "service name already exists":
 			c.JSON(http.StatusConflict, gin.H{"error": msg})
-		case "service name and hostname are required":
-			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		default:
 			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		}
@@ -75,8 +112,11 @@ func (h *ServiceHandler) Update(c *gin.Context) {
 		return
 	}
 
-	result, err := h.svcSvc.Update(id, svc.Name, svc.Hostname, svc.Description)
+	result, err := h.svcSvc.Update(id, svc.Name, svc.Hostname, svc.DestType, svc.Description, svc.Agent, svc.PortRangeEnd, svc.RequiresStepUp)
 	if err != nil {
+		if validationFailed(c, err) {
+			return
+		}
 		msg := err.Error()
 		switch msg {
 		case "service not found":
@@ -114,20 +154,124 @@ func (h *ServiceHandler) Delete(c *gin.Context) {
 	c.String(http.StatusOK, "Service deleted successfully")
 }
 
-// resolveCurrentUserIDAndRole resolves the user ID and role ID from the Gin context.
-func (h *ServiceHandler) resolveCurrentUserIDAndRole(c *gin.Context) (int, int, error) {
+// BindContainer binds a service to a Docker container, so the Docker watcher updates its address
+// whenever that container starts regardless of the container's names.
+func (h *ServiceHandler) BindContainer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service ID"})
+		return
+	}
+
+	var req struct {
+		Container string `json:"container" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	if !h.setContainer(c, id, req.Container) {
+		return
+	}
+	log.Printf("[services] bound service ID %d to container %s", id, req.Container)
+	c.JSON(http.StatusOK, gin.H{"id": id, "container": strings.TrimPrefix(req.Container, "/")})
+}
+
+// UnbindContainer removes a service's container binding, so the Docker watcher matches it by
+// hostname again.
+func (h *ServiceHandler) UnbindContainer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service ID"})
+		return
+	}
+
+	if !h.setContainer(c, id, "") {
+		return
+	}
+	log.Printf("[services] removed the container binding of service ID %d", id)
+	c.String(http.StatusOK, "Container binding removed successfully")
+}
+
+// setContainer stores a service's container binding, writing the error response and reporting false
+// if it fails.
+func (h *ServiceHandler) setContainer(c *gin.Context, id int, container string) bool {
+	err := h.svcSvc.SetContainer(id, container)
+	if err == nil {
+		return true
+	}
+	switch err.Error() {
+	case "service not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+	case "invalid container name":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid container name"})
+	default:
+		log.Printf("[services] set container failed for service %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update container binding"})
+	}
+	return false
+}
+
+// resolveCurrentUser resolves the user ID and role ID of the authenticated user. It writes 401 when
+// there is no user or it no longer exists, and 500 when the lookup fails, reporting false in both cases.
+func (h *ServiceHandler) resolveCurrentUser(c *gin.Context) (int, int, bool) {
 	username := c.GetString(middleware.UsernameKey)
 	if username == "" {
-		return 0, 0, nil
+		middleware.Unauthorized(c, false)
+		return 0, 0, false
+	}
+	userID, roleID, err := h.userRepo.GetIDAndRole(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[dashboard] user '%s' no longer exists", username)
+		middleware.Unauthorized(c, true)
+		return 0, 0, false
+	}
+	if err != nil {
+		log.Printf("[dashboard] failed to resolve user '%s': %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return 0, 0, false
 	}
-	return h.userRepo.GetIDAndRole(username)
+	return userID, roleID, true
+}
+
+// sourceIP returns the address a selection of the current user is enforced for: requested when the
+// user's role holds override_source_ip and the address is allowlisted, else utils.GetSourceIP. It
+// writes the error response and reports false when the override is refused.
+func (h *ServiceHandler) sourceIP(c *gin.Context, userID int, requested string) (string, bool) {
+	if requested == "" {
+		return utils.GetSourceIP(c.Request), true
+	}
+	username := c.GetString(middleware.UsernameKey)
+	caps, err := h.userRepo.GetCapabilitiesByUsername(username)
+	if err != nil {
+		log.Printf("[dashboard] failed to get capabilities for user '%s': %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return "", false
+	}
+	if !middleware.HasCapability(caps, models.CapOverrideSourceIP) {
+		log.Printf("[audit] user ID %d denied source IP override to %s: missing %s", userID, requested, models.CapOverrideSourceIP)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: You may not choose the source IP"})
+		return "", false
+	}
+	if err := h.svcSvc.CheckSourceIPOverride(requested); err != nil {
+		switch err.Error() {
+		case "invalid source IP":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source IP"})
+		default:
+			log.Printf("[audit] user ID %d denied source IP override to %s: not allowlisted", userID, requested)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Source IP is not in the allowlist"})
+		}
+		return "", false
+	}
+	log.Printf("[audit] user ID %d overrode source IP %s with %s", userID, utils.GetSourceIP(c.Request), requested)
+	return requested, true
 }
 
 // GetMyServices returns all services accessible by the current user.
 func (h *ServiceHandler) GetMyServices(c *gin.Context) {
-	userID, roleID, err := h.resolveCurrentUserIDAndRole(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	userID, roleID, ok := h.resolveCurrentUser(c)
+	if !ok {
 		return
 	}
 
@@ -142,9 +286,8 @@ func (h *ServiceHandler) GetMyServices(c *gin.Context) {
 
 // GetMyActiveServices returns the user's currently active services.
 func (h *ServiceHandler) GetMyActiveServices(c *gin.Context) {
-	userID, _, err := h.resolveCurrentUserIDAndRole(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	userID, _, ok := h.resolveCurrentUser(c)
+	if !ok {
 		return
 	}
 
@@ -159,44 +302,91 @@ func (h *ServiceHandler) GetMyActiveServices(c *gin.Context) {
 
 // SelectActiveService activates a service for the current user.
 func (h *ServiceHandler) SelectActiveService(c *gin.Context) {
-	userID, roleID, err := h.resolveCurrentUserIDAndRole(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	userID, roleID, ok := h.resolveCurrentUser(c)
+	if !ok {
 		return
 	}
 
 	var req struct {
 		ServiceID int `json:"service_id"`
+		// SourceIP replaces the request IP as the enforced source, see sourceIP.
+		SourceIP string `json:"source_ip"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
 
-	clientIP := utils.GetClientIP(c.Request)
+	if !middleware.TokenAllowsService(c, req.ServiceID) {
+		log.Printf("[dashboard] denied activating service ID %d for user ID %d: not in the token's services", req.ServiceID, userID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Token is not scoped to this service"})
+		return
+	}
+
+	clientIP, ok := h.sourceIP(c, userID, req.SourceIP)
+	if !ok {
+		return
+	}
 	log.Printf("[dashboard] activating service ID %d for user ID %d from IP %s", req.ServiceID, userID, clientIP)
 
-	if err := h.svcSvc.SelectActiveService(userID, roleID, req.ServiceID, clientIP); err != nil {
-		msg := err.Error()
-		switch msg {
+	authTime := c.GetTime(middleware.AuthTimeKey)
+	queued, err := h.svcSvc.SelectActiveService(c.Request.Context(), userID, roleID, req.ServiceID, clientIP, authTime)
+	if err != nil {
+		switch err.Error() {
 		case "forbidden: no access to this service":
 			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: You do not have access to this service"})
-		case "service not found or invalid configuration":
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not found or invalid configuration"})
+		case "step-up required":
+			if _, ok := c.Get(middleware.TokenScopeKey); ok {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: This service cannot be activated with an API token"})
+				return
+			}
+			log.Printf("[dashboard] step-up required to activate service ID %d for user ID %d", req.ServiceID, userID)
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error":            "Recent authentication required",
+				"step_up_required": true,
+				"step_up_endpoint": "/api/auth/step-up",
+			})
+		case "already active":
+			c.String(http.StatusOK, "Service already active")
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate session"})
+			activationFailed(c, err)
 		}
 		return
 	}
+	if queued {
+		log.Printf("[dashboard] agent unreachable, queued activation of service ID %d for user ID %d", req.ServiceID, userID)
+		c.JSON(http.StatusAccepted, gin.H{"status": models.ActiveServicePending, "message": "Agent unreachable, activation queued"})
+		return
+	}
 
 	c.String(http.StatusOK, "Service set to active")
 }
 
+// activationFailed writes the response for an error activating a service that does not depend on
+// who activates it, for users activating their own services and admins activating one for a user.
+func activationFailed(c *gin.Context, err error) {
+	switch msg := err.Error(); msg {
+	case "service not found or invalid configuration":
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service not found or invalid configuration"})
+	case "IPv6 services are not supported", "IPv6 clients are not supported":
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+	case "service not currently resolvable":
+		c.JSON(http.StatusConflict, gin.H{"error": "Service not currently resolvable"})
+	case "service misconfigured":
+		c.JSON(http.StatusConflict, gin.H{"error": "Service is misconfigured, contact an administrator"})
+	case "active session limit reached":
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Active session limit reached, try again later"})
+	case "agent unavailable":
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Agent unavailable, try again later"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate session"})
+	}
+}
+
 // DeselectActiveService deactivates a service for the current user.
 func (h *ServiceHandler) DeselectActiveService(c *gin.Context) {
-	userID, _, err := h.resolveCurrentUserIDAndRole(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	userID, _, ok := h.resolveCurrentUser(c)
+	if !ok {
 		return
 	}
 
@@ -206,10 +396,13 @@ func (h *ServiceHandler) DeselectActiveService(c *gin.Context) {
 		return
 	}
 
-	clientIP := utils.GetClientIP(c.Request)
+	clientIP, ok := h.sourceIP(c, userID, c.Query("source_ip"))
+	if !ok {
+		return
+	}
 	log.Printf("[dashboard] deactivating service ID %d for user ID %d from IP %s", svcID, userID, clientIP)
 
-	if err := h.svcSvc.DeselectActiveService(userID, svcID, clientIP); err != nil {
+	if err := h.svcSvc.DeselectActiveService(c.Request.Context(), userID, svcID, clientIP); err != nil {
 		log.Printf("[dashboard] deselect service failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		return
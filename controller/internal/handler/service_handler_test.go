@@ -4,16 +4,106 @@ import (
 	"Aegis/controller/internal/middleware"
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
+	"Aegis/controller/proto"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"maps"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+func TestDashboardAuthStatus(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if _, err := db.Exec("INSERT INTO services (id, name, hostname, ip, port) VALUES (7, 'Private', '127.0.0.1:9000', 2130706433, 9000)"); err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES ('plain-user', 'x', 3)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+
+	// The username header stands in for the auth middleware; without it no user is set.
+	r := gin.New()
+	me := r.Group("/api/me", func(c *gin.Context) {
+		if u := c.GetHeader("X-User"); u != "" {
+			c.Set(middleware.UsernameKey, u)
+		}
+	})
+	me.GET("/services", h.GetMyServices)
+	me.GET("/selected", h.GetMyActiveServices)
+	me.POST("/selected", h.SelectActiveService)
+	me.DELETE("/selected/:svc_id", h.DeselectActiveService)
+
+	requests := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/me/services", ""},
+		{http.MethodGet, "/api/me/selected", ""},
+		{http.MethodPost, "/api/me/selected", `{"service_id":7}`},
+		{http.MethodDelete, "/api/me/selected/7", ""},
+	}
+	do := func(user, method, path, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, req := range requests {
+		t.Run(req.method+" "+req.path, func(t *testing.T) {
+			if code := do("", req.method, req.path, req.body); code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d without a user, got %d", http.StatusUnauthorized, code)
+			}
+			if code := do("deleted-user", req.method, req.path, req.body); code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d for a user that no longer exists, got %d", http.StatusUnauthorized, code)
+			}
+		})
+	}
+
+	if code := do("plain-user", http.MethodPost, "/api/me/selected", `{"service_id":7}`); code != http.StatusForbidden {
+		t.Errorf("Expected status %d activating a service without access, got %d", http.StatusForbidden, code)
+	}
+
+	_ = db.Close()
+	for _, req := range requests {
+		if code := do("plain-user", req.method, req.path, req.body); code != http.StatusInternalServerError {
+			t.Errorf("%s %s: expected status %d when the database fails, got %d", req.method, req.path, http.StatusInternalServerError, code)
+		}
+	}
+}
+
 func TestGetServices(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -28,7 +118,7 @@ func TestGetServices(t *testing.T) {
 		t.Fatalf("Failed to create service repo: %v", err)
 	}
 
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -51,6 +141,168 @@ func TestGetServices(t *testing.T) {
 	}
 }
 
+func TestUnassignedServices(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, q := range []string{
+		"INSERT INTO services (id, name, hostname, ip, port) VALUES (1, 'ByRole', 'localhost:8080', 2130706433, 8080)",
+		"INSERT INTO services (id, name, hostname, ip, port) VALUES (2, 'ByUser', 'localhost:8081', 2130706433, 8081)",
+		"INSERT INTO services (id, name, hostname, ip, port) VALUES (3, 'Forgotten', 'localhost:8082', 2130706433, 8082)",
+		"INSERT INTO users (id, username, password, role_id) VALUES (50, 'grantee', 'x', 3)",
+		"INSERT INTO role_services (role_id, service_id) VALUES (3, 1)",
+		"INSERT INTO user_extra_services (user_id, service_id) VALUES (50, 2)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Failed to seed %q: %v", q, err)
+		}
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	newRouter := func(activation service.ActivationConfig) *gin.Engine {
+		h := NewServiceHandler(service.NewServiceService(svcRepo, activation), userRepo)
+		r := gin.New()
+		r.GET("/api/services", h.GetAll)
+		r.GET("/api/services/unassigned", h.GetUnassigned)
+		r.POST("/api/services", h.Create)
+		return r
+	}
+	r := newRouter(service.ActivationConfig{})
+	get := func(path string, into any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected status %d, got %d: %s", path, http.StatusOK, w.Code, w.Body.String())
+		}
+		if err := json.NewDecoder(w.Body).Decode(into); err != nil {
+			t.Fatalf("GET %s: failed to decode response: %v", path, err)
+		}
+	}
+	unassigned := func(services []models.Service) map[string]bool {
+		flags := make(map[string]bool)
+		for _, s := range services {
+			flags[s.Name] = s.Unassigned
+		}
+		return flags
+	}
+	want := map[string]bool{"ByRole": false, "ByUser": false, "Forgotten": true}
+
+	// A grant to a role or to a single user both make a service reachable, listed whole or by page.
+	var all []models.Service
+	get("/api/services", &all)
+	if got := unassigned(all); !maps.Equal(got, want) {
+		t.Errorf("Expected unassigned flags %v, got %v", want, got)
+	}
+	var page struct {
+		Services []models.Service `json:"services"`
+	}
+	get("/api/services?limit=10", &page)
+	if got := unassigned(page.Services); !maps.Equal(got, want) {
+		t.Errorf("Expected unassigned flags %v on a page, got %v", want, got)
+	}
+	var listed []models.Service
+	get("/api/services/unassigned", &listed)
+	if len(listed) != 1 || listed[0].Name != "Forgotten" || !listed[0].Unassigned {
+		t.Errorf("Expected only Forgotten to be listed as unassigned, got %+v", listed)
+	}
+
+	// A new service is unassigned unless a default role is configured, which is then granted it.
+	create := func(r *gin.Engine, name, hostname string) models.Service {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/services", bytes.NewReader(mustMarshal(t, models.Service{Name: name, Hostname: hostname})))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var created models.Service
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return created
+	}
+	if created := create(r, "Fresh", "127.0.0.1:9090"); !created.Unassigned {
+		t.Error("Expected a new service without a default role to be unassigned")
+	}
+	granted := create(newRouter(service.ActivationConfig{DefaultRoleID: 3}), "Granted", "127.0.0.1:9091")
+	if granted.Unassigned {
+		t.Error("Expected a new service granted to the default role not to be unassigned")
+	}
+	var grants int
+	if err := db.QueryRow("SELECT COUNT(*) FROM role_services WHERE role_id = 3 AND service_id = ?", granted.Id).Scan(&grants); err != nil || grants != 1 {
+		t.Errorf("Expected the default role to be granted the new service, got %d grants (err %v)", grants, err)
+	}
+	get("/api/services/unassigned", &listed)
+	if len(listed) != 2 || listed[0].Name != "Forgotten" || listed[1].Name != "Fresh" {
+		t.Errorf("Expected Forgotten and Fresh to be unassigned, got %+v", listed)
+	}
+}
+
+func TestGetServicesSort(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, name := range []string{"Bravo", "Alpha", "Charlie"} {
+		if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, ?)", name, "localhost:8080", 0x7F000001, 8080); err != nil {
+			t.Fatalf("Failed to create test service: %v", err)
+		}
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+
+	r := gin.New()
+	r.GET("/api/services", h.GetAll)
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedNames  []string
+	}{
+		{"Default sort by name", "", http.StatusOK, []string{"Alpha", "Bravo", "Charlie"}},
+		{"Descending name", "?sort=-name", http.StatusOK, []string{"Charlie", "Bravo", "Alpha"}},
+		{"By id", "?sort=id", http.StatusOK, []string{"Bravo", "Alpha", "Charlie"}},
+		{"Unknown column", "?sort=ip", http.StatusBadRequest, nil},
+		{"Injection attempt", "?sort=name%3BDROP%20TABLE%20services", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/services"+tt.query, nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedNames == nil {
+				return
+			}
+			var services []models.Service
+			if err := json.NewDecoder(w.Body).Decode(&services); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			var names []string
+			for _, s := range services {
+				names = append(names, s.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.expectedNames) {
+				t.Errorf("Expected order %v, got %v", tt.expectedNames, names)
+			}
+		})
+	}
+}
+
 func TestDeleteService(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -63,7 +315,7 @@ func TestDeleteService(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -98,7 +350,7 @@ func TestCreateService(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -119,6 +371,11 @@ func TestCreateService(t *testing.T) {
 			payload:        models.Service{Name: "Test", Hostname: "invalid-no-port"},
 			expectedStatus: http.StatusBadRequest,
 		},
+		{
+			name:           "Unknown agent",
+			payload:        models.Service{Name: "Test", Hostname: "127.0.0.1:8080", Agent: "zone-z"},
+			expectedStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -136,13 +393,89 @@ func TestCreateService(t *testing.T) {
 	}
 }
 
+func TestServiceNamesUniqueIgnoringCase(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.POST("/api/services", h.Create)
+	r.PUT("/api/services/:id", h.Update)
+	send := func(method, path string, payload models.Service) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(http.MethodPost, "/api/services", models.Service{Name: "Prod", Hostname: "127.0.0.1:8080"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w := send(http.MethodPost, "/api/services", models.Service{Name: " staging ", Hostname: "127.0.0.1:8081"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var staging models.Service
+	if err := json.NewDecoder(w.Body).Decode(&staging); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if staging.Name != "staging" {
+		t.Errorf("Expected the name to be trimmed, got %q", staging.Name)
+	}
+
+	if w := send(http.MethodPost, "/api/services", models.Service{Name: "prod", Hostname: "127.0.0.1:8082"}); w.Code != http.StatusConflict {
+		t.Errorf("Create \"prod\" next to \"Prod\": expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	if w := send(http.MethodPut, fmt.Sprintf("/api/services/%d", staging.Id), models.Service{Name: "PROD", Hostname: "127.0.0.1:8081"}); w.Code != http.StatusConflict {
+		t.Errorf("Rename to \"PROD\": expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	// Changing only the case of a service's own name is not a conflict.
+	if w := send(http.MethodPut, fmt.Sprintf("/api/services/%d", staging.Id), models.Service{Name: "Staging", Hostname: "127.0.0.1:8081"}); w.Code != http.StatusOK {
+		t.Errorf("Recase own name: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestServiceValidationReportsAllErrors(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Existing', '127.0.0.1:8080', ?, 8080)", 0x7F000001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.POST("/api/services", h.Create)
+	r.PUT("/api/services/:id", h.Update)
+	send := func(method, path string, payload models.Service) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Create with every field invalid", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Agent: "zone-z"}), "name", "hostname", "agent")
+	})
+	t.Run("Update with a bad hostname and no name", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPut, fmt.Sprintf("/api/services/%d", svcID), models.Service{Hostname: "no-port"}), "name", "hostname")
+	})
+}
+
 func TestUpdateService(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -183,13 +516,62 @@ func TestUpdateService(t *testing.T) {
 	}
 }
 
+func TestServiceDescriptionValidation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.POST("/api/services", h.Create)
+	r.PUT("/api/services/:id", h.Update)
+	send := func(method, path string, payload models.Service) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "/api/services", models.Service{Name: "Wiki", Hostname: "127.0.0.1:8080", Description: " Team\x1b[31m wiki\r\n\tdocs\x00 "})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created models.Service
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if want := "Team[31m wiki\n\tdocs"; created.Description != want {
+		t.Errorf("Expected control characters to be stripped to %q, got %q", want, created.Description)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT description FROM services WHERE id = ?", created.Id).Scan(&stored); err != nil || stored != created.Description {
+		t.Errorf("Expected stored description %q, got %q (%v)", created.Description, stored, err)
+	}
+
+	// The limit counts characters, not bytes, and applies after stripping.
+	atLimit := strings.Repeat("é", service.MaxDescriptionLength) + "\x07"
+	if w := send(http.MethodPut, fmt.Sprintf("/api/services/%d", created.Id), models.Service{Name: "Wiki", Hostname: "127.0.0.1:8080", Description: atLimit}); w.Code != http.StatusOK {
+		t.Errorf("Expected a description of %d characters to be accepted, got %d: %s", service.MaxDescriptionLength, w.Code, w.Body.String())
+	}
+
+	tooLong := strings.Repeat("a", service.MaxDescriptionLength+1)
+	t.Run("Create with an over-length description", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Long", Hostname: "127.0.0.1:8081", Description: tooLong}), "description")
+	})
+	t.Run("Update with an over-length description", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPut, fmt.Sprintf("/api/services/%d", created.Id), models.Service{Name: "Wiki", Hostname: "127.0.0.1:8080", Description: tooLong}), "description")
+	})
+}
+
 func TestCreateServiceSuccess(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -216,6 +598,9 @@ func TestCreateServiceSuccess(t *testing.T) {
 	if created.Name != payload.Name {
 		t.Errorf("Expected service name %q, got %q", payload.Name, created.Name)
 	}
+	if created.Agent != "primary" {
+		t.Errorf("Expected service to default to the primary agent, got %q", created.Agent)
+	}
 }
 
 func TestUpdateServiceSuccess(t *testing.T) {
@@ -230,7 +615,7 @@ func TestUpdateServiceSuccess(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -267,7 +652,7 @@ func TestGetMyServices(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -295,7 +680,7 @@ func TestGetMyServicesUnknownUser(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -323,7 +708,7 @@ func TestGetMyActiveServices(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -351,7 +736,7 @@ func TestSelectActiveServiceInvalidBody(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -382,7 +767,7 @@ func TestSelectActiveServiceForbidden(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -412,7 +797,7 @@ func TestDeselectActiveServiceInvalidID(t *testing.T) {
 
 	userRepo, _ := createReposFromDB(t, db)
 	svcRepo, _ := createServiceRepo(t, db)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{})
 	h := NewServiceHandler(svcSvc, userRepo)
 
 	r := gin.New()
@@ -428,3 +813,894 @@ func TestDeselectActiveServiceInvalidID(t *testing.T) {
 		t.Errorf("Expected status %d for invalid service ID, got %d", http.StatusBadRequest, w.Code)
 	}
 }
+
+// initUnreachableAgent registers an agent client named name whose address nothing listens on.
+func initUnreachableAgent(t *testing.T, name string) {
+	t.Helper()
+	certFile, keyFile := writeAgentCert(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+	if err := proto.InitAgent(name, addr, certFile, keyFile, certFile, "aegis-agent"); err != nil {
+		t.Fatalf("InitAgent failed: %v", err)
+	}
+}
+
+// serveAgent serves agent over TLS and registers an agent client named name for it.
+func serveAgent(t *testing.T, name string, agent proto.SessionManagerServer) {
+	t.Helper()
+	certFile, keyFile := writeAgentCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	proto.RegisterSessionManagerServer(srv, agent)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	if err := proto.InitAgent(name, lis.Addr().String(), certFile, keyFile, certFile, "aegis-agent"); err != nil {
+		t.Fatalf("InitAgent failed: %v", err)
+	}
+}
+
+// writeAgentCert writes a self-signed certificate for aegis-agent, usable as agent certificate,
+// client certificate and CA alike, and returns the paths of the certificate and its key.
+func writeAgentCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aegis-agent"},
+		DNSNames:              []string{"aegis-agent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// blockingAgent accepts every session, but holds each call until release is closed.
+type blockingAgent struct {
+	proto.UnimplementedSessionManagerServer
+	calls   *atomic.Int32
+	release chan struct{}
+}
+
+func (a blockingAgent) SubmitSession(ctx context.Context, _ *proto.LoginEvent) (*proto.Ack, error) {
+	a.calls.Add(1)
+	select {
+	case <-a.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &proto.Ack{Success: true}, nil
+}
+
+func TestSelectActiveServiceConcurrentActivations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	agent := blockingAgent{calls: &atomic.Int32{}, release: make(chan struct{})}
+	serveAgent(t, "blocking", agent)
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('raceuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES ('Raced', '10.9.0.1:22', ?, 22, 'blocking')", 0x0A090001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcID); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{CallTimeout: 10 * time.Second}), userRepo)
+	r := gin.New()
+	r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "raceuser") }, h.SelectActiveService)
+
+	const requests = 5
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ServeHTTP(responses[i], httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+		}()
+	}
+	// The same user selecting the service from another IP needs a session of its own.
+	other := httptest.NewRecorder()
+	wg.Go(func() {
+		req := httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID})))
+		req.RemoteAddr = "192.0.2.2:1234"
+		r.ServeHTTP(other, req)
+	})
+	// Hold the first activation at the agent until every request has had time to arrive.
+	deadline := time.Now().Add(5 * time.Second)
+	for agent.calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(agent.release)
+	wg.Wait()
+
+	if n := agent.calls.Load(); n != 2 {
+		t.Errorf("Expected 1 agent call for %d concurrent activations and 1 for the other IP, got %d", requests, n)
+	}
+	if other.Code != http.StatusOK || other.Body.String() != "Service set to active" {
+		t.Errorf("Expected the activation from the other IP to reach the agent, got %d: %s", other.Code, other.Body.String())
+	}
+	var activated, alreadyActive int
+	for _, w := range responses {
+		switch {
+		case w.Code == http.StatusOK && w.Body.String() == "Service set to active":
+			activated++
+		case w.Code == http.StatusOK && w.Body.String() == "Service already active":
+			alreadyActive++
+		default:
+			t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if activated != 1 || alreadyActive != requests-1 {
+		t.Errorf("Expected 1 activation and %d already active, got %d and %d", requests-1, activated, alreadyActive)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_active_services WHERE service_id = ?", svcID).Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected the service to be active once, got %d (%v)", count, err)
+	}
+
+	// Once the activation has finished, selecting the service again renews it at the agent.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+	if w.Code != http.StatusOK || w.Body.String() != "Service set to active" || agent.calls.Load() != 3 {
+		t.Errorf("Expected a renewal reaching the agent, got %d: %s after %d calls", w.Code, w.Body.String(), agent.calls.Load())
+	}
+}
+
+func TestSelectActiveServiceSessionLimit(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('limituser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	svcIDs := map[string]int64{}
+	for i, name := range []string{"Held", "New"} {
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES (?, ?, ?, 22, 'offline')", name, fmt.Sprintf("10.9.0.%d:22", i+1), 0x0A090001+i)
+		if err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+		svcIDs[name], _ = res.LastInsertId()
+		if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcIDs[name]); err != nil {
+			t.Fatalf("Failed to grant service: %v", err)
+		}
+	}
+	// The one session the limit allows is already in use.
+	if _, err := db.Exec("INSERT INTO user_active_services (user_id, service_id, updated_at, time_left) SELECT id, ?, CURRENT_TIMESTAMP, 60 FROM users WHERE username = 'limituser'", svcIDs["Held"]); err != nil {
+		t.Fatalf("Failed to activate service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	selectService := func(cfg service.ActivationConfig, name string) *httptest.ResponseRecorder {
+		h := NewServiceHandler(service.NewServiceService(svcRepo, cfg), userRepo)
+		r := gin.New()
+		r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "limituser") }, h.SelectActiveService)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcIDs[name]}))))
+		return w
+	}
+	rejecting := service.ActivationConfig{Queue: true, TTL: time.Minute, MaxActiveSessions: 1, RejectOverLimit: true}
+
+	if w := selectService(rejecting, "New"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d at the limit, got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+	// Renewing a held session adds nothing, so it reaches the (unreachable) agent and is queued.
+	if w := selectService(rejecting, "Held"); w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d when renewing at the limit, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	// Without reject_over_limit the limit only warns.
+	if w := selectService(service.ActivationConfig{Queue: true, TTL: time.Minute, MaxActiveSessions: 1}, "New"); w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d when only warning, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	var out strings.Builder
+	service.SessionLimitCollector(svcRepo, 1)(&out)
+	for _, want := range []string{"aegis_active_sessions 1\n", "aegis_active_sessions_limit 1\n", "aegis_session_limit_rejections_total 1\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSelectActiveServiceQueuesWhenAgentUnreachable(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('queueuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES ('Offline', '10.9.0.1:22', ?, 22, 'offline')", 0x0A090001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcID); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	newRouter := func(svcSvc service.ServiceService) *gin.Engine {
+		h := NewServiceHandler(svcSvc, userRepo)
+		r := gin.New()
+		setUser := func(c *gin.Context) { c.Set(middleware.UsernameKey, "queueuser") }
+		r.GET("/api/me/selected", setUser, h.GetMyActiveServices)
+		r.POST("/api/me/selected", setUser, h.SelectActiveService)
+		r.DELETE("/api/me/selected/:svc_id", setUser, h.DeselectActiveService)
+		return r
+	}
+	selectService := func(r *gin.Engine) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+		return w
+	}
+	activeServices := func(r *gin.Engine) []models.ActiveService {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/me/selected", nil))
+		var services []models.ActiveService
+		if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil {
+			t.Fatalf("Failed to decode active services: %v", err)
+		}
+		return services
+	}
+
+	// Fail-fast mode reports the agent as unavailable once its retries are used up.
+	if w := selectService(newRouter(service.NewServiceService(svcRepo, service.ActivationConfig{}))); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d in fail-fast mode, got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+
+	queueSvc := service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Minute})
+	r := newRouter(queueSvc)
+	w := selectService(r)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"status":"pending"`) {
+		t.Fatalf("Expected status %d with a pending status, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	services := activeServices(r)
+	if len(services) != 1 || services[0].Id != int(svcID) || services[0].Status != models.ActiveServicePending {
+		t.Fatalf("Expected the service to be listed as pending, got %+v", services)
+	}
+
+	// The agent is still down, so a retry keeps the selection queued.
+	queueSvc.RetryPendingActivations()
+	if services := activeServices(r); len(services) != 1 || services[0].Status != models.ActiveServicePending {
+		t.Errorf("Expected the selection to stay queued, got %+v", services)
+	}
+
+	// Deselecting withdraws the queued selection.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/me/selected/%d", svcID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if services := activeServices(r); len(services) != 0 {
+		t.Errorf("Expected no services after deselecting, got %+v", services)
+	}
+
+	// Queued selections older than the TTL are dropped on the next retry.
+	expiringSvc := service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Nanosecond})
+	r = newRouter(expiringSvc)
+	if w := selectService(r); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	expiringSvc.RetryPendingActivations()
+	if services := activeServices(r); len(services) != 0 {
+		t.Errorf("Expected the expired selection to be dropped, got %+v", services)
+	}
+}
+
+func TestSelectActiveServiceSourceIP(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	for _, u := range []struct {
+		name string
+		role int
+	}{{"vpnroot", 1}, {"vpnuser", 3}} {
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, 'hashed', ?, 1)", u.name, u.role); err != nil {
+			t.Fatalf("Failed to create test user: %v", err)
+		}
+	}
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES ('Offline', '10.9.0.1:22', ?, 22, 'offline')", 0x0A090001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (1, ?), (3, ?)", svcID, svcID); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	allowlist, err := utils.ParseSourceIPAllowlist([]string{"10.8.0.0/16"})
+	if err != nil {
+		t.Fatalf("Failed to parse allowlist: %v", err)
+	}
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Minute, SourceIPAllowlist: allowlist}), userRepo)
+	selectService := func(username string, body map[string]any, header string) *httptest.ResponseRecorder {
+		r := gin.New()
+		r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, username) }, h.SelectActiveService)
+		req := httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, body)))
+		if header != "" {
+			req.Header.Set("X-VPN-Client-IP", header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// queuedIP returns the source IP the user's selection was queued for, since the agent is down.
+	queuedIP := func(username string) string {
+		var ip string
+		if err := db.QueryRow("SELECT pa.client_ip FROM pending_activations pa JOIN users u ON u.id = pa.user_id WHERE u.username = ?", username).Scan(&ip); err != nil {
+			t.Fatalf("Failed to read queued activation for %s: %v", username, err)
+		}
+		return ip
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		sourceIP string
+		header   string
+		wantCode int
+		wantIP   string
+	}{
+		{"Request IP by default", "vpnuser", "", "", http.StatusAccepted, "192.0.2.1"},
+		{"Source IP header", "vpnuser", "", "10.8.3.4", http.StatusAccepted, "10.8.3.4"},
+		{"Invalid source IP header", "vpnuser", "", "not-an-ip", http.StatusAccepted, "192.0.2.1"},
+		{"Override without capability", "vpnuser", "10.8.0.5", "", http.StatusForbidden, ""},
+		{"Allowlisted override", "vpnroot", "10.8.0.5", "", http.StatusAccepted, "10.8.0.5"},
+		{"Override outside the allowlist", "vpnroot", "192.0.2.99", "", http.StatusForbidden, ""},
+		{"Invalid override", "vpnroot", "fd00::1", "", http.StatusBadRequest, ""},
+	}
+	utils.SetSourceIPHeader("X-VPN-Client-IP")
+	t.Cleanup(func() { utils.SetSourceIPHeader("") })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]any{"service_id": svcID}
+			if tt.sourceIP != "" {
+				body["source_ip"] = tt.sourceIP
+			}
+			w := selectService(tt.username, body, tt.header)
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantIP != "" {
+				if got := queuedIP(tt.username); got != tt.wantIP {
+					t.Errorf("Expected the selection to be enforced for %s, got %s", tt.wantIP, got)
+				}
+			}
+		})
+	}
+}
+
+func TestContainerBinding(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	result, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, ?)", "Postgres", "db:5432", 0x0A000002, 5432)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := result.LastInsertId()
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.GET("/api/services", h.GetAll)
+	r.PUT("/api/services/:id/container", h.BindContainer)
+	r.DELETE("/api/services/:id/container", h.UnbindContainer)
+	send := func(method, path string, payload any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	bound := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/services", nil))
+		var services []models.Service
+		if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil || len(services) != 1 {
+			t.Fatalf("Failed to list services: %v: %s", err, w.Body.String())
+		}
+		return services[0].Container
+	}
+	path := fmt.Sprintf("/api/services/%d/container", svcID)
+
+	tests := []struct {
+		name           string
+		path           string
+		payload        any
+		expectedStatus int
+	}{
+		{"Missing container", path, map[string]string{}, http.StatusBadRequest},
+		{"Invalid container name", path, map[string]string{"container": "pg primary"}, http.StatusBadRequest},
+		{"Non-existent service", "/api/services/99999/container", map[string]string{"container": "pg-primary"}, http.StatusNotFound},
+		{"Invalid ID", "/api/services/invalid/container", map[string]string{"container": "pg-primary"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(http.MethodPut, tt.path, tt.payload); w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if w := send(http.MethodPut, path, map[string]string{"container": "/pg-primary"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := bound(); got != "pg-primary" {
+		t.Errorf("Expected the service to be bound to pg-primary, got %q", got)
+	}
+
+	if w := send(http.MethodDelete, path, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := bound(); got != "" {
+		t.Errorf("Expected the binding to be removed, got %q", got)
+	}
+	if w := send(http.MethodDelete, "/api/services/99999/container", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d unbinding a missing service, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestPortRangeService(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('rangeuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Minute}), userRepo)
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set(middleware.UsernameKey, "rangeuser") }
+	r.POST("/api/services", h.Create)
+	r.GET("/api/me/selected", setUser, h.GetMyActiveServices)
+	r.POST("/api/me/selected", setUser, h.SelectActiveService)
+	send := func(method, path string, payload any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Range end below the port", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Backwards", Hostname: "10.9.0.1:10000", PortRangeEnd: 9999}), "port_range_end")
+	})
+	t.Run("Range too wide", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Wide", Hostname: "10.9.0.1:10000", PortRangeEnd: 10000 + models.MaxPortRangePorts}), "port_range_end")
+	})
+
+	w := send(http.MethodPost, "/api/services", models.Service{Name: "RTP", Hostname: "10.9.0.1:10000", PortRangeEnd: 10000 + models.MaxPortRangePorts - 1, Agent: "offline"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created models.Service
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to decode service: %v", err)
+	}
+	if created.Port != 10000 || created.PortRangeEnd != 10255 {
+		t.Errorf("Expected ports 10000-10255, got %d-%d", created.Port, created.PortRangeEnd)
+	}
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", created.Id); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	// The agent is down, so the selection is queued and retried with the whole range.
+	if w := send(http.MethodPost, "/api/me/selected", map[string]int{"service_id": created.Id}); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/me/selected", nil))
+	var services []models.ActiveService
+	if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil {
+		t.Fatalf("Failed to decode active services: %v", err)
+	}
+	if len(services) != 1 || services[0].Port != 10000 || services[0].PortRangeEnd != 10255 {
+		t.Errorf("Expected the ranged service to be listed as pending, got %+v", services)
+	}
+}
+
+// recordingAgent accepts every session and passes each login event to events.
+type recordingAgent struct {
+	proto.UnimplementedSessionManagerServer
+	events chan *proto.LoginEvent
+}
+
+func (a recordingAgent) SubmitSession(_ context.Context, e *proto.LoginEvent) (*proto.Ack, error) {
+	a.events <- e
+	return &proto.Ack{Success: true}, nil
+}
+
+func TestCIDRService(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	agent := recordingAgent{events: make(chan *proto.LoginEvent, 2)}
+	serveAgent(t, "subnets", agent)
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('cidruser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{CallTimeout: 5 * time.Second}), userRepo)
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set(middleware.UsernameKey, "cidruser") }
+	r.POST("/api/services", h.Create)
+	r.POST("/api/me/selected", setUser, h.SelectActiveService)
+	r.DELETE("/api/me/selected/:svc_id", setUser, h.DeselectActiveService)
+	send := func(method, path string, payload any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Unknown destination type", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Odd", Hostname: "10.20.0.0/24:443", DestType: "range"}), "destination_type")
+	})
+	t.Run("Host bits set", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Unmasked", Hostname: "10.20.0.1/24:443", DestType: models.DestinationCIDR}), "hostname")
+	})
+	t.Run("Not a network", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Named", Hostname: "db.internal:443", DestType: models.DestinationCIDR}), "hostname")
+	})
+	t.Run("Too many rules", func(t *testing.T) {
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "Wide", Hostname: "10.20.0.0/23:443", DestType: models.DestinationCIDR}), "hostname")
+		expectFieldErrors(t, send(http.MethodPost, "/api/services", models.Service{Name: "WideRange", Hostname: "10.20.0.0/24:443", PortRangeEnd: 444, DestType: models.DestinationCIDR}), "hostname")
+	})
+
+	// The network is stored as given, without a DNS lookup.
+	w := send(http.MethodPost, "/api/services", models.Service{Name: "Subnet", Hostname: "10.20.0.0/24:443", DestType: models.DestinationCIDR, Agent: "subnets"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created models.Service
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to decode service: %v", err)
+	}
+	if created.DestType != models.DestinationCIDR || created.Ip != 0x0A140000 || created.Port != 443 {
+		t.Errorf("Expected a CIDR service at 10.20.0.0 port 443, got %+v", created)
+	}
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", created.Id); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	// Activation and deactivation hand the agent the whole network.
+	if w := send(http.MethodPost, "/api/me/selected", map[string]int{"service_id": created.Id}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if e := <-agent.events; e.GetDstIp() != 0x0A140000 || e.GetDstPrefixLen() != 24 || e.GetDstPort() != 443 || !e.GetActivate() {
+		t.Errorf("Expected an activation of 10.20.0.0/24 port 443, got %+v", e)
+	}
+	if w := send(http.MethodDelete, fmt.Sprintf("/api/me/selected/%d", created.Id), nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if e := <-agent.events; e.GetDstIp() != 0x0A140000 || e.GetDstPrefixLen() != 24 || e.GetActivate() {
+		t.Errorf("Expected a deactivation of 10.20.0.0/24, got %+v", e)
+	}
+}
+
+func TestRoleMaxTTL(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	agent := recordingAgent{events: make(chan *proto.LoginEvent, 2)}
+	serveAgent(t, "ttl", agent)
+
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES ('Timed', '10.30.0.1:22', ?, 22, 'ttl')", 0x0A1E0001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	// One role cuts the default session short; the other allows more than the default.
+	for _, role := range []struct {
+		name, user string
+		maxTTL     int
+	}{{"ShortLived", "shortuser", 30}, {"LongLived", "longuser", 300}} {
+		res, err := db.Exec("INSERT INTO roles (name, max_ttl) VALUES (?, ?)", role.name, role.maxTTL)
+		if err != nil {
+			t.Fatalf("Failed to create role: %v", err)
+		}
+		roleID, _ := res.LastInsertId()
+		if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (?, ?)", roleID, svcID); err != nil {
+			t.Fatalf("Failed to grant service: %v", err)
+		}
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, 'hashed', ?, 1)", role.user, roleID); err != nil {
+			t.Fatalf("Failed to create test user: %v", err)
+		}
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{CallTimeout: 5 * time.Second}), userRepo)
+
+	tests := []struct {
+		user       string
+		ttlSeconds uint32
+		timeLeft   int
+	}{
+		// The role limit wins over the longer default.
+		{"shortuser", 30, 30},
+		// A limit above the default leaves the agent's own timeout in place.
+		{"longuser", 0, models.SessionTimeLeft},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			r := gin.New()
+			r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, tt.user) }, h.SelectActiveService)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID})))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			if e := <-agent.events; e.GetTtlSeconds() != tt.ttlSeconds || !e.GetActivate() {
+				t.Errorf("Expected an activation with ttl_seconds %d, got %+v", tt.ttlSeconds, e)
+			}
+			var timeLeft int
+			if err := db.QueryRow("SELECT uas.time_left FROM user_active_services uas JOIN users u ON u.id = uas.user_id WHERE u.username = ?", tt.user).Scan(&timeLeft); err != nil {
+				t.Fatalf("Failed to read session: %v", err)
+			}
+			if timeLeft != tt.timeLeft {
+				t.Errorf("Expected time_left %d, got %d", tt.timeLeft, timeLeft)
+			}
+		})
+	}
+}
+
+func TestMalformedServiceAddress(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('corruptuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	// A port no service can have, as a manual database edit might leave it.
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Corrupt', '10.9.0.1:22', ?, 99999)", 0x0A090001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcID); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "corruptuser") }, h.SelectActiveService)
+	r.GET("/api/admin/integrity", newIntegrityHandler(t, db).Get)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a malformed service, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/integrity", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report models.IntegrityReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.Services) != 1 || report.Services[0].ServiceID != int(svcID) || report.Services[0].Field != "port" ||
+		report.Services[0].Value != "99999" || !strings.Contains(report.Services[0].Repair, fmt.Sprintf("/api/services/%d", svcID)) {
+		t.Errorf("Expected one port issue with a repair for service %d, got %+v", svcID, report.Services)
+	}
+}
+
+func TestSelectActiveServiceRequiresStepUp(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('stepupuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent, requires_step_up) VALUES ('Prod DB', '10.9.0.2:5432', ?, 5432, 'offline', 1)", 0x0A090002)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcID); err != nil {
+		t.Fatalf("Failed to grant service: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{StepUpMaxAge: 5 * time.Minute}), userRepo)
+
+	tests := []struct {
+		name     string
+		authTime time.Time
+		token    bool
+		want     int
+	}{
+		{"No auth_time", time.Time{}, false, http.StatusUnauthorized},
+		{"Stale auth_time", time.Now().Add(-10 * time.Minute), false, http.StatusUnauthorized},
+		{"API token", time.Time{}, true, http.StatusForbidden},
+		// The step-up check passes; activation then fails because the agent is unreachable.
+		{"Fresh auth_time", time.Now(), false, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.POST("/api/me/selected", func(c *gin.Context) {
+				c.Set(middleware.UsernameKey, "stepupuser")
+				if !tt.authTime.IsZero() {
+					c.Set(middleware.AuthTimeKey, tt.authTime)
+				}
+				if tt.token {
+					c.Set(middleware.TokenScopeKey, models.TokenScopeFull)
+				}
+			}, h.SelectActiveService)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+			if w.Code != tt.want {
+				t.Fatalf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.want == http.StatusUnauthorized && !strings.Contains(w.Body.String(), `"step_up_required":true`) {
+				t.Errorf("Expected a step-up challenge, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSelectActiveServiceUnresolvedAddress(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('resolveuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	// Every service is stored without an address, as if its hostname never resolved.
+	svcIDs := map[string]int64{}
+	for name, hostname := range map[string]string{"Unresolvable": "unresolvable.invalid:22", "Zero": "0.0.0.0:22", "Resolvable": "10.9.0.5:22"} {
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES (?, ?, 0, 22, 'offline')", name, hostname)
+		if err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+		svcIDs[name], _ = res.LastInsertId()
+		if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcIDs[name]); err != nil {
+			t.Fatalf("Failed to grant service: %v", err)
+		}
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Minute}), userRepo)
+	r := gin.New()
+	r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "resolveuser") }, h.SelectActiveService)
+	selectService := func(svcID int64) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/selected", bytes.NewReader(mustMarshal(t, map[string]int64{"service_id": svcID}))))
+		return w
+	}
+
+	for _, name := range []string{"Unresolvable", "Zero"} {
+		w := selectService(svcIDs[name])
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Service not currently resolvable") {
+			t.Errorf("%s: expected status %d, got %d: %s", name, http.StatusConflict, w.Code, w.Body.String())
+		}
+	}
+
+	// A hostname that resolves now is stored and activation goes ahead; the agent is down, so it queues.
+	if w := selectService(svcIDs["Resolvable"]); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if target, err := svcRepo.GetTarget(int(svcIDs["Resolvable"])); err != nil || target.Ip != 0x0A090005 {
+		t.Errorf("Expected the resolved address to be stored, got %#x, %v", target.Ip, err)
+	}
+}
+
+func TestIPv6ServicesRejected(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('ipv6user', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	// Stored as it would have been before IPv6 hostnames were rejected: with no usable address.
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Loopback6', '[::1]:8080', 0, 8080)")
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	v6ID, _ := res.LastInsertId()
+	res, err = db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Loopback4', '127.0.0.1:8080', ?, 8080)", 0x7F000001)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	v4ID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?), (3, ?)", v6ID, v4ID); err != nil {
+		t.Fatalf("Failed to grant services: %v", err)
+	}
+
+	userRepo, _ := createReposFromDB(t, db)
+	svcRepo, _ := createServiceRepo(t, db)
+	h := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+	r := gin.New()
+	r.POST("/api/services", h.Create)
+	r.POST("/api/me/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "ipv6user") }, h.SelectActiveService)
+
+	tests := []struct {
+		name       string
+		path       string
+		body       any
+		remoteAddr string
+	}{
+		{"Create IPv6 service", "/api/services", map[string]string{"name": "New6", "hostname": "[::1]:9090"}, "192.0.2.1:1234"},
+		{"Activate IPv6 service", "/api/me/selected", map[string]int64{"service_id": v6ID}, "192.0.2.1:1234"},
+		{"Activate from IPv6 client", "/api/me/selected", map[string]int64{"service_id": v4ID}, "[2001:db8::1]:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(mustMarshal(t, tt.body)))
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "IPv6") {
+				t.Errorf("Expected status %d with an IPv6 error, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	grpcPkg "Aegis/controller/internal/grpc"
+	"Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An agent's session list is stale once it is older than staleIntervals push intervals, or
+// defaultSessionStaleAfter while the agent's cadence has not been observed yet.
+const (
+	staleIntervals           = 3
+	defaultSessionStaleAfter = 15 * time.Second
+)
+
+// snapshotStale reports whether snap is too old to reflect what its agent enforces now, or was never received.
+func snapshotStale(snap grpcPkg.AgentSnapshot, now time.Time) bool {
+	if snap.ReceivedAt.IsZero() {
+		return true
+	}
+	staleAfter := defaultSessionStaleAfter
+	if snap.Interval > 0 {
+		staleAfter = staleIntervals * snap.Interval
+	}
+	return now.Sub(snap.ReceivedAt) > staleAfter
+}
+
+// SessionSnapshotFunc returns the latest session list received from each agent.
+type SessionSnapshotFunc func() []grpcPkg.AgentSnapshot
+
+// SessionHandler exposes the sessions agents report, as opposed to the ones stored in the database.
+type SessionHandler struct {
+	snapshots SessionSnapshotFunc
+	svcSvc    service.ServiceService
+}
+
+// NewSessionHandler creates a new SessionHandler.
+func NewSessionHandler(snapshots SessionSnapshotFunc, svcSvc service.ServiceService) *SessionHandler {
+	return &SessionHandler{snapshots: snapshots, svcSvc: svcSvc}
+}
+
+type agentSession struct {
+	SrcIP       string `json:"src_ip"`
+	DstIP       string `json:"dst_ip"`
+	DstPort     uint32 `json:"dst_port"`
+	TimeLeft    int32  `json:"time_left"`
+	ServiceID   int    `json:"service_id,omitempty"`
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+type agentSessions struct {
+	Agent               string         `json:"agent"`
+	ReceivedAt          *time.Time     `json:"received_at"`
+	AgeSeconds          int            `json:"age_seconds"`
+	PushIntervalSeconds float64        `json:"push_interval_seconds,omitempty"`
+	Stale               bool           `json:"stale"`
+	Sessions            []agentSession `json:"sessions"`
+}
+
+// GetAgentSessions returns the last session list each agent reported, with services resolved by
+// agent and destination address where possible.
+func (h *SessionHandler) GetAgentSessions(c *gin.Context) {
+	_, byTarget, err := h.loadServiceTargets()
+	if err != nil {
+		log.Printf("[sessions] failed to load services: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
+		return
+	}
+
+	now := time.Now()
+	snapshots := h.snapshots()
+	out := make([]agentSessions, 0, len(snapshots))
+	for _, snap := range snapshots {
+		entry := agentSessions{Agent: snap.Agent, Stale: snapshotStale(snap, now), Sessions: make([]agentSession, 0, len(snap.Sessions))}
+		if !snap.ReceivedAt.IsZero() {
+			receivedAt := snap.ReceivedAt.UTC()
+			entry.ReceivedAt = &receivedAt
+			entry.AgeSeconds = int(now.Sub(receivedAt).Seconds())
+			if snap.Interval > 0 {
+				entry.PushIntervalSeconds = snap.Interval.Seconds()
+			}
+		}
+		for _, s := range snap.Sessions {
+			session := agentSession{
+				SrcIP:    utils.Uint32ToIp(s.SrcIp),
+				DstIP:    utils.Uint32ToIp(s.DstIp),
+				DstPort:  s.DstPort,
+				TimeLeft: s.TimeLeft,
+			}
+			if svc, ok := byTarget[repository.ServiceKey{Agent: snap.Agent, Addr: fmt.Sprintf("%s:%d", session.DstIP, s.DstPort)}]; ok {
+				session.ServiceID = svc.Id
+				session.ServiceName = svc.Name
+			}
+			entry.Sessions = append(entry.Sessions, session)
+		}
+		out = append(out, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"agents": out})
+}
+
+// reconcileSession is a session an agent reports that the database does not account for.
+type reconcileSession struct {
+	Agent string `json:"agent"`
+	agentSession
+}
+
+// dbOnlySession is a service active in the database that its agent reports no session for.
+type dbOnlySession struct {
+	UserID      int    `json:"user_id"`
+	ServiceID   int    `json:"service_id"`
+	ServiceName string `json:"service_name"`
+	Agent       string `json:"agent"`
+}
+
+// reconcileReport lists where the agents' session lists and user_active_services disagree. Agents
+// without a fresh session list are skipped, together with the services they enforce.
+type reconcileReport struct {
+	CheckedAgents   []string           `json:"checked_agents"`
+	SkippedAgents   []string           `json:"skipped_agents"`
+	AgentOnly       []reconcileSession `json:"agent_only"`
+	DBOnly          []dbOnlySession    `json:"db_only"`
+	UnknownServices []reconcileSession `json:"unknown_services"`
+}
+
+// loadServiceTargets returns every service, and maps each destination agents report sessions to, by
+// agent and "ip:port", to its service. Ranged and CIDR services are matched on every port and
+// address they cover, like the session sync matches them.
+func (h *SessionHandler) loadServiceTargets() ([]models.Service, map[repository.ServiceKey]models.Service, error) {
+	services, err := h.svcSvc.GetAll("")
+	if err != nil {
+		return nil, nil, err
+	}
+	serviceMap, err := h.svcSvc.GetServiceMap()
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[int]models.Service, len(services))
+	for _, s := range services {
+		byID[s.Id] = s
+	}
+	byTarget := make(map[repository.ServiceKey]models.Service, len(serviceMap))
+	for key, id := range serviceMap {
+		if s, ok := byID[id]; ok {
+			byTarget[key] = s
+		}
+	}
+	return services, byTarget, nil
+}
+
+// buildReconcileReport compares snapshots with active, the users each service is active for in the
+// database. Sessions are matched to services through byTarget, as built by loadServiceTargets.
+func buildReconcileReport(snapshots []grpcPkg.AgentSnapshot, services []models.Service, byTarget map[repository.ServiceKey]models.Service, active map[int][]int, now time.Time) reconcileReport {
+	report := reconcileReport{
+		CheckedAgents:   []string{},
+		SkippedAgents:   []string{},
+		AgentOnly:       []reconcileSession{},
+		DBOnly:          []dbOnlySession{},
+		UnknownServices: []reconcileSession{},
+	}
+
+	checked := make(map[string]bool)
+	enforced := make(map[int]bool) // services with at least one session on their agent
+	for _, snap := range snapshots {
+		if snapshotStale(snap, now) {
+			report.SkippedAgents = append(report.SkippedAgents, snap.Agent)
+			continue
+		}
+		checked[snap.Agent] = true
+		report.CheckedAgents = append(report.CheckedAgents, snap.Agent)
+		for _, s := range snap.Sessions {
+			session := reconcileSession{Agent: snap.Agent, agentSession: agentSession{
+				SrcIP:    utils.Uint32ToIp(s.SrcIp),
+				DstIP:    utils.Uint32ToIp(s.DstIp),
+				DstPort:  s.DstPort,
+				TimeLeft: s.TimeLeft,
+			}}
+			svc, ok := byTarget[repository.ServiceKey{Agent: snap.Agent, Addr: fmt.Sprintf("%s:%d", session.DstIP, s.DstPort)}]
+			if !ok {
+				report.UnknownServices = append(report.UnknownServices, session)
+				continue
+			}
+			enforced[svc.Id] = true
+			if len(active[svc.Id]) == 0 {
+				session.ServiceID, session.ServiceName = svc.Id, svc.Name
+				report.AgentOnly = append(report.AgentOnly, session)
+			}
+		}
+	}
+
+	for _, svc := range services {
+		if !checked[svc.Agent] || enforced[svc.Id] {
+			continue
+		}
+		for _, userID := range active[svc.Id] {
+			report.DBOnly = append(report.DBOnly, dbOnlySession{UserID: userID, ServiceID: svc.Id, ServiceName: svc.Name, Agent: svc.Agent})
+		}
+	}
+	return report
+}
+
+// buildReport loads what buildReconcileReport compares, writing 500 and reporting false on failure.
+func (h *SessionHandler) buildReport(c *gin.Context) (reconcileReport, bool) {
+	services, byTarget, err := h.loadServiceTargets()
+	if err != nil {
+		log.Printf("[sessions] failed to load services: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
+		return reconcileReport{}, false
+	}
+	active, err := h.svcSvc.GetActiveServiceUsers()
+	if err != nil {
+		log.Printf("[sessions] failed to load active services: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve active services"})
+		return reconcileReport{}, false
+	}
+	return buildReconcileReport(h.snapshots(), services, byTarget, active, time.Now()), true
+}
+
+// GetReconcile reports sessions agents enforce for services no user has active, services active in
+// the database that their agent has no session for, and traffic to unknown services.
+func (h *SessionHandler) GetReconcile(c *gin.Context) {
+	report, ok := h.buildReport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+type reconcileResult struct {
+	reconcileReport
+	ClosedSessions int      `json:"closed_sessions"`
+	DroppedRows    int      `json:"dropped_rows"`
+	Errors         []string `json:"errors"`
+}
+
+// Reconcile corrects what GetReconcile reports: agent-only sessions are closed on their agent and
+// database-only active services are dropped. Traffic to unknown services is left alone, since the
+// controller cannot tell what it belongs to.
+func (h *SessionHandler) Reconcile(c *gin.Context) {
+	report, ok := h.buildReport(c)
+	if !ok {
+		return
+	}
+	result := reconcileResult{reconcileReport: report, Errors: []string{}}
+	for _, s := range report.AgentOnly {
+		if err := h.svcSvc.CloseAgentSession(c.Request.Context(), s.Agent, utils.IpToUint32(s.SrcIP), utils.IpToUint32(s.DstIP), s.DstPort); err != nil {
+			log.Printf("[sessions] reconcile: failed to close session %s -> %s:%d on agent %s: %v", s.SrcIP, s.DstIP, s.DstPort, s.Agent, err)
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to close session %s -> %s:%d on agent %s", s.SrcIP, s.DstIP, s.DstPort, s.Agent))
+			continue
+		}
+		result.ClosedSessions++
+	}
+	for _, r := range report.DBOnly {
+		if err := h.svcSvc.DropActiveService(r.UserID, r.ServiceID); err != nil {
+			log.Printf("[sessions] reconcile: failed to drop service ID %d for user ID %d: %v", r.ServiceID, r.UserID, err)
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to drop service %d for user %d", r.ServiceID, r.UserID))
+			continue
+		}
+		result.DroppedRows++
+	}
+	log.Printf("[sessions] reconcile by %s: closed %d agent sessions, dropped %d active services, %d errors",
+		c.GetString(middleware.UsernameKey), result.ClosedSessions, result.DroppedRows, len(result.Errors))
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	grpcPkg "Aegis/controller/internal/grpc"
+	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/utils"
+	"Aegis/controller/proto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetAgentSessions(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, ?)", "Database", "10.0.0.5:5432", utils.IpToUint32("10.0.0.5"), 5432); err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO services (name, hostname, destination_type, ip, port) VALUES (?, ?, 'cidr', ?, ?)", "Subnet", "10.0.1.0/30:22", utils.IpToUint32("10.0.1.0"), 22); err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	now := time.Now()
+	snapshots := func() []grpcPkg.AgentSnapshot {
+		return []grpcPkg.AgentSnapshot{
+			{Agent: proto.PrimaryAgent, ReceivedAt: now, Sessions: []*proto.Session{
+				{SrcIp: utils.IpToUint32("192.0.2.1"), DstIp: utils.IpToUint32("10.0.0.5"), DstPort: 5432, TimeLeft: 42},
+				{SrcIp: utils.IpToUint32("192.0.2.2"), DstIp: utils.IpToUint32("10.0.0.9"), DstPort: 80, TimeLeft: 10},
+				// An address of the /30 other than its network address.
+				{SrcIp: utils.IpToUint32("192.0.2.1"), DstIp: utils.IpToUint32("10.0.1.2"), DstPort: 22, TimeLeft: 30},
+				{SrcIp: utils.IpToUint32("192.0.2.1"), DstIp: utils.IpToUint32("10.0.1.4"), DstPort: 22, TimeLeft: 30},
+			}},
+			// Same address as the service, but the service belongs to the primary agent.
+			{Agent: "zone-b", ReceivedAt: now.Add(-time.Minute), Sessions: []*proto.Session{
+				{SrcIp: utils.IpToUint32("192.0.2.3"), DstIp: utils.IpToUint32("10.0.0.5"), DstPort: 5432, TimeLeft: 5},
+			}},
+			{Agent: "zone-c"},
+			// Twenty seconds old, but the agent only pushes every ten.
+			{Agent: "zone-d", ReceivedAt: now.Add(-20 * time.Second), Interval: 10 * time.Second},
+		}
+	}
+	h := NewSessionHandler(snapshots, service.NewServiceService(svcRepo, service.ActivationConfig{}))
+
+	r := gin.New()
+	r.GET("/api/admin/sessions", h.GetAgentSessions)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/sessions", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp struct {
+		Agents []agentSessions `json:"agents"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Agents) != 4 {
+		t.Fatalf("Expected 4 agents, got %d", len(resp.Agents))
+	}
+
+	primary := resp.Agents[0]
+	if primary.Stale || primary.ReceivedAt == nil || len(primary.Sessions) != 4 {
+		t.Fatalf("Unexpected primary entry: %+v", primary)
+	}
+	if s := primary.Sessions[0]; s.ServiceName != "Database" || s.ServiceID == 0 || s.DstIP != "10.0.0.5" || s.DstPort != 5432 || s.TimeLeft != 42 || s.SrcIP != "192.0.2.1" {
+		t.Errorf("Expected the first session to map to Database, got %+v", s)
+	}
+	if s := primary.Sessions[1]; s.ServiceName != "" || s.ServiceID != 0 {
+		t.Errorf("Expected the unknown destination to stay unmapped, got %+v", s)
+	}
+	if s := primary.Sessions[2]; s.ServiceName != "Subnet" {
+		t.Errorf("Expected the session inside the /30 to map to Subnet, got %+v", s)
+	}
+	if s := primary.Sessions[3]; s.ServiceName != "" {
+		t.Errorf("Expected the session past the /30 to stay unmapped, got %+v", s)
+	}
+
+	zoneB := resp.Agents[1]
+	if !zoneB.Stale || zoneB.AgeSeconds < 60 {
+		t.Errorf("Expected zone-b to be stale, got %+v", zoneB)
+	}
+	if zoneB.Sessions[0].ServiceName != "" {
+		t.Errorf("Expected services to be matched per agent, got %+v", zoneB.Sessions[0])
+	}
+
+	zoneC := resp.Agents[2]
+	if !zoneC.Stale || zoneC.ReceivedAt != nil || zoneC.Sessions == nil || len(zoneC.Sessions) != 0 {
+		t.Errorf("Expected zone-c to be reported as never received, got %+v", zoneC)
+	}
+
+	zoneD := resp.Agents[3]
+	if zoneD.Stale || zoneD.PushIntervalSeconds != 10 {
+		t.Errorf("Expected zone-d to be judged by its observed push interval, got %+v", zoneD)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('alice', 'hashed', 3, 1), ('bob', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test users: %v", err)
+	}
+	services := []struct {
+		name, ip string
+		port     int
+		agent    string
+	}{
+		{"Database", "10.0.0.5", 5432, proto.PrimaryAgent}, // active and enforced
+		{"Web", "10.0.0.7", 80, proto.PrimaryAgent},        // active, not enforced
+		{"Cache", "10.0.0.6", 6379, "offline"},             // enforced, not active
+		{"Legacy", "10.0.0.8", 22, "zone-b"},               // active on a stale agent
+	}
+	ids := make(map[string]int)
+	for _, svc := range services {
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent) VALUES (?, ?, ?, ?, ?)",
+			svc.name, fmt.Sprintf("%s:%d", svc.ip, svc.port), utils.IpToUint32(svc.ip), svc.port, svc.agent)
+		if err != nil {
+			t.Fatalf("Failed to create service %s: %v", svc.name, err)
+		}
+		id, _ := res.LastInsertId()
+		ids[svc.name] = int(id)
+	}
+	// Active and enforced at an address of its /30 other than the network address.
+	res, err := db.Exec("INSERT INTO services (name, hostname, destination_type, ip, port) VALUES ('Subnet', '10.0.1.0/30:22', 'cidr', ?, 22)", utils.IpToUint32("10.0.1.0"))
+	if err != nil {
+		t.Fatalf("Failed to create service Subnet: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	ids["Subnet"] = int(id)
+	for _, active := range []struct {
+		user    string
+		service string
+	}{{"alice", "Database"}, {"bob", "Web"}, {"alice", "Legacy"}, {"bob", "Subnet"}} {
+		if _, err := db.Exec("INSERT INTO user_active_services (user_id, service_id, updated_at, time_left) SELECT id, ?, CURRENT_TIMESTAMP, 60 FROM users WHERE username = ?", ids[active.service], active.user); err != nil {
+			t.Fatalf("Failed to activate %s for %s: %v", active.service, active.user, err)
+		}
+	}
+
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	now := time.Now()
+	snapshots := func() []grpcPkg.AgentSnapshot {
+		return []grpcPkg.AgentSnapshot{
+			{Agent: proto.PrimaryAgent, ReceivedAt: now, Sessions: []*proto.Session{
+				{SrcIp: utils.IpToUint32("192.0.2.1"), DstIp: utils.IpToUint32("10.0.0.5"), DstPort: 5432, TimeLeft: 42},
+				{SrcIp: utils.IpToUint32("192.0.2.2"), DstIp: utils.IpToUint32("10.0.0.9"), DstPort: 80, TimeLeft: 10},
+				{SrcIp: utils.IpToUint32("192.0.2.4"), DstIp: utils.IpToUint32("10.0.1.3"), DstPort: 22, TimeLeft: 20},
+			}},
+			{Agent: "offline", ReceivedAt: now, Sessions: []*proto.Session{
+				{SrcIp: utils.IpToUint32("192.0.2.3"), DstIp: utils.IpToUint32("10.0.0.6"), DstPort: 6379, TimeLeft: 30},
+			}},
+			{Agent: "zone-b", ReceivedAt: now.Add(-time.Minute)},
+		}
+	}
+	h := NewSessionHandler(snapshots, service.NewServiceService(svcRepo, service.ActivationConfig{}))
+
+	r := gin.New()
+	r.GET("/api/admin/reconcile", h.GetReconcile)
+	r.POST("/api/admin/reconcile", h.Reconcile)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/reconcile", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report reconcileReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.CheckedAgents) != 2 || len(report.SkippedAgents) != 1 || report.SkippedAgents[0] != "zone-b" {
+		t.Errorf("Expected zone-b to be skipped and the rest checked, got %v / %v", report.CheckedAgents, report.SkippedAgents)
+	}
+	if len(report.AgentOnly) != 1 || report.AgentOnly[0].ServiceName != "Cache" || report.AgentOnly[0].Agent != "offline" || report.AgentOnly[0].SrcIP != "192.0.2.3" {
+		t.Errorf("Expected the Cache session to be agent-only, got %+v", report.AgentOnly)
+	}
+	if len(report.DBOnly) != 1 || report.DBOnly[0].ServiceName != "Web" || report.DBOnly[0].ServiceID != ids["Web"] {
+		t.Errorf("Expected Web to be database-only, got %+v", report.DBOnly)
+	}
+	if len(report.UnknownServices) != 1 || report.UnknownServices[0].DstIP != "10.0.0.9" {
+		t.Errorf("Expected the 10.0.0.9 session to be unknown, got %+v", report.UnknownServices)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/reconcile", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result reconcileResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	if result.DroppedRows != 1 || result.ClosedSessions != 0 || len(result.Errors) != 1 {
+		t.Errorf("Expected one dropped row and one failed close on the unreachable agent, got %+v", result)
+	}
+
+	var remaining int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_active_services WHERE service_id = ?", ids["Web"]).Scan(&remaining); err != nil {
+		t.Fatalf("Failed to count active services: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("Expected the Web row to be dropped, %d remain", remaining)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_active_services WHERE service_id IN (?, ?, ?)", ids["Database"], ids["Legacy"], ids["Subnet"]).Scan(&remaining); err != nil {
+		t.Fatalf("Failed to count active services: %v", err)
+	}
+	if remaining != 3 {
+		t.Errorf("Expected the enforced and skipped rows to be kept, %d remain", remaining)
+	}
+}
@@ -2,104 +2,18 @@ package handler
 
 import (
 	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/service"
 	"database/sql"
-	"path/filepath"
 	"testing"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-const testSchema = `
-CREATE TABLE IF NOT EXISTS roles (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	name TEXT NOT NULL UNIQUE,
-	description TEXT
-);
-CREATE TABLE IF NOT EXISTS users (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	username TEXT NOT NULL UNIQUE,
-	password TEXT,
-	role_id INTEGER NOT NULL DEFAULT 2,
-	is_active INTEGER NOT NULL DEFAULT 1,
-	provider TEXT DEFAULT 'local',
-	provider_id TEXT,
-	email TEXT,
-	FOREIGN KEY(role_id) REFERENCES roles(id)
-);
-CREATE TABLE IF NOT EXISTS services (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	name TEXT NOT NULL UNIQUE,
-	hostname TEXT NOT NULL,
-	ip INTEGER NOT NULL,
-	port INTEGER NOT NULL,
-	description TEXT,
-	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-);
-CREATE TABLE IF NOT EXISTS user_active_services (
-	user_id INTEGER NOT NULL,
-	service_id INTEGER NOT NULL,
-	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-	time_left INTEGER DEFAULT 60,
-	PRIMARY KEY(user_id, service_id),
-	FOREIGN KEY(user_id) REFERENCES users(id),
-	FOREIGN KEY(service_id) REFERENCES services(id)
-);
-CREATE TABLE IF NOT EXISTS role_services (
-	role_id INTEGER NOT NULL,
-	service_id INTEGER NOT NULL,
-	PRIMARY KEY(role_id, service_id),
-	FOREIGN KEY(role_id) REFERENCES roles(id),
-	FOREIGN KEY(service_id) REFERENCES services(id)
-);
-CREATE TABLE IF NOT EXISTS user_extra_services (
-	user_id INTEGER NOT NULL,
-	service_id INTEGER NOT NULL,
-	PRIMARY KEY(user_id, service_id),
-	FOREIGN KEY(user_id) REFERENCES users(id),
-	FOREIGN KEY(service_id) REFERENCES services(id)
-);
-CREATE TABLE IF NOT EXISTS refresh_tokens (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	token TEXT NOT NULL UNIQUE,
-	user_id INTEGER NOT NULL,
-	expires_at DATETIME NOT NULL,
-	FOREIGN KEY(user_id) REFERENCES users(id)
-);
-`
-
-// setupTestDB creates an isolated SQLite test database and returns the db and cleanup function.
+// setupTestDB creates an isolated SQLite test database with the production schema and returns the db and cleanup function.
 func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	t.Helper()
-	tempDir := t.TempDir()
-	testDBPath := filepath.Join(tempDir, "test_aegis.db")
-
-	db, err := sql.Open("sqlite3", testDBPath)
+	db, err := repository.SetupTestStmt(t.TempDir())
 	if err != nil {
-		t.Fatalf("Failed to open test database: %v", err)
-	}
-
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-
-	if _, err := db.Exec("PRAGMA foreign_keys = ON;"); err != nil {
-		t.Fatalf("Failed to enable foreign keys: %v", err)
+		t.Fatalf("Failed to set up test database: %v", err)
 	}
-
-	if _, err := db.Exec(testSchema); err != nil {
-		t.Fatalf("Failed to create schema: %v", err)
-	}
-
-	seedRoles := `INSERT OR IGNORE INTO roles (name, description) VALUES
-		('admin', 'Administrator with full access'),
-		('user', 'Standard user access'),
-		('root', 'Root access');`
-	if _, err := db.Exec(seedRoles); err != nil {
-		t.Fatalf("Failed to seed roles: %v", err)
-	}
-
-	// Set the global DB for watcher/grpc compatibility
-	repository.DB = db
-
 	return db, func() { _ = db.Close() }
 }
 
@@ -134,3 +48,17 @@ func createServiceRepo(t *testing.T, db *sql.DB) (repository.ServiceRepository,
 	t.Helper()
 	return repository.NewServiceRepository(db)
 }
+
+// newIntegrityHandler creates an IntegrityHandler over a test database.
+func newIntegrityHandler(t *testing.T, db *sql.DB) *IntegrityHandler {
+	t.Helper()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	integrityRepo, err := repository.NewIntegrityRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create integrity repo: %v", err)
+	}
+	return NewIntegrityHandler(service.NewIntegrityService(svcRepo, integrityRepo))
+}
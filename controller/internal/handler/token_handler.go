@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/service"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenHandler handles the current user's personal API tokens.
+type TokenHandler struct {
+	tokenSvc service.TokenService
+}
+
+// NewTokenHandler creates a new TokenHandler.
+func NewTokenHandler(tokenSvc service.TokenService) *TokenHandler {
+	return &TokenHandler{tokenSvc: tokenSvc}
+}
+
+type createTokenRequest struct {
+	Name          string `json:"name"`
+	Scope         string `json:"scope"`
+	ServiceIDs    []int  `json:"service_ids"`
+	ExpiresInDays int    `json:"expires_in_days"`
+}
+
+type createTokenResponse struct {
+	models.APIToken
+	Token string `json:"token"`
+}
+
+// rejectTokenAuth refuses token management from requests authenticated with an API token, so a
+// token can never be used to mint a longer-lived or wider-scoped one.
+func rejectTokenAuth(c *gin.Context) bool {
+	if _, ok := c.Get(middleware.TokenScopeKey); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API tokens cannot manage API tokens"})
+		return true
+	}
+	return false
+}
+
+// Create generates a new API token for the current user. The token is only returned here.
+func (h *TokenHandler) Create(c *gin.Context) {
+	if rejectTokenAuth(c) {
+		return
+	}
+	var req createTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+
+	username := c.GetString(middleware.UsernameKey)
+	token, secret, err := h.tokenSvc.Create(username, req.Name, req.Scope, req.ServiceIDs, req.ExpiresInDays)
+	if err != nil {
+		switch err.Error() {
+		case "token name is required":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token name is required"})
+		case "invalid token scope":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Scope must be 'read', 'full' or 'services'"})
+		case "service ids require the services scope":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "service_ids are only allowed with the 'services' scope"})
+		case "services scope requires service ids":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The 'services' scope requires service_ids"})
+		case "service not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		case "invalid token expiry":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must not be negative"})
+		case "user not found":
+			middleware.Unauthorized(c, true)
+		default:
+			log.Printf("[tokens] create failed for user '%s': %v", username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		}
+		return
+	}
+
+	if token.Scope == models.TokenScopeServices {
+		log.Printf("[tokens] user '%s' created api token '%s' (ID: %d, scope: %s, services: %v)", username, token.Name, token.Id, token.Scope, token.ServiceIDs)
+	} else {
+		log.Printf("[tokens] user '%s' created api token '%s' (ID: %d, scope: %s)", username, token.Name, token.Id, token.Scope)
+	}
+	c.JSON(http.StatusCreated, createTokenResponse{APIToken: *token, Token: secret})
+}
+
+// GetAll lists the current user's API tokens without the tokens themselves.
+func (h *TokenHandler) GetAll(c *gin.Context) {
+	if rejectTokenAuth(c) {
+		return
+	}
+	tokens, err := h.tokenSvc.List(c.GetString(middleware.UsernameKey))
+	if err != nil {
+		if err.Error() == "user not found" {
+			middleware.Unauthorized(c, true)
+			return
+		}
+		log.Printf("[tokens] list failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Delete revokes one of the current user's API tokens.
+func (h *TokenHandler) Delete(c *gin.Context) {
+	if rejectTokenAuth(c) {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	username := c.GetString(middleware.UsernameKey)
+	if err := h.tokenSvc.Delete(username, id); err != nil {
+		switch err.Error() {
+		case "token not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		case "user not found":
+			middleware.Unauthorized(c, true)
+		default:
+			log.Printf("[tokens] delete failed for user '%s': %v", username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
+		}
+		return
+	}
+
+	log.Printf("[tokens] user '%s' revoked api token %d", username, id)
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/service"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTokenTestRouter serves the token endpoints and two probes behind the real auth middleware.
+// Requests without a bearer token are authenticated as cookieUser.
+func newTokenTestRouter(t *testing.T, db *sql.DB, cookieUser string) *gin.Engine {
+	t.Helper()
+	userRepo, _ := createReposFromDB(t, db)
+	tokenRepo, err := repository.NewTokenRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create token repo: %v", err)
+	}
+	tokenSvc := service.NewTokenService(tokenRepo, userRepo)
+	h := NewTokenHandler(tokenSvc)
+	svcRepo, err := createServiceRepo(t, db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	svcHandler := NewServiceHandler(service.NewServiceService(svcRepo, service.ActivationConfig{}), userRepo)
+
+	auth := middleware.JWTAuth([]byte("k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"), nil, tokenSvc.Authenticate, nil)
+	withCookieUser := func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Set(middleware.UsernameKey, cookieUser)
+			c.Next()
+			return
+		}
+		auth(c)
+	}
+	probe := func(c *gin.Context) { c.String(http.StatusOK, c.GetString(middleware.UsernameKey)) }
+
+	r := gin.New()
+	me := r.Group("/api/me", withCookieUser)
+	me.GET("/tokens", h.GetAll)
+	me.POST("/tokens", h.Create)
+	me.DELETE("/tokens/:id", h.Delete)
+	me.GET("/services", svcHandler.GetMyServices)
+	me.POST("/selected", svcHandler.SelectActiveService)
+	me.DELETE("/selected/:svc_id", svcHandler.DeselectActiveService)
+	r.GET("/probe", auth, probe)
+	r.POST("/probe", auth, probe)
+	r.GET("/admin-probe", auth, middleware.RequireCapability(userRepo, models.CapManageUsers), probe)
+	return r
+}
+
+func createToken(t *testing.T, r *gin.Engine, body string) createTokenResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/tokens", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var resp createTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func bearerRequest(method, path, token string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestTokenEndpointsUserStatus(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	deleted := newTokenTestRouter(t, db, "deleted-user")
+	r := newTokenTestRouter(t, db, "root")
+
+	requests := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/me/tokens", ""},
+		{http.MethodPost, "/api/me/tokens", `{"name": "ci"}`},
+		{http.MethodDelete, "/api/me/tokens/1", ""},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		deleted.ServeHTTP(w, httptest.NewRequest(req.method, req.path, strings.NewReader(req.body)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected status %d for a user that no longer exists, got %d", req.method, req.path, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	_ = db.Close()
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(req.method, req.path, strings.NewReader(req.body)))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s: expected status %d when the database fails, got %d", req.method, req.path, http.StatusInternalServerError, w.Code)
+		}
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	r := newTokenTestRouter(t, db, "root")
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"Invalid JSON", "{", http.StatusBadRequest},
+		{"Missing name", `{"scope": "read"}`, http.StatusBadRequest},
+		{"Unknown scope", `{"name": "ci", "scope": "admin"}`, http.StatusBadRequest},
+		{"Negative expiry", `{"name": "ci", "expires_in_days": -1}`, http.StatusBadRequest},
+		{"Valid", `{"name": "ci", "scope": "read", "expires_in_days": 30}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/tokens", strings.NewReader(tt.body)))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	created := createToken(t, r, `{"name": "deploy"}`)
+	if !strings.HasPrefix(created.Token, "aegis_") || created.Scope != models.TokenScopeFull || created.ExpiresAt != nil {
+		t.Errorf("Unexpected token: %+v", created)
+	}
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE token_hash = ?", created.Token).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("Expected the token to be stored hashed, found %d plain copies (%v)", stored, err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/me/tokens", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Token) || strings.Contains(w.Body.String(), `"token"`) {
+		t.Fatalf("Expected a token list without secrets, got %d: %s", w.Code, w.Body.String())
+	}
+	var listed []models.APIToken
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 2 || listed[0].ExpiresAt == nil {
+		t.Errorf("Unexpected token list: %s", w.Body.String())
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES ('alice', 'x', 3)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	root := newTokenTestRouter(t, db, "root")
+	alice := newTokenTestRouter(t, db, "alice")
+
+	full := createToken(t, root, `{"name": "full"}`).Token
+	read := createToken(t, root, `{"name": "read", "scope": "read"}`).Token
+	userToken := createToken(t, alice, `{"name": "alice"}`).Token
+	expired := createToken(t, root, `{"name": "expired", "expires_in_days": 1}`)
+	if _, err := db.Exec("UPDATE api_tokens SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Hour), expired.Id); err != nil {
+		t.Fatalf("Failed to expire token: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"Full token", http.MethodPost, "/probe", full, http.StatusOK},
+		{"Read token GET", http.MethodGet, "/probe", read, http.StatusOK},
+		{"Read token POST", http.MethodPost, "/probe", read, http.StatusForbidden},
+		{"Unknown token", http.MethodGet, "/probe", "aegis_nope", http.StatusUnauthorized},
+		{"Expired token", http.MethodGet, "/probe", expired.Token, http.StatusUnauthorized},
+		{"Admin route with root token", http.MethodGet, "/admin-probe", full, http.StatusOK},
+		{"Admin route with user token", http.MethodGet, "/admin-probe", userToken, http.StatusForbidden},
+		{"Token managing tokens", http.MethodGet, "/api/me/tokens", full, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			root.ServeHTTP(w, bearerRequest(tt.method, tt.path, tt.token))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	var lastUsed sql.NullTime
+	if err := db.QueryRow("SELECT last_used_at FROM api_tokens WHERE name = 'full'").Scan(&lastUsed); err != nil || !lastUsed.Valid {
+		t.Errorf("Expected last_used_at to be recorded, got %v (%v)", lastUsed, err)
+	}
+
+	if _, err := db.Exec("UPDATE users SET is_active = 0 WHERE username = 'alice'"); err != nil {
+		t.Fatalf("Failed to deactivate user: %v", err)
+	}
+	w := httptest.NewRecorder()
+	root.ServeHTTP(w, bearerRequest(http.MethodGet, "/probe", userToken))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected tokens of inactive users to be rejected, got %d", w.Code)
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES ('alice', 'x', 3)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	root := newTokenTestRouter(t, db, "root")
+	alice := newTokenTestRouter(t, db, "alice")
+	created := createToken(t, root, `{"name": "ci"}`)
+
+	tests := []struct {
+		name           string
+		router         *gin.Engine
+		id             string
+		expectedStatus int
+	}{
+		{"Invalid ID", root, "abc", http.StatusBadRequest},
+		{"Another user's token", alice, fmt.Sprintf("%d", created.Id), http.StatusNotFound},
+		{"Own token", root, fmt.Sprintf("%d", created.Id), http.StatusOK},
+		{"Already revoked", root, fmt.Sprintf("%d", created.Id), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/me/tokens/"+tt.id, nil))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	root.ServeHTTP(w, bearerRequest(http.MethodGet, "/probe", created.Token))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestServiceScopedToken(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	res, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES ('alice', 'x', 3)")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	aliceID, _ := res.LastInsertId()
+	var svcIDs []int64
+	for i, name := range []string{"Deploy", "Database"} {
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, ?)", name, fmt.Sprintf("127.0.0.1:%d", 7000+i), 0x7F000001, 7000+i)
+		if err != nil {
+			t.Fatalf("Failed to create test service: %v", err)
+		}
+		id, _ := res.LastInsertId()
+		svcIDs = append(svcIDs, id)
+		// alice may use both services; the token is what limits her.
+		if _, err := db.Exec("INSERT INTO user_extra_services (user_id, service_id) VALUES (?, ?)", aliceID, id); err != nil {
+			t.Fatalf("Failed to grant test service: %v", err)
+		}
+	}
+	inScope, outOfScope := svcIDs[0], svcIDs[1]
+	r := newTokenTestRouter(t, db, "alice")
+
+	for _, tt := range []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"Services scope without services", `{"name": "ci", "scope": "services"}`, http.StatusBadRequest},
+		{"Services with another scope", fmt.Sprintf(`{"name": "ci", "scope": "read", "service_ids": [%d]}`, inScope), http.StatusBadRequest},
+		{"Unknown service", `{"name": "ci", "scope": "services", "service_ids": [999]}`, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/me/tokens", strings.NewReader(tt.body)))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	created := createToken(t, r, fmt.Sprintf(`{"name": "pipeline", "scope": "services", "service_ids": [%d, %d]}`, inScope, inScope))
+	if len(created.ServiceIDs) != 1 || created.ServiceIDs[0] != int(inScope) {
+		t.Fatalf("Expected the token to be limited to service %d, got %+v", inScope, created)
+	}
+
+	selectReq := func(svcID int64) *http.Request {
+		req := bearerRequest(http.MethodPost, "/api/me/selected", created.Token)
+		req.Body = io.NopCloser(strings.NewReader(fmt.Sprintf(`{"service_id": %d}`, svcID)))
+		return req
+	}
+	tests := []struct {
+		name      string
+		req       *http.Request
+		forbidden bool
+	}{
+		{"Activate out of scope", selectReq(outOfScope), true},
+		{"Deactivate out of scope", bearerRequest(http.MethodDelete, fmt.Sprintf("/api/me/selected/%d", outOfScope), created.Token), true},
+		{"Other endpoint", bearerRequest(http.MethodGet, "/api/me/services", created.Token), true},
+		{"Token management", bearerRequest(http.MethodGet, "/api/me/tokens", created.Token), true},
+		// No agent is running, so an in-scope activation fails later, but not on the scope check.
+		{"Activate in scope", selectReq(inScope), false},
+		{"Deactivate in scope", bearerRequest(http.MethodDelete, fmt.Sprintf("/api/me/selected/%d", inScope), created.Token), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, tt.req)
+			if got := w.Code == http.StatusForbidden; got != tt.forbidden {
+				t.Errorf("Expected forbidden=%v, got status %d: %s", tt.forbidden, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/me/tokens", nil))
+	if !strings.Contains(w.Body.String(), fmt.Sprintf(`"service_ids":[%d]`, inScope)) {
+		t.Errorf("Expected the token list to include the token's services, got %s", w.Body.String())
+	}
+}
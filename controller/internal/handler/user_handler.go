@@ -5,6 +5,7 @@ import (
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/service"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,17 +16,40 @@ import (
 // UserHandler handles user management endpoints.
 type UserHandler struct {
 	userSvc service.UserService
+	svcSvc  service.ServiceService
 }
 
 // NewUserHandler creates a new UserHandler.
-func NewUserHandler(userSvc service.UserService) *UserHandler {
-	return &UserHandler{userSvc: userSvc}
+func NewUserHandler(userSvc service.UserService, svcSvc service.ServiceService) *UserHandler {
+	return &UserHandler{userSvc: userSvc, svcSvc: svcSvc}
 }
 
-// GetAll returns all users.
+// GetAll returns all users, or one page of them when a limit or cursor is given.
 func (h *UserHandler) GetAll(c *gin.Context) {
-	users, err := h.userSvc.GetAll()
+	cursor, limit, paged, ok := pageRequest(c)
+	if !ok {
+		return
+	}
+	if paged {
+		users, next, err := h.userSvc.GetPage(c.Query("sort"), cursor, limit)
+		if err != nil {
+			if pageFailed(c, err) {
+				return
+			}
+			log.Printf("[users] get page failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+			return
+		}
+		c.JSON(http.StatusOK, pageBody("users", users, next))
+		return
+	}
+
+	users, err := h.userSvc.GetAll(c.Query("sort"))
 	if err != nil {
+		if err.Error() == "invalid sort key" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort key"})
+			return
+		}
 		log.Printf("[users] get all failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
 		return
@@ -34,7 +58,7 @@ func (h *UserHandler) GetAll(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
-// Create adds a new user.
+// Create adds a new user. Without a role_id the user gets the configured default role.
 func (h *UserHandler) Create(c *gin.Context) {
 	var newUser models.UserWithCredentials
 	if err := c.ShouldBindJSON(&newUser); err != nil {
@@ -43,19 +67,20 @@ func (h *UserHandler) Create(c *gin.Context) {
 		return
 	}
 
-	result, err := h.userSvc.Create(newUser.Credentials.Username, newUser.Credentials.Password, newUser.RoleId)
+	result, err := h.userSvc.Create(newUser.Credentials.Username, newUser.Credentials.Password, newUser.RoleId, newUser.Role)
 	if err != nil {
+		if validationFailed(c, err) {
+			return
+		}
 		msg := err.Error()
 		switch {
-		case msg == "invalid username format":
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username format"})
-		case msg == "role_id is required":
-			c.JSON(http.StatusBadRequest, gin.H{"error": "User role_id is required"})
+		case msg == "default role not found":
+			log.Printf("[users] create failed: default role no longer exists")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Default role not found"})
 		case msg == "username already exists":
 			c.JSON(http.StatusConflict, gin.H{"error": "Error creating user (name must be unique)"})
-		case strings.HasPrefix(msg, "password too weak"):
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password" + msg[len("password"):]})
 		default:
+			log.Printf("[users] create failed: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		}
 		return
@@ -101,15 +126,18 @@ func (h *UserHandler) UpdateRole(c *gin.Context) {
 	}
 
 	var req struct {
-		RoleId int `json:"role_id"`
+		RoleId int    `json:"role_id"`
+		Role   string `json:"role"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
 		return
 	}
-
 	requester := c.GetString(middleware.UsernameKey)
-	if err := h.userSvc.UpdateRole(id, req.RoleId, requester); err != nil {
+	if err := h.userSvc.UpdateRole(id, req.RoleId, req.Role, requester); err != nil {
+		if validationFailed(c, err) {
+			return
+		}
 		msg := err.Error()
 		switch msg {
 		case "user not found":
@@ -117,12 +145,13 @@ func (h *UserHandler) UpdateRole(c *gin.Context) {
 		case "forbidden: cannot modify root user":
 			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Cannot modify root user role"})
 		default:
+			log.Printf("[users] update role failed for user ID %d: %v", id, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user role"})
 		}
 		return
 	}
 
-	log.Printf("[users] updated role for user ID %d to role %d", id, req.RoleId)
+	log.Printf("[users] updated role for user ID %d (role_id %d, role %q)", id, req.RoleId, req.Role)
 	c.String(http.StatusOK, "User role updated successfully")
 }
 
@@ -197,11 +226,16 @@ func (h *UserHandler) AddService(c *gin.Context) {
 
 	requester := c.GetString(middleware.UsernameKey)
 	if err := h.userSvc.AddExtraService(userID, req.ServiceID, requester); err != nil {
-		msg := err.Error()
-		if msg == "forbidden: cannot modify root user" {
+		switch err.Error() {
+		case "forbidden: cannot modify root user":
 			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Cannot modify root user services"})
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to assign service to user (check if IDs exist)"})
+		case "user not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		case "service not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		default:
+			log.Printf("[users] add service failed for user %d and service %d: %v", userID, req.ServiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign service to user"})
 		}
 		return
 	}
@@ -210,7 +244,8 @@ func (h *UserHandler) AddService(c *gin.Context) {
 	c.String(http.StatusOK, "Service assigned to user successfully")
 }
 
-// RemoveService revokes an extra service from a user.
+// RemoveService revokes an extra service from a user. Revoking a service that is not assigned succeeds
+// unless ?strict=true is given, in which case it returns 404.
 func (h *UserHandler) RemoveService(c *gin.Context) {
 	userID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -225,7 +260,8 @@ func (h *UserHandler) RemoveService(c *gin.Context) {
 	}
 
 	requester := c.GetString(middleware.UsernameKey)
-	if err := h.userSvc.RemoveExtraService(userID, svcID, requester); err != nil {
+	removed, err := h.userSvc.RemoveExtraService(userID, svcID, requester)
+	if err != nil {
 		msg := err.Error()
 		if msg == "forbidden: cannot modify root user" {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Cannot modify root user services"})
@@ -235,6 +271,93 @@ func (h *UserHandler) RemoveService(c *gin.Context) {
 		return
 	}
 
+	if !removed {
+		log.Printf("[users] no assignment found for service %d and user %d", svcID, userID)
+		if c.Query("strict") == "true" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service is not assigned to user"})
+			return
+		}
+		c.String(http.StatusOK, "Service removed from user successfully")
+		return
+	}
+
 	log.Printf("[users] removed service %d from user %d", svcID, userID)
 	c.String(http.StatusOK, "Service removed from user successfully")
 }
+
+// ActivateService activates a service for a user on an admin's behalf, e.g. during incident response.
+// The agent is given client_ip from the body if set, otherwise the user's last login IP.
+func (h *UserHandler) ActivateService(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID in URL"})
+		return
+	}
+
+	var req struct {
+		ServiceID int    `json:"service_id"`
+		ClientIP  string `json:"client_ip"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+		return
+	}
+	if req.ClientIP != "" {
+		if ip := net.ParseIP(req.ClientIP); ip == nil || ip.To4() == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "client_ip must be an IPv4 address"})
+			return
+		}
+	}
+
+	requester := c.GetString(middleware.UsernameKey)
+	roleID, lastLoginIP, err := h.userSvc.ActivationTarget(userID, requester)
+	if err != nil {
+		switch err.Error() {
+		case "forbidden: cannot modify root user":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Cannot activate services for root user"})
+		case "user not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		case "account disabled":
+			c.JSON(http.StatusConflict, gin.H{"error": "User account is disabled"})
+		default:
+			log.Printf("[users] activate service failed for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate service for user"})
+		}
+		return
+	}
+
+	clientIP := req.ClientIP
+	if clientIP == "" {
+		clientIP = lastLoginIP
+	}
+	if clientIP == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No login IP recorded for user, client_ip is required"})
+		return
+	}
+
+	log.Printf("[audit] '%s' activating service ID %d for user ID %d from IP %s", requester, req.ServiceID, userID, clientIP)
+	queued, err := h.svcSvc.ActivateForUser(c.Request.Context(), userID, roleID, req.ServiceID, clientIP)
+	if err != nil && err.Error() == "already active" {
+		log.Printf("[audit] service ID %d for user ID %d was already being activated when '%s' activated it", req.ServiceID, userID, requester)
+		c.String(http.StatusOK, "Service already active for user")
+		return
+	}
+	if err != nil {
+		log.Printf("[audit] activation of service ID %d for user ID %d by '%s' failed: %v", req.ServiceID, userID, requester, err)
+		switch err.Error() {
+		case "forbidden: no access to this service":
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: User does not have access to this service"})
+		default:
+			activationFailed(c, err)
+		}
+		return
+	}
+	if queued {
+		log.Printf("[audit] activation of service ID %d for user ID %d by '%s' queued: agent unreachable", req.ServiceID, userID, requester)
+		c.JSON(http.StatusAccepted, gin.H{"status": models.ActiveServicePending, "message": "Agent unreachable, activation queued"})
+		return
+	}
+
+	log.Printf("[audit] '%s' activated service ID %d for user ID %d", requester, req.ServiceID, userID)
+	c.String(http.StatusOK, "Service set to active for user")
+}
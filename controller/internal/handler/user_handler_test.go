@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -24,9 +26,9 @@ func TestGetUsers(t *testing.T) {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.GET("/api/users", h.GetAll)
@@ -48,12 +50,94 @@ func TestGetUsers(t *testing.T) {
 	}
 }
 
+func TestGetUsersPaged(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	insert := func(name string) {
+		t.Helper()
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, 'x', 3, 1)", name); err != nil {
+			t.Fatalf("Failed to create test user: %v", err)
+		}
+	}
+	for i := range 7 {
+		insert(fmt.Sprintf("member%02d", i*2))
+	}
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	h := NewUserHandler(service.NewUserService(userRepo, roleRepo, "user"), nil)
+
+	r := gin.New()
+	r.GET("/api/users", h.GetAll)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users?"+query, nil))
+		return w
+	}
+
+	// Users are inserted on both sides of the cursor between fetches; none may repeat and every
+	// user present from the start must be returned.
+	seen := make(map[string]int)
+	query := "limit=3"
+	for page := 0; ; page++ {
+		w := get(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var body struct {
+			Users      []models.User `json:"users"`
+			NextCursor string        `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(body.Users) > 3 {
+			t.Fatalf("Expected at most 3 users per page, got %d", len(body.Users))
+		}
+		for _, u := range body.Users {
+			seen[u.Username]++
+		}
+		if body.NextCursor == "" {
+			break
+		}
+		insert(fmt.Sprintf("member%02da", page))
+		insert(fmt.Sprintf("aaa%02d", page))
+		query = "limit=3&cursor=" + body.NextCursor
+	}
+
+	for name, n := range seen {
+		if n > 1 {
+			t.Errorf("User %q returned %d times", name, n)
+		}
+	}
+	for _, name := range []string{"root", "member00", "member06", "member12"} {
+		if seen[name] != 1 {
+			t.Errorf("Expected user %q to be returned once, got %d", name, seen[name])
+		}
+	}
+
+	w := get("limit=2")
+	var first struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&first); err != nil || first.NextCursor == "" {
+		t.Fatalf("Expected a next_cursor, got %q (err %v)", first.NextCursor, err)
+	}
+	for _, query := range []string{"limit=0", "limit=1000", "limit=x", "cursor=bogus", "sort=-username&cursor=" + first.NextCursor} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
 func TestCreateUser(t *testing.T) {
-	userRepo, _, _, cleanup := setupTestRepos(t)
+	userRepo, _, roleRepo, cleanup := setupTestRepos(t)
 	defer cleanup()
 
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	// No default role, so role_id stays required.
+	userSvc := service.NewUserService(userRepo, roleRepo, "")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.POST("/api/users", h.Create)
@@ -122,6 +206,137 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestCreateUserDefaultRole(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	userRepo, roleRepo := createReposFromDB(t, db)
+
+	create := func(t *testing.T, defaultRole, username string, roleID int) *httptest.ResponseRecorder {
+		t.Helper()
+		r := gin.New()
+		r.POST("/api/users", NewUserHandler(service.NewUserService(userRepo, roleRepo, defaultRole), nil).Create)
+		body := mustMarshal(t, models.UserWithCredentials{
+			Credentials: models.Credentials{Username: username, Password: "ValidPass123!"},
+			RoleId:      roleID,
+		})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	roleOf := func(t *testing.T, w *httptest.ResponseRecorder) int {
+		t.Helper()
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var user models.UserWithCredentials
+		if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		var stored int
+		if err := db.QueryRow("SELECT role_id FROM users WHERE id = ?", user.Id).Scan(&stored); err != nil {
+			t.Fatalf("Failed to read stored role: %v", err)
+		}
+		if stored != user.RoleId {
+			t.Errorf("Response role %d does not match stored role %d", user.RoleId, stored)
+		}
+		return stored
+	}
+
+	t.Run("Omitted role_id uses the default role", func(t *testing.T) {
+		if got := roleOf(t, create(t, "user", "defaultuser", 0)); got != 3 {
+			t.Errorf("Expected the user role (3), got %d", got)
+		}
+	})
+	t.Run("Default role is configurable", func(t *testing.T) {
+		if got := roleOf(t, create(t, "admin", "defaultadmin", 0)); got != 2 {
+			t.Errorf("Expected the admin role (2), got %d", got)
+		}
+	})
+	t.Run("Explicit role_id is honored", func(t *testing.T) {
+		if got := roleOf(t, create(t, "user", "explicitadmin", 2)); got != 2 {
+			t.Errorf("Expected the requested admin role (2), got %d", got)
+		}
+	})
+	t.Run("Missing default role", func(t *testing.T) {
+		if w := create(t, "contractor", "orphanuser", 0); w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusInternalServerError, w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestCreateUserEmailUsernames(t *testing.T) {
+	userRepo, _, roleRepo, cleanup := setupTestRepos(t)
+	defer cleanup()
+	t.Cleanup(func() { _ = utils.SetUsernamePattern(utils.DefaultUsernamePattern) })
+
+	r := gin.New()
+	r.POST("/api/users", NewUserHandler(service.NewUserService(userRepo, roleRepo, "user"), nil).Create)
+	create := func(username string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewReader(mustMarshal(t, models.UserWithCredentials{
+			Credentials: models.Credentials{Username: username, Password: "ValidPass123!"},
+		})))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := create("alice.smith@example.com"); code != http.StatusBadRequest {
+		t.Errorf("Expected the default pattern to reject an email username, got %d", code)
+	}
+	if err := utils.SetUsernamePattern(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`); err != nil {
+		t.Fatalf("SetUsernamePattern failed: %v", err)
+	}
+	if code := create("alice.smith@example.com"); code != http.StatusCreated {
+		t.Errorf("Expected an email username to be accepted, got %d", code)
+	}
+	if code := create("alice_smith"); code != http.StatusBadRequest {
+		t.Errorf("Expected a plain username to be rejected by the email pattern, got %d", code)
+	}
+}
+
+func TestUserValidationReportsAllErrors(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('targetuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userRepo, roleRepo := createReposFromDB(t, db)
+	targetID, _ := userRepo.GetIDByUsername("targetuser")
+	h := NewUserHandler(service.NewUserService(userRepo, roleRepo, ""), nil)
+
+	r := gin.New()
+	r.POST("/api/users", h.Create)
+	r.PUT("/api/users/:id/role", func(c *gin.Context) { c.Set(middleware.UsernameKey, "adminuser") }, h.UpdateRole)
+	send := func(method, path string, payload any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Create with every field invalid", func(t *testing.T) {
+		w := send(http.MethodPost, "/api/users", models.UserWithCredentials{
+			Credentials: models.Credentials{Username: "ab", Password: "weak"},
+			Role:        "contractor",
+		})
+		expectFieldErrors(t, w, "username", "password", "role")
+	})
+	t.Run("Create without a role", func(t *testing.T) {
+		w := send(http.MethodPost, "/api/users", models.UserWithCredentials{
+			Credentials: models.Credentials{Username: "ab", Password: "ValidPass123!"},
+		})
+		expectFieldErrors(t, w, "username", "role_id")
+	})
+	t.Run("Update role with an unknown name", func(t *testing.T) {
+		w := send(http.MethodPut, fmt.Sprintf("/api/users/%d/role", targetID), map[string]string{"role": "contractor"})
+		expectFieldErrors(t, w, "role")
+	})
+}
+
 func TestCreateUserDuplicate(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -131,9 +346,9 @@ func TestCreateUserDuplicate(t *testing.T) {
 		t.Fatalf("Failed to create test user: %v", err)
 	}
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.POST("/api/users", h.Create)
@@ -164,9 +379,9 @@ func TestDeleteUser(t *testing.T) {
 	}
 	userID, _ := result.LastInsertId()
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.DELETE("/api/users/:id", func(c *gin.Context) {
@@ -207,9 +422,9 @@ func TestUpdateUserRole(t *testing.T) {
 	}
 	userID, _ := result.LastInsertId()
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.PUT("/api/users/:id/role", func(c *gin.Context) {
@@ -243,6 +458,165 @@ func TestUpdateUserRole(t *testing.T) {
 	}
 }
 
+func TestPrivilegeChangesRevokeTokens(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	password := "TestPass123!"
+	hashedPassword, _ := utils.HashPassword(password)
+	result, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES (?, ?, 3, 1)", "revokeduser", hashedPassword)
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	userID, _ := result.LastInsertId()
+
+	userRepo, roleRepo := createReposFromDB(t, db)
+	key := []byte("test-secret-key")
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{JWTKey: key, TokenLifetime: time.Hour})
+	h := NewUserHandler(service.NewUserService(userRepo, roleRepo, "user"), nil)
+
+	r := gin.New()
+	setAdmin := func(c *gin.Context) { c.Set(middleware.UsernameKey, "adminuser") }
+	r.PUT("/api/users/:id/role", setAdmin, h.UpdateRole)
+	r.PUT("/api/users/:id/password", setAdmin, h.ResetPassword)
+	r.GET("/probe", middleware.JWTAuth(key, nil, nil, &middleware.AccountCheck{Lookup: userRepo.GetAuthState, DisabledStatus: http.StatusUnauthorized}), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	login := func() string {
+		res, err := authSvc.Login("revokeduser", password, "192.0.2.10")
+		if err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		return res.TokenString
+	}
+	probe := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	admin := func(path string, body any) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/users/%d/%s", userID, path), bytes.NewReader(mustMarshal(t, body)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: expected status %d, got %d: %s", path, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	token := login()
+	if got := probe(token); got != http.StatusOK {
+		t.Fatalf("Expected status %d before the role change, got %d", http.StatusOK, got)
+	}
+	// Setting the role the user already has changes nothing.
+	admin("role", map[string]int{"role_id": 3})
+	if got := probe(token); got != http.StatusOK {
+		t.Errorf("Expected status %d after setting the same role, got %d", http.StatusOK, got)
+	}
+	admin("role", map[string]int{"role_id": 2})
+	if got := probe(token); got != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a token issued before the role change, got %d", http.StatusUnauthorized, got)
+	}
+
+	token = login()
+	if got := probe(token); got != http.StatusOK {
+		t.Fatalf("Expected status %d for a token issued after the role change, got %d", http.StatusOK, got)
+	}
+	password = "NewPass456!"
+	admin("password", map[string]string{"password": password})
+	if got := probe(token); got != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a token issued before the password reset, got %d", http.StatusUnauthorized, got)
+	}
+	if got := probe(login()); got != http.StatusOK {
+		t.Errorf("Expected status %d for a token issued after the password reset, got %d", http.StatusOK, got)
+	}
+}
+
+func TestUserRoleByName(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	userRepo, roleRepo := createReposFromDB(t, db)
+	h := NewUserHandler(service.NewUserService(userRepo, roleRepo, ""), nil)
+
+	r := gin.New()
+	r.POST("/api/users", h.Create)
+	r.PUT("/api/users/:id/role", func(c *gin.Context) { c.Set(middleware.UsernameKey, "adminuser") }, h.UpdateRole)
+	send := func(t *testing.T, method, path string, payload any) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(mustMarshal(t, payload)))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	storedRole := func(t *testing.T, username string) int {
+		t.Helper()
+		var roleID int
+		if err := db.QueryRow("SELECT role_id FROM users WHERE username = ?", username).Scan(&roleID); err != nil {
+			t.Fatalf("Failed to read role of %s: %v", username, err)
+		}
+		return roleID
+	}
+	credentials := func(username string) models.Credentials {
+		return models.Credentials{Username: username, Password: "ValidPass123!"}
+	}
+
+	createTests := []struct {
+		name       string
+		payload    models.UserWithCredentials
+		wantStatus int
+		wantRole   int
+	}{
+		{"By name", models.UserWithCredentials{Credentials: credentials("bynameuser"), Role: "admin"}, http.StatusCreated, 2},
+		{"By ID", models.UserWithCredentials{Credentials: credentials("byiduser"), RoleId: 3}, http.StatusCreated, 3},
+		{"ID takes precedence", models.UserWithCredentials{Credentials: credentials("bothuser"), RoleId: 3, Role: "admin"}, http.StatusCreated, 3},
+		{"Unknown name", models.UserWithCredentials{Credentials: credentials("unknownuser"), Role: "contractor"}, http.StatusBadRequest, 0},
+	}
+	for _, tt := range createTests {
+		t.Run("Create "+tt.name, func(t *testing.T) {
+			w := send(t, http.MethodPost, "/api/users", tt.payload)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantRole != 0 {
+				if got := storedRole(t, tt.payload.Credentials.Username); got != tt.wantRole {
+					t.Errorf("Expected role %d, got %d", tt.wantRole, got)
+				}
+			}
+		})
+	}
+
+	userID, err := userRepo.GetIDByUsername("byiduser")
+	if err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+	path := fmt.Sprintf("/api/users/%d/role", userID)
+	updateTests := []struct {
+		name       string
+		payload    map[string]any
+		wantStatus int
+		wantRole   int
+	}{
+		{"By name", map[string]any{"role": "admin"}, http.StatusOK, 2},
+		{"By ID", map[string]any{"role_id": 3}, http.StatusOK, 3},
+		{"ID takes precedence", map[string]any{"role_id": 2, "role": "user"}, http.StatusOK, 2},
+		{"Unknown name", map[string]any{"role": "contractor"}, http.StatusBadRequest, 2},
+		{"Neither given", map[string]any{}, http.StatusBadRequest, 2},
+	}
+	for _, tt := range updateTests {
+		t.Run("Update "+tt.name, func(t *testing.T) {
+			w := send(t, http.MethodPut, path, tt.payload)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := storedRole(t, "byiduser"); got != tt.wantRole {
+				t.Errorf("Expected role %d, got %d", tt.wantRole, got)
+			}
+		})
+	}
+}
+
 func TestGetUserServices(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -258,9 +632,9 @@ func TestGetUserServices(t *testing.T) {
 		t.Fatalf("Failed to assign service to user: %v", err)
 	}
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.GET("/api/users/:id/services", h.GetServices)
@@ -298,9 +672,9 @@ func TestAddUserService(t *testing.T) {
 	svcResult, _ := db.Exec("INSERT INTO services (name, hostname, ip, port, description) VALUES (?, ?, ?, ?, ?)", "AddSvc", "localhost:8080", 0x7F000001, 8080, "Add service")
 	svcID, _ := svcResult.LastInsertId()
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.POST("/api/users/:id/services", func(c *gin.Context) {
@@ -312,9 +686,13 @@ func TestAddUserService(t *testing.T) {
 		userID         string
 		serviceID      int
 		expectedStatus int
+		expectedError  string
 	}{
-		{"Successful service addition", fmt.Sprintf("%d", userID), int(svcID), http.StatusOK},
-		{"Invalid user ID", "invalid", int(svcID), http.StatusBadRequest},
+		{"Successful service addition", fmt.Sprintf("%d", userID), int(svcID), http.StatusOK, ""},
+		{"Invalid user ID", "invalid", int(svcID), http.StatusBadRequest, ""},
+		{"Missing user", "9999", int(svcID), http.StatusNotFound, "User not found"},
+		{"Missing service", fmt.Sprintf("%d", userID), 9999, http.StatusNotFound, "Service not found"},
+		{"Missing user and service", "9999", 9999, http.StatusNotFound, "User not found"},
 	}
 
 	for _, tt := range tests {
@@ -329,6 +707,9 @@ func TestAddUserService(t *testing.T) {
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
 			}
+			if tt.expectedError != "" && !strings.Contains(w.Body.String(), tt.expectedError) {
+				t.Errorf("Expected error %q, got %s", tt.expectedError, w.Body.String())
+			}
 		})
 	}
 }
@@ -348,9 +729,9 @@ func TestRemoveUserService(t *testing.T) {
 		t.Fatalf("Failed to link service to user: %v", err)
 	}
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
 
 	r := gin.New()
 	r.DELETE("/api/users/:id/services/:svc_id", func(c *gin.Context) {
@@ -361,17 +742,20 @@ func TestRemoveUserService(t *testing.T) {
 		name           string
 		userID         string
 		serviceID      string
+		query          string
 		expectedStatus int
 	}{
-		{"Successful service removal", fmt.Sprintf("%d", userID), fmt.Sprintf("%d", svcID), http.StatusOK},
-		{"Invalid user ID", "invalid", fmt.Sprintf("%d", svcID), http.StatusBadRequest},
-		{"Invalid service ID", fmt.Sprintf("%d", userID), "invalid", http.StatusBadRequest},
+		{"Successful service removal", fmt.Sprintf("%d", userID), fmt.Sprintf("%d", svcID), "", http.StatusOK},
+		{"Repeated removal is idempotent", fmt.Sprintf("%d", userID), fmt.Sprintf("%d", svcID), "", http.StatusOK},
+		{"Repeated strict removal", fmt.Sprintf("%d", userID), fmt.Sprintf("%d", svcID), "?strict=true", http.StatusNotFound},
+		{"Invalid user ID", "invalid", fmt.Sprintf("%d", svcID), "", http.StatusBadRequest},
+		{"Invalid service ID", fmt.Sprintf("%d", userID), "invalid", "", http.StatusBadRequest},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := httptest.NewRequest(http.MethodDelete, "/api/users/"+tt.userID+"/services/"+tt.serviceID, nil)
+			req := httptest.NewRequest(http.MethodDelete, "/api/users/"+tt.userID+"/services/"+tt.serviceID+tt.query, nil)
 			r.ServeHTTP(w, req)
 
 			if w.Code != tt.expectedStatus {
@@ -392,14 +776,21 @@ func TestResetUserPassword(t *testing.T) {
 	}
 	userID, _ := result.LastInsertId()
 
-	userRepo, _ := createReposFromDB(t, db)
-	userSvc := service.NewUserService(userRepo)
-	h := NewUserHandler(userSvc)
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userSvc := service.NewUserService(userRepo, roleRepo, "user")
+	h := NewUserHandler(userSvc, nil)
+
+	authSvc := service.NewAuthService(userRepo, service.AuthConfig{JWTKey: []byte("test-secret-key"), TokenLifetime: time.Hour})
+	session, err := authSvc.Login("resetuser", "TestPass123!", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
 
 	r := gin.New()
 	r.POST("/api/users/:id/reset-password", func(c *gin.Context) {
 		c.Set(middleware.UsernameKey, "adminuser")
 	}, h.ResetPassword)
+	r.POST("/api/auth/refresh", NewAuthHandler(authSvc).RefreshToken)
 
 	tests := []struct {
 		name           string
@@ -427,4 +818,104 @@ func TestResetUserPassword(t *testing.T) {
 			}
 		})
 	}
+
+	// A refresh cookie from before the reset no longer yields access tokens.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: session.RefreshToken})
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a refresh token issued before the reset, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+}
+
+func TestActivateServiceForUser(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	initUnreachableAgent(t, "offline")
+
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('adminuser', 'hashed', 2, 1), ('incidentuser', 'hashed', 3, 1)"); err != nil {
+		t.Fatalf("Failed to create test users: %v", err)
+	}
+	userRepo, roleRepo := createReposFromDB(t, db)
+	userID, _ := userRepo.GetIDByUsername("incidentuser")
+
+	// Granted and StepUp are granted to the user role; Restricted is not. Step-up does not apply to admins.
+	svcIDs := map[string]int64{}
+	for _, name := range []string{"Granted", "StepUp", "Restricted"} {
+		res, err := db.Exec("INSERT INTO services (name, hostname, ip, port, agent, requires_step_up) VALUES (?, '10.9.0.3:22', ?, 22, 'offline', ?)", name, 0x0A090003, name == "StepUp")
+		if err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+		svcIDs[name], _ = res.LastInsertId()
+	}
+	for _, name := range []string{"Granted", "StepUp"} {
+		if _, err := db.Exec("INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", svcIDs[name]); err != nil {
+			t.Fatalf("Failed to grant service: %v", err)
+		}
+	}
+
+	svcRepo, _ := createServiceRepo(t, db)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{Queue: true, TTL: time.Minute})
+	h := NewUserHandler(service.NewUserService(userRepo, roleRepo, "user"), svcSvc)
+	r := gin.New()
+	r.POST("/api/users/:id/selected", func(c *gin.Context) { c.Set(middleware.UsernameKey, "adminuser") }, h.ActivateService)
+
+	activate := func(userID string, body map[string]any) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/users/"+userID+"/selected", bytes.NewReader(mustMarshal(t, body))))
+		return w
+	}
+	queuedIP := func(svcID int64) string {
+		pending, err := svcRepo.GetPendingActivations()
+		if err != nil {
+			t.Fatalf("GetPendingActivations failed: %v", err)
+		}
+		for _, p := range pending {
+			if p.UserID == userID && p.ServiceID == int(svcID) {
+				return p.ClientIP
+			}
+		}
+		return ""
+	}
+	target := fmt.Sprintf("%d", userID)
+
+	tests := []struct {
+		name   string
+		userID string
+		body   map[string]any
+		want   int
+	}{
+		{"Root user", "1", map[string]any{"service_id": svcIDs["Granted"], "client_ip": "192.0.2.10"}, http.StatusForbidden},
+		{"Missing user", "9999", map[string]any{"service_id": svcIDs["Granted"], "client_ip": "192.0.2.10"}, http.StatusNotFound},
+		{"No known IP", target, map[string]any{"service_id": svcIDs["Granted"]}, http.StatusBadRequest},
+		{"Invalid client IP", target, map[string]any{"service_id": svcIDs["Granted"], "client_ip": "fd00::1"}, http.StatusBadRequest},
+		{"Service not granted", target, map[string]any{"service_id": svcIDs["Restricted"], "client_ip": "192.0.2.10"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := activate(tt.userID, tt.body); w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// A supplied IP is used for the agent call.
+	if w := activate(target, map[string]any{"service_id": svcIDs["StepUp"], "client_ip": "192.0.2.10"}); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if ip := queuedIP(svcIDs["StepUp"]); ip != "192.0.2.10" {
+		t.Errorf("Expected the supplied IP to be queued, got %q", ip)
+	}
+
+	// Without one, the user's last login IP is used.
+	if err := userRepo.SetLastLoginIP(userID, "198.51.100.7"); err != nil {
+		t.Fatalf("SetLastLoginIP failed: %v", err)
+	}
+	if w := activate(target, map[string]any{"service_id": svcIDs["Granted"]}); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if ip := queuedIP(svcIDs["Granted"]); ip != "198.51.100.7" {
+		t.Errorf("Expected the last login IP to be queued, got %q", ip)
+	}
 }
@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"Aegis/controller/internal/service"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validationFailed writes 400 with the per-field messages and reports true if err is a
+// service.ValidationError.
+func validationFailed(c *gin.Context, err error) bool {
+	var verr service.ValidationError
+	if !errors.As(err, &verr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "errors": verr})
+	return true
+}
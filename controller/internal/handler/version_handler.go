@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BuildInfo identifies the running controller build and the schema version of its database.
+type BuildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	BuildDate     string `json:"build_date"`
+	SchemaVersion string `json:"schema_version"`
+}
+
+// VersionHandler reports which controller build is running.
+type VersionHandler struct {
+	info BuildInfo
+}
+
+// NewVersionHandler creates a new VersionHandler.
+func NewVersionHandler(info BuildInfo) *VersionHandler {
+	return &VersionHandler{info: info}
+}
+
+// Get returns the build information. It is public, so it carries nothing beyond what identifies
+// the build.
+func (h *VersionHandler) Get(c *gin.Context) {
+	c.JSON(http.StatusOK, h.info)
+}
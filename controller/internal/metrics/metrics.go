@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Collector writes its metrics in the Prometheus text exposition format.
+type Collector func(w io.Writer)
+
+// Sample is a single metric value with optional labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+var (
+	mu         sync.RWMutex
+	collectors = make(map[string]Collector)
+)
+
+// Register adds a named collector, replacing any collector registered under the same name.
+func Register(name string, c Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+	collectors[name] = c
+}
+
+// Write renders all registered collectors in name order.
+func Write(w io.Writer) {
+	mu.RLock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ordered := make([]Collector, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, collectors[name])
+	}
+	mu.RUnlock()
+
+	for _, c := range ordered {
+		c(w)
+	}
+}
+
+// Handler serves all registered metrics.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		Write(c.Writer)
+	}
+}
+
+// WriteMetric writes one metric family with HELP and TYPE lines.
+func WriteMetric(w io.Writer, name, kind, help string, samples ...Sample) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		_, _ = fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(s.Labels), s.Value)
+	}
+}
+
+// formatLabels renders labels as {k="v",...} with keys in sorted order.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteMetric(t *testing.T) {
+	var buf bytes.Buffer
+	WriteMetric(&buf, "aegis_test_total", "counter", "Test counter.",
+		Sample{Labels: map[string]string{"statement": "users.GetAll", "a": `q"x`}, Value: 3},
+		Sample{Value: 1.5},
+	)
+
+	want := "# HELP aegis_test_total Test counter.\n" +
+		"# TYPE aegis_test_total counter\n" +
+		`aegis_test_total{a="q\"x",statement="users.GetAll"} 3` + "\n" +
+		"aegis_test_total 1.5\n"
+	if buf.String() != want {
+		t.Errorf("WriteMetric output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHandlerRendersCollectorsInOrder(t *testing.T) {
+	Register("zz_second", func(w io.Writer) { WriteMetric(w, "aegis_second", "gauge", "Second.", Sample{Value: 2}) })
+	Register("aa_first", func(w io.Writer) { WriteMetric(w, "aegis_first", "gauge", "First.", Sample{Value: 1}) })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/metrics", Handler())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	first, second := strings.Index(body, "aegis_first 1"), strings.Index(body, "aegis_second 2")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("Expected both metrics in collector name order, got:\n%s", body)
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// AccountFunc returns whether the account of username is enabled and its token generation, which is
+// raised whenever tokens issued to the user must stop working. It returns sql.ErrNoRows for an unknown
+// user.
+type AccountFunc func(username string) (active bool, generation int64, err error)
+
+// AccountCheck makes JWTAuth refuse session cookies whose account changed after they were issued.
+// Cookies of a disabled user are answered with DisabledStatus, 401 or 403; cookies of a user who no
+// longer exists, or carrying an older token generation than the account, with 401.
+type AccountCheck struct {
+	Lookup AccountFunc
+	// TTL is how long an answer of Lookup is reused for a user, so the check costs a query per user
+	// per TTL rather than per request. Zero or less looks the account up on every request.
+	TTL            time.Duration
+	DisabledStatus int
+}
+
+type accountEntry struct {
+	active     bool
+	generation int64
+	checked    time.Time
+}
+
+// accountCache reuses the answers of lookup for ttl.
+type accountCache struct {
+	lookup AccountFunc
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]accountEntry
+}
+
+func newAccountCache(lookup AccountFunc, ttl time.Duration) *accountCache {
+	return &accountCache{lookup: lookup, ttl: ttl, entries: make(map[string]accountEntry)}
+}
+
+// get returns the state of username's account. A cached answer is only reused while it is younger
+// than ttl and knows of minGeneration, so a token issued after a revocation is not refused because the
+// cache still holds the generation before it.
+func (a *accountCache) get(username string, minGeneration int64) (bool, int64, error) {
+	if a.ttl <= 0 {
+		return a.lookup(username)
+	}
+	now := time.Now()
+	a.mu.Lock()
+	e, ok := a.entries[username]
+	a.mu.Unlock()
+	if ok && now.Sub(e.checked) < a.ttl && e.generation >= minGeneration {
+		return e.active, e.generation, nil
+	}
+
+	active, generation, err := a.lookup(username)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		delete(a.entries, username)
+		return false, 0, err
+	}
+	// Drop the answers that have gone stale, so users who stopped calling do not pile up.
+	for name, e := range a.entries {
+		if now.Sub(e.checked) >= a.ttl {
+			delete(a.entries, name)
+		}
+	}
+	a.entries[username] = accountEntry{active: active, generation: generation, checked: now}
+	return active, generation, nil
+}
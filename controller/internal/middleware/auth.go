@@ -1,10 +1,15 @@
 package middleware
 
 import (
+	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/utils"
-	"crypto/rsa"
+	"database/sql"
+	"errors"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,34 +17,165 @@ import (
 // Gin context key to store the username.
 const UsernameKey = "username"
 
-// JWTAuth validates the JWT token cookie and sets the username in Gin context.
-func JWTAuth(jwtKey []byte, publicKey *rsa.PublicKey) gin.HandlerFunc {
+// Gin context key to store the scope of the API token a request was authenticated with.
+// It is unset for requests authenticated with the session cookie.
+const TokenScopeKey = "token_scope"
+
+// Gin context key to store the service IDs a services-scoped API token is limited to.
+const TokenServicesKey = "token_services"
+
+// Gin context key to store when the user last authenticated, as a time.Time. It is unset for
+// requests authenticated with an API token and for session tokens issued without an auth_time.
+const AuthTimeKey = "auth_time"
+
+// bearerChallenge is the WWW-Authenticate challenge of 401 responses to requests made with an
+// Authorization header.
+const bearerChallenge = `Bearer realm="aegis"`
+
+// Unauthorized aborts with 401. Requests that carried an Authorization header are API clients and
+// get a Bearer challenge, with error="invalid_token" when invalidToken is set; cookie requests from
+// the UI get the plain JSON error they redirect to the login page on.
+func Unauthorized(c *gin.Context, invalidToken bool) {
+	if c.GetHeader("Authorization") != "" {
+		challenge := bearerChallenge
+		if invalidToken {
+			challenge += `, error="invalid_token"`
+		}
+		c.Header("WWW-Authenticate", challenge)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+}
+
+// serviceTokenRoutes are the only routes a services-scoped token may call.
+var serviceTokenRoutes = map[string]bool{
+	http.MethodPost + " /api/me/selected":           true,
+	http.MethodDelete + " /api/me/selected/:svc_id": true,
+}
+
+// TokenAuthFunc resolves a personal API token to what it grants.
+type TokenAuthFunc func(token string) (*models.TokenGrant, error)
+
+// JWTAuth validates the JWT token cookie and sets the username in Gin context. The cookie is verified
+// with RS256 or ES256 against publicKeys when any are given, and with HS256 against jwtKey otherwise. When
+// tokens is not nil, an "Authorization: Bearer" personal API token is accepted instead of the cookie.
+// Role checks still apply to the token's owner, read tokens are limited to GET and HEAD requests, and
+// services tokens to activating and deactivating their services.
+//
+// When accounts is not nil, a valid cookie is also checked against the account it was issued for, see
+// AccountCheck. API tokens of disabled users are already refused by tokens.
+func JWTAuth(jwtKey []byte, publicKeys utils.KeySet, tokens TokenAuthFunc, accounts *AccountCheck) gin.HandlerFunc {
+	var cache *accountCache
+	if accounts != nil {
+		cache = newAccountCache(accounts.Lookup, accounts.TTL)
+	}
 	return func(c *gin.Context) {
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && tokens != nil {
+			grant, err := tokens(strings.TrimSpace(bearer))
+			if err != nil {
+				log.Printf("[middleware] auth failed: api token invalid - %v", err)
+				Unauthorized(c, true)
+				return
+			}
+			c.Set(UsernameKey, grant.Username)
+			c.Set(TokenScopeKey, grant.Scope)
+			if grant.Scope == models.TokenScopeServices {
+				c.Set(TokenServicesKey, grant.ServiceIDs)
+			}
+			if !tokenAllowsRequest(c, grant) {
+				log.Printf("[middleware] auth denied: %s api token of user '%s' used for %s %s", grant.Scope, grant.Username, c.Request.Method, c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request"})
+				return
+			}
+			c.Next()
+			return
+		}
+
 		cookie, err := c.Cookie("token")
 		if err != nil {
 			log.Printf("[middleware] auth failed: missing token cookie: %v", err)
+			if c.GetHeader("Authorization") != "" {
+				Unauthorized(c, false)
+				return
+			}
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication cookie missing"})
 			return
 		}
 
-		var username string
-		if publicKey != nil {
-			username, err = utils.GetUsernameFromTokenRS256(cookie, publicKey)
+		var claims *models.Claims
+		if len(publicKeys) > 0 {
+			claims, err = utils.ParseTokenWithKeys(cookie, publicKeys)
 		} else {
-			username, err = utils.GetUsernameFromToken(cookie, jwtKey)
+			claims, err = utils.ParseToken(cookie, jwtKey)
 		}
 
 		if err != nil {
 			log.Printf("[middleware] auth failed: token invalid - %v", err)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			Unauthorized(c, false)
 			return
 		}
 
-		c.Set(UsernameKey, username)
+		if cache != nil {
+			active, generation, err := cache.get(claims.Username, claims.TokenGeneration)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				log.Printf("[middleware] auth failed: user '%s' no longer exists", claims.Username)
+				Unauthorized(c, true)
+				return
+			case err != nil:
+				log.Printf("[middleware] auth failed: cannot check the account of user '%s': %v", claims.Username, err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				return
+			case !active:
+				log.Printf("[middleware] auth denied: user '%s' is disabled", claims.Username)
+				c.AbortWithStatusJSON(accounts.DisabledStatus, gin.H{"error": "Account is disabled"})
+				return
+			case claims.TokenGeneration != generation:
+				log.Printf("[middleware] auth failed: token of user '%s' was revoked (generation %d, current %d)", claims.Username, claims.TokenGeneration, generation)
+				Unauthorized(c, true)
+				return
+			}
+		}
+
+		c.Set(UsernameKey, claims.Username)
+		if claims.AuthTime != nil {
+			c.Set(AuthTimeKey, claims.AuthTime.Time)
+		}
 		c.Next()
 	}
 }
 
+// tokenAllowsRequest reports whether grant's scope covers the request. For services tokens a service ID
+// in the path is checked here; handlers check IDs in the body with TokenAllowsService.
+func tokenAllowsRequest(c *gin.Context, grant *models.TokenGrant) bool {
+	switch grant.Scope {
+	case models.TokenScopeFull:
+		return true
+	case models.TokenScopeRead:
+		return c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+	case models.TokenScopeServices:
+		if !serviceTokenRoutes[c.Request.Method+" "+c.FullPath()] {
+			return false
+		}
+		if p := c.Param("svc_id"); p != "" {
+			id, err := strconv.Atoi(p)
+			return err == nil && slices.Contains(grant.ServiceIDs, id)
+		}
+		return true
+	}
+	return false
+}
+
+// TokenAllowsService reports whether the request may act on serviceID. It is always true unless the
+// request was authenticated with a services-scoped token that does not list serviceID.
+func TokenAllowsService(c *gin.Context, serviceID int) bool {
+	v, ok := c.Get(TokenServicesKey)
+	if !ok {
+		return true
+	}
+	ids, _ := v.([]int)
+	return slices.Contains(ids, serviceID)
+}
+
 // SecurityHeaders adds security HTTP headers to all responses.
 func SecurityHeaders() gin.HandlerFunc {
 	return func(c *gin.Context) {
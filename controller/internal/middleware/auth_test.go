@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTAuthChallenge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	key := []byte("test-secret-key")
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &models.Claims{
+		Username:         "alice",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}).SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	tokens := func(token string) (*models.TokenGrant, error) {
+		if token != "aegis_valid" {
+			return nil, fmt.Errorf("token not found")
+		}
+		return &models.TokenGrant{Username: "alice", Scope: models.TokenScopeFull}, nil
+	}
+
+	r := gin.New()
+	r.GET("/probe", JWTAuth(key, nil, tokens, nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{"Valid bearer token", "Bearer aegis_valid", "", http.StatusOK, ""},
+		{"Invalid bearer token", "Bearer aegis_nope", "", http.StatusUnauthorized, `Bearer realm="aegis", error="invalid_token"`},
+		{"Other authorization scheme", "Basic YWxpY2U6cHc=", "", http.StatusUnauthorized, `Bearer realm="aegis"`},
+		{"Valid cookie", "", cookie, http.StatusOK, ""},
+		{"Invalid cookie", "", "garbage", http.StatusUnauthorized, ""},
+		{"No credentials", "", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("Expected WWW-Authenticate %q, got %q", tt.wantChallenge, got)
+			}
+		})
+	}
+}
+
+func TestJWTAuthRejectsAlgorithmConfusion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	jwtKey := []byte("test-secret-key")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	claims := &models.Claims{
+		Username:         "mallory",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}
+	sign := func(method jwt.SigningMethod, key any, kid bool) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, claims)
+		if kid {
+			token.Header["kid"] = utils.KeyID(&rsaKey.PublicKey)
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return s
+	}
+
+	r := gin.New()
+	r.GET("/probe", JWTAuth(jwtKey, utils.NewKeySet(&rsaKey.PublicKey), nil, nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name       string
+		cookie     string
+		wantStatus int
+	}{
+		{"RS256 token", sign(jwt.SigningMethodRS256, rsaKey, true), http.StatusOK},
+		{"HS256 forged with the public key PEM", sign(jwt.SigningMethodHS256, publicPEM, true), http.StatusUnauthorized},
+		{"HS256 forged with the public key DER", sign(jwt.SigningMethodHS256, der, false), http.StatusUnauthorized},
+		{"HS256 signed with the configured secret", sign(jwt.SigningMethodHS256, jwtKey, false), http.StatusUnauthorized},
+		{"Unsigned token", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, true), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+			req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestJWTAuthChecksAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	res, err := db.Exec("INSERT INTO users (username, password, role_id, is_active) VALUES ('alice', 'x', 3, 1)")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	aliceID, _ := res.LastInsertId()
+	userRepo, err := repository.NewUserRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create user repo: %v", err)
+	}
+
+	key := []byte("test-secret-key")
+	cookie := func(username string, generation int64) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &models.Claims{
+			Username:         username,
+			TokenGeneration:  generation,
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		}).SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+	probe := func(r *gin.Engine, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	newRouter := func(lookup AccountFunc, ttl time.Duration, status int) *gin.Engine {
+		r := gin.New()
+		r.GET("/probe", JWTAuth(key, nil, nil, &AccountCheck{Lookup: lookup, TTL: ttl, DisabledStatus: status}), func(c *gin.Context) { c.Status(http.StatusOK) })
+		return r
+	}
+	setActive := func(active bool) {
+		if _, err := db.Exec("UPDATE users SET is_active = ? WHERE username = 'alice'", active); err != nil {
+			t.Fatalf("Failed to update user: %v", err)
+		}
+	}
+
+	// Without caching, a session stops working on the request after the user is disabled.
+	r := newRouter(userRepo.GetAuthState, 0, http.StatusUnauthorized)
+	if got := probe(r, cookie("alice", 0)); got != http.StatusOK {
+		t.Fatalf("Expected status %d for an active user, got %d", http.StatusOK, got)
+	}
+	setActive(false)
+	if got := probe(r, cookie("alice", 1)); got != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a disabled user, got %d", http.StatusUnauthorized, got)
+	}
+	if got := probe(newRouter(userRepo.GetAuthState, 0, http.StatusForbidden), cookie("alice", 1)); got != http.StatusForbidden {
+		t.Errorf("Expected the configured status %d for a disabled user, got %d", http.StatusForbidden, got)
+	}
+	if got := probe(r, cookie("mallory", 0)); got != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a deleted user, got %d", http.StatusUnauthorized, got)
+	}
+
+	// Disabling the account raised its generation, so re-enabling it does not revive older tokens.
+	setActive(true)
+	if got := probe(r, cookie("alice", 0)); got != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a token of a stale generation, got %d", http.StatusUnauthorized, got)
+	}
+	if got := probe(r, cookie("alice", 1)); got != http.StatusOK {
+		t.Errorf("Expected status %d for a token of the current generation, got %d", http.StatusOK, got)
+	}
+
+	// A cached answer is reused until it is TTL old, unless a token is newer than it.
+	var lookups int
+	counted := func(username string) (bool, int64, error) {
+		lookups++
+		return userRepo.GetAuthState(username)
+	}
+	r = newRouter(counted, 50*time.Millisecond, http.StatusUnauthorized)
+	if got := probe(r, cookie("alice", 1)); got != http.StatusOK {
+		t.Fatalf("Expected status %d for an active user, got %d", http.StatusOK, got)
+	}
+	if _, err := userRepo.UpdateRole(int(aliceID), 2); err != nil {
+		t.Fatalf("UpdateRole failed: %v", err)
+	}
+	if got := probe(r, cookie("alice", 1)); got != http.StatusOK || lookups != 1 {
+		t.Errorf("Expected the cached answer within the TTL, got status %d after %d lookups", got, lookups)
+	}
+	if got := probe(r, cookie("alice", 2)); got != http.StatusOK || lookups != 2 {
+		t.Errorf("Expected a token issued after the role change to be looked up, got status %d after %d lookups", got, lookups)
+	}
+	if got := probe(r, cookie("alice", 1)); got != http.StatusUnauthorized || lookups != 2 {
+		t.Errorf("Expected the token issued before the role change to be refused, got status %d after %d lookups", got, lookups)
+	}
+	setActive(false)
+	time.Sleep(60 * time.Millisecond)
+	if got := probe(r, cookie("alice", 2)); got != http.StatusUnauthorized || lookups != 3 {
+		t.Errorf("Expected the user to be looked up again after the TTL, got status %d after %d lookups", got, lookups)
+	}
+}
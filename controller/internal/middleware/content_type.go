@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireJSON rejects POST, PUT and PATCH requests whose body is not declared as application/json
+// with 415, so a form-encoded body is not reported as malformed JSON. Requests without a body, and
+// other methods such as the query-based OIDC callback, pass unchecked.
+func RequireJSON() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength == 0 {
+			c.Next()
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type")); err != nil || mediaType != "application/json" {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/json"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequireJSON())
+	r.Any("/probe", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"JSON body", http.MethodPost, "application/json", `{"a":1}`, http.StatusOK},
+		{"JSON with charset", http.MethodPut, "application/json; charset=utf-8", `{"a":1}`, http.StatusOK},
+		{"Form-encoded body", http.MethodPost, "application/x-www-form-urlencoded", "a=1", http.StatusUnsupportedMediaType},
+		{"Plain text body", http.MethodPatch, "text/plain", `{"a":1}`, http.StatusUnsupportedMediaType},
+		{"Body without content type", http.MethodPost, "", `{"a":1}`, http.StatusUnsupportedMediaType},
+		{"POST without body", http.MethodPost, "", "", http.StatusOK},
+		{"DELETE ignores content type", http.MethodDelete, "text/plain", "x", http.StatusOK},
+		{"GET with query", http.MethodGet, "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/probe?state=x", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
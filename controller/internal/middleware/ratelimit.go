@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"Aegis/controller/internal/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitSweep is how often limiters that have refilled are dropped, so the set of limiters does not
+// grow with every user or address ever seen.
+const rateLimitSweep = 10 * time.Minute
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimit allows each user burst requests at once and one more every interval after that, and
+// answers requests over the limit with 429 and a Retry-After header. Requests are counted per user
+// when an auth middleware ran before it, and per client IP otherwise.
+func RateLimit(interval time.Duration, burst int) gin.HandlerFunc {
+	var (
+		mu        sync.Mutex
+		limiters  = make(map[string]*limiterEntry)
+		lastSweep = time.Now()
+	)
+	// A limiter idle for this long has refilled completely and is the same as a new one.
+	idle := interval * time.Duration(burst)
+
+	return func(c *gin.Context) {
+		key := "ip:" + utils.GetClientIP(c.Request)
+		if username := c.GetString(UsernameKey); username != "" {
+			key = "user:" + username
+		}
+
+		now := time.Now()
+		mu.Lock()
+		if now.Sub(lastSweep) >= rateLimitSweep {
+			for k, e := range limiters {
+				if now.Sub(e.lastSeen) >= idle {
+					delete(limiters, k)
+				}
+			}
+			lastSweep = now
+		}
+		entry, ok := limiters[key]
+		if !ok {
+			entry = &limiterEntry{limiter: rate.NewLimiter(rate.Every(interval), burst)}
+			limiters[key] = entry
+		}
+		entry.lastSeen = now
+		reservation := entry.limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if delay > 0 {
+			reservation.CancelAt(now)
+		}
+		mu.Unlock()
+
+		if delay > 0 {
+			log.Printf("[middleware] rate limit exceeded for %s on %s %s", key, c.Request.Method, c.FullPath())
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
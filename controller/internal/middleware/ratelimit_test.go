@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if u := c.GetHeader("X-User"); u != "" {
+			c.Set(UsernameKey, u)
+		}
+	}, RateLimit(time.Hour, 2))
+	r.POST("/probe", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/probe", nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := range 2 {
+		if w := do("alice"); w.Code != http.StatusOK {
+			t.Fatalf("Request %d within burst: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	w := do("alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Request over burst: expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Expected Retry-After 3600, got %q", got)
+	}
+	// A rejected request does not use up a token, so the wait does not grow with retries.
+	if got := do("alice").Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Expected Retry-After to stay 3600 after a rejected retry, got %q", got)
+	}
+
+	if w := do("bob"); w.Code != http.StatusOK {
+		t.Errorf("Other user: expected 200, got %d", w.Code)
+	}
+}
@@ -2,14 +2,26 @@ package middleware
 
 import (
 	"Aegis/controller/internal/repository"
+	"database/sql"
+	"errors"
 	"log"
 	"net/http"
+	"slices"
 
 	"github.com/gin-gonic/gin"
 )
 
-// RequireRole enforces role based access control.
-func RequireRole(repo repository.UserRepository, roles ...string) gin.HandlerFunc {
+// CapabilitiesKey is the context key under which RequireCapability stores the capabilities of the
+// user's role.
+const CapabilitiesKey = "capabilities"
+
+// HasCapability reports whether held contains any of caps.
+func HasCapability(held []string, caps ...string) bool {
+	return slices.ContainsFunc(caps, func(c string) bool { return slices.Contains(held, c) })
+}
+
+// RequireCapability lets a request through if the user's role holds any of caps.
+func RequireCapability(repo repository.UserRepository, caps ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		username, exists := c.Get(UsernameKey)
 		if !exists {
@@ -18,21 +30,25 @@ func RequireRole(repo repository.UserRepository, roles ...string) gin.HandlerFun
 			return
 		}
 
-		roleName, err := repo.GetRoleNameByUsername(username.(string))
+		held, err := repo.GetCapabilitiesByUsername(username.(string))
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[middleware] rbac: user '%s' no longer exists", username)
+			Unauthorized(c, true)
+			return
+		}
 		if err != nil {
-			log.Printf("[middleware] rbac: failed to get role for user '%s': %v", username, err)
+			log.Printf("[middleware] rbac: failed to get capabilities for user '%s': %v", username, err)
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 			return
 		}
 
-		for _, r := range roles {
-			if roleName == r {
-				c.Next()
-				return
-			}
+		if HasCapability(held, caps...) {
+			c.Set(CapabilitiesKey, held)
+			c.Next()
+			return
 		}
 
-		log.Printf("[middleware] rbac: access denied for user '%s' (role: %s)", username, roleName)
+		log.Printf("[middleware] rbac: access denied for user '%s' (needs one of %v)", username, caps)
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 	}
 }
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireCapability(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	roleRepo, err := repository.NewRoleRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create role repo: %v", err)
+	}
+	reviewerID, err := roleRepo.Create("reviewer", "", nil, []string{models.CapViewSessions, models.CapExportPolicy})
+	if err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+	var auditorID int64
+	if err := db.QueryRow("SELECT id FROM roles WHERE name = 'auditor'").Scan(&auditorID); err != nil {
+		t.Fatalf("Expected the built-in auditor role to be seeded: %v", err)
+	}
+	for _, u := range []struct {
+		name   string
+		roleID int64
+	}{{"admin-user", 2}, {"plain-user", 3}, {"reviewer-user", reviewerID}, {"auditor-user", auditorID}} {
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES (?, 'x', ?)", u.name, u.roleID); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	userRepo, err := repository.NewUserRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create user repo: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		caps     []string
+		want     int
+	}{
+		{"root", []string{models.CapManageRoles}, http.StatusOK},
+		{"root", []string{models.CapImportPolicy}, http.StatusOK},
+		{"admin-user", []string{models.CapManageUsers}, http.StatusOK},
+		{"admin-user", []string{models.CapManageRoles}, http.StatusForbidden},
+		{"admin-user", []string{models.CapImportPolicy}, http.StatusForbidden},
+		{"admin-user", []string{models.CapManageRoles, models.CapManageServices}, http.StatusOK},
+		{"plain-user", []string{models.CapManageUsers}, http.StatusForbidden},
+		{"plain-user", []string{models.CapViewSessions}, http.StatusForbidden},
+		{"reviewer-user", []string{models.CapViewSessions}, http.StatusOK},
+		{"reviewer-user", []string{models.CapManageUsers}, http.StatusForbidden},
+		{"auditor-user", []string{models.CapManageUsers, models.CapViewManagement}, http.StatusOK},
+		{"auditor-user", []string{models.CapViewSessions}, http.StatusOK},
+		{"auditor-user", []string{models.CapManageUsers}, http.StatusForbidden},
+		{"auditor-user", []string{models.CapManageServices}, http.StatusForbidden},
+		{"auditor-user", []string{models.CapExportPolicy}, http.StatusForbidden},
+		{"unknown-user", []string{models.CapManageUsers}, http.StatusUnauthorized},
+	}
+	probe := func(username string, caps ...string) int {
+		r := gin.New()
+		r.GET("/probe", func(c *gin.Context) {
+			c.Set(UsernameKey, username)
+		}, RequireCapability(userRepo, caps...), func(c *gin.Context) {
+			if !HasCapability(c.GetStringSlice(CapabilitiesKey), caps...) {
+				t.Errorf("Expected the user's capabilities in the context, got %v", c.GetStringSlice(CapabilitiesKey))
+			}
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/probe", nil))
+		return w.Code
+	}
+	for _, tt := range tests {
+		t.Run(tt.username+" "+tt.caps[0], func(t *testing.T) {
+			if code := probe(tt.username, tt.caps...); code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, code)
+			}
+		})
+	}
+
+	// A failing lookup is an internal error, not a denial.
+	_ = db.Close()
+	if code := probe("root", models.CapManageUsers); code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d when the database fails, got %d", http.StatusInternalServerError, code)
+	}
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fingerprintRE matches asset names carrying a content hash, e.g. app.3f2a9c1b.js.
+var fingerprintRE = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[A-Za-z0-9]+$`)
+
+// compressibleTypes lists content type prefixes worth compressing.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"image/svg+xml",
+}
+
+// StaticCacheHeaders sets Cache-Control and a weak ETag for static files.
+// Fingerprinted assets are cached for a year, everything else (including HTML) must revalidate.
+func StaticCacheHeaders(staticDir, urlPrefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := c.Request.URL.Path
+		if fingerprintRE.MatchString(path.Base(p)) {
+			c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			c.Header("Cache-Control", "no-cache")
+		}
+
+		if rel, ok := strings.CutPrefix(p, urlPrefix); ok {
+			file := filepath.Join(staticDir, filepath.FromSlash(path.Clean("/"+rel)))
+			if info, err := os.Stat(file); err == nil && !info.IsDir() {
+				c.Header("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+			}
+		}
+		c.Next()
+	}
+}
+
+// StaticCompression compresses text responses with gzip or deflate when the client accepts it.
+// It is meant for static assets only; authenticated API responses must not go through it.
+func StaticCompression() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		// Byte ranges refer to the uncompressed file, so serve the full body instead.
+		c.Request.Header.Del("Range")
+
+		cw := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = cw
+		defer cw.close()
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter decides on the first write whether the response is compressible.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	decided  bool
+	writer   io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	w.decide(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// decide enables compression for successful responses with a compressible content type.
+func (w *compressWriter) decide(code int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || !isCompressible(h.Get("Content-Type")) {
+		return
+	}
+
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	if w.encoding == "gzip" {
+		w.writer = gzip.NewWriter(w.ResponseWriter)
+	} else {
+		w.writer, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+	}
+}
+
+func (w *compressWriter) close() {
+	if w.writer != nil {
+		_ = w.writer.Close()
+	}
+}
+
+// isCompressible reports whether a content type is text-like.
+func isCompressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newStaticRouter serves a temp dir under /static with both asset middlewares.
+func newStaticRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.js":          strings.Repeat("console.log('aegis');\n", 50),
+		"app.3f2a9c1b.js": "console.log('fingerprinted');",
+		"index.html":      "<html><body>dashboard</body></html>",
+		"logo.png":        "\x89PNG\r\n\x1a\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	r := gin.New()
+	static := r.Group("/static", StaticCacheHeaders(dir, "/static"), StaticCompression())
+	static.StaticFS("", http.Dir(dir))
+	r.GET("/api/data", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"secret": "value"})
+	})
+	return r
+}
+
+func TestStaticCompression(t *testing.T) {
+	r := newStaticRouter(t)
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"Gzip advertised", "/static/app.js", "gzip, deflate, br", "gzip"},
+		{"Only deflate advertised", "/static/app.js", "deflate", "deflate"},
+		{"Gzip refused with q=0", "/static/app.js", "gzip;q=0, deflate", "deflate"},
+		{"No encoding advertised", "/static/app.js", "", ""},
+		{"Binary asset not compressed", "/static/logo.png", "gzip", ""},
+		{"API response not compressed", "/api/data", "gzip", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding: got %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestStaticCompressionBody(t *testing.T) {
+	r := newStaticRouter(t)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Length") != "" {
+		t.Errorf("Expected Content-Length to be dropped, got %q", w.Header().Get("Content-Length"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Response is not valid gzip: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Failed to read gzip body: %v", err)
+	}
+	if !strings.HasPrefix(string(body), "console.log('aegis');") {
+		t.Errorf("Unexpected decompressed body: %q", string(body)[:30])
+	}
+}
+
+func TestStaticCacheHeaders(t *testing.T) {
+	r := newStaticRouter(t)
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCache string
+	}{
+		{"Fingerprinted asset", "/static/app.3f2a9c1b.js", "public, max-age=31536000, immutable"},
+		{"Plain asset", "/static/app.js", "no-cache"},
+		{"HTML page", "/static/index.html", "no-cache"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if got := w.Header().Get("Cache-Control"); got != tt.wantCache {
+				t.Errorf("Cache-Control: got %q, want %q", got, tt.wantCache)
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Error("Expected an ETag header")
+			}
+		})
+	}
+}
+
+func TestStaticETagRevalidation(t *testing.T) {
+	r := newStaticRouter(t)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+	req.Header.Set("If-None-Match", etag)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected empty body for 304, got %d bytes", w.Body.Len())
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingStartsSpanPerRequest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Tracing())
+	var handlerSpan trace.SpanContext
+	r.GET("/api/services/:id", func(c *gin.Context) {
+		handlerSpan = trace.SpanContextFromContext(c.Request.Context())
+		c.Status(http.StatusOK)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/services/1", nil))
+	req := httptest.NewRequest(http.MethodGet, "/api/services/2", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected one span per request, got %d", len(spans))
+	}
+	if spans[0].Name() != "GET /api/services/:id" || spans[0].SpanKind() != trace.SpanKindServer {
+		t.Errorf("expected a server span named after the route, got %q (%v)", spans[0].Name(), spans[0].SpanKind())
+	}
+	if spans[0].Parent().IsValid() {
+		t.Errorf("expected a request without traceparent to start a new trace, got parent %v", spans[0].Parent())
+	}
+	if got := spans[1].SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the incoming trace to be continued, got trace %s", got)
+	}
+	if handlerSpan.SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("expected the handler's context to carry the request span")
+	}
+	if spans[2].Name() != "GET unmatched" {
+		t.Errorf("expected unmatched paths to share one span name, got %q", spans[2].Name())
+	}
+}
@@ -0,0 +1,18 @@
+package models
+
+// Orphan is a row referring to a row that no longer exists, e.g. a role link to a deleted service
+// left behind while foreign keys were off, as reported by PRAGMA foreign_key_check.
+type Orphan struct {
+	Table  string `json:"table"`
+	RowID  int64  `json:"rowid"`
+	Parent string `json:"parent"` // table the missing row belonged to
+	// Removable orphans are deleted by the cleanup. Users are never deleted; they need a new role.
+	Removable bool   `json:"removable"`
+	Repair    string `json:"repair"`
+}
+
+// IntegrityReport lists malformed service values and dangling references found in the database.
+type IntegrityReport struct {
+	Services []ServiceIssue `json:"services"`
+	Orphans  []Orphan       `json:"orphans"`
+}
@@ -0,0 +1,57 @@
+package models
+
+// PolicyVersion is the format version of PolicyDocument.
+const PolicyVersion = 1
+
+// PolicyDocument is the exported access model: roles, services and who may reach which service.
+// Entries reference each other by name so a document can be applied to another database.
+// It never contains users' credentials.
+type PolicyDocument struct {
+	Version      int                 `json:"version"`
+	Roles        []PolicyRole        `json:"roles"`
+	Services     []PolicyService     `json:"services"`
+	RoleServices []PolicyRoleService `json:"role_services"`
+	UserServices []PolicyUserService `json:"user_services"`
+}
+
+type PolicyRole struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type PolicyService struct {
+	Name        string `json:"name"`
+	Hostname    string `json:"hostname"`
+	Description string `json:"description"`
+	Agent       string `json:"agent,omitempty"`
+}
+
+// PolicyRoleService links a service to a role.
+type PolicyRoleService struct {
+	Role    string `json:"role"`
+	Service string `json:"service"`
+}
+
+// PolicyUserService grants a user an extra service. The user must already exist.
+type PolicyUserService struct {
+	User    string `json:"user"`
+	Service string `json:"service"`
+}
+
+// PolicyChanges lists the entries an import created, updated or found already up to date.
+type PolicyChanges struct {
+	Created   []string `json:"created,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Unchanged []string `json:"unchanged,omitempty"`
+}
+
+// PolicyReport describes the outcome of an import. Nothing is applied when Conflicts is not empty.
+type PolicyReport struct {
+	DryRun       bool          `json:"dry_run"`
+	Applied      bool          `json:"applied"`
+	Roles        PolicyChanges `json:"roles"`
+	Services     PolicyChanges `json:"services"`
+	RoleServices PolicyChanges `json:"role_services"`
+	UserServices PolicyChanges `json:"user_services"`
+	Conflicts    []string      `json:"conflicts,omitempty"`
+}
@@ -1,7 +1,46 @@
 package models
 
+import "slices"
+
 type Role struct {
-	Name        string `json:"name"`
-	Id          int    `json:"id"`
-	Description string `json:"description"`
+	Name         string   `json:"name"`
+	Id           int      `json:"id"`
+	Description  string   `json:"description"`
+	Capabilities []string `json:"capabilities"`
+	MaxTTL       *int     `json:"max_ttl"` // seconds a session of the role's users may stay idle; nil for no limit
+}
+
+// RootRoleName is the built-in role of the root account. Its capabilities cannot be changed.
+const RootRoleName = "root"
+
+// Capabilities a role can hold. Management endpoints are guarded by capability, not by role name.
+// CapManageRoles is held by the root role only and cannot be granted. CapViewManagement admits a role
+// to the read-only management endpoints without any of the manage capabilities. CapOverrideSourceIP
+// lets a user choose the source IP their own selections are enforced for.
+const (
+	CapManageUsers      = "manage_users"
+	CapManageRoles      = "manage_roles"
+	CapManageServices   = "manage_services"
+	CapViewManagement   = "view_management"
+	CapViewSessions     = "view_sessions"
+	CapExportPolicy     = "export_policy"
+	CapImportPolicy     = "import_policy"
+	CapOverrideSourceIP = "override_source_ip"
+)
+
+// AllCapabilities lists every capability.
+var AllCapabilities = []string{
+	CapManageUsers,
+	CapManageRoles,
+	CapManageServices,
+	CapViewManagement,
+	CapViewSessions,
+	CapExportPolicy,
+	CapImportPolicy,
+	CapOverrideSourceIP,
+}
+
+// IsCapability reports whether name is a known capability.
+func IsCapability(name string) bool {
+	return slices.Contains(AllCapabilities, name)
 }
@@ -3,17 +3,103 @@ package models
 import "time"
 
 type Service struct {
-	Name        string    `json:"name"`
-	Id          int       `json:"id"`
-	Description string    `json:"description"`
-	Hostname    string    `json:"hostname"`
-	Ip          uint32    `json:"ip"` // network byte order
-	Port        uint16    `json:"port"`
-	CreatedAt   time.Time `json:"created_at"`
+	Name           string    `json:"name"`
+	Id             int       `json:"id"`
+	Description    string    `json:"description"`
+	Hostname       string    `json:"hostname"`
+	DestType       string    `json:"destination_type"` // DestinationHost, or DestinationCIDR for a "network/bits:port" Hostname
+	Ip             uint32    `json:"ip"`               // network byte order; the network address of a CIDR service
+	PrefixLen      int       `json:"-"`                // network bits of a CIDR service, set where it is enforced
+	Port           uint16    `json:"port"`
+	PortRangeEnd   uint16    `json:"port_range_end,omitempty"` // last port of a range starting at Port; 0 for Port alone
+	Agent          string    `json:"agent,omitempty"`          // name of the agent enforcing this service
+	RequiresStepUp bool      `json:"requires_step_up"`         // activation needs a recent re-authentication
+	Container      string    `json:"container,omitempty"`      // Docker container bound to the service, by ID or name
+	CreatedAt      time.Time `json:"created_at"`
+	Unassigned     bool      `json:"unassigned,omitempty"` // granted to no role or user, so nobody can reach it; set in admin listings only
 }
 
+// Destination types of a Service.
+const (
+	// DestinationHost is a single address, resolved from a hostname or given as an IP.
+	DestinationHost = "host"
+	// DestinationCIDR is every address of an IPv4 network.
+	DestinationCIDR = "cidr"
+)
+
+// MaxPortRangePorts bounds the rules a service covers, counting every port of its range at every
+// address of its network, since agents hold one rule per address and port.
+const MaxPortRangePorts = 256
+
+// Addresses returns the number of destination addresses of the service: the size of its network
+// for a CIDR service and 1 otherwise.
+func (s Service) Addresses() int {
+	if s.DestType == DestinationCIDR && s.PrefixLen >= 0 && s.PrefixLen < 32 {
+		return 1 << (32 - s.PrefixLen)
+	}
+	return 1
+}
+
+// LastPort returns the last port of the service's range, which is Port for a single-port service.
+func (s Service) LastPort() uint16 {
+	if s.PortRangeEnd > s.Port {
+		return s.PortRangeEnd
+	}
+	return s.Port
+}
+
+// Session time_left values are whole seconds until the agent drops the rule, as reported in
+// proto.Session.TimeLeft. A selected service starts with SessionTimeLeft, which matches the agent's
+// default rule_timeout_ns of 60s, and is overwritten by the agent's value on every session sync.
+const (
+	SessionTimeLeft = 60
+	// MaxSessionTimeLeft bounds the time_left values accepted from an agent.
+	MaxSessionTimeLeft = 24 * 60 * 60
+)
+
+// SessionTTL returns how long, in seconds, a session of a user whose role has maxTTL (nil for no
+// limit) may stay idle: the shorter of SessionTimeLeft and maxTTL, so the role's limit wins. ttlSeconds
+// is what to send the agent with the session, 0 unless the role shortened it so that the agent's own
+// rule_timeout_ns keeps applying otherwise.
+func SessionTTL(maxTTL *int) (timeLeft int, ttlSeconds uint32) {
+	if maxTTL != nil && *maxTTL < SessionTimeLeft {
+		return *maxTTL, uint32(*maxTTL)
+	}
+	return SessionTimeLeft, 0
+}
+
+// ServiceRef identifies a service without its address, for listings that only need to name it.
+type ServiceRef struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Statuses of an ActiveService.
+const (
+	ActiveServiceActive = "active"
+	// ActiveServicePending marks a selection queued while its agent was unreachable.
+	ActiveServicePending = "pending"
+)
+
 type ActiveService struct {
 	Service
-	TimeLeft  int       `json:"time_left"`
+	Status    string    `json:"status"`
+	TimeLeft  int       `json:"time_left"` // seconds remaining as last reported by the agent at UpdatedAt
 	UpdatedAt time.Time `json:"updated_at"`
+	// RemainingSeconds is TimeLeft counted down from UpdatedAt to the time of the request.
+	RemainingSeconds int `json:"remaining_seconds"`
+	// Expiring marks an active session whose remaining time has run out but which the next
+	// sync has not removed yet.
+	Expiring bool `json:"expiring"`
+}
+
+// ServiceIssue is a malformed value stored for a service, e.g. after a manual database edit, with a
+// suggested repair.
+type ServiceIssue struct {
+	ServiceID   int    `json:"service_id"`
+	ServiceName string `json:"service_name"`
+	Field       string `json:"field"`
+	Value       string `json:"value"`
+	Problem     string `json:"problem"`
+	Repair      string `json:"repair"`
 }
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// API token scopes. A read token may only make GET and HEAD requests; a full token may do whatever
+// its owner's role allows; a services token may only activate and deactivate the services it lists.
+// No scope grants more than the owner's role.
+const (
+	TokenScopeRead     = "read"
+	TokenScopeFull     = "full"
+	TokenScopeServices = "services"
+)
+
+// APIToken is a personal access token as listed to its owner. The token itself is never stored.
+type APIToken struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	ServiceIDs []int      `json:"service_ids,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TokenGrant is what an authenticated API token allows: who it acts as, its scope and, for the
+// services scope, which services.
+type TokenGrant struct {
+	Username   string
+	Scope      string
+	ServiceIDs []int
+}
@@ -16,7 +16,9 @@ type UserWithCredentials struct {
 	Id          int         `json:"id"`
 	Credentials Credentials `json:"credentials"`
 	RoleId      int         `json:"role_id"`
-	IsActive    bool        `json:"is_active"`
+	// Role names the role when RoleId is not given.
+	Role     string `json:"role,omitempty"`
+	IsActive bool   `json:"is_active"`
 }
 
 // Credentials holds the authentication payload (username and password) provided by the client.
@@ -31,5 +33,11 @@ type Claims struct {
 	Role     string `json:"role,omitempty"`
 	RoleID   int    `json:"role_id,omitempty"`
 	Provider string `json:"provider,omitempty"` // "local", "google", "github"
+	// AuthTime is when the user last entered credentials or signed in with a provider. It is kept
+	// when the token is refreshed.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// TokenGeneration is the user's token generation when the token was issued. Raising the
+	// generation, e.g. on a role change, revokes every token issued before.
+	TokenGeneration int64 `json:"gen,omitempty"`
 	jwt.RegisteredClaims
 }
@@ -0,0 +1,140 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GitHubAPIURL is the GitHub REST API the GitHub provider reads users from.
+const GitHubAPIURL = "https://api.github.com"
+
+// Values of Options.GitHubGroups: which GitHub memberships become groups for group_mappings. Teams
+// include the organizations they belong to.
+const (
+	GitHubGroupsNone  = "none"
+	GitHubGroupsOrgs  = "orgs"
+	GitHubGroupsTeams = "teams"
+)
+
+// ErrProviderUnavailable is wrapped by errors for provider calls that failed because the provider
+// could not be reached or answered with a server error, rather than because it refused the request.
+var ErrProviderUnavailable = errors.New("identity provider unavailable")
+
+// GitHub API calls are given gitHubCallTimeout per attempt and retried up to gitHubAttempts times on
+// network errors and 5xx answers, waiting gitHubRetryDelay and then twice as long between attempts.
+var (
+	gitHubCallTimeout = 10 * time.Second
+	gitHubAttempts    = 3
+	gitHubRetryDelay  = 250 * time.Millisecond
+)
+
+// gitHubPageSize and gitHubMaxPages bound the membership lists read, so a login makes at most a
+// handful of API calls.
+const (
+	gitHubPageSize = 100
+	gitHubMaxPages = 10
+)
+
+// FetchGitHubGroups returns the GitHub memberships of the user client is authorized as, as groups
+// for group mappings: organizations by login, e.g. "acme", and with GitHubGroupsTeams also teams as
+// "org:team-slug", e.g. "acme:platform". Both need the read:org scope; without it GitHub only
+// lists public organization memberships.
+func FetchGitHubGroups(ctx context.Context, client *http.Client, apiURL, mode string) ([]string, error) {
+	if mode != GitHubGroupsOrgs && mode != GitHubGroupsTeams {
+		return nil, nil
+	}
+
+	var groups []string
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := gitHubGetAll(ctx, client, apiURL+"/user/orgs", &orgs); err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	for _, org := range orgs {
+		groups = append(groups, org.Login)
+	}
+
+	if mode == GitHubGroupsTeams {
+		var teams []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		if err := gitHubGetAll(ctx, client, apiURL+"/user/teams", &teams); err != nil {
+			return nil, fmt.Errorf("failed to list teams: %w", err)
+		}
+		for _, team := range teams {
+			groups = append(groups, team.Organization.Login+":"+team.Slug)
+		}
+	}
+	return groups, nil
+}
+
+// GitHubGetJSON decodes the JSON answer of the GitHub API at url into out. Each attempt is bounded by
+// a timeout derived from ctx, and network errors and 5xx answers are retried a few times before the
+// call fails with ErrProviderUnavailable. Other answers than 200 fail straight away.
+func GitHubGetJSON(ctx context.Context, client *http.Client, url string, out any) error {
+	delay := gitHubRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = gitHubGetOnce(ctx, client, url, out)
+		if !retry || attempt == gitHubAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return err
+}
+
+// gitHubGetOnce makes a single GitHubGetJSON attempt and reports whether a failure may be retried.
+func gitHubGetOnce(ctx context.Context, client *http.Client, url string, out any) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitHubCallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return true, fmt.Errorf("%w: GitHub API returned %s", ErrProviderUnavailable, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GitHub API returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("failed to decode GitHub API answer: %w", err)
+	}
+	return false, nil
+}
+
+// gitHubGetAll appends every page of the list at url to out, a pointer to a slice.
+func gitHubGetAll[T any](ctx context.Context, client *http.Client, url string, out *[]T) error {
+	for page := 1; page <= gitHubMaxPages; page++ {
+		var items []T
+		if err := GitHubGetJSON(ctx, client, fmt.Sprintf("%s?per_page=%d&page=%d", url, gitHubPageSize, page), &items); err != nil {
+			return err
+		}
+		*out = append(*out, items...)
+		if len(items) < gitHubPageSize {
+			return nil
+		}
+	}
+	return nil
+}
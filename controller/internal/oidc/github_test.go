@@ -0,0 +1,195 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newGitHubAPI serves the membership endpoints FetchGitHubGroups reads, answering the ones in
+// failing with 403 like GitHub does without the read:org scope.
+func newGitHubAPI(t *testing.T, failing ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(failing, r.URL.Path) {
+			http.Error(w, `{"message":"Resource not accessible"}`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/user/orgs":
+			// The first page is full, so the second one is read too.
+			if r.URL.Query().Get("page") == "1" {
+				orgs := make([]string, gitHubPageSize)
+				for i := range orgs {
+					orgs[i] = fmt.Sprintf(`{"login":"org-%d"}`, i)
+				}
+				_, _ = fmt.Fprintf(w, "[%s]", strings.Join(orgs, ","))
+				return
+			}
+			_, _ = w.Write([]byte(`[{"login":"acme"}]`))
+		case "/user/teams":
+			_, _ = w.Write([]byte(`[{"slug":"platform","organization":{"login":"acme"}},{"slug":"sre","organization":{"login":"globex"}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchGitHubGroups(t *testing.T) {
+	ctx := context.Background()
+	srv := newGitHubAPI(t)
+
+	groups, err := FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsTeams)
+	if err != nil {
+		t.Fatalf("FetchGitHubGroups failed: %v", err)
+	}
+	if len(groups) != gitHubPageSize+3 {
+		t.Fatalf("Expected %d groups, got %d: %v", gitHubPageSize+3, len(groups), groups)
+	}
+	for _, want := range []string{"org-0", "acme", "acme:platform", "globex:sre"} {
+		if !slices.Contains(groups, want) {
+			t.Errorf("Expected group %q in %v", want, groups)
+		}
+	}
+
+	groups, err = FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsOrgs)
+	if err != nil || slices.Contains(groups, "acme:platform") || !slices.Contains(groups, "acme") {
+		t.Errorf("Expected organizations only, got %v (%v)", groups, err)
+	}
+
+	if groups, err := FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsNone); err != nil || groups != nil {
+		t.Errorf("Expected no groups and no API calls, got %v (%v)", groups, err)
+	}
+
+	// A team mapping resolves once the groups are fetched.
+	rules := RoleMappingRules{GroupMappings: map[string]string{"acme:platform": "admin"}, DefaultRole: "user"}
+	groups, _ = FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsTeams)
+	if role, matched := rules.Match("", false, groups); role != "admin" || matched != MatchGroup {
+		t.Errorf("Expected the team to map to admin, got %q (%s)", role, matched)
+	}
+}
+
+func TestFetchGitHubGroupsErrors(t *testing.T) {
+	fastGitHubRetries(t, time.Second)
+	ctx := context.Background()
+
+	srv := newGitHubAPI(t, "/user/teams")
+	if _, err := FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsTeams); err == nil || !strings.Contains(err.Error(), "teams") {
+		t.Errorf("Expected a teams error, got %v", err)
+	}
+	if groups, err := FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsOrgs); err != nil || !slices.Contains(groups, "acme") {
+		t.Errorf("Expected organizations to still be listed, got %v (%v)", groups, err)
+	}
+
+	srv.Close()
+	if _, err := FetchGitHubGroups(ctx, srv.Client(), srv.URL, GitHubGroupsOrgs); err == nil {
+		t.Error("Expected an error when the API is unreachable")
+	}
+}
+
+// roundTripFunc is an http.RoundTripper made of a function, to mock the GitHub API without a server.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// fastGitHubRetries shortens the GitHub API timeout and retry delay for the test.
+func fastGitHubRetries(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	oldTimeout, oldDelay := gitHubCallTimeout, gitHubRetryDelay
+	gitHubCallTimeout, gitHubRetryDelay = timeout, time.Millisecond
+	t.Cleanup(func() { gitHubCallTimeout, gitHubRetryDelay = oldTimeout, oldDelay })
+}
+
+func TestGitHubGetJSONRetries(t *testing.T) {
+	fastGitHubRetries(t, time.Second)
+	ctx := context.Background()
+
+	// answer returns a client answering the statuses in turn and counting its calls.
+	answer := func(statuses ...int) (*http.Client, *int) {
+		calls := 0
+		return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			status := statuses[min(calls, len(statuses)-1)]
+			calls++
+			return &http.Response{
+				StatusCode: status,
+				Status:     http.StatusText(status),
+				Body:       io.NopCloser(strings.NewReader(`{"login":"alice"}`)),
+				Request:    r,
+			}, nil
+		})}, &calls
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+
+	client, calls := answer(http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+	if err := GitHubGetJSON(ctx, client, "https://api.github.test/user", &user); err != nil || user.Login != "alice" {
+		t.Errorf("Expected the third attempt to succeed, got %q (%v)", user.Login, err)
+	}
+	if *calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", *calls)
+	}
+
+	client, calls = answer(http.StatusInternalServerError)
+	if err := GitHubGetJSON(ctx, client, "https://api.github.test/user", &user); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected ErrProviderUnavailable after persistent 5xx, got %v", err)
+	}
+	if *calls != gitHubAttempts {
+		t.Errorf("Expected %d calls, got %d", gitHubAttempts, *calls)
+	}
+
+	// A refused request is not retried and is not the provider being unavailable.
+	client, calls = answer(http.StatusUnauthorized)
+	if err := GitHubGetJSON(ctx, client, "https://api.github.test/user", &user); err == nil || errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected a plain error for 401, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected 1 call, got %d", *calls)
+	}
+}
+
+func TestGitHubGetJSONTimeout(t *testing.T) {
+	fastGitHubRetries(t, 50*time.Millisecond)
+
+	// The client hangs until the attempt's deadline, like a GitHub that stopped answering.
+	calls := 0
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})}
+
+	start := time.Now()
+	var user struct{}
+	err := GitHubGetJSON(context.Background(), client, "https://api.github.test/user", &user)
+	if !errors.Is(err, ErrProviderUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timed out ErrProviderUnavailable, got %v", err)
+	}
+	if calls != gitHubAttempts {
+		t.Errorf("Expected %d attempts, got %d", gitHubAttempts, calls)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the call to give up after about 150ms, took %v", elapsed)
+	}
+
+	// A canceled request context stops the retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	if err := GitHubGetJSON(ctx, client, "https://api.github.test/user", &user); err == nil {
+		t.Error("Expected an error for a canceled context")
+	}
+	if calls > 1 {
+		t.Errorf("Expected no retries after the context was canceled, got %d calls", calls)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -19,6 +20,40 @@ type Provider struct {
 	Config      *oauth2.Config
 	Verifier    *oidc.IDTokenVerifier
 	RoleMapping *RoleMappingRules
+	// AuthOptions are added to the authorization URL, e.g. to request offline access.
+	AuthOptions []oauth2.AuthCodeOption
+	// APIURL is the REST API user details are read from, for providers without ID tokens.
+	APIURL string
+	// GitHubGroups is one of the GitHubGroups constants: which memberships become groups.
+	GitHubGroups string
+	// Disabled refuses new logins via the provider. Sessions it already issued stay valid.
+	Disabled bool
+
+	// mu guards RoleMapping, which OIDCManager.ReloadRoleMapping replaces while callbacks read it
+	// through Rules.
+	mu sync.RWMutex
+}
+
+// Default scopes requested from each provider when Options leaves them empty.
+var (
+	DefaultGoogleScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	DefaultGitHubScopes = []string{"read:user", "user:email"}
+)
+
+// Options tunes what the providers are asked for.
+type Options struct {
+	GoogleScopes []string
+	GitHubScopes []string
+	// OfflineAccess asks providers that support it for a refresh token. GitHub OAuth apps never
+	// issue one.
+	OfflineAccess bool
+	// GitHubGroups is one of the GitHubGroups constants. Orgs and teams need the read:org scope.
+	GitHubGroups string
+	// GoogleDisabled and GitHubDisabled keep a configured provider from accepting new logins.
+	GoogleDisabled bool
+	GitHubDisabled bool
+	// TokenKey encrypts stored provider refresh tokens. Refresh tokens are not stored without it.
+	TokenKey string
 }
 
 // RoleMappingRules defines how OIDC claims maps to roles
@@ -26,21 +61,35 @@ type RoleMappingRules struct {
 	DomainMappings map[string]string `json:"domain_mappings"` // email domain -> role name
 	GroupMappings  map[string]string `json:"group_mappings"`  // OIDC group -> role name
 	DefaultRole    string            `json:"default_role"`
+	// UnverifiedEmails lets domain mappings match emails the provider has not verified. Anyone can
+	// claim an unverified address at any domain, so it is off unless a provider only issues
+	// addresses it controls.
+	UnverifiedEmails bool `json:"unverified_email_mappings"`
 }
 
 // Manages multiple OIDC providers
 type OIDCManager struct {
 	Providers map[string]*Provider
+	TokenKey  string
 }
 
 // NewOIDCManager creates a new OIDC manager
-func NewOIDCManager(ctx context.Context, googleClientID, googleSecret, githubClientID, githubSecret, redirectURL, roleMappingJSON string) (*OIDCManager, error) {
+func NewOIDCManager(ctx context.Context, googleClientID, googleSecret, githubClientID, githubSecret, redirectURL, roleMappingJSON string, opts Options) (*OIDCManager, error) {
 	manager := &OIDCManager{
 		Providers: make(map[string]*Provider),
+		TokenKey:  opts.TokenKey,
+	}
+	googleScopes := opts.GoogleScopes
+	if len(googleScopes) == 0 {
+		googleScopes = DefaultGoogleScopes
+	}
+	githubScopes := opts.GitHubScopes
+	if len(githubScopes) == 0 {
+		githubScopes = DefaultGitHubScopes
 	}
 
-	var roleMapping RoleMappingRules
-	if err := json.Unmarshal([]byte(roleMappingJSON), &roleMapping); err != nil {
+	roleMapping, err := ParseRoleMappingRules(roleMappingJSON)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse role mapping rules: %w", err)
 	}
 
@@ -57,12 +106,17 @@ func NewOIDCManager(ctx context.Context, googleClientID, googleSecret, githubCli
 				ClientSecret: googleSecret,
 				RedirectURL:  redirectURL,
 				Endpoint:     google.Endpoint,
-				Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+				Scopes:       googleScopes,
 			},
 			Verifier: googleProvider.Verifier(&oidc.Config{
 				ClientID: googleClientID,
 			}),
-			RoleMapping: &roleMapping,
+			RoleMapping: roleMapping,
+			Disabled:    opts.GoogleDisabled,
+		}
+		if opts.OfflineAccess {
+			// Google ignores the offline_access scope and only returns a refresh token on consent.
+			manager.Providers["google"].AuthOptions = []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.ApprovalForce}
 		}
 		log.Printf("[INFO] Google OIDC provider initialized")
 	}
@@ -75,9 +129,12 @@ func NewOIDCManager(ctx context.Context, googleClientID, googleSecret, githubCli
 				ClientSecret: githubSecret,
 				RedirectURL:  redirectURL,
 				Endpoint:     github.Endpoint,
-				Scopes:       []string{"read:user", "user:email"},
+				Scopes:       githubScopes,
 			},
-			RoleMapping: &roleMapping,
+			RoleMapping:  roleMapping,
+			APIURL:       GitHubAPIURL,
+			GitHubGroups: opts.GitHubGroups,
+			Disabled:     opts.GitHubDisabled,
 		}
 		log.Printf("[INFO] GitHub OAuth2 provider initialized")
 	}
@@ -89,6 +146,21 @@ func NewOIDCManager(ctx context.Context, googleClientID, googleSecret, githubCli
 	return manager, nil
 }
 
+// ReloadRoleMapping parses rulesJSON and, if it is valid, makes it the role mapping rules of every
+// provider. Invalid rules leave the current ones in place.
+func (m *OIDCManager) ReloadRoleMapping(rulesJSON string) error {
+	rules, err := ParseRoleMappingRules(rulesJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse role mapping rules: %w", err)
+	}
+	for _, p := range m.Providers {
+		p.mu.Lock()
+		p.RoleMapping = rules
+		p.mu.Unlock()
+	}
+	return nil
+}
+
 // GetProvider returns a provider name
 func (m *OIDCManager) GetProvider(name string) (*Provider, error) {
 	provider, ok := m.Providers[name]
@@ -98,27 +170,85 @@ func (m *OIDCManager) GetProvider(name string) (*Provider, error) {
 	return provider, nil
 }
 
-// MapClaimsToRole gets the role based on OIDC claims
-func (p *Provider) MapClaimsToRole(email string, groups []string) string {
-	if role, ok := p.RoleMapping.DomainMappings[email]; ok {
-		return role
+// ParseRoleMappingRules parses role mapping rules from JSON. Unknown keys, empty role names and
+// domain_mappings keys that are neither an email address nor an @domain are rejected, since such
+// rules would silently never match.
+func ParseRoleMappingRules(rulesJSON string) (*RoleMappingRules, error) {
+	var rules RoleMappingRules
+	dec := json.NewDecoder(strings.NewReader(rulesJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the rules object")
+	}
+	for key, role := range rules.DomainMappings {
+		if at := strings.Index(key, "@"); at < 0 || at == len(key)-1 || strings.Count(key, "@") > 1 {
+			return nil, fmt.Errorf("domain_mappings key %q is neither an email address nor an @domain", key)
+		}
+		if role == "" {
+			return nil, fmt.Errorf("domain_mappings key %q maps to an empty role", key)
+		}
+	}
+	for group, role := range rules.GroupMappings {
+		if role == "" {
+			return nil, fmt.Errorf("group_mappings key %q maps to an empty role", group)
+		}
+	}
+	return &rules, nil
+}
+
+// Rules Match reports as having decided the role.
+const (
+	MatchEmail   = "email"
+	MatchDomain  = "domain"
+	MatchGroup   = "group"
+	MatchDefault = "default"
+)
+
+// Match returns the role the rules assign to an identity and which rule decided it, one of the Match
+// constants. An exact email address wins over its @domain, which wins over groups, in the order
+// given; without a match the default role applies. Domain mappings only apply to an email the
+// provider verified unless UnverifiedEmails is set.
+func (r *RoleMappingRules) Match(email string, emailVerified bool, groups []string) (string, string) {
+	if email != "" && !emailVerified && !r.UnverifiedEmails {
+		log.Printf("[oidc] not applying domain mappings to unverified email '%s'", email)
+		email = ""
+	}
+
+	if role, ok := r.DomainMappings[email]; ok {
+		return role, MatchEmail
 	}
 
 	if email != "" {
 		parts := strings.Split(email, "@")
 		if len(parts) == 2 {
 			domain := "@" + parts[1]
-			if role, ok := p.RoleMapping.DomainMappings[domain]; ok {
-				return role
+			if role, ok := r.DomainMappings[domain]; ok {
+				return role, MatchDomain
 			}
 		}
 	}
 
 	for _, group := range groups {
-		if role, ok := p.RoleMapping.GroupMappings[group]; ok {
-			return role
+		if role, ok := r.GroupMappings[group]; ok {
+			return role, MatchGroup
 		}
 	}
 
-	return p.RoleMapping.DefaultRole
+	return r.DefaultRole, MatchDefault
+}
+
+// Rules returns the provider's current role mapping rules.
+func (p *Provider) Rules() *RoleMappingRules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.RoleMapping
+}
+
+// MapClaimsToRole gets the role based on OIDC claims, as RoleMappingRules.Match decides it.
+func (p *Provider) MapClaimsToRole(email string, emailVerified bool, groups []string) string {
+	role, _ := p.Rules().Match(email, emailVerified, groups)
+	return role
 }
@@ -2,6 +2,7 @@ package oidc
 
 import (
 	"context"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -60,6 +61,7 @@ func TestNewOIDCManagerErrors(t *testing.T) {
 				tt.githubSecret,
 				tt.redirectURL,
 				tt.roleMappingJSON,
+				Options{},
 			)
 
 			if tt.shouldError {
@@ -92,6 +94,7 @@ func TestOIDCManagerGetProvider(t *testing.T) {
 		"github-secret",
 		"http://localhost/callback",
 		roleMappingJSON,
+		Options{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -150,6 +153,7 @@ func TestMapClaimsToRole(t *testing.T) {
 		name         string
 		mapping      RoleMappingRules
 		email        string
+		unverified   bool
 		groups       []string
 		expectedRole string
 	}{
@@ -207,6 +211,39 @@ func TestMapClaimsToRole(t *testing.T) {
 			email:        "outsider@other.com",
 			expectedRole: "guest",
 		},
+		{
+			name: "Unverified email gets the default role",
+			mapping: RoleMappingRules{
+				DomainMappings: map[string]string{"@company.com": "user", "admin@company.com": "admin"},
+				DefaultRole:    "guest",
+			},
+			email:        "admin@company.com",
+			unverified:   true,
+			expectedRole: "guest",
+		},
+		{
+			name: "Unverified email still matches groups",
+			mapping: RoleMappingRules{
+				DomainMappings: map[string]string{"@company.com": "admin"},
+				GroupMappings:  map[string]string{"devs": "developer"},
+				DefaultRole:    "guest",
+			},
+			email:        "someone@company.com",
+			unverified:   true,
+			groups:       []string{"devs"},
+			expectedRole: "developer",
+		},
+		{
+			name: "Unverified email mappings allowed",
+			mapping: RoleMappingRules{
+				DomainMappings:   map[string]string{"@company.com": "user"},
+				DefaultRole:      "guest",
+				UnverifiedEmails: true,
+			},
+			email:        "someone@company.com",
+			unverified:   true,
+			expectedRole: "user",
+		},
 	}
 
 	for _, tt := range tests {
@@ -215,7 +252,7 @@ func TestMapClaimsToRole(t *testing.T) {
 				Name:        "test",
 				RoleMapping: &tt.mapping,
 			}
-			role := provider.MapClaimsToRole(tt.email, tt.groups)
+			role := provider.MapClaimsToRole(tt.email, !tt.unverified, tt.groups)
 			if role != tt.expectedRole {
 				t.Errorf("Expected role %q, got %q", tt.expectedRole, role)
 			}
@@ -240,6 +277,7 @@ func TestProviderConfiguration(t *testing.T) {
 		"github-secret",
 		"http://localhost/callback",
 		roleMappingJSON,
+		Options{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to create OIDC manager: %v", err)
@@ -265,3 +303,79 @@ func TestProviderConfiguration(t *testing.T) {
 		}
 	})
 }
+
+func TestProviderScopes(t *testing.T) {
+	newGitHub := func(opts Options) *Provider {
+		t.Helper()
+		manager, err := NewOIDCManager(context.Background(), "", "", "github-client", "github-secret", "http://localhost/callback", `{"default_role": "user"}`, opts)
+		if err != nil {
+			t.Fatalf("Failed to create OIDC manager: %v", err)
+		}
+		return manager.Providers["github"]
+	}
+
+	if got := newGitHub(Options{}).Config.Scopes; !slices.Equal(got, DefaultGitHubScopes) {
+		t.Errorf("Expected default scopes %v, got %v", DefaultGitHubScopes, got)
+	}
+
+	custom := []string{"read:user", "user:email", "read:org"}
+	provider := newGitHub(Options{GitHubScopes: custom, OfflineAccess: true})
+	if !slices.Equal(provider.Config.Scopes, custom) {
+		t.Errorf("Expected scopes %v, got %v", custom, provider.Config.Scopes)
+	}
+	if len(provider.AuthOptions) != 0 {
+		t.Errorf("Expected no offline access options for GitHub, got %d", len(provider.AuthOptions))
+	}
+}
+
+func TestParseRoleMappingRules(t *testing.T) {
+	rules, err := ParseRoleMappingRules(`{"domain_mappings":{"@company.com":"user","admin@company.com":"admin"},"group_mappings":{"ops":"admin"},"default_role":"none"}`)
+	if err != nil {
+		t.Fatalf("ParseRoleMappingRules failed: %v", err)
+	}
+	if rules.DomainMappings["admin@company.com"] != "admin" || rules.GroupMappings["ops"] != "admin" || rules.DefaultRole != "none" {
+		t.Errorf("Unexpected rules %+v", rules)
+	}
+
+	for _, rulesJSON := range []string{
+		``,
+		`{"domain_mappings":`,
+		`{"default_role":"user"} {}`,
+		`{"domain_mapping":{"@company.com":"user"}}`,
+		`{"domain_mappings":{"company.com":"user"}}`,
+		`{"domain_mappings":{"user@":"user"}}`,
+		`{"domain_mappings":{"a@b@company.com":"user"}}`,
+		`{"domain_mappings":{"@company.com":""}}`,
+		`{"group_mappings":{"ops":""}}`,
+	} {
+		if _, err := ParseRoleMappingRules(rulesJSON); err == nil {
+			t.Errorf("Expected %q to be rejected", rulesJSON)
+		}
+	}
+}
+
+func TestReloadRoleMapping(t *testing.T) {
+	manager, err := NewOIDCManager(context.Background(), "", "", "github-client", "github-secret", "http://localhost/callback", `{"domain_mappings": {"@company.com": "user"}}`, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create OIDC manager: %v", err)
+	}
+	provider := manager.Providers["github"]
+	if role := provider.MapClaimsToRole("alice@company.com", true, nil); role != "user" {
+		t.Fatalf("Expected role 'user' before the reload, got '%s'", role)
+	}
+
+	if err := manager.ReloadRoleMapping(`{"domain_mappings": {"@company.com": "admin"}}`); err != nil {
+		t.Fatalf("ReloadRoleMapping failed: %v", err)
+	}
+	if role := provider.MapClaimsToRole("alice@company.com", true, nil); role != "admin" {
+		t.Errorf("Expected role 'admin' after the reload, got '%s'", role)
+	}
+
+	// Invalid rules are rejected and the current ones stay in place.
+	if err := manager.ReloadRoleMapping(`{"domain_mapping": {"@company.com": "root"}}`); err == nil {
+		t.Error("Expected invalid rules to be rejected")
+	}
+	if role := provider.MapClaimsToRole("alice@company.com", true, nil); role != "admin" {
+		t.Errorf("Expected role 'admin' after a rejected reload, got '%s'", role)
+	}
+}
@@ -2,9 +2,13 @@ package repository
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,33 +17,190 @@ import (
 // DB is the global database connection pool.
 var DB *sql.DB
 
+// Pragmas are the SQLite settings InitDB applies to every connection in the pool.
+type Pragmas struct {
+	// BusyTimeout is how long a connection waits for a lock before failing with SQLITE_BUSY.
+	BusyTimeout time.Duration
+	// Synchronous is one of OFF, NORMAL, FULL or EXTRA.
+	Synchronous string
+	// CacheSize is the page cache size, in pages if positive or in KiB if negative.
+	CacheSize int
+}
+
+// DefaultPragmas are used until SetPragmas is called.
+var DefaultPragmas = Pragmas{BusyTimeout: 5 * time.Second, Synchronous: "NORMAL", CacheSize: -2000}
+
+var (
+	pragmasMu sync.Mutex
+	pragmas   = DefaultPragmas
+)
+
+// SetPragmas sets the pragmas applied by later calls to InitDB.
+func SetPragmas(p Pragmas) {
+	pragmasMu.Lock()
+	defer pragmasMu.Unlock()
+	pragmas = p
+}
+
+// dsn returns the data source name that opens dbPath with p and foreign keys enabled on every connection.
+func dsn(dbPath string, p Pragmas) string {
+	q := url.Values{}
+	q.Set("_busy_timeout", strconv.FormatInt(p.BusyTimeout.Milliseconds(), 10))
+	q.Set("_synchronous", p.Synchronous)
+	q.Set("_cache_size", strconv.Itoa(p.CacheSize))
+	q.Set("_foreign_keys", "on")
+	return dbPath + "?" + q.Encode()
+}
+
 // InitDB opens the SQLite database, configures the connection pool, and returns the connection.
+// A missing dir or aegis.db is created with the production schema first.
+// Calling it again closes the previous pool and moves existing repositories over to the new one.
 func InitDB(dir string, maxOpen, maxIdle int, connMaxLifetime time.Duration) *sql.DB {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		log.Fatalf("[ERROR] [database] init failed: data directory '%s' does not exist", dir)
-	}
-	dbPath := filepath.Join(dir, "aegis.db")
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		log.Fatalf("[ERROR] [database] init failed: aegis.db not found at %s", dbPath)
+	if _, err := CreateDB(dir); err != nil {
+		log.Fatalf("[ERROR] [database] init failed: %v", err)
 	}
+	dbPath := DBPath(dir)
 
-	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+	pragmasMu.Lock()
+	p := pragmas
+	pragmasMu.Unlock()
+	db, err := sql.Open("sqlite3", dsn(dbPath, p))
 	if err != nil {
 		log.Fatalf("[ERROR] [database] init failed: %v", err)
 	}
 
-	if _, err := DB.Exec("PRAGMA journal_mode=WAL;"); err != nil {
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
 		log.Printf("[WARN] [database] WAL mode not enabled: %v", err)
 	}
-	if _, err := DB.Exec("PRAGMA foreign_keys = ON;"); err != nil {
-		log.Fatalf("[ERROR] [database] init failed: unable to enable foreign keys: %v", err)
+	if err := logPragmas(db); err != nil {
+		log.Fatalf("[ERROR] [database] init failed: %v", err)
 	}
 
-	DB.SetMaxOpenConns(maxOpen)
-	DB.SetMaxIdleConns(maxIdle)
-	DB.SetConnMaxLifetime(connMaxLifetime)
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	if old := DB; old != nil {
+		if err := moveRepositories(old, db); err != nil {
+			log.Fatalf("[ERROR] [database] reinit failed: %v", err)
+		}
+		if err := old.Close(); err != nil {
+			log.Printf("[WARN] [database] failed to close previous connection pool: %v", err)
+		}
+	}
+	DB = db
 
 	log.Printf("[INFO] [database] initialized successfully at %s", dbPath)
 	return DB
 }
+
+// logPragmas logs the pragmas in effect on a connection from db.
+func logPragmas(db *sql.DB) error {
+	var busyTimeout, synchronous, cacheSize, foreignKeys int
+	var journalMode string
+	for _, q := range []struct {
+		name string
+		dest any
+	}{
+		{"busy_timeout", &busyTimeout},
+		{"synchronous", &synchronous},
+		{"cache_size", &cacheSize},
+		{"foreign_keys", &foreignKeys},
+		{"journal_mode", &journalMode},
+	} {
+		if err := db.QueryRow("PRAGMA " + q.name).Scan(q.dest); err != nil {
+			return fmt.Errorf("unable to read pragma %s: %w", q.name, err)
+		}
+	}
+	if foreignKeys != 1 {
+		return fmt.Errorf("unable to enable foreign keys")
+	}
+	modes := []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+	mode := strconv.Itoa(synchronous)
+	if synchronous >= 0 && synchronous < len(modes) {
+		mode = modes[synchronous]
+	}
+	log.Printf("[INFO] [database] pragmas: journal_mode=%s busy_timeout=%dms synchronous=%s cache_size=%d foreign_keys=on",
+		journalMode, busyTimeout, mode, cacheSize)
+	return nil
+}
+
+// CreateDB creates dir and an aegis.db with the production schema inside it if they do not exist yet.
+// The root account init.sql seeds with the well-known password root is dropped, so a new database has
+// no users until --bootstrap creates one. It reports whether a new database file was created.
+func CreateDB(dir string) (bool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return false, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	dbPath := DBPath(dir)
+	if _, err := os.Stat(dbPath); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = db.Close() }()
+	if err := ApplySchema(db); err != nil {
+		_ = db.Close()
+		_ = RemoveDB(dir)
+		return false, err
+	}
+	if _, err := db.Exec("DELETE FROM users"); err != nil {
+		_ = db.Close()
+		_ = RemoveDB(dir)
+		return false, fmt.Errorf("failed to remove seeded root user: %w", err)
+	}
+	log.Printf("[INFO] [database] created %s", dbPath)
+	return true, nil
+}
+
+// DBPath returns the path of the database file inside dir.
+func DBPath(dir string) string {
+	return filepath.Join(dir, "aegis.db")
+}
+
+// RemoveDB deletes aegis.db and its WAL files from dir.
+func RemoveDB(dir string) error {
+	dbPath := DBPath(dir)
+	for _, suffix := range []string{"-wal", "-shm"} {
+		_ = os.Remove(dbPath + suffix)
+	}
+	return os.Remove(dbPath)
+}
+
+// rebinder is implemented by repositories that can re-prepare their statements on another pool.
+type rebinder interface {
+	rebind(db *sql.DB) error
+}
+
+var (
+	trackedMu sync.Mutex
+	tracked   = make(map[*sql.DB][]rebinder)
+)
+
+// track remembers that r holds statements prepared on db.
+func track(db *sql.DB, r rebinder) {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	tracked[db] = append(tracked[db], r)
+}
+
+// moveRepositories re-prepares every repository tracked on from against to.
+// Callers must make sure no queries are in flight on from.
+func moveRepositories(from, to *sql.DB) error {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	for _, r := range tracked[from] {
+		if err := r.rebind(to); err != nil {
+			return err
+		}
+	}
+	tracked[to] = append(tracked[to], tracked[from]...)
+	delete(tracked, from)
+	servicesVersion.Add(1)
+	return nil
+}
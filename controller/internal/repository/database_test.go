@@ -0,0 +1,302 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestDBFile creates an aegis.db with the production schema inside a temp dir and returns the dir.
+func createTestDBFile(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := SetupTestStmt(dir)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	_ = db.Close()
+	DB = nil
+	return dir
+}
+
+// resetGlobalDB closes and clears the package-level DB after a test.
+func resetGlobalDB(t *testing.T) {
+	t.Cleanup(func() {
+		if DB != nil {
+			_ = DB.Close()
+			DB = nil
+		}
+	})
+}
+
+func TestInitDBReopenKeepsRepositoriesWorking(t *testing.T) {
+	resetGlobalDB(t)
+	dir := createTestDBFile(t)
+
+	first := InitDB(dir, 1, 1, time.Hour)
+	repo, err := NewRoleRepository(first)
+	if err != nil {
+		t.Fatalf("Failed to create role repo: %v", err)
+	}
+	if _, err := repo.Create("ops", "Operations", nil, nil); err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+
+	second := InitDB(dir, 1, 1, time.Hour)
+	if second == first {
+		t.Fatal("Expected InitDB to open a new connection pool")
+	}
+	if err := first.Ping(); err == nil {
+		t.Error("Expected the previous connection pool to be closed")
+	}
+
+	roles, err := repo.GetAll(DefaultRoleSort)
+	if err != nil {
+		t.Fatalf("GetAll after reopen failed: %v", err)
+	}
+	found := false
+	for _, role := range roles {
+		found = found || role.Name == "ops"
+	}
+	if !found {
+		t.Errorf("Expected role 'ops' after reopen, got %+v", roles)
+	}
+	if _, err := repo.Create("dev", "", nil, nil); err != nil {
+		t.Errorf("Create after reopen failed: %v", err)
+	}
+}
+
+func TestStmtReprepareAfterClose(t *testing.T) {
+	resetGlobalDB(t)
+	dir := createTestDBFile(t)
+	db := InitDB(dir, 1, 1, time.Hour)
+
+	repo, err := NewRoleRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create role repo: %v", err)
+	}
+	r := repo.(*roleRepo)
+
+	// Close the underlying statements behind the wrapper's back.
+	_ = r.stmtDelete.current().Close()
+	_ = r.stmtGetIDByName.current().Close()
+	_ = r.stmtGetAll[DefaultRoleSort].current().Close()
+
+	if _, err := repo.Create("ops", "", nil, nil); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	id, err := repo.GetIDByName("ops")
+	if err != nil {
+		t.Fatalf("QueryRow on closed statement was not retried: %v", err)
+	}
+	if roles, err := repo.GetAll(DefaultRoleSort); err != nil || len(roles) == 0 {
+		t.Fatalf("Query on closed statement was not retried: %v (%d roles)", err, len(roles))
+	}
+	if n, err := repo.Delete(id); err != nil || n != 1 {
+		t.Fatalf("Exec on closed statement was not retried: %v (%d rows)", err, n)
+	}
+}
+
+func TestSetupTestStmtUsesProductionSchema(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	if DB != db {
+		t.Error("Expected SetupTestStmt to set the global DB")
+	}
+
+	for _, column := range []string{"provider", "provider_id", "email"} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = ?", column).Scan(&n); err != nil {
+			t.Fatalf("Failed to inspect users table: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("Expected users.%s to exist", column)
+		}
+	}
+	if _, err := db.Exec("SELECT 1 FROM refresh_tokens"); err != nil {
+		t.Errorf("Expected refresh_tokens table: %v", err)
+	}
+}
+
+func TestDetectSchemaVersion(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	version, err := DetectSchemaVersion(db)
+	if err != nil {
+		t.Fatalf("DetectSchemaVersion failed: %v", err)
+	}
+	if version != CurrentSchemaVersion {
+		t.Errorf("Expected schema version %s, got %s", CurrentSchemaVersion, version)
+	}
+
+	if _, err := db.Exec("DROP TABLE api_tokens"); err != nil {
+		t.Fatalf("Failed to drop api_tokens: %v", err)
+	}
+	if version, _ := DetectSchemaVersion(db); version != "1.3" {
+		t.Errorf("Expected schema version 1.3 without api_tokens, got %s", version)
+	}
+	if _, err := db.Exec("DROP INDEX idx_services_agent; ALTER TABLE services DROP COLUMN agent"); err != nil {
+		t.Fatalf("Failed to drop services.agent: %v", err)
+	}
+	if version, _ := DetectSchemaVersion(db); version != "1.2" {
+		t.Errorf("Expected schema version 1.2 without services.agent, got %s", version)
+	}
+	if _, err := db.Exec("DROP TABLE refresh_tokens"); err != nil {
+		t.Fatalf("Failed to drop refresh_tokens: %v", err)
+	}
+	if version, _ := DetectSchemaVersion(db); version != "1.1.1" {
+		t.Errorf("Expected schema version 1.1.1 without refresh_tokens, got %s", version)
+	}
+}
+
+func TestNameCaseCollisions(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Prod', '10.0.0.1:80', 1, 80)"); err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('prod', '10.0.0.2:80', 2, 80)"); err == nil {
+		t.Error("Expected a service name differing only in case to be rejected")
+	}
+	if _, err := db.Exec("INSERT INTO roles (name) VALUES ('USER')"); err == nil {
+		t.Error("Expected a role name differing only in case to be rejected")
+	}
+	if got, err := NameCaseCollisions(db); err != nil || len(got) != 0 {
+		t.Fatalf("Expected no collisions, got %q, %v", got, err)
+	}
+
+	// Databases created before the indexes may already hold such names.
+	if _, err := db.Exec(`DROP INDEX idx_services_name_nocase; DROP INDEX idx_roles_name_nocase;
+		INSERT INTO services (name, hostname, ip, port) VALUES ('prod', '10.0.0.2:80', 2, 80), ('PROD', '10.0.0.3:80', 3, 80);
+		INSERT INTO roles (name) VALUES ('USER')`); err != nil {
+		t.Fatalf("Failed to create colliding names: %v", err)
+	}
+	got, err := NameCaseCollisions(db)
+	if err != nil {
+		t.Fatalf("NameCaseCollisions failed: %v", err)
+	}
+	want := []string{"services: PROD, Prod, prod", "roles: USER, user"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected collisions %q, got %q", want, got)
+	}
+}
+
+func TestInitDBCreatesMissingDatabase(t *testing.T) {
+	resetGlobalDB(t)
+	dir := filepath.Join(t.TempDir(), "nested", "data")
+
+	db := InitDB(dir, 1, 1, time.Hour)
+	if _, err := os.Stat(DBPath(dir)); err != nil {
+		t.Fatalf("Expected aegis.db to be created: %v", err)
+	}
+	if version, err := DetectSchemaVersion(db); err != nil || version != CurrentSchemaVersion {
+		t.Errorf("Expected schema version %s, got %q (%v)", CurrentSchemaVersion, version, err)
+	}
+	userRepo, err := NewUserRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create user repo: %v", err)
+	}
+	if _, err := userRepo.GetIDByUsername("root"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected no seeded root user, got %v", err)
+	}
+
+	// Opening the same directory again keeps the existing database.
+	if _, err := userRepo.Create("alice", "hash", 3); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	InitDB(dir, 1, 1, time.Hour)
+	if _, err := userRepo.GetIDByUsername("alice"); err != nil {
+		t.Errorf("Expected existing data to survive a reopen, got %v", err)
+	}
+}
+
+func TestInitDBOpensConfiguredDir(t *testing.T) {
+	resetGlobalDB(t)
+	dir := createTestDBFile(t)
+
+	db := InitDB(dir, 1, 1, time.Hour)
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		t.Fatalf("PRAGMA database_list failed: %v", err)
+	}
+	want, err := filepath.EvalSymlinks(DBPath(dir))
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", DBPath(dir), err)
+	}
+	if got, _ := filepath.EvalSymlinks(file); got != want {
+		t.Errorf("Expected the database to be opened at %s, got %s", want, file)
+	}
+}
+
+// holdWriteLock takes the write lock on the database in dir from a separate pool and releases it after d.
+func holdWriteLock(t *testing.T, dir string, d time.Duration) <-chan struct{} {
+	t.Helper()
+	other, err := sql.Open("sqlite3", DBPath(dir))
+	if err != nil {
+		t.Fatalf("Failed to open second pool: %v", err)
+	}
+	t.Cleanup(func() { _ = other.Close() })
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to take the write lock: %v", err)
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(d)
+		_, _ = conn.ExecContext(context.Background(), "COMMIT")
+		_ = conn.Close()
+		close(released)
+	}()
+	return released
+}
+
+func TestInitDBBusyTimeout(t *testing.T) {
+	resetGlobalDB(t)
+	t.Cleanup(func() { SetPragmas(DefaultPragmas) })
+	dir := createTestDBFile(t)
+
+	// Without a busy timeout a write fails as soon as another connection holds the lock.
+	SetPragmas(Pragmas{BusyTimeout: 0, Synchronous: "NORMAL", CacheSize: -2000})
+	db := InitDB(dir, 1, 1, time.Hour)
+	released := holdWriteLock(t, dir, 200*time.Millisecond)
+	if _, err := db.Exec("INSERT INTO roles (name) VALUES ('busy')"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Expected a database is locked error, got %v", err)
+	}
+	<-released
+
+	// With a busy timeout the write waits for the lock instead.
+	SetPragmas(Pragmas{BusyTimeout: 5 * time.Second, Synchronous: "FULL", CacheSize: 500})
+	db = InitDB(dir, 1, 1, time.Hour)
+	released = holdWriteLock(t, dir, 200*time.Millisecond)
+	if _, err := db.Exec("INSERT INTO roles (name) VALUES ('patient')"); err != nil {
+		t.Errorf("Expected the write to wait for the lock, got %v", err)
+	}
+	<-released
+
+	var synchronous, cacheSize int
+	if err := db.QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil || synchronous != 2 {
+		t.Errorf("Expected synchronous=FULL (2), got %d (%v)", synchronous, err)
+	}
+	if err := db.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil || cacheSize != 500 {
+		t.Errorf("Expected cache_size=500, got %d (%v)", cacheSize, err)
+	}
+}
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"Aegis/controller/internal/models"
+	"database/sql"
+	"fmt"
+)
+
+// IntegrityRepository finds and removes rows left dangling by manual edits or by writes made while
+// foreign keys were not enforced.
+type IntegrityRepository interface {
+	FindOrphans() ([]models.Orphan, error)
+	DeleteOrphans() ([]models.Orphan, error)
+}
+
+type integrityRepo struct {
+	db                *sql.DB
+	stmtForeignKeys   *stmt
+	stmtUsersWithRole *stmt
+}
+
+// NewIntegrityRepository prepares all statements and returns an IntegrityRepository.
+func NewIntegrityRepository(db *sql.DB) (IntegrityRepository, error) {
+	r := &integrityRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
+	}
+	track(db, r)
+	return r, nil
+}
+
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *integrityRepo) rebind(db *sql.DB) error {
+	r.db = db
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtForeignKeys: {"integrity.ForeignKeys", "PRAGMA foreign_key_check"},
+		// users.role_id is nullable, so foreign_key_check does not flag users without a role.
+		&r.stmtUsersWithRole: {"integrity.UsersWithoutRole", "SELECT id FROM users WHERE role_id IS NULL ORDER BY id"},
+	})
+}
+
+// orphan describes a row of table that refers to a missing row of parent.
+func orphan(table string, rowID int64, parent string) models.Orphan {
+	if table == "users" {
+		return models.Orphan{Table: table, RowID: rowID, Parent: parent,
+			Repair: fmt.Sprintf("Assign the user a role with PUT /api/users/%d/role", rowID)}
+	}
+	return models.Orphan{Table: table, RowID: rowID, Parent: parent, Removable: true,
+		Repair: "Delete the row with POST /api/admin/integrity"}
+}
+
+// FindOrphans returns every row whose parent row is missing, and every user without a role.
+func (r *integrityRepo) FindOrphans() ([]models.Orphan, error) {
+	orphans := make([]models.Orphan, 0)
+	err := scanAll(r.stmtForeignKeys, func(rows *sql.Rows) error {
+		o, err := scanForeignKeyViolation(rows)
+		if err == nil {
+			orphans = append(orphans, o)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanAll(r.stmtUsersWithRole, func(rows *sql.Rows) error {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		orphans = append(orphans, orphan("users", id, "roles"))
+		return nil
+	})
+	return orphans, err
+}
+
+// scanForeignKeyViolation reads a row of PRAGMA foreign_key_check: table, rowid, parent, fkid.
+func scanForeignKeyViolation(rows *sql.Rows) (models.Orphan, error) {
+	var table, parent string
+	var rowID sql.NullInt64
+	var fkID int
+	if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+		return models.Orphan{}, err
+	}
+	return orphan(table, rowID.Int64, parent), nil
+}
+
+// DeleteOrphans deletes every removable orphan in one transaction and returns the deleted rows.
+func (r *integrityRepo) DeleteOrphans() ([]models.Orphan, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	var found []models.Orphan
+	for rows.Next() {
+		o, err := scanForeignKeyViolation(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		found = append(found, o)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	removed := make([]models.Orphan, 0, len(found))
+	for _, o := range found {
+		if !o.Removable {
+			continue
+		}
+		// Table names come from the schema via foreign_key_check, not from the request.
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %q WHERE rowid = ?", o.Table), o.RowID); err != nil {
+			return nil, fmt.Errorf("failed to delete %s row %d: %w", o.Table, o.RowID, err)
+		}
+		removed = append(removed, o)
+	}
+	return removed, tx.Commit()
+}
@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOrphansReportedAndRemoved(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Gone', '10.0.0.1:22', 167772161, 22)")
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES ('roleless', 'x', NULL)"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Deleting with foreign keys off skips the cascade, as a manual edit in the sqlite3 shell would.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	for _, step := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO role_services (role_id, service_id) VALUES (3, ?)", []any{svcID}},
+		{"PRAGMA foreign_keys = OFF", nil},
+		{"DELETE FROM services WHERE id = ?", []any{svcID}},
+		{"INSERT INTO users (username, password, role_id) VALUES ('dangling', 'x', 99)", nil},
+		{"PRAGMA foreign_keys = ON", nil},
+	} {
+		if _, err := conn.ExecContext(ctx, step.query, step.args...); err != nil {
+			t.Fatalf("%s: %v", step.query, err)
+		}
+	}
+	_ = conn.Close()
+
+	repo, err := NewIntegrityRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create integrity repo: %v", err)
+	}
+	orphans, err := repo.FindOrphans()
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	found := map[string]bool{}
+	for _, o := range orphans {
+		found[o.Table+"->"+o.Parent] = o.Removable
+		if o.Repair == "" {
+			t.Errorf("Expected a repair for %+v", o)
+		}
+	}
+	removable, reported := found["role_services->services"]
+	if len(orphans) != 3 || !reported || !removable || found["users->roles"] {
+		t.Fatalf("Expected the role link and both users to be reported, got %+v", orphans)
+	}
+
+	removed, err := repo.DeleteOrphans()
+	if err != nil {
+		t.Fatalf("DeleteOrphans failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0].Table != "role_services" {
+		t.Errorf("Expected only the role link to be removed, got %+v", removed)
+	}
+	var links, users int
+	_ = db.QueryRow("SELECT COUNT(*) FROM role_services WHERE service_id = ?", svcID).Scan(&links)
+	_ = db.QueryRow("SELECT COUNT(*) FROM users WHERE username IN ('roleless', 'dangling')").Scan(&users)
+	if links != 0 || users != 2 {
+		t.Errorf("Expected the link deleted and both users kept, got %d links and %d users", links, users)
+	}
+
+	orphans, err = repo.FindOrphans()
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	if len(orphans) != 2 {
+		t.Errorf("Expected only the two users to remain reported, got %+v", orphans)
+	}
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+// Writers of a service's address, stored in services.ip_source.
+const (
+	IPSourceDNS    = "dns"
+	IPSourceDocker = "docker"
+)
+
+// IPAuthority decides between the Docker watcher and hostname resolution when they disagree on a
+// service's address, e.g. DNS answering with a load balancer VIP while Docker reports the container
+// IP. The Preferred source may always replace the address; the other may only replace an address
+// the Preferred source wrote once it is at least Hold old, so the two do not undo each other on
+// every event.
+type IPAuthority struct {
+	Preferred string
+	Hold      time.Duration
+}
+
+var (
+	ipAuthorityMu sync.RWMutex
+	ipAuthority   = IPAuthority{Preferred: IPSourceDocker, Hold: 10 * time.Minute}
+)
+
+// SetIPAuthority sets the rule UpdateIPPort applies between address writers.
+func SetIPAuthority(a IPAuthority) {
+	ipAuthorityMu.Lock()
+	defer ipAuthorityMu.Unlock()
+	ipAuthority = a
+}
+
+func currentIPAuthority() IPAuthority {
+	ipAuthorityMu.RLock()
+	defer ipAuthorityMu.RUnlock()
+	return ipAuthority
+}
+
+// allows reports whether writer may replace an address lastWriter stored at lastWrite.
+func (a IPAuthority) allows(writer, lastWriter string, lastWrite, now time.Time) bool {
+	if writer == a.Preferred || lastWriter != a.Preferred || lastWrite.IsZero() {
+		return true
+	}
+	return now.Sub(lastWrite) >= a.Hold
+}
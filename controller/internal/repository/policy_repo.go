@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"Aegis/controller/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// PolicyServiceTarget is a service from a policy document with its hostname resolved.
+type PolicyServiceTarget struct {
+	models.PolicyService
+	Ip   uint32
+	Port uint16
+}
+
+// PolicyImport is a validated policy document ready to be applied.
+type PolicyImport struct {
+	Roles        []models.PolicyRole
+	Services     []PolicyServiceTarget
+	RoleServices []models.PolicyRoleService
+	UserServices []models.PolicyUserService
+}
+
+// PolicyRepository reads and applies the access model as a whole.
+type PolicyRepository interface {
+	Export() (*models.PolicyDocument, error)
+	Apply(in PolicyImport, dryRun bool) (*models.PolicyReport, error)
+}
+
+type policyRepo struct {
+	db                   *sql.DB
+	stmtExportRoles      *stmt
+	stmtExportServices   *stmt
+	stmtExportRoleLinks  *stmt
+	stmtExportExtraLinks *stmt
+}
+
+// NewPolicyRepository prepares all statements and returns a PolicyRepository.
+func NewPolicyRepository(db *sql.DB) (PolicyRepository, error) {
+	r := &policyRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
+	}
+	track(db, r)
+	return r, nil
+}
+
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *policyRepo) rebind(db *sql.DB) error {
+	r.db = db
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtExportRoles:    {"policy.ExportRoles", "SELECT name, COALESCE(description, '') FROM roles ORDER BY name"},
+		&r.stmtExportServices: {"policy.ExportServices", "SELECT name, hostname, COALESCE(description, ''), agent FROM services ORDER BY name"},
+		&r.stmtExportRoleLinks: {"policy.ExportRoleLinks", `SELECT r.name, s.name FROM role_services rs
+			JOIN roles r ON r.id = rs.role_id JOIN services s ON s.id = rs.service_id ORDER BY r.name, s.name`},
+		&r.stmtExportExtraLinks: {"policy.ExportExtraLinks", `SELECT u.username, s.name FROM user_extra_services ues
+			JOIN users u ON u.id = ues.user_id JOIN services s ON s.id = ues.service_id ORDER BY u.username, s.name`},
+	})
+}
+
+// Export returns the current access model ordered by name.
+func (r *policyRepo) Export() (*models.PolicyDocument, error) {
+	doc := &models.PolicyDocument{
+		Version:      models.PolicyVersion,
+		Roles:        make([]models.PolicyRole, 0),
+		Services:     make([]models.PolicyService, 0),
+		RoleServices: make([]models.PolicyRoleService, 0),
+		UserServices: make([]models.PolicyUserService, 0),
+	}
+	err := scanAll(r.stmtExportRoles, func(rows *sql.Rows) error {
+		var role models.PolicyRole
+		if err := rows.Scan(&role.Name, &role.Description); err != nil {
+			return err
+		}
+		doc.Roles = append(doc.Roles, role)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanAll(r.stmtExportServices, func(rows *sql.Rows) error {
+		var svc models.PolicyService
+		if err := rows.Scan(&svc.Name, &svc.Hostname, &svc.Description, &svc.Agent); err != nil {
+			return err
+		}
+		doc.Services = append(doc.Services, svc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanAll(r.stmtExportRoleLinks, func(rows *sql.Rows) error {
+		var link models.PolicyRoleService
+		if err := rows.Scan(&link.Role, &link.Service); err != nil {
+			return err
+		}
+		doc.RoleServices = append(doc.RoleServices, link)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanAll(r.stmtExportExtraLinks, func(rows *sql.Rows) error {
+		var link models.PolicyUserService
+		if err := rows.Scan(&link.User, &link.Service); err != nil {
+			return err
+		}
+		doc.UserServices = append(doc.UserServices, link)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// scanAll runs s with args and calls fn for every row.
+func scanAll(s *stmt, fn func(*sql.Rows) error, args ...any) error {
+	rows, err := s.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Apply creates or updates roles and services by name and adds the listed links, all in one
+// transaction. Links that reference a role, service or user that does not exist once the roles and
+// services are applied are reported as conflicts. The transaction is only committed when there are
+// no conflicts and dryRun is false, so the report of a dry run shows exactly what an import would do.
+func (r *policyRepo) Apply(in PolicyImport, dryRun bool) (*models.PolicyReport, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	report := &models.PolicyReport{DryRun: dryRun}
+
+	for _, role := range in.Roles {
+		var id int
+		var desc string
+		err := tx.QueryRow("SELECT id, COALESCE(description, '') FROM roles WHERE name = ? COLLATE NOCASE", role.Name).Scan(&id, &desc)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err := tx.Exec("INSERT INTO roles (name, description) VALUES (?, ?)", role.Name, role.Description); err != nil {
+				return nil, fmt.Errorf("failed to create role %q: %w", role.Name, err)
+			}
+			report.Roles.Created = append(report.Roles.Created, role.Name)
+		case err != nil:
+			return nil, err
+		case desc != role.Description:
+			if _, err := tx.Exec("UPDATE roles SET description = ? WHERE id = ?", role.Description, id); err != nil {
+				return nil, fmt.Errorf("failed to update role %q: %w", role.Name, err)
+			}
+			report.Roles.Updated = append(report.Roles.Updated, role.Name)
+		default:
+			report.Roles.Unchanged = append(report.Roles.Unchanged, role.Name)
+		}
+	}
+
+	for _, svc := range in.Services {
+		var id int
+		var cur PolicyServiceTarget
+		err := tx.QueryRow("SELECT id, hostname, ip, port, COALESCE(description, ''), agent FROM services WHERE name = ? COLLATE NOCASE", svc.Name).
+			Scan(&id, &cur.Hostname, &cur.Ip, &cur.Port, &cur.Description, &cur.Agent)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err := tx.Exec("INSERT INTO services (name, hostname, ip, port, description, agent) VALUES (?, ?, ?, ?, ?, ?)",
+				svc.Name, svc.Hostname, svc.Ip, svc.Port, svc.Description, svc.Agent); err != nil {
+				return nil, fmt.Errorf("failed to create service %q: %w", svc.Name, err)
+			}
+			report.Services.Created = append(report.Services.Created, svc.Name)
+		case err != nil:
+			return nil, err
+		case cur.Hostname != svc.Hostname || cur.Ip != svc.Ip || cur.Port != svc.Port || cur.Description != svc.Description || cur.Agent != svc.Agent:
+			if _, err := tx.Exec("UPDATE services SET hostname = ?, ip = ?, port = ?, description = ?, agent = ? WHERE id = ?",
+				svc.Hostname, svc.Ip, svc.Port, svc.Description, svc.Agent, id); err != nil {
+				return nil, fmt.Errorf("failed to update service %q: %w", svc.Name, err)
+			}
+			report.Services.Updated = append(report.Services.Updated, svc.Name)
+		default:
+			report.Services.Unchanged = append(report.Services.Unchanged, svc.Name)
+		}
+	}
+
+	for i, link := range in.RoleServices {
+		roleID, svcID, conflict, err := lookupLink(tx, "role", "SELECT id FROM roles WHERE name = ? COLLATE NOCASE", link.Role, link.Service)
+		if err != nil {
+			return nil, err
+		}
+		if conflict != "" {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("role_services[%d]: %s", i, conflict))
+			continue
+		}
+		res, err := tx.Exec("INSERT OR IGNORE INTO role_services (role_id, service_id) VALUES (?, ?)", roleID, svcID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to link service %q to role %q: %w", link.Service, link.Role, err)
+		}
+		addLinkChange(&report.RoleServices, res, link.Role+"/"+link.Service)
+	}
+
+	for i, link := range in.UserServices {
+		userID, svcID, conflict, err := lookupLink(tx, "user", "SELECT id FROM users WHERE username = ?", link.User, link.Service)
+		if err != nil {
+			return nil, err
+		}
+		if conflict != "" {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("user_services[%d]: %s", i, conflict))
+			continue
+		}
+		res, err := tx.Exec("INSERT OR IGNORE INTO user_extra_services (user_id, service_id) VALUES (?, ?)", userID, svcID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant service %q to user %q: %w", link.Service, link.User, err)
+		}
+		addLinkChange(&report.UserServices, res, link.User+"/"+link.Service)
+	}
+
+	if len(report.Conflicts) > 0 || dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	servicesVersion.Add(1)
+	report.Applied = true
+	return report, nil
+}
+
+// lookupLink resolves both ends of a link inside tx. A missing end is returned as a conflict message.
+func lookupLink(tx *sql.Tx, kind, ownerQuery, owner, service string) (int, int, string, error) {
+	var ownerID, svcID int
+	err := tx.QueryRow(ownerQuery, owner).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, fmt.Sprintf("unknown %s %q", kind, owner), nil
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+	err = tx.QueryRow("SELECT id FROM services WHERE name = ? COLLATE NOCASE", service).Scan(&svcID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, fmt.Sprintf("unknown service %q", service), nil
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+	return ownerID, svcID, "", nil
+}
+
+// addLinkChange records a link insert as created, or as unchanged if the link already existed.
+func addLinkChange(changes *models.PolicyChanges, res sql.Result, name string) {
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		changes.Created = append(changes.Created, name)
+	} else {
+		changes.Unchanged = append(changes.Unchanged, name)
+	}
+}
@@ -3,57 +3,76 @@ package repository
 import (
 	"Aegis/controller/internal/models"
 	"database/sql"
-	"fmt"
+	"slices"
+	"strings"
 )
 
 // RoleRepository defines all data access operations for roles.
 type RoleRepository interface {
-	GetAll() ([]models.Role, error)
-	Create(name, description string) (int64, error)
+	GetAll(sort Sort) ([]models.Role, error)
+	Create(name, description string, maxTTL *int, capabilities []string) (int64, error)
+	SetCapabilities(roleID int, capabilities []string) error
+	SetMaxTTL(roleID int, maxTTL *int) (int64, error)
+	GetName(id int) (string, error)
 	Delete(id int) (int64, error)
 	GetServices(roleID int) ([]models.Service, error)
 	AddService(roleID, serviceID int) error
-	RemoveService(roleID, serviceID int) error
+	RemoveService(roleID, serviceID int) (int64, error)
 	GetIDByName(name string) (int, error)
+	Exists(id int) (bool, error)
+	ServiceExists(serviceID int) (bool, error)
 }
 
 type roleRepo struct {
 	db                *sql.DB
-	stmtGetAll        *sql.Stmt
-	stmtCreate        *sql.Stmt
-	stmtDelete        *sql.Stmt
-	stmtGetServices   *sql.Stmt
-	stmtAddService    *sql.Stmt
-	stmtRemoveService *sql.Stmt
-	stmtGetIDByName   *sql.Stmt
+	stmtGetAll        sortedStmts
+	stmtDelete        *stmt
+	stmtSetMaxTTL     *stmt
+	stmtGetServices   *stmt
+	stmtAddService    *stmt
+	stmtRemoveService *stmt
+	stmtGetIDByName   *stmt
+	stmtGetName       *stmt
+	stmtExists        *stmt
+	stmtServiceExists *stmt
 }
 
 // NewRoleRepository prepares all statements and returns RoleRepository.
 func NewRoleRepository(db *sql.DB) (RoleRepository, error) {
-	r := &roleRepo{db: db}
-	var err error
-
-	queries := map[**sql.Stmt]string{
-		&r.stmtGetAll:        "SELECT id, name, description FROM roles",
-		&r.stmtCreate:        "INSERT INTO roles (name, description) VALUES (?, ?)",
-		&r.stmtDelete:        "DELETE FROM roles WHERE id = ?",
-		&r.stmtGetServices:   "SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at FROM services s INNER JOIN role_services rs ON s.id = rs.service_id WHERE rs.role_id = ?",
-		&r.stmtAddService:    "INSERT OR IGNORE INTO role_services (role_id, service_id) VALUES (?, ?)",
-		&r.stmtRemoveService: "DELETE FROM role_services WHERE role_id = ? AND service_id = ?",
-		&r.stmtGetIDByName:   "SELECT id FROM roles WHERE name = ?",
-	}
-
-	for stmt, query := range queries {
-		*stmt, err = db.Prepare(query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to prepare query %q: %w", query, err)
-		}
+	r := &roleRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
 	}
+	track(db, r)
 	return r, nil
 }
 
-func (r *roleRepo) GetAll() ([]models.Role, error) {
-	rows, err := r.stmtGetAll.Query()
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *roleRepo) rebind(db *sql.DB) error {
+	r.db = db
+	if err := prepareSorted(db, &r.stmtGetAll, "roles.GetAll", `SELECT id, name, description, max_ttl,
+		COALESCE((SELECT GROUP_CONCAT(capability) FROM role_capabilities rc WHERE rc.role_id = roles.id), '') FROM roles`, RoleSortColumns); err != nil {
+		return err
+	}
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtDelete:        {"roles.Delete", "DELETE FROM roles WHERE id = ?"},
+		&r.stmtSetMaxTTL:     {"roles.SetMaxTTL", "UPDATE roles SET max_ttl = ? WHERE id = ?"},
+		&r.stmtGetServices:   {"roles.GetServices", "SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at FROM services s INNER JOIN role_services rs ON s.id = rs.service_id WHERE rs.role_id = ?"},
+		&r.stmtAddService:    {"roles.AddService", "INSERT OR IGNORE INTO role_services (role_id, service_id) VALUES (?, ?)"},
+		&r.stmtRemoveService: {"roles.RemoveService", "DELETE FROM role_services WHERE role_id = ? AND service_id = ?"},
+		&r.stmtGetIDByName:   {"roles.GetIDByName", "SELECT id FROM roles WHERE name = ? COLLATE NOCASE"},
+		&r.stmtGetName:       {"roles.GetName", "SELECT name FROM roles WHERE id = ?"},
+		&r.stmtExists:        {"roles.Exists", "SELECT EXISTS(SELECT 1 FROM roles WHERE id = ?)"},
+		&r.stmtServiceExists: {"roles.ServiceExists", "SELECT EXISTS(SELECT 1 FROM services WHERE id = ?)"},
+	})
+}
+
+func (r *roleRepo) GetAll(sort Sort) ([]models.Role, error) {
+	st, err := r.stmtGetAll.get(sort)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.Query()
 	if err != nil {
 		return nil, err
 	}
@@ -62,21 +81,94 @@ func (r *roleRepo) GetAll() ([]models.Role, error) {
 	for rows.Next() {
 		var role models.Role
 		var desc sql.NullString
-		if err := rows.Scan(&role.Id, &role.Name, &desc); err != nil {
+		var maxTTL sql.NullInt64
+		var caps string
+		if err := rows.Scan(&role.Id, &role.Name, &desc, &maxTTL, &caps); err != nil {
 			continue
 		}
 		role.Description = desc.String
+		if maxTTL.Valid {
+			ttl := int(maxTTL.Int64)
+			role.MaxTTL = &ttl
+		}
+		role.Capabilities = splitCapabilities(caps)
 		roles = append(roles, role)
 	}
 	return roles, rows.Err()
 }
 
-func (r *roleRepo) Create(name, description string) (int64, error) {
-	res, err := r.stmtCreate.Exec(name, description)
+// splitCapabilities turns a GROUP_CONCAT of capabilities into a sorted list.
+func splitCapabilities(concat string) []string {
+	caps := []string{}
+	if concat != "" {
+		caps = strings.Split(concat, ",")
+		slices.Sort(caps)
+	}
+	return caps
+}
+
+// Create stores a role and its capabilities in one transaction. A nil maxTTL leaves the role's sessions
+// without a limit.
+func (r *roleRepo) Create(name, description string, maxTTL *int, capabilities []string) (int64, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("INSERT INTO roles (name, description, max_ttl) VALUES (?, ?, ?)", name, description, maxTTL)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := insertCapabilities(tx, id, capabilities); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// SetCapabilities replaces the capabilities of a role in one transaction.
+func (r *roleRepo) SetCapabilities(roleID int, capabilities []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec("DELETE FROM role_capabilities WHERE role_id = ?", roleID); err != nil {
+		return err
+	}
+	if err := insertCapabilities(tx, int64(roleID), capabilities); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetMaxTTL sets the longest idle timeout of the sessions of the role's users; nil removes the limit.
+func (r *roleRepo) SetMaxTTL(roleID int, maxTTL *int) (int64, error) {
+	res, err := r.stmtSetMaxTTL.Exec(maxTTL, roleID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func insertCapabilities(tx *sql.Tx, roleID int64, capabilities []string) error {
+	for _, capability := range capabilities {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO role_capabilities (role_id, capability) VALUES (?, ?)", roleID, capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *roleRepo) GetName(id int) (string, error) {
+	var name string
+	err := r.stmtGetName.QueryRow(id).Scan(&name)
+	return name, err
 }
 
 func (r *roleRepo) Delete(id int) (int64, error) {
@@ -97,7 +189,7 @@ func (r *roleRepo) GetServices(roleID int) ([]models.Service, error) {
 	for rows.Next() {
 		var s models.Service
 		var desc sql.NullString
-		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, &s.CreatedAt); err != nil {
+		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, utcTime{&s.CreatedAt}); err != nil {
 			continue
 		}
 		s.Description = desc.String
@@ -111,9 +203,12 @@ func (r *roleRepo) AddService(roleID, serviceID int) error {
 	return err
 }
 
-func (r *roleRepo) RemoveService(roleID, serviceID int) error {
-	_, err := r.stmtRemoveService.Exec(roleID, serviceID)
-	return err
+func (r *roleRepo) RemoveService(roleID, serviceID int) (int64, error) {
+	res, err := r.stmtRemoveService.Exec(roleID, serviceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 func (r *roleRepo) GetIDByName(name string) (int, error) {
@@ -121,3 +216,15 @@ func (r *roleRepo) GetIDByName(name string) (int, error) {
 	err := r.stmtGetIDByName.QueryRow(name).Scan(&id)
 	return id, err
 }
+
+func (r *roleRepo) Exists(id int) (bool, error) {
+	var exists bool
+	err := r.stmtExists.QueryRow(id).Scan(&exists)
+	return exists, err
+}
+
+func (r *roleRepo) ServiceExists(serviceID int) (bool, error) {
+	var exists bool
+	err := r.stmtServiceExists.QueryRow(serviceID).Scan(&exists)
+	return exists, err
+}
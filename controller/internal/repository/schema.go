@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"Aegis/controller/data"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// CurrentSchemaVersion is the schema version produced by ApplySchema and expected by the repositories.
+const CurrentSchemaVersion = "1.4"
+
+// ApplySchema runs the production schema scripts against an empty database.
+func ApplySchema(db *sql.DB) error {
+	scripts, err := data.Schema()
+	if err != nil {
+		return err
+	}
+	for i, script := range scripts {
+		if _, err := db.Exec(script); err != nil {
+			return fmt.Errorf("failed to apply schema script %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// DetectSchemaVersion infers the schema version of db from the tables and columns the migrations add.
+func DetectSchemaVersion(db *sql.DB) (string, error) {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('users', 'services')").Scan(&n); err != nil {
+		return "", err
+	}
+	if n < 2 {
+		return "", fmt.Errorf("database has no Aegis schema")
+	}
+
+	checks := []struct {
+		version string
+		query   string
+	}{
+		{"1.4", "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'api_tokens'"},
+		{"1.3", "SELECT COUNT(*) FROM pragma_table_info('services') WHERE name = 'agent'"},
+		{"1.2", "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'refresh_tokens'"},
+		{"1.1.1", "SELECT COUNT(*) FROM pragma_table_info('services') WHERE name = 'port'"},
+		{"1.1", "SELECT COUNT(*) FROM pragma_table_info('services') WHERE name = 'hostname'"},
+	}
+	for _, c := range checks {
+		if err := db.QueryRow(c.query).Scan(&n); err != nil {
+			return "", err
+		}
+		if n > 0 {
+			return c.version, nil
+		}
+	}
+	return "1.0", nil
+}
+
+// NameCaseCollisions lists the service and role names that differ only in case, one group per line
+// such as `services: Prod, prod`. The case-insensitive unique indexes of schema 1.4 cannot be built
+// while any exist.
+func NameCaseCollisions(db *sql.DB) ([]string, error) {
+	var out []string
+	for _, table := range []string{"services", "roles"} {
+		groups, err := caseCollisions(db, table, "name")
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			out = append(out, table+": "+g)
+		}
+	}
+	return out, nil
+}
+
+// UsernameCaseCollisions lists the usernames that differ only in case, one group per line such as
+// `Alice, alice`, and counts the usernames that are not lowercase. Both must be resolved before
+// auth.case_insensitive_usernames is enabled, since only lowercase usernames can then sign in.
+func UsernameCaseCollisions(db *sql.DB) ([]string, int, error) {
+	groups, err := caseCollisions(db, "users", "username")
+	if err != nil {
+		return nil, 0, err
+	}
+	var mixed int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username != lower(username)").Scan(&mixed); err != nil {
+		return nil, 0, err
+	}
+	return groups, mixed, nil
+}
+
+// caseCollisions returns the values of column in table that differ only in case, one
+// comma-separated group per entry.
+func caseCollisions(db *sql.DB, table, column string) ([]string, error) {
+	rows, err := db.Query("SELECT GROUP_CONCAT(" + column + ", ', ') FROM (SELECT " + column + " FROM " + table + " ORDER BY " + column + ") GROUP BY " + column + " COLLATE NOCASE HAVING COUNT(*) > 1 ORDER BY MIN(" + column + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var out []string
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		out = append(out, group)
+	}
+	return out, rows.Err()
+}
+
+// OpenReadOnly opens dir/aegis.db without creating or modifying it.
+func OpenReadOnly(dir string) (*sql.DB, error) {
+	dbPath := DBPath(dir)
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+}
+
+// SetupTestStmt creates dir/aegis.db with the production schema, sets it as the global DB and
+// checks that every repository's statements prepare against it. It is meant for tests only.
+func SetupTestStmt(dir string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", DBPath(dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open test database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	if err := ApplySchema(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA foreign_keys = ON;"); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+	}
+	for _, r := range []rebinder{&userRepo{}, &roleRepo{}, &serviceRepo{}, &policyRepo{}, &tokenRepo{}, &integrityRepo{}} {
+		if err := r.rebind(db); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	DB = db
+	servicesVersion.Add(1)
+	return db, nil
+}
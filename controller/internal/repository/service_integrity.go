@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/utils"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+// MalformedServiceError reports a service whose stored address cannot be used.
+type MalformedServiceError struct {
+	Issues []models.ServiceIssue
+}
+
+func (e *MalformedServiceError) Error() string {
+	problems := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		problems = append(problems, issue.Problem)
+	}
+	return fmt.Sprintf("service ID %d is malformed: %s", e.Issues[0].ServiceID, strings.Join(problems, "; "))
+}
+
+// storedService is a services row with its address columns as SQLite returned them, so that values
+// which do not fit their Go types can still be read and reported.
+type storedService struct {
+	id                              int
+	name, hostname, agent, destType string
+	ip, port, portRangeEnd          any
+}
+
+// storedServiceColumns lists the columns scan expects, in order.
+const storedServiceColumns = "id, name, hostname, ip, port, port_range_end, agent, destination_type"
+
+func (s *storedService) scan(row interface{ Scan(...any) error }) error {
+	return row.Scan(&s.id, &s.name, &s.hostname, &s.ip, &s.port, &s.portRangeEnd, &s.agent, &s.destType)
+}
+
+// address returns the service with its stored address, and an issue for every address column that
+// is malformed. The service must not be used for enforcement unless there are no issues.
+func (s *storedService) address() (models.Service, []models.ServiceIssue) {
+	svc := models.Service{Id: s.id, Name: s.name, Hostname: s.hostname, Agent: s.agent, DestType: s.destType}
+	var issues []models.ServiceIssue
+	resave := fmt.Sprintf("Save the service with PUT /api/services/%d to resolve its hostname again", s.id)
+
+	if ip, ok := s.ip.(int64); ok && ip >= 0 && ip <= math.MaxUint32 {
+		svc.Ip = uint32(ip)
+	} else {
+		issues = append(issues, s.issue("ip", s.ip, "ip is not an IPv4 address", resave))
+	}
+	if port, ok := s.port.(int64); ok && port >= 1 && port <= math.MaxUint16 {
+		svc.Port = uint16(port)
+	} else {
+		issues = append(issues, s.issue("port", s.port, "port is not between 1 and 65535", resave))
+	}
+	end, ok := s.portRangeEnd.(int64)
+	switch {
+	case !ok || end < 0 || end > math.MaxUint16:
+		issues = append(issues, s.issue("port_range_end", s.portRangeEnd, "port_range_end is not a port",
+			fmt.Sprintf("Save the service with PUT /api/services/%d and a valid port_range_end, or 0 for a single port", s.id)))
+	case end != 0 && svc.Port != 0 && (end < int64(svc.Port) || end-int64(svc.Port) >= models.MaxPortRangePorts):
+		issues = append(issues, s.issue("port_range_end", s.portRangeEnd,
+			fmt.Sprintf("port_range_end does not end a range of at most %d ports starting at port", models.MaxPortRangePorts),
+			fmt.Sprintf("Save the service with PUT /api/services/%d and a valid port_range_end, or 0 for a single port", s.id)))
+	default:
+		svc.PortRangeEnd = uint16(end)
+	}
+
+	switch s.destType {
+	case models.DestinationHost:
+	case models.DestinationCIDR:
+		// The network is read from the hostname, which ip and port were stored from.
+		prefix, _, err := utils.ParseCIDRDestination(s.hostname)
+		if err != nil {
+			issues = append(issues, s.issue("hostname", s.hostname, "hostname is not in network/bits:port form",
+				fmt.Sprintf("Save the service with PUT /api/services/%d and a network/bits:port hostname", s.id)))
+			break
+		}
+		svc.PrefixLen = prefix.Bits()
+		if rules := svc.Addresses() * (int(svc.LastPort()) - int(svc.Port) + 1); rules > models.MaxPortRangePorts {
+			issues = append(issues, s.issue("hostname", s.hostname,
+				fmt.Sprintf("network and port range cover %d rules, more than %d", rules, models.MaxPortRangePorts),
+				fmt.Sprintf("Save the service with PUT /api/services/%d and a smaller network or port range", s.id)))
+		}
+	default:
+		issues = append(issues, s.issue("destination_type", s.destType, "destination_type is neither host nor cidr",
+			fmt.Sprintf("Save the service with PUT /api/services/%d and a destination_type of host or cidr", s.id)))
+	}
+	return svc, issues
+}
+
+// issues returns every malformed column of the row, including the hostname that addresses are
+// resolved from.
+func (s *storedService) issues() []models.ServiceIssue {
+	_, issues := s.address()
+	if s.destType == models.DestinationCIDR {
+		return issues
+	}
+	if _, _, err := net.SplitHostPort(s.hostname); err != nil {
+		issues = append(issues, s.issue("hostname", s.hostname, "hostname is not in host:port form",
+			fmt.Sprintf("Save the service with PUT /api/services/%d and a host:port hostname", s.id)))
+	}
+	return issues
+}
+
+func (s *storedService) issue(field string, value any, problem, repair string) models.ServiceIssue {
+	v := "NULL"
+	switch value := value.(type) {
+	case nil:
+	case []byte:
+		v = string(value)
+	default:
+		v = fmt.Sprint(value)
+	}
+	return models.ServiceIssue{ServiceID: s.id, ServiceName: s.name, Field: field, Value: v, Problem: problem, Repair: repair}
+}
+
+// GetIntegrityIssues checks every stored service and returns its malformed values, ordered by service.
+func (r *serviceRepo) GetIntegrityIssues() ([]models.ServiceIssue, error) {
+	issues := make([]models.ServiceIssue, 0)
+	err := scanAll(r.stmtGetStored, func(rows *sql.Rows) error {
+		var s storedService
+		if err := s.scan(rows); err != nil {
+			return err
+		}
+		issues = append(issues, s.issues()...)
+		return nil
+	})
+	return issues, err
+}
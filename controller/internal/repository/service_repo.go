@@ -2,8 +2,14 @@ package repository
 
 import (
 	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/utils"
 	"database/sql"
 	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,121 +20,310 @@ type ActiveSessionSync struct {
 	TimeLeft  int
 }
 
+// ActiveSessionKey identifies one row of user_active_services.
+type ActiveSessionKey struct {
+	UserID    int
+	ServiceID int
+}
+
+// SessionDiff lists the active sessions a sync inserted, updated (remaining time changed) or deleted.
+// Each list is sorted by user and then service.
+type SessionDiff struct {
+	Inserted []ActiveSessionKey
+	Updated  []ActiveSessionKey
+	Deleted  []ActiveSessionKey
+}
+
+// Empty reports whether the sync changed nothing.
+func (d SessionDiff) Empty() bool {
+	return len(d.Inserted) == 0 && len(d.Updated) == 0 && len(d.Deleted) == 0
+}
+
 // HostnameSyncEntry holds service data for hostname-to-IP synchronisation.
 type HostnameSyncEntry struct {
 	ID          int
 	Hostname    string
 	CurrentIP   uint32
 	CurrentPort uint16
+	Agent       string
+	// ResolvedIPs is the sorted address set the hostname resolved to when it was last synced, nil
+	// if it has not been synced yet.
+	ResolvedIPs []uint32
+}
+
+// PendingActivation is a selection queued while the agent enforcing the service was unreachable.
+type PendingActivation struct {
+	UserID      int
+	RoleID      int
+	ServiceID   int
+	ClientIP    string
+	RequestedAt time.Time
+}
+
+// ActiveClient is the client an active session was opened for, with the max_ttl of the user's role.
+type ActiveClient struct {
+	IP     string
+	MaxTTL *int
+}
+
+// ServiceKey identifies a service by the agent enforcing it and its "ip:port" address.
+type ServiceKey struct {
+	Agent string
+	Addr  string
 }
 
 // ServiceRepository defines all data access operations for services.
 type ServiceRepository interface {
-	GetAll() ([]models.Service, error)
-	Create(name, hostname string, ip uint32, port uint16, description string) (int64, error)
-	Update(id int, name, hostname string, ip uint32, port uint16, description string) (int64, error)
+	GetAll(sort Sort) ([]models.Service, error)
+	GetPage(sort Sort, after *Cursor, limit int) ([]models.Service, *Cursor, error)
+	GetUnassigned() ([]models.Service, error)
+	Create(name, hostname, destType string, ip uint32, port, portRangeEnd uint16, description, agent string, requiresStepUp bool) (int64, error)
+	GrantRole(serviceID, roleID int) error
+	Update(id int, name, hostname, destType string, ip uint32, port, portRangeEnd uint16, description, agent string, requiresStepUp bool) (int64, error)
 	Delete(id int) (int64, error)
-	GetIPPort(id int) (uint32, uint16, error)
-	GetServiceMap() (map[string]int, error)
+	SetContainer(id int, container string) (int64, error)
+	GetTarget(id int) (models.Service, error)
+	GetHostname(id int) (string, error)
+	RequiresStepUp(id int) (bool, error)
+	GetServiceMap() (map[ServiceKey]int, error)
+	GetIntegrityIssues() ([]models.ServiceIssue, error)
 	GetActiveServiceUsers() (map[int][]int, error)
-	InsertActiveService(userID, serviceID, timeLeft int) error
+	GetActiveTargets(agent string) ([]models.Service, error)
+	GetActiveClients(agent string) (map[int][]ActiveClient, error)
+	GetRoleMaxTTL(userID int) (*int, error)
+	InsertActiveService(userID, serviceID, timeLeft int, clientIP string) error
 	DeleteActiveService(userID, serviceID int) error
-	SyncActiveSessions(sessions []ActiveSessionSync) error
+	CountActiveServices() (int, error)
+	IsActiveService(userID, serviceID int) (bool, error)
+	QueueActivation(userID, serviceID int, clientIP string) error
+	GetPendingActivations() ([]PendingActivation, error)
+	DeletePendingActivation(userID, serviceID int) error
+	SyncActiveSessions(sessions []ActiveSessionSync) (SessionDiff, error)
 	GetUserServices(userID, roleID int) ([]models.Service, error)
 	GetUserActiveServices(userID int) ([]models.ActiveService, error)
 	CheckUserServiceAccess(userID, roleID, serviceID int) (bool, error)
 	ListForIPSync() ([]HostnameSyncEntry, error)
-	UpdateIPPort(id int, ip uint32, port uint16) error
+	UpdateIPPort(id int, ip uint32, port uint16, source string) (bool, error)
+	UpdateResolvedIPs(id int, ips []uint32) error
 }
 
 type serviceRepo struct {
 	db                        *sql.DB
-	stmtGetAll                *sql.Stmt
-	stmtCreate                *sql.Stmt
-	stmtDelete                *sql.Stmt
-	stmtGetIPPort             *sql.Stmt
-	stmtGetServiceMap         *sql.Stmt
-	stmtGetActiveUsers        *sql.Stmt
-	stmtInsertActive          *sql.Stmt
-	stmtDeleteActive          *sql.Stmt
-	stmtGetUserServices       *sql.Stmt
-	stmtGetUserActiveServices *sql.Stmt
-	stmtCheckAccess           *sql.Stmt
-	stmtListForIPSync         *sql.Stmt
-	stmtUpdateIPPort          *sql.Stmt
+	stmtGetAll                sortedStmts
+	stmtGetPage               sortedStmts
+	stmtGetUnassigned         *stmt
+	stmtCreate                *stmt
+	stmtGrantRole             *stmt
+	stmtDelete                *stmt
+	stmtSetContainer          *stmt
+	stmtGetTarget             *stmt
+	stmtGetHostname           *stmt
+	stmtRequiresStepUp        *stmt
+	stmtGetStored             *stmt
+	stmtGetActiveUsers        *stmt
+	stmtGetActiveTargets      *stmt
+	stmtGetActiveClients      *stmt
+	stmtGetRoleMaxTTL         *stmt
+	stmtInsertActive          *stmt
+	stmtDeleteActive          *stmt
+	stmtCountActive           *stmt
+	stmtIsActive              *stmt
+	stmtQueueActivation       *stmt
+	stmtGetPending            *stmt
+	stmtDeletePending         *stmt
+	stmtGetUserPending        *stmt
+	stmtGetUserServices       *stmt
+	stmtGetUserActiveServices *stmt
+	stmtCheckAccess           *stmt
+	stmtListForIPSync         *stmt
+	stmtGetIPSource           *stmt
+	stmtUpdateIPPort          *stmt
+	stmtUpdateResolvedIPs     *stmt
 }
 
 // NewServiceRepository prepares all statements and returns a ServiceRepository.
 func NewServiceRepository(db *sql.DB) (ServiceRepository, error) {
-	r := &serviceRepo{db: db}
-	var err error
-
-	queries := map[**sql.Stmt]string{
-		&r.stmtGetAll:         "SELECT id, name, hostname, ip, port, description, created_at FROM services",
-		&r.stmtCreate:         "INSERT INTO services (name, hostname, ip, port, description) VALUES (?, ?, ?, ?, ?)",
-		&r.stmtDelete:         "DELETE FROM services WHERE id = ?",
-		&r.stmtGetIPPort:      "SELECT ip, port FROM services WHERE id = ?",
-		&r.stmtGetServiceMap:  "SELECT id, ip, port FROM services",
-		&r.stmtGetActiveUsers: "SELECT user_id, service_id FROM user_active_services",
-		&r.stmtInsertActive:   "INSERT OR REPLACE INTO user_active_services (user_id, service_id, updated_at, time_left) VALUES (?, ?, ?, ?)",
-		&r.stmtDeleteActive:   "DELETE FROM user_active_services WHERE user_id = ? AND service_id = ?",
-		&r.stmtGetUserServices: `SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at
+	r := &serviceRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
+	}
+	track(db, r)
+	return r, nil
+}
+
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *serviceRepo) rebind(db *sql.DB) error {
+	r.db = db
+	if err := prepareSorted(db, &r.stmtGetAll, "services.GetAll", serviceListQuery, ServiceSortColumns); err != nil {
+		return err
+	}
+	if err := prepareKeyset(db, &r.stmtGetPage, "services.GetPage", serviceListQuery, ServiceSortColumns); err != nil {
+		return err
+	}
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtGetUnassigned:  {"services.GetUnassigned", "SELECT * FROM (" + serviceListQuery + ") WHERE unassigned ORDER BY id"},
+		&r.stmtGrantRole:      {"services.GrantRole", "INSERT OR IGNORE INTO role_services (role_id, service_id) VALUES (?, ?)"},
+		&r.stmtCreate:         {"services.Create", "INSERT INTO services (name, hostname, destination_type, ip, port, port_range_end, description, agent, requires_step_up) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		&r.stmtDelete:         {"services.Delete", "DELETE FROM services WHERE id = ?"},
+		&r.stmtSetContainer:   {"services.SetContainer", "UPDATE services SET container = ? WHERE id = ?"},
+		&r.stmtGetTarget:      {"services.GetTarget", "SELECT " + storedServiceColumns + " FROM services WHERE id = ?"},
+		&r.stmtGetHostname:    {"services.GetHostname", "SELECT hostname FROM services WHERE id = ?"},
+		&r.stmtRequiresStepUp: {"services.RequiresStepUp", "SELECT requires_step_up FROM services WHERE id = ?"},
+		&r.stmtGetStored:      {"services.GetStored", "SELECT " + storedServiceColumns + " FROM services ORDER BY id"},
+		&r.stmtGetActiveUsers: {"services.GetActiveUsers", "SELECT user_id, service_id FROM user_active_services"},
+		&r.stmtGetActiveTargets: {"services.GetActiveTargets", "SELECT " + storedServiceColumns + ` FROM services
+			WHERE agent = ? AND id IN (SELECT service_id FROM user_active_services) ORDER BY id`},
+		&r.stmtGetActiveClients: {"services.GetActiveClients", `SELECT a.service_id, COALESCE(NULLIF(a.client_ip, ''), u.last_login_ip, ''), r.max_ttl
+			FROM user_active_services a JOIN users u ON u.id = a.user_id JOIN services s ON s.id = a.service_id
+			LEFT JOIN roles r ON r.id = u.role_id
+			WHERE s.agent = ? ORDER BY a.service_id, a.user_id`},
+		&r.stmtGetRoleMaxTTL: {"services.GetRoleMaxTTL", "SELECT r.max_ttl FROM users u JOIN roles r ON r.id = u.role_id WHERE u.id = ?"},
+		&r.stmtInsertActive:  {"services.InsertActive", "INSERT OR REPLACE INTO user_active_services (user_id, service_id, updated_at, time_left, client_ip) VALUES (?, ?, ?, ?, ?)"},
+		&r.stmtDeleteActive:  {"services.DeleteActive", "DELETE FROM user_active_services WHERE user_id = ? AND service_id = ?"},
+		&r.stmtCountActive:   {"services.CountActive", "SELECT COUNT(*) FROM user_active_services"},
+		&r.stmtIsActive:      {"services.IsActive", "SELECT EXISTS(SELECT 1 FROM user_active_services WHERE user_id = ? AND service_id = ?)"},
+		&r.stmtQueueActivation: {"services.QueueActivation", `INSERT OR REPLACE INTO pending_activations (user_id, service_id, client_ip, requested_at)
+			VALUES (?, ?, ?, ?)`},
+		&r.stmtGetPending: {"services.GetPending", `SELECT pa.user_id, u.role_id, pa.service_id, pa.client_ip, pa.requested_at
+			FROM pending_activations pa JOIN users u ON u.id = pa.user_id ORDER BY pa.requested_at`},
+		&r.stmtDeletePending: {"services.DeletePending", "DELETE FROM pending_activations WHERE user_id = ? AND service_id = ?"},
+		&r.stmtGetUserPending: {"services.GetUserPending", `SELECT s.id, s.name, s.hostname, s.destination_type, s.ip, s.port, s.port_range_end, s.description, s.created_at, pa.requested_at
+			FROM services s JOIN pending_activations pa ON s.id = pa.service_id
+			WHERE pa.user_id = ? ORDER BY pa.requested_at DESC`},
+		&r.stmtGetUserServices: {"services.GetUserServices", `SELECT s.id, s.name, s.hostname, s.destination_type, s.ip, s.port, s.port_range_end, s.description, s.created_at
 			FROM services s JOIN role_services rs ON s.id = rs.service_id WHERE rs.role_id = ?
 			UNION
-			SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at
-			FROM services s JOIN user_extra_services ues ON s.id = ues.service_id WHERE ues.user_id = ?`,
-		&r.stmtGetUserActiveServices: `SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at, uas.time_left, uas.updated_at
+			SELECT s.id, s.name, s.hostname, s.destination_type, s.ip, s.port, s.port_range_end, s.description, s.created_at
+			FROM services s JOIN user_extra_services ues ON s.id = ues.service_id WHERE ues.user_id = ?`},
+		&r.stmtGetUserActiveServices: {"services.GetUserActiveServices", `SELECT s.id, s.name, s.hostname, s.destination_type, s.ip, s.port, s.port_range_end, s.description, s.created_at, uas.time_left, uas.updated_at
 			FROM services s JOIN user_active_services uas ON s.id = uas.service_id
-			WHERE uas.user_id = ? ORDER BY uas.updated_at DESC`,
-		&r.stmtCheckAccess: `SELECT 1 FROM role_services WHERE role_id = ? AND service_id = ?
-			UNION SELECT 1 FROM user_extra_services WHERE user_id = ? AND service_id = ?`,
-		&r.stmtListForIPSync: "SELECT id, hostname, ip, port FROM services",
-		&r.stmtUpdateIPPort:  "UPDATE services SET ip = ?, port = ? WHERE id = ?",
-	}
+			WHERE uas.user_id = ? ORDER BY uas.updated_at DESC`},
+		&r.stmtCheckAccess: {"services.CheckAccess", `SELECT 1 FROM role_services WHERE role_id = ? AND service_id = ?
+			UNION SELECT 1 FROM user_extra_services WHERE user_id = ? AND service_id = ?`},
+		&r.stmtListForIPSync:     {"services.ListForIPSync", "SELECT id, hostname, ip, port, agent, resolved_ips FROM services WHERE destination_type = 'host'"},
+		&r.stmtGetIPSource:       {"services.GetIPSource", "SELECT ip_source, ip_updated_at FROM services WHERE id = ?"},
+		&r.stmtUpdateIPPort:      {"services.UpdateIPPort", "UPDATE services SET ip = ?, port = ?, ip_source = ?, ip_updated_at = ? WHERE id = ?"},
+		&r.stmtUpdateResolvedIPs: {"services.UpdateResolvedIPs", "UPDATE services SET resolved_ips = ? WHERE id = ?"},
+	})
+}
 
-	for stmt, query := range queries {
-		*stmt, err = db.Prepare(query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to prepare query %q: %w", query, err)
-		}
+// serviceListQuery selects the columns scanService expects. A service is unassigned while neither a
+// role nor a user is granted it, so nobody can reach it.
+const serviceListQuery = `SELECT id, name, hostname, destination_type, ip, port, port_range_end, description, agent, requires_step_up, container, created_at,
+	NOT EXISTS (SELECT 1 FROM role_services WHERE service_id = services.id)
+	AND NOT EXISTS (SELECT 1 FROM user_extra_services WHERE service_id = services.id) AS unassigned
+	FROM services`
+
+// scanService scans a row of serviceListQuery, followed by extra columns into extra.
+func scanService(rows *sql.Rows, extra ...any) (models.Service, error) {
+	var s models.Service
+	var desc sql.NullString
+	dest := []any{&s.Id, &s.Name, &s.Hostname, &s.DestType, &s.Ip, &s.Port, &s.PortRangeEnd, &desc, &s.Agent, &s.RequiresStepUp, &s.Container, utcTime{&s.CreatedAt}, &s.Unassigned}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return s, err
 	}
-	return r, nil
+	s.Description = desc.String
+	return s, nil
 }
 
-func (r *serviceRepo) GetAll() ([]models.Service, error) {
-	rows, err := r.stmtGetAll.Query()
+func (r *serviceRepo) GetAll(sort Sort) ([]models.Service, error) {
+	st, err := r.stmtGetAll.get(sort)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.Query()
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = rows.Close() }()
 	services := make([]models.Service, 0)
 	for rows.Next() {
-		var s models.Service
-		var desc sql.NullString
-		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, &s.CreatedAt); err != nil {
+		s, err := scanService(rows)
+		if err != nil {
 			continue
 		}
-		s.Description = desc.String
 		services = append(services, s)
 	}
 	return services, rows.Err()
 }
 
-func (r *serviceRepo) Create(name, hostname string, ip uint32, port uint16, description string) (int64, error) {
-	res, err := r.stmtCreate.Exec(name, hostname, ip, port, description)
+// GetUnassigned returns the services no role or user is granted, by ID.
+func (r *serviceRepo) GetUnassigned() ([]models.Service, error) {
+	services := make([]models.Service, 0)
+	err := scanAll(r.stmtGetUnassigned, func(rows *sql.Rows) error {
+		s, err := scanService(rows)
+		if err != nil {
+			return err
+		}
+		services = append(services, s)
+		return nil
+	})
+	return services, err
+}
+
+// GetPage returns up to limit services after the cursor, or from the start when after is nil. The
+// returned cursor marks the last service and is nil when there are no more.
+func (r *serviceRepo) GetPage(sort Sort, after *Cursor, limit int) ([]models.Service, *Cursor, error) {
+	st, err := r.stmtGetPage.get(sort)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := st.Query(pageArgs(after, limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	services := make([]models.Service, 0, limit)
+	var last Cursor
+	for rows.Next() {
+		if len(services) == limit {
+			return services, &last, nil
+		}
+		s, err := scanService(rows, &last.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		last.ID = s.Id
+		services = append(services, s)
+	}
+	return services, nil, rows.Err()
+}
+
+// servicesVersion counts the changes made to the set of services or their hostnames.
+var servicesVersion atomic.Uint64
+
+// ServicesVersion returns a number that changes whenever a service is created, deleted or edited, or
+// the database is replaced, so callers caching service hostnames know when to reload them. Address
+// updates do not change it.
+func ServicesVersion() uint64 {
+	return servicesVersion.Load()
+}
+
+// Create stores a service. destType is one of the models.Destination constants; for a CIDR service
+// ip is the network address.
+func (r *serviceRepo) Create(name, hostname, destType string, ip uint32, port, portRangeEnd uint16, description, agent string, requiresStepUp bool) (int64, error) {
+	res, err := r.stmtCreate.Exec(name, hostname, destType, ip, port, portRangeEnd, description, agent, requiresStepUp)
 	if err != nil {
 		return 0, err
 	}
+	servicesVersion.Add(1)
 	return res.LastInsertId()
 }
 
-func (r *serviceRepo) Update(id int, name, hostname string, ip uint32, port uint16, description string) (int64, error) {
+// GrantRole grants the role access to the service.
+func (r *serviceRepo) GrantRole(serviceID, roleID int) error {
+	_, err := r.stmtGrantRole.Exec(roleID, serviceID)
+	return err
+}
+
+func (r *serviceRepo) Update(id int, name, hostname, destType string, ip uint32, port, portRangeEnd uint16, description, agent string, requiresStepUp bool) (int64, error) {
 	res, err := r.db.Exec(
-		"UPDATE services SET name=?, hostname=?, ip=?, port=?, description=? WHERE id=?",
-		name, hostname, ip, port, description, id)
+		"UPDATE services SET name=?, hostname=?, destination_type=?, ip=?, port=?, port_range_end=?, description=?, agent=?, requires_step_up=? WHERE id=?",
+		name, hostname, destType, ip, port, portRangeEnd, description, agent, requiresStepUp, id)
 	if err != nil {
 		return 0, err
 	}
+	servicesVersion.Add(1)
 	return res.RowsAffected()
 }
 
@@ -137,35 +332,82 @@ func (r *serviceRepo) Delete(id int) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	servicesVersion.Add(1)
+	return res.RowsAffected()
+}
+
+// SetContainer binds a service to a Docker container by ID or name; an empty container removes the
+// binding.
+func (r *serviceRepo) SetContainer(id int, container string) (int64, error) {
+	res, err := r.stmtSetContainer.Exec(container, id)
+	if err != nil {
+		return 0, err
+	}
+	servicesVersion.Add(1)
 	return res.RowsAffected()
 }
 
-func (r *serviceRepo) GetIPPort(id int) (uint32, uint16, error) {
-	var ip uint32
-	var port uint16
-	err := r.stmtGetIPPort.QueryRow(id).Scan(&ip, &port)
-	return ip, port, err
+func (r *serviceRepo) GetHostname(id int) (string, error) {
+	var hostname string
+	err := r.stmtGetHostname.QueryRow(id).Scan(&hostname)
+	return hostname, err
 }
 
-func (r *serviceRepo) GetServiceMap() (map[string]int, error) {
-	rows, err := r.stmtGetServiceMap.Query()
-	if err != nil {
-		return nil, err
+func (r *serviceRepo) RequiresStepUp(id int) (bool, error) {
+	var required bool
+	err := r.stmtRequiresStepUp.QueryRow(id).Scan(&required)
+	return required, err
+}
+
+// GetTarget returns the service with where the agent enforces it: its address, port range, network
+// bits and agent. A malformed stored address is reported as a *MalformedServiceError.
+func (r *serviceRepo) GetTarget(id int) (models.Service, error) {
+	var stored storedService
+	if err := stored.scan(r.stmtGetTarget.QueryRow(id)); err != nil {
+		return models.Service{}, err
 	}
-	defer func() { _ = rows.Close() }()
-	svcMap := make(map[string]int)
-	for rows.Next() {
-		var id int
-		var ip uint32
-		var port uint16
-		if err := rows.Scan(&id, &ip, &port); err != nil {
-			continue
-		}
-		ipStr := fmt.Sprintf("%d.%d.%d.%d", ip>>24, (ip>>16)&0xFF, (ip>>8)&0xFF, ip&0xFF)
-		key := fmt.Sprintf("%s:%d", ipStr, port)
-		svcMap[key] = id
+	s, issues := stored.address()
+	if len(issues) > 0 {
+		return models.Service{}, &MalformedServiceError{Issues: issues}
 	}
-	return svcMap, rows.Err()
+	return s, nil
+}
+
+// GetServiceMap maps the address of every service to its ID. Services with a malformed stored address
+// are logged and left out, since no session can be attributed to them. A CIDR service maps every
+// address of its network, but a host service on the same address and port takes precedence.
+func (r *serviceRepo) GetServiceMap() (map[ServiceKey]int, error) {
+	svcMap := make(map[ServiceKey]int)
+	hosts := make(map[ServiceKey]bool)
+	err := scanAll(r.stmtGetStored, func(rows *sql.Rows) error {
+		var stored storedService
+		if err := stored.scan(rows); err != nil {
+			return err
+		}
+		s, issues := stored.address()
+		if len(issues) > 0 {
+			log.Printf("[WARN] [services] leaving service out of session matching: %v", &MalformedServiceError{Issues: issues})
+			return nil
+		}
+		// Agents report a ranged or CIDR service as one session per address and port, so every one
+		// maps to it.
+		cidr := s.DestType == models.DestinationCIDR
+		for i := range s.Addresses() {
+			ip := s.Ip + uint32(i)
+			ipStr := fmt.Sprintf("%d.%d.%d.%d", ip>>24, (ip>>16)&0xFF, (ip>>8)&0xFF, ip&0xFF)
+			for port := int(s.Port); port <= int(s.LastPort()); port++ {
+				key := ServiceKey{Agent: s.Agent, Addr: fmt.Sprintf("%s:%d", ipStr, port)}
+				if !cidr {
+					hosts[key] = true
+				} else if hosts[key] {
+					continue
+				}
+				svcMap[key] = s.Id
+			}
+		}
+		return nil
+	})
+	return svcMap, err
 }
 
 func (r *serviceRepo) GetActiveServiceUsers() (map[int][]int, error) {
@@ -185,8 +427,65 @@ func (r *serviceRepo) GetActiveServiceUsers() (map[int][]int, error) {
 	return m, rows.Err()
 }
 
-func (r *serviceRepo) InsertActiveService(userID, serviceID, timeLeft int) error {
-	_, err := r.stmtInsertActive.Exec(userID, serviceID, time.Now(), timeLeft)
+// GetActiveTargets returns the services enforced by agent that at least one user has active, by ID,
+// with their stored address. Services with a malformed stored address are logged and left out, since
+// the agent could not enforce them.
+func (r *serviceRepo) GetActiveTargets(agent string) ([]models.Service, error) {
+	var services []models.Service
+	err := scanAll(r.stmtGetActiveTargets, func(rows *sql.Rows) error {
+		var stored storedService
+		if err := stored.scan(rows); err != nil {
+			return err
+		}
+		s, issues := stored.address()
+		if len(issues) > 0 {
+			log.Printf("[WARN] [services] leaving service out of agent snapshot: %v", &MalformedServiceError{Issues: issues})
+			return nil
+		}
+		services = append(services, s)
+		return nil
+	}, agent)
+	return services, err
+}
+
+// GetActiveClients returns, by service ID, the client of every session open on a service enforced by
+// agent. Sessions opened before their address was stored fall back to the user's last login address,
+// and are left as "" without one.
+func (r *serviceRepo) GetActiveClients(agent string) (map[int][]ActiveClient, error) {
+	m := make(map[int][]ActiveClient)
+	err := scanAll(r.stmtGetActiveClients, func(rows *sql.Rows) error {
+		var serviceID int
+		var client ActiveClient
+		var maxTTL sql.NullInt64
+		if err := rows.Scan(&serviceID, &client.IP, &maxTTL); err != nil {
+			return err
+		}
+		if maxTTL.Valid {
+			ttl := int(maxTTL.Int64)
+			client.MaxTTL = &ttl
+		}
+		m[serviceID] = append(m[serviceID], client)
+		return nil
+	}, agent)
+	return m, err
+}
+
+// GetRoleMaxTTL returns the max_ttl of the role of userID, nil if it has none.
+func (r *serviceRepo) GetRoleMaxTTL(userID int) (*int, error) {
+	var maxTTL sql.NullInt64
+	if err := r.stmtGetRoleMaxTTL.QueryRow(userID).Scan(&maxTTL); err != nil {
+		return nil, err
+	}
+	if !maxTTL.Valid {
+		return nil, nil
+	}
+	ttl := int(maxTTL.Int64)
+	return &ttl, nil
+}
+
+// InsertActiveService records that userID has serviceID open for clientIP.
+func (r *serviceRepo) InsertActiveService(userID, serviceID, timeLeft int, clientIP string) error {
+	_, err := r.stmtInsertActive.Exec(userID, serviceID, dbTime(time.Now()), timeLeft, clientIP)
 	return err
 }
 
@@ -195,37 +494,88 @@ func (r *serviceRepo) DeleteActiveService(userID, serviceID int) error {
 	return err
 }
 
-func (r *serviceRepo) SyncActiveSessions(sessions []ActiveSessionSync) error {
-	if len(sessions) == 0 {
-		_, err := r.db.Exec("DELETE FROM user_active_services")
-		return err
-	}
+// CountActiveServices returns the number of active sessions across all users.
+func (r *serviceRepo) CountActiveServices() (int, error) {
+	var n int
+	err := r.stmtCountActive.QueryRow().Scan(&n)
+	return n, err
+}
+
+// IsActiveService reports whether serviceID is active for userID.
+func (r *serviceRepo) IsActiveService(userID, serviceID int) (bool, error) {
+	var active bool
+	err := r.stmtIsActive.QueryRow(userID, serviceID).Scan(&active)
+	return active, err
+}
+
+// QueueActivation records a selection to retry once the agent is reachable, replacing an earlier one
+// for the same user and service.
+func (r *serviceRepo) QueueActivation(userID, serviceID int, clientIP string) error {
+	_, err := r.stmtQueueActivation.Exec(userID, serviceID, clientIP, dbTime(time.Now()))
+	return err
+}
+
+// GetPendingActivations returns every queued selection with the user's current role, oldest first.
+func (r *serviceRepo) GetPendingActivations() ([]PendingActivation, error) {
+	var pending []PendingActivation
+	err := scanAll(r.stmtGetPending, func(rows *sql.Rows) error {
+		var p PendingActivation
+		if err := rows.Scan(&p.UserID, &p.RoleID, &p.ServiceID, &p.ClientIP, utcTime{&p.RequestedAt}); err != nil {
+			return err
+		}
+		pending = append(pending, p)
+		return nil
+	})
+	return pending, err
+}
+
+func (r *serviceRepo) DeletePendingActivation(userID, serviceID int) error {
+	_, err := r.stmtDeletePending.Exec(userID, serviceID)
+	return err
+}
+
+// SyncActiveSessions replaces the contents of user_active_services with sessions in one transaction
+// and returns which rows changed, so callers can notify only the affected users and services.
+func (r *serviceRepo) SyncActiveSessions(sessions []ActiveSessionSync) (SessionDiff, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 	defer func() { _ = tx.Rollback() }()
 
+	before, err := activeSessionsTx(tx)
+	if err != nil {
+		return SessionDiff{}, err
+	}
+	diff := diffActiveSessions(before, sessions)
+
+	if len(sessions) == 0 {
+		if _, err := tx.Exec("DELETE FROM user_active_services"); err != nil {
+			return SessionDiff{}, err
+		}
+		return diff, tx.Commit()
+	}
+
 	if _, err = tx.Exec("CREATE TEMP TABLE sync_sessions (user_id INTEGER, service_id INTEGER, time_left INTEGER)"); err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 
 	stmt, err := tx.Prepare("INSERT INTO sync_sessions (user_id, service_id, time_left) VALUES (?, ?, ?)")
 	if err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 	defer func() { _ = stmt.Close() }()
 
 	for _, s := range sessions {
 		if _, err := stmt.Exec(s.UserID, s.ServiceID, s.TimeLeft); err != nil {
-			return err
+			return SessionDiff{}, err
 		}
 	}
 
 	if _, err := tx.Exec(`DELETE FROM user_active_services WHERE NOT EXISTS (
 		SELECT 1 FROM sync_sessions WHERE sync_sessions.user_id = user_active_services.user_id
 		AND sync_sessions.service_id = user_active_services.service_id)`); err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 
 	if _, err := tx.Exec(`UPDATE user_active_services SET
@@ -234,7 +584,7 @@ func (r *serviceRepo) SyncActiveSessions(sessions []ActiveSessionSync) error {
 		updated_at = CURRENT_TIMESTAMP
 		WHERE EXISTS (SELECT 1 FROM sync_sessions WHERE sync_sessions.user_id = user_active_services.user_id
 			AND sync_sessions.service_id = user_active_services.service_id)`); err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 
 	if _, err := tx.Exec(`INSERT INTO user_active_services (user_id, service_id, time_left, updated_at)
@@ -242,14 +592,67 @@ func (r *serviceRepo) SyncActiveSessions(sessions []ActiveSessionSync) error {
 		WHERE NOT EXISTS (SELECT 1 FROM user_active_services
 			WHERE user_active_services.user_id = sync_sessions.user_id
 			AND user_active_services.service_id = sync_sessions.service_id)`); err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 
 	if _, err := tx.Exec("DROP TABLE sync_sessions"); err != nil {
-		return err
+		return SessionDiff{}, err
 	}
 
-	return tx.Commit()
+	return diff, tx.Commit()
+}
+
+// activeSessionsTx returns the remaining time of every active session as seen by tx.
+func activeSessionsTx(tx *sql.Tx) (map[ActiveSessionKey]int, error) {
+	rows, err := tx.Query("SELECT user_id, service_id, time_left FROM user_active_services")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	active := make(map[ActiveSessionKey]int)
+	for rows.Next() {
+		var k ActiveSessionKey
+		var timeLeft int
+		if err := rows.Scan(&k.UserID, &k.ServiceID, &timeLeft); err != nil {
+			return nil, err
+		}
+		active[k] = timeLeft
+	}
+	return active, rows.Err()
+}
+
+// diffActiveSessions compares the stored sessions with the ones about to replace them.
+func diffActiveSessions(before map[ActiveSessionKey]int, sessions []ActiveSessionSync) SessionDiff {
+	var diff SessionDiff
+	after := make(map[ActiveSessionKey]bool, len(sessions))
+	for _, s := range sessions {
+		k := ActiveSessionKey{UserID: s.UserID, ServiceID: s.ServiceID}
+		if after[k] {
+			continue
+		}
+		after[k] = true
+		timeLeft, existed := before[k]
+		switch {
+		case !existed:
+			diff.Inserted = append(diff.Inserted, k)
+		case timeLeft != s.TimeLeft:
+			diff.Updated = append(diff.Updated, k)
+		}
+	}
+	for k := range before {
+		if !after[k] {
+			diff.Deleted = append(diff.Deleted, k)
+		}
+	}
+	for _, keys := range [][]ActiveSessionKey{diff.Inserted, diff.Updated, diff.Deleted} {
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].UserID != keys[j].UserID {
+				return keys[i].UserID < keys[j].UserID
+			}
+			return keys[i].ServiceID < keys[j].ServiceID
+		})
+	}
+	return diff
 }
 
 func (r *serviceRepo) GetUserServices(userID, roleID int) ([]models.Service, error) {
@@ -262,7 +665,7 @@ func (r *serviceRepo) GetUserServices(userID, roleID int) ([]models.Service, err
 	for rows.Next() {
 		var s models.Service
 		var desc sql.NullString
-		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, &s.CreatedAt); err != nil {
+		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.DestType, &s.Ip, &s.Port, &s.PortRangeEnd, &desc, utcTime{&s.CreatedAt}); err != nil {
 			continue
 		}
 		s.Description = desc.String
@@ -277,17 +680,44 @@ func (r *serviceRepo) GetUserActiveServices(userID int) ([]models.ActiveService,
 		return nil, err
 	}
 	defer func() { _ = rows.Close() }()
+	now := time.Now()
 	services := make([]models.ActiveService, 0)
 	for rows.Next() {
 		var as models.ActiveService
 		var desc sql.NullString
-		if err := rows.Scan(&as.Id, &as.Name, &as.Hostname, &as.Ip, &as.Port, &desc, &as.CreatedAt, &as.TimeLeft, &as.UpdatedAt); err != nil {
+		if err := rows.Scan(&as.Id, &as.Name, &as.Hostname, &as.DestType, &as.Ip, &as.Port, &as.PortRangeEnd, &desc, utcTime{&as.CreatedAt}, &as.TimeLeft, utcTime{&as.UpdatedAt}); err != nil {
 			continue
 		}
 		as.Description = desc.String
+		as.Status = models.ActiveServiceActive
+		as.RemainingSeconds = remainingTimeLeft(as.TimeLeft, as.UpdatedAt, now)
+		as.Expiring = as.RemainingSeconds == 0
 		services = append(services, as)
 	}
-	return services, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Queued selections follow with no time left; UpdatedAt is when the selection was made.
+	err = scanAll(r.stmtGetUserPending, func(rows *sql.Rows) error {
+		as := models.ActiveService{Status: models.ActiveServicePending}
+		var desc sql.NullString
+		if err := rows.Scan(&as.Id, &as.Name, &as.Hostname, &as.DestType, &as.Ip, &as.Port, &as.PortRangeEnd, &desc, utcTime{&as.CreatedAt}, utcTime{&as.UpdatedAt}); err != nil {
+			return err
+		}
+		as.Description = desc.String
+		services = append(services, as)
+		return nil
+	}, userID)
+	return services, err
+}
+
+// remainingTimeLeft counts a stored time_left, in seconds as of updatedAt, down to now.
+func remainingTimeLeft(timeLeft int, updatedAt, now time.Time) int {
+	if elapsed := int(now.Sub(updatedAt) / time.Second); elapsed > 0 {
+		timeLeft -= elapsed
+	}
+	return max(timeLeft, 0)
 }
 
 func (r *serviceRepo) CheckUserServiceAccess(userID, roleID, serviceID int) (bool, error) {
@@ -311,15 +741,59 @@ func (r *serviceRepo) ListForIPSync() ([]HostnameSyncEntry, error) {
 	var entries []HostnameSyncEntry
 	for rows.Next() {
 		var e HostnameSyncEntry
-		if err := rows.Scan(&e.ID, &e.Hostname, &e.CurrentIP, &e.CurrentPort); err != nil {
+		var resolved string
+		if err := rows.Scan(&e.ID, &e.Hostname, &e.CurrentIP, &e.CurrentPort, &e.Agent, &resolved); err != nil {
 			continue
 		}
+		e.ResolvedIPs = parseIPSet(resolved)
 		entries = append(entries, e)
 	}
 	return entries, rows.Err()
 }
 
-func (r *serviceRepo) UpdateIPPort(id int, ip uint32, port uint16) error {
-	_, err := r.stmtUpdateIPPort.Exec(ip, port, id)
+// UpdateIPPort stores a service's address as written by source, one of the IPSource constants. It
+// returns false without writing if the current address came from the other source and the
+// configured IPAuthority keeps it.
+func (r *serviceRepo) UpdateIPPort(id int, ip uint32, port uint16, source string) (bool, error) {
+	var lastWriter string
+	var lastWrite sql.NullTime
+	if err := r.stmtGetIPSource.QueryRow(id).Scan(&lastWriter, &lastWrite); err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	if !currentIPAuthority().allows(source, lastWriter, lastWrite.Time, now) {
+		return false, nil
+	}
+	_, err := r.stmtUpdateIPPort.Exec(ip, port, source, dbTime(now), id)
+	return err == nil, err
+}
+
+// UpdateResolvedIPs stores the address set a service's hostname resolved to, so a restarted
+// controller compares new answers against it instead of treating every hostname as changed.
+func (r *serviceRepo) UpdateResolvedIPs(id int, ips []uint32) error {
+	_, err := r.stmtUpdateResolvedIPs.Exec(formatIPSet(ips), id)
 	return err
 }
+
+// formatIPSet stores an address set as comma-separated dotted quads.
+func formatIPSet(ips []uint32) string {
+	parts := make([]string, len(ips))
+	for i, ip := range ips {
+		parts[i] = utils.Uint32ToIp(ip)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseIPSet reverses formatIPSet. Entries that are not IPv4 addresses are dropped.
+func parseIPSet(s string) []uint32 {
+	if s == "" {
+		return nil
+	}
+	var ips []uint32
+	for _, part := range strings.Split(s, ",") {
+		if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+			ips = append(ips, utils.IpToUint32(part))
+		}
+	}
+	return ips
+}
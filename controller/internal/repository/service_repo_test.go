@@ -0,0 +1,459 @@
+package repository
+
+import (
+	"Aegis/controller/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncActiveSessionsReturnsDiff(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	for _, name := range []string{"alice_user", "bobby_user"} {
+		if _, err := db.Exec("INSERT INTO users (username, password, role_id) VALUES (?, 'x', 3)", name); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	for _, name := range []string{"SvcA", "SvcB"} {
+		if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, 'localhost:80', 2130706433, 80)", name); err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	// Users 2 and 3 are the ones created above; user 1 is the seeded root user.
+	steps := []struct {
+		name     string
+		sessions []ActiveSessionSync
+		want     SessionDiff
+	}{
+		{
+			"Initial sync inserts every session",
+			[]ActiveSessionSync{{3, 1, 60}, {2, 1, 60}, {2, 2, 30}},
+			SessionDiff{Inserted: []ActiveSessionKey{{2, 1}, {2, 2}, {3, 1}}},
+		},
+		{
+			"Unchanged sync reports nothing",
+			[]ActiveSessionSync{{2, 1, 60}, {2, 2, 30}, {3, 1, 60}},
+			SessionDiff{},
+		},
+		{
+			"Mixed insert, update and delete",
+			[]ActiveSessionSync{{2, 1, 55}, {3, 1, 60}, {3, 2, 60}},
+			SessionDiff{
+				Inserted: []ActiveSessionKey{{3, 2}},
+				Updated:  []ActiveSessionKey{{2, 1}},
+				Deleted:  []ActiveSessionKey{{2, 2}},
+			},
+		},
+		{
+			"Empty sync deletes everything",
+			nil,
+			SessionDiff{Deleted: []ActiveSessionKey{{2, 1}, {3, 1}, {3, 2}}},
+		},
+	}
+
+	for _, step := range steps {
+		diff, err := repo.SyncActiveSessions(step.sessions)
+		if err != nil {
+			t.Fatalf("%s: SyncActiveSessions failed: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(diff, step.want) {
+			t.Errorf("%s: expected diff %+v, got %+v", step.name, step.want, diff)
+		}
+		if diff.Empty() != step.want.Empty() {
+			t.Errorf("%s: expected Empty() = %v", step.name, step.want.Empty())
+		}
+
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM user_active_services").Scan(&n); err != nil {
+			t.Fatalf("Failed to count active sessions: %v", err)
+		}
+		if n != len(step.sessions) {
+			t.Errorf("%s: expected %d stored sessions, got %d", step.name, len(step.sessions), n)
+		}
+	}
+}
+
+func TestActiveServiceRemainingSeconds(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('SvcA', 'localhost:80', 2130706433, 80)"); err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	// rewind moves the last update of root's session back by d, as if d had passed since.
+	rewind := func(d time.Duration) {
+		t.Helper()
+		if _, err := db.Exec("UPDATE user_active_services SET updated_at = ? WHERE user_id = 1", time.Now().Add(-d)); err != nil {
+			t.Fatalf("Failed to rewind updated_at: %v", err)
+		}
+	}
+	expect := func(step string, timeLeft, want int) {
+		t.Helper()
+		services, err := repo.GetUserActiveServices(1)
+		if err != nil || len(services) != 1 {
+			t.Fatalf("%s: GetUserActiveServices returned %+v, %v", step, services, err)
+		}
+		as := services[0]
+		if as.TimeLeft != timeLeft {
+			t.Errorf("%s: expected stored time_left %d, got %d", step, timeLeft, as.TimeLeft)
+		}
+		// CURRENT_TIMESTAMP has whole-second resolution, so allow up to a second of extra elapsed time.
+		if got := as.RemainingSeconds; got > want || got < want-1 {
+			t.Errorf("%s: expected remaining_seconds %d, got %d", step, want, got)
+		}
+		if as.Expiring != (want == 0) {
+			t.Errorf("%s: expected expiring=%v, got %v", step, want == 0, as.Expiring)
+		}
+	}
+
+	if err := repo.InsertActiveService(1, 1, models.SessionTimeLeft, "192.0.2.10"); err != nil {
+		t.Fatalf("InsertActiveService failed: %v", err)
+	}
+	expect("Selected", models.SessionTimeLeft, models.SessionTimeLeft)
+	rewind(20 * time.Second)
+	expect("20s after selecting", models.SessionTimeLeft, 40)
+
+	// A sync cycle that agrees with the wall clock leaves the countdown where it was.
+	if _, err := repo.SyncActiveSessions([]ActiveSessionSync{{UserID: 1, ServiceID: 1, TimeLeft: 40}}); err != nil {
+		t.Fatalf("SyncActiveSessions failed: %v", err)
+	}
+	expect("After sync", 40, 40)
+	rewind(5 * time.Second)
+	expect("One sync interval later", 40, 35)
+	if _, err := repo.SyncActiveSessions([]ActiveSessionSync{{UserID: 1, ServiceID: 1, TimeLeft: 35}}); err != nil {
+		t.Fatalf("SyncActiveSessions failed: %v", err)
+	}
+	expect("After second sync", 35, 35)
+
+	// Not reaped yet: still listed, with no time remaining and flagged as expiring.
+	rewind(time.Minute)
+	expect("Long after expiry", 35, 0)
+}
+
+func TestServiceGetPageStableUnderChanges(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	insert := func(name string) {
+		t.Helper()
+		if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, 'localhost:80', 2130706433, 80)", name); err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+	}
+	for i := 0; i < 20; i += 2 {
+		insert(fmt.Sprintf("svc-%02d", i))
+	}
+
+	// agent and created_at are the same for every row, so those orderings rest on the id tie-break.
+	for i, key := range []string{"name", "-name", "id", "-id", "agent", "-created_at"} {
+		t.Run(key, func(t *testing.T) {
+			sort, err := ParseSort(key, ServiceSortColumns, DefaultServiceSort)
+			if err != nil {
+				t.Fatalf("ParseSort failed: %v", err)
+			}
+			all, err := repo.GetAll(sort)
+			if err != nil {
+				t.Fatalf("GetAll failed: %v", err)
+			}
+			want := make(map[string]bool, len(all))
+			for _, s := range all {
+				want[s.Name] = true
+			}
+
+			seen := make(map[string]bool)
+			var after *Cursor
+			for page := 0; ; page++ {
+				services, next, err := repo.GetPage(sort, after, 3)
+				if err != nil {
+					t.Fatalf("GetPage failed: %v", err)
+				}
+				for _, s := range services {
+					if seen[s.Name] {
+						t.Errorf("Service %q returned twice", s.Name)
+					}
+					seen[s.Name] = true
+				}
+				if next == nil {
+					break
+				}
+				// Rows added anywhere in the order and rows removed ahead of the cursor must not
+				// shift later pages.
+				insert(fmt.Sprintf("new-%d-%d-a", i, page))
+				insert(fmt.Sprintf("zzz-%d-%d", i, page))
+				if page == 0 {
+					if _, err := db.Exec("DELETE FROM services WHERE id = (SELECT MAX(id) FROM services WHERE name LIKE 'svc-%')"); err != nil {
+						t.Fatalf("Failed to delete service: %v", err)
+					}
+				}
+				after = next
+			}
+
+			remaining, err := repo.GetAll(sort)
+			if err != nil {
+				t.Fatalf("GetAll failed: %v", err)
+			}
+			still := make(map[string]bool, len(remaining))
+			for _, s := range remaining {
+				still[s.Name] = true
+			}
+			for name := range want {
+				if still[name] && !seen[name] {
+					t.Errorf("Service %q present throughout but never returned", name)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseCursor(EncodeCursor(Sort{Column: "name"}, Cursor{Value: "svc-02", ID: 2}), Sort{Column: "name", Desc: true}); err == nil {
+		t.Error("Expected a cursor issued for another sort to be rejected")
+	}
+	if _, err := ParseCursor("not a cursor", Sort{Column: "name"}); err == nil {
+		t.Error("Expected a malformed cursor to be rejected")
+	}
+}
+
+func TestServiceMapCoversPortRanges(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	single, err := repo.Create("Web", "10.0.0.5:80", models.DestinationHost, 0x0A000005, 80, 0, "", "primary", false)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	ranged, err := repo.Create("RTP", "10.0.0.6:10000", models.DestinationHost, 0x0A000006, 10000, 10003, "", "primary", false)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	// The network covers the single service's address, which stays attributed to it.
+	network, err := repo.Create("Subnet", "10.0.0.4/30:80", models.DestinationCIDR, 0x0A000004, 80, 0, "", "primary", false)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	svcMap, err := repo.GetServiceMap()
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %v", err)
+	}
+	want := map[ServiceKey]int{
+		{Agent: "primary", Addr: "10.0.0.4:80"}:    int(network),
+		{Agent: "primary", Addr: "10.0.0.5:80"}:    int(single),
+		{Agent: "primary", Addr: "10.0.0.6:80"}:    int(network),
+		{Agent: "primary", Addr: "10.0.0.7:80"}:    int(network),
+		{Agent: "primary", Addr: "10.0.0.6:10000"}: int(ranged),
+		{Agent: "primary", Addr: "10.0.0.6:10001"}: int(ranged),
+		{Agent: "primary", Addr: "10.0.0.6:10002"}: int(ranged),
+		{Agent: "primary", Addr: "10.0.0.6:10003"}: int(ranged),
+	}
+	if !reflect.DeepEqual(svcMap, want) {
+		t.Errorf("Expected service map %v, got %v", want, svcMap)
+	}
+
+	if target, err := repo.GetTarget(int(ranged)); err != nil || target.Port != 10000 || target.PortRangeEnd != 10003 {
+		t.Errorf("Expected target ports 10000-10003, got %d-%d (err %v)", target.Port, target.PortRangeEnd, err)
+	}
+	if target, err := repo.GetTarget(int(network)); err != nil || target.Ip != 0x0A000004 || target.PrefixLen != 30 {
+		t.Errorf("Expected target network 10.0.0.4/30, got %#x/%d (err %v)", target.Ip, target.PrefixLen, err)
+	}
+}
+
+func TestMalformedStoredServices(t *testing.T) {
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	good, err := repo.Create("Web", "10.0.0.5:80", models.DestinationHost, 0x0A000005, 80, 0, "", "primary", false)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	// Rows as a manual edit or a broken migration might leave them.
+	corrupt := map[string]string{
+		"BadIP":    "INSERT INTO services (name, hostname, ip, port, agent) VALUES ('BadIP', '10.0.0.6:22', 'ten.zero', 22, 'primary')",
+		"BadPort":  "INSERT INTO services (name, hostname, ip, port, agent) VALUES ('BadPort', '10.0.0.7:22', 167772167, 70000, 'primary')",
+		"BadRange": "INSERT INTO services (name, hostname, ip, port, port_range_end, agent) VALUES ('BadRange', '10.0.0.8:9000', 167772168, 9000, 8000, 'primary')",
+		"BadHost":  "INSERT INTO services (name, hostname, ip, port, agent) VALUES ('BadHost', '10.0.0.9', 167772169, 443, 'primary')",
+		"BadCIDR": `INSERT INTO services (name, hostname, ip, port, agent, destination_type)
+			VALUES ('BadCIDR', '10.1.0.0/16:443', 167837696, 443, 'primary', 'cidr')`,
+	}
+	ids := map[string]int{}
+	for name, query := range corrupt {
+		res, err := db.Exec(query)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		id, _ := res.LastInsertId()
+		ids[name] = int(id)
+	}
+
+	// Session matching keeps every usable address and leaves the malformed ones out.
+	svcMap, err := repo.GetServiceMap()
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %v", err)
+	}
+	want := map[ServiceKey]int{
+		{Agent: "primary", Addr: "10.0.0.5:80"}:  int(good),
+		{Agent: "primary", Addr: "10.0.0.9:443"}: ids["BadHost"],
+	}
+	if !reflect.DeepEqual(svcMap, want) {
+		t.Errorf("Expected service map %v, got %v", want, svcMap)
+	}
+
+	for _, name := range []string{"BadIP", "BadPort", "BadRange", "BadCIDR"} {
+		var malformed *MalformedServiceError
+		if _, err := repo.GetTarget(ids[name]); !errors.As(err, &malformed) {
+			t.Errorf("Expected GetTarget of %s to report a malformed service, got %v", name, err)
+		}
+	}
+	if _, err := repo.GetTarget(int(good)); err != nil {
+		t.Errorf("Expected GetTarget of a well-formed service to succeed, got %v", err)
+	}
+
+	issues, err := repo.GetIntegrityIssues()
+	if err != nil {
+		t.Fatalf("GetIntegrityIssues failed: %v", err)
+	}
+	got := map[string]string{}
+	for _, issue := range issues {
+		got[issue.ServiceName] = issue.Field + "=" + issue.Value
+		if issue.ServiceID != ids[issue.ServiceName] || issue.Problem == "" || issue.Repair == "" {
+			t.Errorf("Expected an issue naming the service, its problem and a repair, got %+v", issue)
+		}
+	}
+	wantIssues := map[string]string{
+		"BadIP":    "ip=ten.zero",
+		"BadPort":  "port=70000",
+		"BadRange": "port_range_end=8000",
+		"BadHost":  "hostname=10.0.0.9",
+		"BadCIDR":  "hostname=10.1.0.0/16:443",
+	}
+	if !reflect.DeepEqual(got, wantIssues) {
+		t.Errorf("Expected issues %v, got %v", wantIssues, got)
+	}
+}
+
+// TestTimestampsRoundTripInUTC stores timestamps through the repository with a controller clock
+// that is not in UTC and checks that they are stored without an offset and come back, and marshal
+// to JSON, as RFC3339 in UTC.
+func TestTimestampsRoundTripInUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5:30", 5*3600+1800)
+	t.Cleanup(func() { time.Local = local })
+
+	resetGlobalDB(t)
+	db, err := SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('SvcA', 'localhost:80', 2130706433, 80)"); err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	repo, err := NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if err := repo.InsertActiveService(1, 1, models.SessionTimeLeft, "192.0.2.10"); err != nil {
+		t.Fatalf("InsertActiveService failed: %v", err)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT CAST(updated_at AS TEXT) FROM user_active_services").Scan(&stored); err != nil {
+		t.Fatalf("Failed to read updated_at: %v", err)
+	}
+	if _, err := time.ParseInLocation(timestampFormat, stored, time.UTC); err != nil {
+		t.Errorf("Expected updated_at stored in UTC without an offset, got %q", stored)
+	}
+
+	services, err := repo.GetUserActiveServices(1)
+	if err != nil || len(services) != 1 {
+		t.Fatalf("GetUserActiveServices returned %+v, %v", services, err)
+	}
+	as := services[0]
+	if as.CreatedAt.Location() != time.UTC || as.UpdatedAt.Location() != time.UTC {
+		t.Errorf("Expected UTC timestamps, got created_at %v and updated_at %v", as.CreatedAt, as.UpdatedAt)
+	}
+	if as.UpdatedAt.Before(before) || as.UpdatedAt.After(time.Now().Add(time.Second)) {
+		t.Errorf("Expected updated_at to be now, got %v", as.UpdatedAt)
+	}
+	if as.CreatedAt.Before(before.Truncate(time.Second)) {
+		t.Errorf("Expected created_at (CURRENT_TIMESTAMP) to be read as UTC, got %v", as.CreatedAt)
+	}
+
+	body, err := json.Marshal(as)
+	if err != nil {
+		t.Fatalf("Failed to marshal active service: %v", err)
+	}
+	var decoded struct {
+		CreatedAt string `json:"created_at"`
+		UpdatedAt string `json:"updated_at"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal active service: %v", err)
+	}
+	for field, value := range map[string]string{"created_at": decoded.CreatedAt, "updated_at": decoded.UpdatedAt} {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil || !strings.HasSuffix(value, "Z") {
+			t.Errorf("Expected %s in RFC3339 UTC, got %q (%v)", field, value, err)
+		}
+		if field == "updated_at" && !parsed.Equal(as.UpdatedAt) {
+			t.Errorf("Expected updated_at to round-trip as %v, got %v", as.UpdatedAt, parsed)
+		}
+	}
+
+	// Values written with an offset before timestamps were stored in UTC are converted.
+	if _, err := db.Exec("UPDATE user_active_services SET updated_at = '2026-03-01 10:00:00+05:30'"); err != nil {
+		t.Fatalf("Failed to store an offset timestamp: %v", err)
+	}
+	services, err = repo.GetUserActiveServices(1)
+	if err != nil || len(services) != 1 {
+		t.Fatalf("GetUserActiveServices returned %+v, %v", services, err)
+	}
+	if want := time.Date(2026, 3, 1, 4, 30, 0, 0, time.UTC); !services[0].UpdatedAt.Equal(want) || services[0].UpdatedAt.Location() != time.UTC {
+		t.Errorf("Expected updated_at %v, got %v", want, services[0].UpdatedAt)
+	}
+
+	// SQLite hands the results of expressions over as text, which is read as UTC.
+	var now time.Time
+	if err := db.QueryRow("SELECT CURRENT_TIMESTAMP").Scan(utcTime{&now}); err != nil {
+		t.Fatalf("Failed to scan CURRENT_TIMESTAMP: %v", err)
+	}
+	if now.Location() != time.UTC || now.Before(before.Truncate(time.Second)) || now.After(time.Now().Add(time.Second)) {
+		t.Errorf("Expected CURRENT_TIMESTAMP to scan as the current UTC time, got %v", now)
+	}
+}
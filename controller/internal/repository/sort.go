@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Sort selects the column and direction a list query is ordered by.
+type Sort struct {
+	Column string
+	Desc   bool
+}
+
+// Sortable columns of each list query. Rows are ordered by the chosen column and then by id,
+// so the order is stable even when the column has duplicate values.
+var (
+	UserSortColumns    = []string{"id", "username", "role_id", "is_active"}
+	RoleSortColumns    = []string{"id", "name"}
+	ServiceSortColumns = []string{"id", "name", "hostname", "agent", "created_at"}
+)
+
+// Default orderings used when no sort key is given.
+var (
+	DefaultUserSort    = Sort{Column: "username"}
+	DefaultRoleSort    = Sort{Column: "name"}
+	DefaultServiceSort = Sort{Column: "name"}
+)
+
+// Key returns the sort key that ParseSort parses into s.
+func (s Sort) Key() string {
+	if s.Desc {
+		return "-" + s.Column
+	}
+	return s.Column
+}
+
+// Cursor marks where a page ended: the last row's value in the sort column, as text, and its id.
+// The next page starts strictly after it, so rows inserted or deleted between fetches never shift
+// later pages the way an offset would.
+type Cursor struct {
+	Value string
+	ID    int
+}
+
+// cursorToken is the JSON form of a Cursor. It records the sort key so a cursor cannot be replayed
+// against a different ordering.
+type cursorToken struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// EncodeCursor returns c as an opaque token for clients to pass back unchanged.
+func EncodeCursor(s Sort, c Cursor) string {
+	b, _ := json.Marshal(cursorToken{Sort: s.Key(), Value: c.Value, ID: c.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a token from EncodeCursor. Tokens that are malformed or were issued for
+// another sort are rejected.
+func ParseCursor(token string, s Sort) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	var t cursorToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if t.Sort != s.Key() {
+		return nil, fmt.Errorf("cursor was issued for sort %q, not %q", t.Sort, s.Key())
+	}
+	return &Cursor{Value: t.Value, ID: t.ID}, nil
+}
+
+// pageArgs returns the arguments of a statement from prepareKeyset: the cursor's value and id,
+// both NULL for the first page, and the number of rows to fetch.
+func pageArgs(after *Cursor, limit int) []any {
+	if after == nil {
+		return []any{nil, nil, limit}
+	}
+	return []any{after.Value, after.ID, limit}
+}
+
+// ParseSort parses a sort key of the form "column" (ascending) or "-column" (descending).
+// An empty key selects def. Columns not in allowed are rejected.
+func ParseSort(key string, allowed []string, def Sort) (Sort, error) {
+	if key == "" {
+		return def, nil
+	}
+	s := Sort{Column: strings.TrimPrefix(key, "-"), Desc: strings.HasPrefix(key, "-")}
+	for _, col := range allowed {
+		if col == s.Column {
+			return s, nil
+		}
+	}
+	return Sort{}, fmt.Errorf("invalid sort key %q", key)
+}
+
+// sortedStmts holds one prepared statement per allowed column and direction of a list query.
+type sortedStmts map[Sort]*stmt
+
+// get returns the statement for s. Callers validate s with ParseSort first.
+func (m sortedStmts) get(s Sort) (*stmt, error) {
+	st, ok := m[s]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort %s", s.Column)
+	}
+	return st, nil
+}
+
+// prepareSorted prepares base once for every column and direction in columns, closing any
+// statements it replaces. All variants are reported under the same name.
+func prepareSorted(db *sql.DB, dst *sortedStmts, name, base string, columns []string) error {
+	return prepareVariants(db, dst, name, base, columns, func(col, dir, order string) string {
+		return base + " ORDER BY " + order
+	})
+}
+
+// prepareKeyset prepares a page query over base for every column and direction in columns. Each
+// row gets the sort column as text appended, for the next Cursor. The statements take the
+// arguments from pageArgs and return rows strictly after the cursor in the chosen order.
+func prepareKeyset(db *sql.DB, dst *sortedStmts, name, base string, columns []string) error {
+	return prepareVariants(db, dst, name, base, columns, func(col, dir, order string) string {
+		cmp := ">"
+		if dir == "DESC" {
+			cmp = "<"
+		}
+		after := fmt.Sprintf("%s %s ?1 OR (%s = ?1 AND id %s ?2)", col, cmp, col, cmp)
+		if col == "id" {
+			after = "id " + cmp + " ?2"
+		}
+		return fmt.Sprintf("SELECT *, CAST(%s AS TEXT) FROM (%s) WHERE ?2 IS NULL OR %s ORDER BY %s LIMIT ?3",
+			col, base, after, order)
+	})
+}
+
+// prepareVariants prepares the query built for every column and direction in columns, closing
+// any statements it replaces.
+func prepareVariants(db *sql.DB, dst *sortedStmts, name, base string, columns []string, build func(col, dir, order string) string) error {
+	next := make(sortedStmts, 2*len(columns))
+	for _, col := range columns {
+		for _, desc := range []bool{false, true} {
+			dir := "ASC"
+			if desc {
+				dir = "DESC"
+			}
+			order := col + " " + dir
+			if col != "id" {
+				order += ", id " + dir
+			}
+			s, err := prepare(db, namedQuery{name, build(col, dir, order)})
+			if err != nil {
+				for _, prepared := range next {
+					_ = prepared.Close()
+				}
+				return fmt.Errorf("failed to prepare query %q: %w", base, err)
+			}
+			next[Sort{Column: col, Desc: desc}] = s
+		}
+	}
+	for _, old := range *dst {
+		_ = old.Close()
+	}
+	*dst = next
+	return nil
+}
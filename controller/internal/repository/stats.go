@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"Aegis/controller/internal/metrics"
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"time"
+)
+
+// StatsCollector exposes connection pool and per-statement query metrics for db.
+func StatsCollector(db *sql.DB) metrics.Collector {
+	return func(w io.Writer) {
+		st := db.Stats()
+		metrics.WriteMetric(w, "aegis_db_max_open_connections", "gauge", "Maximum number of open connections to the database.",
+			metrics.Sample{Value: float64(st.MaxOpenConnections)})
+		metrics.WriteMetric(w, "aegis_db_open_connections", "gauge", "Number of established connections, both in use and idle.",
+			metrics.Sample{Value: float64(st.OpenConnections)})
+		metrics.WriteMetric(w, "aegis_db_in_use_connections", "gauge", "Number of connections currently in use.",
+			metrics.Sample{Value: float64(st.InUse)})
+		metrics.WriteMetric(w, "aegis_db_idle_connections", "gauge", "Number of idle connections.",
+			metrics.Sample{Value: float64(st.Idle)})
+		metrics.WriteMetric(w, "aegis_db_wait_count_total", "counter", "Total number of connections waited for.",
+			metrics.Sample{Value: float64(st.WaitCount)})
+		metrics.WriteMetric(w, "aegis_db_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.",
+			metrics.Sample{Value: st.WaitDuration.Seconds()})
+
+		stats := QueryStats()
+		counts := make([]metrics.Sample, 0, len(stats))
+		slow := make([]metrics.Sample, 0, len(stats))
+		durations := make([]metrics.Sample, 0, len(stats))
+		for _, qs := range stats {
+			labels := map[string]string{"statement": qs.Name}
+			counts = append(counts, metrics.Sample{Labels: labels, Value: float64(qs.Count)})
+			slow = append(slow, metrics.Sample{Labels: labels, Value: float64(qs.SlowCount)})
+			durations = append(durations, metrics.Sample{Labels: labels, Value: qs.TotalDuration.Seconds()})
+		}
+		metrics.WriteMetric(w, "aegis_db_queries_total", "counter", "Prepared statement executions.", counts...)
+		metrics.WriteMetric(w, "aegis_db_slow_queries_total", "counter", "Prepared statement executions above the slow query threshold.", slow...)
+		metrics.WriteMetric(w, "aegis_db_query_duration_seconds_total", "counter", "Total time spent executing prepared statements.", durations...)
+	}
+}
+
+// poolWaitCheckInterval is how often MonitorPoolWait samples the pool stats.
+const poolWaitCheckInterval = time.Minute
+
+// MonitorPoolWait logs a warning whenever connection wait time within one check interval exceeds threshold.
+// It samples the current DB on every tick and returns when ctx is cancelled.
+func MonitorPoolWait(ctx context.Context, threshold time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	interval := poolWaitCheckInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last sql.DBStats
+	if db := DB; db != nil {
+		last = db.Stats()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db := DB
+		if db == nil {
+			continue
+		}
+		cur := db.Stats()
+		waited := cur.WaitDuration - last.WaitDuration
+		if waited > threshold {
+			log.Printf("[WARN] [database] connections waited %v over the last %v (%d waits, max_open_conns=%d); consider raising max_open_conns",
+				waited, interval, cur.WaitCount-last.WaitCount, cur.MaxOpenConnections)
+		}
+		last = cur
+	}
+}
@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowQueryThreshold is the duration above which statement executions are logged. Zero disables logging.
+var slowQueryThreshold atomic.Int64
+
+// SetSlowQueryThreshold sets the duration above which prepared statement executions are logged.
+func SetSlowQueryThreshold(d time.Duration) {
+	slowQueryThreshold.Store(int64(d))
+}
+
+// namedQuery is a SQL query and the name it is reported under in logs and metrics.
+type namedQuery struct {
+	name  string
+	query string
+}
+
+// stmt wraps a prepared statement and records its execution time under a name.
+// If the statement turns out to be stale it is re-prepared once and the call retried.
+type stmt struct {
+	mu    sync.RWMutex
+	stmt  *sql.Stmt
+	db    *sql.DB
+	name  string
+	query string
+}
+
+// prepare prepares q on db and returns it as a named statement.
+func prepare(db *sql.DB, q namedQuery) (*stmt, error) {
+	s, err := db.Prepare(q.query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{stmt: s, db: db, name: q.name, query: q.query}, nil
+}
+
+func (s *stmt) Query(args ...any) (*sql.Rows, error) {
+	defer s.observe(time.Now())
+	cur := s.current()
+	rows, err := cur.Query(args...)
+	if isStaleStmtErr(err) {
+		if next, perr := s.reprepare(cur); perr == nil {
+			rows, err = next.Query(args...)
+		}
+	}
+	return rows, err
+}
+
+func (s *stmt) QueryRow(args ...any) *sql.Row {
+	defer s.observe(time.Now())
+	cur := s.current()
+	row := cur.QueryRow(args...)
+	if isStaleStmtErr(row.Err()) {
+		if next, perr := s.reprepare(cur); perr == nil {
+			row = next.QueryRow(args...)
+		}
+	}
+	return row
+}
+
+func (s *stmt) Exec(args ...any) (sql.Result, error) {
+	defer s.observe(time.Now())
+	cur := s.current()
+	res, err := cur.Exec(args...)
+	if isStaleStmtErr(err) {
+		if next, perr := s.reprepare(cur); perr == nil {
+			res, err = next.Exec(args...)
+		}
+	}
+	return res, err
+}
+
+// Close closes the underlying prepared statement.
+func (s *stmt) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stmt.Close()
+}
+
+func (s *stmt) current() *sql.Stmt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stmt
+}
+
+// reprepare replaces stale with a freshly prepared statement, unless another caller already did.
+func (s *stmt) reprepare(stale *sql.Stmt) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stmt != stale {
+		return s.stmt, nil
+	}
+	next, err := s.db.Prepare(s.query)
+	if err != nil {
+		log.Printf("[ERROR] [database] failed to re-prepare statement %s: %v", s.name, err)
+		return nil, err
+	}
+	_ = stale.Close()
+	s.stmt = next
+	log.Printf("[WARN] [database] re-prepared stale statement %s", s.name)
+	return next, nil
+}
+
+// isStaleStmtErr reports whether err means the statement or its connection is no longer usable.
+func isStaleStmtErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, driver.ErrBadConn) || err.Error() == "sql: statement is closed"
+}
+
+// observe records the duration of a statement execution and logs it if slow.
+func (s *stmt) observe(start time.Time) {
+	elapsed := time.Since(start)
+	slow := false
+	if threshold := time.Duration(slowQueryThreshold.Load()); threshold > 0 && elapsed > threshold {
+		slow = true
+		log.Printf("[WARN] [database] slow query %s took %v (threshold %v)", s.name, elapsed, threshold)
+	}
+	queryStats.record(s.name, elapsed, slow)
+}
+
+// QueryStat holds accumulated execution statistics for one named statement.
+type QueryStat struct {
+	Name          string
+	Count         uint64
+	SlowCount     uint64
+	TotalDuration time.Duration
+}
+
+type queryStatsRegistry struct {
+	mu    sync.Mutex
+	stats map[string]*QueryStat
+}
+
+var queryStats = &queryStatsRegistry{stats: make(map[string]*QueryStat)}
+
+func (r *queryStatsRegistry) record(name string, elapsed time.Duration, slow bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.stats[name]
+	if !ok {
+		st = &QueryStat{Name: name}
+		r.stats[name] = st
+	}
+	st.Count++
+	st.TotalDuration += elapsed
+	if slow {
+		st.SlowCount++
+	}
+}
+
+// QueryStats returns a snapshot of per-statement execution statistics sorted by name.
+func QueryStats() []QueryStat {
+	queryStats.mu.Lock()
+	defer queryStats.mu.Unlock()
+	out := make([]QueryStat, 0, len(queryStats.stats))
+	for _, st := range queryStats.stats {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// prepareAll prepares every query into its destination, closing any statement it replaces.
+func prepareAll(db *sql.DB, queries map[**stmt]namedQuery) error {
+	for dst, q := range queries {
+		next, err := prepare(db, q)
+		if err != nil {
+			return fmt.Errorf("failed to prepare query %q: %w", q.query, err)
+		}
+		if *dst != nil {
+			_ = (*dst).Close()
+		}
+		*dst = next
+	}
+	return nil
+}
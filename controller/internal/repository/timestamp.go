@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// timestampFormat is how timestamps are stored: in UTC and without an offset, like SQLite's
+// CURRENT_TIMESTAMP, so every stored value compares correctly with the others as text.
+const timestampFormat = "2006-01-02 15:04:05.999999999"
+
+// dbTime formats t for a DATETIME column.
+func dbTime(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// dbTimePtr is dbTime for a nullable column; nil stays NULL.
+func dbTimePtr(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return dbTime(*t)
+}
+
+// parseTimestamp parses a stored timestamp in any of the layouts the driver accepts. Values without
+// an offset, such as CURRENT_TIMESTAMP's "YYYY-MM-DD HH:MM:SS", are UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// utcTime scans a timestamp into the time.Time it points to, in UTC. The driver parses columns
+// declared DATETIME itself but keeps the offset a value was written with, and hands over the
+// results of expressions as text.
+type utcTime struct{ t *time.Time }
+
+func (u utcTime) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		*u.t = v.UTC()
+	case string:
+		t, err := parseTimestamp(v)
+		if err != nil {
+			return err
+		}
+		*u.t = t
+	case []byte:
+		return u.Scan(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
+	}
+	return nil
+}
+
+// nullUTCTime is utcTime for a nullable column, setting the pointer it points to to nil for NULL.
+type nullUTCTime struct{ t **time.Time }
+
+func (n nullUTCTime) Scan(src any) error {
+	if src == nil {
+		*n.t = nil
+		return nil
+	}
+	var t time.Time
+	if err := (utcTime{&t}).Scan(src); err != nil {
+		return err
+	}
+	*n.t = &t
+	return nil
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"Aegis/controller/internal/models"
+	"database/sql"
+	"time"
+)
+
+// TokenRepository stores personal API tokens by the hash of the token.
+type TokenRepository interface {
+	Create(userID int, name, hash, scope string, expiresAt *time.Time, serviceIDs []int) (int64, error)
+	ListByUser(userID int) ([]models.APIToken, error)
+	Delete(id, userID int) (int64, error)
+	// Authenticate returns the grant of the unexpired token with the given hash whose owner is
+	// active, and records the use.
+	Authenticate(hash string) (*models.TokenGrant, error)
+}
+
+type tokenRepo struct {
+	db                     *sql.DB
+	stmtListByUser         *stmt
+	stmtListServicesByUser *stmt
+	stmtDelete             *stmt
+	stmtAuthenticate       *stmt
+	stmtGetServices        *stmt
+	stmtTouch              *stmt
+}
+
+// NewTokenRepository prepares all statements and returns a TokenRepository.
+func NewTokenRepository(db *sql.DB) (TokenRepository, error) {
+	r := &tokenRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
+	}
+	track(db, r)
+	return r, nil
+}
+
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *tokenRepo) rebind(db *sql.DB) error {
+	r.db = db
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtListByUser: {"tokens.ListByUser", "SELECT id, name, scope, expires_at, last_used_at, created_at FROM api_tokens WHERE user_id = ? ORDER BY id"},
+		&r.stmtListServicesByUser: {"tokens.ListServicesByUser", `SELECT ts.token_id, ts.service_id FROM api_token_services ts
+			JOIN api_tokens t ON t.id = ts.token_id WHERE t.user_id = ? ORDER BY ts.token_id, ts.service_id`},
+		&r.stmtDelete: {"tokens.Delete", "DELETE FROM api_tokens WHERE id = ? AND user_id = ?"},
+		&r.stmtAuthenticate: {"tokens.Authenticate", `SELECT t.id, u.username, t.scope FROM api_tokens t JOIN users u ON u.id = t.user_id
+			WHERE t.token_hash = ? AND u.is_active = 1 AND (t.expires_at IS NULL OR t.expires_at > ?)`},
+		&r.stmtGetServices: {"tokens.GetServices", "SELECT service_id FROM api_token_services WHERE token_id = ? ORDER BY service_id"},
+		&r.stmtTouch:       {"tokens.Touch", "UPDATE api_tokens SET last_used_at = ? WHERE id = ?"},
+	})
+}
+
+// Create stores a token and the services it is limited to in one transaction.
+func (r *tokenRepo) Create(userID int, name, hash, scope string, expiresAt *time.Time, serviceIDs []int) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("INSERT INTO api_tokens (user_id, name, token_hash, scope, expires_at) VALUES (?, ?, ?, ?, ?)", userID, name, hash, scope, dbTimePtr(expiresAt))
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, svcID := range serviceIDs {
+		if _, err := tx.Exec("INSERT INTO api_token_services (token_id, service_id) VALUES (?, ?)", id, svcID); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (r *tokenRepo) ListByUser(userID int) ([]models.APIToken, error) {
+	rows, err := r.stmtListByUser.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tokens := make([]models.APIToken, 0)
+	for rows.Next() {
+		var t models.APIToken
+		if err := rows.Scan(&t.Id, &t.Name, &t.Scope, nullUTCTime{&t.ExpiresAt}, nullUTCTime{&t.LastUsedAt}, utcTime{&t.CreatedAt}); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*models.APIToken, len(tokens))
+	for i := range tokens {
+		byID[tokens[i].Id] = &tokens[i]
+	}
+	err = scanAll(r.stmtListServicesByUser, func(rows *sql.Rows) error {
+		var tokenID, svcID int
+		if err := rows.Scan(&tokenID, &svcID); err != nil {
+			return err
+		}
+		if t, ok := byID[tokenID]; ok {
+			t.ServiceIDs = append(t.ServiceIDs, svcID)
+		}
+		return nil
+	}, userID)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *tokenRepo) Delete(id, userID int) (int64, error) {
+	res, err := r.stmtDelete.Exec(id, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *tokenRepo) Authenticate(hash string) (*models.TokenGrant, error) {
+	var id int
+	var grant models.TokenGrant
+	now := dbTime(time.Now())
+	if err := r.stmtAuthenticate.QueryRow(hash, now).Scan(&id, &grant.Username, &grant.Scope); err != nil {
+		return nil, err
+	}
+	err := scanAll(r.stmtGetServices, func(rows *sql.Rows) error {
+		var svcID int
+		if err := rows.Scan(&svcID); err != nil {
+			return err
+		}
+		grant.ServiceIDs = append(grant.ServiceIDs, svcID)
+		return nil
+	}, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.stmtTouch.Exec(now, id); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
@@ -3,7 +3,6 @@ package repository
 import (
 	"Aegis/controller/internal/models"
 	"database/sql"
-	"fmt"
 	"time"
 )
 
@@ -13,7 +12,8 @@ type UserRepository interface {
 	GetIDAndRole(username string) (id, roleID int, err error)
 	UpdatePassword(username, newHash string) (int64, error)
 	GetPasswordHash(username string) (string, error)
-	GetAll() ([]models.User, error)
+	GetAll(sort Sort) ([]models.User, error)
+	GetPage(sort Sort, after *Cursor, limit int) ([]models.User, *Cursor, error)
 	Create(username, hashedPwd string, roleID int) (int64, error)
 	Delete(id int) (int64, error)
 	GetRoleNameByUserID(id int) (string, error)
@@ -22,11 +22,12 @@ type UserRepository interface {
 	ResetPassword(id int, newHash string) (int64, error)
 	GetExtraServices(userID int) ([]models.Service, error)
 	AddExtraService(userID, serviceID int) error
-	RemoveExtraService(userID, serviceID int) error
+	RemoveExtraService(userID, serviceID int) (int64, error)
 	CreateRefreshToken(token string, userID int, expiresAt time.Time) error
-	GetRefreshToken(token string) (userID int, err error)
-	DeleteRefreshToken(token string) error
-	DeleteUserRefreshTokens(userID int) error
+	GetRefreshToken(token string) (userID int, issuedAt time.Time, err error)
+	DeleteRefreshToken(userID int, token string) error
+	DeleteUserRefreshTokens(userID int) (int64, error)
+	RevokeUserTokens(userID int) (int64, error)
 	CleanupExpiredRefreshTokens() error
 	GetByProviderAndID(provider, providerID string) (*models.User, error)
 	CreateOIDCUser(username, provider, providerID, email string, roleID int) (*models.User, error)
@@ -35,75 +36,114 @@ type UserRepository interface {
 	GetIDByUsername(username string) (int, error)
 	GetProvider(username string) (string, error)
 	GetRoleAndIDByUsername(username string) (roleName string, roleID int, err error)
+	GetAccessByUsername(username string) (roleName string, roleID int, services []models.ServiceRef, capabilities []string, err error)
+	GetCapabilitiesByUsername(username string) ([]string, error)
+	GetAuthState(username string) (isActive bool, tokenGeneration int64, err error)
+	CountByRole(roleID int) (int, error)
+	Exists(id int) (bool, error)
+	ServiceExists(serviceID int) (bool, error)
+	SetLastLoginIP(id int, ip string) error
+	GetLastLoginIP(id int) (string, error)
+	SetOIDCRefreshToken(id int, provider, sealed string) error
+	GetOIDCRefreshToken(id int) (provider, sealed string, err error)
 }
 
 type userRepo struct {
 	db                          *sql.DB
-	stmtGetCredentials          *sql.Stmt
-	stmtGetIDAndRole            *sql.Stmt
-	stmtUpdatePassword          *sql.Stmt
-	stmtGetPasswordHash         *sql.Stmt
-	stmtGetAll                  *sql.Stmt
-	stmtCreate                  *sql.Stmt
-	stmtDelete                  *sql.Stmt
-	stmtGetRoleNameByUserID     *sql.Stmt
-	stmtGetRoleNameByUsername   *sql.Stmt
-	stmtUpdateRole              *sql.Stmt
-	stmtResetPassword           *sql.Stmt
-	stmtGetExtraServices        *sql.Stmt
-	stmtAddExtraService         *sql.Stmt
-	stmtRemoveExtraService      *sql.Stmt
-	stmtCreateRefreshToken      *sql.Stmt
-	stmtGetRefreshToken         *sql.Stmt
-	stmtDeleteRefreshToken      *sql.Stmt
-	stmtDeleteUserRefreshTokens *sql.Stmt
-	stmtGetByProviderAndID      *sql.Stmt
-	stmtGetFullInfoByID         *sql.Stmt
-	stmtGetIDByUsername         *sql.Stmt
-	stmtGetProvider             *sql.Stmt
-	stmtGetRoleAndID            *sql.Stmt
+	stmtGetCredentials          *stmt
+	stmtGetIDAndRole            *stmt
+	stmtGetPasswordHash         *stmt
+	stmtGetAll                  sortedStmts
+	stmtGetPage                 sortedStmts
+	stmtCreate                  *stmt
+	stmtDelete                  *stmt
+	stmtGetRoleNameByUserID     *stmt
+	stmtGetRoleNameByUsername   *stmt
+	stmtUpdateRole              *stmt
+	stmtGetExtraServices        *stmt
+	stmtAddExtraService         *stmt
+	stmtRemoveExtraService      *stmt
+	stmtCreateRefreshToken      *stmt
+	stmtGetRefreshToken         *stmt
+	stmtDeleteRefreshToken      *stmt
+	stmtDeleteUserRefreshTokens *stmt
+	stmtGetByProviderAndID      *stmt
+	stmtGetFullInfoByID         *stmt
+	stmtGetIDByUsername         *stmt
+	stmtGetProvider             *stmt
+	stmtGetRoleAndID            *stmt
+	stmtGetAccess               *stmt
+	stmtGetCapabilities         *stmt
+	stmtGetAuthState            *stmt
+	stmtCountByRole             *stmt
+	stmtExists                  *stmt
+	stmtServiceExists           *stmt
+	stmtSetLastLoginIP          *stmt
+	stmtGetLastLoginIP          *stmt
+	stmtSetOIDCRefreshToken     *stmt
+	stmtGetOIDCRefreshToken     *stmt
 }
 
 // NewUserRepository prepares all statements and returns a UserRepository.
 func NewUserRepository(db *sql.DB) (UserRepository, error) {
-	r := &userRepo{db: db}
-	var err error
-
-	queries := map[**sql.Stmt]string{
-		&r.stmtGetCredentials:          "SELECT password, is_active FROM users WHERE username = ?",
-		&r.stmtGetIDAndRole:            "SELECT id, role_id FROM users WHERE username = ?",
-		&r.stmtUpdatePassword:          "UPDATE users SET password = ? WHERE username = ?",
-		&r.stmtGetPasswordHash:         "SELECT password FROM users WHERE username = ?",
-		&r.stmtGetAll:                  "SELECT id, username, role_id, is_active FROM users",
-		&r.stmtCreate:                  "INSERT INTO users (username, password, role_id) VALUES (?, ?, ?)",
-		&r.stmtDelete:                  "DELETE FROM users WHERE id = ?",
-		&r.stmtGetRoleNameByUserID:     "SELECT r.name FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.id = ?",
-		&r.stmtGetRoleNameByUsername:   "SELECT r.name FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.username = ?",
-		&r.stmtUpdateRole:              "UPDATE users SET role_id = ? WHERE id = ?",
-		&r.stmtResetPassword:           "UPDATE users SET password = ? WHERE id = ?",
-		&r.stmtGetExtraServices:        "SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at FROM services s JOIN user_extra_services ues ON s.id = ues.service_id WHERE ues.user_id = ?",
-		&r.stmtAddExtraService:         "INSERT OR IGNORE INTO user_extra_services (user_id, service_id) VALUES (?, ?)",
-		&r.stmtRemoveExtraService:      "DELETE FROM user_extra_services WHERE user_id = ? AND service_id = ?",
-		&r.stmtCreateRefreshToken:      "INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)",
-		&r.stmtGetRefreshToken:         "SELECT user_id FROM refresh_tokens WHERE token = ? AND expires_at > ?",
-		&r.stmtDeleteRefreshToken:      "DELETE FROM refresh_tokens WHERE token = ?",
-		&r.stmtDeleteUserRefreshTokens: "DELETE FROM refresh_tokens WHERE user_id = ?",
-		&r.stmtGetByProviderAndID:      "SELECT id, username, role_id, is_active, provider, provider_id FROM users WHERE provider = ? AND provider_id = ?",
-		&r.stmtGetFullInfoByID:         "SELECT u.username, r.name, r.id, u.is_active, COALESCE(u.provider, 'local') FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.id = ?",
-		&r.stmtGetIDByUsername:         "SELECT id FROM users WHERE username = ?",
-		&r.stmtGetProvider:             "SELECT COALESCE(provider, 'local') FROM users WHERE username = ?",
-		&r.stmtGetRoleAndID:            "SELECT r.name, r.id FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.username = ?",
-	}
-
-	for stmt, query := range queries {
-		*stmt, err = db.Prepare(query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to prepare query %q: %w", query, err)
-		}
+	r := &userRepo{}
+	if err := r.rebind(db); err != nil {
+		return nil, err
 	}
+	track(db, r)
 	return r, nil
 }
 
+// rebind prepares all statements on db, closing any prepared on a previous pool.
+func (r *userRepo) rebind(db *sql.DB) error {
+	r.db = db
+	if err := prepareSorted(db, &r.stmtGetAll, "users.GetAll", "SELECT id, username, role_id, is_active FROM users", UserSortColumns); err != nil {
+		return err
+	}
+	if err := prepareKeyset(db, &r.stmtGetPage, "users.GetPage", "SELECT id, username, role_id, is_active FROM users", UserSortColumns); err != nil {
+		return err
+	}
+	return prepareAll(db, map[**stmt]namedQuery{
+		&r.stmtGetCredentials:          {"users.GetCredentials", "SELECT password, is_active FROM users WHERE username = ?"},
+		&r.stmtGetIDAndRole:            {"users.GetIDAndRole", "SELECT id, role_id FROM users WHERE username = ?"},
+		&r.stmtGetPasswordHash:         {"users.GetPasswordHash", "SELECT password FROM users WHERE username = ?"},
+		&r.stmtCreate:                  {"users.Create", "INSERT INTO users (username, password, role_id) VALUES (?, ?, ?)"},
+		&r.stmtDelete:                  {"users.Delete", "DELETE FROM users WHERE id = ?"},
+		&r.stmtGetRoleNameByUserID:     {"users.GetRoleNameByUserID", "SELECT r.name FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.id = ?"},
+		&r.stmtGetRoleNameByUsername:   {"users.GetRoleNameByUsername", "SELECT r.name FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.username = ?"},
+		&r.stmtUpdateRole:              {"users.UpdateRole", "UPDATE users SET token_generation = token_generation + (role_id IS NOT ?1), role_id = ?1 WHERE id = ?2"},
+		&r.stmtGetExtraServices:        {"users.GetExtraServices", "SELECT s.id, s.name, s.hostname, s.ip, s.port, s.description, s.created_at FROM services s JOIN user_extra_services ues ON s.id = ues.service_id WHERE ues.user_id = ?"},
+		&r.stmtAddExtraService:         {"users.AddExtraService", "INSERT OR IGNORE INTO user_extra_services (user_id, service_id) VALUES (?, ?)"},
+		&r.stmtRemoveExtraService:      {"users.RemoveExtraService", "DELETE FROM user_extra_services WHERE user_id = ? AND service_id = ?"},
+		&r.stmtCreateRefreshToken:      {"users.CreateRefreshToken", "INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)"},
+		&r.stmtGetRefreshToken:         {"users.GetRefreshToken", "SELECT user_id, created_at FROM refresh_tokens WHERE token = ? AND expires_at > ?"},
+		&r.stmtDeleteRefreshToken:      {"users.DeleteRefreshToken", "DELETE FROM refresh_tokens WHERE token = ? AND user_id = ?"},
+		&r.stmtDeleteUserRefreshTokens: {"users.DeleteUserRefreshTokens", "DELETE FROM refresh_tokens WHERE user_id = ?"},
+		&r.stmtGetByProviderAndID:      {"users.GetByProviderAndID", "SELECT id, username, role_id, is_active, provider, provider_id FROM users WHERE provider = ? AND provider_id = ?"},
+		&r.stmtGetFullInfoByID:         {"users.GetFullInfoByID", "SELECT u.username, r.name, r.id, u.is_active, COALESCE(u.provider, 'local') FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.id = ?"},
+		&r.stmtGetIDByUsername:         {"users.GetIDByUsername", "SELECT id FROM users WHERE username = ?"},
+		&r.stmtGetProvider:             {"users.GetProvider", "SELECT COALESCE(provider, 'local') FROM users WHERE username = ?"},
+		&r.stmtGetRoleAndID:            {"users.GetRoleAndID", "SELECT r.name, r.id FROM users u INNER JOIN roles r ON u.role_id = r.id WHERE u.username = ?"},
+		&r.stmtGetCapabilities:         {"users.GetCapabilities", "SELECT COALESCE(GROUP_CONCAT(rc.capability), '') FROM users u LEFT JOIN role_capabilities rc ON rc.role_id = u.role_id WHERE u.username = ? GROUP BY u.id"},
+		&r.stmtGetAccess: {"users.GetAccess", `SELECT r.name, r.id,
+			COALESCE((SELECT GROUP_CONCAT(capability) FROM role_capabilities rc WHERE rc.role_id = r.id), ''), s.id, s.name FROM users u
+			INNER JOIN roles r ON u.role_id = r.id
+			LEFT JOIN services s ON s.id IN (
+				SELECT service_id FROM role_services WHERE role_id = u.role_id
+				UNION
+				SELECT service_id FROM user_extra_services WHERE user_id = u.id)
+			WHERE u.username = ? ORDER BY s.name`},
+		&r.stmtGetAuthState:        {"users.GetAuthState", "SELECT is_active, token_generation FROM users WHERE username = ?"},
+		&r.stmtCountByRole:         {"users.CountByRole", "SELECT COUNT(*) FROM users WHERE role_id = ?"},
+		&r.stmtExists:              {"users.Exists", "SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)"},
+		&r.stmtServiceExists:       {"users.ServiceExists", "SELECT EXISTS(SELECT 1 FROM services WHERE id = ?)"},
+		&r.stmtSetLastLoginIP:      {"users.SetLastLoginIP", "UPDATE users SET last_login_ip = ? WHERE id = ?"},
+		&r.stmtGetLastLoginIP:      {"users.GetLastLoginIP", "SELECT COALESCE(last_login_ip, '') FROM users WHERE id = ?"},
+		&r.stmtSetOIDCRefreshToken: {"users.SetOIDCRefreshToken", "INSERT INTO oidc_refresh_tokens (user_id, provider, token) VALUES (?, ?, ?) ON CONFLICT(user_id) DO UPDATE SET provider = excluded.provider, token = excluded.token, updated_at = CURRENT_TIMESTAMP"},
+		&r.stmtGetOIDCRefreshToken: {"users.GetOIDCRefreshToken", "SELECT provider, token FROM oidc_refresh_tokens WHERE user_id = ?"},
+	})
+}
+
 func (r *userRepo) GetCredentials(username string) (string, bool, error) {
 	var hash string
 	var isActive bool
@@ -117,12 +157,27 @@ func (r *userRepo) GetIDAndRole(username string) (int, int, error) {
 	return id, roleID, err
 }
 
+// UpdatePassword sets the password of username, deletes their refresh tokens and raises their token
+// generation in one transaction, like ResetPassword.
 func (r *userRepo) UpdatePassword(username, newHash string) (int64, error) {
-	res, err := r.stmtUpdatePassword.Exec(newHash, username)
+	tx, err := r.db.Begin()
 	if err != nil {
 		return 0, err
 	}
-	return res.RowsAffected()
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET password = ?, token_generation = token_generation + 1 WHERE username = ?", newHash, username)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = (SELECT id FROM users WHERE username = ?)", username); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
 func (r *userRepo) GetPasswordHash(username string) (string, error) {
@@ -131,8 +186,12 @@ func (r *userRepo) GetPasswordHash(username string) (string, error) {
 	return hash, err
 }
 
-func (r *userRepo) GetAll() ([]models.User, error) {
-	rows, err := r.stmtGetAll.Query()
+func (r *userRepo) GetAll(sort Sort) ([]models.User, error) {
+	st, err := r.stmtGetAll.get(sort)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.Query()
 	if err != nil {
 		return nil, err
 	}
@@ -148,6 +207,34 @@ func (r *userRepo) GetAll() ([]models.User, error) {
 	return users, rows.Err()
 }
 
+// GetPage returns up to limit users after the cursor, or from the start when after is nil. The
+// returned cursor marks the last user and is nil when there are no more.
+func (r *userRepo) GetPage(sort Sort, after *Cursor, limit int) ([]models.User, *Cursor, error) {
+	st, err := r.stmtGetPage.get(sort)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := st.Query(pageArgs(after, limit+1)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	users := make([]models.User, 0, limit)
+	var last Cursor
+	for rows.Next() {
+		if len(users) == limit {
+			return users, &last, nil
+		}
+		var u models.User
+		if err := rows.Scan(&u.Id, &u.Username, &u.RoleId, &u.IsActive, &last.Value); err != nil {
+			return nil, nil, err
+		}
+		last.ID = u.Id
+		users = append(users, u)
+	}
+	return users, nil, rows.Err()
+}
+
 func (r *userRepo) Create(username, hashedPwd string, roleID int) (int64, error) {
 	res, err := r.stmtCreate.Exec(username, hashedPwd, roleID)
 	if err != nil {
@@ -184,12 +271,27 @@ func (r *userRepo) UpdateRole(id, roleID int) (int64, error) {
 	return res.RowsAffected()
 }
 
+// ResetPassword sets the password of user id, deletes their refresh tokens and raises their token
+// generation in one transaction, so no session from before the reset keeps working.
 func (r *userRepo) ResetPassword(id int, newHash string) (int64, error) {
-	res, err := r.stmtResetPassword.Exec(newHash, id)
+	tx, err := r.db.Begin()
 	if err != nil {
 		return 0, err
 	}
-	return res.RowsAffected()
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET password = ?, token_generation = token_generation + 1 WHERE id = ?", newHash, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", id); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
 func (r *userRepo) GetExtraServices(userID int) ([]models.Service, error) {
@@ -202,7 +304,7 @@ func (r *userRepo) GetExtraServices(userID int) ([]models.Service, error) {
 	for rows.Next() {
 		var s models.Service
 		var desc sql.NullString
-		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, &s.CreatedAt); err != nil {
+		if err := rows.Scan(&s.Id, &s.Name, &s.Hostname, &s.Ip, &s.Port, &desc, utcTime{&s.CreatedAt}); err != nil {
 			continue
 		}
 		s.Description = desc.String
@@ -216,30 +318,64 @@ func (r *userRepo) AddExtraService(userID, serviceID int) error {
 	return err
 }
 
-func (r *userRepo) RemoveExtraService(userID, serviceID int) error {
-	_, err := r.stmtRemoveExtraService.Exec(userID, serviceID)
-	return err
+func (r *userRepo) RemoveExtraService(userID, serviceID int) (int64, error) {
+	res, err := r.stmtRemoveExtraService.Exec(userID, serviceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 func (r *userRepo) CreateRefreshToken(token string, userID int, expiresAt time.Time) error {
-	_, err := r.stmtCreateRefreshToken.Exec(token, userID, expiresAt)
+	_, err := r.stmtCreateRefreshToken.Exec(token, userID, dbTime(expiresAt))
 	return err
 }
 
-func (r *userRepo) GetRefreshToken(token string) (int, error) {
+// GetRefreshToken returns the owner of an unexpired refresh token and when the token was issued.
+func (r *userRepo) GetRefreshToken(token string) (int, time.Time, error) {
 	var userID int
-	err := r.stmtGetRefreshToken.QueryRow(token, time.Now()).Scan(&userID)
-	return userID, err
+	var issuedAt time.Time
+	err := r.stmtGetRefreshToken.QueryRow(token, dbTime(time.Now())).Scan(&userID, utcTime{&issuedAt})
+	return userID, issuedAt, err
 }
 
-func (r *userRepo) DeleteRefreshToken(token string) error {
-	_, err := r.stmtDeleteRefreshToken.Exec(token)
+// DeleteRefreshToken deletes one refresh token of userID; tokens of other users are left alone.
+func (r *userRepo) DeleteRefreshToken(userID int, token string) error {
+	_, err := r.stmtDeleteRefreshToken.Exec(token, userID)
 	return err
 }
 
-func (r *userRepo) DeleteUserRefreshTokens(userID int) error {
-	_, err := r.stmtDeleteUserRefreshTokens.Exec(userID)
-	return err
+// DeleteUserRefreshTokens deletes every refresh token of userID and returns how many there were.
+func (r *userRepo) DeleteUserRefreshTokens(userID int) (int64, error) {
+	res, err := r.stmtDeleteUserRefreshTokens.Exec(userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RevokeUserTokens deletes every refresh token of userID and raises their token generation in one
+// transaction, so neither the refresh tokens nor the access tokens issued before keep working. It
+// returns how many refresh tokens there were.
+func (r *userRepo) RevokeUserTokens(userID int) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE users SET token_generation = token_generation + 1 WHERE id = ?", userID); err != nil {
+		return 0, err
+	}
+	return revoked, tx.Commit()
 }
 
 func (r *userRepo) CleanupExpiredRefreshTokens() error {
@@ -306,3 +442,99 @@ func (r *userRepo) GetRoleAndIDByUsername(username string) (string, int, error)
 	err := r.stmtGetRoleAndID.QueryRow(username).Scan(&roleName, &roleID)
 	return roleName, roleID, err
 }
+
+// GetAccessByUsername returns the user's role, its capabilities and every service the role or the
+// user's extra grants give access to, by name. It returns sql.ErrNoRows for an unknown user.
+func (r *userRepo) GetAccessByUsername(username string) (string, int, []models.ServiceRef, []string, error) {
+	rows, err := r.stmtGetAccess.Query(username)
+	if err != nil {
+		return "", 0, nil, nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var roleName, caps string
+	var roleID int
+	found := false
+	services := []models.ServiceRef{}
+	for rows.Next() {
+		var svcID sql.NullInt64
+		var svcName sql.NullString
+		if err := rows.Scan(&roleName, &roleID, &caps, &svcID, &svcName); err != nil {
+			return "", 0, nil, nil, err
+		}
+		found = true
+		if svcID.Valid {
+			services = append(services, models.ServiceRef{Id: int(svcID.Int64), Name: svcName.String})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, nil, nil, err
+	}
+	if !found {
+		return "", 0, nil, nil, sql.ErrNoRows
+	}
+	return roleName, roleID, services, splitCapabilities(caps), nil
+}
+
+// GetCapabilitiesByUsername returns the capabilities of the user's role, or sql.ErrNoRows for an
+// unknown user.
+func (r *userRepo) GetCapabilitiesByUsername(username string) ([]string, error) {
+	var caps string
+	if err := r.stmtGetCapabilities.QueryRow(username).Scan(&caps); err != nil {
+		return nil, err
+	}
+	return splitCapabilities(caps), nil
+}
+
+// GetAuthState returns whether the user's account is enabled and its token generation, or
+// sql.ErrNoRows for an unknown user.
+func (r *userRepo) GetAuthState(username string) (bool, int64, error) {
+	var active bool
+	var generation int64
+	err := r.stmtGetAuthState.QueryRow(username).Scan(&active, &generation)
+	return active, generation, err
+}
+
+func (r *userRepo) CountByRole(roleID int) (int, error) {
+	var n int
+	err := r.stmtCountByRole.QueryRow(roleID).Scan(&n)
+	return n, err
+}
+
+func (r *userRepo) Exists(id int) (bool, error) {
+	var exists bool
+	err := r.stmtExists.QueryRow(id).Scan(&exists)
+	return exists, err
+}
+
+func (r *userRepo) ServiceExists(serviceID int) (bool, error) {
+	var exists bool
+	err := r.stmtServiceExists.QueryRow(serviceID).Scan(&exists)
+	return exists, err
+}
+
+func (r *userRepo) SetLastLoginIP(id int, ip string) error {
+	_, err := r.stmtSetLastLoginIP.Exec(ip, id)
+	return err
+}
+
+// GetLastLoginIP returns the client IP of the user's most recent login, or "" if none is recorded.
+func (r *userRepo) GetLastLoginIP(id int) (string, error) {
+	var ip string
+	err := r.stmtGetLastLoginIP.QueryRow(id).Scan(&ip)
+	return ip, err
+}
+
+// SetOIDCRefreshToken stores the encrypted refresh token a provider issued to the user, replacing
+// any earlier one.
+func (r *userRepo) SetOIDCRefreshToken(id int, provider, sealed string) error {
+	_, err := r.stmtSetOIDCRefreshToken.Exec(id, provider, sealed)
+	return err
+}
+
+// GetOIDCRefreshToken returns the provider and encrypted refresh token stored for the user, or
+// sql.ErrNoRows if there is none.
+func (r *userRepo) GetOIDCRefreshToken(id int) (provider, sealed string, err error) {
+	err = r.stmtGetOIDCRefreshToken.QueryRow(id).Scan(&provider, &sealed)
+	return provider, sealed, err
+}
@@ -3,42 +3,107 @@ package router
 import (
 	"Aegis/controller/internal/handler"
 	internalMiddleware "Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Token introspection is a debugging aid, so each user may introspect introspectBurst tokens at once
+// and one more every introspectInterval after that.
+const (
+	introspectInterval = 6 * time.Second
+	introspectBurst    = 10
+)
+
 // RouterConfig holds all handlers and middleware for setting up routes.
 type RouterConfig struct {
-	AuthHandler    *handler.AuthHandler
-	UserHandler    *handler.UserHandler
-	RoleHandler    *handler.RoleHandler
-	ServiceHandler *handler.ServiceHandler
-	OIDCHandler    *handler.OIDCHandler
-	AuthMiddleware gin.HandlerFunc
-	RootOnly       gin.HandlerFunc
-	AdminOrRoot    gin.HandlerFunc
+	AuthHandler      *handler.AuthHandler
+	UserHandler      *handler.UserHandler
+	RoleHandler      *handler.RoleHandler
+	ServiceHandler   *handler.ServiceHandler
+	OIDCHandler      *handler.OIDCHandler
+	HealthHandler    *handler.HealthHandler
+	SessionHandler   *handler.SessionHandler
+	PolicyHandler    *handler.PolicyHandler
+	TokenHandler     *handler.TokenHandler
+	IntegrityHandler *handler.IntegrityHandler
+	ConfigHandler    *handler.ConfigHandler
+	VersionHandler   *handler.VersionHandler
+	MetricsHandler   gin.HandlerFunc
+	AuthMiddleware   gin.HandlerFunc
+	// RequireCapability returns middleware that admits users whose role holds any of caps.
+	RequireCapability func(caps ...string) gin.HandlerFunc
+	StaticDir         string
+	// Tracing starts a span for every request; see middleware.Tracing.
+	Tracing bool
+	// Static asset delivery toggles
+	StaticCompression  bool
+	StaticCacheHeaders bool
 }
 
 // NewRouter builds and returns the configured Gin router.
 func NewRouter(cfg RouterConfig) *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Logger(), gin.Recovery())
+	if cfg.Tracing {
+		r.Use(internalMiddleware.Tracing())
+	}
 	r.Use(internalMiddleware.SecurityHeaders())
 
-	r.StaticFS("/static", http.Dir("static"))
-	r.GET("/", func(c *gin.Context) {
-		c.File("static/pages/login.html")
-	})
+	// Methods are enforced by the routes alone; handlers never check them. A known path requested
+	// with the wrong method gets a JSON 405 with an Allow header listing the registered methods.
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(methodNotAllowed)
+
+	staticDir := cfg.StaticDir
+	if staticDir == "" {
+		staticDir = "static"
+	}
+
+	var assetMW []gin.HandlerFunc
+	if cfg.StaticCacheHeaders {
+		assetMW = append(assetMW, internalMiddleware.StaticCacheHeaders(staticDir, "/static"))
+	}
+	if cfg.StaticCompression {
+		assetMW = append(assetMW, internalMiddleware.StaticCompression())
+	}
 
-	api := r.Group("/api")
+	static := r.Group("/static", assetMW...)
+	static.StaticFS("", http.Dir(staticDir))
+	r.GET("/", append(slices.Clip(assetMW), func(c *gin.Context) {
+		c.File(filepath.Join(staticDir, "pages", "login.html"))
+	})...)
+	r.NoRoute(spaFallback(staticDir, assetMW)...)
+
+	if cfg.HealthHandler != nil {
+		r.GET("/healthz", cfg.HealthHandler.Liveness)
+		r.GET("/readyz", cfg.HealthHandler.Readiness)
+	}
+	if cfg.MetricsHandler != nil {
+		r.GET("/metrics", cfg.MetricsHandler)
+	}
+
+	api := r.Group("/api", internalMiddleware.RequireJSON())
+
+	if cfg.VersionHandler != nil {
+		api.GET("/version", cfg.VersionHandler.Get)
+	}
 
 	auth := api.Group("/auth")
 	{
 		auth.POST("/login", cfg.AuthHandler.Login)
 		auth.POST("/logout", cfg.AuthMiddleware, cfg.AuthHandler.Logout)
 		auth.POST("/password", cfg.AuthMiddleware, cfg.AuthHandler.UpdatePassword)
+		auth.POST("/step-up", cfg.AuthMiddleware, cfg.AuthHandler.StepUp)
 		auth.GET("/me", cfg.AuthMiddleware, cfg.AuthHandler.GetCurrentUser)
+		auth.POST("/introspect", cfg.AuthMiddleware, internalMiddleware.RateLimit(introspectInterval, introspectBurst), cfg.AuthHandler.Introspect)
 		auth.POST("/refresh", cfg.AuthHandler.RefreshToken)
 
 		if cfg.OIDCHandler != nil {
@@ -49,37 +114,84 @@ func NewRouter(cfg RouterConfig) *gin.Engine {
 		}
 	}
 
+	// Each management area has a read guard for its GETs and a write guard for every method that changes
+	// state. Read guards also admit view_management, so list-only access (the built-in auditor role) can
+	// be delegated without any manage capability.
+	readGuard := func(caps ...string) gin.HandlerFunc {
+		return cfg.RequireCapability(append(caps, models.CapViewManagement)...)
+	}
+	// Listing roles is needed to assign users and services as well as to manage roles.
+	readRoles := readGuard(models.CapManageRoles, models.CapManageUsers, models.CapManageServices)
+	writeRoles := cfg.RequireCapability(models.CapManageRoles)
+	readServices := readGuard(models.CapManageServices)
+	writeServices := cfg.RequireCapability(models.CapManageServices)
+	readUsers := readGuard(models.CapManageUsers)
+	writeUsers := cfg.RequireCapability(models.CapManageUsers)
+
 	roles := api.Group("/roles")
 	roles.Use(cfg.AuthMiddleware)
 	{
-		roles.GET("", cfg.AdminOrRoot, cfg.RoleHandler.GetAll)
-		roles.POST("", cfg.RootOnly, cfg.RoleHandler.Create)
-		roles.DELETE("/:id", cfg.RootOnly, cfg.RoleHandler.Delete)
-		roles.GET("/:id/services", cfg.AdminOrRoot, cfg.RoleHandler.GetServices)
-		roles.POST("/:id/services", cfg.AdminOrRoot, cfg.RoleHandler.AddService)
-		roles.DELETE("/:id/services/:svc_id", cfg.AdminOrRoot, cfg.RoleHandler.RemoveService)
+		roles.GET("", readRoles, cfg.RoleHandler.GetAll)
+		roles.POST("", writeRoles, cfg.RoleHandler.Create)
+		roles.DELETE("/:id", writeRoles, cfg.RoleHandler.Delete)
+		roles.GET("/capabilities", readGuard(models.CapManageRoles), cfg.RoleHandler.GetCapabilities)
+		roles.PUT("/:id/capabilities", writeRoles, cfg.RoleHandler.SetCapabilities)
+		roles.PUT("/:id/max-ttl", writeRoles, cfg.RoleHandler.SetMaxTTL)
+		roles.GET("/:id/services", readServices, cfg.RoleHandler.GetServices)
+		roles.POST("/:id/services", writeServices, cfg.RoleHandler.AddService)
+		roles.DELETE("/:id/services/:svc_id", writeServices, cfg.RoleHandler.RemoveService)
 	}
 
 	services := api.Group("/services")
-	services.Use(cfg.AuthMiddleware, cfg.AdminOrRoot)
+	services.Use(cfg.AuthMiddleware)
 	{
-		services.GET("", cfg.ServiceHandler.GetAll)
-		services.POST("", cfg.ServiceHandler.Create)
-		services.PUT("/:id", cfg.ServiceHandler.Update)
-		services.DELETE("/:id", cfg.ServiceHandler.Delete)
+		services.GET("", readServices, cfg.ServiceHandler.GetAll)
+		services.GET("/unassigned", readServices, cfg.ServiceHandler.GetUnassigned)
+		services.POST("", writeServices, cfg.ServiceHandler.Create)
+		services.PUT("/:id", writeServices, cfg.ServiceHandler.Update)
+		services.DELETE("/:id", writeServices, cfg.ServiceHandler.Delete)
+		services.PUT("/:id/container", writeServices, cfg.ServiceHandler.BindContainer)
+		services.DELETE("/:id/container", writeServices, cfg.ServiceHandler.UnbindContainer)
 	}
 
 	users := api.Group("/users")
-	users.Use(cfg.AuthMiddleware, cfg.AdminOrRoot)
+	users.Use(cfg.AuthMiddleware)
 	{
-		users.GET("", cfg.UserHandler.GetAll)
-		users.POST("", cfg.UserHandler.Create)
-		users.DELETE("/:id", cfg.UserHandler.Delete)
-		users.PUT("/:id/role", cfg.UserHandler.UpdateRole)
-		users.POST("/:id/reset-password", cfg.UserHandler.ResetPassword)
-		users.GET("/:id/services", cfg.UserHandler.GetServices)
-		users.POST("/:id/services", cfg.UserHandler.AddService)
-		users.DELETE("/:id/services/:svc_id", cfg.UserHandler.RemoveService)
+		users.GET("", readUsers, cfg.UserHandler.GetAll)
+		users.POST("", writeUsers, cfg.UserHandler.Create)
+		users.DELETE("/:id", writeUsers, cfg.UserHandler.Delete)
+		users.PUT("/:id/role", writeUsers, cfg.UserHandler.UpdateRole)
+		users.POST("/:id/reset-password", writeUsers, cfg.UserHandler.ResetPassword)
+		users.GET("/:id/services", readUsers, cfg.UserHandler.GetServices)
+		users.POST("/:id/services", writeUsers, cfg.UserHandler.AddService)
+		users.DELETE("/:id/services/:svc_id", writeUsers, cfg.UserHandler.RemoveService)
+		users.POST("/:id/selected", writeUsers, cfg.UserHandler.ActivateService)
+	}
+
+	admin := api.Group("/admin")
+	admin.Use(cfg.AuthMiddleware)
+	if cfg.IntegrityHandler != nil {
+		admin.GET("/integrity", readGuard(models.CapManageServices, models.CapManageUsers), cfg.IntegrityHandler.Get)
+		// Cleanup deletes rows directly, so it is left to root.
+		admin.POST("/integrity", cfg.RequireCapability(models.CapManageRoles), cfg.IntegrityHandler.Clean)
+	}
+	if cfg.SessionHandler != nil {
+		viewSessions := cfg.RequireCapability(models.CapViewSessions)
+		admin.GET("/sessions", viewSessions, cfg.SessionHandler.GetAgentSessions)
+		admin.GET("/reconcile", viewSessions, cfg.SessionHandler.GetReconcile)
+		admin.POST("/reconcile", viewSessions, writeServices, cfg.SessionHandler.Reconcile)
+	}
+	if cfg.PolicyHandler != nil {
+		admin.GET("/export", cfg.RequireCapability(models.CapExportPolicy), cfg.PolicyHandler.Export)
+		admin.POST("/import", cfg.RequireCapability(models.CapImportPolicy), cfg.PolicyHandler.Import)
+	}
+	if cfg.OIDCHandler != nil {
+		// Role mapping decides who gets which role, so testing it is left to root like the config.
+		admin.POST("/oidc/test-mapping", cfg.RequireCapability(models.CapManageRoles), cfg.OIDCHandler.TestMapping)
+	}
+	if cfg.ConfigHandler != nil {
+		// The configuration names key files, agents and upstream endpoints, so it is left to root.
+		admin.GET("/config", cfg.RequireCapability(models.CapManageRoles), cfg.ConfigHandler.Get)
 	}
 
 	me := api.Group("/me")
@@ -89,7 +201,45 @@ func NewRouter(cfg RouterConfig) *gin.Engine {
 		me.GET("/selected", cfg.ServiceHandler.GetMyActiveServices)
 		me.POST("/selected", cfg.ServiceHandler.SelectActiveService)
 		me.DELETE("/selected/:svc_id", cfg.ServiceHandler.DeselectActiveService)
+		if cfg.TokenHandler != nil {
+			me.GET("/tokens", cfg.TokenHandler.GetAll)
+			me.POST("/tokens", cfg.TokenHandler.Create)
+			me.DELETE("/tokens/:id", cfg.TokenHandler.Delete)
+		}
 	}
 
 	return r
 }
+
+// methodNotAllowed is the NoMethod handler. Gin sets the Allow header before it runs.
+func methodNotAllowed(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+}
+
+// spaFallback returns the NoRoute chain that serves index.html for client-side routes.
+// Unknown /api/ and /static/ paths, asset-like paths and non-GET requests get a 404
+// before the asset middleware runs, so API errors are never compressed.
+func spaFallback(staticDir string, assetMW []gin.HandlerFunc) []gin.HandlerFunc {
+	index := filepath.Join(staticDir, "index.html")
+	guard := func(c *gin.Context) {
+		p := c.Request.URL.Path
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead ||
+			p == "/api" || strings.HasPrefix(p, "/api/") ||
+			p == "/static" || strings.HasPrefix(p, "/static/") ||
+			strings.Contains(p, "..") || path.Ext(p) != "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+
+		if info, err := os.Stat(index); err != nil || info.IsDir() {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.Next()
+	}
+
+	chain := append([]gin.HandlerFunc{guard}, assetMW...)
+	return append(chain, func(c *gin.Context) {
+		c.File(index)
+	})
+}
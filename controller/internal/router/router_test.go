@@ -0,0 +1,257 @@
+package router
+
+import (
+	"Aegis/controller/internal/handler"
+	internalMiddleware "Aegis/controller/internal/middleware"
+	"Aegis/controller/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter builds a router serving from a temp static dir with an index.html.
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "js"), 0755); err != nil {
+		t.Fatalf("failed to create static dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>spa</html>"), 0644); err != nil {
+		t.Fatalf("failed to write index.html: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "js", "app.js"), []byte("console.log('app')"), 0644); err != nil {
+		t.Fatalf("failed to write app.js: %v", err)
+	}
+
+	noop := func(c *gin.Context) { c.Next() }
+	return NewRouter(RouterConfig{
+		AuthHandler:    &handler.AuthHandler{},
+		UserHandler:    &handler.UserHandler{},
+		RoleHandler:    &handler.RoleHandler{},
+		ServiceHandler: &handler.ServiceHandler{},
+		AuthMiddleware: noop,
+		StaticDir:      dir,
+
+		RequireCapability: func(...string) gin.HandlerFunc { return noop },
+	})
+}
+
+func TestSPAFallback(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"Deep link serves index", http.MethodGet, "/dashboard/services/3", http.StatusOK, "spa"},
+		{"Static asset served", http.MethodGet, "/static/js/app.js", http.StatusOK, "app"},
+		{"Unknown API path", http.MethodGet, "/api/does-not-exist", http.StatusNotFound, "Not found"},
+		{"Unknown static asset", http.MethodGet, "/static/js/missing.js", http.StatusNotFound, ""},
+		{"Asset-like path outside static", http.MethodGet, "/favicon.ico", http.StatusNotFound, "Not found"},
+		{"Non-GET request", http.MethodPost, "/dashboard", http.StatusNotFound, "Not found"},
+		{"Traversal attempt", http.MethodGet, "/static/../../etc/passwd", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantBody != "" && !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("Expected body to contain %q, got %q", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantAllow string
+	}{
+		{"GET on login", http.MethodGet, "/api/auth/login", "POST"},
+		{"GET on logout", http.MethodGet, "/api/auth/logout", "POST"},
+		{"PATCH on users", http.MethodPatch, "/api/users", "GET, POST"},
+		{"POST on a service", http.MethodPost, "/api/services/1", "DELETE, PUT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusMethodNotAllowed, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Expected Allow %q, got %q", tt.wantAllow, got)
+			}
+			if !strings.Contains(w.Body.String(), `"error":"Method not allowed"`) {
+				t.Errorf("Expected JSON error body, got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// newGuardedRouter builds a router whose capability guard stands in for the handlers: it answers 200
+// when held passes the guard and 403 otherwise, so only the route guards are exercised.
+func newGuardedRouter(t *testing.T, held ...string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	noop := func(c *gin.Context) { c.Next() }
+	return NewRouter(RouterConfig{
+		AuthHandler:      &handler.AuthHandler{},
+		UserHandler:      &handler.UserHandler{},
+		RoleHandler:      &handler.RoleHandler{},
+		ServiceHandler:   &handler.ServiceHandler{},
+		SessionHandler:   &handler.SessionHandler{},
+		IntegrityHandler: &handler.IntegrityHandler{},
+		ConfigHandler:    &handler.ConfigHandler{},
+		OIDCHandler:      &handler.OIDCHandler{},
+		AuthMiddleware:   noop,
+		StaticDir:        t.TempDir(),
+
+		RequireCapability: func(caps ...string) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				if !internalMiddleware.HasCapability(held, caps...) {
+					c.AbortWithStatus(http.StatusForbidden)
+					return
+				}
+				c.AbortWithStatus(http.StatusOK)
+			}
+		},
+	})
+}
+
+func TestAuditorIsReadOnly(t *testing.T) {
+	r := newGuardedRouter(t, models.CapViewManagement, models.CapViewSessions)
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/api/users", http.StatusOK},
+		{http.MethodGet, "/api/users/2/services", http.StatusOK},
+		{http.MethodGet, "/api/roles", http.StatusOK},
+		{http.MethodGet, "/api/roles/capabilities", http.StatusOK},
+		{http.MethodGet, "/api/roles/2/services", http.StatusOK},
+		{http.MethodGet, "/api/services", http.StatusOK},
+		{http.MethodGet, "/api/admin/sessions", http.StatusOK},
+		{http.MethodGet, "/api/admin/reconcile", http.StatusOK},
+		{http.MethodGet, "/api/admin/integrity", http.StatusOK},
+		{http.MethodPost, "/api/users", http.StatusForbidden},
+		{http.MethodPut, "/api/users/2/role", http.StatusForbidden},
+		{http.MethodPost, "/api/users/2/services", http.StatusForbidden},
+		{http.MethodPost, "/api/roles", http.StatusForbidden},
+		{http.MethodPut, "/api/roles/2/capabilities", http.StatusForbidden},
+		{http.MethodPost, "/api/services", http.StatusForbidden},
+		{http.MethodDelete, "/api/services/1", http.StatusForbidden},
+		{http.MethodPost, "/api/admin/integrity", http.StatusForbidden},
+		{http.MethodGet, "/api/admin/config", http.StatusForbidden},
+		{http.MethodPost, "/api/admin/oidc/test-mapping", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestManagementReadWriteGuards(t *testing.T) {
+	// A principal holding only view_management may call every GET of the management areas and none
+	// of their mutations, including routes added later.
+	r := newGuardedRouter(t, models.CapViewManagement)
+
+	checked := 0
+	for _, route := range r.Routes() {
+		if !strings.HasPrefix(route.Path, "/api/users") && !strings.HasPrefix(route.Path, "/api/services") &&
+			!strings.HasPrefix(route.Path, "/api/roles") {
+			continue
+		}
+		checked++
+		want := http.StatusForbidden
+		if route.Method == http.MethodGet {
+			want = http.StatusOK
+		}
+		path := strings.NewReplacer(":id", "2", ":svc_id", "1").Replace(route.Path)
+		t.Run(route.Method+" "+route.Path, func(t *testing.T) {
+			req := httptest.NewRequest(route.Method, path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != want {
+				t.Errorf("Expected status %d, got %d", want, w.Code)
+			}
+		})
+	}
+	if checked == 0 {
+		t.Fatal("Expected management routes to be registered")
+	}
+}
+
+func TestAPIRejectsFormBodies(t *testing.T) {
+	r := newTestRouter(t)
+
+	for _, path := range []string{"/api/auth/login", "/api/users", "/api/me/selected"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("username=root&password=x"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("Expected status %d, got %d. Response: %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestVersionIsPublic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := NewRouter(RouterConfig{
+		AuthHandler:    &handler.AuthHandler{},
+		UserHandler:    &handler.UserHandler{},
+		RoleHandler:    &handler.RoleHandler{},
+		ServiceHandler: &handler.ServiceHandler{},
+		VersionHandler: handler.NewVersionHandler(handler.BuildInfo{Version: "1.4.0"}),
+		AuthMiddleware: func(c *gin.Context) { c.AbortWithStatus(http.StatusUnauthorized) },
+		StaticDir:      t.TempDir(),
+
+		RequireCapability: func(...string) gin.HandlerFunc { return func(c *gin.Context) { c.Next() } },
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"version":"1.4.0"`) {
+		t.Errorf("Expected the version without authentication, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -4,20 +4,26 @@ import (
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"database/sql"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// AuthConfig holds JWT signing configuration.
+// AuthConfig holds JWT signing configuration. PrivateKey, an *rsa.PrivateKey (RS256) or a P-256
+// *ecdsa.PrivateKey (ES256), signs tokens when set; otherwise they are signed with JWTKey (HS256).
+// PublicKeys holds its public key and those of keys retired or not yet in use, which tokens are also
+// verified with.
 type AuthConfig struct {
 	JWTKey        []byte
-	PrivateKey    *rsa.PrivateKey
-	PublicKey     *rsa.PublicKey
+	PrivateKey    crypto.Signer
+	PublicKeys    utils.KeySet
 	TokenLifetime time.Duration
 }
 
@@ -32,9 +38,18 @@ type LoginResult struct {
 
 // CurrentUserInfo is returned by GetCurrentUser.
 type CurrentUserInfo struct {
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	RoleId   int    `json:"role_id"`
+	Username     string              `json:"username"`
+	Role         string              `json:"role"`
+	RoleId       int                 `json:"role_id"`
+	Services     []models.ServiceRef `json:"services"`
+	Capabilities Capabilities        `json:"capabilities"`
+}
+
+// Capabilities summarises what a role may manage, so clients need not check role names themselves.
+type Capabilities struct {
+	CanManageUsers    bool `json:"can_manage_users"`
+	CanManageServices bool `json:"can_manage_services"`
+	CanManageRoles    bool `json:"can_manage_roles"`
 }
 
 // TokenResult is used for RefreshToken.
@@ -44,14 +59,41 @@ type TokenResult struct {
 	RoleName    string
 }
 
+// Statuses of an introspected token.
+const (
+	TokenStatusActive  = "active"
+	TokenStatusExpired = "expired"
+	TokenStatusInvalid = "invalid"
+	// TokenStatusRevoked is a token whose user was disabled, deleted or had their token generation
+	// raised since it was issued.
+	TokenStatusRevoked = "revoked"
+)
+
+// TokenIntrospection describes a token submitted to Introspect. Only Active and Status are set for a
+// token that does not verify, so nothing is reported from claims the controller did not sign.
+type TokenIntrospection struct {
+	Active    bool       `json:"active"`
+	Status    string     `json:"status"`
+	Username  string     `json:"username,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	RoleID    int        `json:"role_id,omitempty"`
+	Provider  string     `json:"provider,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	AuthTime  *time.Time `json:"auth_time,omitempty"`
+}
+
 // AuthService handles authentication and token lifecycle.
 type AuthService interface {
-	Login(username, password string) (*LoginResult, error)
-	Logout(username string) error
-	UpdatePassword(username, oldPassword, newPassword string) error
+	Login(username, password, clientIP string) (*LoginResult, error)
+	Logout(username, refreshToken string) error
+	LogoutAll(username string) (int64, error)
+	UpdatePassword(username, oldPassword, newPassword, clientIP string) (*LoginResult, error)
 	GetCurrentUser(username string) (*CurrentUserInfo, error)
 	RefreshToken(token string) (*TokenResult, error)
+	StepUp(username, password, clientIP string) (*LoginResult, error)
 	GenerateAccessToken(claims *models.Claims) (string, error)
+	Introspect(caller, token string) (*TokenIntrospection, error)
 }
 
 type authService struct {
@@ -64,7 +106,10 @@ func NewAuthService(userRepo repository.UserRepository, cfg AuthConfig) AuthServ
 	return &authService{userRepo: userRepo, cfg: cfg}
 }
 
-func (s *authService) Login(username, password string) (*LoginResult, error) {
+// Login checks the user's password and issues tokens. clientIP is recorded as the user's last login IP.
+// The username is normalized first, so with auth.case_insensitive_usernames any case signs in.
+func (s *authService) Login(username, password, clientIP string) (*LoginResult, error) {
+	username = utils.NormalizeUsername(username)
 	storedHash, isActive, err := s.userRepo.GetCredentials(username)
 	if err == sql.ErrNoRows {
 		utils.CheckPasswordHash(password, "$2a$12$DUMMYHASH0000000000000000000000000000000000000000")
@@ -88,12 +133,14 @@ func (s *authService) Login(username, password string) (*LoginResult, error) {
 		roleID = 0
 	}
 
-	expiresAt := time.Now().Add(s.cfg.TokenLifetime)
+	now := time.Now()
+	expiresAt := now.Add(s.cfg.TokenLifetime)
 	claims := &models.Claims{
 		Username: username,
 		Role:     roleName,
 		RoleID:   roleID,
 		Provider: "local",
+		AuthTime: jwt.NewNumericDate(now),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			Issuer:    "aegis-controller",
@@ -115,6 +162,9 @@ func (s *authService) Login(username, password string) (*LoginResult, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user ID: %w", err)
 	}
+	if err := s.userRepo.SetLastLoginIP(userID, clientIP); err != nil {
+		log.Printf("[auth] failed to record login IP for user '%s': %v", username, err)
+	}
 
 	refreshExpiry := time.Now().Add(7 * 24 * time.Hour)
 	if err := s.userRepo.CreateRefreshToken(refreshToken, userID, refreshExpiry); err != nil {
@@ -130,58 +180,86 @@ func (s *authService) Login(username, password string) (*LoginResult, error) {
 	}, nil
 }
 
-func (s *authService) Logout(username string) error {
+// Logout ends the session refreshToken belongs to. Without a refresh token the session cannot be
+// told apart from the user's others, so all of them are ended.
+func (s *authService) Logout(username, refreshToken string) error {
 	userID, err := s.userRepo.GetIDByUsername(username)
 	if err != nil {
 		return nil
 	}
-	return s.userRepo.DeleteUserRefreshTokens(userID)
+	if refreshToken == "" {
+		_, err := s.userRepo.DeleteUserRefreshTokens(userID)
+		return err
+	}
+	return s.userRepo.DeleteRefreshToken(userID, refreshToken)
 }
 
-func (s *authService) UpdatePassword(username, oldPassword, newPassword string) error {
+// LogoutAll ends every session of the user on every device and returns how many were ended. The
+// access tokens already issued are revoked along with the refresh tokens.
+func (s *authService) LogoutAll(username string) (int64, error) {
+	userID, err := s.userRepo.GetIDByUsername(username)
+	if err != nil {
+		return 0, nil
+	}
+	return s.userRepo.RevokeUserTokens(userID)
+}
+
+// UpdatePassword changes the password of username after checking the old one. Every session of the
+// user ends, like after an admin reset, and a new one is started for the caller with the new password.
+func (s *authService) UpdatePassword(username, oldPassword, newPassword, clientIP string) (*LoginResult, error) {
 	provider, err := s.userRepo.GetProvider(username)
 	if err == nil && provider != "local" {
-		return fmt.Errorf("password changes not allowed for SSO users")
+		return nil, fmt.Errorf("password changes not allowed for SSO users")
 	}
 
 	if err := utils.ValidatePasswordComplexity(newPassword); err != nil {
-		return fmt.Errorf("password too weak: %w", err)
+		return nil, fmt.Errorf("password too weak: %w", err)
 	}
 
 	storedHash, err := s.userRepo.GetPasswordHash(username)
 	if err != nil {
-		return fmt.Errorf("database error: %w", err)
+		return nil, fmt.Errorf("database error: %w", err)
 	}
 
 	if !utils.CheckPasswordHash(oldPassword, storedHash) {
-		return fmt.Errorf("invalid credentials")
+		return nil, fmt.Errorf("invalid credentials")
 	}
 
 	newHash, err := utils.HashPassword(newPassword)
 	if err != nil {
-		return fmt.Errorf("hashing error: %w", err)
+		return nil, fmt.Errorf("hashing error: %w", err)
 	}
 
 	rows, err := s.userRepo.UpdatePassword(username, newHash)
 	if err != nil {
-		return fmt.Errorf("update error: %w", err)
+		return nil, fmt.Errorf("update error: %w", err)
 	}
 	if rows == 0 {
-		return fmt.Errorf("user not found")
+		return nil, fmt.Errorf("user not found")
 	}
-	return nil
+	return s.Login(username, newPassword, clientIP)
 }
 
 func (s *authService) GetCurrentUser(username string) (*CurrentUserInfo, error) {
-	roleName, roleID, err := s.userRepo.GetRoleAndIDByUsername(username)
+	roleName, roleID, services, caps, err := s.userRepo.GetAccessByUsername(username)
 	if err != nil {
 		return nil, fmt.Errorf("database error: %w", err)
 	}
-	return &CurrentUserInfo{Username: username, Role: roleName, RoleId: roleID}, nil
+	return &CurrentUserInfo{
+		Username: username,
+		Role:     roleName,
+		RoleId:   roleID,
+		Services: services,
+		Capabilities: Capabilities{
+			CanManageUsers:    slices.Contains(caps, models.CapManageUsers),
+			CanManageServices: slices.Contains(caps, models.CapManageServices),
+			CanManageRoles:    slices.Contains(caps, models.CapManageRoles),
+		},
+	}, nil
 }
 
 func (s *authService) RefreshToken(token string) (*TokenResult, error) {
-	userID, err := s.userRepo.GetRefreshToken(token)
+	userID, issuedAt, err := s.userRepo.GetRefreshToken(token)
 	if err != nil {
 		return nil, fmt.Errorf("invalid or expired refresh token")
 	}
@@ -201,6 +279,8 @@ func (s *authService) RefreshToken(token string) (*TokenResult, error) {
 		Role:     roleName,
 		RoleID:   roleID,
 		Provider: provider,
+		// A refresh token is issued when the user authenticates, so the new token keeps that time.
+		AuthTime: jwt.NewNumericDate(issuedAt),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			Issuer:    "aegis-controller",
@@ -220,9 +300,84 @@ func (s *authService) RefreshToken(token string) (*TokenResult, error) {
 	}, nil
 }
 
+// StepUp re-authenticates an already signed-in user with their password and issues tokens with a
+// fresh auth time. Users who sign in with an identity provider step up by signing in with it again.
+func (s *authService) StepUp(username, password, clientIP string) (*LoginResult, error) {
+	provider, err := s.userRepo.GetProvider(username)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	if provider != "local" {
+		return nil, fmt.Errorf("sso users must sign in with their provider")
+	}
+	return s.Login(username, password, clientIP)
+}
+
+// GenerateAccessToken signs claims, stamped with the user's current token generation so that the
+// token is refused once the generation is raised.
 func (s *authService) GenerateAccessToken(claims *models.Claims) (string, error) {
-	if s.cfg.PrivateKey != nil {
-		return utils.GenerateTokenRS256(claims, s.cfg.PrivateKey)
+	_, generation, err := s.userRepo.GetAuthState(claims.Username)
+	if err != nil {
+		return "", fmt.Errorf("failed to get token generation: %w", err)
+	}
+	claims.TokenGeneration = generation
+	switch key := s.cfg.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return utils.GenerateTokenRS256(claims, key)
+	case *ecdsa.PrivateKey:
+		return utils.GenerateTokenES256(claims, key)
 	}
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.cfg.JWTKey)
 }
+
+// Introspect verifies token with the keys session tokens are verified with and describes it. Tokens
+// of users other than caller may only be introspected by users whose role holds manage_users.
+func (s *authService) Introspect(caller, token string) (*TokenIntrospection, error) {
+	claims, err := utils.InspectToken(token, s.cfg.JWTKey, s.cfg.PublicKeys)
+	if err != nil {
+		return &TokenIntrospection{Status: TokenStatusInvalid}, nil
+	}
+
+	if claims.Username != caller {
+		caps, err := s.userRepo.GetCapabilitiesByUsername(caller)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if !slices.Contains(caps, models.CapManageUsers) {
+			return nil, fmt.Errorf("forbidden")
+		}
+	}
+
+	result := &TokenIntrospection{
+		Active:   true,
+		Status:   TokenStatusActive,
+		Username: claims.Username,
+		Role:     claims.Role,
+		RoleID:   claims.RoleID,
+		Provider: claims.Provider,
+		Issuer:   claims.Issuer,
+	}
+	if claims.ExpiresAt != nil {
+		expiresAt := claims.ExpiresAt.UTC()
+		result.ExpiresAt = &expiresAt
+		if !time.Now().Before(claims.ExpiresAt.Time) {
+			result.Active = false
+			result.Status = TokenStatusExpired
+		}
+	}
+	if result.Active {
+		active, generation, err := s.userRepo.GetAuthState(claims.Username)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if err != nil || !active || generation != claims.TokenGeneration {
+			result.Active = false
+			result.Status = TokenStatusRevoked
+		}
+	}
+	if claims.AuthTime != nil {
+		authTime := claims.AuthTime.UTC()
+		result.AuthTime = &authTime
+	}
+	return result, nil
+}
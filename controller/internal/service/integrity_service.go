@@ -0,0 +1,39 @@
+package service
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+)
+
+// IntegrityService checks the database for malformed service values and dangling references.
+type IntegrityService interface {
+	Check() (*models.IntegrityReport, error)
+	RemoveOrphans() ([]models.Orphan, error)
+}
+
+type integrityService struct {
+	svcRepo       repository.ServiceRepository
+	integrityRepo repository.IntegrityRepository
+}
+
+// NewIntegrityService creates a new IntegrityService.
+func NewIntegrityService(svcRepo repository.ServiceRepository, integrityRepo repository.IntegrityRepository) IntegrityService {
+	return &integrityService{svcRepo: svcRepo, integrityRepo: integrityRepo}
+}
+
+func (s *integrityService) Check() (*models.IntegrityReport, error) {
+	issues, err := s.svcRepo.GetIntegrityIssues()
+	if err != nil {
+		return nil, err
+	}
+	orphans, err := s.integrityRepo.FindOrphans()
+	if err != nil {
+		return nil, err
+	}
+	return &models.IntegrityReport{Services: issues, Orphans: orphans}, nil
+}
+
+// RemoveOrphans deletes every orphan except users, which need a role assigned instead.
+func (s *integrityService) RemoveOrphans() ([]models.Orphan, error) {
+	return s.integrityRepo.DeleteOrphans()
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"Aegis/controller/internal/repository"
+	"fmt"
+)
+
+// MaxPageSize is the largest page a paginated list returns.
+const MaxPageSize = 500
+
+// parsePage validates the sort key, cursor token and limit of a paginated list request.
+func parsePage(sortKey, cursor string, limit int, columns []string, def repository.Sort) (repository.Sort, *repository.Cursor, error) {
+	sort, err := repository.ParseSort(sortKey, columns, def)
+	if err != nil {
+		return repository.Sort{}, nil, fmt.Errorf("invalid sort key")
+	}
+	if limit < 1 || limit > MaxPageSize {
+		return repository.Sort{}, nil, fmt.Errorf("invalid limit")
+	}
+	if cursor == "" {
+		return sort, nil, nil
+	}
+	after, err := repository.ParseCursor(cursor, sort)
+	if err != nil {
+		return repository.Sort{}, nil, fmt.Errorf("invalid cursor")
+	}
+	return sort, after, nil
+}
+
+// nextCursor encodes the cursor of the following page, or returns "" on the last page.
+func nextCursor(sort repository.Sort, next *repository.Cursor) string {
+	if next == nil {
+		return ""
+	}
+	return repository.EncodeCursor(sort, *next)
+}
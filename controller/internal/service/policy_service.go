@@ -0,0 +1,104 @@
+package service
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"fmt"
+	"strings"
+)
+
+// PolicyService exports and imports the access model as a single document.
+type PolicyService interface {
+	Export() (*models.PolicyDocument, error)
+	Import(doc *models.PolicyDocument, dryRun bool) (*models.PolicyReport, error)
+}
+
+type policyService struct {
+	policyRepo repository.PolicyRepository
+}
+
+// NewPolicyService creates a new PolicyService.
+func NewPolicyService(policyRepo repository.PolicyRepository) PolicyService {
+	return &policyService{policyRepo: policyRepo}
+}
+
+func (s *policyService) Export() (*models.PolicyDocument, error) {
+	return s.policyRepo.Export()
+}
+
+// Import checks doc for problems that make it unusable as a whole, then applies it. Problems with
+// individual entries (missing names, duplicates, unresolvable hostnames, unknown agents) are returned
+// as conflicts in a report from a dry run, so the caller sees every problem at once.
+func (s *policyService) Import(doc *models.PolicyDocument, dryRun bool) (*models.PolicyReport, error) {
+	if doc.Version != models.PolicyVersion {
+		return nil, fmt.Errorf("unsupported policy version")
+	}
+
+	var conflicts []string
+	in := repository.PolicyImport{RoleServices: doc.RoleServices}
+	for _, link := range doc.UserServices {
+		link.User = utils.NormalizeUsername(link.User)
+		in.UserServices = append(in.UserServices, link)
+	}
+
+	// Names are unique regardless of case, so duplicates are detected on the lowercased name.
+	seenRoles := make(map[string]bool, len(doc.Roles))
+	for i, role := range doc.Roles {
+		role.Name = strings.TrimSpace(role.Name)
+		switch {
+		case role.Name == "":
+			conflicts = append(conflicts, fmt.Sprintf("roles[%d]: name is required", i))
+		case seenRoles[strings.ToLower(role.Name)]:
+			conflicts = append(conflicts, fmt.Sprintf("roles[%d]: duplicate role %q", i, role.Name))
+		default:
+			seenRoles[strings.ToLower(role.Name)] = true
+			errs := ValidationError{}
+			if role.Description = cleanDescription(role.Description, errs); len(errs) > 0 {
+				conflicts = append(conflicts, fmt.Sprintf("roles[%d]: %s", i, strings.ToLower(errs["description"])))
+				continue
+			}
+			in.Roles = append(in.Roles, role)
+		}
+	}
+
+	seenServices := make(map[string]bool, len(doc.Services))
+	for i, svc := range doc.Services {
+		svc.Name = strings.TrimSpace(svc.Name)
+		if svc.Name == "" || svc.Hostname == "" {
+			conflicts = append(conflicts, fmt.Sprintf("services[%d]: name and hostname are required", i))
+			continue
+		}
+		if seenServices[strings.ToLower(svc.Name)] {
+			conflicts = append(conflicts, fmt.Sprintf("services[%d]: duplicate service %q", i, svc.Name))
+			continue
+		}
+		seenServices[strings.ToLower(svc.Name)] = true
+		errs := ValidationError{}
+		if svc.Description = cleanDescription(svc.Description, errs); len(errs) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf("services[%d]: %s", i, strings.ToLower(errs["description"])))
+			continue
+		}
+		agent, err := resolveAgent(svc.Agent)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("services[%d]: unknown agent %q", i, svc.Agent))
+			continue
+		}
+		ip, port, err := resolveHostnameAndPort(svc.Hostname)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("services[%d]: %v", i, err))
+			continue
+		}
+		svc.Agent = agent
+		in.Services = append(in.Services, repository.PolicyServiceTarget{PolicyService: svc, Ip: ip, Port: port})
+	}
+
+	// With invalid entries present, still run the rest as a dry run so link references are checked too.
+	report, err := s.policyRepo.Apply(in, dryRun || len(conflicts) > 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply policy: %w", err)
+	}
+	report.DryRun = dryRun
+	report.Conflicts = append(conflicts, report.Conflicts...)
+	return report, nil
+}
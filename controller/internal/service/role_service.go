@@ -3,18 +3,23 @@ package service
 import (
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/repository"
+	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 )
 
 // RoleService handles role management logic.
 type RoleService interface {
-	GetAll() ([]models.Role, error)
-	Create(name, description string) (*models.Role, error)
+	GetAll(sortKey string) ([]models.Role, error)
+	Create(name, description string, maxTTL *int, capabilities, granted []string) (*models.Role, error)
+	SetCapabilities(roleID int, capabilities, granted []string) error
+	SetMaxTTL(roleID int, maxTTL *int) error
 	Delete(id int) error
 	GetServices(roleID int) ([]models.Service, error)
 	AddService(roleID, serviceID int) error
-	RemoveService(roleID, svcID int) error
+	RemoveService(roleID, svcID int) (bool, error)
 }
 
 type roleService struct {
@@ -26,22 +31,114 @@ func NewRoleService(roleRepo repository.RoleRepository) RoleService {
 	return &roleService{roleRepo: roleRepo}
 }
 
-func (s *roleService) GetAll() ([]models.Role, error) {
-	return s.roleRepo.GetAll()
+func (s *roleService) GetAll(sortKey string) ([]models.Role, error) {
+	sort, err := repository.ParseSort(sortKey, repository.RoleSortColumns, repository.DefaultRoleSort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sort key")
+	}
+	return s.roleRepo.GetAll(sort)
 }
 
-func (s *roleService) Create(name, description string) (*models.Role, error) {
+// checkGrant rejects unknown capabilities and capabilities the granting user's role does not hold
+// itself, so managing roles cannot be used to escalate privileges. manage_roles is never granted:
+// only the root role holds it.
+func checkGrant(capabilities, granted []string) error {
+	for _, c := range capabilities {
+		if !models.IsCapability(c) {
+			return fmt.Errorf("unknown capability")
+		}
+		if c == models.CapManageRoles {
+			return fmt.Errorf("manage_roles is reserved for the root role")
+		}
+		if !slices.Contains(granted, c) {
+			return fmt.Errorf("cannot grant capabilities you do not hold")
+		}
+	}
+	return nil
+}
+
+// Create adds a role with the given capabilities, each of which must be in granted, the
+// capabilities of the requesting user. A non-nil maxTTL limits the sessions of its users.
+func (s *roleService) Create(name, description string, maxTTL *int, capabilities, granted []string) (*models.Role, error) {
+	name = strings.TrimSpace(name)
+	errs := ValidationError{}
 	if name == "" {
-		return nil, fmt.Errorf("role name is required")
+		errs["name"] = "Name is required"
 	}
-	id, err := s.roleRepo.Create(name, description)
+	description = cleanDescription(description, errs)
+	if !validMaxTTL(maxTTL) {
+		errs["max_ttl"] = fmt.Sprintf("max_ttl must be between 1 and %d seconds", models.MaxSessionTimeLeft)
+	}
+	for _, c := range capabilities {
+		if !models.IsCapability(c) {
+			errs["capabilities"] = fmt.Sprintf("Unknown capability %q", c)
+			break
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	if err := checkGrant(capabilities, granted); err != nil {
+		return nil, err
+	}
+	capabilities = sortedUnique(capabilities)
+	id, err := s.roleRepo.Create(name, description, maxTTL, capabilities)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
 			return nil, fmt.Errorf("role name already exists")
 		}
 		return nil, fmt.Errorf("failed to create role: %w", err)
 	}
-	return &models.Role{Id: int(id), Name: name, Description: description}, nil
+	return &models.Role{Id: int(id), Name: name, Description: description, Capabilities: capabilities, MaxTTL: maxTTL}, nil
+}
+
+// validMaxTTL reports whether maxTTL is no limit or a number of seconds an agent accepts.
+func validMaxTTL(maxTTL *int) bool {
+	return maxTTL == nil || (*maxTTL >= 1 && *maxTTL <= models.MaxSessionTimeLeft)
+}
+
+// SetMaxTTL sets the longest idle timeout of the sessions of the role's users, or removes it for a nil
+// maxTTL. Sessions already open keep their timeout until they are selected again.
+func (s *roleService) SetMaxTTL(roleID int, maxTTL *int) error {
+	if !validMaxTTL(maxTTL) {
+		return fmt.Errorf("invalid max_ttl")
+	}
+	rows, err := s.roleRepo.SetMaxTTL(roleID, maxTTL)
+	if err != nil {
+		return fmt.Errorf("failed to set max_ttl: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("role not found")
+	}
+	return nil
+}
+
+// SetCapabilities replaces the capabilities of a role. The root role keeps all of them.
+func (s *roleService) SetCapabilities(roleID int, capabilities, granted []string) error {
+	name, err := s.roleRepo.GetName(roleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("role not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check role: %w", err)
+	}
+	if name == models.RootRoleName {
+		return fmt.Errorf("cannot change root role capabilities")
+	}
+	if err := checkGrant(capabilities, granted); err != nil {
+		return err
+	}
+	if err := s.roleRepo.SetCapabilities(roleID, sortedUnique(capabilities)); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	return nil
+}
+
+// sortedUnique returns a sorted copy of s without duplicates, never nil.
+func sortedUnique(s []string) []string {
+	out := append([]string{}, s...)
+	slices.Sort(out)
+	return slices.Compact(out)
 }
 
 func (s *roleService) Delete(id int) error {
@@ -60,9 +157,24 @@ func (s *roleService) GetServices(roleID int) ([]models.Service, error) {
 }
 
 func (s *roleService) AddService(roleID, serviceID int) error {
-	return s.roleRepo.AddService(roleID, serviceID)
+	if exists, err := s.roleRepo.Exists(roleID); err != nil {
+		return fmt.Errorf("failed to check role: %w", err)
+	} else if !exists {
+		return fmt.Errorf("role not found")
+	}
+	if exists, err := s.roleRepo.ServiceExists(serviceID); err != nil {
+		return fmt.Errorf("failed to check service: %w", err)
+	} else if !exists {
+		return fmt.Errorf("service not found")
+	}
+	if err := s.roleRepo.AddService(roleID, serviceID); err != nil {
+		return fmt.Errorf("failed to link service: %w", err)
+	}
+	return nil
 }
 
-func (s *roleService) RemoveService(roleID, svcID int) error {
-	return s.roleRepo.RemoveService(roleID, svcID)
+// RemoveService reports whether the service was linked to the role before the call.
+func (s *roleService) RemoveService(roleID, svcID int) (bool, error) {
+	rows, err := s.roleRepo.RemoveService(roleID, svcID)
+	return rows > 0, err
 }
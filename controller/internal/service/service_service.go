@@ -1,35 +1,122 @@
 package service
 
 import (
+	"Aegis/controller/internal/metrics"
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
 	"Aegis/controller/proto"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"net/netip"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ServiceService handles service management and dashboard logic.
 type ServiceService interface {
-	GetAll() ([]models.Service, error)
-	Create(name, hostname, description string) (*models.Service, error)
-	Update(id int, name, hostname, description string) (*models.Service, error)
+	GetAll(sortKey string) ([]models.Service, error)
+	GetPage(sortKey, cursor string, limit int) ([]models.Service, string, error)
+	GetUnassigned() ([]models.Service, error)
+	Create(name, hostname, destType, description, agent string, portRangeEnd uint16, requiresStepUp bool) (*models.Service, error)
+	Update(id int, name, hostname, destType, description, agent string, portRangeEnd uint16, requiresStepUp bool) (*models.Service, error)
 	Delete(id int) error
+	SetContainer(id int, container string) error
 	GetUserServices(userID, roleID int) ([]models.Service, error)
 	GetUserActiveServices(userID int) ([]models.ActiveService, error)
-	SelectActiveService(userID, roleID, serviceID int, clientIP string) error
-	DeselectActiveService(userID, svcID int, clientIP string) error
+	SelectActiveService(ctx context.Context, userID, roleID, serviceID int, clientIP string, authTime time.Time) (queued bool, err error)
+	ActivateForUser(ctx context.Context, userID, roleID, serviceID int, clientIP string) (queued bool, err error)
+	DeselectActiveService(ctx context.Context, userID, svcID int, clientIP string) error
+	CheckSourceIPOverride(ip string) error
+	RetryPendingActivations()
+	GetActiveServiceUsers() (map[int][]int, error)
+	GetServiceMap() (map[repository.ServiceKey]int, error)
+	DropActiveService(userID, serviceID int) error
+	CloseAgentSession(ctx context.Context, agent string, srcIP, dstIP, dstPort uint32) error
+}
+
+// ActivationConfig controls what SelectActiveService does when the agent enforcing a service cannot
+// be reached. The zero value fails the selection straight away.
+type ActivationConfig struct {
+	// CallTimeout bounds each call activating or closing a session on an agent; zero uses
+	// defaultCallTimeout.
+	CallTimeout time.Duration
+	// Queue records the selection and retries it in RetryPendingActivations instead of failing.
+	Queue bool
+	// TTL is how long a queued selection is retried before it is dropped.
+	TTL time.Duration
+	// StepUpMaxAge is how recently the user must have authenticated to activate a service marked
+	// requires_step_up.
+	StepUpMaxAge time.Duration
+	// MaxActiveSessions caps the sessions active across all users; 0 means no limit. Activations
+	// beyond it are logged, and refused when RejectOverLimit is set.
+	MaxActiveSessions int
+	RejectOverLimit   bool
+	// SourceIPAllowlist holds the networks a client-supplied source IP must fall in; empty refuses
+	// every override.
+	SourceIPAllowlist []netip.Prefix
+	// DefaultRoleID is granted every service created, so a new service is reachable before anyone
+	// assigns it; 0 grants none.
+	DefaultRoleID int
+}
+
+// defaultCallTimeout bounds agent calls when ActivationConfig.CallTimeout is unset.
+const defaultCallTimeout = time.Second
+
+// sessionWarnPercent is the share of MaxActiveSessions past which activations log a warning.
+const sessionWarnPercent = 90
+
+// sessionLimitRejections counts activations refused by MaxActiveSessions.
+var sessionLimitRejections atomic.Uint64
+
+// SessionLimitCollector exposes the number of active sessions against limit, 0 meaning none.
+func SessionLimitCollector(svcRepo repository.ServiceRepository, limit int) metrics.Collector {
+	return func(w io.Writer) {
+		if n, err := svcRepo.CountActiveServices(); err == nil {
+			metrics.WriteMetric(w, "aegis_active_sessions", "gauge", "Sessions currently active across all users.",
+				metrics.Sample{Value: float64(n)})
+		}
+		metrics.WriteMetric(w, "aegis_active_sessions_limit", "gauge", "Configured ceiling on active sessions; 0 means no limit.",
+			metrics.Sample{Value: float64(limit)})
+		metrics.WriteMetric(w, "aegis_session_limit_rejections_total", "counter", "Activations refused because the active session limit was reached.",
+			metrics.Sample{Value: float64(sessionLimitRejections.Load())})
+	}
 }
 
 type serviceService struct {
-	svcRepo repository.ServiceRepository
+	svcRepo    repository.ServiceRepository
+	activation ActivationConfig
+
+	// activations holds the activation in flight for each user, service and client IP, see activateOnce.
+	activationsMu sync.Mutex
+	activations   map[activationKey]*activationCall
+}
+
+type activationKey struct {
+	userID, serviceID int
+	clientIP          string
+}
+
+// activationCall is an activation in flight; done is closed once queued and err are set.
+type activationCall struct {
+	done   chan struct{}
+	queued bool
+	err    error
 }
 
 // NewServiceService creates a new ServiceService.
-func NewServiceService(svcRepo repository.ServiceRepository) ServiceService {
-	return &serviceService{svcRepo: svcRepo}
+func NewServiceService(svcRepo repository.ServiceRepository, activation ActivationConfig) ServiceService {
+	if activation.CallTimeout <= 0 {
+		activation.CallTimeout = defaultCallTimeout
+	}
+	return &serviceService{svcRepo: svcRepo, activation: activation, activations: make(map[activationKey]*activationCall)}
 }
 
 // resolveHostnameAndPort parses host:port, resolves DNS, and returns IP and port.
@@ -41,6 +128,10 @@ func resolveHostnameAndPort(hostnameWithPort string) (uint32, uint16, error) {
 
 	var resolvedIP string
 	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			// Agents enforce IPv4 rules only; IpToUint32 would turn this into 0.0.0.0.
+			return 0, 0, fmt.Errorf("IPv6 services are not supported")
+		}
 		resolvedIP = host
 	} else {
 		ips, err := utils.ResolveHostname(host)
@@ -58,39 +149,131 @@ func resolveHostnameAndPort(hostnameWithPort string) (uint32, uint16, error) {
 	return ipUint32, uint16(portNum), nil
 }
 
-func (s *serviceService) GetAll() ([]models.Service, error) {
-	return s.svcRepo.GetAll()
+// resolveAgent defaults an empty agent name to the primary agent and rejects unknown agents.
+func resolveAgent(agent string) (string, error) {
+	if agent == "" {
+		return proto.PrimaryAgent, nil
+	}
+	if !proto.HasAgent(agent) {
+		return "", fmt.Errorf("unknown agent")
+	}
+	return agent, nil
+}
+
+func (s *serviceService) GetAll(sortKey string) ([]models.Service, error) {
+	sort, err := repository.ParseSort(sortKey, repository.ServiceSortColumns, repository.DefaultServiceSort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sort key")
+	}
+	return s.svcRepo.GetAll(sort)
 }
 
-func (s *serviceService) Create(name, hostname, description string) (*models.Service, error) {
-	if name == "" || hostname == "" {
-		return nil, fmt.Errorf("service name and hostname are required")
+// GetPage returns up to limit services after cursor and the cursor of the next page, "" on the last.
+func (s *serviceService) GetPage(sortKey, cursor string, limit int) ([]models.Service, string, error) {
+	sort, after, err := parsePage(sortKey, cursor, limit, repository.ServiceSortColumns, repository.DefaultServiceSort)
+	if err != nil {
+		return nil, "", err
 	}
-	ip, port, err := resolveHostnameAndPort(hostname)
+	services, next, err := s.svcRepo.GetPage(sort, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return services, nextCursor(sort, next), nil
+}
+
+// GetUnassigned returns the services no role or user is granted.
+func (s *serviceService) GetUnassigned() ([]models.Service, error) {
+	return s.svcRepo.GetUnassigned()
+}
+
+// validateService checks every field of a service being created or updated, returning the resolved
+// agent and address and the cleaned description, or a ValidationError listing each invalid field. The
+// address of a CIDR service is its network address, which is never resolved, and its PrefixLen is
+// set.
+func validateService(name, hostname, destType, description, agent string, portRangeEnd uint16) (string, string, models.Service, error) {
+	errs := ValidationError{}
+	if name == "" {
+		errs["name"] = "Name is required"
+	}
+	description = cleanDescription(description, errs)
+	agent, err := resolveAgent(agent)
+	if err != nil {
+		errs["agent"] = "Unknown agent"
+	}
+	target := models.Service{DestType: destType, PortRangeEnd: portRangeEnd}
+	switch {
+	case destType != models.DestinationHost && destType != models.DestinationCIDR:
+		errs["destination_type"] = "Destination type must be host or cidr"
+	case hostname == "":
+		errs["hostname"] = "Hostname is required"
+	case destType == models.DestinationCIDR:
+		prefix, port, err := utils.ParseCIDRDestination(hostname)
+		if err != nil {
+			errs["hostname"] = err.Error()
+			break
+		}
+		target.Ip = utils.IpToUint32(prefix.Addr().String())
+		target.Port = port
+		target.PrefixLen = prefix.Bits()
+	default:
+		if target.Ip, target.Port, err = resolveHostnameAndPort(hostname); err != nil {
+			errs["hostname"] = err.Error()
+		}
+	}
+	if target.Port != 0 {
+		if portRangeEnd != 0 && portRangeEnd < target.Port {
+			errs["port_range_end"] = "Port range end must not be below the port"
+		} else if portRangeEnd != 0 && int(portRangeEnd-target.Port) >= models.MaxPortRangePorts {
+			errs["port_range_end"] = fmt.Sprintf("Port range must not span more than %d ports", models.MaxPortRangePorts)
+		} else if rules := target.Addresses() * (int(target.LastPort()) - int(target.Port) + 1); rules > models.MaxPortRangePorts {
+			errs["hostname"] = fmt.Sprintf("Network and port range must not cover more than %d addresses and ports together", models.MaxPortRangePorts)
+		}
+	}
+	return agent, description, target, errs.err()
+}
+
+// Create stores a new service. An empty destType is a host service.
+func (s *serviceService) Create(name, hostname, destType, description, agent string, portRangeEnd uint16, requiresStepUp bool) (*models.Service, error) {
+	name = strings.TrimSpace(name)
+	if destType == "" {
+		destType = models.DestinationHost
+	}
+	agent, description, target, err := validateService(name, hostname, destType, description, agent, portRangeEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := s.svcRepo.Create(name, hostname, ip, port, description)
+	id, err := s.svcRepo.Create(name, hostname, destType, target.Ip, target.Port, portRangeEnd, description, agent, requiresStepUp)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
 			return nil, fmt.Errorf("service name already exists")
 		}
 		return nil, fmt.Errorf("failed to create service: %w", err)
 	}
-	return &models.Service{Id: int(id), Name: name, Hostname: hostname, Ip: ip, Port: port, Description: description}, nil
+	created := &models.Service{Id: int(id), Name: name, Hostname: hostname, DestType: destType, Ip: target.Ip, PrefixLen: target.PrefixLen, Port: target.Port, PortRangeEnd: portRangeEnd, Description: description, Agent: agent, RequiresStepUp: requiresStepUp, Unassigned: true}
+	// The service exists either way, so a failed grant leaves it unassigned rather than failing.
+	if s.activation.DefaultRoleID != 0 {
+		if err := s.svcRepo.GrantRole(created.Id, s.activation.DefaultRoleID); err != nil {
+			log.Printf("[WARN] [services] failed to grant new service %d to the default role: %v", created.Id, err)
+		} else {
+			created.Unassigned = false
+		}
+	}
+	return created, nil
 }
 
-func (s *serviceService) Update(id int, name, hostname, description string) (*models.Service, error) {
-	if name == "" || hostname == "" {
-		return nil, fmt.Errorf("service name and hostname are required")
+// Update replaces every field of a service. An empty destType is a host service.
+func (s *serviceService) Update(id int, name, hostname, destType, description, agent string, portRangeEnd uint16, requiresStepUp bool) (*models.Service, error) {
+	name = strings.TrimSpace(name)
+	if destType == "" {
+		destType = models.DestinationHost
 	}
-	ip, port, err := resolveHostnameAndPort(hostname)
+	agent, description, target, err := validateService(name, hostname, destType, description, agent, portRangeEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := s.svcRepo.Update(id, name, hostname, ip, port, description)
+	rows, err := s.svcRepo.Update(id, name, hostname, destType, target.Ip, target.Port, portRangeEnd, description, agent, requiresStepUp)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
 			return nil, fmt.Errorf("service name already exists")
@@ -100,7 +283,7 @@ func (s *serviceService) Update(id int, name, hostname, description string) (*mo
 	if rows == 0 {
 		return nil, fmt.Errorf("service not found")
 	}
-	return &models.Service{Id: id, Name: name, Hostname: hostname, Ip: ip, Port: port, Description: description}, nil
+	return &models.Service{Id: id, Name: name, Hostname: hostname, DestType: destType, Ip: target.Ip, PrefixLen: target.PrefixLen, Port: target.Port, PortRangeEnd: portRangeEnd, Description: description, Agent: agent, RequiresStepUp: requiresStepUp}, nil
 }
 
 func (s *serviceService) Delete(id int) error {
@@ -114,6 +297,26 @@ func (s *serviceService) Delete(id int) error {
 	return nil
 }
 
+// containerRef matches a Docker container ID or name.
+var containerRef = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+// SetContainer binds a service to the Docker container with the given ID or name, or removes the
+// binding if container is empty.
+func (s *serviceService) SetContainer(id int, container string) error {
+	container = strings.TrimPrefix(container, "/")
+	if container != "" && !containerRef.MatchString(container) {
+		return fmt.Errorf("invalid container name")
+	}
+	rows, err := s.svcRepo.SetContainer(id, container)
+	if err != nil {
+		return fmt.Errorf("failed to bind container: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("service not found")
+	}
+	return nil
+}
+
 func (s *serviceService) GetUserServices(userID, roleID int) ([]models.Service, error) {
 	return s.svcRepo.GetUserServices(userID, roleID)
 }
@@ -122,7 +325,49 @@ func (s *serviceService) GetUserActiveServices(userID int) ([]models.ActiveServi
 	return s.svcRepo.GetUserActiveServices(userID)
 }
 
-func (s *serviceService) SelectActiveService(userID, roleID, serviceID int, clientIP string) error {
+// SelectActiveService activates serviceID for the user. If the agent is unreachable and queueing is
+// enabled, the selection is recorded for RetryPendingActivations and queued is true. Services marked
+// requires_step_up are refused unless authTime is within StepUpMaxAge. Transient agent failures are
+// retried while ctx allows.
+func (s *serviceService) SelectActiveService(ctx context.Context, userID, roleID, serviceID int, clientIP string, authTime time.Time) (bool, error) {
+	if err := s.checkAccess(userID, roleID, serviceID); err != nil {
+		return false, err
+	}
+
+	stepUp, err := s.svcRepo.RequiresStepUp(serviceID)
+	if err != nil {
+		return false, fmt.Errorf("service not found or invalid configuration")
+	}
+	if stepUp && (authTime.IsZero() || time.Since(authTime) > s.activation.StepUpMaxAge) {
+		return false, fmt.Errorf("step-up required")
+	}
+	return s.activateOnce(ctx, userID, serviceID, clientIP)
+}
+
+// ActivateForUser activates serviceID for a user on an admin's behalf. The user must have access to
+// the service, but no step-up is required since the user is not the one authenticating.
+func (s *serviceService) ActivateForUser(ctx context.Context, userID, roleID, serviceID int, clientIP string) (bool, error) {
+	if err := s.checkAccess(userID, roleID, serviceID); err != nil {
+		return false, err
+	}
+	return s.activateOnce(ctx, userID, serviceID, clientIP)
+}
+
+// CheckSourceIPOverride validates a source IP a client asked to be enforced instead of its own.
+func (s *serviceService) CheckSourceIPOverride(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("invalid source IP")
+	}
+	for _, p := range s.activation.SourceIPAllowlist {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source IP not allowed")
+}
+
+func (s *serviceService) checkAccess(userID, roleID, serviceID int) error {
 	hasAccess, err := s.svcRepo.CheckUserServiceAccess(userID, roleID, serviceID)
 	if err != nil {
 		return fmt.Errorf("permission check error: %w", err)
@@ -130,13 +375,125 @@ func (s *serviceService) SelectActiveService(userID, roleID, serviceID int, clie
 	if !hasAccess {
 		return fmt.Errorf("forbidden: no access to this service")
 	}
+	return nil
+}
 
-	dstIP, dstPort, err := s.svcRepo.GetIPPort(serviceID)
+// activateOnce runs activateOrQueue unless an activation of the same service for the same user from
+// the same client IP is already in flight, e.g. after a double click or a client retry. In that case
+// it waits for that activation instead of calling the agent again, and returns "already active" if
+// it succeeded or its result otherwise. An activation from another IP always reaches the agent, as
+// the session in flight does not cover it.
+func (s *serviceService) activateOnce(ctx context.Context, userID, serviceID int, clientIP string) (bool, error) {
+	key := activationKey{userID, serviceID, clientIP}
+	s.activationsMu.Lock()
+	if call, ok := s.activations[key]; ok {
+		s.activationsMu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		if call.err == nil && !call.queued {
+			log.Printf("[services] service ID %d for user ID %d was activated by a concurrent request", serviceID, userID)
+			return false, fmt.Errorf("already active")
+		}
+		return call.queued, call.err
+	}
+	call := &activationCall{done: make(chan struct{})}
+	s.activations[key] = call
+	s.activationsMu.Unlock()
+
+	call.queued, call.err = s.activateOrQueue(ctx, userID, serviceID, clientIP)
+
+	s.activationsMu.Lock()
+	delete(s.activations, key)
+	s.activationsMu.Unlock()
+	close(call.done)
+	return call.queued, call.err
+}
+
+// activateOrQueue activates the service, queueing it instead if the agent is unreachable and
+// queueing is enabled.
+func (s *serviceService) activateOrQueue(ctx context.Context, userID, serviceID int, clientIP string) (bool, error) {
+	err := s.activate(ctx, userID, serviceID, clientIP)
+	if err == nil || !agentUnreachable(err) {
+		return false, err
+	}
+	if !s.activation.Queue {
+		log.Printf("[WARN] [services] cannot activate service ID %d for user ID %d: %v", serviceID, userID, err)
+		return false, fmt.Errorf("agent unavailable")
+	}
+	if err := s.svcRepo.QueueActivation(userID, serviceID, clientIP); err != nil {
+		return false, fmt.Errorf("failed to queue activation: %w", err)
+	}
+	return true, nil
+}
+
+// checkSessionLimit refuses a new session for userID and serviceID once MaxActiveSessions are active
+// and RejectOverLimit is set, and warns as the limit is approached. Renewing an active session does
+// not count against the limit.
+func (s *serviceService) checkSessionLimit(userID, serviceID int) error {
+	limit := s.activation.MaxActiveSessions
+	if limit <= 0 {
+		return nil
+	}
+	count, err := s.svcRepo.CountActiveServices()
+	if err != nil {
+		return fmt.Errorf("failed to count active sessions: %w", err)
+	}
+	if (count+1)*100 <= limit*sessionWarnPercent {
+		return nil
+	}
+	if active, err := s.svcRepo.IsActiveService(userID, serviceID); err != nil {
+		return fmt.Errorf("failed to check active session: %w", err)
+	} else if active {
+		return nil
+	}
+	if count >= limit {
+		if s.activation.RejectOverLimit {
+			sessionLimitRejections.Add(1)
+			log.Printf("[WARN] [services] refused service ID %d for user ID %d: %d of %d active sessions in use", serviceID, userID, count, limit)
+			return fmt.Errorf("active session limit reached")
+		}
+		log.Printf("[WARN] [services] activating service ID %d for user ID %d exceeds the active session limit (%d of %d in use)", serviceID, userID, count, limit)
+		return nil
+	}
+	log.Printf("[WARN] [services] approaching the active session limit: %d of %d in use", count+1, limit)
+	return nil
+}
+
+// activate asks the agent to open the session, limited to the max_ttl of the user's role, and records
+// the service as active.
+func (s *serviceService) activate(ctx context.Context, userID, serviceID int, clientIP string) error {
+	if net.ParseIP(clientIP).To4() == nil {
+		return fmt.Errorf("IPv6 clients are not supported")
+	}
+	if err := s.checkSessionLimit(userID, serviceID); err != nil {
+		return err
+	}
+	target, err := s.svcRepo.GetTarget(serviceID)
+	var malformed *repository.MalformedServiceError
+	if errors.As(err, &malformed) {
+		log.Printf("[ERROR] [services] cannot activate: %v", err)
+		return fmt.Errorf("service misconfigured")
+	}
 	if err != nil {
 		return fmt.Errorf("service not found or invalid configuration")
 	}
+	if target.Ip == 0 && target.DestType != models.DestinationCIDR {
+		// Never hand the agent a rule for 0.0.0.0; try to resolve the hostname now instead.
+		if target.Ip, target.Port, err = s.reresolve(serviceID); err != nil {
+			return err
+		}
+	}
+
+	maxTTL, err := s.svcRepo.GetRoleMaxTTL(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get session TTL: %w", err)
+	}
+	timeLeft, ttl := models.SessionTTL(maxTTL)
 
-	success, err := proto.SendSessionData(utils.IpToUint32(clientIP), dstIP, uint32(dstPort), true, time.Second)
+	success, err := proto.SendSessionData(ctx, target.Agent, utils.IpToUint32(clientIP), target.Ip, uint32(target.PrefixLen), uint32(target.Port), uint32(target.PortRangeEnd), ttl, true, s.activation.CallTimeout)
 	if err != nil {
 		return fmt.Errorf("failed to activate session: %w", err)
 	}
@@ -144,13 +501,134 @@ func (s *serviceService) SelectActiveService(userID, roleID, serviceID int, clie
 		return fmt.Errorf("session activation failed")
 	}
 
-	return s.svcRepo.InsertActiveService(userID, serviceID, 60)
+	if err := s.svcRepo.DeletePendingActivation(userID, serviceID); err != nil {
+		return err
+	}
+	return s.svcRepo.InsertActiveService(userID, serviceID, timeLeft, clientIP)
+}
+
+// agentUnreachable reports whether err means the agent could not be reached, as opposed to the agent
+// rejecting the request or not being configured.
+func agentUnreachable(err error) bool {
+	return proto.IsRetryable(err)
 }
 
-func (s *serviceService) DeselectActiveService(userID, svcID int, clientIP string) error {
-	dstIP, dstPort, err := s.svcRepo.GetIPPort(svcID)
-	if err == nil {
-		_, _ = proto.SendSessionData(utils.IpToUint32(clientIP), dstIP, uint32(dstPort), false, time.Second)
+// reresolve looks up the hostname of a service with no stored address and stores the result.
+func (s *serviceService) reresolve(serviceID int) (uint32, uint16, error) {
+	hostname, err := s.svcRepo.GetHostname(serviceID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("service not found or invalid configuration")
+	}
+	ip, port, err := resolveHostnameAndPort(hostname)
+	if err != nil && err.Error() == "IPv6 services are not supported" {
+		return 0, 0, err
+	}
+	if err == nil && ip == 0 {
+		err = fmt.Errorf("%s resolves to 0.0.0.0", hostname)
+	}
+	if err != nil {
+		log.Printf("[WARN] [services] service ID %d has no address: %v", serviceID, err)
+		return 0, 0, fmt.Errorf("service not currently resolvable")
+	}
+	if _, err := s.svcRepo.UpdateIPPort(serviceID, ip, port, repository.IPSourceDNS); err != nil {
+		log.Printf("[ERROR] [services] failed to store resolved address of service ID %d: %v", serviceID, err)
+	}
+	log.Printf("[INFO] [services] resolved service ID %d (%s) to %s:%d", serviceID, hostname, utils.Uint32ToIp(ip), port)
+	return ip, port, nil
+}
+
+// RetryPendingActivations retries every queued selection. Selections the user no longer has access
+// to, that the agent rejects, or that are older than the configured TTL are dropped; the rest stay
+// queued until the agent is reachable.
+func (s *serviceService) RetryPendingActivations() {
+	pending, err := s.svcRepo.GetPendingActivations()
+	if err != nil {
+		log.Printf("[ERROR] [activations] failed to list pending activations: %v", err)
+		return
+	}
+	for _, p := range pending {
+		drop := func(reason string) {
+			log.Printf("[WARN] [activations] dropping queued activation of service ID %d for user ID %d: %s", p.ServiceID, p.UserID, reason)
+			if err := s.svcRepo.DeletePendingActivation(p.UserID, p.ServiceID); err != nil {
+				log.Printf("[ERROR] [activations] failed to drop queued activation: %v", err)
+			}
+		}
+		if time.Since(p.RequestedAt) > s.activation.TTL {
+			drop("expired")
+			continue
+		}
+		hasAccess, err := s.svcRepo.CheckUserServiceAccess(p.UserID, p.RoleID, p.ServiceID)
+		if err != nil {
+			log.Printf("[ERROR] [activations] permission check failed: %v", err)
+			continue
+		}
+		if !hasAccess {
+			drop("no access to this service")
+			continue
+		}
+
+		err = s.activate(context.Background(), p.UserID, p.ServiceID, p.ClientIP)
+		switch {
+		case err == nil:
+			log.Printf("[INFO] [activations] activated queued service ID %d for user ID %d from IP %s", p.ServiceID, p.UserID, p.ClientIP)
+		case agentUnreachable(err):
+			// Still unreachable; try again next time.
+		case err.Error() == "active session limit reached":
+			// Wait for sessions to free up until the selection expires.
+		default:
+			drop(err.Error())
+		}
+	}
+}
+
+// RetryActivations calls svc.RetryPendingActivations every interval until ctx is cancelled.
+func RetryActivations(ctx context.Context, svc ServiceService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			svc.RetryPendingActivations()
+		}
+	}
+}
+
+// GetActiveServiceUsers returns the IDs of the users each service is active for in the database.
+func (s *serviceService) GetActiveServiceUsers() (map[int][]int, error) {
+	return s.svcRepo.GetActiveServiceUsers()
+}
+
+// GetServiceMap maps every destination an agent reports sessions to, by agent and "ip:port", to the
+// ID of the service it belongs to, the same way session syncs match them.
+func (s *serviceService) GetServiceMap() (map[repository.ServiceKey]int, error) {
+	return s.svcRepo.GetServiceMap()
+}
+
+// DropActiveService removes a service from the user's active services without contacting the agent.
+func (s *serviceService) DropActiveService(userID, serviceID int) error {
+	return s.svcRepo.DeleteActiveService(userID, serviceID)
+}
+
+// CloseAgentSession asks agent to remove the rule letting srcIP reach dstIP:dstPort.
+func (s *serviceService) CloseAgentSession(ctx context.Context, agent string, srcIP, dstIP, dstPort uint32) error {
+	success, err := proto.SendSessionData(ctx, agent, srcIP, dstIP, 0, dstPort, 0, 0, false, s.activation.CallTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to close session: %w", err)
+	}
+	if !success {
+		return fmt.Errorf("session deactivation failed")
+	}
+	return nil
+}
+
+func (s *serviceService) DeselectActiveService(ctx context.Context, userID, svcID int, clientIP string) error {
+	if err := s.svcRepo.DeletePendingActivation(userID, svcID); err != nil {
+		return err
+	}
+	if target, err := s.svcRepo.GetTarget(svcID); err == nil {
+		_, _ = proto.SendSessionData(ctx, target.Agent, utils.IpToUint32(clientIP), target.Ip, uint32(target.PrefixLen), uint32(target.Port), uint32(target.PortRangeEnd), 0, false, s.activation.CallTimeout)
 	}
 	return s.svcRepo.DeleteActiveService(userID, svcID)
 }
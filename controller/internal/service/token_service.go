@@ -0,0 +1,149 @@
+package service
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// apiTokenPrefix marks personal API tokens so they are easy to recognise in scripts and secret scanners.
+const apiTokenPrefix = "aegis_"
+
+// TokenService manages personal API tokens.
+type TokenService interface {
+	Create(username, name, scope string, serviceIDs []int, expiresInDays int) (*models.APIToken, string, error)
+	List(username string) ([]models.APIToken, error)
+	Delete(username string, id int) error
+	Authenticate(token string) (*models.TokenGrant, error)
+}
+
+type tokenService struct {
+	tokenRepo repository.TokenRepository
+	userRepo  repository.UserRepository
+}
+
+// NewTokenService creates a new TokenService.
+func NewTokenService(tokenRepo repository.TokenRepository, userRepo repository.UserRepository) TokenService {
+	return &tokenService{tokenRepo: tokenRepo, userRepo: userRepo}
+}
+
+// hashAPIToken returns the hex SHA-256 of token. Tokens are random, so a slow hash adds nothing.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create generates a token for username and returns it once alongside its stored metadata. An empty
+// scope means full; expiresInDays of zero means the token does not expire. serviceIDs is required for
+// the services scope and not allowed otherwise.
+func (s *tokenService) Create(username, name, scope string, serviceIDs []int, expiresInDays int) (*models.APIToken, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("token name is required")
+	}
+	if scope == "" {
+		scope = models.TokenScopeFull
+	}
+	switch scope {
+	case models.TokenScopeRead, models.TokenScopeFull:
+		if len(serviceIDs) > 0 {
+			return nil, "", fmt.Errorf("service ids require the services scope")
+		}
+	case models.TokenScopeServices:
+		if len(serviceIDs) == 0 {
+			return nil, "", fmt.Errorf("services scope requires service ids")
+		}
+	default:
+		return nil, "", fmt.Errorf("invalid token scope")
+	}
+	if expiresInDays < 0 {
+		return nil, "", fmt.Errorf("invalid token expiry")
+	}
+	userID, err := s.userID(username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	serviceIDs = slices.Clone(serviceIDs)
+	slices.Sort(serviceIDs)
+	serviceIDs = slices.Compact(serviceIDs)
+	for _, id := range serviceIDs {
+		exists, err := s.userRepo.ServiceExists(id)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to check service: %w", err)
+		}
+		if !exists {
+			return nil, "", fmt.Errorf("service not found")
+		}
+	}
+
+	secret, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("token generation error: %w", err)
+	}
+	token := apiTokenPrefix + secret
+
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if expiresInDays > 0 {
+		t := now.Add(time.Duration(expiresInDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+	id, err := s.tokenRepo.Create(userID, name, hashAPIToken(token), scope, expiresAt, serviceIDs)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return &models.APIToken{Id: int(id), Name: name, Scope: scope, ServiceIDs: serviceIDs, ExpiresAt: expiresAt, CreatedAt: now}, token, nil
+}
+
+// userID looks up the ID of username. Only a missing user is reported as "user not found"; database
+// errors are returned wrapped so handlers answer them with 500 rather than 401.
+func (s *tokenService) userID(username string) (int, error) {
+	userID, _, err := s.userRepo.GetIDAndRole(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up user: %w", err)
+	}
+	return userID, nil
+}
+
+func (s *tokenService) List(username string) ([]models.APIToken, error) {
+	userID, err := s.userID(username)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokenRepo.ListByUser(userID)
+}
+
+// Delete revokes one of username's tokens. Tokens of other users are reported as not found.
+func (s *tokenService) Delete(username string, id int) error {
+	userID, err := s.userID(username)
+	if err != nil {
+		return err
+	}
+	rows, err := s.tokenRepo.Delete(id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+// Authenticate resolves a bearer token to what it grants.
+func (s *tokenService) Authenticate(token string) (*models.TokenGrant, error) {
+	grant, err := s.tokenRepo.Authenticate(hashAPIToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("invalid or expired API token")
+	}
+	return grant, err
+}
@@ -4,32 +4,36 @@ import (
 	"Aegis/controller/internal/models"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
+	"database/sql"
+	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
-var usernameRE = regexp.MustCompile("^[a-zA-Z0-9_]{5,30}$")
-
 // UserService handles user management logic.
 type UserService interface {
-	GetAll() ([]models.User, error)
-	Create(username, password string, roleID int) (*models.UserWithCredentials, error)
+	GetAll(sortKey string) ([]models.User, error)
+	GetPage(sortKey, cursor string, limit int) ([]models.User, string, error)
+	Create(username, password string, roleID int, roleName string) (*models.UserWithCredentials, error)
 	Delete(id int, requesterUsername string) error
-	UpdateRole(id, roleID int, requesterUsername string) error
+	UpdateRole(id, roleID int, roleName, requesterUsername string) error
 	ResetPassword(id int, newPassword, requesterUsername string) error
 	GetExtraServices(userID int) ([]models.Service, error)
 	AddExtraService(userID, serviceID int, requesterUsername string) error
-	RemoveExtraService(userID, svcID int, requesterUsername string) error
+	RemoveExtraService(userID, svcID int, requesterUsername string) (bool, error)
+	ActivationTarget(userID int, requesterUsername string) (roleID int, lastLoginIP string, err error)
 }
 
 type userService struct {
-	userRepo repository.UserRepository
+	userRepo    repository.UserRepository
+	roleRepo    repository.RoleRepository
+	defaultRole string
 }
 
-// NewUserService creates a new UserService.
-func NewUserService(userRepo repository.UserRepository) UserService {
-	return &userService{userRepo: userRepo}
+// NewUserService creates a new UserService. Users created without a role get defaultRole, looked up
+// by name on every create; an empty defaultRole makes the role required.
+func NewUserService(userRepo repository.UserRepository, roleRepo repository.RoleRepository, defaultRole string) UserService {
+	return &userService{userRepo: userRepo, roleRepo: roleRepo, defaultRole: defaultRole}
 }
 
 func (s *userService) checkRootProtection(targetID int, requesterUsername string) error {
@@ -38,31 +42,69 @@ func (s *userService) checkRootProtection(targetID int, requesterUsername string
 		return nil
 	}
 
-	if targetRole == "root" {
+	if targetRole == models.RootRoleName {
 		requesterRole, err := s.userRepo.GetRoleNameByUsername(requesterUsername)
 		if err != nil {
 			return fmt.Errorf("failed to verify requester role")
 		}
-		if requesterRole != "root" {
+		if requesterRole != models.RootRoleName {
 			return fmt.Errorf("forbidden: cannot modify root user")
 		}
 	}
 	return nil
 }
 
-func (s *userService) GetAll() ([]models.User, error) {
-	return s.userRepo.GetAll()
+func (s *userService) GetAll(sortKey string) ([]models.User, error) {
+	sort, err := repository.ParseSort(sortKey, repository.UserSortColumns, repository.DefaultUserSort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sort key")
+	}
+	return s.userRepo.GetAll(sort)
 }
 
-func (s *userService) Create(username, password string, roleID int) (*models.UserWithCredentials, error) {
-	if !usernameRE.MatchString(username) {
-		return nil, fmt.Errorf("invalid username format")
+// GetPage returns up to limit users after cursor and the cursor of the next page, "" on the last.
+func (s *userService) GetPage(sortKey, cursor string, limit int) ([]models.User, string, error) {
+	sort, after, err := parsePage(sortKey, cursor, limit, repository.UserSortColumns, repository.DefaultUserSort)
+	if err != nil {
+		return nil, "", err
+	}
+	users, next, err := s.userRepo.GetPage(sort, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return users, nextCursor(sort, next), nil
+}
+
+// Create adds a local user. The role is roleID, else the role named roleName, else the default role.
+// Invalid fields are reported together as a ValidationError.
+func (s *userService) Create(username, password string, roleID int, roleName string) (*models.UserWithCredentials, error) {
+	username = utils.NormalizeUsername(username)
+	errs := ValidationError{}
+	if !utils.ValidUsername(username) {
+		errs["username"] = "Invalid username format"
 	}
 	if err := utils.ValidatePasswordComplexity(password); err != nil {
-		return nil, fmt.Errorf("password too weak: %w", err)
+		errs["password"] = "Password too weak: " + err.Error()
+	}
+	roleID, err := s.resolveRole(roleID, roleName, errs)
+	if err != nil {
+		return nil, err
+	}
+	if roleID == 0 && roleName == "" && s.defaultRole == "" {
+		errs["role_id"] = "role_id or role is required"
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
 	}
 	if roleID == 0 {
-		return nil, fmt.Errorf("role_id is required")
+		id, err := s.roleRepo.GetIDByName(s.defaultRole)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("default role not found")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve default role: %w", err)
+		}
+		roleID = id
 	}
 
 	hashedPwd, err := utils.HashPassword(password)
@@ -101,7 +143,19 @@ func (s *userService) Delete(id int, requesterUsername string) error {
 	return nil
 }
 
-func (s *userService) UpdateRole(id, roleID int, requesterUsername string) error {
+// UpdateRole gives a user the role roleID, or the role named roleName if roleID is 0.
+func (s *userService) UpdateRole(id, roleID int, roleName, requesterUsername string) error {
+	errs := ValidationError{}
+	roleID, err := s.resolveRole(roleID, roleName, errs)
+	if err != nil {
+		return err
+	}
+	if roleID == 0 && len(errs) == 0 {
+		errs["role_id"] = "role_id or role is required"
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
 	if requesterUsername != "" {
 		if err := s.checkRootProtection(id, requesterUsername); err != nil {
 			return err
@@ -117,6 +171,23 @@ func (s *userService) UpdateRole(id, roleID int, requesterUsername string) error
 	return nil
 }
 
+// resolveRole returns roleID if set, otherwise the ID of the role named roleName, with roleID taking
+// precedence. An unknown name is added to errs. It returns 0 when neither is given.
+func (s *userService) resolveRole(roleID int, roleName string, errs ValidationError) (int, error) {
+	if roleID != 0 || roleName == "" {
+		return roleID, nil
+	}
+	id, err := s.roleRepo.GetIDByName(roleName)
+	if errors.Is(err, sql.ErrNoRows) {
+		errs["role"] = "Unknown role"
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve role: %w", err)
+	}
+	return id, nil
+}
+
 func (s *userService) ResetPassword(id int, newPassword, requesterUsername string) error {
 	if requesterUsername != "" {
 		if err := s.checkRootProtection(id, requesterUsername); err != nil {
@@ -150,14 +221,52 @@ func (s *userService) AddExtraService(userID, serviceID int, requesterUsername s
 			return err
 		}
 	}
-	return s.userRepo.AddExtraService(userID, serviceID)
+	if exists, err := s.userRepo.Exists(userID); err != nil {
+		return fmt.Errorf("failed to check user: %w", err)
+	} else if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if exists, err := s.userRepo.ServiceExists(serviceID); err != nil {
+		return fmt.Errorf("failed to check service: %w", err)
+	} else if !exists {
+		return fmt.Errorf("service not found")
+	}
+	if err := s.userRepo.AddExtraService(userID, serviceID); err != nil {
+		return fmt.Errorf("failed to assign service: %w", err)
+	}
+	return nil
 }
 
-func (s *userService) RemoveExtraService(userID, svcID int, requesterUsername string) error {
+// RemoveExtraService reports whether the service was assigned to the user before the call.
+func (s *userService) RemoveExtraService(userID, svcID int, requesterUsername string) (bool, error) {
 	if requesterUsername != "" {
 		if err := s.checkRootProtection(userID, requesterUsername); err != nil {
-			return err
+			return false, err
 		}
 	}
-	return s.userRepo.RemoveExtraService(userID, svcID)
+	rows, err := s.userRepo.RemoveExtraService(userID, svcID)
+	return rows > 0, err
+}
+
+// ActivationTarget returns the role and last login IP of a user an admin is activating a service
+// for, enforcing the same root protection as other changes to the user.
+func (s *userService) ActivationTarget(userID int, requesterUsername string) (int, string, error) {
+	if err := s.checkRootProtection(userID, requesterUsername); err != nil {
+		return 0, "", err
+	}
+	_, _, _, roleID, isActive, err := s.userRepo.GetFullInfoByID(userID)
+	if err == sql.ErrNoRows {
+		return 0, "", fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get user: %w", err)
+	}
+	if !isActive {
+		return 0, "", fmt.Errorf("account disabled")
+	}
+	lastLoginIP, err := s.userRepo.GetLastLoginIP(userID)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get user: %w", err)
+	}
+	return roleID, lastLoginIP, nil
 }
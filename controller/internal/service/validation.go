@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxDescriptionLength bounds the description of a service or role, in characters.
+const MaxDescriptionLength = 500
+
+// ValidationError holds every invalid field of a request, keyed by JSON field name, so clients can
+// show all problems at once instead of one per submission.
+type ValidationError map[string]string
+
+func (e ValidationError) Error() string {
+	parts := make([]string, 0, len(e))
+	for _, field := range slices.Sorted(maps.Keys(e)) {
+		parts = append(parts, field+": "+e[field])
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// err returns e as an error, or nil if no field failed.
+func (e ValidationError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// cleanDescription returns description without control characters other than newlines and tabs, and
+// without surrounding whitespace. A description that is not valid UTF-8 or is still longer than
+// MaxDescriptionLength is recorded in errs.
+func cleanDescription(description string, errs ValidationError) string {
+	if !utf8.ValidString(description) {
+		errs["description"] = "Description must be valid UTF-8"
+		return description
+	}
+	description = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, description))
+	if utf8.RuneCountInString(description) > MaxDescriptionLength {
+		errs["description"] = fmt.Sprintf("Description must not be longer than %d characters", MaxDescriptionLength)
+	}
+	return description
+}
@@ -0,0 +1,52 @@
+// Package tracing sets up OpenTelemetry tracing for the controller.
+//
+// Until Setup is called the global tracer provider is a no-op, so the spans started by the HTTP
+// middleware and the agent client cost next to nothing while tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName identifies the controller in exported traces.
+const ServiceName = "aegis-controller"
+
+// Config selects where traces are exported and how many are kept.
+type Config struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector.
+	Endpoint string
+	// Insecure sends traces over plain HTTP.
+	Insecure bool
+	// SampleRatio is the share of new traces recorded. Traces continued from an incoming
+	// traceparent follow the caller's sampling decision.
+	SampleRatio float64
+}
+
+// Setup installs a tracer provider exporting to cfg.Endpoint and the W3C trace context propagator
+// as the globals. The returned function flushes pending spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
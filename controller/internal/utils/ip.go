@@ -1,20 +1,24 @@
 package utils
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
 )
 
-// IpToUint32 converts IP string to uint32 representation.
+// IpToUint32 converts IP string to uint32 representation. It returns 0 for anything that is not an
+// IPv4 address, including IPv6 addresses.
 func IpToUint32(ipStr string) uint32 {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
+	ip4 := net.ParseIP(ipStr).To4()
+	if ip4 == nil {
 		return 0
 	}
-	ip4 := ip.To4()
 	return binary.BigEndian.Uint32(ip4)
 }
 
@@ -25,6 +29,31 @@ func Uint32ToIp(nn uint32) string {
 	return ip.String()
 }
 
+// ParseCIDRDestination parses a network destination in "network/bits:port" form, e.g.
+// "10.0.0.0/24:443". The network must be IPv4 and written with its host bits cleared, so every
+// destination has one spelling.
+func ParseCIDRDestination(dest string) (netip.Prefix, uint16, error) {
+	network, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return netip.Prefix{}, 0, fmt.Errorf("invalid destination '%s' (use network/bits:port format): %w", dest, err)
+	}
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		return netip.Prefix{}, 0, fmt.Errorf("invalid network '%s': %w", network, err)
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, 0, fmt.Errorf("IPv6 services are not supported")
+	}
+	if prefix != prefix.Masked() {
+		return netip.Prefix{}, 0, fmt.Errorf("network '%s' has host bits set; use %s", network, prefix.Masked())
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return netip.Prefix{}, 0, fmt.Errorf("invalid port '%s'. Port must be a valid TCP port number (1-65535)", portStr)
+	}
+	return prefix, uint16(port), nil
+}
+
 // GetClientIP extracts the real client IP from HTTP request headers.
 func GetClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header
@@ -54,23 +83,40 @@ func GetClientIP(r *http.Request) string {
 	return ip
 }
 
-// ResolveHostname looks up the IP addresses for a given hostname
+// ResolveHostname looks up the IPv4 addresses for a given hostname using the resolver set by
+// ConfigureResolver. The addresses are deduplicated and sorted numerically, so callers picking the
+// first one get the same address however the resolver orders its answer.
 func ResolveHostname(hostname string) ([]string, error) {
-	ips, err := net.LookupIP(hostname)
+	return ResolveHostnameContext(context.Background(), hostname)
+}
+
+// ResolveHostnameContext is ResolveHostname bounded by ctx as well as the configured lookup timeout.
+func ResolveHostnameContext(ctx context.Context, hostname string) ([]string, error) {
+	r, timeout := currentResolver()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ips, err := r.LookupIP(ctx, "ip4", hostname)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve hostname %s: %w", hostname, err)
 	}
 
-	var ipStrings []string
+	var addrs []uint32
 	for _, ip := range ips {
 		if ipv4 := ip.To4(); ipv4 != nil {
-			ipStrings = append(ipStrings, ipv4.String())
+			addrs = append(addrs, binary.BigEndian.Uint32(ipv4))
 		}
 	}
 
-	if len(ipStrings) == 0 {
+	if len(addrs) == 0 {
 		return nil, fmt.Errorf("no IPv4 addresses found for hostname %s", hostname)
 	}
 
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	ipStrings := make([]string, len(addrs))
+	for i, a := range addrs {
+		ipStrings[i] = Uint32ToIp(a)
+	}
 	return ipStrings, nil
 }
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"slices"
 	"testing"
+	"time"
 )
 
 // TestResolveHostname tests the hostname resolution function
@@ -103,6 +105,16 @@ func TestIpToUint32(t *testing.T) {
 			ip:       "invalid",
 			expected: 0,
 		},
+		{
+			name:     "IPv6 address",
+			ip:       "::1",
+			expected: 0,
+		},
+		{
+			name:     "IPv4-mapped IPv6 address",
+			ip:       "::ffff:10.0.0.1",
+			expected: 0x0A000001,
+		},
 	}
 
 	for _, tt := range tests {
@@ -149,6 +161,34 @@ func TestUint32ToIp(t *testing.T) {
 	}
 }
 
+// TestParseCIDRDestination tests parsing network destinations
+func TestParseCIDRDestination(t *testing.T) {
+	prefix, port, err := ParseCIDRDestination("10.0.0.0/24:443")
+	if err != nil || prefix.String() != "10.0.0.0/24" || port != 443 {
+		t.Errorf("Expected 10.0.0.0/24 port 443, got %v port %d (%v)", prefix, port, err)
+	}
+	if prefix, _, err := ParseCIDRDestination("10.1.2.3/32:22"); err != nil || prefix.Bits() != 32 {
+		t.Errorf("Expected a single-address network to parse, got %v (%v)", prefix, err)
+	}
+
+	for _, dest := range []string{
+		"10.0.0.0/24",        // no port
+		"10.0.0.1/24:443",    // host bits set
+		"10.0.0.0/33:443",    // prefix too long
+		"10.0.0.0:443",       // no prefix
+		"fd00::/64:443",      // IPv6, and ambiguous without brackets
+		"[fd00::/64]:443",    // IPv6
+		"10.0.0.0/24:0",      // port 0
+		"10.0.0.0/24:70000",  // port out of range
+		"10.0.0.0/24:https",  // named port
+		"example.com/24:443", // not an address
+	} {
+		if _, _, err := ParseCIDRDestination(dest); err == nil {
+			t.Errorf("Expected %q to be rejected", dest)
+		}
+	}
+}
+
 // TestGetClientIP tests the client IP extraction from HTTP request headers
 func TestGetClientIP(t *testing.T) {
 	tests := []struct {
@@ -235,3 +275,41 @@ func TestGetClientIP(t *testing.T) {
 		})
 	}
 }
+
+// TestConfigureResolver points the resolver at a nameserver that never answers and checks that
+// lookups go there and give up after the configured timeout.
+func TestConfigureResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	queried := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 512)
+		if _, _, err := conn.ReadFrom(buf); err == nil {
+			queried <- struct{}{}
+		}
+	}()
+
+	ConfigureResolver([]string{conn.LocalAddr().String()}, 300*time.Millisecond)
+	t.Cleanup(func() { ConfigureResolver(nil, defaultLookupTimeout) })
+
+	start := time.Now()
+	if _, err := ResolveHostname("db.aegis-test.internal"); err == nil {
+		t.Fatal("Expected the lookup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the lookup to time out after about 300ms, took %v", elapsed)
+	}
+	select {
+	case <-queried:
+	case <-time.After(time.Second):
+		t.Error("Expected the configured nameserver to be queried")
+	}
+
+	// IP literals never reach the nameserver.
+	if ips, err := ResolveHostname("10.0.0.5"); err != nil || !slices.Equal(ips, []string{"10.0.0.5"}) {
+		t.Errorf("Expected 10.0.0.5 to resolve to itself, got %v, %v", ips, err)
+	}
+}
@@ -2,9 +2,16 @@ package utils
 
 import (
 	"Aegis/controller/internal/models"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"math/big"
+	"slices"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -12,52 +19,188 @@ import (
 // GetUsernameFromToken verifies the JWT token string using the provided secret key
 // and extracts the username claim. It enforces the HMAC signing method.
 func GetUsernameFromToken(tokenString string, jwtKey []byte) (string, error) {
-	// Parse the token, validating the signature in the callback function.
-	token, err := jwt.ParseWithClaims(tokenString, &models.Claims{}, func(token *jwt.Token) (any, error) {
-		// Explicitly verify the signing method is HMAC to prevent critical vulnerabilities
-		// where an attacker could switch the algorithm to 'None'.
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	claims, err := ParseToken(tokenString, jwtKey)
+	if err != nil {
+		return "", err
+	}
+	return claims.Username, nil
+}
+
+// KeySet holds the public keys asymmetric tokens are verified with, by key ID: *rsa.PublicKey for
+// RS256 and P-256 *ecdsa.PublicKey for ES256. Keeping the keys of retired signing keys in the set
+// lets tokens they signed expire normally during a rotation.
+type KeySet map[string]crypto.PublicKey
+
+// NewKeySet returns a set holding keys under their KeyID.
+func NewKeySet(keys ...crypto.PublicKey) KeySet {
+	set := make(KeySet, len(keys))
+	for _, key := range keys {
+		set[KeyID(key)] = key
+	}
+	return set
+}
+
+// KeyID returns the RFC 7638 JWK thumbprint of an RSA or ECDSA public key, which the token generators
+// put in the kid header, or "" for other keys. It depends only on the key, so every controller
+// sharing a key pair derives the same ID.
+func KeyID(key crypto.PublicKey) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	// The members are in lexicographic order, as the thumbprint requires.
+	var jwk string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64(big.NewInt(int64(k.E)).Bytes()), b64(k.N.Bytes()))
+	case *ecdsa.PublicKey:
+		// Bytes returns the uncompressed point: 0x04 followed by X and Y padded to the curve size.
+		point, err := k.Bytes()
+		if err != nil {
+			return ""
+		}
+		size := (len(point) - 1) / 2
+		jwk = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Curve.Params().Name, b64(point[1:1+size]), b64(point[1+size:]))
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(jwk))
+	return b64(sum[:])
+}
+
+// lookup returns the key a token's kid header selects. Tokens without a kid were signed before key
+// IDs were introduced; they are accepted only while the set holds a single key.
+func (s KeySet) lookup(kid any) (crypto.PublicKey, error) {
+	if kid == nil {
+		if len(s) == 1 {
+			for _, key := range s {
+				return key, nil
+			}
 		}
-		return jwtKey, nil
-	})
+		return nil, errors.New("token has no key ID")
+	}
+	id, ok := kid.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid key ID: %v", kid)
+	}
+	key, ok := s[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+	return key, nil
+}
 
+// GetUsernameFromTokenRS256 verifies the JWT token string using RS256 (RSA) asymmetric signing with
+// the key its kid header selects from keys, and returns the username.
+func GetUsernameFromTokenRS256(tokenString string, keys KeySet) (string, error) {
+	claims, err := ParseTokenRS256(tokenString, keys)
 	if err != nil {
-		return "", fmt.Errorf("token parsing failed: %w", err)
+		return "", err
 	}
+	return claims.Username, nil
+}
 
-	// Validate the token and type-cast the claims.
-	if claims, ok := token.Claims.(*models.Claims); ok && token.Valid {
-		return claims.Username, nil
-	}
+// ParseToken verifies the JWT token string using the provided secret key and returns its claims.
+// It enforces the HMAC signing method.
+func ParseToken(tokenString string, jwtKey []byte) (*models.Claims, error) {
+	return parseClaims(tokenString, func(*jwt.Token) (any, error) { return jwtKey, nil })
+}
 
-	return "", errors.New("token is invalid or claims could not be parsed")
+// allowedAlgs is the allowlist of signing algorithms for each kind of verification key. Every
+// verifier selects the key first and accepts only the algorithms listed for its kind, so a token
+// cannot choose how it is verified: "none", or an HS256 token using an RSA public key as its HMAC
+// secret, is rejected like any other mismatch.
+func allowedAlgs(key any) []string {
+	switch k := key.(type) {
+	case []byte:
+		return []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodHS384.Alg(), jwt.SigningMethodHS512.Alg()}
+	case *rsa.PublicKey:
+		return []string{jwt.SigningMethodRS256.Alg()}
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return []string{jwt.SigningMethodES256.Alg()}
+		}
+	}
+	return nil
 }
 
-// GetUsernameFromTokenRS256 verifies the JWT token string using RS256 (RSA) asymmetric signing and retuns username.
-func GetUsernameFromTokenRS256(tokenString string, publicKey *rsa.PublicKey) (string, error) {
+// parseClaims verifies the JWT token string with the key keyFor selects for it, using an algorithm
+// allowedAlgs permits for that key, and returns its claims.
+func parseClaims(tokenString string, keyFor jwt.Keyfunc, opts ...jwt.ParserOption) (*models.Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &models.Claims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		key, err := keyFor(token)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(allowedAlgs(key), token.Method.Alg()) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return publicKey, nil
-	})
+		return key, nil
+	}, opts...)
 
 	if err != nil {
-		return "", fmt.Errorf("token parsing failed: %w", err)
+		return nil, fmt.Errorf("token parsing failed: %w", err)
 	}
 
 	// Validate the token and type-cast the claims.
 	if claims, ok := token.Claims.(*models.Claims); ok && token.Valid {
-		return claims.Username, nil
+		return claims, nil
 	}
 
-	return "", errors.New("token is invalid or claims could not be parsed")
+	return nil, errors.New("token is invalid or claims could not be parsed")
+}
+
+// ParseTokenRS256 verifies the JWT token string using RS256 (RSA) asymmetric signing with the key its
+// kid header selects from keys, and returns its claims.
+func ParseTokenRS256(tokenString string, keys KeySet) (*models.Claims, error) {
+	return parseTokenWithKeys(tokenString, keys, jwt.SigningMethodRS256.Alg())
+}
+
+// ParseTokenES256 verifies the JWT token string using ES256 (ECDSA P-256) signing with the key its kid
+// header selects from keys, and returns its claims.
+func ParseTokenES256(tokenString string, keys KeySet) (*models.Claims, error) {
+	return parseTokenWithKeys(tokenString, keys, jwt.SigningMethodES256.Alg())
+}
+
+// ParseTokenWithKeys verifies an RS256 or ES256 JWT token string with the key its kid header selects
+// from keys, and returns its claims. The token must be signed with the algorithm of the selected
+// key, so a key set holding both kinds of keys can verify tokens during a switch of algorithm.
+func ParseTokenWithKeys(tokenString string, keys KeySet) (*models.Claims, error) {
+	return parseTokenWithKeys(tokenString, keys, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+}
+
+func parseTokenWithKeys(tokenString string, keys KeySet, algs ...string) (*models.Claims, error) {
+	return parseClaims(tokenString, func(token *jwt.Token) (any, error) {
+		return keys.lookup(token.Header["kid"])
+	}, jwt.WithValidMethods(algs))
+}
+
+// InspectToken verifies the signature of the JWT token string like ParseTokenWithKeys, or like
+// ParseToken when keys is empty, and returns its claims. Its time claims are not validated, so the
+// claims of an expired token are returned too; callers decide whether the token is still active.
+func InspectToken(tokenString string, jwtKey []byte, keys KeySet) (*models.Claims, error) {
+	if len(keys) > 0 {
+		return parseClaims(tokenString, func(token *jwt.Token) (any, error) {
+			return keys.lookup(token.Header["kid"])
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}), jwt.WithoutClaimsValidation())
+	}
+	return parseClaims(tokenString, func(*jwt.Token) (any, error) { return jwtKey, nil }, jwt.WithoutClaimsValidation())
 }
 
-// GenerateTokenRS256 creates a new JWT token signed with RS256 using the private key.
+// GenerateTokenRS256 creates a new JWT token signed with RS256 using the private key, tagged with the
+// KeyID of its public key.
 func GenerateTokenRS256(claims *models.Claims, privateKey *rsa.PrivateKey) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = KeyID(&privateKey.PublicKey)
+	tokenString, err := token.SignedString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return tokenString, nil
+}
+
+// GenerateTokenES256 creates a new JWT token signed with ES256 using the P-256 private key, tagged
+// with the KeyID of its public key.
+func GenerateTokenES256(claims *models.Claims, privateKey *ecdsa.PrivateKey) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = KeyID(&privateKey.PublicKey)
 	tokenString, err := token.SignedString(privateKey)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
@@ -2,8 +2,14 @@ package utils
 
 import (
 	"Aegis/controller/internal/models"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"testing"
 	"time"
 
@@ -214,7 +220,7 @@ func TestGenerateTokenRS256(t *testing.T) {
 	}
 
 	// Verify the token can be parsed with the public key
-	username, err := GetUsernameFromTokenRS256(tokenString, &privKey.PublicKey)
+	username, err := GetUsernameFromTokenRS256(tokenString, NewKeySet(&privKey.PublicKey))
 	if err != nil {
 		t.Errorf("GetUsernameFromTokenRS256 failed: %v", err)
 	}
@@ -313,7 +319,7 @@ func TestGetUsernameFromTokenRS256(t *testing.T) {
 			} else {
 				pubKey = &privKey.PublicKey
 			}
-			username, err := GetUsernameFromTokenRS256(tt.tokenString, pubKey)
+			username, err := GetUsernameFromTokenRS256(tt.tokenString, NewKeySet(pubKey))
 			if tt.shouldError {
 				if err == nil {
 					t.Errorf("Expected error but got none")
@@ -345,8 +351,221 @@ func TestGetUsernameFromTokenRS256WrongKey(t *testing.T) {
 		t.Fatalf("Failed to create token: %v", err)
 	}
 
-	_, err = GetUsernameFromTokenRS256(tokenString, &otherKey.PublicKey)
+	_, err = GetUsernameFromTokenRS256(tokenString, NewKeySet(&otherKey.PublicKey))
 	if err == nil {
 		t.Error("Expected error when verifying with wrong public key, but got none")
 	}
 }
+
+func TestKeyID(t *testing.T) {
+	// The example key of RFC 7638 section 3.1.
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatalf("Failed to decode modulus: %v", err)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	if got, want := KeyID(key), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Expected key ID %s, got %s", want, got)
+	}
+}
+
+func TestRS256KeyRotation(t *testing.T) {
+	oldKey := generateTestRSAKey(t)
+	newKey := generateTestRSAKey(t)
+	sign := func(key *rsa.PrivateKey) string {
+		t.Helper()
+		token, err := GenerateTokenRS256(&models.Claims{
+			Username:         "rotator",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute))},
+		}, key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return token
+	}
+	oldToken := sign(oldKey)
+
+	// During the rotation the new key signs while the old one is still published for verification.
+	rotating := NewKeySet(&oldKey.PublicKey, &newKey.PublicKey)
+	for name, token := range map[string]string{"old": oldToken, "new": sign(newKey)} {
+		if _, err := GetUsernameFromTokenRS256(token, rotating); err != nil {
+			t.Errorf("Expected %s token to verify during rotation, got %v", name, err)
+		}
+	}
+
+	// Once the old key is retired, tokens it signed are rejected.
+	if _, err := GetUsernameFromTokenRS256(oldToken, NewKeySet(&newKey.PublicKey)); err == nil {
+		t.Error("Expected token signed with a retired key to be rejected")
+	}
+
+	// Tokens issued before key IDs carry no kid; they verify only while a single key is configured.
+	unkeyed := jwt.NewWithClaims(jwt.SigningMethodRS256, &models.Claims{
+		Username:         "rotator",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute))},
+	})
+	legacyToken, err := unkeyed.SignedString(oldKey)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := GetUsernameFromTokenRS256(legacyToken, NewKeySet(&oldKey.PublicKey)); err != nil {
+		t.Errorf("Expected token without kid to verify against a single key, got %v", err)
+	}
+	if _, err := GetUsernameFromTokenRS256(legacyToken, rotating); err == nil {
+		t.Error("Expected token without kid to be rejected when several keys are configured")
+	}
+}
+
+func TestES256Tokens(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	rsaKey := generateTestRSAKey(t)
+	keys := NewKeySet(&ecKey.PublicKey, &rsaKey.PublicKey)
+	claims := func() *models.Claims {
+		return &models.Claims{
+			Username:         "es256user",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute))},
+		}
+	}
+
+	token, err := GenerateTokenES256(claims(), ecKey)
+	if err != nil {
+		t.Fatalf("GenerateTokenES256 failed: %v", err)
+	}
+	for name, parse := range map[string]func(string, KeySet) (*models.Claims, error){
+		"ParseTokenES256":    ParseTokenES256,
+		"ParseTokenWithKeys": ParseTokenWithKeys,
+	} {
+		got, err := parse(token, keys)
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if got.Username != "es256user" {
+			t.Errorf("%s: expected username es256user, got %s", name, got.Username)
+		}
+	}
+	if _, err := ParseTokenRS256(token, keys); err == nil {
+		t.Error("Expected the RS256 verifier to reject an ES256 token")
+	}
+
+	// A token must be signed with the algorithm of the key its kid selects.
+	withKid := func(method jwt.SigningMethod, kid string, key any) string {
+		t.Helper()
+		tok := jwt.NewWithClaims(method, claims())
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return s
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	confused := map[string]string{
+		"RS256 token naming the EC key":          withKid(jwt.SigningMethodRS256, KeyID(&ecKey.PublicKey), rsaKey),
+		"ES256 token naming the RSA key":         withKid(jwt.SigningMethodES256, KeyID(&rsaKey.PublicKey), ecKey),
+		"HS256 token keyed with the public key":  withKid(jwt.SigningMethodHS256, KeyID(&ecKey.PublicKey), pubDER),
+		"ES384 token naming the EC key":          withKid(jwt.SigningMethodES384, KeyID(&ecKey.PublicKey), mustECKey(t, elliptic.P384())),
+		"HS256 token keyed with the kid as text": withKid(jwt.SigningMethodHS256, KeyID(&ecKey.PublicKey), []byte(KeyID(&ecKey.PublicKey))),
+	}
+	for name, token := range confused {
+		if _, err := ParseTokenWithKeys(token, keys); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func mustECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	return key
+}
+
+func TestVerifiersRejectAlgorithmConfusion(t *testing.T) {
+	rsaKey := generateTestRSAKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keys := NewKeySet(&rsaKey.PublicKey)
+	claims := &models.Claims{
+		Username:         "mallory",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute))},
+	}
+
+	// An HS256 token using the RSA public key as its HMAC secret: anyone holding the public key can
+	// mint one, so it must never verify.
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(publicPEM)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("Failed to create none token: %v", err)
+	}
+	for name, token := range map[string]string{"HS256 forged with the public key": forged, "none": unsigned} {
+		if _, err := ParseTokenRS256(token, keys); err == nil {
+			t.Errorf("%s: expected ParseTokenRS256 to reject the token", name)
+		}
+		if _, err := ParseTokenWithKeys(token, keys); err == nil {
+			t.Errorf("%s: expected ParseTokenWithKeys to reject the token", name)
+		}
+	}
+
+	// The HMAC verifier likewise refuses an RS256 token, whatever secret it is given.
+	rs256, err := GenerateTokenRS256(claims, rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := ParseToken(rs256, publicPEM); err == nil {
+		t.Error("Expected ParseToken to reject an RS256 token")
+	}
+}
+
+func TestInspectToken(t *testing.T) {
+	rsaKey := generateTestRSAKey(t)
+	keys := NewKeySet(&rsaKey.PublicKey)
+	expiredClaims := func() *models.Claims {
+		return &models.Claims{
+			Username:         "inspector",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+		}
+	}
+
+	expiredRS256, err := GenerateTokenRS256(expiredClaims(), rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := ParseTokenWithKeys(expiredRS256, keys); err == nil {
+		t.Fatal("Expected ParseTokenWithKeys to reject an expired token")
+	}
+	claims, err := InspectToken(expiredRS256, nil, keys)
+	if err != nil || claims.Username != "inspector" {
+		t.Errorf("Expected the claims of an expired RS256 token, got %v, %v", claims, err)
+	}
+
+	expiredHS256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, expiredClaims()).SignedString([]byte("secret"))
+	if claims, err := InspectToken(expiredHS256, []byte("secret"), nil); err != nil || claims.Username != "inspector" {
+		t.Errorf("Expected the claims of an expired HS256 token, got %v, %v", claims, err)
+	}
+
+	// The signature is still verified, and with the same keys as ParseTokenWithKeys: once RS256 keys
+	// are configured an HS256 token is rejected even when signed with the right secret.
+	if _, err := InspectToken(expiredHS256, []byte("other"), nil); err == nil {
+		t.Error("Expected a token signed with another secret to be rejected")
+	}
+	if _, err := InspectToken(expiredHS256, []byte("secret"), keys); err == nil {
+		t.Error("Expected an HS256 token to be rejected when RS256 keys are configured")
+	}
+	if _, err := InspectToken(expiredRS256, nil, NewKeySet(&generateTestRSAKey(t).PublicKey)); err == nil {
+		t.Error("Expected a token signed with an unknown key to be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLookupTimeout bounds hostname lookups until ConfigureResolver is called.
+const defaultLookupTimeout = 5 * time.Second
+
+var (
+	resolverMu    sync.RWMutex
+	resolver      = net.DefaultResolver
+	lookupTimeout = defaultLookupTimeout
+)
+
+// ConfigureResolver makes ResolveHostname query nameservers (ip:port addresses) instead of the
+// system resolver, so internal names resolve regardless of the host's /etc/resolv.conf. Queries
+// rotate through the nameservers, so a retry goes to the next one. With no nameservers the system
+// resolver is used. Every lookup is cancelled after timeout.
+func ConfigureResolver(nameservers []string, timeout time.Duration) {
+	r := net.DefaultResolver
+	if len(nameservers) > 0 {
+		servers := append([]string(nil), nameservers...)
+		var next atomic.Uint64
+		dialer := &net.Dialer{}
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := servers[(next.Add(1)-1)%uint64(len(servers))]
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = r
+	lookupTimeout = timeout
+}
+
+// currentResolver returns the resolver and timeout set by ConfigureResolver.
+func currentResolver() (*net.Resolver, time.Duration) {
+	resolverMu.RLock()
+	defer resolverMu.RUnlock()
+	return resolver, lookupTimeout
+}
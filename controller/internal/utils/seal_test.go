@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	const key = "k3Jv9QzX7mP2wL8rT5nB1cY6hF4dG0sA"
+
+	sealed, err := Seal(key, "1//refresh-token")
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if strings.Contains(sealed, "refresh-token") {
+		t.Errorf("Sealed value contains the plaintext: %s", sealed)
+	}
+	if again, _ := Seal(key, "1//refresh-token"); again == sealed {
+		t.Error("Expected sealing twice to use different nonces")
+	}
+
+	plaintext, err := Open(key, sealed)
+	if err != nil || plaintext != "1//refresh-token" {
+		t.Errorf("Open: got %q, %v", plaintext, err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		sealed string
+	}{
+		{"Wrong key", "another-key", sealed},
+		{"Altered value", key, sealed[:len(sealed)-4] + "AAA="},
+		{"Not base64", key, "not base64!"},
+		{"Too short", key, "AAAA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.key, tt.sealed); err == nil {
+				t.Error("Expected Open to fail")
+			}
+		})
+	}
+}
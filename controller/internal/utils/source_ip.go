@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+var (
+	sourceIPMu     sync.RWMutex
+	sourceIPHeader string
+)
+
+// SetSourceIPHeader makes GetSourceIP read the enforced source IP from the named request header, for
+// deployments where a VPN gateway reports the user's device address. An empty name restores the
+// default of using the request's client IP.
+func SetSourceIPHeader(name string) {
+	sourceIPMu.Lock()
+	defer sourceIPMu.Unlock()
+	sourceIPHeader = name
+}
+
+// GetSourceIP returns the address an activation should admit traffic from: the configured source IP
+// header when it holds a valid IP, else GetClientIP. The gateway in front of the controller must set
+// or strip that header, or clients could choose their own source IP.
+func GetSourceIP(r *http.Request) string {
+	sourceIPMu.RLock()
+	header := sourceIPHeader
+	sourceIPMu.RUnlock()
+	if header != "" {
+		if ip := strings.TrimSpace(r.Header.Get(header)); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	return GetClientIP(r)
+}
+
+// ParseSourceIPAllowlist parses the networks a client-supplied source IP must fall in. Entries are
+// IPv4 CIDRs or single IPv4 addresses.
+func ParseSourceIPAllowlist(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(e, "/") {
+			p, err = netip.ParsePrefix(e)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(e); err == nil {
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", e, err)
+		}
+		if !p.Addr().Is4() {
+			return nil, fmt.Errorf("invalid network %q: only IPv4 is supported", e)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
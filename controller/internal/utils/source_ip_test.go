@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetSourceIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   string
+	}{
+		{"Request IP without a header", "", "10.8.0.5", "192.0.2.1"},
+		{"Configured header", "X-VPN-Client-IP", "10.8.0.5", "10.8.0.5"},
+		{"Missing header value", "X-VPN-Client-IP", "", "192.0.2.1"},
+		{"Invalid header value", "X-VPN-Client-IP", "10.8.0", "192.0.2.1"},
+	}
+	t.Cleanup(func() { SetSourceIPHeader("") })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetSourceIPHeader(tt.header)
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.value != "" {
+				req.Header.Set("X-VPN-Client-IP", tt.value)
+			}
+			if got := GetSourceIP(req); got != tt.want {
+				t.Errorf("GetSourceIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceIPAllowlist(t *testing.T) {
+	prefixes, err := ParseSourceIPAllowlist([]string{"10.8.1.9/16", "192.0.2.7"})
+	if err != nil {
+		t.Fatalf("ParseSourceIPAllowlist failed: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "10.8.0.0/16" || prefixes[1].String() != "192.0.2.7/32" {
+		t.Errorf("Expected [10.8.0.0/16 192.0.2.7/32], got %v", prefixes)
+	}
+
+	for _, entry := range []string{"10.8.0.0/33", "not-an-ip", "fd00::/8"} {
+		if _, err := ParseSourceIPAllowlist([]string{entry}); err == nil || !strings.Contains(err.Error(), entry) {
+			t.Errorf("Expected an error naming %q, got %v", entry, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultUsernamePattern is the rule usernames follow until SetUsernamePattern is called.
+const DefaultUsernamePattern = `^[a-zA-Z0-9_]{5,30}$`
+
+var (
+	usernameMu sync.RWMutex
+	usernameRE = regexp.MustCompile(DefaultUsernamePattern)
+)
+
+// SetUsernamePattern replaces the rule ValidUsername checks. The pattern must match the whole
+// username whether or not it is anchored.
+func SetUsernamePattern(pattern string) error {
+	re, err := CompileUsernamePattern(pattern)
+	if err != nil {
+		return err
+	}
+	usernameMu.Lock()
+	usernameRE = re
+	usernameMu.Unlock()
+	return nil
+}
+
+// CompileUsernamePattern compiles pattern so that it matches whole usernames only.
+func CompileUsernamePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username pattern: %w", err)
+	}
+	return re, nil
+}
+
+// ValidUsername reports whether username follows the configured rule.
+func ValidUsername(username string) bool {
+	usernameMu.RLock()
+	defer usernameMu.RUnlock()
+	return usernameRE.MatchString(username)
+}
+
+var lowercaseUsernames atomic.Bool
+
+// SetLowercaseUsernames makes NormalizeUsername lowercase usernames, so that usernames differing only
+// in case name the same account.
+func SetLowercaseUsernames(enabled bool) {
+	lowercaseUsernames.Store(enabled)
+}
+
+// NormalizeUsername returns the form username is stored and looked up in: lowercased when
+// SetLowercaseUsernames is enabled, and unchanged otherwise.
+func NormalizeUsername(username string) string {
+	if lowercaseUsernames.Load() {
+		return strings.ToLower(username)
+	}
+	return username
+}
@@ -0,0 +1,37 @@
+package utils
+
+import "testing"
+
+func TestValidUsername(t *testing.T) {
+	t.Cleanup(func() { _ = SetUsernamePattern(DefaultUsernamePattern) })
+
+	tests := []struct {
+		pattern  string
+		username string
+		want     bool
+	}{
+		{DefaultUsernamePattern, "alice_01", true},
+		{DefaultUsernamePattern, "abc", false},
+		{DefaultUsernamePattern, "alice@example.com", false},
+		{`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`, "alice.smith@example.com", true},
+		{`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`, "alice", false},
+		// Unanchored patterns still have to match the whole username.
+		{`[a-z]+`, "alice", true},
+		{`[a-z]+`, "alice!", false},
+	}
+	for _, tt := range tests {
+		if err := SetUsernamePattern(tt.pattern); err != nil {
+			t.Fatalf("SetUsernamePattern(%q) failed: %v", tt.pattern, err)
+		}
+		if got := ValidUsername(tt.username); got != tt.want {
+			t.Errorf("pattern %q, username %q: got %v, want %v", tt.pattern, tt.username, got, tt.want)
+		}
+	}
+
+	if err := SetUsernamePattern(`[a-z`); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+	if !ValidUsername("alice") || ValidUsername("alice!") {
+		t.Error("Expected a rejected pattern to leave the previous rule in place")
+	}
+}
@@ -1,66 +1,212 @@
 package watcher
 
 import (
+	"Aegis/controller/internal/metrics"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 )
 
-// StartDockerWatcher listens for container events and updates service IPs in realtime
-func StartDockerWatcher() {
+// Config holds the reconnect backoff of the Docker event subscription. Delays start at RetryDelay
+// and double after every subscription that lasted less than StableAfter, up to MaxRetryDelay.
+type Config struct {
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	StableAfter   time.Duration
+}
+
+// Status is the state of the Docker event subscription. Enabled is false if the Docker socket could
+// not be reached at startup, in which case service addresses rely on DNS polling alone.
+type Status struct {
+	Enabled     bool
+	Connected   bool
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// dockerClient is the part of the Docker API the watcher uses.
+type dockerClient interface {
+	Ping(ctx context.Context) (types.Ping, error)
+	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
+	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+	Close() error
+}
+
+// DockerWatcher updates service IPs in realtime from container start events.
+type DockerWatcher struct {
+	svcRepo   repository.ServiceRepository
+	cfg       Config
+	newClient func() (dockerClient, error)
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewDockerWatcher creates a DockerWatcher connecting to the Docker daemon configured in the
+// environment.
+func NewDockerWatcher(svcRepo repository.ServiceRepository, cfg Config) *DockerWatcher {
+	return &DockerWatcher{
+		svcRepo: svcRepo,
+		cfg:     cfg,
+		newClient: func() (dockerClient, error) {
+			return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		},
+	}
+}
+
+// Status returns the current state of the event subscription.
+func (w *DockerWatcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+func (w *DockerWatcher) setConnected(connected bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Connected = connected
+	if err != nil {
+		w.status.LastError = err.Error()
+		w.status.LastErrorAt = time.Now()
+	}
+}
+
+// Run listens for container events and updates service IPs until ctx is cancelled. If the event
+// stream fails, it resubscribes with backoff and reconciles every running container, since starts
+// may have been missed meanwhile.
+func (w *DockerWatcher) Run(ctx context.Context) {
 	// Initialize Docker Client
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := w.newClient()
 	if err != nil {
 		log.Printf("[WARN] Docker watcher: failed to create client: %v. Relying on DNS polling.", err)
+		w.setConnected(false, err)
 		return
 	}
 	defer func() { _ = cli.Close() }()
 
 	// Verify connection
-	if _, err := cli.Ping(context.Background()); err != nil {
+	if _, err := cli.Ping(ctx); err != nil {
 		log.Printf("[WARN] Docker watcher: cannot connect to Docker socket: %v. Relying on DNS polling.", err)
+		w.setConnected(false, err)
 		return
 	}
+	w.mu.Lock()
+	w.status.Enabled = true
+	w.mu.Unlock()
 
 	log.Println("[INFO] Docker watcher started. Listening for real-time container updates...")
 
+	var delay time.Duration
+	for {
+		connected := time.Now()
+		err := w.watch(ctx, cli)
+		if ctx.Err() != nil {
+			log.Println("[INFO] Docker watcher stopped")
+			return
+		}
+		w.setConnected(false, err)
+
+		switch {
+		case delay == 0 || time.Since(connected) >= w.cfg.StableAfter:
+			delay = w.cfg.RetryDelay
+		default:
+			delay = min(delay*2, w.cfg.MaxRetryDelay)
+		}
+		log.Printf("[ERROR] Docker event listener failed: %v. Reconnecting in %v...", err, delay)
+		select {
+		case <-ctx.Done():
+			log.Println("[INFO] Docker watcher stopped")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// watch subscribes to container start events, reconciles running containers and handles events
+// until the subscription fails or ctx is done.
+func (w *DockerWatcher) watch(ctx context.Context, cli dockerClient) error {
+	if _, err := cli.Ping(ctx); err != nil {
+		return err
+	}
+
 	// Filter for container 'start' events
 	filterArgs := filters.NewArgs()
 	filterArgs.Add("type", "container")
 	filterArgs.Add("event", "start")
 
-	msgChan, errChan := cli.Events(context.Background(), events.ListOptions{
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgChan, errChan := cli.Events(subCtx, events.ListOptions{
 		Filters: filterArgs,
 	})
+	w.setConnected(true, nil)
+
+	// Subscribed first, so no start between the listing and the subscription is missed.
+	w.reconcile(ctx, cli)
 
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case err := <-errChan:
-			log.Printf("[ERROR] Docker event listener failed: %v", err)
-			return
+			return err
 		case msg := <-msgChan:
-			handleContainerEvent(cli, msg)
+			handleContainerEvent(cli, w.svcRepo, msg)
 		}
 	}
 }
 
-// handleContainerEvent hanles a container event by getting its hostname and checking with existing hostnames, if found it will udpate the ip
-func handleContainerEvent(cli *client.Client, msg events.Message) {
-	containerName := msg.Actor.Attributes["name"]
-	if containerName == "" {
+// reconcile applies the address of every running container to the service it is registered under.
+func (w *DockerWatcher) reconcile(ctx context.Context, cli dockerClient) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		log.Printf("[WARN] Docker watcher: failed to list containers: %v", err)
 		return
 	}
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		json, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			log.Printf("[WARN] Docker watcher: failed to inspect container %s: %v", c.Names[0], err)
+			continue
+		}
+		applyContainer(w.svcRepo, strings.TrimPrefix(c.Names[0], "/"), json)
+	}
+}
 
-	// Check if there is any service using the container name as a hostname
-	serviceID, currentIP, currentPort, servicePort, err := findServiceByHostnamePrefix(containerName)
-	if err != nil {
+// HostnameLabel is the container label that binds a container to the Aegis service registered under
+// that host (without port). It takes precedence over the container name, compose service name and
+// network aliases.
+const HostnameLabel = "aegis.hostname"
+
+// composeServiceLabel is set by Docker Compose to the name of the service a container belongs to.
+const composeServiceLabel = "com.docker.compose.service"
+
+// handleContainerEvent hanles a container event by getting its hostname and checking with existing hostnames, if found it will udpate the ip
+func handleContainerEvent(cli dockerClient, svcRepo repository.ServiceRepository, msg events.Message) {
+	containerName := msg.Actor.Attributes["name"]
+	if containerName == "" {
 		return
 	}
 
@@ -69,16 +215,32 @@ func handleContainerEvent(cli *client.Client, msg events.Message) {
 		log.Printf("[WARN] Docker watcher: failed to inspect container %s: %v", containerName, err)
 		return
 	}
+	applyContainer(svcRepo, containerName, json)
+}
 
-	// Extract IP address
-	var newIPStr string
-	for _, network := range json.NetworkSettings.Networks {
-		if network.IPAddress != "" {
-			newIPStr = network.IPAddress
-			break
-		}
+// applyContainer updates the service a started container is registered under with the container's
+// address.
+func applyContainer(svcRepo repository.ServiceRepository, containerName string, json container.InspectResponse) {
+	// A service bound to the container takes precedence over any service using one of the
+	// container's names as a hostname
+	var containerID string
+	if json.ContainerJSONBase != nil {
+		containerID = json.ID
+	}
+	serviceID, host, currentIP, currentPort, servicePort, err := findBoundService(containerID, containerName)
+	if errors.Is(err, ErrNoMatchingService) {
+		serviceID, host, currentIP, currentPort, servicePort, err = findServiceByHost(containerHosts(containerName, json))
+	}
+	if errors.Is(err, ErrNoMatchingService) {
+		return
+	}
+	if err != nil {
+		lookupErrors.Add(1)
+		log.Printf("[ERROR] Docker watcher: failed to look up the service of container %s: %v", containerName, err)
+		return
 	}
 
+	newIPStr := containerIP(json, host)
 	if newIPStr == "" {
 		log.Printf("[WARN] Docker watcher: container %s started but has no IP", containerName)
 		return
@@ -97,31 +259,202 @@ func handleContainerEvent(cli *client.Client, msg events.Message) {
 
 	if newIP != currentIP || newPort != currentPort {
 		currentIPStr := utils.Uint32ToIp(currentIP)
-		log.Printf("[INFO] Docker Event: Container '%s' started. Updating Service %d IP: %s:%d -> %s:%d",
-			containerName, serviceID, currentIPStr, currentPort, newIPStr, newPort)
+		updated, err := svcRepo.UpdateIPPort(serviceID, newIP, newPort, repository.IPSourceDocker)
+		switch {
+		case err != nil:
+			log.Printf("[ERROR] Docker watcher: failed to update DB: %v", err)
+		case !updated:
+			log.Printf("[INFO] Docker Event: Container '%s' started at %s:%d, but Service %d keeps %s:%d resolved from DNS (dns.ip_authority)",
+				containerName, newIPStr, newPort, serviceID, currentIPStr, currentPort)
+		default:
+			log.Printf("[INFO] Docker Event: Container '%s' started as '%s'. Updated Service %d IP: %s:%d -> %s:%d",
+				containerName, host, serviceID, currentIPStr, currentPort, newIPStr, newPort)
+		}
+	}
+}
 
-		_, err := repository.DB.Exec("UPDATE services SET ip = ?, port = ? WHERE id = ?", newIP, newPort, serviceID)
+// containerHosts returns the hosts a container may be registered under, in order of preference: only
+// the HostnameLabel value if it is set, otherwise the container name, its compose service name and
+// its network aliases.
+func containerHosts(containerName string, json container.InspectResponse) []string {
+	var labels map[string]string
+	if json.Config != nil {
+		labels = json.Config.Labels
+	}
+	if host := labels[HostnameLabel]; host != "" {
+		return []string{host}
+	}
+
+	hosts := []string{containerName}
+	if svc := labels[composeServiceLabel]; svc != "" {
+		hosts = append(hosts, svc)
+	}
+	if json.NetworkSettings != nil {
+		names := make([]string, 0, len(json.NetworkSettings.Networks))
+		for name := range json.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ep := json.NetworkSettings.Networks[name]; ep != nil {
+				hosts = append(hosts, ep.Aliases...)
+			}
+		}
+	}
+
+	out := hosts[:0]
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// containerIP returns the container's address on a network where host is one of its aliases, or on
+// the first network that has one.
+func containerIP(json container.InspectResponse, host string) string {
+	if json.NetworkSettings == nil {
+		return ""
+	}
+	var fallback string
+	for _, network := range json.NetworkSettings.Networks {
+		if network == nil || network.IPAddress == "" {
+			continue
+		}
+		if slices.Contains(network.Aliases, host) || slices.Contains(network.DNSNames, host) {
+			return network.IPAddress
+		}
+		if fallback == "" {
+			fallback = network.IPAddress
+		}
+	}
+	return fallback
+}
+
+// ErrNoMatchingService is returned by findServiceByHost when no service is registered under any of
+// a container's hosts, which is the case for most containers.
+var ErrNoMatchingService = errors.New("no service matches the container")
+
+// lookupErrors counts container events dropped because their service could not be looked up.
+var lookupErrors atomic.Uint64
+
+// Collector exposes the number of container events dropped because of lookup errors.
+func Collector() metrics.Collector {
+	return func(w io.Writer) {
+		metrics.WriteMetric(w, "aegis_docker_watcher_lookup_errors_total", "counter", "Container events dropped because the service lookup failed.",
+			metrics.Sample{Value: float64(lookupErrors.Load())})
+	}
+}
+
+// findServiceByHost returns the first registered service whose hostname has one of hosts as its
+// host part, trying hosts in order, along with the host it matched. It returns ErrNoMatchingService
+// if there is none.
+func findServiceByHost(hosts []string) (int, string, uint32, uint16, string, error) {
+	return findService(hosts, services.lookup)
+}
+
+// findBoundService returns the service bound to a container by its full ID, short ID or name, along
+// with the reference it was bound by. It returns ErrNoMatchingService if there is none.
+func findBoundService(containerID, containerName string) (int, string, uint32, uint16, string, error) {
+	refs := []string{containerID, containerName}
+	if len(containerID) > 12 {
+		refs = append(refs, containerID[:12])
+	}
+	return findService(refs, services.lookupBound)
+}
+
+// findService returns the first service lookup finds for one of keys, trying keys in order, along
+// with the key it matched.
+func findService(keys []string, lookup func(string) (indexedService, bool, error)) (int, string, uint32, uint16, string, error) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		svc, ok, err := lookup(key)
 		if err != nil {
-			log.Printf("[ERROR] Docker watcher: failed to update DB: %v", err)
+			return 0, "", 0, 0, "", err
+		}
+		if !ok {
+			continue
+		}
+		var ip uint32
+		var port uint16
+		err = repository.DB.QueryRow("SELECT ip, port FROM services WHERE id = ?", svc.id).Scan(&ip, &port)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, "", 0, 0, "", fmt.Errorf("query failed: %w", err)
 		}
+		return svc.id, key, ip, port, svc.port, nil
 	}
+	return 0, "", 0, 0, "", ErrNoMatchingService
+}
+
+// indexMaxAge bounds how long the hostname index is used without reloading it, in case services
+// were changed other than through the repository.
+const indexMaxAge = 5 * time.Minute
+
+type indexedService struct {
+	id   int
+	port string
+}
+
+// hostIndex maps the host part of every service hostname, and every container bound to a service,
+// to the services registered under it, so container events are matched without scanning the
+// services table. CIDR services are left out, since they have no single address to follow. It is
+// reloaded on the next lookup after repository.ServicesVersion changes or once it is indexMaxAge old.
+type hostIndex struct {
+	mu      sync.Mutex
+	version uint64
+	builtAt time.Time
+	hosts   map[string][]indexedService
+	bound   map[string][]indexedService
 }
 
-// findServiceByHostnamePrefix checks if any registered service matches the container name.
-func findServiceByHostnamePrefix(containerName string) (int, uint32, uint16, string, error) {
-	pattern := containerName + ":%"
-	rows, err := repository.DB.Query("SELECT id, hostname, ip, port FROM services WHERE hostname LIKE ?", pattern)
+var services = &hostIndex{}
+
+// lookup returns the service with the lowest ID registered under host.
+func (x *hostIndex) lookup(host string) (indexedService, bool, error) {
+	return x.find(host, func() map[string][]indexedService { return x.hosts })
+}
+
+// lookupBound returns the service with the lowest ID bound to the container ref.
+func (x *hostIndex) lookupBound(ref string) (indexedService, bool, error) {
+	return x.find(ref, func() map[string][]indexedService { return x.bound })
+}
+
+func (x *hostIndex) find(key string, table func() map[string][]indexedService) (indexedService, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if version := repository.ServicesVersion(); x.hosts == nil || version != x.version || time.Since(x.builtAt) > indexMaxAge {
+		if err := x.load(version); err != nil {
+			return indexedService{}, false, fmt.Errorf("failed to load service hostnames: %w", err)
+		}
+	}
+	matches := table()[key]
+	if len(matches) == 0 {
+		return indexedService{}, false, nil
+	}
+	return matches[0], true, nil
+}
+
+func (x *hostIndex) load(version uint64) error {
+	rows, err := repository.DB.Query("SELECT id, hostname, container FROM services WHERE destination_type = 'host' ORDER BY id")
 	if err != nil {
-		return 0, 0, 0, "", fmt.Errorf("query failed: %w", err)
+		return fmt.Errorf("query failed: %w", err)
 	}
 	defer func() { _ = rows.Close() }()
 
+	hosts := make(map[string][]indexedService)
+	bound := make(map[string][]indexedService)
 	for rows.Next() {
 		var id int
-		var hostname string
-		var ip uint32
-		var port uint16
-		if err := rows.Scan(&id, &hostname, &ip, &port); err != nil {
+		var hostname, container string
+		if err := rows.Scan(&id, &hostname, &container); err != nil {
 			log.Printf("[WARN] Docker watcher: failed to scan service row: %v", err)
 			continue
 		}
@@ -131,11 +464,15 @@ func findServiceByHostnamePrefix(containerName string) (int, uint32, uint16, str
 			log.Printf("[WARN] Docker watcher: invalid hostname format '%s': %v", hostname, err)
 			continue
 		}
-
-		if host == containerName {
-			return id, ip, port, portStr, nil
+		svc := indexedService{id: id, port: portStr}
+		hosts[host] = append(hosts[host], svc)
+		if container != "" {
+			bound[container] = append(bound[container], svc)
 		}
 	}
-
-	return 0, 0, 0, "", fmt.Errorf("service not found for container: %s", containerName)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	x.hosts, x.bound, x.version, x.builtAt = hosts, bound, version, time.Now()
+	return nil
 }
@@ -0,0 +1,394 @@
+package watcher
+
+import (
+	"Aegis/controller/internal/models"
+	"Aegis/controller/internal/repository"
+	"Aegis/controller/internal/utils"
+	"Aegis/controller/proto"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestContainerHosts(t *testing.T) {
+	json := container.InspectResponse{
+		Config: &container.Config{Labels: map[string]string{composeServiceLabel: "billing"}},
+		NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"backend":  {Aliases: []string{"billing-api", "billing"}},
+			"frontend": {Aliases: []string{"invoices"}},
+		}},
+	}
+	if got, want := containerHosts("stack-billing-1", json), []string{"stack-billing-1", "billing", "billing-api", "invoices"}; !slices.Equal(got, want) {
+		t.Errorf("containerHosts() = %v, want %v", got, want)
+	}
+
+	json.Config.Labels[HostnameLabel] = "payments"
+	if got := containerHosts("stack-billing-1", json); !slices.Equal(got, []string{"payments"}) {
+		t.Errorf("containerHosts() with %s label = %v, want [payments]", HostnameLabel, got)
+	}
+}
+
+func TestApplyContainerPrefersLabel(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	for _, hostname := range []string{"web-1:80", "payments:8443"} {
+		if _, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, 1)", hostname, hostname, utils.IpToUint32("10.0.0.2")); err != nil {
+			t.Fatalf("Failed to create test service: %v", err)
+		}
+	}
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	// The container's name matches one service, but its label binds it to the other.
+	applyContainer(svcRepo, "web-1", container.InspectResponse{
+		Config: &container.Config{Labels: map[string]string{HostnameLabel: "payments"}},
+		NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: "172.17.0.4"},
+		}},
+	})
+
+	addr := func(hostname string) string {
+		t.Helper()
+		var ip uint32
+		var port uint16
+		if err := db.QueryRow("SELECT ip, port FROM services WHERE hostname = ?", hostname).Scan(&ip, &port); err != nil {
+			t.Fatalf("Failed to read service %s: %v", hostname, err)
+		}
+		return fmt.Sprintf("%s:%d", utils.Uint32ToIp(ip), port)
+	}
+	if got := addr("payments:8443"); got != "172.17.0.4:8443" {
+		t.Errorf("Expected the labeled service to move to the container, got %s", got)
+	}
+	if got := addr("web-1:80"); got != "10.0.0.2:1" {
+		t.Errorf("Expected the service matching the container name to be left alone, got %s", got)
+	}
+}
+
+// fakeDocker is a Docker daemon whose event streams are handed out from streams, one per subscription.
+type fakeDocker struct {
+	streams    chan chan error
+	listed     chan struct{}
+	subscribed atomic.Int32
+}
+
+func (f *fakeDocker) Ping(ctx context.Context) (types.Ping, error) { return types.Ping{}, nil }
+
+func (f *fakeDocker) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	f.subscribed.Add(1)
+	errs := make(chan error, 1)
+	select {
+	case stream := <-f.streams:
+		go func() {
+			select {
+			case err := <-stream:
+				errs <- err
+			case <-ctx.Done():
+			}
+		}()
+	case <-ctx.Done():
+	}
+	return make(chan events.Message), errs
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	f.listed <- struct{}{}
+	return nil, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	return container.InspectResponse{}, errors.New("no such container")
+}
+
+func (f *fakeDocker) Close() error { return nil }
+
+func TestDockerWatcherReconnects(t *testing.T) {
+	fake := &fakeDocker{streams: make(chan chan error, 2), listed: make(chan struct{}, 2)}
+	first, second := make(chan error), make(chan error)
+	fake.streams <- first
+	fake.streams <- second
+
+	w := NewDockerWatcher(nil, Config{RetryDelay: 10 * time.Millisecond, MaxRetryDelay: 10 * time.Millisecond, StableAfter: time.Minute})
+	w.newClient = func() (dockerClient, error) { return fake, nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitListed := func() {
+		t.Helper()
+		select {
+		case <-fake.listed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the watcher to reconcile running containers")
+		}
+	}
+	waitListed()
+	if st := w.Status(); !st.Enabled || !st.Connected {
+		t.Fatalf("Expected a connected watcher, got %+v", st)
+	}
+
+	first <- errors.New("unexpected EOF")
+	waitListed()
+	if n := fake.subscribed.Load(); n != 2 {
+		t.Errorf("Expected the watcher to resubscribe once, got %d subscriptions", n)
+	}
+	if st := w.Status(); !st.Connected || st.LastError != "unexpected EOF" || st.LastErrorAt.IsZero() {
+		t.Errorf("Expected a reconnected watcher remembering the stream error, got %+v", st)
+	}
+}
+
+func TestApplyContainerMatchesServiceMap(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	res, err := db.Exec("INSERT INTO services (name, hostname, ip, port) VALUES ('Web', 'web:80', ?, 80)", utils.IpToUint32("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("Failed to create test service: %v", err)
+	}
+	svcID, _ := res.LastInsertId()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	applyContainer(svcRepo, "web", container.InspectResponse{
+		NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: "172.17.0.250"},
+		}},
+	})
+
+	// Agents report the destination of a session as a uint32; the watcher's address must map back
+	// to the same service key.
+	serviceMap, err := svcRepo.GetServiceMap()
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %v", err)
+	}
+	dst := uint32(172)<<24 | 17<<16 | 0<<8 | 250
+	key := repository.ServiceKey{Agent: proto.PrimaryAgent, Addr: fmt.Sprintf("%s:%d", utils.Uint32ToIp(dst), 80)}
+	if id, ok := serviceMap[key]; !ok || id != int(svcID) {
+		t.Errorf("Expected %v to map to service %d, got %v", key, svcID, serviceMap)
+	}
+}
+
+func TestServiceIndexFollowsServiceChanges(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+
+	if _, _, _, _, _, err := findServiceByHost([]string{"web"}); err == nil {
+		t.Fatal("Expected no service before one is created")
+	}
+	id, err := svcRepo.Create("Web", "web:80", models.DestinationHost, utils.IpToUint32("10.0.0.2"), 80, 0, "", proto.PrimaryAgent, false)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if got, _, _, _, _, err := findServiceByHost([]string{"web"}); err != nil || got != int(id) {
+		t.Fatalf("Expected the new service %d, got %d, %v", id, got, err)
+	}
+
+	if _, err := svcRepo.Update(int(id), "Web", "web-v2:8080", models.DestinationHost, utils.IpToUint32("10.0.0.2"), 8080, 0, "", proto.PrimaryAgent, false); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, _, _, _, _, err := findServiceByHost([]string{"web"}); err == nil {
+		t.Error("Expected the old hostname to be dropped after an update")
+	}
+	if got, host, _, _, port, err := findServiceByHost([]string{"web", "web-v2"}); err != nil || got != int(id) || host != "web-v2" || port != "8080" {
+		t.Errorf("Expected service %d under web-v2:8080, got %d under %s:%s, %v", id, got, host, port, err)
+	}
+}
+
+// scanServiceByHost is the per-event table scan the hostname index replaced, kept for comparison.
+func scanServiceByHost(host string) (int, error) {
+	rows, err := repository.DB.Query("SELECT id, hostname, ip, port FROM services WHERE hostname LIKE ?", host+":%")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var id int
+		var hostname string
+		var ip uint32
+		var port uint16
+		if err := rows.Scan(&id, &hostname, &ip, &port); err != nil {
+			return 0, err
+		}
+		if h, _, err := net.SplitHostPort(hostname); err == nil && h == host {
+			return id, nil
+		}
+	}
+	return 0, errors.New("not found")
+}
+
+func BenchmarkFindService(b *testing.B) {
+	db, err := repository.SetupTestStmt(b.TempDir())
+	if err != nil {
+		b.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range 5000 {
+		host := fmt.Sprintf("svc-%d:80", i)
+		if _, err := tx.Exec("INSERT INTO services (name, hostname, ip, port) VALUES (?, ?, ?, 80)", host, host, uint32(0x0A000000+i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := scanServiceByHost("svc-4999"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for b.Loop() {
+			if _, _, _, _, _, err := findServiceByHost([]string{"svc-4999"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestApplyContainerLogsLookupErrors(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	json := container.InspectResponse{
+		NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: "172.17.0.9"},
+		}},
+	}
+
+	applyContainer(svcRepo, "unrelated", json)
+	if logs.Len() != 0 {
+		t.Errorf("Expected a container without a service to be ignored silently, got %q", logs.String())
+	}
+
+	// The next lookup reloads the hostname index from a database that is gone.
+	before := lookupErrors.Load()
+	_ = db.Close()
+	services.mu.Lock()
+	services.hosts = nil
+	services.mu.Unlock()
+	applyContainer(svcRepo, "unrelated", json)
+	if !strings.Contains(logs.String(), "failed to look up the service of container unrelated") {
+		t.Errorf("Expected the database error to be logged, got %q", logs.String())
+	}
+	if lookupErrors.Load() != before+1 {
+		t.Errorf("Expected the lookup error to be counted")
+	}
+}
+
+func TestApplyContainerHonorsBinding(t *testing.T) {
+	db, err := repository.SetupTestStmt(t.TempDir())
+	if err != nil {
+		t.Fatalf("SetupTestStmt failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	svcRepo, err := repository.NewServiceRepository(db)
+	if err != nil {
+		t.Fatalf("Failed to create service repo: %v", err)
+	}
+	web, err := svcRepo.Create("Web", "web:80", models.DestinationHost, utils.IpToUint32("10.0.0.2"), 80, 0, "", proto.PrimaryAgent, false)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	pg, err := svcRepo.Create("Postgres", "db.internal:5432", models.DestinationHost, utils.IpToUint32("10.0.0.3"), 5432, 0, "", proto.PrimaryAgent, false)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	addr := func(id int64) string {
+		t.Helper()
+		var ip uint32
+		if err := db.QueryRow("SELECT ip FROM services WHERE id = ?", id).Scan(&ip); err != nil {
+			t.Fatalf("Failed to read service: %v", err)
+		}
+		return utils.Uint32ToIp(ip)
+	}
+	start := func(id, name, ip string) {
+		applyContainer(svcRepo, name, container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{ID: id, Name: "/" + name},
+			Config:            &container.Config{Labels: map[string]string{HostnameLabel: "web"}},
+			NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+				"bridge": {IPAddress: ip},
+			}},
+		})
+	}
+	bind := func(ref string) {
+		t.Helper()
+		if _, err := svcRepo.SetContainer(int(pg), ref); err != nil {
+			t.Fatalf("SetContainer failed: %v", err)
+		}
+	}
+	const id = "4f9d2c81a7e0b3d6c5f8e9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0"
+
+	// Bound by short ID: the binding wins over the label naming another service.
+	bind(id[:12])
+	start(id, "pg-7", "172.17.0.5")
+	if got := addr(pg); got != "172.17.0.5" {
+		t.Errorf("Expected the bound service to move to 172.17.0.5, got %s", got)
+	}
+	if got := addr(web); got != "10.0.0.2" {
+		t.Errorf("Expected the labeled service to be left alone, got %s", got)
+	}
+
+	// Bound by name, so a recreated container with a new ID still matches.
+	bind("pg-7")
+	start("91ab", "pg-7", "172.17.0.6")
+	if got := addr(pg); got != "172.17.0.6" {
+		t.Errorf("Expected the service bound by name to move to 172.17.0.6, got %s", got)
+	}
+
+	// Unbound, the label applies again.
+	bind("")
+	start("91ab", "pg-7", "172.17.0.7")
+	if got, want := addr(web)+" "+addr(pg), "172.17.0.7 172.17.0.6"; got != want {
+		t.Errorf("Expected only the labeled service to move, got %s", got)
+	}
+}
@@ -4,26 +4,88 @@ import (
 	"Aegis/controller/config"
 	grpcPkg "Aegis/controller/internal/grpc"
 	"Aegis/controller/internal/handler"
+	"Aegis/controller/internal/metrics"
 	"Aegis/controller/internal/middleware"
 	"Aegis/controller/internal/oidc"
 	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/router"
 	"Aegis/controller/internal/service"
+	"Aegis/controller/internal/tracing"
+	"Aegis/controller/internal/utils"
 	"Aegis/controller/internal/watcher"
 	"Aegis/controller/proto"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/connectivity"
 )
 
+// shutdownTimeout bounds how long in-flight HTTP requests may run after a shutdown signal.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	bootstrap := flag.Bool("bootstrap", false, "create the database if needed and set up a root user, then exit")
+	bootstrapUser := flag.String("username", defaultRootUsername, "root username to create or reset in --bootstrap mode")
+	bootstrapPassword := flag.String("password", "", "root password for --bootstrap mode (prompted for if empty)")
+	force := flag.Bool("force", false, "allow --bootstrap to reset credentials when a root user already exists")
+	check := flag.Bool("check", false, "validate config, certificates, database, agent and keys, then exit")
+	genSecret := flag.Bool("gen-jwt-secret", false, "print a random value for auth.jwt_secret, then exit")
+	flag.Parse()
+
+	if *genSecret {
+		secret, err := config.GenerateJWTSecret()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		fmt.Println(secret)
+		return
+	}
+
+	if *check {
+		cfg, err := config.Read(config.DefaultConfigPath)
+		os.Exit(runCheck(cfg, err, os.Stdout))
+	}
+
 	cfg := config.Load()
+	if err := utils.SetUsernamePattern(cfg.UsernamePattern); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	utils.SetLowercaseUsernames(cfg.LowercaseUsernames)
+
+	if *bootstrap {
+		opts := bootstrapOptions{Username: *bootstrapUser, Password: *bootstrapPassword, Force: *force}
+		if err := runBootstrap(cfg.DBDir, opts, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("[ERROR] [bootstrap] %v", err)
+		}
+		return
+	}
 
+	log.Printf("[INFO] Effective configuration: %+v", *cfg.Redacted())
+
+	repository.SetPragmas(repository.Pragmas{
+		BusyTimeout: cfg.DBBusyTimeout,
+		Synchronous: cfg.DBSynchronous,
+		CacheSize:   cfg.DBCacheSize,
+	})
 	db := repository.InitDB(cfg.DBDir, cfg.MaxOpenConns, cfg.MaxIdleConns, cfg.ConnMaxLifetime)
 	defer func() {
 		if err := db.Close(); err != nil {
@@ -31,6 +93,25 @@ func main() {
 		}
 	}()
 
+	build := buildInfo(db)
+	log.Printf("[INFO] Aegis controller %s (commit %s, built %s), database schema version %s", build.Version, build.Commit, build.BuildDate, build.SchemaVersion)
+
+	utils.ConfigureResolver(cfg.Nameservers(), cfg.DNSTimeout)
+	utils.SetSourceIPHeader(cfg.SourceIPHeader)
+	if cfg.SourceIPHeader != "" {
+		log.Printf("[INFO] Enforcing sessions for the source IP in the %s header", cfg.SourceIPHeader)
+	}
+	sourceIPAllowlist, err := utils.ParseSourceIPAllowlist(cfg.SourceIPAllowlist)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if len(cfg.DNSNameservers) > 0 {
+		log.Printf("[INFO] Resolving service hostnames with nameservers %v", cfg.Nameservers())
+	}
+
+	repository.SetSlowQueryThreshold(cfg.SlowQueryThreshold)
+	repository.SetIPAuthority(repository.IPAuthority{Preferred: cfg.DNSIPAuthority, Hold: cfg.DNSAuthorityHold})
+
 	userRepo, err := repository.NewUserRepository(db)
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to create user repository: %v", err)
@@ -39,41 +120,94 @@ func main() {
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to create role repository: %v", err)
 	}
+	if err := requireRootUser(userRepo, roleRepo); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if _, err := roleRepo.GetIDByName(cfg.DefaultUserRole); err != nil {
+		log.Fatalf("[ERROR] auth.default_user_role %q does not name an existing role: %v", cfg.DefaultUserRole, err)
+	}
+	var defaultServiceRoleID int
+	if cfg.DefaultServiceRole != "" {
+		if defaultServiceRoleID, err = roleRepo.GetIDByName(cfg.DefaultServiceRole); err != nil {
+			log.Fatalf("[ERROR] auth.default_service_role %q does not name an existing role: %v", cfg.DefaultServiceRole, err)
+		}
+	}
 	svcRepo, err := repository.NewServiceRepository(db)
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to create service repository: %v", err)
 	}
+	policyRepo, err := repository.NewPolicyRepository(db)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to create policy repository: %v", err)
+	}
+	integrityRepo, err := repository.NewIntegrityRepository(db)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to create integrity repository: %v", err)
+	}
+	tokenRepo, err := repository.NewTokenRepository(db)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to create token repository: %v", err)
+	}
 
-	privateKey, publicKey, err := loadRSAKeys(cfg.JwtPrivateKey, cfg.JwtPublicKey)
+	privateKey, publicKeys, err := loadSigningKeys(cfg)
 	if err != nil {
-		log.Printf("[WARN] Failed to load RSA keys: %v. RS256 signing will not be available.", err)
-		privateKey = nil
-		publicKey = nil
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if privateKey != nil {
+		log.Printf("[INFO] Signing tokens with %s (key ID %s), verifying with %d keys", cfg.JwtAlgorithm, utils.KeyID(privateKey.Public()), len(publicKeys))
 	} else {
-		log.Printf("[INFO] RSA keys loaded successfully for JWT RS256 signing")
+		log.Printf("[WARN] Signing tokens with HS256 using auth.jwt_secret. Anyone who learns the secret can forge tokens; configure %s keys and auth.require_rs256 for production deployments.", cfg.JwtAlgorithm)
 	}
 
 	authCfg := service.AuthConfig{
 		JWTKey:        []byte(cfg.JwtKey),
 		PrivateKey:    privateKey,
-		PublicKey:     publicKey,
+		PublicKeys:    publicKeys,
 		TokenLifetime: cfg.JwtTokenLifetime,
 	}
 
 	authSvc := service.NewAuthService(userRepo, authCfg)
-	userSvc := service.NewUserService(userRepo)
+	userSvc := service.NewUserService(userRepo, roleRepo, cfg.DefaultUserRole)
 	roleSvc := service.NewRoleService(roleRepo)
-	svcSvc := service.NewServiceService(svcRepo)
+	svcSvc := service.NewServiceService(svcRepo, service.ActivationConfig{
+		CallTimeout:       cfg.AgentSessionTimeout,
+		Queue:             cfg.AgentOnUnreachable == config.OnUnreachableQueue,
+		TTL:               cfg.ActivationTTL,
+		StepUpMaxAge:      cfg.StepUpMaxAge,
+		MaxActiveSessions: cfg.MaxActiveSessions,
+		RejectOverLimit:   cfg.RejectOverLimit,
+		SourceIPAllowlist: sourceIPAllowlist,
+		DefaultRoleID:     defaultServiceRoleID,
+	})
+	policySvc := service.NewPolicyService(policyRepo)
+	tokenSvc := service.NewTokenService(tokenRepo, userRepo)
+	integritySvc := service.NewIntegrityService(svcRepo, integrityRepo)
 
 	authHandler := handler.NewAuthHandler(authSvc)
-	userHandler := handler.NewUserHandler(userSvc)
+	userHandler := handler.NewUserHandler(userSvc, svcSvc)
 	roleHandler := handler.NewRoleHandler(roleSvc)
 	serviceHandler := handler.NewServiceHandler(svcSvc, userRepo)
+	policyHandler := handler.NewPolicyHandler(policySvc)
+	tokenHandler := handler.NewTokenHandler(tokenSvc)
+	integrityHandler := handler.NewIntegrityHandler(integritySvc)
+	grpcMgr := grpcPkg.NewSessionManager(svcRepo, userRepo)
+	dockerWatcher := watcher.NewDockerWatcher(svcRepo, watcher.Config{
+		RetryDelay:    cfg.MonitorRetryDelay,
+		MaxRetryDelay: cfg.MonitorMaxRetryDelay,
+		StableAfter:   cfg.MonitorStableAfter,
+	})
+	healthHandler := handler.NewHealthHandler(db, proto.ConnState, proto.ActiveEndpoint, func() time.Time {
+		return grpcMgr.LastSync(proto.PrimaryAgent)
+	}, primaryAgentCalls, func() handler.DockerStatus {
+		return handler.DockerStatus(dockerWatcher.Status())
+	})
+	sessionHandler := handler.NewSessionHandler(grpcMgr.Snapshots, svcSvc)
 
 	var oidcHandler *handler.OIDCHandler
+	var oidcMgr *oidc.OIDCManager
 	if cfg.OIDCEnabled {
 		ctx := context.Background()
-		oidcMgr, err := oidc.NewOIDCManager(
+		mgr, err := oidc.NewOIDCManager(
 			ctx,
 			cfg.OIDCGoogleClientID,
 			cfg.OIDCGoogleSecret,
@@ -81,28 +215,91 @@ func main() {
 			cfg.OIDCGitHubSecret,
 			cfg.OIDCRedirectURL,
 			cfg.OIDCRoleMappingRules,
+			oidc.Options{
+				GoogleScopes:   cfg.OIDCGoogleScopes,
+				GitHubScopes:   cfg.OIDCGitHubScopes,
+				OfflineAccess:  cfg.OIDCOfflineAccess,
+				GitHubGroups:   cfg.OIDCGitHubGroups,
+				GoogleDisabled: !cfg.OIDCGoogleEnabled,
+				GitHubDisabled: !cfg.OIDCGitHubEnabled,
+				TokenKey:       cfg.OIDCTokenKey,
+			},
 		)
 		if err != nil {
 			log.Printf("[ERROR] Failed to initialize OIDC manager: %v", err)
 		} else {
 			log.Printf("[INFO] OIDC manager initialized successfully")
+			oidcMgr = mgr
 			oidcHandler = handler.NewOIDCHandler(oidcMgr, authSvc, userRepo, roleRepo)
 		}
 	}
 
-	authMW := middleware.JWTAuth([]byte(cfg.JwtKey), publicKey)
-	rootOnly := middleware.RequireRole(userRepo, "root")
-	adminOrRoot := middleware.RequireRole(userRepo, "admin", "root")
+	configHandler := handler.NewConfigHandler(cfg, func() handler.FeatureFlags {
+		state, initialized := proto.ConnState()
+		return handler.FeatureFlags{
+			OIDCEnabled:          oidcHandler != nil,
+			RS256Enabled:         privateKey != nil && cfg.JwtAlgorithm == config.JWTAlgorithmRS256,
+			ES256Enabled:         privateKey != nil && cfg.JwtAlgorithm == config.JWTAlgorithmES256,
+			DockerWatcherRunning: dockerWatcher.Status().Connected,
+			AgentConnected:       initialized && state == connectivity.Ready,
+		}
+	})
+
+	var shutdownTracing func(context.Context) error
+	if cfg.TracingEnabled {
+		shutdownTracing, err = tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:    cfg.TracingEndpoint,
+			Insecure:    cfg.TracingInsecure,
+			SampleRatio: cfg.TracingSampleRatio,
+		})
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to set up tracing: %v", err)
+		}
+		log.Printf("[INFO] Tracing enabled, exporting to %s", cfg.TracingEndpoint)
+	}
+
+	var metricsHandler gin.HandlerFunc
+	if cfg.MetricsEnabled {
+		metrics.Register("database", repository.StatsCollector(db))
+		metrics.Register("sessions", service.SessionLimitCollector(svcRepo, cfg.MaxActiveSessions))
+		metrics.Register("agent", proto.CallStatsCollector())
+		metrics.Register("docker", watcher.Collector())
+		metricsHandler = metrics.Handler()
+	}
+
+	disabledStatus := http.StatusUnauthorized
+	if cfg.DisabledUserResponse == config.DisabledUserForbidden {
+		disabledStatus = http.StatusForbidden
+	}
+	authMW := middleware.JWTAuth([]byte(cfg.JwtKey), publicKeys, tokenSvc.Authenticate, &middleware.AccountCheck{
+		Lookup:         userRepo.GetAuthState,
+		TTL:            cfg.ActiveCheckTTL,
+		DisabledStatus: disabledStatus,
+	})
 
 	r := router.NewRouter(router.RouterConfig{
-		AuthHandler:    authHandler,
-		UserHandler:    userHandler,
-		RoleHandler:    roleHandler,
-		ServiceHandler: serviceHandler,
-		OIDCHandler:    oidcHandler,
-		AuthMiddleware: authMW,
-		RootOnly:       rootOnly,
-		AdminOrRoot:    adminOrRoot,
+		AuthHandler:      authHandler,
+		UserHandler:      userHandler,
+		RoleHandler:      roleHandler,
+		ServiceHandler:   serviceHandler,
+		OIDCHandler:      oidcHandler,
+		HealthHandler:    healthHandler,
+		SessionHandler:   sessionHandler,
+		PolicyHandler:    policyHandler,
+		TokenHandler:     tokenHandler,
+		IntegrityHandler: integrityHandler,
+		ConfigHandler:    configHandler,
+		VersionHandler:   handler.NewVersionHandler(build),
+		MetricsHandler:   metricsHandler,
+		AuthMiddleware:   authMW,
+		StaticDir:        cfg.StaticDir,
+		Tracing:          cfg.TracingEnabled,
+		RequireCapability: func(caps ...string) gin.HandlerFunc {
+			return middleware.RequireCapability(userRepo, caps...)
+		},
+
+		StaticCompression:  cfg.StaticCompression,
+		StaticCacheHeaders: cfg.StaticCacheHeaders,
 	})
 
 	err = proto.Init(cfg.AgentAddress, cfg.AgentCertFile, cfg.AgentKeyFile, cfg.AgentCAFile, cfg.AgentServerName)
@@ -110,23 +307,210 @@ func main() {
 		log.Printf("[ERROR] Error starting grpc client: %v", err)
 		return
 	}
+	for name, addr := range cfg.Agents {
+		if err := proto.InitAgent(name, addr, cfg.AgentCertFile, cfg.AgentKeyFile, cfg.AgentCAFile, cfg.AgentServerName); err != nil {
+			log.Printf("[ERROR] Error starting grpc client for agent %s: %v", name, err)
+			return
+		}
+	}
 
-	grpcMgr := grpcPkg.NewSessionManager(svcRepo, userRepo)
-	go grpcMgr.Start(grpcPkg.SessionConfig{IpUpdateInterval: cfg.IpUpdateInterval})
+	ln, err := listen(cfg)
+	if err != nil {
+		log.Printf("[ERROR] Error starting server: %v", err)
+		return
+	}
 
-	go watcher.StartDockerWatcher()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	var wg sync.WaitGroup
+	grpcMgr.Start(ctx, &wg, grpcPkg.SessionConfig{
+		IpUpdateInterval: cfg.IpUpdateInterval,
+		IpUpdateTimeout:  cfg.AgentIpUpdateTimeout,
+		ResolveWorkers:   cfg.ResolveWorkers,
+		RetryDelay:       cfg.MonitorRetryDelay,
+		MaxRetryDelay:    cfg.MonitorMaxRetryDelay,
+		StableAfter:      cfg.MonitorStableAfter,
+		StallTimeout:     cfg.MonitorStallTimeout,
+	})
+
+	if cfg.AgentOnUnreachable == config.OnUnreachableQueue {
+		wg.Go(func() { service.RetryActivations(ctx, svcSvc, cfg.ActivationRetryInterval) })
+	}
+
+	wg.Go(func() { repository.MonitorPoolWait(ctx, cfg.PoolWaitThreshold) })
+	wg.Go(func() { dockerWatcher.Run(ctx) })
+	if oidcHandler != nil {
+		wg.Go(func() { oidcHandler.PruneStates(ctx, time.Minute) })
+		wg.Go(func() { reloadOnHangup(ctx, oidcMgr) })
+	}
+
+	srv, err := newServer(cfg, r)
+	if err != nil {
+		log.Fatalf("[ERROR] Error configuring server: %v", err)
+	}
 	go func() {
-		log.Printf("[INFO] Server initializing on port %s...", cfg.ServerPort)
-		if err := r.RunTLS(cfg.ServerPort, cfg.CertFile, cfg.KeyFile); err != nil {
+		log.Printf("[INFO] Server listening on %s...", ln.Addr())
+		if err := srv.ServeTLS(ln, cfg.CertFile, cfg.KeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Println("[INFO] Interrupt signal received. Shutting down server...")
+	<-ctx.Done()
+	stop()
+	log.Println("[INFO] Shutdown signal received. Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[ERROR] Error shutting down server: %v", err)
+	}
+	wg.Wait()
+	log.Println("[INFO] Background tasks stopped")
+	if shutdownTracing != nil {
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Printf("[ERROR] Failed to flush traces: %v", err)
+		}
+	}
+}
+
+// reloadOnHangup re-reads the config file on every SIGHUP until ctx is done and applies its OIDC
+// role mapping rules, so mapping changes take effect without a restart. Other settings still need
+// one.
+func reloadOnHangup(ctx context.Context, oidcMgr *oidc.OIDCManager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := config.Read(config.DefaultConfigPath)
+		if err != nil {
+			log.Printf("[ERROR] [reload] %v", err)
+			continue
+		}
+		if err := oidcMgr.ReloadRoleMapping(cfg.OIDCRoleMappingRules); err != nil {
+			log.Printf("[ERROR] [reload] Keeping the current OIDC role mapping rules: %v", err)
+			continue
+		}
+		log.Printf("[INFO] [reload] OIDC role mapping rules reloaded")
+	}
+}
+
+// listen binds the HTTPS listener to cfg.ServerAddr, so an unusable address fails startup right away.
+func listen(cfg *config.Config) (net.Listener, error) {
+	addr, err := cfg.ServerAddr()
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// primaryAgentCalls summarizes the calls made to the primary agent for the readiness probe.
+func primaryAgentCalls() []handler.AgentCall {
+	stats := proto.AgentCallStats(proto.PrimaryAgent)
+	calls := make([]handler.AgentCall, 0, len(stats))
+	for _, st := range stats {
+		call := handler.AgentCall{Method: st.Method, Calls: st.Count, Errors: st.Errors, LastError: st.LastError}
+		if st.Count > 0 {
+			call.AvgLatencyMs = float64(st.TotalDuration.Microseconds()) / float64(st.Count) / 1000
+		}
+		if !st.LastErrorAt.IsZero() {
+			age := int64(time.Since(st.LastErrorAt) / time.Second)
+			call.LastErrorAgeSeconds = &age
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// newServer returns the HTTPS server for handler with the TLS settings and timeouts of the [server] section.
+func newServer(cfg *config.Config, handler http.Handler) (*http.Server, error) {
+	tlsCfg, err := cfg.ServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Handler:           withHandlerTimeout(handler, cfg.HandlerTimeout),
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}, nil
+}
+
+// handlerTimeoutBody is the response to requests cut off by server.handler_timeout.
+const handlerTimeoutBody = `{"error": "Request timed out"}`
+
+// isStreamRequest reports whether r asks for a long-lived response: server-sent events or a
+// protocol upgrade.
+func isStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream") || r.Header.Get("Upgrade") != ""
+}
+
+// withHandlerTimeout answers requests still running after d with 503 and cancels their context. Stream
+// requests are exempt and have the server's read and write deadlines lifted. Zero d disables the timeout.
+func withHandlerTimeout(handler http.Handler, d time.Duration) http.Handler {
+	if d <= 0 {
+		return handler
+	}
+	timed := http.TimeoutHandler(handler, d, handlerTimeoutBody)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreamRequest(r) {
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(time.Time{})
+			_ = rc.SetWriteDeadline(time.Time{})
+			handler.ServeHTTP(w, r)
+			return
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
+
+// loadSigningKeys loads the auth.jwt_algorithm signing key and the keys tokens are verified with. It
+// returns no keys when the key pair cannot be loaded, so tokens are signed with HS256, unless
+// auth.require_rs256 is set.
+func loadSigningKeys(cfg *config.Config) (crypto.Signer, utils.KeySet, error) {
+	privateKey, publicKey, err := loadKeyPair(cfg)
+	if err != nil {
+		if cfg.JwtRequireRS256 {
+			return nil, nil, fmt.Errorf("auth.require_rs256 is set but the %s keys failed to load: %w", cfg.JwtAlgorithm, err)
+		}
+		log.Printf("[WARN] Failed to load %s keys: %v. %s signing will not be available.", cfg.JwtAlgorithm, err, cfg.JwtAlgorithm)
+		return nil, nil, nil
+	}
+	if !keysMatch(privateKey, publicKey) {
+		return nil, nil, errors.New("auth.jwt_public_key does not match auth.jwt_private_key")
+	}
+	publicKeys := utils.NewKeySet(publicKey)
+	if cfg.JwtPublicKeysDir != "" {
+		extra, err := loadPublicKeys(cfg.JwtPublicKeysDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load verification keys from %s: %w", cfg.JwtPublicKeysDir, err)
+		}
+		for _, key := range extra {
+			publicKeys[utils.KeyID(key)] = key
+		}
+	}
+	return privateKey, publicKeys, nil
+}
+
+// loadKeyPair loads the key pair of auth.jwt_algorithm.
+func loadKeyPair(cfg *config.Config) (crypto.Signer, crypto.PublicKey, error) {
+	if cfg.JwtAlgorithm == config.JWTAlgorithmES256 {
+		return loadECKeys(cfg.JwtPrivateKey, cfg.JwtPublicKey)
+	}
+	return loadRSAKeys(cfg.JwtPrivateKey, cfg.JwtPublicKey)
+}
+
+// keysMatch reports whether publicKey belongs to privateKey.
+func keysMatch(privateKey crypto.Signer, publicKey crypto.PublicKey) bool {
+	key, ok := publicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(privateKey.Public())
 }
 
 func loadRSAKeys(privateKeyPath, publicKeyPath string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
@@ -150,20 +534,98 @@ func loadRSAKeys(privateKeyPath, publicKeyPath string) (*rsa.PrivateKey, *rsa.Pu
 		return nil, nil, fmt.Errorf("failed to read public key: %w", err)
 	}
 
-	block, _ = pem.Decode(publicKeyPEM)
+	key, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("not an RSA public key")
+	}
+
+	return privateKey, publicKey, nil
+}
+
+// loadECKeys loads a P-256 key pair for ES256: a SEC 1 ("EC PRIVATE KEY") private key and a PKIX
+// public key, as written by "openssl ecparam -name prime256v1 -genkey" and "openssl ec -pubout".
+func loadECKeys(privateKeyPath, publicKeyPath string) (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
+	privateKeyPEM, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	block, _ := pem.Decode(privateKeyPEM)
 	if block == nil {
-		return nil, nil, fmt.Errorf("failed to decode PEM block containing public key")
+		return nil, nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
 
-	publicKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse public key: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	if privateKey.Curve != elliptic.P256() {
+		return nil, nil, fmt.Errorf("ES256 needs a P-256 key, got %s", privateKey.Curve.Params().Name)
+	}
+
+	publicKeyPEM, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read public key: %w", err)
 	}
 
-	publicKey, ok := publicKeyInterface.(*rsa.PublicKey)
+	key, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
 	if !ok {
-		return nil, nil, fmt.Errorf("not an RSA public key")
+		return nil, nil, fmt.Errorf("not an EC public key")
 	}
 
 	return privateKey, publicKey, nil
 }
+
+// parsePublicKey parses a PKIX public key usable for token verification: RSA, or EC on P-256.
+func parsePublicKey(publicKeyPEM []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing public key")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 needs a P-256 key, got %s", key.Curve.Params().Name)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("not an RSA or EC public key")
+}
+
+// loadPublicKeys loads every *.pem file in dir as a public key that tokens are verified with, for
+// keys that no longer sign or do not sign yet during a rotation.
+func loadPublicKeys(dir string) ([]crypto.PublicKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		publicKeyPEM, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		key, err := parsePublicKey(publicKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -1,37 +1,31 @@
 package main
 
 import (
+	"Aegis/controller/config"
+	"Aegis/controller/internal/handler"
+	"Aegis/controller/internal/repository"
 	"Aegis/controller/internal/utils"
+	"crypto/ecdsa"
+	"crypto/tls"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/gin-gonic/gin"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := repository.SetupTestStmt(t.TempDir())
 	if err != nil {
 		t.Fatalf("failed to create test database: %v", err)
 	}
-
-	// Create schema
-	schema := `
-		CREATE TABLE services (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			hostname TEXT NOT NULL,
-			ip INTEGER NOT NULL,
-			port INTEGER NOT NULL,
-			description TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-	`
-	if _, err := db.Exec(schema); err != nil {
-		t.Fatalf("failed to create schema: %v", err)
-	}
-
 	return db
 }
 
@@ -241,3 +235,226 @@ func TestHostnameToParts(t *testing.T) {
 		})
 	}
 }
+
+func TestListenBindsConfiguredAddress(t *testing.T) {
+	ln, err := listen(&config.Config{ServerPort: ":0", ListenAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected the listener on 127.0.0.1, got %s", addr)
+	}
+
+	if _, err := listen(&config.Config{ServerPort: ":0", ListenAddr: "not an ip"}); err == nil {
+		t.Error("Expected an invalid listen address to be rejected")
+	}
+}
+
+func TestServerEnforcesTLSMinVersion(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "server", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cfg := &config.Config{ServerPort: ":0", ListenAddr: "127.0.0.1", TLSMinVersion: "1.3"}
+
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	srv, err := newServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	go func() { _ = srv.ServeTLS(ln, certFile, keyFile) }()
+	defer func() { _ = srv.Close() }()
+
+	dial := func(maxVersion uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+	}
+
+	if conn, err := dial(tls.VersionTLS12); err == nil {
+		_ = conn.Close()
+		t.Error("Expected a TLS 1.2 handshake to be refused with tls_min_version 1.3")
+	}
+
+	conn, err := dial(tls.VersionTLS13)
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if state := conn.ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "h2" {
+		t.Errorf("Expected TLS 1.3 with h2, got version %x protocol %q", state.Version, state.NegotiatedProtocol)
+	}
+}
+
+func TestServerCutsOffSlowRequests(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "server", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cfg := &config.Config{
+		ServerPort:        ":0",
+		ListenAddr:        "127.0.0.1",
+		TLSMinVersion:     "1.2",
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		WriteTimeout:      time.Second,
+		HandlerTimeout:    100 * time.Millisecond,
+	}
+
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	srv, err := newServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+			_, _ = w.Write([]byte("done"))
+		}
+	}))
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	go func() { _ = srv.ServeTLS(ln, certFile, keyFile) }()
+	defer func() { _ = srv.Close() }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	url := "https://" + ln.Addr().String() + "/slow"
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a slow handler to be cut off with %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("stream request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a stream request to be exempt from the handler timeout, got %d", resp.StatusCode)
+	}
+
+	// A client that never finishes its headers is disconnected after read_header_timeout.
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: aegis\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	buf := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("Expected the server to close a connection with incomplete headers")
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the connection to be closed after about 100ms, took %v", elapsed)
+	}
+}
+
+func TestLoadSigningKeysFailsClosed(t *testing.T) {
+	privPath, pubPath := writeRSAKeys(t, t.TempDir())
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name        string
+		privateKey  string
+		required    bool
+		wantErr     bool
+		wantSigning bool
+	}{
+		{"Keys loaded", privPath, true, false, true},
+		{"Missing keys fall back to HS256", missing, false, false, false},
+		{"Missing keys with RS256 required", missing, true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{JwtAlgorithm: config.JWTAlgorithmRS256, JwtPrivateKey: tt.privateKey, JwtPublicKey: pubPath, JwtRequireRS256: tt.required}
+			privateKey, publicKeys, err := loadSigningKeys(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if (privateKey != nil) != tt.wantSigning || (len(publicKeys) > 0) != tt.wantSigning {
+				t.Errorf("Expected RS256 signing %v, got private key %v and %d public keys", tt.wantSigning, privateKey != nil, len(publicKeys))
+			}
+		})
+	}
+}
+
+func TestLoadSigningKeysES256(t *testing.T) {
+	dir := t.TempDir()
+	privPath, pubPath := writeECKeys(t, dir)
+	// The previous RSA key stays published while tokens it signed expire.
+	_, rsaPubPath := writeRSAKeys(t, t.TempDir())
+	keysDir := filepath.Join(dir, "verify")
+	if err := os.Mkdir(keysDir, 0700); err != nil {
+		t.Fatalf("failed to create key directory: %v", err)
+	}
+	rsaPub, err := os.ReadFile(rsaPubPath)
+	if err != nil {
+		t.Fatalf("failed to read public key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, "previous.pem"), rsaPub, 0600); err != nil {
+		t.Fatalf("failed to write public key: %v", err)
+	}
+
+	cfg := &config.Config{JwtAlgorithm: config.JWTAlgorithmES256, JwtPrivateKey: privPath, JwtPublicKey: pubPath, JwtPublicKeysDir: keysDir}
+	privateKey, publicKeys, err := loadSigningKeys(cfg)
+	if err != nil {
+		t.Fatalf("loadSigningKeys failed: %v", err)
+	}
+	if _, ok := privateKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("Expected an ECDSA signing key, got %T", privateKey)
+	}
+	if len(publicKeys) != 2 {
+		t.Errorf("Expected the EC key and the previous RSA key, got %d keys", len(publicKeys))
+	}
+
+	// RSA keys are not accepted for ES256.
+	cfg.JwtPrivateKey, cfg.JwtPublicKey = writeRSAKeys(t, t.TempDir())
+	cfg.JwtRequireRS256 = true
+	if _, _, err := loadSigningKeys(cfg); err == nil {
+		t.Error("Expected RSA keys to fail to load for ES256")
+	}
+}
+
+func TestVersionEndpointReportsBuildInfo(t *testing.T) {
+	// Set the variables as -ldflags "-X main.version=..." would.
+	saved := []string{version, commit, buildDate}
+	version, commit, buildDate = "1.4.0", "0a1b2c3", "2026-10-15T09:30:00Z"
+	t.Cleanup(func() { version, commit, buildDate = saved[0], saved[1], saved[2] })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/version", handler.NewVersionHandler(buildInfo(setupTestDB(t))).Get)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var got handler.BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := handler.BuildInfo{Version: "1.4.0", Commit: "0a1b2c3", BuildDate: "2026-10-15T09:30:00Z", SchemaVersion: repository.CurrentSchemaVersion}
+	if got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
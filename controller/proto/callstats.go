@@ -0,0 +1,173 @@
+package proto
+
+import (
+	"Aegis/controller/internal/metrics"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDMetadataKey is the gRPC metadata key carrying the ID of the HTTP request a call was made for.
+const RequestIDMetadataKey = "x-request-id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx whose agent calls carry id in their metadata, so agent logs can
+// be matched to controller requests.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// CallStat holds accumulated statistics for one gRPC method called on one agent.
+type CallStat struct {
+	Agent         string
+	Method        string
+	Count         uint64
+	Errors        uint64
+	TotalDuration time.Duration
+	LastError     string
+	LastErrorAt   time.Time
+}
+
+type callKey struct{ agent, method string }
+
+type callStatsRegistry struct {
+	mu    sync.Mutex
+	stats map[callKey]*CallStat
+}
+
+var callStats = &callStatsRegistry{stats: make(map[callKey]*CallStat)}
+
+func (r *callStatsRegistry) record(agent, method string, elapsed time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := callKey{agent, method}
+	st, ok := r.stats[key]
+	if !ok {
+		st = &CallStat{Agent: agent, Method: method}
+		r.stats[key] = st
+	}
+	st.Count++
+	st.TotalDuration += elapsed
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		st.LastErrorAt = time.Now()
+	}
+}
+
+// CallStats returns a snapshot of per-method call statistics for every agent, sorted by agent and
+// method.
+func CallStats() []CallStat {
+	callStats.mu.Lock()
+	defer callStats.mu.Unlock()
+	out := make([]CallStat, 0, len(callStats.stats))
+	for _, st := range callStats.stats {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Agent != out[j].Agent {
+			return out[i].Agent < out[j].Agent
+		}
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
+// AgentCallStats returns the call statistics of the named agent, sorted by method.
+func AgentCallStats(agent string) []CallStat {
+	var out []CallStat
+	for _, st := range CallStats() {
+		if st.Agent == agent {
+			out = append(out, st)
+		}
+	}
+	return out
+}
+
+// tracerName names the tracer agent call spans are started with.
+const tracerName = "Aegis/controller/proto"
+
+// metadataCarrier lets the trace context propagator write into outgoing gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Get(key string) string {
+	if v := metadata.MD(m).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (m metadataCarrier) Set(key, value string) { metadata.MD(m).Set(key, value) }
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// callInterceptor records the latency and outcome of every unary call made to agent in a client span
+// and in the call statistics. The span's trace context and the request ID set by WithRequestID are
+// forwarded in the call metadata.
+func callInterceptor(agent string) grpc.UnaryClientInterceptor {
+	tracer := otel.Tracer(tracerName)
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := tracer.Start(ctx, strings.TrimPrefix(method, "/"),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "grpc"),
+				attribute.String("rpc.method", method),
+				attribute.String("aegis.agent", agent),
+			))
+		defer span.End()
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+		md = md.Copy()
+		otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+		if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+			md.Set(RequestIDMetadataKey, id)
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		callStats.record(agent, method, time.Since(start), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, status.Code(err).String())
+		}
+		return err
+	}
+}
+
+// CallStatsCollector exposes per-agent, per-method call counts, errors and latency.
+func CallStatsCollector() metrics.Collector {
+	return func(w io.Writer) {
+		stats := CallStats()
+		counts := make([]metrics.Sample, 0, len(stats))
+		errs := make([]metrics.Sample, 0, len(stats))
+		durations := make([]metrics.Sample, 0, len(stats))
+		for _, st := range stats {
+			labels := map[string]string{"agent": st.Agent, "method": st.Method}
+			counts = append(counts, metrics.Sample{Labels: labels, Value: float64(st.Count)})
+			errs = append(errs, metrics.Sample{Labels: labels, Value: float64(st.Errors)})
+			durations = append(durations, metrics.Sample{Labels: labels, Value: st.TotalDuration.Seconds()})
+		}
+		metrics.WriteMetric(w, "aegis_agent_calls_total", "counter", "gRPC calls made to agents.", counts...)
+		metrics.WriteMetric(w, "aegis_agent_call_errors_total", "counter", "gRPC calls to agents that returned an error.", errs...)
+		metrics.WriteMetric(w, "aegis_agent_call_duration_seconds_total", "counter", "Total time spent in gRPC calls to agents.", durations...)
+	}
+}
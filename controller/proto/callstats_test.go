@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCallInterceptorRecordsCalls(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	agent := testAgent{fail: make(chan codes.Code, 1), metadata: make(chan metadata.MD, 2)}
+	// A name no other test uses, since the statistics are kept for the life of the process.
+	if err := InitAgent("stats", serveTestAgent(t, p, agent), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("InitAgent failed: %v", err)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1189")
+	if ok, err := SendSessionData(ctx, "stats", 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, 5*time.Second); err != nil || !ok {
+		t.Fatalf("SendSessionData failed: ok=%v err=%v", ok, err)
+	}
+	if ids := (<-agent.metadata).Get(RequestIDMetadataKey); len(ids) != 1 || ids[0] != "req-1189" {
+		t.Errorf("expected the request ID in the call metadata, got %v", ids)
+	}
+
+	agent.fail <- codes.InvalidArgument
+	if _, err := SendSessionData(context.Background(), "stats", 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, 5*time.Second); err == nil {
+		t.Fatal("expected the rejected call to fail")
+	}
+	if ids := (<-agent.metadata).Get(RequestIDMetadataKey); len(ids) != 0 {
+		t.Errorf("expected no request ID without WithRequestID, got %v", ids)
+	}
+
+	stats := AgentCallStats("stats")
+	if len(stats) != 1 {
+		t.Fatalf("expected statistics for one method, got %+v", stats)
+	}
+	st := stats[0]
+	if st.Method != SessionManager_SubmitSession_FullMethodName || st.Count != 2 || st.Errors != 1 {
+		t.Errorf("expected 2 SubmitSession calls with 1 error, got %+v", st)
+	}
+	if st.TotalDuration <= 0 || !strings.Contains(st.LastError, "injected failure") || st.LastErrorAt.IsZero() {
+		t.Errorf("expected a latency and the last error to be recorded, got %+v", st)
+	}
+
+	var buf bytes.Buffer
+	CallStatsCollector()(&buf)
+	want := `aegis_agent_call_errors_total{agent="stats",method="/session.SessionManager/SubmitSession"} 1`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected metrics to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestCallInterceptorPropagatesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	resetClient(t)
+	p := newTestPKI(t)
+	agent := testAgent{metadata: make(chan metadata.MD, 1)}
+	if err := Init(serveTestAgent(t, p, agent), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "POST /api/me/selected")
+	if ok, err := SendSessionData(ctx, PrimaryAgent, 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, 5*time.Second); err != nil || !ok {
+		t.Fatalf("SendSessionData failed: ok=%v err=%v", ok, err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected the agent call and request spans, got %d", len(spans))
+	}
+	call := spans[0]
+	if call.Name() != "session.SessionManager/SubmitSession" || call.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected a SubmitSession span under the request span, got %q with parent %v", call.Name(), call.Parent())
+	}
+	traceparent := (<-agent.metadata).Get("traceparent")
+	want := "00-" + call.SpanContext().TraceID().String() + "-" + call.SpanContext().SpanID().String() + "-01"
+	if len(traceparent) != 1 || traceparent[0] != want {
+		t.Errorf("expected traceparent %q in the call metadata, got %v", want, traceparent)
+	}
+}
@@ -0,0 +1,66 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// endpointScheme is the resolver scheme used when several agent endpoints are configured.
+const endpointScheme = "aegis-agents"
+
+// agentEndpoints holds the configured agent endpoints and remembers which one is in use.
+type agentEndpoints struct {
+	addrs []string
+
+	mu      sync.Mutex
+	current string
+}
+
+// parseEndpoints splits a comma-separated list of host:port agent addresses.
+func parseEndpoints(agentAddr string) (*agentEndpoints, error) {
+	eps := &agentEndpoints{}
+	for _, addr := range strings.Split(agentAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		eps.addrs = append(eps.addrs, addr)
+	}
+	if len(eps.addrs) == 0 {
+		return nil, fmt.Errorf("no agent address configured")
+	}
+	if len(eps.addrs) == 1 {
+		eps.current = eps.addrs[0]
+	}
+	return eps, nil
+}
+
+// dial opens a TCP connection to addr and records it as the active endpoint on success.
+func (e *agentEndpoints) dial(ctx context.Context, addr string) (net.Conn, error) {
+	nc, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	prev := e.current
+	e.current = addr
+	e.mu.Unlock()
+	switch {
+	case prev == "":
+		log.Printf("[INFO] [agent] connected to endpoint %s", addr)
+	case prev != addr:
+		log.Printf("[WARN] [agent] failed over from endpoint %s to %s", prev, addr)
+	}
+	return nc, nil
+}
+
+func (e *agentEndpoints) active() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current
+}
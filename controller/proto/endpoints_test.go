@@ -0,0 +1,420 @@
+package proto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testAgent struct {
+	UnimplementedSessionManagerServer
+	events    chan *LoginEvent      // receives every submitted event if set
+	deadlines chan time.Duration    // receives the time left on each call's deadline if set
+	fail      chan codes.Code       // SubmitSession fails with each queued code before succeeding
+	calls     *atomic.Int32         // counts SubmitSession calls if set
+	metadata  chan metadata.MD      // receives the metadata of each SubmitSession call if set
+	ipChanges chan *IpChangeList    // receives every IP change batch if set
+	snapshots chan *ServiceSnapshot // receives every resync snapshot if set
+}
+
+func (a testAgent) SubmitSession(ctx context.Context, e *LoginEvent) (*Ack, error) {
+	a.recordDeadline(ctx)
+	if a.calls != nil {
+		a.calls.Add(1)
+	}
+	if a.metadata != nil {
+		md, _ := metadata.FromIncomingContext(ctx)
+		a.metadata <- md
+	}
+	select {
+	case code := <-a.fail:
+		return nil, status.Error(code, "injected failure")
+	default:
+	}
+	if a.events != nil {
+		a.events <- e
+	}
+	return &Ack{Success: true}, nil
+}
+
+func (a testAgent) IpChange(ctx context.Context, list *IpChangeList) (*Ack, error) {
+	a.recordDeadline(ctx)
+	if a.ipChanges != nil {
+		a.ipChanges <- list
+	}
+	return &Ack{Success: true}, nil
+}
+
+func (a testAgent) Resync(ctx context.Context, snapshot *ServiceSnapshot) (*Ack, error) {
+	a.recordDeadline(ctx)
+	if a.snapshots != nil {
+		a.snapshots <- snapshot
+	}
+	return &Ack{Success: true}, nil
+}
+
+func (a testAgent) recordDeadline(ctx context.Context) {
+	if a.deadlines == nil {
+		return
+	}
+	var left time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		left = time.Until(deadline)
+	}
+	a.deadlines <- left
+}
+
+// testPKI holds a CA plus server and client certificates for mutual TLS.
+type testPKI struct {
+	caFile, clientCert, clientKey string
+	serverCert                    tls.Certificate
+	pool                          *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, *rsa.PrivateKey) {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("failed to issue %s: %v", cn, err)
+		}
+		return der, key
+	}
+
+	p := &testPKI{
+		caFile:     filepath.Join(dir, "ca.pem"),
+		clientCert: filepath.Join(dir, "controller.pem"),
+		clientKey:  filepath.Join(dir, "controller.key"),
+		pool:       x509.NewCertPool(),
+	}
+	p.pool.AddCert(caCert)
+	write := func(path, typ string, der []byte) {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	write(p.caFile, "CERTIFICATE", caDER)
+	clientDER, clientKey := issue(2, "aegis-controller", x509.ExtKeyUsageClientAuth)
+	write(p.clientCert, "CERTIFICATE", clientDER)
+	write(p.clientKey, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(clientKey))
+	serverDER, serverKey := issue(3, "aegis-agent", x509.ExtKeyUsageServerAuth)
+	p.serverCert = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+	return p
+}
+
+// startTestAgent serves a healthy agent on a random local port and returns its address.
+func startTestAgent(t *testing.T, p *testPKI) string {
+	t.Helper()
+	return serveTestAgent(t, p, testAgent{})
+}
+
+// serveTestAgent serves agent over mutual TLS and returns its address.
+func serveTestAgent(t *testing.T, p *testPKI, agent testAgent) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	RegisterSessionManagerServer(srv, agent)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// deadAddress returns a local address with nothing listening on it.
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+	return addr
+}
+
+// resetClient removes every agent client registered during a test.
+func resetClient(t *testing.T) {
+	t.Cleanup(func() {
+		agentsMu.Lock()
+		defer agentsMu.Unlock()
+		for name, a := range agents {
+			_ = a.conn.Close()
+			delete(agents, name)
+		}
+	})
+}
+
+func TestParseEndpoints(t *testing.T) {
+	eps, err := parseEndpoints(" 10.0.0.1:50001, ,10.0.0.2:50001 ")
+	if err != nil {
+		t.Fatalf("parseEndpoints failed: %v", err)
+	}
+	if len(eps.addrs) != 2 || eps.addrs[0] != "10.0.0.1:50001" || eps.addrs[1] != "10.0.0.2:50001" {
+		t.Errorf("unexpected endpoints: %v", eps.addrs)
+	}
+	if eps.active() != "" {
+		t.Errorf("expected no active endpoint before connecting, got %q", eps.active())
+	}
+
+	single, err := parseEndpoints("10.0.0.1:50001")
+	if err != nil {
+		t.Fatalf("parseEndpoints failed: %v", err)
+	}
+	if single.active() != "10.0.0.1:50001" {
+		t.Errorf("expected single endpoint to be active, got %q", single.active())
+	}
+
+	if _, err := parseEndpoints(" , "); err == nil {
+		t.Error("expected an error for an empty address list")
+	}
+}
+
+func TestInitFailsOverToHealthyEndpoint(t *testing.T) {
+	p := newTestPKI(t)
+	healthy := startTestAgent(t, p)
+	dead := deadAddress(t)
+
+	tests := []struct {
+		name  string
+		addrs string
+	}{
+		{"Dead endpoint first", dead + "," + healthy},
+		{"Healthy endpoint first", healthy + "," + dead},
+		{"Single healthy endpoint", healthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetClient(t)
+			if err := Init(tt.addrs, p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+				t.Fatalf("Init failed: %v", err)
+			}
+
+			ok, err := SendSessionData(context.Background(), PrimaryAgent, 0x0A000001, 0x0A000002, 0, 80, 0, 0, true, 5*time.Second)
+			if err != nil || !ok {
+				t.Fatalf("SendSessionData failed: ok=%v err=%v", ok, err)
+			}
+			if got := ActiveEndpoint(); got != healthy {
+				t.Errorf("expected active endpoint %s, got %q", healthy, got)
+			}
+		})
+	}
+}
+
+func TestProbeMultipleEndpoints(t *testing.T) {
+	p := newTestPKI(t)
+	healthy := startTestAgent(t, p)
+
+	if err := Probe(deadAddress(t)+","+healthy, p.clientCert, p.clientKey, p.caFile, "aegis-agent", 5*time.Second); err != nil {
+		t.Errorf("expected probe to reach the healthy endpoint: %v", err)
+	}
+	if err := Probe(deadAddress(t), p.clientCert, p.clientKey, p.caFile, "aegis-agent", 500*time.Millisecond); err == nil {
+		t.Error("expected probe of a dead endpoint to fail")
+	}
+}
+
+func TestNamedAgentRouting(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	zoneB := startTestAgent(t, p)
+
+	if err := Init(deadAddress(t), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := InitAgent("zone-b", zoneB, p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("InitAgent failed: %v", err)
+	}
+
+	if got := Agents(); len(got) != 2 || got[0] != PrimaryAgent || got[1] != "zone-b" {
+		t.Errorf("unexpected agents: %v", got)
+	}
+	if !HasAgent("zone-b") || HasAgent("zone-c") {
+		t.Error("HasAgent does not match the registered agents")
+	}
+
+	if ok, err := SendSessionData(context.Background(), "zone-b", 0x0A000001, 0x0A000002, 0, 80, 0, 0, true, 5*time.Second); err != nil || !ok {
+		t.Errorf("expected zone-b to accept the session: ok=%v err=%v", ok, err)
+	}
+	if _, err := SendSessionData(context.Background(), PrimaryAgent, 0x0A000001, 0x0A000002, 0, 80, 0, 0, true, 500*time.Millisecond); err == nil {
+		t.Error("expected the dead primary agent to fail")
+	}
+	if _, err := SendSessionData(context.Background(), "zone-c", 0x0A000001, 0x0A000002, 0, 80, 0, 0, true, time.Second); err == nil {
+		t.Error("expected an unknown agent to be rejected")
+	}
+}
+
+func TestSendSessionDataPortRange(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	events := make(chan *LoginEvent, 1)
+	if err := Init(serveTestAgent(t, p, testAgent{events: events}), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	if ok, err := SendSessionData(context.Background(), PrimaryAgent, 0x0A000001, 0x0A000002, 0, 10000, 10099, 0, true, 5*time.Second); err != nil || !ok {
+		t.Fatalf("SendSessionData failed: ok=%v err=%v", ok, err)
+	}
+	e := <-events
+	if e.GetDstPort() != 10000 || e.GetDstPortEnd() != 10099 || !e.GetActivate() {
+		t.Errorf("expected an activation of ports 10000-10099, got %+v", e)
+	}
+}
+
+func TestSendChangedIpDataOrdersAndNumbersBatches(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	batches := make(chan *IpChangeList, 2)
+	if err := Init(serveTestAgent(t, p, testAgent{ipChanges: batches}), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	send := func(changes ...*IpChangeEvent) *IpChangeList {
+		t.Helper()
+		if ok, err := SendChanedIpData(context.Background(), PrimaryAgent, &IpChangeList{IpChanges: changes}, 5*time.Second); err != nil || !ok {
+			t.Fatalf("SendChanedIpData failed: ok=%v err=%v", ok, err)
+		}
+		return <-batches
+	}
+
+	first := send(
+		&IpChangeEvent{OldIp: 0x0A000003, NewIp: 0x0A000009},
+		&IpChangeEvent{OldIp: 0x0A000001, NewIp: 0x0A000008},
+		&IpChangeEvent{OldIp: 0x0A000001, NewIp: 0x0A000002},
+	)
+	want := [][2]uint32{{0x0A000001, 0x0A000002}, {0x0A000001, 0x0A000008}, {0x0A000003, 0x0A000009}}
+	if len(first.GetIpChanges()) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), first.GetIpChanges())
+	}
+	for i, c := range first.GetIpChanges() {
+		if c.GetOldIp() != want[i][0] || c.GetNewIp() != want[i][1] {
+			t.Errorf("change %d: expected %x -> %x, got %x -> %x", i, want[i][0], want[i][1], c.GetOldIp(), c.GetNewIp())
+		}
+	}
+	if first.GetSequence() != 1 {
+		t.Errorf("expected the first batch to be number 1, got %d", first.GetSequence())
+	}
+	if second := send(&IpChangeEvent{OldIp: 0x0A000002, NewIp: 0x0A000004}); second.GetSequence() != 2 {
+		t.Errorf("expected the second batch to be number 2, got %d", second.GetSequence())
+	}
+}
+
+func TestSendSnapshotFollowsLastBatch(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	batches := make(chan *IpChangeList, 1)
+	snapshots := make(chan *ServiceSnapshot, 2)
+	if err := Init(serveTestAgent(t, p, testAgent{ipChanges: batches, snapshots: snapshots}), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	services := []*ServiceTarget{{Ip: 0x0A000005, Port: 80}, {Ip: 0x0A000007, Port: 9000, PortEnd: 9010}}
+	build := func() (*ServiceSnapshot, error) { return &ServiceSnapshot{Services: services}, nil }
+
+	// Before any batch the agent resumes from 0; after one it resumes from that batch.
+	for _, sequence := range []uint64{0, 1} {
+		if sequence > 0 {
+			if _, err := SendChanedIpData(context.Background(), PrimaryAgent, &IpChangeList{}, 5*time.Second); err != nil {
+				t.Fatalf("SendChanedIpData failed: %v", err)
+			}
+			<-batches
+		}
+		if ok, err := SendSnapshot(context.Background(), PrimaryAgent, build, 5*time.Second); err != nil || !ok {
+			t.Fatalf("SendSnapshot failed: ok=%v err=%v", ok, err)
+		}
+		got := <-snapshots
+		if got.GetSequence() != sequence {
+			t.Errorf("expected snapshot after batch %d, got %d", sequence, got.GetSequence())
+		}
+		if len(got.GetServices()) != len(services) || got.GetServices()[1].GetPortEnd() != 9010 {
+			t.Errorf("expected the full mapping %v, got %v", services, got.GetServices())
+		}
+	}
+
+	if ok, err := SendSnapshot(context.Background(), PrimaryAgent, func() (*ServiceSnapshot, error) {
+		return nil, errors.New("database is locked")
+	}, 5*time.Second); err == nil || ok {
+		t.Errorf("expected a failed build to fail the resync, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestCallTimeoutReachesAgent(t *testing.T) {
+	resetClient(t)
+	p := newTestPKI(t)
+	deadlines := make(chan time.Duration, 1)
+	if err := Init(serveTestAgent(t, p, testAgent{deadlines: deadlines}), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	// Timeouts well apart from the former hardcoded second, so a regression to it cannot pass.
+	calls := []struct {
+		name    string
+		timeout time.Duration
+		call    func(timeout time.Duration) (bool, error)
+	}{
+		{"SendSessionData", 7 * time.Second, func(timeout time.Duration) (bool, error) {
+			return SendSessionData(context.Background(), PrimaryAgent, 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, timeout)
+		}},
+		{"SendChanedIpData", 4 * time.Second, func(timeout time.Duration) (bool, error) {
+			return SendChanedIpData(context.Background(), PrimaryAgent, &IpChangeList{}, timeout)
+		}},
+	}
+	for _, c := range calls {
+		t.Run(c.name, func(t *testing.T) {
+			if ok, err := c.call(c.timeout); err != nil || !ok {
+				t.Fatalf("call failed: ok=%v err=%v", ok, err)
+			}
+			if left := <-deadlines; left <= c.timeout-time.Second || left > c.timeout {
+				t.Errorf("expected the agent to see a deadline about %v away, got %v", c.timeout, left)
+			}
+		})
+	}
+}
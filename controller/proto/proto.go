@@ -8,28 +8,146 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 )
 
-var c SessionManagerClient
+// PrimaryAgent is the name of the agent configured in the [agent] section.
+// Services without an explicit agent are enforced by it.
+const PrimaryAgent = "primary"
 
+// agentClient is the connection to one named agent.
+type agentClient struct {
+	conn      *grpc.ClientConn
+	client    SessionManagerClient
+	endpoints *agentEndpoints
+
+	// ipChangeMu orders IP change batches, numbered by ipChangeSeq, so the agent receives them in
+	// sequence order.
+	ipChangeMu  sync.Mutex
+	ipChangeSeq uint64
+}
+
+var (
+	agentsMu sync.RWMutex
+	agents   = make(map[string]*agentClient)
+)
+
+// Init creates the primary agent client. agentAddr may be a comma-separated list of host:port endpoints,
+// in which case the client connects to the first reachable one and fails over to the others.
 func Init(agentAddr, certFile, keyFile, caFile, serverName string) error {
+	return InitAgent(PrimaryAgent, agentAddr, certFile, keyFile, caFile, serverName)
+}
+
+// InitAgent creates the client for the named agent, replacing any existing client with that name.
+func InitAgent(name, agentAddr, certFile, keyFile, caFile, serverName string) error {
+	cc, eps, err := dial(agentAddr, certFile, keyFile, caFile, serverName, grpc.WithUnaryInterceptor(callInterceptor(name)))
+	if err != nil {
+		return err
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if old, ok := agents[name]; ok {
+		_ = old.conn.Close()
+	}
+	agents[name] = &agentClient{conn: cc, client: NewSessionManagerClient(cc), endpoints: eps}
+	return nil
+}
+
+// Agents returns the names of all initialized agents, primary first.
+func Agents() []string {
+	agentsMu.RLock()
+	defer agentsMu.RUnlock()
+	names := make([]string, 0, len(agents))
+	for name := range agents {
+		if name != PrimaryAgent {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := agents[PrimaryAgent]; ok {
+		names = append([]string{PrimaryAgent}, names...)
+	}
+	return names
+}
+
+// HasAgent reports whether name refers to a configured agent. The primary agent always exists.
+func HasAgent(name string) bool {
+	if name == PrimaryAgent {
+		return true
+	}
+	agentsMu.RLock()
+	defer agentsMu.RUnlock()
+	_, ok := agents[name]
+	return ok
+}
+
+// lookup returns the client for the named agent. An empty name selects the primary agent.
+func lookup(name string) (*agentClient, error) {
+	if name == "" {
+		name = PrimaryAgent
+	}
+	agentsMu.RLock()
+	defer agentsMu.RUnlock()
+	a, ok := agents[name]
+	if !ok {
+		return nil, fmt.Errorf("agent %q is not configured", name)
+	}
+	return a, nil
+}
+
+// Probe connects to the agent with the given credentials and waits until the connection is ready.
+// It does not touch the client used by the rest of the package.
+func Probe(agentAddr, certFile, keyFile, caFile, serverName string, timeout time.Duration) error {
+	cc, _, err := dial(agentAddr, certFile, keyFile, caFile, serverName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cc.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cc.Connect()
+	for {
+		state := cc.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("agent not ready after %v (last state %s)", timeout, state)
+		}
+	}
+}
+
+// dial creates a mutual-TLS client connection to the agent endpoints in agentAddr, adding extra to
+// the dial options. The connection is established lazily.
+func dial(agentAddr, certFile, keyFile, caFile, serverName string, extra ...grpc.DialOption) (*grpc.ClientConn, *agentEndpoints, error) {
+	eps, err := parseEndpoints(agentAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return fmt.Errorf("failed to load client cert/key: %v", err)
+		return nil, nil, fmt.Errorf("failed to load client cert/key: %v", err)
 	}
 
 	caCert, err := os.ReadFile(caFile)
 	if err != nil {
-		return fmt.Errorf("failed to read CA cert: %v", err)
+		return nil, nil, fmt.Errorf("failed to read CA cert: %v", err)
 	}
 	caCertPool := x509.NewCertPool()
 	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-		return fmt.Errorf("failed to append CA cert")
+		return nil, nil, fmt.Errorf("failed to append CA cert")
 	}
 
 	creds := credentials.NewTLS(&tls.Config{
@@ -48,53 +166,103 @@ func Init(agentAddr, certFile, keyFile, caFile, serverName string) error {
 		MinConnectTimeout: 20 * time.Second,
 	}
 
-	conn, err := grpc.NewClient(agentAddr, grpc.WithTransportCredentials(creds), grpc.WithConnectParams(cp))
-	if err != nil {
-		return err
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithConnectParams(cp)}, extra...)
+	if len(eps.addrs) == 1 {
+		cc, err := grpc.NewClient(eps.addrs[0], opts...)
+		return cc, eps, err
 	}
-	c = NewSessionManagerClient(conn)
-	return nil
+
+	// pick_first walks the endpoint list in order and moves on when the current one fails.
+	r := manual.NewBuilderWithScheme(endpointScheme)
+	state := resolver.State{}
+	for _, addr := range eps.addrs {
+		state.Endpoints = append(state.Endpoints, resolver.Endpoint{Addresses: []resolver.Address{{Addr: addr}}})
+	}
+	r.InitialState(state)
+	opts = append(opts,
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"pick_first":{}}]}`),
+		grpc.WithContextDialer(eps.dial),
+	)
+	cc, err := grpc.NewClient(endpointScheme+":///agent", opts...)
+	return cc, eps, err
 }
 
-// SendSessionData sends a login event to the server
-func SendSessionData(srcIp, dstIp uint32, port uint32, active bool, timeout time.Duration) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// ActiveEndpoint returns the primary agent endpoint the client last connected to, or "" if Init has not
+// been called or no connection has been made yet.
+func ActiveEndpoint() string {
+	a, err := lookup(PrimaryAgent)
+	if err != nil {
+		return ""
+	}
+	return a.endpoints.active()
+}
 
-	req := &LoginEvent{
-		SrcIp:    srcIp,
-		DstIp:    dstIp,
-		DstPort:  port,
-		Activate: active,
+// ConnState returns the primary agent connection state and false if Init has not been called.
+func ConnState() (connectivity.State, bool) {
+	a, err := lookup(PrimaryAgent)
+	if err != nil {
+		return connectivity.Shutdown, false
 	}
+	return a.conn.GetState(), true
+}
 
-	res, err := c.SubmitSession(ctx, req)
+// SendSessionData sends a login event to the named agent. A non-zero dstPrefixLen extends the
+// session to every address of the network dstIp/dstPrefixLen, and a non-zero portEnd to every port
+// from port to portEnd. A non-zero ttlSeconds makes the agent drop the session's rules after that
+// many idle seconds instead of its rule_timeout_ns. Each attempt may take up to timeout; attempts
+// failing with a transient status are retried under SessionRetry while ctx allows. A failed call
+// returns an *AgentError.
+func SendSessionData(ctx context.Context, agent string, srcIp, dstIp, dstPrefixLen uint32, port, portEnd, ttlSeconds uint32, active bool, timeout time.Duration) (bool, error) {
+	a, err := lookup(agent)
 	if err != nil {
 		return false, err
 	}
-	return res.GetSuccess(), nil
+
+	req := &LoginEvent{
+		SrcIp:        srcIp,
+		DstIp:        dstIp,
+		DstPrefixLen: dstPrefixLen,
+		DstPort:      port,
+		DstPortEnd:   portEnd,
+		TtlSeconds:   ttlSeconds,
+		Activate:     active,
+	}
+
+	return withRetry(ctx, SessionRetry, func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		res, err := a.client.SubmitSession(ctx, req)
+		if err != nil {
+			return false, err
+		}
+		return res.GetSuccess(), nil
+	})
 }
 
-// MonitorStream listens to the server stream and executes a callback for each update
-func MonitorStream(callback func(*SessionList)) error {
-	// Use context.Background() since this stream should run indefinitely
-	stream, err := c.MonitorSessions(context.Background(), &Empty{})
+// MonitorStream listens to the named agent's stream and executes a callback for each update until the
+// stream ends or ctx is cancelled.
+func MonitorStream(ctx context.Context, agent string, callback func(*SessionList)) error {
+	a, err := lookup(agent)
+	if err != nil {
+		return err
+	}
+	stream, err := a.client.MonitorSessions(ctx, &Empty{})
 	if err != nil {
 		return err
 	}
 
-	log.Println("[INFO] Started monitoring sessions...")
+	log.Printf("[INFO] Started monitoring sessions on agent %s...", agent)
 
 	for {
-		// This blocks until the server sends data (every 5 seconds as per your server logic)
+		// This blocks until the agent pushes its next list; the cadence is set by the agent's config
 		sessionList, err := stream.Recv()
 		if err == io.EOF {
 			log.Println("[INFO] Server closed the stream.")
 			break
 		}
 		if err != nil {
-			log.Printf("[ERROR] stream error: %v", err)
-			break
+			return err
 		}
 
 		// Execute the provided callback with the received list [cite: 5]
@@ -104,12 +272,58 @@ func MonitorStream(callback func(*SessionList)) error {
 	return nil
 }
 
-// SendChanedIpData sends list of changed IPs to the agent
-func SendChanedIpData(changedIps *IpChangeList, timeout time.Duration) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// SendChanedIpData sends list of changed IPs to the named agent. The changes are sorted by old IP, then
+// new IP, and the batch is given the agent's next sequence number, so the agent applies them in a
+// deterministic order and can tell when it missed a batch or received one out of order.
+func SendChanedIpData(ctx context.Context, agent string, changedIps *IpChangeList, timeout time.Duration) (bool, error) {
+	a, err := lookup(agent)
+	if err != nil {
+		return false, err
+	}
+
+	changes := changedIps.IpChanges
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].OldIp != changes[j].OldIp {
+			return changes[i].OldIp < changes[j].OldIp
+		}
+		return changes[i].NewIp < changes[j].NewIp
+	})
+	a.ipChangeMu.Lock()
+	defer a.ipChangeMu.Unlock()
+	a.ipChangeSeq++
+	changedIps.Sequence = a.ipChangeSeq
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res, err := a.client.IpChange(ctx, changedIps)
+	if err != nil {
+		return false, err
+	}
+	return res.GetSuccess(), nil
+}
+
+// SendSnapshot sends the named agent the snapshot build returns, for an agent that asked to resync.
+// The snapshot is built and sent between IP change batches and carries the number of the last batch
+// sent, so the agent knows which batch follows it.
+func SendSnapshot(ctx context.Context, agent string, build func() (*ServiceSnapshot, error), timeout time.Duration) (bool, error) {
+	a, err := lookup(agent)
+	if err != nil {
+		return false, err
+	}
+
+	a.ipChangeMu.Lock()
+	defer a.ipChangeMu.Unlock()
+	snapshot, err := build()
+	if err != nil {
+		return false, err
+	}
+	snapshot.Sequence = a.ipChangeSeq
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	res, err := c.IpChange(ctx, changedIps)
+	res, err := a.client.Resync(ctx, snapshot)
 	if err != nil {
 		return false, err
 	}
@@ -1,13 +1,14 @@
 package proto
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
 func TestSendChangedIpData(t *testing.T) {
 	// Skip if gRPC client is not initialized (which is expected in unit tests)
-	if c == nil {
+	if _, err := lookup(PrimaryAgent); err != nil {
 		t.Skip("Skipping test: gRPC client not initialized (agent not running)")
 	}
 
@@ -53,7 +54,7 @@ func TestSendChangedIpData(t *testing.T) {
 				IpChanges: tt.ipChanges,
 			}
 
-			_, err := SendChanedIpData(changedIps, time.Second)
+			_, err := SendChanedIpData(context.Background(), PrimaryAgent, changedIps, time.Second)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("SendChanedIpData() error = %v, wantErr %v", err, tt.wantErr)
@@ -0,0 +1,81 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy bounds how often a call failing with a transient status is retried. Delays start at
+// BaseDelay and double per attempt up to MaxDelay, each jittered to between half and all of it.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// SessionRetry is the policy SendSessionData retries with.
+var SessionRetry = RetryPolicy{Attempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+// AgentError is a failed agent call. Retryable is set when the agent could not be reached or did not
+// answer in time, so the same call may succeed later; otherwise the agent rejected the call.
+type AgentError struct {
+	Err       error
+	Retryable bool
+	Attempts  int
+}
+
+func (e *AgentError) Error() string {
+	if e.Retryable {
+		return fmt.Sprintf("agent unavailable after %d attempts: %v", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("agent rejected call: %v", e.Err)
+}
+
+func (e *AgentError) Unwrap() error { return e.Err }
+
+// IsRetryable reports whether err is an agent call that failed for a transient reason.
+func IsRetryable(err error) bool {
+	var agentErr *AgentError
+	return errors.As(err, &agentErr) && agentErr.Retryable
+}
+
+// retryableCode reports whether a call failing with code may succeed if repeated.
+func retryableCode(code codes.Code) bool {
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// withRetry runs call until it succeeds, fails with a status that is not retryable, or runs out of
+// attempts. No retry is started that could not finish before ctx's deadline.
+func withRetry(ctx context.Context, policy RetryPolicy, call func(ctx context.Context) (bool, error)) (bool, error) {
+	delay := policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		ok, err := call(ctx)
+		if err == nil {
+			return ok, nil
+		}
+		if !retryableCode(status.Code(err)) {
+			return false, &AgentError{Err: err, Attempts: attempt}
+		}
+		failed := &AgentError{Err: err, Retryable: true, Attempts: attempt}
+		if attempt >= policy.Attempts {
+			return false, failed
+		}
+
+		wait := delay/2 + rand.N(delay/2+1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return false, failed
+		}
+		select {
+		case <-ctx.Done():
+			return false, failed
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, policy.MaxDelay)
+	}
+}
@@ -0,0 +1,69 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestSendSessionDataRetries(t *testing.T) {
+	p := newTestPKI(t)
+
+	tests := []struct {
+		name          string
+		failures      []codes.Code
+		ctxTimeout    time.Duration
+		wantErr       bool
+		wantRetryable bool
+		wantCalls     int32
+	}{
+		{"Succeeds after one transient failure", []codes.Code{codes.Unavailable}, 0, false, false, 2},
+		{"Retries a timed out attempt", []codes.Code{codes.DeadlineExceeded}, 0, false, false, 2},
+		{"Fails fast on a rejected request", []codes.Code{codes.InvalidArgument}, 0, true, false, 1},
+		{"Gives up after the attempt limit", []codes.Code{codes.Unavailable, codes.Unavailable, codes.Unavailable}, 0, true, true, 3},
+		{"Stops when the request deadline is too close", []codes.Code{codes.Unavailable, codes.Unavailable}, 20 * time.Millisecond, true, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetClient(t)
+			agent := testAgent{fail: make(chan codes.Code, len(tt.failures)), calls: new(atomic.Int32)}
+			if err := Init(serveTestAgent(t, p, agent), p.clientCert, p.clientKey, p.caFile, "aegis-agent"); err != nil {
+				t.Fatalf("Init failed: %v", err)
+			}
+			// Connect first so the handshake does not eat into the request deadline.
+			if _, err := SendSessionData(context.Background(), PrimaryAgent, 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, 5*time.Second); err != nil {
+				t.Fatalf("warm-up call failed: %v", err)
+			}
+			agent.calls.Store(0)
+			for _, code := range tt.failures {
+				agent.fail <- code
+			}
+
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				defer cancel()
+			}
+			ok, err := SendSessionData(ctx, PrimaryAgent, 0x0A000001, 0x0A000002, 0, 22, 0, 0, true, 5*time.Second)
+			if tt.wantErr {
+				var agentErr *AgentError
+				if !errors.As(err, &agentErr) {
+					t.Fatalf("expected an AgentError, got ok=%v err=%v", ok, err)
+				}
+				if agentErr.Retryable != tt.wantRetryable || IsRetryable(err) != tt.wantRetryable {
+					t.Errorf("expected retryable=%v, got %+v", tt.wantRetryable, agentErr)
+				}
+			} else if err != nil || !ok {
+				t.Fatalf("expected success, got ok=%v err=%v", ok, err)
+			}
+			if got := agent.calls.Load(); got != tt.wantCalls {
+				t.Errorf("expected %d calls to the agent, got %d", tt.wantCalls, got)
+			}
+		})
+	}
+}
@@ -27,6 +27,9 @@ type LoginEvent struct {
 	DstIp         uint32                 `protobuf:"varint,2,opt,name=dst_ip,json=dstIp,proto3" json:"dst_ip,omitempty"`
 	DstPort       uint32                 `protobuf:"varint,3,opt,name=dst_port,json=dstPort,proto3" json:"dst_port,omitempty"`
 	Activate      bool                   `protobuf:"varint,4,opt,name=activate,proto3" json:"activate,omitempty"`
+	DstPortEnd    uint32                 `protobuf:"varint,5,opt,name=dst_port_end,json=dstPortEnd,proto3" json:"dst_port_end,omitempty"`       // last port of a range starting at dst_port; 0 for dst_port alone
+	DstPrefixLen  uint32                 `protobuf:"varint,6,opt,name=dst_prefix_len,json=dstPrefixLen,proto3" json:"dst_prefix_len,omitempty"` // dst_ip is the network of this many leading bits; 0 for dst_ip alone
+	TtlSeconds    uint32                 `protobuf:"varint,7,opt,name=ttl_seconds,json=ttlSeconds,proto3" json:"ttl_seconds,omitempty"`         // idle timeout of the session's rules; 0 for the agent's rule_timeout_ns
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -89,6 +92,27 @@ func (x *LoginEvent) GetActivate() bool {
 	return false
 }
 
+func (x *LoginEvent) GetDstPortEnd() uint32 {
+	if x != nil {
+		return x.DstPortEnd
+	}
+	return 0
+}
+
+func (x *LoginEvent) GetDstPrefixLen() uint32 {
+	if x != nil {
+		return x.DstPrefixLen
+	}
+	return 0
+}
+
+func (x *LoginEvent) GetTtlSeconds() uint32 {
+	if x != nil {
+		return x.TtlSeconds
+	}
+	return 0
+}
+
 type Ack struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -170,10 +194,11 @@ func (*Empty) Descriptor() ([]byte, []int) {
 }
 
 type SessionList struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Sessions      []*Session             `protobuf:"bytes,1,rep,name=sessions,proto3" json:"sessions,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Sessions        []*Session             `protobuf:"bytes,1,rep,name=sessions,proto3" json:"sessions,omitempty"`
+	ResyncRequested bool                   `protobuf:"varint,2,opt,name=resync_requested,json=resyncRequested,proto3" json:"resync_requested,omitempty"` // the agent lost its state and asks for a ServiceSnapshot
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
 }
 
 func (x *SessionList) Reset() {
@@ -213,12 +238,19 @@ func (x *SessionList) GetSessions() []*Session {
 	return nil
 }
 
+func (x *SessionList) GetResyncRequested() bool {
+	if x != nil {
+		return x.ResyncRequested
+	}
+	return false
+}
+
 type Session struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	SrcIp         uint32                 `protobuf:"varint,1,opt,name=src_ip,json=srcIp,proto3" json:"src_ip,omitempty"`
 	DstIp         uint32                 `protobuf:"varint,2,opt,name=dst_ip,json=dstIp,proto3" json:"dst_ip,omitempty"`
 	DstPort       uint32                 `protobuf:"varint,3,opt,name=dst_port,json=dstPort,proto3" json:"dst_port,omitempty"`
-	TimeLeft      int32                  `protobuf:"varint,4,opt,name=time_left,json=timeLeft,proto3" json:"time_left,omitempty"`
+	TimeLeft      int32                  `protobuf:"varint,4,opt,name=time_left,json=timeLeft,proto3" json:"time_left,omitempty"` // seconds until the agent drops the rule
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -284,6 +316,7 @@ func (x *Session) GetTimeLeft() int32 {
 type IpChangeList struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	IpChanges     []*IpChangeEvent       `protobuf:"bytes,1,rep,name=ip_changes,json=ipChanges,proto3" json:"ip_changes,omitempty"`
+	Sequence      uint64                 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"` // per-agent batch number, starting at 1 and raised by one for every batch sent
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -325,6 +358,13 @@ func (x *IpChangeList) GetIpChanges() []*IpChangeEvent {
 	return nil
 }
 
+func (x *IpChangeList) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
 type IpChangeEvent struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	OldIp         uint32                 `protobuf:"varint,1,opt,name=old_ip,json=oldIp,proto3" json:"old_ip,omitempty"`
@@ -377,37 +417,183 @@ func (x *IpChangeEvent) GetNewIp() uint32 {
 	return 0
 }
 
+type ServiceSnapshot struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Services      []*ServiceTarget       `protobuf:"bytes,1,rep,name=services,proto3" json:"services,omitempty"`
+	Sequence      uint64                 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"` // number of the last IpChangeList sent before the snapshot, whose changes it includes
+	Sessions      []*LoginEvent          `protobuf:"bytes,3,rep,name=sessions,proto3" json:"sessions,omitempty"`  // every active session, with activate set, for the agent to reinstall
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServiceSnapshot) Reset() {
+	*x = ServiceSnapshot{}
+	mi := &file_proto_session_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServiceSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceSnapshot) ProtoMessage() {}
+
+func (x *ServiceSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_session_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceSnapshot.ProtoReflect.Descriptor instead.
+func (*ServiceSnapshot) Descriptor() ([]byte, []int) {
+	return file_proto_session_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServiceSnapshot) GetServices() []*ServiceTarget {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
+func (x *ServiceSnapshot) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *ServiceSnapshot) GetSessions() []*LoginEvent {
+	if x != nil {
+		return x.Sessions
+	}
+	return nil
+}
+
+type ServiceTarget struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            uint32                 `protobuf:"varint,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	Port          uint32                 `protobuf:"varint,2,opt,name=port,proto3" json:"port,omitempty"`
+	PortEnd       uint32                 `protobuf:"varint,3,opt,name=port_end,json=portEnd,proto3" json:"port_end,omitempty"`       // last port of a range starting at port; 0 for port alone
+	PrefixLen     uint32                 `protobuf:"varint,4,opt,name=prefix_len,json=prefixLen,proto3" json:"prefix_len,omitempty"` // ip is the network of this many leading bits; 0 for ip alone
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServiceTarget) Reset() {
+	*x = ServiceTarget{}
+	mi := &file_proto_session_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServiceTarget) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceTarget) ProtoMessage() {}
+
+func (x *ServiceTarget) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_session_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceTarget.ProtoReflect.Descriptor instead.
+func (*ServiceTarget) Descriptor() ([]byte, []int) {
+	return file_proto_session_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ServiceTarget) GetIp() uint32 {
+	if x != nil {
+		return x.Ip
+	}
+	return 0
+}
+
+func (x *ServiceTarget) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *ServiceTarget) GetPortEnd() uint32 {
+	if x != nil {
+		return x.PortEnd
+	}
+	return 0
+}
+
+func (x *ServiceTarget) GetPrefixLen() uint32 {
+	if x != nil {
+		return x.PrefixLen
+	}
+	return 0
+}
+
 var File_proto_session_proto protoreflect.FileDescriptor
 
 const file_proto_session_proto_rawDesc = "" +
 	"\n" +
-	"\x13proto/session.proto\x12\asession\"q\n" +
+	"\x13proto/session.proto\x12\asession\"\xda\x01\n" +
 	"\n" +
 	"LoginEvent\x12\x15\n" +
 	"\x06src_ip\x18\x01 \x01(\rR\x05srcIp\x12\x15\n" +
 	"\x06dst_ip\x18\x02 \x01(\rR\x05dstIp\x12\x19\n" +
 	"\bdst_port\x18\x03 \x01(\rR\adstPort\x12\x1a\n" +
-	"\bactivate\x18\x04 \x01(\bR\bactivate\"\x1f\n" +
+	"\bactivate\x18\x04 \x01(\bR\bactivate\x12 \n" +
+	"\fdst_port_end\x18\x05 \x01(\rR\n" +
+	"dstPortEnd\x12$\n" +
+	"\x0edst_prefix_len\x18\x06 \x01(\rR\fdstPrefixLen\x12\x1f\n" +
+	"\vttl_seconds\x18\a \x01(\rR\n" +
+	"ttlSeconds\"\x1f\n" +
 	"\x03Ack\x12\x18\n" +
 	"\asuccess\x18\x01 \x01(\bR\asuccess\"\a\n" +
-	"\x05Empty\";\n" +
+	"\x05Empty\"f\n" +
 	"\vSessionList\x12,\n" +
-	"\bsessions\x18\x01 \x03(\v2\x10.session.SessionR\bsessions\"o\n" +
+	"\bsessions\x18\x01 \x03(\v2\x10.session.SessionR\bsessions\x12)\n" +
+	"\x10resync_requested\x18\x02 \x01(\bR\x0fresyncRequested\"o\n" +
 	"\aSession\x12\x15\n" +
 	"\x06src_ip\x18\x01 \x01(\rR\x05srcIp\x12\x15\n" +
 	"\x06dst_ip\x18\x02 \x01(\rR\x05dstIp\x12\x19\n" +
 	"\bdst_port\x18\x03 \x01(\rR\adstPort\x12\x1b\n" +
-	"\ttime_left\x18\x04 \x01(\x05R\btimeLeft\"E\n" +
+	"\ttime_left\x18\x04 \x01(\x05R\btimeLeft\"a\n" +
 	"\fIpChangeList\x125\n" +
 	"\n" +
-	"ip_changes\x18\x01 \x03(\v2\x16.session.IpChangeEventR\tipChanges\"=\n" +
+	"ip_changes\x18\x01 \x03(\v2\x16.session.IpChangeEventR\tipChanges\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\"=\n" +
 	"\rIpChangeEvent\x12\x15\n" +
 	"\x06old_ip\x18\x01 \x01(\rR\x05oldIp\x12\x15\n" +
-	"\x06new_ip\x18\x02 \x01(\rR\x05newIp2\xb0\x01\n" +
+	"\x06new_ip\x18\x02 \x01(\rR\x05newIp\"\x92\x01\n" +
+	"\x0fServiceSnapshot\x122\n" +
+	"\bservices\x18\x01 \x03(\v2\x16.session.ServiceTargetR\bservices\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\x12/\n" +
+	"\bsessions\x18\x03 \x03(\v2\x13.session.LoginEventR\bsessions\"m\n" +
+	"\rServiceTarget\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\rR\x02ip\x12\x12\n" +
+	"\x04port\x18\x02 \x01(\rR\x04port\x12\x19\n" +
+	"\bport_end\x18\x03 \x01(\rR\aportEnd\x12\x1d\n" +
+	"\n" +
+	"prefix_len\x18\x04 \x01(\rR\tprefixLen2\xe2\x01\n" +
 	"\x0eSessionManager\x122\n" +
 	"\rSubmitSession\x12\x13.session.LoginEvent\x1a\f.session.Ack\x129\n" +
 	"\x0fMonitorSessions\x12\x0e.session.Empty\x1a\x14.session.SessionList0\x01\x12/\n" +
-	"\bIpChange\x12\x15.session.IpChangeList\x1a\f.session.AckB\x18Z\x16Aegis/controller/protob\x06proto3"
+	"\bIpChange\x12\x15.session.IpChangeList\x1a\f.session.Ack\x120\n" +
+	"\x06Resync\x12\x18.session.ServiceSnapshot\x1a\f.session.AckB\x18Z\x16Aegis/controller/protob\x06proto3"
 
 var (
 	file_proto_session_proto_rawDescOnce sync.Once
@@ -421,30 +607,36 @@ func file_proto_session_proto_rawDescGZIP() []byte {
 	return file_proto_session_proto_rawDescData
 }
 
-var file_proto_session_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_proto_session_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
 var file_proto_session_proto_goTypes = []any{
-	(*LoginEvent)(nil),    // 0: session.LoginEvent
-	(*Ack)(nil),           // 1: session.Ack
-	(*Empty)(nil),         // 2: session.Empty
-	(*SessionList)(nil),   // 3: session.SessionList
-	(*Session)(nil),       // 4: session.Session
-	(*IpChangeList)(nil),  // 5: session.IpChangeList
-	(*IpChangeEvent)(nil), // 6: session.IpChangeEvent
+	(*LoginEvent)(nil),      // 0: session.LoginEvent
+	(*Ack)(nil),             // 1: session.Ack
+	(*Empty)(nil),           // 2: session.Empty
+	(*SessionList)(nil),     // 3: session.SessionList
+	(*Session)(nil),         // 4: session.Session
+	(*IpChangeList)(nil),    // 5: session.IpChangeList
+	(*IpChangeEvent)(nil),   // 6: session.IpChangeEvent
+	(*ServiceSnapshot)(nil), // 7: session.ServiceSnapshot
+	(*ServiceTarget)(nil),   // 8: session.ServiceTarget
 }
 var file_proto_session_proto_depIdxs = []int32{
 	4, // 0: session.SessionList.sessions:type_name -> session.Session
 	6, // 1: session.IpChangeList.ip_changes:type_name -> session.IpChangeEvent
-	0, // 2: session.SessionManager.SubmitSession:input_type -> session.LoginEvent
-	2, // 3: session.SessionManager.MonitorSessions:input_type -> session.Empty
-	5, // 4: session.SessionManager.IpChange:input_type -> session.IpChangeList
-	1, // 5: session.SessionManager.SubmitSession:output_type -> session.Ack
-	3, // 6: session.SessionManager.MonitorSessions:output_type -> session.SessionList
-	1, // 7: session.SessionManager.IpChange:output_type -> session.Ack
-	5, // [5:8] is the sub-list for method output_type
-	2, // [2:5] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	8, // 2: session.ServiceSnapshot.services:type_name -> session.ServiceTarget
+	0, // 3: session.ServiceSnapshot.sessions:type_name -> session.LoginEvent
+	0, // 4: session.SessionManager.SubmitSession:input_type -> session.LoginEvent
+	2, // 5: session.SessionManager.MonitorSessions:input_type -> session.Empty
+	5, // 6: session.SessionManager.IpChange:input_type -> session.IpChangeList
+	7, // 7: session.SessionManager.Resync:input_type -> session.ServiceSnapshot
+	1, // 8: session.SessionManager.SubmitSession:output_type -> session.Ack
+	3, // 9: session.SessionManager.MonitorSessions:output_type -> session.SessionList
+	1, // 10: session.SessionManager.IpChange:output_type -> session.Ack
+	1, // 11: session.SessionManager.Resync:output_type -> session.Ack
+	8, // [8:12] is the sub-list for method output_type
+	4, // [4:8] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_proto_session_proto_init() }
@@ -458,7 +650,7 @@ func file_proto_session_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_session_proto_rawDesc), len(file_proto_session_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   7,
+			NumMessages:   9,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -22,6 +22,7 @@ const (
 	SessionManager_SubmitSession_FullMethodName   = "/session.SessionManager/SubmitSession"
 	SessionManager_MonitorSessions_FullMethodName = "/session.SessionManager/MonitorSessions"
 	SessionManager_IpChange_FullMethodName        = "/session.SessionManager/IpChange"
+	SessionManager_Resync_FullMethodName          = "/session.SessionManager/Resync"
 )
 
 // SessionManagerClient is the client API for SessionManager service.
@@ -31,6 +32,7 @@ type SessionManagerClient interface {
 	SubmitSession(ctx context.Context, in *LoginEvent, opts ...grpc.CallOption) (*Ack, error)
 	MonitorSessions(ctx context.Context, in *Empty, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SessionList], error)
 	IpChange(ctx context.Context, in *IpChangeList, opts ...grpc.CallOption) (*Ack, error)
+	Resync(ctx context.Context, in *ServiceSnapshot, opts ...grpc.CallOption) (*Ack, error)
 }
 
 type sessionManagerClient struct {
@@ -80,6 +82,16 @@ func (c *sessionManagerClient) IpChange(ctx context.Context, in *IpChangeList, o
 	return out, nil
 }
 
+func (c *sessionManagerClient) Resync(ctx context.Context, in *ServiceSnapshot, opts ...grpc.CallOption) (*Ack, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, SessionManager_Resync_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SessionManagerServer is the server API for SessionManager service.
 // All implementations must embed UnimplementedSessionManagerServer
 // for forward compatibility.
@@ -87,6 +99,7 @@ type SessionManagerServer interface {
 	SubmitSession(context.Context, *LoginEvent) (*Ack, error)
 	MonitorSessions(*Empty, grpc.ServerStreamingServer[SessionList]) error
 	IpChange(context.Context, *IpChangeList) (*Ack, error)
+	Resync(context.Context, *ServiceSnapshot) (*Ack, error)
 	mustEmbedUnimplementedSessionManagerServer()
 }
 
@@ -106,6 +119,9 @@ func (UnimplementedSessionManagerServer) MonitorSessions(*Empty, grpc.ServerStre
 func (UnimplementedSessionManagerServer) IpChange(context.Context, *IpChangeList) (*Ack, error) {
 	return nil, status.Error(codes.Unimplemented, "method IpChange not implemented")
 }
+func (UnimplementedSessionManagerServer) Resync(context.Context, *ServiceSnapshot) (*Ack, error) {
+	return nil, status.Error(codes.Unimplemented, "method Resync not implemented")
+}
 func (UnimplementedSessionManagerServer) mustEmbedUnimplementedSessionManagerServer() {}
 func (UnimplementedSessionManagerServer) testEmbeddedByValue()                        {}
 
@@ -174,6 +190,24 @@ func _SessionManager_IpChange_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SessionManager_Resync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServiceSnapshot)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SessionManagerServer).Resync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SessionManager_Resync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SessionManagerServer).Resync(ctx, req.(*ServiceSnapshot))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // SessionManager_ServiceDesc is the grpc.ServiceDesc for SessionManager service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -189,6 +223,10 @@ var SessionManager_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "IpChange",
 			Handler:    _SessionManager_IpChange_Handler,
 		},
+		{
+			MethodName: "Resync",
+			Handler:    _SessionManager_Resync_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"Aegis/controller/internal/handler"
+	"Aegis/controller/internal/repository"
+	"database/sql"
+	"log"
+)
+
+// Build information, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...". The Makefile does this.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buildInfo describes this build and the schema version detected in db.
+func buildInfo(db *sql.DB) handler.BuildInfo {
+	schema, err := repository.DetectSchemaVersion(db)
+	if err != nil {
+		log.Printf("[WARN] Failed to detect the database schema version: %v", err)
+		schema = "unknown"
+	}
+	return handler.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, SchemaVersion: schema}
+}